@@ -0,0 +1,223 @@
+/* Adaptive audio coding for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "github.com/RobMeades/ioc-server/urtp"
+)
+
+// The coding advisor measures how well audio is getting through from
+// the client over windows of CODING_ADVICE_WINDOW: the proportion of
+// datagrams lost (sequence numbers that never turned up) and the
+// shortfall in throughput (audio received compared with the time that
+// has passed, which is how trouble shows up over TCP, where nothing is
+// lost but everything is late).  If either is bad while the client is
+// sending PCM_SIGNED_16_BIT it is advised to switch to
+// UNICAM_COMPRESSED_8_BIT and, once things have been good for a while,
+// it is advised to switch back.  The advice is a coding advice datagram:
+//
+//   - CODING_ADVICE_SYNC_BYTE,
+//   - one byte, the audio coding scheme that the client should use.
+//
+// The advice is repeated every window for as long as it holds.  A
+// client that doesn't support coding advice can ignore it.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of the coding advisor, protected by ingestLocker
+type CodingAdvisor struct {
+    windowStart       time.Time
+    lastDatagram      time.Time
+    started           bool
+    sequenceNumber    uint16
+    expected          int
+    received          int
+    bytes             int
+    audio             time.Duration
+    heartbeats        int
+    goodWindows       int
+    codingScheme      byte
+    advised           byte
+    lossPercent       float64
+    shortfallPercent  float64
+    kbitsPerSecond    float64
+    advisories        int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// Marker at the start of a coding advice datagram
+const CODING_ADVICE_SYNC_BYTE byte = 0xab
+
+// The period over which loss and throughput are measured
+const CODING_ADVICE_WINDOW time.Duration = time.Second * 5
+
+// Loss or throughput shortfall, in percent, above which a client
+// sending PCM is advised to switch to UNICAM
+const CODING_ADVICE_DOWNGRADE_PERCENT float64 = 5
+
+// Loss or throughput shortfall, in percent, below which a window
+// counts as good
+const CODING_ADVICE_UPGRADE_PERCENT float64 = 1
+
+// The number of good windows in a row before a client sending UNICAM
+// is advised to switch back to PCM
+const CODING_ADVICE_UPGRADE_WINDOWS int = 6
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The coding advisor, nil if not enabled
+var codingAdvisor *CodingAdvisor
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a coding advisor, registering its statistics
+func newCodingAdvisor() *CodingAdvisor {
+    advisor := new(CodingAdvisor)
+    advisor.advised = urtp.PCM_SIGNED_16_BIT
+    registerStats("coding_advice", advisor.Stats)
+    log.Printf("Clients will be advised to change audio coding scheme according to conditions.\n")
+
+    return advisor
+}
+
+// Return the audio coding scheme to advise, given the state of the
+// last window
+func (advisor *CodingAdvisor) decide(degradation float64) byte {
+    advice := advisor.codingScheme
+
+    if degradation < CODING_ADVICE_UPGRADE_PERCENT {
+        advisor.goodWindows++
+    } else {
+        advisor.goodWindows = 0
+    }
+    if (advisor.codingScheme == urtp.PCM_SIGNED_16_BIT) && (degradation > CODING_ADVICE_DOWNGRADE_PERCENT) {
+        advice = urtp.UNICAM_COMPRESSED_8_BIT
+    } else if (advisor.codingScheme == urtp.UNICAM_COMPRESSED_8_BIT) && (advisor.goodWindows >= CODING_ADVICE_UPGRADE_WINDOWS) {
+        advice = urtp.PCM_SIGNED_16_BIT
+    }
+
+    // Don't advise something the client has said it can't do
+    if (session.Hello != nil) && !session.Hello.supportsCodingScheme(int(advice)) {
+        advice = advisor.codingScheme
+    }
+
+    return advice
+}
+
+// Note a datagram from the client (audioCodingScheme is ignored for a
+// heartbeat), returning a coding advice datagram if the client should
+// change audio coding scheme; ingestLocker must be held
+func (advisor *CodingAdvisor) Received(now time.Time, audioCodingScheme byte, sequenceNumber uint16,
+                                       numBytes int, audioDuration time.Duration, heartbeat bool) []byte {
+    var adviceDatagram []byte
+
+    // Start again if the client has been away
+    if !advisor.started || (now.Sub(advisor.lastDatagram) > CODING_ADVICE_WINDOW) {
+        advisor.started = false
+        advisor.windowStart = now
+        advisor.expected = 0
+        advisor.received = 0
+        advisor.bytes = 0
+        advisor.audio = 0
+        advisor.heartbeats = 0
+    }
+    advisor.lastDatagram = now
+
+    if heartbeat {
+        advisor.heartbeats++
+    } else {
+        advisor.codingScheme = audioCodingScheme
+        if advisor.started {
+            distance := sequenceDistance(advisor.sequenceNumber, sequenceNumber)
+            if distance > 0 {
+                advisor.expected += distance
+                advisor.sequenceNumber = sequenceNumber
+            }
+        } else {
+            advisor.started = true
+            advisor.sequenceNumber = sequenceNumber
+            advisor.expected++
+        }
+        advisor.received++
+        advisor.bytes += numBytes
+        advisor.audio += audioDuration
+    }
+
+    window := now.Sub(advisor.windowStart)
+    if window >= CODING_ADVICE_WINDOW {
+        // A client that is sending heartbeats has nothing to say, which
+        // is not a sign of a bad link, so only judge full windows
+        if (advisor.heartbeats == 0) && (advisor.expected > 0) {
+            advisor.lossPercent = 0
+            if advisor.received < advisor.expected {
+                advisor.lossPercent = float64(advisor.expected - advisor.received) * 100 / float64(advisor.expected)
+            }
+            advisor.shortfallPercent = 0
+            if advisor.audio < window {
+                advisor.shortfallPercent = float64(window - advisor.audio) * 100 / float64(window)
+            }
+            advisor.kbitsPerSecond = float64(advisor.bytes) * 8 / 1000 / window.Seconds()
+            degradation := advisor.lossPercent
+            if advisor.shortfallPercent > degradation {
+                degradation = advisor.shortfallPercent
+            }
+            advice := advisor.decide(degradation)
+            if advice != advisor.codingScheme {
+                if advice != advisor.advised {
+                    log.Printf("Loss %.1f%%, throughput shortfall %.1f%% (%.1f kbits/s), advising client to switch from audio coding scheme %d to %d.\n",
+                               advisor.lossPercent, advisor.shortfallPercent, advisor.kbitsPerSecond, advisor.codingScheme, advice)
+                }
+                adviceDatagram = []byte{CODING_ADVICE_SYNC_BYTE, advice}
+                advisor.advisories++
+            }
+            advisor.advised = advice
+        }
+        advisor.windowStart = now
+        advisor.expected = 0
+        advisor.received = 0
+        advisor.bytes = 0
+        advisor.audio = 0
+        advisor.heartbeats = 0
+        advisor.started = false
+    }
+
+    return adviceDatagram
+}
+
+// Return the statistics of the coding advisor
+func (advisor *CodingAdvisor) Stats() interface{} {
+    ingestLocker.Lock()
+    defer ingestLocker.Unlock()
+
+    return map[string]interface{}{
+        "codingScheme": advisor.codingScheme,
+        "advisedCodingScheme": advisor.advised,
+        "lossPercent": advisor.lossPercent,
+        "shortfallPercent": advisor.shortfallPercent,
+        "kbitsPerSecond": advisor.kbitsPerSecond,
+        "advisories": advisor.advisories,
+    }
+}
+
+/* End Of File */
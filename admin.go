@@ -0,0 +1,722 @@
+/* Admin API for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/http/pprof"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// The admin API is served on its own port.  Every request must carry
+// a bearer token ("Authorization: Bearer <token>") and each endpoint
+// requires a permission which the token must include.  Tokens are
+// issued by the server for a role, the permissions of which are
+// written into the token and signed (HMAC-SHA256) with the admin
+// secret, so a token can't be edited to give it more permissions.
+// The admin secret itself may be used as a token with every
+// permission, which is how the first tokens are issued.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// What is in a token
+type AdminClaims struct {
+    Role         string    `json:"role"`
+    Permissions  []string  `json:"permissions"`
+    Expires      int64     `json:"expires"`
+}
+
+// A handler for an admin endpoint
+type AdminHandler func(out http.ResponseWriter, in *http.Request, claims *AdminClaims)
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The permissions
+const (
+    PERMISSION_VIEW = "view"
+    PERMISSION_OPERATE = "operate"
+    PERMISSION_CONFIGURE = "configure"
+    PERMISSION_MANAGE_DEVICES = "manage-devices"
+)
+
+// The longest a token may be issued for
+const ADMIN_TOKEN_MAX_LIFETIME time.Duration = time.Hour * 24 * 365
+
+// The log levels: everything is logged or nothing is
+const (
+    LOG_LEVEL_OFF = "off"
+    LOG_LEVEL_INFO = "info"
+)
+
+// The largest request body accepted by the admin API
+const ADMIN_MAX_BODY_SIZE int64 = 4096
+
+// The largest body accepted for downlink audio
+const ADMIN_MAX_DOWNLINK_BODY_SIZE int64 = int64(DOWNLINK_MAX_QUEUED_MILLISECONDS * SAMPLING_FREQUENCY / 1000 * URTP_SAMPLE_SIZE)
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The roles and the permissions they have
+var adminRoles = map[string][]string{
+    "viewer":   {PERMISSION_VIEW},
+    "operator": {PERMISSION_VIEW, PERMISSION_OPERATE},
+    "engineer": {PERMISSION_VIEW, PERMISSION_OPERATE, PERMISSION_CONFIGURE},
+    "admin":    {PERMISSION_VIEW, PERMISSION_OPERATE, PERMISSION_CONFIGURE, PERMISSION_MANAGE_DEVICES},
+}
+
+// The secret that tokens are signed with
+var adminSecret []byte
+
+// Cancels the context of the server, shutting it down cleanly as
+// SIGTERM would
+var requestShutdown context.CancelFunc
+
+// Where logging goes when it is on
+var logOutput io.Writer = os.Stderr
+
+// The current log level
+var logLevel string = LOG_LEVEL_INFO
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return true if the claims include a permission
+func (claims *AdminClaims) has(permission string) bool {
+    for _, item := range claims.Permissions {
+        if item == permission {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Sign a token payload
+func signAdminPayload(payload string) string {
+    mac := hmac.New(sha256.New, adminSecret)
+    mac.Write([]byte(payload))
+
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue a token for a role, lasting for the given time
+func issueAdminToken(role string, lifetime time.Duration) (string, *AdminClaims, error) {
+    var token string
+    var claims *AdminClaims
+    var err error
+
+    permissions, found := adminRoles[role]
+    if found && (lifetime > 0) && (lifetime <= ADMIN_TOKEN_MAX_LIFETIME) {
+        claims = &AdminClaims{Role: role, Permissions: permissions, Expires: time.Now().Add(lifetime).Unix()}
+        var payload []byte
+        payload, err = json.Marshal(claims)
+        if err == nil {
+            encoded := base64.RawURLEncoding.EncodeToString(payload)
+            token = encoded + "." + signAdminPayload(encoded)
+        }
+    } else if !found {
+        err = errors.New(fmt.Sprintf("there is no role \"%s\"", role))
+    } else {
+        err = errors.New(fmt.Sprintf("a token must last for between 1 second and %d hours", ADMIN_TOKEN_MAX_LIFETIME / time.Hour))
+    }
+
+    return token, claims, err
+}
+
+// Check a token, returning its claims
+func checkAdminToken(token string) (*AdminClaims, error) {
+    var claims *AdminClaims
+    var err error
+
+    if hmac.Equal([]byte(token), adminSecret) {
+        claims = &AdminClaims{Role: "secret", Permissions: adminRoles["admin"]}
+    } else {
+        parts := strings.Split(token, ".")
+        if (len(parts) == 2) && hmac.Equal([]byte(parts[1]), []byte(signAdminPayload(parts[0]))) {
+            var payload []byte
+            payload, err = base64.RawURLEncoding.DecodeString(parts[0])
+            if err == nil {
+                claims = new(AdminClaims)
+                err = json.Unmarshal(payload, claims)
+                if (err == nil) && (time.Now().Unix() > claims.Expires) {
+                    err = errors.New("token has expired")
+                }
+            }
+        } else {
+            err = errors.New("token is not valid")
+        }
+    }
+
+    return claims, err
+}
+
+// Write a JSON response
+func writeAdminJson(out http.ResponseWriter, status int, value interface{}) {
+    out.Header().Set("Content-Type", "application/json")
+    stopCache(out)
+    out.WriteHeader(status)
+    json.NewEncoder(out).Encode(value)
+}
+
+// Write an error response
+func writeAdminError(out http.ResponseWriter, status int, message string) {
+    writeAdminJson(out, status, map[string]string{"error": message})
+}
+
+// Wrap an admin endpoint so that it requires a method and a permission
+func requirePermission(method string, permission string, handler AdminHandler) http.HandlerFunc {
+    return requirePermissionWithBody(method, permission, ADMIN_MAX_BODY_SIZE, handler)
+}
+
+// As requirePermission() but allowing a request body of up to maxBodySize
+func requirePermissionWithBody(method string, permission string, maxBodySize int64, handler AdminHandler) http.HandlerFunc {
+    return func(out http.ResponseWriter, in *http.Request) {
+        if in.Method != method {
+            out.Header().Set("Allow", method)
+            writeAdminError(out, http.StatusMethodNotAllowed, "use " + method)
+            return
+        }
+        token := strings.TrimPrefix(in.Header.Get("Authorization"), "Bearer ")
+        claims, err := checkAdminToken(token)
+        if err != nil {
+            log.Printf("Admin request for \"%s\" from %s refused (%s).\n", in.URL.Path, in.RemoteAddr, err.Error())
+            out.Header().Set("WWW-Authenticate", "Bearer")
+            writeAdminError(out, http.StatusUnauthorized, err.Error())
+            return
+        }
+        if !claims.has(permission) {
+            log.Printf("Admin request for \"%s\" from %s refused, role \"%s\" doesn't have \"%s\" permission.\n",
+                       in.URL.Path, in.RemoteAddr, claims.Role, permission)
+            writeAdminError(out, http.StatusForbidden, "\"" + permission + "\" permission is required")
+            return
+        }
+        log.Printf("Admin request for \"%s\" from %s, role \"%s\".\n", in.URL.Path, in.RemoteAddr, claims.Role)
+        in.Body = http.MaxBytesReader(out, in.Body, maxBodySize)
+        handler(out, in, claims)
+    }
+}
+
+// GET /admin/whoami: the role and permissions of the token used
+func adminWhoAmIHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    writeAdminJson(out, http.StatusOK, claims)
+}
+
+// GET /admin/status: the state of the stream
+func adminStatusHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    ingestLocker.Lock()
+    currentSession := session
+    ingestLocker.Unlock()
+    pcmBuffered, outputBuffered := bufferDepths()
+    writeAdminJson(out, http.StatusOK, map[string]interface{}{
+        "version": SERVER_VERSION,
+        "sessionStarted": currentSession.Started,
+        "lastDatagram": currentSession.LastDatagram,
+        "capabilitiesAcknowledged": currentSession.Acknowledged,
+        "pcmBufferedMs": int64(pcmBuffered / time.Millisecond),
+        "outputBufferedMs": int64(outputBuffered / time.Millisecond),
+        "datagramsDropped": atomic.LoadUint64(&mainPipeline.datagramsDropped),
+        "controlDropped": atomic.LoadUint64(&mainPipeline.controlDropped),
+    })
+}
+
+// GET /admin/stats: the statistics kept by the server
+func adminStatsHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    writeAdminJson(out, http.StatusOK, statsSnapshot())
+}
+
+// GET /admin/listeners: the listeners to the streams, the most recent
+// to join first
+func adminListenersHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    if listenerTracker == nil {
+        writeAdminError(out, http.StatusNotFound, "listeners aren't tracked (see --listenerwindow)")
+        return
+    }
+    writeAdminJson(out, http.StatusOK, listenerTracker.Listeners())
+}
+
+// GET /admin/segments: the segment files of the main stream, oldest
+// first, and whether each is in the playlist
+func adminSegmentsHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    var segments []map[string]interface{}
+
+    mainPipeline.playlistLocker.Lock()
+    inPlaylist := make(map[string]bool)
+    for _, line := range strings.Split(string(mainPipeline.playlist), "\n") {
+        if line = strings.TrimSpace(line); (line != "") && !strings.HasPrefix(line, "#") {
+            inPlaylist[line] = true
+        }
+    }
+    mainPipeline.playlistLocker.Unlock()
+    for _, extension := range segmentExtensions() {
+        for _, path := range segmentStore.Paths(mainPipeline.Dir, extension) {
+            data, written, err := segmentStore.Read(path)
+            if err == nil {
+                segments = append(segments, map[string]interface{}{"name": filepath.Base(path), "bytes": len(data),
+                                                                   "written": written,
+                                                                   "inPlaylist": inPlaylist[segmentStore.Uri(path)]})
+            }
+        }
+    }
+    sort.Slice(segments, func(x, y int) bool {
+        return segments[x]["written"].(time.Time).Before(segments[y]["written"].(time.Time))
+    })
+    writeAdminJson(out, http.StatusOK, segments)
+}
+
+// GET /admin/levels?seconds=<seconds>: the levels of the incoming audio
+// over the last so many seconds, all that are kept if not given
+func adminLevelsHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    seconds := LEVEL_HISTORY_SECONDS
+    if in.URL.Query().Get("seconds") != "" {
+        _, err := fmt.Sscan(in.URL.Query().Get("seconds"), &seconds)
+        if (err != nil) || (seconds <= 0) {
+            writeAdminError(out, http.StatusBadRequest, "seconds must be a positive number")
+            return
+        }
+    }
+    writeAdminJson(out, http.StatusOK, map[string]interface{}{
+        "blockDurationMs": BLOCK_DURATION_MS,
+        "levels": mainPipeline.levels.Get(seconds, time.Now()),
+    })
+}
+
+// GET /admin/journal?from=<RFC 3339>&to=<RFC 3339>&events=<names>&limit=<n>:
+// the entries of the journal between two times (either may be left
+// out), only of the comma-separated events if given, oldest first,
+// the most recent limit (JOURNAL_QUERY_LIMIT if not given)
+func adminJournalHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    var from, to time.Time
+    var err error
+
+    if journal == nil {
+        writeAdminError(out, http.StatusNotFound, "no journal (see --journal)")
+        return
+    }
+    query := in.URL.Query()
+    if query.Get("from") != "" {
+        from, err = time.Parse(time.RFC3339, query.Get("from"))
+        if err != nil {
+            writeAdminError(out, http.StatusBadRequest, "from must be an RFC 3339 time, e.g. 2024-06-01T14:30:00Z")
+            return
+        }
+    }
+    if query.Get("to") != "" {
+        to, err = time.Parse(time.RFC3339, query.Get("to"))
+        if err != nil {
+            writeAdminError(out, http.StatusBadRequest, "to must be an RFC 3339 time, e.g. 2024-06-01T14:35:00Z")
+            return
+        }
+    }
+    names := make(map[string]bool)
+    for _, name := range strings.Split(query.Get("events"), ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            names[name] = true
+        }
+    }
+    limit := JOURNAL_QUERY_LIMIT
+    if query.Get("limit") != "" {
+        _, err = fmt.Sscan(query.Get("limit"), &limit)
+        if (err != nil) || (limit <= 0) || (limit > JOURNAL_QUERY_LIMIT) {
+            writeAdminError(out, http.StatusBadRequest, fmt.Sprintf("limit must be from 1 to %d", JOURNAL_QUERY_LIMIT))
+            return
+        }
+    }
+    entries, truncated := journal.Query(from, to, names, limit)
+    writeAdminJson(out, http.StatusOK, map[string]interface{}{"entries": entries, "truncated": truncated})
+}
+
+// GET /admin/settings: the settings of the stream that may be changed
+// while it is running
+func adminSettingsHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    writeAdminJson(out, http.StatusOK, getStreamSettings().Json())
+}
+
+// POST /admin/settings: change the settings of the stream, the request
+// body being a JSON object with any of "bitrate", "scale", "segmentMs"
+// and "playlistSeconds"
+func adminChangeSettingsHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    var change StreamSettingsChange
+
+    err := json.NewDecoder(in.Body).Decode(&change)
+    if err == nil {
+        var settings StreamSettings
+        settings, err = changeStreamSettings(change)
+        if err == nil {
+            log.Printf("Stream settings changed by role \"%s\".\n", claims.Role)
+            writeAdminJson(out, http.StatusOK, settings.Json())
+        }
+    }
+    if err != nil {
+        writeAdminError(out, http.StatusBadRequest, err.Error())
+    }
+}
+
+// GET /admin/mixer: the inputs of the mixer and their gains
+func adminMixerHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    if mixer == nil {
+        writeAdminError(out, http.StatusNotFound, "not mixing (see --mix)")
+        return
+    }
+    writeAdminJson(out, http.StatusOK, mixer.Stats())
+}
+
+// POST /admin/mixer?input=<name>&gain=<dB>: set the gain of an input of
+// the mixer, which need not be connected
+func adminChangeMixerHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    var gainDb float64
+
+    if mixer == nil {
+        writeAdminError(out, http.StatusNotFound, "not mixing (see --mix)")
+        return
+    }
+    name := in.URL.Query().Get("input")
+    _, err := fmt.Sscan(in.URL.Query().Get("gain"), &gainDb)
+    if err == nil {
+        if name == "" {
+            err = errors.New("an input is required")
+        } else {
+            err = mixer.SetGain(name, gainDb)
+        }
+    }
+    if err == nil {
+        log.Printf("Mixer gain of %s changed by role \"%s\".\n", name, claims.Role)
+        writeAdminJson(out, http.StatusOK, mixer.Stats())
+    } else {
+        writeAdminError(out, http.StatusBadRequest, err.Error())
+    }
+}
+
+// POST /admin/marker?label=<label>: mark the current point in the stream
+func adminMarkerHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    label := in.URL.Query().Get("label")
+    if label != "" {
+        marker := new(Marker)
+        marker.label = label
+        marker.timestamp = time.Now()
+        mainPipeline.media <- marker
+        writeAdminJson(out, http.StatusOK, map[string]string{"marker": label})
+    } else {
+        writeAdminError(out, http.StatusBadRequest, "a label is required")
+    }
+}
+
+// POST /admin/export?from=<RFC 3339>&to=<RFC 3339>&destination=<path>&prune=<true|false>:
+// start an export of the archive files last modified from from up to
+// to, to a directory or rsync target, pruning the local copies once
+// verified if prune is true
+func adminExportHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    if archiveRecorder == nil {
+        writeAdminError(out, http.StatusNotFound, "no archive (see --archive)")
+        return
+    }
+    query := in.URL.Query()
+    job := &ExportJob{ArchiveDir: archiveRecorder.Dir, Destination: query.Get("destination"), Prune: query.Get("prune") == "true"}
+    var err error
+    job.From, err = time.Parse(time.RFC3339, query.Get("from"))
+    if err == nil {
+        job.To, err = time.Parse(time.RFC3339, query.Get("to"))
+    }
+    if err != nil {
+        writeAdminError(out, http.StatusBadRequest, "from and to must be RFC 3339 times, e.g. 2024-06-01T00:00:00Z")
+        return
+    }
+    err = startExport(job)
+    if err != nil {
+        status := http.StatusBadRequest
+        if isExportRunning() {
+            status = http.StatusConflict
+        }
+        writeAdminError(out, status, err.Error())
+        return
+    }
+    log.Printf("Export to \"%s\" started by role \"%s\".\n", job.Destination, claims.Role)
+    writeAdminJson(out, http.StatusAccepted, map[string]interface{}{"from": job.From, "to": job.To,
+                                                                   "destination": job.Destination, "prune": job.Prune})
+}
+
+// GET /admin/exports: whether an export is running and the records of
+// the exports so far, oldest first
+func adminExportsHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    if archiveRecorder == nil {
+        writeAdminError(out, http.StatusNotFound, "no archive (see --archive)")
+        return
+    }
+    records, err := exportRecords(archiveRecorder.Dir)
+    if err != nil {
+        writeAdminError(out, http.StatusInternalServerError, err.Error())
+        return
+    }
+    writeAdminJson(out, http.StatusOK, map[string]interface{}{"running": isExportRunning(), "exports": records})
+}
+
+// POST /admin/reset: reset the main stream, as happens when nothing
+// has arrived from the client for the out of service time
+func adminResetHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    atomic.AddInt32(&mainPipeline.resetsPending, 1)
+    log.Printf("Reset of the stream requested by role \"%s\".\n", claims.Role)
+    writeAdminJson(out, http.StatusOK, map[string]bool{"reset": true})
+}
+
+// GET /admin/loglevel: the log level
+func adminLogLevelHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    writeAdminJson(out, http.StatusOK, map[string]string{"level": logLevel})
+}
+
+// POST /admin/loglevel?level=<level>: change the log level
+func adminChangeLogLevelHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    switch level := in.URL.Query().Get("level"); level {
+        case LOG_LEVEL_OFF:
+            log.Printf("Logging turned off by role \"%s\".\n", claims.Role)
+            log.SetOutput(io.Discard)
+            logLevel = level
+        case LOG_LEVEL_INFO:
+            log.SetOutput(logOutput)
+            logLevel = level
+            log.Printf("Logging turned on by role \"%s\".\n", claims.Role)
+        default:
+            writeAdminError(out, http.StatusBadRequest, fmt.Sprintf("level must be \"%s\" or \"%s\"", LOG_LEVEL_OFF, LOG_LEVEL_INFO))
+            return
+    }
+    writeAdminJson(out, http.StatusOK, map[string]string{"level": logLevel})
+}
+
+// POST /admin/shutdown: shut the server down cleanly, as SIGTERM
+// would, the final playlist being written
+func adminShutdownHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    log.Printf("Shutdown requested by role \"%s\".\n", claims.Role)
+    writeAdminJson(out, http.StatusOK, map[string]bool{"shuttingDown": true})
+    if requestShutdown != nil {
+        requestShutdown()
+    }
+}
+
+// POST /admin/control: send the request body to the client as the
+// payload of a control datagram
+func adminControlHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    payload, err := io.ReadAll(in.Body)
+    if err == nil {
+        err = queueControlDatagram(payload)
+    }
+    if err == nil {
+        writeAdminJson(out, http.StatusOK, map[string]int{"queued": len(payload)})
+    } else {
+        writeAdminError(out, http.StatusBadRequest, err.Error())
+    }
+}
+
+// POST /admin/downlink: send the request body, little-endian 16-bit
+// PCM at the incoming sampling frequency, to the client as audio
+func adminDownlinkHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    pcm, err := io.ReadAll(in.Body)
+    if err == nil {
+        err = queueDownlinkAudio(pcm)
+    }
+    if err == nil {
+        writeAdminJson(out, http.StatusOK, map[string]int{"queuedMs": len(pcm) / URTP_SAMPLE_SIZE * 1000 / SAMPLING_FREQUENCY})
+    } else {
+        writeAdminError(out, http.StatusBadRequest, err.Error())
+    }
+}
+
+// POST /admin/tokens?role=<role>&hours=<hours>: issue a token; only a
+// token with every permission may issue tokens
+func adminTokensHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    for _, permission := range adminRoles["admin"] {
+        if !claims.has(permission) {
+            writeAdminError(out, http.StatusForbidden, "only the admin role may issue tokens")
+            return
+        }
+    }
+    var hours float64
+    _, err := fmt.Sscan(in.URL.Query().Get("hours"), &hours)
+    if err == nil {
+        var token string
+        var issued *AdminClaims
+        token, issued, err = issueAdminToken(in.URL.Query().Get("role"), time.Duration(hours * float64(time.Hour)))
+        if err == nil {
+            log.Printf("Admin token issued for role \"%s\", expiring %s.\n", issued.Role, time.Unix(issued.Expires, 0).String())
+            writeAdminJson(out, http.StatusOK, map[string]interface{}{"token": token, "claims": issued})
+        }
+    }
+    if err != nil {
+        writeAdminError(out, http.StatusBadRequest, err.Error())
+    }
+}
+
+// POST /admin/signurl?path=<path>&hours=<hours>[&stream=<name>]: issue
+// a signed URL for the stream at path (e.g. /stream/main/playlist.m3u8),
+// lasting for the given time (see --urlsecret), signed with the secret
+// of the named stream if it has one of its own (see --streamsecret)
+func adminSignUrlHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    var hours float64
+    path := in.URL.Query().Get("path")
+    secret := urlSecret
+    _, err := fmt.Sscan(in.URL.Query().Get("hours"), &hours)
+    if (err == nil) && !strings.HasPrefix(path, "/") {
+        err = errors.New("path must start with /")
+    }
+    if name := in.URL.Query().Get("stream"); (err == nil) && (name != "") {
+        if findPipeline(name) == nil {
+            err = errors.New(fmt.Sprintf("there is no stream \"%s\"", name))
+        } else if !strings.HasPrefix(path, STREAM_PATH_PREFIX + name + "/") {
+            err = errors.New(fmt.Sprintf("path must start with %s%s/", STREAM_PATH_PREFIX, name))
+        }
+        secret = streamUrlSecret(name)
+    }
+    if err == nil {
+        var query string
+        var expires time.Time
+        query, expires, err = signUrlQuery(secret, time.Duration(hours * float64(time.Hour)))
+        if err == nil {
+            log.Printf("Signed URL issued for \"%s\", expiring %s.\n", path, expires.String())
+            writeAdminJson(out, http.StatusOK, map[string]interface{}{"url": signUri(path, query), "expires": expires.Unix()})
+        }
+    }
+    if err != nil {
+        writeAdminError(out, http.StatusBadRequest, err.Error())
+    }
+}
+
+// GET /admin/debug/pprof/...: the Go profiles of the server (see
+// net/http/pprof), e.g. /admin/debug/pprof/profile?seconds=30 for 30
+// seconds of CPU profile or /admin/debug/pprof/heap for allocations
+func adminPprofHandler(out http.ResponseWriter, in *http.Request, claims *AdminClaims) {
+    switch strings.TrimPrefix(in.URL.Path, "/admin") {
+        case "/debug/pprof/cmdline":
+            pprof.Cmdline(out, in)
+        case "/debug/pprof/profile":
+            pprof.Profile(out, in)
+        case "/debug/pprof/symbol":
+            pprof.Symbol(out, in)
+        case "/debug/pprof/trace":
+            pprof.Trace(out, in)
+        default:
+            // pprof.Index() finds the profile from the path after
+            // /debug/pprof/
+            in.URL.Path = strings.TrimPrefix(in.URL.Path, "/admin")
+            pprof.Index(out, in)
+    }
+}
+
+// Run the admin API on the given port until ctx is done; the admin
+// secret is read from secretFileName and, if withPprof is true, the
+// Go profiles of the server are served too
+func operateAdmin(ctx context.Context, bindAddresses []string, port string, secretFileName string, withPprof bool) error {
+    secret, err := os.ReadFile(secretFileName)
+    if err != nil {
+        return err
+    }
+    adminSecret = []byte(strings.TrimSpace(string(secret)))
+    if len(adminSecret) < 16 {
+        return errors.New(fmt.Sprintf("the admin secret in \"%s\" must be at least 16 characters long", secretFileName))
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/admin/whoami", requirePermission(http.MethodGet, PERMISSION_VIEW, adminWhoAmIHandler))
+    mux.HandleFunc("/admin/status", requirePermission(http.MethodGet, PERMISSION_VIEW, adminStatusHandler))
+    mux.HandleFunc("/admin/stats", requirePermission(http.MethodGet, PERMISSION_VIEW, adminStatsHandler))
+    mux.HandleFunc("/admin/listeners", requirePermission(http.MethodGet, PERMISSION_VIEW, adminListenersHandler))
+    mux.HandleFunc("/admin/levels", requirePermission(http.MethodGet, PERMISSION_VIEW, adminLevelsHandler))
+    mux.HandleFunc("/admin/segments", requirePermission(http.MethodGet, PERMISSION_VIEW, adminSegmentsHandler))
+    mux.HandleFunc("/admin/export", requirePermission(http.MethodPost, PERMISSION_CONFIGURE, adminExportHandler))
+    mux.HandleFunc("/admin/exports", requirePermission(http.MethodGet, PERMISSION_VIEW, adminExportsHandler))
+    mux.HandleFunc("/admin/journal", requirePermission(http.MethodGet, PERMISSION_VIEW, adminJournalHandler))
+    getLogLevel := requirePermission(http.MethodGet, PERMISSION_VIEW, adminLogLevelHandler)
+    changeLogLevel := requirePermission(http.MethodPost, PERMISSION_CONFIGURE, adminChangeLogLevelHandler)
+    mux.HandleFunc("/admin/loglevel", func(out http.ResponseWriter, in *http.Request) {
+        if in.Method == http.MethodGet {
+            getLogLevel(out, in)
+        } else {
+            changeLogLevel(out, in)
+        }
+    })
+    getSettings := requirePermission(http.MethodGet, PERMISSION_VIEW, adminSettingsHandler)
+    changeSettings := requirePermission(http.MethodPost, PERMISSION_CONFIGURE, adminChangeSettingsHandler)
+    mux.HandleFunc("/admin/settings", func(out http.ResponseWriter, in *http.Request) {
+        if in.Method == http.MethodGet {
+            getSettings(out, in)
+        } else {
+            changeSettings(out, in)
+        }
+    })
+    getMixer := requirePermission(http.MethodGet, PERMISSION_VIEW, adminMixerHandler)
+    changeMixer := requirePermission(http.MethodPost, PERMISSION_OPERATE, adminChangeMixerHandler)
+    mux.HandleFunc("/admin/mixer", func(out http.ResponseWriter, in *http.Request) {
+        if in.Method == http.MethodGet {
+            getMixer(out, in)
+        } else {
+            changeMixer(out, in)
+        }
+    })
+    mux.HandleFunc("/admin/marker", requirePermission(http.MethodPost, PERMISSION_OPERATE, adminMarkerHandler))
+    mux.HandleFunc("/admin/reset", requirePermission(http.MethodPost, PERMISSION_OPERATE, adminResetHandler))
+    mux.HandleFunc("/admin/shutdown", requirePermission(http.MethodPost, PERMISSION_MANAGE_DEVICES, adminShutdownHandler))
+    mux.HandleFunc("/admin/control", requirePermission(http.MethodPost, PERMISSION_MANAGE_DEVICES, adminControlHandler))
+    mux.HandleFunc("/admin/downlink", requirePermissionWithBody(http.MethodPost, PERMISSION_MANAGE_DEVICES,
+                                                                 ADMIN_MAX_DOWNLINK_BODY_SIZE, adminDownlinkHandler))
+    mux.HandleFunc("/admin/tokens", requirePermission(http.MethodPost, PERMISSION_MANAGE_DEVICES, adminTokensHandler))
+    if withPprof {
+        mux.HandleFunc("/admin/debug/pprof/", requirePermission(http.MethodGet, PERMISSION_CONFIGURE, adminPprofHandler))
+        log.Printf("Go profiles will be served by the admin API at /admin/debug/pprof/.\n")
+    }
+    mux.HandleFunc("/admin/signurl", requirePermission(http.MethodPost, PERMISSION_OPERATE, adminSignUrlHandler))
+    server := &http.Server{Handler: mux}
+
+    for _, bindAddress := range bindAddressesOrAll(bindAddresses) {
+        network, address := listenNetworkAndAddress("tcp", bindAddress, port)
+        listener, err1 := net.Listen(network, address)
+        if err1 != nil {
+            return err1
+        }
+        fmt.Printf("Admin API listening on %s (%s).\n", listener.Addr().String(), network)
+        go func(listener net.Listener) {
+            err1 := server.Serve(listener)
+            if !errors.Is(err1, http.ErrServerClosed) {
+                fmt.Fprintf(os.Stderr, "Admin API stopped (%s).\n", err1.Error())
+            }
+        }(listener)
+    }
+
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+        server.Shutdown(shutdownCtx)
+        cancel()
+    }()
+
+    return nil
+}
+
+/* End Of File */
@@ -0,0 +1,116 @@
+/* Tests of the admin API of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "testing"
+)
+
+// The status served by the admin API is read while the processing
+// loop is writing to the buffers it reports on; run with -race to
+// check that it is read safely.
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Get the status while audio is going into and out of the PCM buffer
+// and datagrams are being dropped
+func TestAdminStatusWhileProcessing(t *testing.T) {
+    var wait sync.WaitGroup
+
+    savedPipeline := mainPipeline
+    defer func() {
+        mainPipeline = savedPipeline
+    }()
+    mainPipeline = newPipeline("test", filepath.Join(t.TempDir(), "test" + PLAYLIST_EXTENSION), DEFAULT_CODEC,
+                               PipelineSettings{PcmBufferSeconds: 1, MaxGapFillMs: 500, LowWaterMs: 1000},
+                               newStreamQuota("test", 0, 0, 0))
+    t.Cleanup(func() {
+        removePipeline("test")
+    })
+    pipeline := mainPipeline
+    stop := make(chan bool)
+    running := make(chan bool)
+
+    // Do what the processing loop does to the PCM buffer
+    wait.Add(1)
+    go func() {
+        defer wait.Done()
+        block := make([]int16, SAMPLES_PER_BLOCK)
+        buffer := make([]byte, SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE / 2)
+        for x := 0; ; x++ {
+            if x == 1 {
+                close(running)
+            }
+            select {
+                case <-stop:
+                    return
+                default:
+                    pipeline.processAudio(block)
+                    pipeline.pcm.Read(buffer)
+                    atomic.StoreInt64(&pipeline.pcmBufferedNs, int64(pcmDuration(pipeline.pcm.Len())))
+            }
+        }
+    }()
+
+    // And queue datagrams that nothing takes, so that they are dropped
+    wait.Add(1)
+    go func() {
+        defer wait.Done()
+        for {
+            select {
+                case <-stop:
+                    return
+                default:
+                    pipeline.Queue(getUrtpDatagram())
+            }
+        }
+    }()
+    <-running
+
+    for x := 0; x < 100; x++ {
+        var status map[string]interface{}
+
+        out := httptest.NewRecorder()
+        adminStatusHandler(out, httptest.NewRequest(http.MethodGet, "/admin/status", nil), nil)
+        if out.Code != http.StatusOK {
+            t.Fatalf("expected status %d, got %d.", http.StatusOK, out.Code)
+        }
+        err := json.Unmarshal(out.Body.Bytes(), &status)
+        if err != nil {
+            t.Fatalf("unable to decode the status (%s).", err.Error())
+        }
+        for _, key := range []string{"pcmBufferedMs", "outputBufferedMs", "datagramsDropped"} {
+            if _, ok := status[key]; !ok {
+                t.Fatalf("expected \"%s\" in the status %v.", key, status)
+            }
+        }
+        if status["pcmBufferedMs"].(float64) < 0 {
+            t.Fatalf("expected a PCM buffer depth of zero or more, got %v.", status["pcmBufferedMs"])
+        }
+    }
+    close(stop)
+    wait.Wait()
+    if atomic.LoadUint64(&pipeline.datagramsDropped) == 0 {
+        t.Errorf("expected datagrams to have been dropped.")
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,129 @@
+/* Automatic gain control for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "math"
+    "sync"
+)
+
+// The automatic gain control (AGC) is applied to the decoded audio of
+// every datagram, whatever its audio coding scheme, after any DSP
+// chain and before it goes into the PCM buffer.  It follows the
+// envelope of the audio, rising at the attack rate and falling at the
+// release rate, and applies the gain that would bring the envelope to
+// the target level, up to a maximum gain, so that a quiet recording is
+// brought up and a sudden whistle blast is brought down within the
+// attack time.  The channels of a stereo stream share the envelope,
+// and so the gain, which keeps the balance between them.  The target
+// is the level of the PCM, before the gain applied by the encoder (see
+// --scale), so the default target leaves room for the default gain of
+// the encoder.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of an AGC
+type Agc struct {
+    TargetDbfs    float64
+    MaxGainDb     float64
+    target        float64
+    maxGain       float64
+    // Per-sample smoothing coefficients
+    attack        float64
+    release       float64
+    envelope      float64
+    gain          float64
+    locker        sync.Mutex
+}
+
+// Statistics of an AGC
+type AgcStats struct {
+    GainDb        float64  `json:"gainDb"`
+    EnvelopeDbfs  float64  `json:"envelopeDbfs"`
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the per-sample coefficient of a smoothing filter that gets
+// most of the way to a new value in the given number of milliseconds,
+// the samples of each channel of the stream taking turns
+func smoothingCoefficient(milliseconds uint) float64 {
+    if milliseconds == 0 {
+        return 1
+    }
+
+    return 1 - math.Exp(-1000 / (float64(milliseconds) * float64(streamSamplingFrequency * streamChannels)))
+}
+
+// Convert decibels to a linear gain
+func dbToGain(db float64) float64 {
+    return math.Pow(10, db / 20)
+}
+
+// Create an AGC bringing the envelope of the audio to targetDbfs with
+// a gain of no more than maxGainDb, the envelope rising over
+// attackMilliseconds and falling over releaseMilliseconds
+func newAgc(targetDbfs float64, maxGainDb float64, attackMilliseconds uint, releaseMilliseconds uint) *Agc {
+    agc := &Agc{TargetDbfs: targetDbfs, MaxGainDb: maxGainDb,
+                target: dbToGain(targetDbfs) * 32768, maxGain: dbToGain(maxGainDb),
+                attack: smoothingCoefficient(attackMilliseconds), release: smoothingCoefficient(releaseMilliseconds),
+                gain: 1}
+    // Start from the target, so that nothing is boosted until there
+    // is some audio
+    agc.envelope = agc.target
+    log.Printf("AGC enabled: target %.1f dBFS, maximum gain %.1f dB, attack %d ms, release %d ms.\n",
+               targetDbfs, maxGainDb, attackMilliseconds, releaseMilliseconds)
+
+    return agc
+}
+
+// Apply the AGC to a block of audio in place
+func (agc *Agc) Process(audio []int16) {
+    agc.locker.Lock()
+    defer agc.locker.Unlock()
+
+    for x, sample := range audio {
+        level := math.Abs(float64(sample))
+        if level > agc.envelope {
+            agc.envelope += (level - agc.envelope) * agc.attack
+        } else {
+            agc.envelope += (level - agc.envelope) * agc.release
+        }
+        agc.gain = agc.maxGain
+        if agc.envelope * agc.maxGain > agc.target {
+            agc.gain = agc.target / agc.envelope
+        }
+        value := float64(sample) * agc.gain
+        if value > 32767 {
+            value = 32767
+        } else if value < -32768 {
+            value = -32768
+        }
+        audio[x] = int16(value)
+    }
+}
+
+// Return the statistics of the AGC
+func (agc *Agc) Stats() interface{} {
+    agc.locker.Lock()
+    defer agc.locker.Unlock()
+
+    return AgcStats{GainDb: 20 * math.Log10(agc.gain), EnvelopeDbfs: dbfs(agc.envelope)}
+}
+
+/* End Of File */
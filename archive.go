@@ -0,0 +1,218 @@
+/* Continuous archive recording for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Segment files only last as long as the playlist, so an archive
+// recorder takes the same PCM as the main encoder and encodes it, with
+// an encoder of its own, into files that each cover an hour of the
+// clock, named after the time at which they start, in a directory of
+// their own.  The encoded audio goes to file as it is produced, rather
+// than being held in memory for the hour.  Each time a new file is
+// started the oldest files are deleted until what is left is within
+// the retention limits.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of an archive recorder
+type ArchiveRecorder struct {
+    Dir          string
+    Codec        string
+    MaxAge       time.Duration
+    MaxBytes     int64
+    encoder      Encoder
+    extension    string
+    audio        bytes.Buffer
+    handle       *os.File
+    period       time.Time
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How much of the clock each archive file covers
+const ARCHIVE_FILE_PERIOD time.Duration = time.Hour
+
+// The format of the name of an archive file, the UTC time at which it
+// starts, which sorts in time order
+const ARCHIVE_FILE_NAME_FORMAT string = "2006-01-02T15-04-05Z"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The archive recorder, nil if there isn't one
+var archiveRecorder *ArchiveRecorder
+
+// The extensions of archive files where they differ from those of
+// segment files: MP3 segments are named for HLS but an archive file is
+// plain MP3
+var archiveExtensions = map[string]string{DEFAULT_CODEC: ".mp3"}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create an archive recorder writing files encoded with codec to
+// dirName, keeping them for up to maxAgeHours and maxMegabytes in
+// total (0 for no limit)
+func newArchiveRecorder(dirName string, codec string, maxAgeHours uint, maxMegabytes uint) (*ArchiveRecorder, error) {
+    var err error
+
+    archive := &ArchiveRecorder{Dir: dirName, Codec: codec,
+                                MaxAge: time.Duration(maxAgeHours) * time.Hour,
+                                MaxBytes: int64(maxMegabytes) * 1024 * 1024}
+    err = os.MkdirAll(dirName, os.ModePerm)
+    if err != nil {
+        return nil, err
+    }
+    archive.encoder, err = newEncoder(codec, &archive.audio, new(Mp3Settings))
+    if err != nil {
+        return nil, err
+    }
+    archive.extension = archiveExtensions[codec]
+    if archive.extension == "" {
+        archive.extension = archive.encoder.Extension()
+    }
+    log.Printf("Archive recorder writing %s to \"%s\" (maximum age %d hour(s), maximum size %d megabyte(s), 0 for no limit).\n",
+               codec, dirName, maxAgeHours, maxMegabytes)
+
+    return archive, nil
+}
+
+// Write what has been encoded to the current file
+func (archive *ArchiveRecorder) drain() {
+    if archive.handle != nil {
+        _, err := archive.audio.WriteTo(archive.handle)
+        if err != nil {
+            log.Printf("Unable to write to archive file \"%s\" (%s), closing it.\n", archive.handle.Name(), err.Error())
+            archive.handle.Close()
+            archive.handle = nil
+        }
+    }
+    archive.audio.Reset()
+}
+
+// Finish the current file, if there is one
+func (archive *ArchiveRecorder) closeFile() {
+    if segmentEncoder, ok := archive.encoder.(SegmentEncoder); ok {
+        segmentEncoder.EndSegment()
+    }
+    archive.drain()
+    if archive.handle != nil {
+        archive.handle.Close()
+        log.Printf("Closed archive file \"%s\".\n", archive.handle.Name())
+        archive.handle = nil
+    }
+}
+
+// Start a new file for the period that now is in
+func (archive *ArchiveRecorder) openFile(now time.Time) {
+    var err error
+
+    archive.period = now.Truncate(ARCHIVE_FILE_PERIOD)
+    fileName := filepath.Join(archive.Dir, now.UTC().Format(ARCHIVE_FILE_NAME_FORMAT) + archive.extension)
+    archive.handle, err = os.Create(fileName)
+    if err == nil {
+        log.Printf("Opened archive file \"%s\".\n", fileName)
+    } else {
+        log.Printf("Unable to create archive file \"%s\" (%s).\n", fileName, err.Error())
+        archive.handle = nil
+    }
+    // Anything the encoder wrote when it was created (e.g. the headers
+    // of its first segment) had no file to go to, so start afresh
+    archive.audio.Reset()
+    if segmentEncoder, ok := archive.encoder.(SegmentEncoder); ok {
+        segmentEncoder.StartSegment()
+    }
+    archive.applyRetention(now)
+}
+
+// Delete the oldest archive files until those left are within the
+// retention limits; the current file is never deleted
+func (archive *ArchiveRecorder) applyRetention(now time.Time) {
+    var total int64
+
+    if (archive.MaxAge == 0) && (archive.MaxBytes == 0) {
+        return
+    }
+    files, err := ioutil.ReadDir(archive.Dir)
+    if err != nil {
+        log.Printf("Unable to read archive directory \"%s\" (%s).\n", archive.Dir, err.Error())
+        return
+    }
+    // Newest first, the names sorting in time order
+    sort.Slice(files, func(x, y int) bool {
+        return files[x].Name() > files[y].Name()
+    })
+    for _, file := range files {
+        if file.IsDir() || !strings.HasSuffix(file.Name(), archive.extension) {
+            continue
+        }
+        filePath := filepath.Join(archive.Dir, file.Name())
+        total += file.Size()
+        if (archive.handle != nil) && (filePath == archive.handle.Name()) {
+            continue
+        }
+        if ((archive.MaxAge > 0) && (now.Sub(file.ModTime()) > archive.MaxAge)) ||
+           ((archive.MaxBytes > 0) && (total > archive.MaxBytes)) {
+            err = os.Remove(filePath)
+            if err == nil {
+                log.Printf("Deleted archive file \"%s\".\n", filePath)
+                total -= file.Size()
+            } else {
+                log.Printf("Unable to delete archive file \"%s\" (%s).\n", filePath, err.Error())
+            }
+        }
+    }
+}
+
+// Encode some little-endian 16-bit PCM into the archive, starting a
+// new file if a new period has begun
+func (archive *ArchiveRecorder) Write(pcm []byte) {
+    now := time.Now()
+    if !now.Truncate(ARCHIVE_FILE_PERIOD).Equal(archive.period) {
+        archive.closeFile()
+        archive.openFile(now)
+    }
+    _, err := archive.encoder.WriteSamples(pcm)
+    if err != nil {
+        log.Printf("Unable to encode archive audio (%s).\n", err.Error())
+    }
+    archive.drain()
+}
+
+// Flush the encoder into the current file and close it; the archive
+// recorder may not be used again
+func (archive *ArchiveRecorder) Close() error {
+    err := archive.encoder.Flush()
+    archive.closeFile()
+    archive.encoder.Close()
+
+    return err
+}
+
+/* End Of File */
@@ -13,12 +13,21 @@
 package main
 
 import (
+    "context"
+    "errors"
     "fmt"
+    "io"
     "net"
     "os"
     "log"
     "bytes"
+    "compress/zlib"
+    "sync"
+    "sync/atomic"
     "time"
+    "github.com/klauspost/compress/zstd"
+    "gopkg.in/hraban/opus.v2"
+    "github.com/RobMeades/ioc-server/urtp"
 //    "encoding/hex"
 )
 
@@ -31,15 +40,43 @@ type UrtpDatagram struct {
     SequenceNumber  uint16
     Timestamp       uint64
     Audio           *[]int16
+    // The sampling frequency of Audio
+    SamplingFrequency int
+    // The number of channels in Audio, which are interleaved
+    Channels        int
+    // The client it came from, see Decoders
+    Source          string
+    Received        time.Time
+    // The highest UNICAM shift value, -1 if not UNICAM
+    UnicamPeakShift int
 }
 
-// Where we are in reassembling a URTP packet (required for TCP reception)
-type TcpReassemblyData struct {
-    State         int
-    ByteCount     int
-    PayloadSize   int
-    Header        bytes.Buffer
-    Datagram      bytes.Buffer
+// A UDP packet received by one of the UDP readers
+type UdpPacket struct {
+    Data     []byte
+    Address  *net.UDPAddr
+    Server   *net.UDPConn
+}
+
+// The urtp.Handler of the server, for one stream
+type ServerUrtpHandler struct {
+    decoders  *Decoders
+}
+
+// Decoder for UNICAM data, which keeps its own DSP chain (by default
+// the deemphasis filter required for unicam and the notch filter to
+// remove squeal from the Hologram Nova modem)
+type UnicamDecoder struct {
+    sampleSizeBits  int
+    signExtend      []int16
+    dsp             *DspChain
+    peakShift       byte
+    block           [SAMPLES_PER_UNICAM_BLOCK]float32
+}
+
+// Decoder for OPUS_COMPRESSED data
+type OpusDecoder struct {
+    decoder  *opus.Decoder
 }
 
 //--------------------------------------------------------------------
@@ -47,11 +84,20 @@ type TcpReassemblyData struct {
 //--------------------------------------------------------------------
 
 // The duration of a block of incoming audio in ms
-const BLOCK_DURATION_MS int = 20
+const BLOCK_DURATION_MS int = urtp.BLOCK_DURATION_MS
 
-// The sampling frequency of the incoming audio
+// The sampling frequency of the incoming audio unless the client's
+// hello agrees another, and the default for the stream
 const SAMPLING_FREQUENCY int = 16000
 
+// The lowest and highest sampling frequencies that a client may send
+// at or the stream may have
+const MIN_SAMPLING_FREQUENCY int = 8000
+const MAX_SAMPLING_FREQUENCY int = urtp.MAX_SAMPLING_FREQUENCY
+
+// The most channels the stream may have
+const MAX_STREAM_CHANNELS int = 2
+
 // The number of samples per block
 const SAMPLES_PER_BLOCK int = SAMPLING_FREQUENCY * BLOCK_DURATION_MS / 1000
 
@@ -59,57 +105,133 @@ const SAMPLES_PER_BLOCK int = SAMPLING_FREQUENCY * BLOCK_DURATION_MS / 1000
 const SAMPLES_PER_UNICAM_BLOCK int = SAMPLING_FREQUENCY / 1000
 const UNICAM_CODED_SHIFT_SIZE_BITS int = 4
 
-// The URTP datagram parameters
-const SYNC_BYTE byte = 0x5a
-const URTP_TIMESTAMP_SIZE int = 8
-const URTP_SEQUENCE_NUMBER_SIZE int = 2
-const URTP_PAYLOAD_SIZE_SIZE int = 2
-const URTP_HEADER_SIZE int = 14
-const URTP_SAMPLE_SIZE int = 2
-const URTP_DATAGRAM_MAX_SIZE int = URTP_HEADER_SIZE + SAMPLES_PER_BLOCK * URTP_SAMPLE_SIZE
+// IMA ADPCM parameters: each datagram starts with the predictor (two
+// bytes, big-endian) and step index (one byte) to decode from, then a
+// reserved byte, so that a lost datagram doesn't upset the next one
+const IMA_ADPCM_HEADER_SIZE int = 4
+const IMA_ADPCM_MAX_STEP_INDEX int = 88
+
+// The longest Opus frame that can be decoded from one datagram
+const OPUS_MAX_FRAME_MS int = 120
 
-// Frequency at which to return timing datagrams
+// The size of a sample in the payload of a URTP datagram
+const URTP_SAMPLE_SIZE int = urtp.SAMPLE_SIZE
+
+// Frequency at which to return timing datagrams; a timing datagram
+// is the sync byte, sequence number and timestamp of the URTP datagram
+// that prompted it followed, for clients that have acknowledged
+// capabilities version CAPABILITIES_VERSION_EXTENDED_TIMING or later,
+// by the depth of the PCM buffer and then the depth of the HLS output
+// buffer, each two bytes (big-endian) in milliseconds and, for clients
+// that have acknowledged CAPABILITIES_VERSION_TIME_SYNC or later, by
+// the times for two-way time synchronisation (see timesync.go)
 const TIMING_DATAGRAM_PERIOD time.Duration = 1000 * time.Millisecond
 
-// Offset to the number of bytes part of the URTP header
-const URTP_NUM_BYTES_AUDIO_OFFSET int = 12
+// The largest buffer depth that can be reported in a timing datagram
+const TIMING_MAX_MILLISECONDS time.Duration = 0xFFFF * time.Millisecond
 
-// The overhead to add to the URTP datagram size to give a good IP buffer size for
-// one packet
-const IP_HEADER_OVERHEAD int = 40
+// Marker at the start of a NACK datagram sent back to the client; a NACK
+// datagram is this byte, a one byte count and then that many two-byte
+// (big-endian) sequence numbers that the client should retransmit over TCP
+const NACK_SYNC_BYTE byte = 0xa5
 
-// The audio coding schemes
-const (
-    PCM_SIGNED_16_BIT = 0
-    UNICAM_COMPRESSED_8_BIT = 1
-    MAX_NUM_AUDIO_CODING_SCHEMES = iota
-)
+// The maximum number of sequence numbers in a NACK datagram; a larger gap
+// is not worth asking for
+const NACK_MAX_SEQUENCE_NUMBERS int = SEQUENCE_RESYNC_THRESHOLD
+
+// Marker at the start of a control datagram sent back to the client; a
+// control datagram is this byte, a two-byte (big-endian) length and then
+// that many bytes of payload, the meaning of which is up to the client
+const CONTROL_SYNC_BYTE byte = 0xa6
+
+// The maximum size of the payload of a control datagram
+const CONTROL_MAX_PAYLOAD_SIZE int = 1024
 
-// URTP reassembly states (needed for TCP reception)
+// The maximum number of control datagrams that can be waiting to go
+const CONTROL_MAX_QUEUED int = 10
+
+// The number of received UDP packets that can be queued waiting to be
+// handled; beyond this packets are dropped rather than holding up the
+// readers
+const UDP_PACKET_QUEUE_SIZE int = 256
+
+// What to do when a TCP client connects while another is connected:
+// close the existing connection, reject the new one, or close the
+// existing connection only if the new one is from the same IP address;
+// when mixing (see mixer.go) every connection is kept
 const (
-    URTP_STATE_WAITING_SYNC = iota
-    URTP_STATE_WAITING_AUDIO_CODING = iota
-    URTP_STATE_WAITING_SEQUENCE_NUMBER = iota
-    URTP_STATE_WAITING_TIMESTAMP = iota
-    URTP_STATE_WAITING_PAYLOAD_SIZE = iota
-    URTP_STATE_WAITING_PAYLOAD = iota
+    TCP_POLICY_TAKEOVER = "takeover"
+    TCP_POLICY_REJECT = "reject"
+    TCP_POLICY_SAME_IP = "sameip"
+    TCP_POLICY_MIX = "mix"
 )
 
+// The TCP keepalive period used when idle connection detection is on
+const TCP_KEEPALIVE_PERIOD time.Duration = time.Second * 10
+
+// The overhead to add to the URTP datagram size to give a good IP buffer size for
+// one packet
+const IP_HEADER_OVERHEAD int = 40
+
 //--------------------------------------------------------------------
 // Variables
 //--------------------------------------------------------------------
 
-// A buffer for TCP data
-var tcpBuffer bytes.Buffer
+// The sampling frequency of the stream, which the incoming audio is
+// resampled to if it is at another
+var streamSamplingFrequency int = SAMPLING_FREQUENCY
+
+// The number of channels of the stream, which the incoming audio is
+// mixed up or down to if it has another number
+var streamChannels int = 1
 
 // The last time a timing datagram was sent
 var timingDatagramSent time.Time
 
-// Deemphasis filter required for unicam
-var deemphasis Fir
+// Whether NACK datagrams should be sent to the client
+var nackEnabled bool
+
+// Whether FEC shards are accepted from the client
+var fecEnabled bool
 
-// Notch filter to remove squeal from the Hologram Nova modem
-var desqueal DeSquealFir
+// The highest sequence number received so far, used for NACKs
+var ingestSequenceNumber uint16
+var ingestStarted bool
+
+// Control datagrams waiting to be sent to the client
+var controlDatagrams [][]byte
+
+// The number of URTP datagrams with a CRC that have been checked, that
+// have been dropped because the CRC was wrong and that have been
+// dropped because they couldn't be parsed
+var urtpCrcChecked int
+var urtpCrcErrors int
+var urtpParseErrors int
+
+// The number of FEC shards received, of URTP datagrams recovered from
+// them and of URTP datagrams that couldn't be recovered
+var fecShards int
+var fecRecovered int
+var fecLost int
+
+// Lock for the return datagram state above, which is shared
+// between the UDP and TCP servers
+var ingestLocker sync.Mutex
+
+// IMA ADPCM step index adjustments, indexed by code
+var imaAdpcmIndexTable = [...]int{-1, -1, -1, -1, 2, 4, 6, 8,
+                                  -1, -1, -1, -1, 2, 4, 6, 8}
+
+// IMA ADPCM step sizes, indexed by step index
+var imaAdpcmStepTable = [...]int{7, 8, 9, 10, 11, 12, 13, 14, 16, 17,
+                                 19, 21, 23, 25, 28, 31, 34, 37, 41, 45,
+                                 50, 55, 60, 66, 73, 80, 88, 97, 107, 118,
+                                 130, 143, 157, 173, 190, 209, 230, 253, 279, 307,
+                                 337, 371, 408, 449, 494, 544, 598, 658, 724, 796,
+                                 876, 963, 1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066,
+                                 2272, 2499, 2749, 3024, 3327, 3660, 4026, 4428, 4871, 5358,
+                                 5894, 6484, 7132, 7845, 8630, 9493, 10442, 11487, 12635, 13899,
+                                 15289, 16818, 18500, 20350, 22385, 24623, 27086, 29794, 32767}
 
 //--------------------------------------------------------------------
 // Functions
@@ -118,47 +240,128 @@ var desqueal DeSquealFir
 // Decode PCM_SIGNED_16_BIT data from a datagram
 // For details of the format, see the client code (ioc-client)
 func decodePcm(audioDataPcm []byte) *[]int16 {
-    audio := make([]int16, len(audioDataPcm) / URTP_SAMPLE_SIZE)
+    audio := getAudio(len(audioDataPcm) / URTP_SAMPLE_SIZE)
+    samples := *audio
 
     // Just copy in the bytes
     x := 0
-    for y := range audio {
-        audio[y] = (int16(audioDataPcm[x]) << 8) + int16(audioDataPcm[x + 1])
+    for y := range samples {
+        samples[y] = (int16(audioDataPcm[x]) << 8) + int16(audioDataPcm[x + 1])
         x += 2
     }
 
-    return &audio
+    return audio
+}
+
+// Decode PCM_SIGNED_16_BIT_LITTLE_ENDIAN data from a datagram, for
+// clients that would rather not byte-swap
+func decodePcmLittleEndian(audioDataPcm []byte) *[]int16 {
+    audio := getAudio(len(audioDataPcm) / URTP_SAMPLE_SIZE)
+    samples := *audio
+
+    x := 0
+    for y := range samples {
+        samples[y] = int16(audioDataPcm[x]) + (int16(audioDataPcm[x + 1]) << 8)
+        x += 2
+    }
+
+    return audio
+}
+
+// Decode PCM_UNSIGNED_8_BIT data from a datagram, where 0x80 is silence,
+// for clients that would rather not upconvert
+func decodePcmUnsigned8(audioDataPcm []byte) *[]int16 {
+    audio := getAudio(len(audioDataPcm))
+    samples := *audio
+
+    for x, item := range audioDataPcm {
+        samples[x] = (int16(item) - 0x80) << 8
+    }
+
+    return audio
+}
+
+// Return a table giving the sign-extended value of every UNICAM
+// compressed value of sampleSizeBits
+func unicamSignExtendTable(sampleSizeBits int) []int16 {
+    table := make([]int16, 1 << uint(sampleSizeBits))
+    for x := range table {
+        table[x] = int16(x << uint(16 - sampleSizeBits)) >> uint(16 - sampleSizeBits)
+    }
+
+    return table
+}
+
+// Read SAMPLES_PER_UNICAM_BLOCK compressed values of sampleSizeBits,
+// most significant bit first, from the start of data, sign-extending
+// them with table
+func unicamValues(data []byte, sampleSizeBits int, table []int16, values []int16) {
+    var bits uint
+    var accumulator uint32
+    var y int
+    size := uint(sampleSizeBits)
+    mask := uint32(len(table) - 1)
+
+    if sampleSizeBits == 8 {
+        for x := range values {
+            values[x] = table[data[x]]
+        }
+        return
+    }
+    for x := range values {
+        for bits < size {
+            accumulator = (accumulator << 8) | uint32(data[y])
+            y++
+            bits += 8
+        }
+        bits -= size
+        values[x] = table[(accumulator >> bits) & mask]
+    }
+}
+
+// Return a factory for decoders of UNICAM data with the given sample
+// size; the sign extension table is shared between them
+func unicamDecoderFactory(sampleSizeBits int) DecoderFactory {
+    table := unicamSignExtendTable(sampleSizeBits)
+    return func() (Decoder, error) {
+        return &UnicamDecoder{sampleSizeBits: sampleSizeBits, signExtend: table, dsp: newDspChain()}, nil
+    }
 }
 
 // Decode UNICAM_COMPRESSED_8_BIT_16000_HZ data from a datagram
-// For details of the format, see the client code (ioc-client)
-func decodeUnicam(audioDataUnicam []byte, sampleSizeBits int) *[]int16 {
+// For details of the format, see the client code (ioc-client); the
+// 10 and 12 bit variants are the same except that the samples of each
+// block are packed together, most significant bit first, so that a
+// block is still a whole number of bytes
+func (decoder *UnicamDecoder) Decode(audioDataUnicam []byte) *[]int16 {
     var numBlocks int
     var blockOffset int
     var blockCount int
     var shiftValues byte
     var shift byte
     var peakShift byte
-    var sample int16
     var sourceIndex int
+    sampleSizeBits := decoder.sampleSizeBits
+    block := decoder.block[:]
 
-    // Work out how much audio data is present
-    for x := 0; x < len(audioDataUnicam) * 8; x += SAMPLES_PER_UNICAM_BLOCK * sampleSizeBits + UNICAM_CODED_SHIFT_SIZE_BITS {
+    // Work out how much audio data is present: only whole blocks,
+    // each pair of blocks sharing a byte of shift values
+    for (numBlocks + 1) * SAMPLES_PER_UNICAM_BLOCK * sampleSizeBits / 8 + (numBlocks + 2) / 2 <= len(audioDataUnicam) {
         numBlocks++;
     }
 
-    // Allocate space
-    audio := make([]int16, numBlocks * SAMPLES_PER_UNICAM_BLOCK)
+    // Get space
+    audio := getAudio(numBlocks * SAMPLES_PER_UNICAM_BLOCK)
+    samples := *audio
 
-    //log.Printf("UNICAM: %d byte(s) containing %d block(s), expanding to a total of %d samples(s) of uncompressed audio.\n", len(audioDataUnicam), numBlocks, len(audio))
+    //log.Printf("UNICAM: %d byte(s) containing %d block(s), expanding to a total of %d samples(s) of uncompressed audio.\n", len(audioDataUnicam), numBlocks, len(samples))
 
     // Decode the blocks
     for blockCount < numBlocks {
-        // Get the compressed values
-        for x := 0; x < SAMPLES_PER_UNICAM_BLOCK; x++ {
-            audio[blockOffset + x] = int16(audioDataUnicam[sourceIndex])
-            sourceIndex++
-        }
+        // Get the compressed values, sign-extended
+        values := samples[blockOffset:blockOffset + SAMPLES_PER_UNICAM_BLOCK]
+        unicamValues(audioDataUnicam[sourceIndex:], sampleSizeBits, decoder.signExtend, values)
+        sourceIndex += SAMPLES_PER_UNICAM_BLOCK * sampleSizeBits / 8
 
         // Get the shift value
         if ((blockCount & 1) == 0) {
@@ -175,64 +378,258 @@ func decodeUnicam(audioDataUnicam []byte, sampleSizeBits int) *[]int16 {
         }
 
         //log.Printf("UNICAM block %d, shift value %d.\n", blockCount, shift)
-        // Shift the values to uncompress them
-        for x := 0; x < SAMPLES_PER_UNICAM_BLOCK; x++ {
-            // Check if the top bit is set and, if so, sign extend
-            sample = audio[blockOffset + x]
-            if sample & (1 << (uint(sampleSizeBits) - 1)) != 0 {
-                for y := uint(sampleSizeBits); y < uint(URTP_SAMPLE_SIZE) * 8; y++ {
-                    sample |= (1 << y)
-                }
-            }
-            
-            // Put the sample through the filters on the way into
-            // the audio slice
-            FirPut(&deemphasis, float32(sample << shift))
-            DeSquealFirPut(&desqueal, FirGet(&deemphasis))
-            audio[blockOffset + x] = int16(DeSquealFirGet(&desqueal))
-
-            //log.Printf("UNICAM block %d:%02d, compressed value %d (0x%x) becomes %d (0x%x).\n",
-            //           blockCount, x, sample, sample, audio[blockOffset + x], audio[blockOffset + x])
+        // Shift the values to uncompress them and put the block through
+        // the DSP chain on the way into the audio slice
+        for x, value := range values {
+            block[x] = float32(value << shift)
         }
+        decoder.dsp.ProcessBlock(block, values)
 
         blockOffset += SAMPLES_PER_UNICAM_BLOCK
         blockCount++
     }
     //log.Printf("UNICAM highest shift value was %d.\n", peakShift)
-    return &audio
+    decoder.peakShift = peakShift
+
+    return audio
+}
+
+// Return the highest shift value in the last UNICAM payload decoded
+func (decoder *UnicamDecoder) PeakShift() int {
+    return int(decoder.peakShift)
 }
 
-// Handle an incoming URTP datagram and send it off for processing
-// For details of the format, see the client code (ioc-client).
-// This function returns a timing datagram which may be sent back
-// to the source if required
-func handleUrtpDatagram(packet []byte) []byte {
-    var timingDatagram []byte
+// Decode IMA_ADPCM_4_BIT data from a datagram: after the header each
+// byte holds two 4-bit codes, the one in the low nibble first
+func decodeImaAdpcm(audioDataAdpcm []byte) *[]int16 {
+    if len(audioDataAdpcm) < IMA_ADPCM_HEADER_SIZE {
+        return nil
+    }
+
+    predictor := int(int16((uint16(audioDataAdpcm[0]) << 8) + uint16(audioDataAdpcm[1])))
+    stepIndex := int(audioDataAdpcm[2])
+    if stepIndex > IMA_ADPCM_MAX_STEP_INDEX {
+        stepIndex = IMA_ADPCM_MAX_STEP_INDEX
+    }
+    codes := audioDataAdpcm[IMA_ADPCM_HEADER_SIZE:]
+    audio := getAudio(len(codes) * 2)
+    samples := *audio
+
+    for x := range samples {
+        code := int(codes[x / 2] >> (uint(x & 1) * 4)) & 0x0F
+        step := imaAdpcmStepTable[stepIndex]
+        difference := step >> 3
+        if code & 4 != 0 {
+            difference += step
+        }
+        if code & 2 != 0 {
+            difference += step >> 1
+        }
+        if code & 1 != 0 {
+            difference += step >> 2
+        }
+        if code & 8 != 0 {
+            predictor -= difference
+        } else {
+            predictor += difference
+        }
+        if predictor > 32767 {
+            predictor = 32767
+        } else if predictor < -32768 {
+            predictor = -32768
+        }
+        stepIndex += imaAdpcmIndexTable[code]
+        if stepIndex < 0 {
+            stepIndex = 0
+        } else if stepIndex > IMA_ADPCM_MAX_STEP_INDEX {
+            stepIndex = IMA_ADPCM_MAX_STEP_INDEX
+        }
+        samples[x] = int16(predictor)
+    }
+
+    return audio
+}
+
+// Create a decoder for OPUS_COMPRESSED data, which keeps state
+// between frames
+func newOpusDecoder() (Decoder, error) {
+    decoder, err := opus.NewDecoder(SAMPLING_FREQUENCY, 1)
+    if err != nil {
+        return nil, err
+    }
+
+    return &OpusDecoder{decoder: decoder}, nil
+}
+
+// Decode OPUS_COMPRESSED data, a single Opus packet of mono audio, from
+// a datagram, always at SAMPLING_FREQUENCY since Opus can decode to
+// any sampling frequency whatever it was encoded at
+func (decoder *OpusDecoder) Decode(audioDataOpus []byte) *[]int16 {
+    audio := getAudio(SAMPLING_FREQUENCY * OPUS_MAX_FRAME_MS / 1000)
+    numSamples, err := decoder.decoder.Decode(audioDataOpus, *audio)
+    if err != nil {
+        log.Printf("Unable to decode %d byte(s) of Opus (%s).\n", len(audioDataOpus), err.Error())
+        putAudio(audio)
+        return nil
+    }
+    *audio = (*audio)[:numSamples]
+
+    return audio
+}
+
+// The sampling frequency of what an Opus decoder decodes
+func (decoder *OpusDecoder) SamplingFrequency() int {
+    return SAMPLING_FREQUENCY
+}
+
+// Count the result of parsing a URTP datagram, logging any error
+func countUrtpParse(parsed *urtp.Datagram, err error) {
+    ingestLocker.Lock()
+    if (parsed != nil) && parsed.Crc {
+        urtpCrcChecked++
+    }
+    if err == urtp.ErrCrc {
+        urtpCrcErrors++
+        log.Printf("URTP datagram with sequence number %d dropped as its CRC is wrong (%d so far).\n",
+                   parsed.SequenceNumber, urtpCrcErrors)
+    } else if err != nil {
+        urtpParseErrors++
+        log.Printf("URTP datagram dropped (%s).\n", err.Error())
+    }
+    ingestLocker.Unlock()
+}
+
+// Handle a capabilities acknowledgement from the client
+func (handler *ServerUrtpHandler) HandleCapabilitiesAck(data []byte) {
+    handleCapabilitiesAck(data)
+}
+
+// Handle a hello from the client
+func (handler *ServerUrtpHandler) HandleHello(data []byte) []byte {
+    return handleHello(data)
+}
+
+// Handle a time report from the client
+func (handler *ServerUrtpHandler) HandleTimeReport(data []byte) {
+    handleTimeReport(data)
+}
+
+// Handle a URTP datagram from the client
+func (handler *ServerUrtpHandler) HandleDatagram(version byte, datagram []byte) [][]byte {
+    return handleUrtpDatagram(mainPipeline, handler.decoders, version, datagram)
+}
+
+// Return the URTP statistics
+func urtpStats() interface{} {
+    ingestLocker.Lock()
+    defer ingestLocker.Unlock()
+
+    return map[string]interface{}{
+        "crcChecked": urtpCrcChecked,
+        "crcErrors": urtpCrcErrors,
+        "parseErrors": urtpParseErrors,
+        "fecShards": fecShards,
+        "fecRecovered": fecRecovered,
+        "fecLost": fecLost,
+    }
+}
+
+// Encode a buffer depth for a timing datagram
+func timingMilliseconds(depth time.Duration) []byte {
+    if depth > TIMING_MAX_MILLISECONDS {
+        depth = TIMING_MAX_MILLISECONDS
+    } else if depth < 0 {
+        depth = 0
+    }
+    milliseconds := int(depth / time.Millisecond)
+
+    return []byte{byte(milliseconds >> 8), byte(milliseconds)}
+}
+
+// Queue a control datagram with the given payload to go back to
+// the client with the next return datagrams
+func queueControlDatagram(payload []byte) error {
+    var err error
+
+    if len(payload) <= CONTROL_MAX_PAYLOAD_SIZE {
+        ingestLocker.Lock()
+        if len(controlDatagrams) < CONTROL_MAX_QUEUED {
+            controlDatagram := []byte{CONTROL_SYNC_BYTE, byte(len(payload) >> 8), byte(len(payload))}
+            controlDatagrams = append(controlDatagrams, append(controlDatagram, payload...))
+        } else {
+            err = errors.New(fmt.Sprintf("%d control datagrams are already waiting to be sent", len(controlDatagrams)))
+        }
+        ingestLocker.Unlock()
+    } else {
+        err = errors.New(fmt.Sprintf("control payload of %d byte(s) is larger than the maximum (%d)", len(payload), CONTROL_MAX_PAYLOAD_SIZE))
+    }
+
+    return err
+}
+
+// Make a NACK datagram for any sequence numbers that have been
+// skipped between the highest received so far and this one, returning
+// nil if there are none
+func makeNackDatagram(sequenceNumber uint16) []byte {
+    var nackDatagram []byte
+
+    if ingestStarted {
+        distance := sequenceDistance(ingestSequenceNumber, sequenceNumber)
+        if distance > 0 {
+            if (distance > 1) && (distance - 1 <= NACK_MAX_SEQUENCE_NUMBERS) {
+                nackDatagram = append(nackDatagram, NACK_SYNC_BYTE, byte(distance - 1))
+                for missing := ingestSequenceNumber + 1; missing != sequenceNumber; missing++ {
+                    nackDatagram = append(nackDatagram, byte(missing >> 8), byte(missing))
+                }
+                log.Printf("Requesting retransmission of %d datagram(s) from sequence number %d.\n", distance - 1, ingestSequenceNumber + 1)
+            }
+            ingestSequenceNumber = sequenceNumber
+        } else if -distance > SEQUENCE_RESYNC_THRESHOLD {
+            ingestSequenceNumber = sequenceNumber
+        }
+    } else {
+        ingestStarted = true
+        ingestSequenceNumber = sequenceNumber
+    }
+
+    return nackDatagram
+}
+
+// Handle an incoming URTP datagram and send it off for processing by
+// pipeline.  For details of the format, see the client code (ioc-client).
+// This function returns any datagrams (capabilities, timing, NACK) which should
+// be sent back to the source; decoders are those of the stream the datagram
+// belongs to and version is the URTP version the datagram arrived in (it
+// must have been normalised to the original layout).  Only a client of
+// the main stream has a session: a client of any other stream is sent
+// nothing back.
+func handleUrtpDatagram(pipeline *Pipeline, decoders *Decoders, version byte, packet []byte) [][]byte {
+    var returnDatagrams [][]byte
     //log.Printf("Packet of size %d byte(s) received.\n", len(packet))
     //log.Printf("%s\n", hex.Dump(line[:numBytesIn]))
-    if (len(packet) >= URTP_HEADER_SIZE) {
+    parsed, err := urtp.Parse(packet)
+    countUrtpParse(parsed, err)
+    if (err == nil) && pipeline.quota.AllowIngest(len(packet)) {
+        started := time.Now()
+        audioCodingScheme := parsed.AudioCodingScheme
+        heartbeat := parsed.Heartbeat
         // Populate a URTP datagram with the data
-        urtpDatagram := new(UrtpDatagram)
-        //log.Printf("URTP header:\n")
-        //log.Printf("  sync byte:        0x%x.\n", packet[0])
-        audioCodingScheme := packet[1]
-        urtpDatagram.SequenceNumber = uint16(packet[2]) << 8 + uint16(packet[3])
+        urtpDatagram := getUrtpDatagram()
+        urtpDatagram.SequenceNumber = parsed.SequenceNumber
         //log.Printf("  sequence number:  %d.\n", urtpDatagram.SequenceNumber)
-        urtpDatagram.Timestamp = (uint64(packet[4]) << 56) + (uint64(packet[5]) << 48) + (uint64(packet[6]) << 40) + (uint64(packet[7]) << 32) +
-                                 (uint64(packet[8]) << 24) + (uint64(packet[9]) << 16) + (uint64(packet[10]) << 8) + uint64(packet[11])
+        urtpDatagram.Timestamp = parsed.Timestamp
+        urtpDatagram.Received = started
+        urtpDatagram.Channels = parsed.Channels
+        urtpDatagram.Source = decoders.Source
         //log.Printf("  timestamp:        %6.3f ms.\n", float64(urtpDatagram.Timestamp) / 1000)
 
-        if (len(packet) > URTP_HEADER_SIZE) {
-            switch (audioCodingScheme) {
-                case PCM_SIGNED_16_BIT:
-                    //log.Printf("  audio coding:     PCM_SIGNED_16_BIT.\n")
-                    urtpDatagram.Audio = decodePcm(packet[URTP_HEADER_SIZE:])
-                case UNICAM_COMPRESSED_8_BIT:
-                    //log.Printf("  audio coding:     UNICAM_COMPRESSED_8_BIT.\n")
-                    urtpDatagram.Audio = decodeUnicam(packet[URTP_HEADER_SIZE:], 8)
-                default:
-                    //log.Printf("  audio coding:     !unknown!\n")
-            }
+        if (len(parsed.Payload) > 0) && !heartbeat {
+            // Decode in isolation so that a malformed payload can't
+            // take the server down
+            runIsolated(pipeline.quota, func() {
+                urtpDatagram.Audio = decoders.Decode(audioCodingScheme, parsed.Channels, parsed.Payload)
+                urtpDatagram.UnicamPeakShift = decoders.PeakShift(audioCodingScheme)
+            })
         }
 
         if urtpDatagram.Audio != nil {
@@ -241,270 +638,507 @@ func handleUrtpDatagram(packet []byte) []byte {
             //log.Printf("Unable to decode audio samples from this datagram.\n")
         }
 
-        // Create the timing datagram
-        timingDatagram = append(timingDatagram, packet[0], packet[2], packet[3], packet[4], packet[5], packet[6], packet[7], packet[8], packet[9], packet[10], packet[11])
+        if pipeline != mainPipeline {
+            urtpDatagram.SamplingFrequency = decoders.SamplingFrequency(audioCodingScheme, SAMPLING_FREQUENCY)
+            pipeline.queueDatagram(urtpDatagram, heartbeat, started)
+            return nil
+        }
 
-        // Send the data to the processing channel
-        ProcessDatagramsChannel <- urtpDatagram
-    }
+        ingestLocker.Lock()
+        urtpDatagram.SamplingFrequency = decoders.SamplingFrequency(audioCodingScheme, clientSamplingFrequency())
+        // Tell a new client what we can do
+        capabilitiesDatagram := sessionDatagramReceived(time.Now())
+        if capabilitiesDatagram != nil {
+            returnDatagrams = append(returnDatagrams, capabilitiesDatagram)
+        }
+        noteUrtpVersion(version)
 
-    return timingDatagram
-}
+        // Ask for anything that has gone missing; a heartbeat repeats
+        // the last sequence number so says nothing about that
+        if nackEnabled && !heartbeat {
+            nackDatagram := makeNackDatagram(urtpDatagram.SequenceNumber)
+            if nackDatagram != nil {
+                returnDatagrams = append(returnDatagrams, nackDatagram)
+            }
+        }
 
-// Verify that a sequence of byte represents URTP header
-// For details of the format, see the client code (ioc-client)
-func verifyUrtpHeader(header []byte) bool {
-    var isHeader bool
-
-    if len(header) >= URTP_HEADER_SIZE {
-        if header[0] == SYNC_BYTE {
-            if header[1] < MAX_NUM_AUDIO_CODING_SCHEMES {
-                bytesOfPayload := ((int(header[URTP_NUM_BYTES_AUDIO_OFFSET]) << 8) + (int(header[URTP_NUM_BYTES_AUDIO_OFFSET + 1])))
-                if bytesOfPayload <= URTP_DATAGRAM_MAX_SIZE {
-                    isHeader = true;
-                } else {
-                    log.Printf("NOT a URTP header %x (%d (0x%x, in the last two bytes) is larger than the maximum number of payload bytes (%d)).\n", header,
-                               bytesOfPayload, bytesOfPayload, URTP_DATAGRAM_MAX_SIZE)
-                }
-            } else {
-                log.Printf("NOT a URTP header %x (0x%x in the second byte is not a valid audio coding scheme).\n", header, header[1])
+        // Tell the client if it should change audio coding scheme
+        if codingAdvisor != nil {
+            var audioDuration time.Duration
+            if urtpDatagram.Audio != nil {
+                audioDuration = time.Duration(len(*urtpDatagram.Audio) / urtpDatagram.Channels) * time.Second / time.Duration(urtpDatagram.SamplingFrequency)
             }
-        } else {
-            log.Printf("NOT a URTP header %x (0x%x at the start is not a sync byte (%x)).\n", header, header[0], SYNC_BYTE)
+            adviceDatagram := codingAdvisor.Received(time.Now(), audioCodingScheme, urtpDatagram.SequenceNumber,
+                                                     len(packet), audioDuration, heartbeat)
+            if adviceDatagram != nil {
+                returnDatagrams = append(returnDatagrams, adviceDatagram)
+            }
+        }
+
+        // Add any control datagrams that are waiting
+        returnDatagrams = append(returnDatagrams, controlDatagrams...)
+        controlDatagrams = nil
+
+        // Create the timing datagram, if it is time to send one
+        if time.Now().After(timingDatagramSent.Add(TIMING_DATAGRAM_PERIOD)) {
+            var timingDatagram []byte
+            timingDatagram = append(timingDatagram, packet[0], packet[2], packet[3], packet[4], packet[5], packet[6], packet[7], packet[8], packet[9], packet[10], packet[11])
+            if session.Acknowledged && (session.ClientVersion >= CAPABILITIES_VERSION_EXTENDED_TIMING) {
+                // Add the buffer depths so that the client can adapt
+                pcmBuffered, outputBuffered := bufferDepths()
+                timingDatagram = append(timingDatagram, timingMilliseconds(pcmBuffered)...)
+                timingDatagram = append(timingDatagram, timingMilliseconds(outputBuffered)...)
+            }
+            if session.Acknowledged && (session.ClientVersion >= CAPABILITIES_VERSION_TIME_SYNC) {
+                // Add the times for two-way time synchronisation
+                timingDatagram = append(timingDatagram, timeSyncTimes(started, time.Now())...)
+            }
+            returnDatagrams = append(returnDatagrams, timingDatagram)
+            timingDatagramSent = time.Now()
         }
+        ingestLocker.Unlock()
+
+        pipeline.queueDatagram(urtpDatagram, heartbeat, started)
+    }
+
+    return returnDatagrams
+}
+
+// Send a URTP datagram, received at the given time, to the processing
+// channel of a pipeline, never blocking; a heartbeat is passed on as
+// just that
+func (pipeline *Pipeline) queueDatagram(urtpDatagram *UrtpDatagram, heartbeat bool, received time.Time) {
+    if heartbeat {
+        putUrtpDatagram(urtpDatagram)
+        pipeline.Queue(&Heartbeat{Received: received})
     } else {
-        log.Printf("NOT a URTP header %x (must be at least %d bytes long).\n", header, URTP_HEADER_SIZE)
+        pipeline.Queue(urtpDatagram)
     }
+}
+
+// Handle a FEC shard from the client, handling any URTP datagrams that
+// it gives up for pipeline; decoders are those of the client and any
+// datagrams that should be sent back to the client are returned
+func handleFec(pipeline *Pipeline, decoders *Decoders, data []byte) [][]byte {
+    var returnDatagrams [][]byte
 
-    return isHeader
+    if decoders.fec == nil {
+        decoders.fec = urtp.NewFecReceiver()
+    }
+    datagrams, counts := decoders.fec.Receive(data)
+    ingestLocker.Lock()
+    fecShards += counts.Shards
+    fecRecovered += counts.Recovered
+    fecLost += counts.Lost
+    ingestLocker.Unlock()
+    if counts.Recovered > 0 {
+        log.Printf("FEC recovered %d URTP datagram(s).\n", counts.Recovered)
+    }
+    if counts.Lost > 0 {
+        log.Printf("FEC was unable to recover %d URTP datagram(s).\n", counts.Lost)
+    }
+    for _, datagram := range datagrams {
+        datagram, version := urtp.Normalise(datagram)
+        if datagram != nil {
+            returnDatagrams = append(returnDatagrams, handleUrtpDatagram(pipeline, decoders, version, datagram)...)
+        }
+    }
+
+    return returnDatagrams
 }
 
-// Handle a stream of (e.g. TCP) bytes containing URTP datagrams
-// For details of the format, see the client code (ioc-client)
-// A timing datagram may be returned if the stream has reached a point
-// where one can be created
-func handleUrtpStream(reassemblyData *TcpReassemblyData, data []byte) []byte {
+// Return a reader that decompresses a TCP stream, the first part of
+// which has already been read into leftover
+func newTransportDecompressor(compression byte, leftover []byte, in io.Reader) (io.ReadCloser, error) {
+    var decompressor io.ReadCloser
     var err error
-    var item byte
-    var timingDatagram []byte
-
-    // Write all the data to the TCP buffer
-    tcpBuffer.Write(data)
-
-    //log.Printf("TCP reassembly: %d byte(s) received.\n", len(data))
-    for item, err = tcpBuffer.ReadByte(); err == nil; item, err = tcpBuffer.ReadByte() {
-        //log.Printf("TCP reassembly: state %d, byte %d (0x%x).\n", reassemblyData.State, item, item)
-        switch (reassemblyData.State) {
-            case URTP_STATE_WAITING_SYNC:
-                // Look for the sync byte
-                if item == SYNC_BYTE {
-                    reassemblyData.Header.WriteByte(item)
-                    reassemblyData.State = URTP_STATE_WAITING_AUDIO_CODING
-                } else {                
-                    //log.Printf("TCP reassembly: awaiting initial sync byte but 0x%x isn't one (0x%x).\n", item, SYNC_BYTE)
-                    reassemblyData.Header.Reset()
-                    reassemblyData.State = URTP_STATE_WAITING_SYNC
-                }
-            case URTP_STATE_WAITING_AUDIO_CODING:
-                // Look for the audio coding scheme and check it
-                if item < MAX_NUM_AUDIO_CODING_SCHEMES {
-                    reassemblyData.Header.WriteByte(item)
-                    //log.Printf("TCP reassembly: audio coding scheme 0x%x.\n", item)
-                    reassemblyData.State = URTP_STATE_WAITING_SEQUENCE_NUMBER
-                } else {
-                    log.Printf("TCP reassembly: audio coding scheme in the second byte (0x%0x) is not a valid audio coding scheme.\n", item)
-                    reassemblyData.Header.Reset()
-                    reassemblyData.State = URTP_STATE_WAITING_SYNC
+
+    stream := io.MultiReader(bytes.NewReader(leftover), in)
+    switch compression {
+        case urtp.TRANSPORT_ZLIB:
+            decompressor, err = zlib.NewReader(stream)
+        case urtp.TRANSPORT_ZSTD:
+            var decoder *zstd.Decoder
+            decoder, err = zstd.NewReader(stream)
+            if err == nil {
+                decompressor = decoder.IOReadCloser()
+            }
+        default:
+            err = errors.New(fmt.Sprintf("unknown compression 0x%02x", compression))
+    }
+
+    return decompressor, err
+}
+
+// Read UDP packets from a socket forever, passing them on to be handled
+func udpReader(server *net.UDPConn, packets chan<- *UdpPacket) {
+    var numBytesIn int
+    var remoteAddress *net.UDPAddr
+    var err error
+    line := make([]byte, urtp.FEC_MAX_SIZE)
+
+    defer server.Close()
+    for numBytesIn, remoteAddress, err = server.ReadFromUDP(line); (err == nil) && (numBytesIn > 0); numBytesIn, remoteAddress, err = server.ReadFromUDP(line) {
+        // Drop floods before they get anywhere near the queue
+        if !udpSourceLimiter.Allow(remoteAddress.IP.String(), numBytesIn) {
+            continue
+        }
+        packet := new(UdpPacket)
+        packet.Data = append([]byte(nil), line[:numBytesIn]...)
+        packet.Address = remoteAddress
+        packet.Server = server
+        select {
+            case packets <- packet:
+            default:
+                log.Printf("UDP packet queue is full, dropping packet from %s.\n", remoteAddress.String())
+        }
+    }
+    if errors.Is(err, net.ErrClosed) {
+        fmt.Printf("UDP server on %v closed.\n", server.LocalAddr())
+    } else if err != nil {
+        fmt.Fprintf(os.Stderr, "Error reading from %v (%s).\n", server.LocalAddr(), err.Error())
+    } else {
+        fmt.Fprintf(os.Stderr, "UDP read on %v returned when it should not.\n", server.LocalAddr())
+    }
+}
+
+// Run a UDP server for pipeline until ctx is done; if numSockets is greater than one then that
+// many sockets are opened on the port with SO_REUSEPORT, each with its
+// own reader, all feeding the same (bounded) queue of packets.  Only
+// the server of the main stream talks to its clients (capabilities,
+// hello, time reports): that of any other stream just takes the audio.
+func udpServer(ctx context.Context, bindAddresses []string, port string, numSockets int, pipeline *Pipeline) {
+    var listenConfig net.ListenConfig
+    var servers []*net.UDPConn
+    packets := make(chan *UdpPacket, UDP_PACKET_QUEUE_SIZE)
+    // Each client gets its own decoders, keyed by address
+    decoders := make(map[string]*Decoders)
+
+    if numSockets > 1 {
+        listenConfig.Control = reusePortControl
+    }
+
+    // Set up the sockets
+    for _, bindAddress := range bindAddressesOrAll(bindAddresses) {
+        network, address := listenNetworkAndAddress("udp", bindAddress, port)
+        for x := 0; x < numSockets; x++ {
+            connection, err := listenConfig.ListenPacket(ctx, network, address)
+            if err == nil {
+                server := connection.(*net.UDPConn)
+                err1 := server.SetReadBuffer(urtp.DATAGRAM_MAX_SIZE + IP_HEADER_OVERHEAD)
+                if err1 != nil {
+                    log.Printf("Unable to set optimal read buffer size (%s).\n", err1.Error())
                 }
-            case URTP_STATE_WAITING_SEQUENCE_NUMBER:
-                // Read in the two-byte sequence number
-                reassemblyData.Header.WriteByte(item)
-                reassemblyData.ByteCount++
-                //log.Printf("TCP reassembly: sequence number byte %d is 0x%x.\n", reassemblyData.ByteCount, item)
-                if reassemblyData.ByteCount >= URTP_SEQUENCE_NUMBER_SIZE {
-                    reassemblyData.ByteCount = 0
-                    reassemblyData.State = URTP_STATE_WAITING_TIMESTAMP
+                if x == 0 {
+                    fmt.Printf("UDP server listening for Chuffs of stream \"%s\" on %s (%s).\n", pipeline.Name,
+                               server.LocalAddr().String(), network)
                 }
-            case URTP_STATE_WAITING_TIMESTAMP:
-                // Read in the eight-byte timestamp
-                reassemblyData.Header.WriteByte(item)
-                reassemblyData.ByteCount++
-                //log.Printf("TCP reassembly: timestamp byte %d is 0x%x.\n", reassemblyData.ByteCount, item)
-                if reassemblyData.ByteCount >= URTP_TIMESTAMP_SIZE {
-                    reassemblyData.ByteCount = 0
-                    reassemblyData.State = URTP_STATE_WAITING_PAYLOAD_SIZE
+                go udpReader(server, packets)
+                servers = append(servers, server)
+            } else {
+                fmt.Fprintf(os.Stderr, "Couldn't start UDP server on %s (%s).\n", address, err.Error())
+            }
+        }
+    }
+
+    if len(servers) > 0 {
+        fmt.Printf("UDP server has %d socket(s) listening for Chuffs of stream \"%s\".\n", len(servers), pipeline.Name)
+        if pipeline == mainPipeline {
+            systemdNotifier.Listening(SYSTEMD_LISTENER_UDP)
+        }
+        // Handle UDP packets until we're told to stop
+        for {
+            select {
+                case <-ctx.Done():
+                {
+                    for _, server := range servers {
+                        server.Close()
+                    }
+                    return
                 }
-            case URTP_STATE_WAITING_PAYLOAD_SIZE:
-                // Read in the two-byte payload size
-                reassemblyData.Header.WriteByte(item)
-                reassemblyData.PayloadSize += int (uint(item) << uint((8 * (URTP_PAYLOAD_SIZE_SIZE - reassemblyData.ByteCount - 1))))
-                reassemblyData.ByteCount++
-                if reassemblyData.ByteCount >= URTP_PAYLOAD_SIZE_SIZE {
-                    // Got the payload size, check it and, if it is OK, write the header
-                    reassemblyData.ByteCount = 0
-                    //log.Printf("TCP reassembly: URTP payload is %d byte(s).\n", reassemblyData.PayloadSize)
-                    if reassemblyData.PayloadSize <= URTP_DATAGRAM_MAX_SIZE {
-                        reassemblyData.State = URTP_STATE_WAITING_PAYLOAD
-                        reassemblyData.Datagram.Write(reassemblyData.Header.Bytes())
-                        if reassemblyData.PayloadSize == 0 {
-                            reassemblyData.Header.Reset()
-                            reassemblyData.State = URTP_STATE_WAITING_SYNC
+                case packet := <-packets:
+                {
+                    // For UDP, a single URTP datagram arrives in a single UDP packet
+                    var returnDatagrams [][]byte
+                    if urtp.IsCapabilitiesAck(packet.Data) || urtp.IsHello(packet.Data) || urtp.IsTimeReport(packet.Data) {
+                        if pipeline == mainPipeline {
+                            if urtp.IsCapabilitiesAck(packet.Data) {
+                                handleCapabilitiesAck(packet.Data)
+                            } else if urtp.IsHello(packet.Data) {
+                                returnDatagrams = append(returnDatagrams, handleHello(packet.Data))
+                            } else {
+                                handleTimeReport(packet.Data)
+                            }
+                        }
+                    } else if urtp.IsFec(packet.Data) {
+                        if fecEnabled {
+                            returnDatagrams = handleFec(pipeline, clientDecoders(decoders, packet.Address.String(), time.Now()), packet.Data)
                         }
                     } else {
-                        //log.Printf("TCP reassembly: NOT a URTP header, payload length %d (0x%x, in the last two bytes) is larger than the maximum number of payload bytes (%d)).\n",
-                        //           reassemblyData.PayloadSize, reassemblyData.PayloadSize, URTP_DATAGRAM_MAX_SIZE)
-                        reassemblyData.PayloadSize = 0
-                        reassemblyData.Header.Reset()
-                        reassemblyData.State = URTP_STATE_WAITING_SYNC
+                        data, version := urtp.Normalise(packet.Data)
+                        if data != nil {
+                            returnDatagrams = handleUrtpDatagram(pipeline, clientDecoders(decoders, packet.Address.String(), time.Now()), version, data)
+                        }
+                    }
+                    for _, returnDatagram := range returnDatagrams {
+                        _, err1 := packet.Server.WriteToUDP(returnDatagram, packet.Address)
+                        if err1 == nil {
+                            log.Printf("Return datagram (0x%02x) sent to %s.\n", returnDatagram[0], packet.Address.String())
+                        } else {
+                            log.Printf("Couldn't send return datagram (%s).\n", err1.Error())
+                        }
                     }
                 }
-            case URTP_STATE_WAITING_PAYLOAD:
-                // Write the one byte we have
-                reassemblyData.Datagram.WriteByte(item)
-                if reassemblyData.PayloadSize > 0 {
-                    reassemblyData.PayloadSize--
-                }
-                // Read in as much of the rest of the payload as possible
-                bytesToRead := tcpBuffer.Len()
-                if bytesToRead > reassemblyData.PayloadSize {
-                    bytesToRead = reassemblyData.PayloadSize
-                }
-                reassemblyData.Datagram.Write(tcpBuffer.Next(bytesToRead))
-                reassemblyData.PayloadSize -= bytesToRead
-                if reassemblyData.PayloadSize == 0 {
-                    // Got the lot, handle the complete datagram now and reset the state machine
-                    //log.Printf("TCP reassembly: URTP packet (%d bytes) fully received.\n", urtpDatagram.Len())
-                    timingDatagram = handleUrtpDatagram(reassemblyData.Datagram.Next(reassemblyData.Datagram.Len()))
-                    reassemblyData.Header.Reset()
-                    reassemblyData.State = URTP_STATE_WAITING_SYNC
+            }
+        }
+    }
+}
+
+// Read a stream of URTP (e.g. from a TCP connection) from in until it
+// ends or fails, returning the error; what arrives is handled by
+// reassembler, any datagrams to be sent back are written to out and
+// framed is set (atomically) while the stream is length-prefixed.
+// If beforeRead is not nil it is called before each read (e.g. to set
+// a deadline).
+func handleUrtpStream(reassembler *urtp.Reassembler, in io.Reader, out io.Writer, framed *int32, beforeRead func()) error {
+    var decompressor io.ReadCloser
+    reader := in
+    line := make([]byte, urtp.DATAGRAM_MAX_SIZE)
+
+    if beforeRead == nil {
+        beforeRead = func() {}
+    }
+    defer func() {
+        if decompressor != nil {
+            decompressor.Close()
+        }
+    }()
+    for {
+        beforeRead()
+        numBytesIn, err := reader.Read(line)
+        if (err != nil) || (numBytesIn <= 0) {
+            return err
+        }
+        returnDatagrams := reassembler.Handle(line[:numBytesIn])
+        if reassembler.LengthPrefixed {
+            atomic.StoreInt32(framed, 1)
+        } else {
+            atomic.StoreInt32(framed, 0)
+        }
+        for _, returnDatagram := range returnDatagrams {
+            numBytesOut, err := out.Write(returnDatagram)
+            if err == nil {
+                log.Printf("Return datagram (0x%02x) sent, length %d byte(s).\n", returnDatagram[0], numBytesOut)
+            } else {
+                log.Printf("Couldn't send return datagram (%s).\n", err.Error())
+            }
+        }
+        if (reassembler.Compression != 0) && (decompressor == nil) {
+            // The client has switched to a compressed stream; what's
+            // left over in the reassembler is the start of it
+            decompressor, err = newTransportDecompressor(reassembler.Compression, reassembler.Leftover(), in)
+            if err != nil {
+                log.Printf("Unable to decompress stream (%s).\n", err.Error())
+                return err
+            }
+            reader = decompressor
+        }
+    }
+}
+
+// Decide, according to policy, whether a new TCP connection may
+// replace the current one (which has finished once done is closed)
+func acceptTcpConnection(policy string, current net.Conn, done chan struct{}, next net.Conn) bool {
+    accept := true
+
+    if (current != nil) && (policy != TCP_POLICY_TAKEOVER) && (policy != TCP_POLICY_MIX) {
+        select {
+            case <-done:
+                // The current connection has gone
+            default:
+                if policy == TCP_POLICY_SAME_IP {
+                    currentHost, _, _ := net.SplitHostPort(current.RemoteAddr().String())
+                    nextHost, _, _ := net.SplitHostPort(next.RemoteAddr().String())
+                    accept = currentHost == nextHost
                 } else {
-                    //log.Printf("TCP reassembly: %d byte(s) of payload remaining to be read.\n", reassemblyData.PayloadSize)
+                    accept = false
                 }
-            default:
-                reassemblyData.ByteCount = 0
-                reassemblyData.PayloadSize = 0
-                reassemblyData.Header.Reset()
-                reassemblyData.State = URTP_STATE_WAITING_SYNC
         }
     }
-    
-    return timingDatagram
+
+    return accept
 }
 
-// Run a UDP server forever
-func udpServer(port string) {
-    var numBytesIn int
-    var server *net.UDPConn
-    var remoteAddress *net.UDPAddr
-    line := make([]byte, URTP_DATAGRAM_MAX_SIZE)
+// Run a TCP server until ctx is done; a connection which sends nothing
+// for idleTimeout (if non-zero) is closed and policy (one of the
+// TCP_POLICY_ values) decides what happens when a second client connects
+func tcpServer(ctx context.Context, bindAddresses []string, port string, idleTimeout time.Duration, policy string) {
+    var currentServer net.Conn
+    var currentServerDone chan struct{}
+    var listeners []net.Listener
+    connections := make(chan net.Conn)
 
-    // Set up the server
-    localUdpAddr, err := net.ResolveUDPAddr("udp", ":" + port)
-    if err == nil {
-        // Begin listening
-        server, err = net.ListenUDP("udp", localUdpAddr)
+    // Listen on all the addresses, passing connections to the channel
+    for _, bindAddress := range bindAddressesOrAll(bindAddresses) {
+        network, address := listenNetworkAndAddress("tcp", bindAddress, port)
+        listener, err := net.Listen(network, address)
         if err == nil {
-            defer server.Close()
-            fmt.Printf("UDP server listening for Chuffs on port %s.\n", port)
-            err1 := server.SetReadBuffer(URTP_DATAGRAM_MAX_SIZE + IP_HEADER_OVERHEAD)
-            if err1 != nil {
-                log.Printf("Unable to set optimal read buffer size (%s).\n", err1.Error())
-            }
-            // Read UDP packets forever
-            for numBytesIn, remoteAddress, err = server.ReadFromUDP(line); (err == nil) && (numBytesIn > 0); numBytesIn, remoteAddress, err = server.ReadFromUDP(line) {
-                // For UDP, a single URTP datagram arrives in a single UDP packet
-                if (numBytesIn >= URTP_HEADER_SIZE) && (verifyUrtpHeader(line[:URTP_HEADER_SIZE])) {
-                    timingDatagram := handleUrtpDatagram(line[:numBytesIn])
-                    if (len(timingDatagram) > 0) && time.Now().After(timingDatagramSent.Add(TIMING_DATAGRAM_PERIOD)) {
-                        _, err = server.WriteToUDP(timingDatagram, remoteAddress)
-                        if err == nil {
-                            timingDatagramSent = time.Now()
-                            log.Printf("Timing datagram sent to %s.\n", remoteAddress.String())
-                        } else {
-                            log.Printf("Couldn't send timing datagram (%s).\n", err.Error())
+            fmt.Printf("TCP server listening for Chuffs on %s (%s).\n", listener.Addr().String(), network)
+            listeners = append(listeners, listener)
+            go func(listener net.Listener) {
+                defer listener.Close()
+                for {
+                    newServer, err := listener.Accept()
+                    if err == nil {
+                        host, _, _ := net.SplitHostPort(newServer.RemoteAddr().String())
+                        if !tcpConnectionLimiter.Allow(host) {
+                            log.Printf("Connection from %s refused, more than %d connection(s) in a minute.\n",
+                                       newServer.RemoteAddr().String(), tcpConnectionLimiter.MaxPerMinute)
+                            newServer.Close()
+                            continue
+                        }
+                        select {
+                            case connections <- newServer:
+                            case <-ctx.Done():
+                                newServer.Close()
+                        }
+                    } else {
+                        if errors.Is(err, net.ErrClosed) {
+                            fmt.Printf("TCP server on %s closed.\n", listener.Addr().String())
+                            return
                         }
+                        fmt.Fprintf(os.Stderr, "Error accepting connection on %s (%s).\n", listener.Addr().String(), err.Error())
                     }
                 }
-            }
-            if err != nil {
-                fmt.Fprintf(os.Stderr, "Error reading from port %v (%s).\n", localUdpAddr, err.Error())
-            } else {
-                fmt.Fprintf(os.Stderr, "UDP read on port %v returned when it should not.\n", localUdpAddr)
-            }
+            }(listener)
         } else {
-            fmt.Fprintf(os.Stderr, "Couldn't start UDP server on port %s (%s).\n", port, err.Error())
+            fmt.Fprintf(os.Stderr, "Unable to listen for TCP connections on %s (%s).\n", address, err.Error())
         }
-    } else {
-        fmt.Fprintf(os.Stderr, "'%s' is not a valid UDP address (%s).\n", port, err.Error())
     }
-}
-
-// Run a TCP server forever
-func tcpServer(port string) {
-    var newServer net.Conn
-    var currentServer net.Conn
 
-    listener, err := net.Listen("tcp", ":" + port)
-    if err == nil {
-        defer listener.Close()
-        // Listen for a connection
+    if len(listeners) > 0 {
+        systemdNotifier.Listening(SYSTEMD_LISTENER_TCP)
+        // Handle connections until we're told to stop
         for {
+            var newServer net.Conn
             fmt.Printf("TCP server waiting for a [further] Chuff connection on port %s.\n", port)
-            newServer, err = listener.Accept()
-            if err == nil {
-                if currentServer != nil {
-                    currentServer.Close()
+            select {
+                case <-ctx.Done():
+                {
+                    for _, listener := range listeners {
+                        listener.Close()
+                    }
+                    if currentServer != nil {
+                        currentServer.Close()
+                    }
+                    return
                 }
-                currentServer = newServer
-                x, success := currentServer.(*net.TCPConn)
-                if success {
-                    err1 := x.SetReadBuffer(30000)
-                    if err1 != nil {
-                        log.Printf("Unable to set optimal read buffer size (%s).\n", err1.Error())
+                case newServer = <-connections:
+            }
+            if !acceptTcpConnection(policy, currentServer, currentServerDone, newServer) {
+                log.Printf("Connection from %s rejected, %s is already connected (policy \"%s\").\n",
+                           newServer.RemoteAddr().String(), currentServer.RemoteAddr().String(), policy)
+                newServer.Close()
+                publishEvent(EVENT_CLIENT_REJECTED, map[string]interface{}{"address": newServer.RemoteAddr().String()})
+                continue
+            }
+            if (currentServer != nil) && (policy != TCP_POLICY_MIX) {
+                currentServer.Close()
+            }
+            currentServer = newServer
+            currentServerDone = make(chan struct{})
+            x, success := currentServer.(*net.TCPConn)
+            if success {
+                err1 := x.SetReadBuffer(30000)
+                if err1 != nil {
+                    log.Printf("Unable to set optimal read buffer size (%s).\n", err1.Error())
+                }
+                err1 = x.SetNoDelay(true)
+                if err1 != nil {
+                    log.Printf("Unable to switch of Nagle algorithm (%s).\n", err1.Error())
+                }
+                if idleTimeout > 0 {
+                    // Keepalives find a dead connection even if the
+                    // read deadline hasn't expired
+                    err1 = x.SetKeepAlive(true)
+                    if err1 == nil {
+                        err1 = x.SetKeepAlivePeriod(TCP_KEEPALIVE_PERIOD)
                     }
-                    err1 = x.SetNoDelay(true)
                     if err1 != nil {
-                        log.Printf("Unable to switch of Nagle algorithm (%s).\n", err1.Error())
+                        log.Printf("Unable to switch on TCP keepalive (%s).\n", err1.Error())
                     }
-                } else {
-                    log.Printf("Can't cast *net.Conn to *net.TCPConn in order to set optimal read buffer size.\n")
                 }
-                // Process datagrams received on the channel in another go routine
-                fmt.Printf("Connection made by %s.\n", currentServer.RemoteAddr().String())
-                go func(server net.Conn) {
-                    var reassemblyData TcpReassemblyData
-                    reassemblyData.State = URTP_STATE_WAITING_SYNC
-                    // Read packets until the connection is closed under us
-                    line := make([]byte, URTP_DATAGRAM_MAX_SIZE)
-                    for numBytesIn, err := server.Read(line); (err == nil) && (numBytesIn > 0); numBytesIn, err = server.Read(line) {
-                        timingDatagram := handleUrtpStream(&reassemblyData, line[:numBytesIn])
-                        if (len(timingDatagram) > 0) && time.Now().After(timingDatagramSent.Add(TIMING_DATAGRAM_PERIOD)) {
-                            numBytesOut, err := server.Write(timingDatagram)
-                            if err == nil {
-                                timingDatagramSent = time.Now()
-                                log.Printf("Timing datagram sent, length %d byte(s).\n", numBytesOut)
-                            } else {
-                                log.Printf("Couldn't send timing datagram (%s).\n", err.Error())
-                            }
-                        }
-                    }
-                    fmt.Printf("[Connection to %s closed].\n", server.RemoteAddr().String())
-                }(currentServer)
             } else {
-                fmt.Fprintf(os.Stderr, "Error accepting connection (%s).\n", err.Error())
+                log.Printf("Can't cast *net.Conn to *net.TCPConn in order to set optimal read buffer size.\n")
             }
+            // Process datagrams received on the channel in another go routine
+            fmt.Printf("Connection made by %s.\n", currentServer.RemoteAddr().String())
+            ingestLocker.Lock()
+            startSession(time.Now())
+            ingestLocker.Unlock()
+            publishEvent(EVENT_CLIENT_CONNECTED, map[string]interface{}{"address": currentServer.RemoteAddr().String()})
+            go func(server net.Conn, done chan struct{}) {
+                var netErr net.Error
+                var framed int32
+                reason := "closed"
+                decoders := newDecoders()
+                decoders.Source = server.RemoteAddr().String()
+                reassembler := urtp.NewReassembler(&ServerUrtpHandler{decoders: decoders})
+                // Send any downlink audio while the connection lasts
+                go operateDownlink(server, done, &framed)
+                // Close the connection, so that the read below returns,
+                // when ctx is done; when mixing it may not be the
+                // current connection
+                go func() {
+                    select {
+                        case <-ctx.Done():
+                            server.Close()
+                        case <-done:
+                    }
+                }()
+                // Read packets until the connection is closed under us or
+                // goes quiet for too long
+                err := handleUrtpStream(reassembler, server, server, &framed, func() {
+                    if idleTimeout > 0 {
+                        server.SetReadDeadline(time.Now().Add(idleTimeout))
+                    }
+                })
+                if errors.As(err, &netErr) && netErr.Timeout() {
+                    // A client that has silently gone away (e.g. a
+                    // cellular drop) ends up here
+                    reason = "idle"
+                    log.Printf("No data from %s for %d second(s), assuming it has gone and closing the connection.\n",
+                               server.RemoteAddr().String(), idleTimeout / time.Second)
+                    server.Close()
+                    clientLost := new(ClientLost)
+                    clientLost.Address = server.RemoteAddr().String()
+                    clientLost.Idle = idleTimeout
+                    mainPipeline.Queue(clientLost)
+                }
+                fmt.Printf("[Connection to %s closed].\n", server.RemoteAddr().String())
+                publishEvent(EVENT_CLIENT_DISCONNECTED, map[string]interface{}{"address": server.RemoteAddr().String(), "reason": reason})
+                close(done)
+            }(currentServer, currentServerDone)
         }
-    } else {
-        fmt.Fprintf(os.Stderr, "Unable to listen for TCP connections on port %s (%s).\n", port, err.Error())
     }
 }
 
-// Run the server that receives the audio of Chuffs; this function should never return
-func operateAudioIn(port string) {
-    // Initialise the filters
-    FirInit(&deemphasis)
-    DeSquealFirInit(&desqueal)
+// Run the server that receives the audio of Chuffs, streamPorts being
+// the pipelines of any streams other than the main one, by the port on
+// which each is fed over UDP; this function returns once ctx is done
+// and the sockets have been closed
+func operateAudioIn(ctx context.Context, bindAddresses []string, port string, streamPorts map[string]*Pipeline,
+                    nack bool, fec bool, numUdpSockets uint, tcpIdleSeconds uint, tcpPolicy string) {
+    nackEnabled = nack
+    fecEnabled = fec
+
+    registerStats("client", clientStats)
+    registerStats("urtp", urtpStats)
+    registerBuiltInDecoders()
     
-    go udpServer(port)
-    tcpServer(port)
+    go udpServer(ctx, bindAddresses, port, int(numUdpSockets), mainPipeline)
+    for streamPort, pipeline := range streamPorts {
+        go udpServer(ctx, bindAddresses, streamPort, 1, pipeline)
+    }
+    tcpServer(ctx, bindAddresses, port, time.Duration(tcpIdleSeconds) * time.Second, tcpPolicy)
 }
@@ -17,9 +17,12 @@
 package main
 
 import (
+    "context"
+    "errors"
     "fmt"
     "log"
     "time"
+    "net"
     "net/http"
     "os"
     "path/filepath"
@@ -27,6 +30,7 @@ import (
     "sync"
     "container/list"
     "math"
+    "strings"
 )
 
 //--------------------------------------------------------------------
@@ -39,14 +43,54 @@ type Mp3AudioFile struct {
     title string
     timestamp time.Time
     duration time.Duration
+    // The bytes of the file, counted against the disk quota of the
+    // stream until it is removed
+    size int
     usable bool
     removable bool
+    markers []*Marker
+    // True once this segment has aged out of the live edge of the
+    // playlist, though it may still be in a DVR window
+    behindLive bool
+    // True if this segment doesn't follow on from the one before, e.g.
+    // because the encoder had to be recreated or the stream was reset
+    discontinuity bool
+}
+
+// Options for the format of playlists
+type PlaylistFormat struct {
+    DurationDecimalPlaces int
+    LineEnding string
+    AllowCache string
+    // The URI of the initialisation segment, if segments need one
+    // (see fmp4.go)
+    MapUri string
+}
+
+// The cross-domain (CORS) policy of the HTTP server
+type CorsPolicy struct {
+    // The origins (e.g. https://www.example.org) allowed to make
+    // cross-domain requests, any origin if empty
+    Origins []string
+    Methods string
+    Headers string
 }
 
 // Indication that we should reset the stream
 type Reset struct {
 }
 
+// Indication that the stream is shutting down; anything sent
+// on the media control channel before this has been dealt with
+type Shutdown struct {
+}
+
+// A label to be attached to the current point in the stream
+type Marker struct {
+    label string
+    timestamp time.Time
+}
+
 //--------------------------------------------------------------------
 // Constants
 //--------------------------------------------------------------------
@@ -55,39 +99,72 @@ type Reset struct {
 // where a browser should begin playing from the playlist
 const MAX_PLAY_LAG time.Duration = time.Second * 1
 
+// How long to wait for the final segment when shutting down and
+// then for HTTP requests in progress to complete
+const SHUTDOWN_TIMEOUT time.Duration = time.Second * 5
+
 //--------------------------------------------------------------------
 // Variables
 //--------------------------------------------------------------------
 
-// The control channel for media streaming out to users
-var MediaControlChannel chan<- interface{}
+// The format of playlists; some players are picky about these things
+var playlistFormat = PlaylistFormat{DurationDecimalPlaces: 6, LineEnding: "\r\n"}
 
-// List of output MP3 files
-var mp3FileList = list.New()
+// The cross-domain policy of the HTTP server
+var corsPolicy = CorsPolicy{Methods: "GET, POST, DELETE, OPTIONS", Headers: "Content-Type, X-Requested-With"}
 
 //--------------------------------------------------------------------
 // Functions
 //--------------------------------------------------------------------
 
-// Add the cross-domain items to a response
+// Return the origin that a request may be allowed cross-domain by
+// the CORS policy, "" if it may not
+func allowedCrossDomainOrigin(in *http.Request) string {
+    if len(corsPolicy.Origins) == 0 {
+        return "*"
+    }
+    origin := in.Header.Get("Origin")
+    for _, allowed := range corsPolicy.Origins {
+        if (allowed == "*") || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+            return origin
+        }
+    }
+
+    return ""
+}
+
+// Add the cross-domain items to a response, as the CORS policy allows
+// for the origin of the request
 // The options allowed are taken from:
 // https://metajack.im/2010/01/19/crossdomain-ajax-for-xmpp-http-binding-made-easy/
-func addCrossDomainToResponse(out http.ResponseWriter) {
-    out.Header().Set("Access-Control-Allow-Origin", "*")
-    out.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-    out.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Requested-With")
-    out.Header().Set("Access-Control-Max-Age", "86400")
+func addCrossDomainToResponse(out http.ResponseWriter, in *http.Request) {
+    if len(corsPolicy.Origins) > 0 {
+        out.Header().Add("Vary", "Origin")
+    }
+    origin := allowedCrossDomainOrigin(in)
+    if origin != "" {
+        out.Header().Set("Access-Control-Allow-Origin", origin)
+        out.Header().Set("Access-Control-Allow-Methods", corsPolicy.Methods)
+        out.Header().Set("Access-Control-Allow-Headers", corsPolicy.Headers)
+        out.Header().Set("Access-Control-Max-Age", "86400")
+    }
 }
 
-// Capture a cross-domain browsing OPTIONS request and allow it, returning
-// true if this was a cross domain request.
+// Capture a cross-domain browsing OPTIONS request and allow it, if
+// the CORS policy allows its origin, returning true if this was a
+// cross domain request.
 func filterCrossDomainRequest(out http.ResponseWriter, in *http.Request) bool {
     var isCrossDomainRequest bool
 
     if (in.Method == "OPTIONS") {
-        log.Printf("Received OPTIONS request from (%s), allowing it.\n", in.URL)
-        addCrossDomainToResponse(out)
-        out.WriteHeader(http.StatusOK)
+        addCrossDomainToResponse(out, in)
+        if allowedCrossDomainOrigin(in) != "" {
+            log.Printf("Received OPTIONS request from (%s), allowing it.\n", in.URL)
+            out.WriteHeader(http.StatusOK)
+        } else {
+            log.Printf("Received OPTIONS request from (%s), origin \"%s\" is not allowed.\n", in.URL, in.Header.Get("Origin"))
+            out.WriteHeader(http.StatusForbidden)
+        }
         isCrossDomainRequest = true
     }
 
@@ -103,22 +180,41 @@ func ukTimeIso8601(timestamp time.Time) string {
 // Make a playlist that could be written to file or served to HTTP
 // See https://en.wikipedia.org/wiki/M3U
 // and, in much more detail, https://tools.ietf.org/html/draft-pantos-http-live-streaming-23#section-4
-func makePlaylist(playlist *[]byte, playlistLocker *sync.Mutex, mediaSequenceNumber int, fileName string) (time.Duration, error) {
+// discontinuitySequence is the number of discontinuities that have
+// gone out of the playlist; playlistType, if not empty, is the value
+// of EXT-X-PLAYLIST-TYPE (e.g. "EVENT") and endList is true if the
+// stream has stopped, no more segments being added to the playlist.
+func makePlaylist(fileList *list.List, playlist *[]byte, playlistLocker *sync.Mutex, mediaSequenceNumber int, discontinuitySequence int, playlistType string, endList bool, fileName string) (time.Duration, error) {
     var maxSegmentDuration time.Duration
     var numSegments int
     var segmentData bytes.Buffer
     var data bytes.Buffer
     var totalDuration time.Duration
+    var eol string = playlistFormat.LineEnding
+    var decimals int = playlistFormat.DurationDecimalPlaces
 
     // Go through all of the MP3 files, assembling the segment
     // list and working out the dynamic header values
-    for newElement := mp3FileList.Front(); newElement != nil; newElement = newElement.Next() {
+    for newElement := fileList.Front(); newElement != nil; newElement = newElement.Next() {
         if newElement.Value.(*Mp3AudioFile).usable {
             numSegments++
-            fmt.Fprintf(&segmentData, "#EXT-X-FRESH-IS-COMING\r\n")
-            fmt.Fprintf(&segmentData, "#EXTINF:%f, %s\r\n", float32(newElement.Value.(*Mp3AudioFile).duration) / float32(time.Second),
-                        newElement.Value.(*Mp3AudioFile).title)
-            fmt.Fprintf(&segmentData, "%s\r\n", newElement.Value.(*Mp3AudioFile).fileName)
+            if newElement.Value.(*Mp3AudioFile).discontinuity {
+                fmt.Fprintf(&segmentData, "#EXT-X-DISCONTINUITY%s", eol)
+            }
+            if len(newElement.Value.(*Mp3AudioFile).markers) > 0 {
+                // Date ranges need the date of the segment they are in
+                fmt.Fprintf(&segmentData, "#EXT-X-PROGRAM-DATE-TIME:%s%s",
+                            ukTimeIso8601(newElement.Value.(*Mp3AudioFile).timestamp.Add(-newElement.Value.(*Mp3AudioFile).duration)), eol)
+                for _, marker := range newElement.Value.(*Mp3AudioFile).markers {
+                    fmt.Fprintf(&segmentData, "#EXT-X-DATERANGE:ID=\"marker-%d\",START-DATE=\"%s\",X-COM-CHUFFS-LABEL=\"%s\"%s",
+                                marker.timestamp.UnixNano(), ukTimeIso8601(marker.timestamp), strings.Replace(marker.label, "\"", "'", -1), eol)
+                }
+            }
+            fmt.Fprintf(&segmentData, "#EXT-X-FRESH-IS-COMING%s", eol)
+            fmt.Fprintf(&segmentData, "#EXTINF:%.*f, %s%s", decimals, float32(newElement.Value.(*Mp3AudioFile).duration) / float32(time.Second),
+                        newElement.Value.(*Mp3AudioFile).title, eol)
+            segmentPath := filepath.Join(filepath.Dir(fileName), newElement.Value.(*Mp3AudioFile).fileName)
+            fmt.Fprintf(&segmentData, "%s%s", segmentStore.Uri(segmentPath), eol)
             totalDuration += newElement.Value.(*Mp3AudioFile).duration
             if maxSegmentDuration < newElement.Value.(*Mp3AudioFile).duration {
                 maxSegmentDuration = newElement.Value.(*Mp3AudioFile).duration
@@ -127,18 +223,38 @@ func makePlaylist(playlist *[]byte, playlistLocker *sync.Mutex, mediaSequenceNum
     }
 
     // Write the fixed header
-    fmt.Fprintf(&data, "#EXTM3U\r\n")
-    fmt.Fprintf(&data, "#EXT-X-VERSION:3\r\n")
+    fmt.Fprintf(&data, "#EXTM3U%s", eol)
+    if playlistFormat.MapUri != "" {
+        // EXT-X-MAP outside an I-frame playlist needs version 6
+        fmt.Fprintf(&data, "#EXT-X-VERSION:6%s", eol)
+    } else {
+        fmt.Fprintf(&data, "#EXT-X-VERSION:3%s", eol)
+    }
+    if playlistFormat.AllowCache != "" {
+        fmt.Fprintf(&data, "#EXT-X-ALLOW-CACHE:%s%s", playlistFormat.AllowCache, eol)
+    }
+    if playlistType != "" {
+        fmt.Fprintf(&data, "#EXT-X-PLAYLIST-TYPE:%s%s", playlistType, eol)
+    }
     if numSegments > 0 {
         // Write the dynamic header fields
-        fmt.Fprintf(&data, "#EXT-X-TARGETDURATION:%d\r\n", int(math.Ceil(float64(maxSegmentDuration) / float64(time.Second))))
-        fmt.Fprintf(&data, "#EXT-X-MEDIA-SEQUENCE:%d\r\n", mediaSequenceNumber)
+        fmt.Fprintf(&data, "#EXT-X-TARGETDURATION:%d%s", int(math.Ceil(float64(maxSegmentDuration) / float64(time.Second))), eol)
+        fmt.Fprintf(&data, "#EXT-X-MEDIA-SEQUENCE:%d%s", mediaSequenceNumber, eol)
+        if discontinuitySequence > 0 {
+            fmt.Fprintf(&data, "#EXT-X-DISCONTINUITY-SEQUENCE:%d%s", discontinuitySequence, eol)
+        }
+        if playlistFormat.MapUri != "" {
+            fmt.Fprintf(&data, "#EXT-X-MAP:URI=\"%s\"%s", playlistFormat.MapUri, eol)
+        }
         if totalDuration > MAX_PLAY_LAG {
-            fmt.Fprintf(&data, "#EXT-X-START:TIME-OFFSET=-%f\r\n", float32(MAX_PLAY_LAG) / float32(time.Second))
+            fmt.Fprintf(&data, "#EXT-X-START:TIME-OFFSET=-%.*f%s", decimals, float32(MAX_PLAY_LAG) / float32(time.Second), eol)
         }
         // Write the segment files
         segmentData.WriteTo(&data)
     }
+    if endList {
+        fmt.Fprintf(&data, "#EXT-X-ENDLIST%s", eol)
+    }
 
     playlistLocker.Lock()
     
@@ -166,8 +282,8 @@ func homeHandler (out http.ResponseWriter, in *http.Request, newPath string) {
     log.Printf("Home handler was asked for \"%s\", redirecting to \"%s\"...\n", in.URL.Path, newPath)
     // Stop caching
     stopCache(out)
-    // Redirect
-    http.Redirect(out, in, newPath, http.StatusFound)
+    // Redirect, keeping any signature
+    http.Redirect(out, in, signUri(newPath, signedQuery(in, urlSecret)), http.StatusFound)
 }
 
 // Stop caching
@@ -179,28 +295,47 @@ func stopCache(out http.ResponseWriter) {
 }
 
 // Handle a stream request
-func streamHandler(out http.ResponseWriter, in *http.Request, playlist *[]byte, playlistLocker *sync.Mutex) {
+func streamHandler(out http.ResponseWriter, in *http.Request, playlistName string, playlist *[]byte, playlistLocker *sync.Mutex) {
     var ext string = filepath.Ext(in.URL.Path)
 
     log.Printf("Stream handler was asked for \"%s\"...\n", in.URL.Path)
+    if !allowSignedUrl(out, in) {
+        return
+    }
+    if (mainPipeline != nil) && ((ext == PLAYLIST_EXTENSION) || (segmentContentType(ext) != "")) {
+        var allowed bool
+        out, allowed = listenerTracker.track(out, in, mainPipeline.Name, ext == PLAYLIST_EXTENSION)
+        if !allowed {
+            return
+        }
+    }
     if ext == PLAYLIST_EXTENSION {
         out.Header().Set("Content-Type","application/x-mpegurl")
-        if (playlist != nil) && (playlistLocker != nil) {
+        if (playlist != nil) && (playlistLocker != nil) && (filepath.Base(in.URL.Path) == playlistName) {
             // Serve the playlist from the buffer
             playlistLocker.Lock()
             log.Printf("Serving playlist from buffer (%d byte(s)).\n", len(*playlist))
-            http.ServeContent(out, in, filepath.Base(in.URL.Path), time.Time{}, bytes.NewReader(*playlist))
+            http.ServeContent(out, in, filepath.Base(in.URL.Path), time.Time{}, bytes.NewReader(signPlaylist(*playlist, in, urlSecret)))
             playlistLocker.Unlock()
+        } else if urlSecret != nil {
+            // Serve the playlist file requested, signed
+            log.Printf("Serving signed playlist file \"%s\".\n", in.URL.Path)
+            data, err := os.ReadFile(in.URL.Path)
+            if err != nil {
+                http.NotFound(out, in)
+                return
+            }
+            http.ServeContent(out, in, filepath.Base(in.URL.Path), time.Time{}, bytes.NewReader(signPlaylist(data, in, urlSecret)))
         } else {
             // Serve the playlist file requested
             log.Printf("Serving playlist file \"%s\".\n", in.URL.Path)
             http.ServeFile(out, in, in.URL.Path)
         }
-    } else if ext == SEGMENT_EXTENSION {
+    } else if contentType := segmentContentType(ext); contentType != "" {
         // Serve the requested segment
         log.Printf("Serving segment file \"%s\".\n", in.URL.Path)
-        http.ServeFile(out, in, in.URL.Path)
-        out.Header().Set("Content-Type","audio/mpeg")
+        out.Header().Set("Content-Type", contentType)
+        serveSegmentFile(out, in, in.URL.Path)
     } else {
         // Just serve the requested page
         log.Printf("Serving \"%s\".\n", in.URL.Path)
@@ -211,31 +346,59 @@ func streamHandler(out http.ResponseWriter, in *http.Request, playlist *[]byte,
     stopCache(out)
 }
 
-// Start HTTP server for streaming output; this function should never return
-func operateAudioOut(port string, playlistPath string, playlistLengthSeconds uint) {
-    var channel = make(chan interface{})
-    var err error
-    var mp3Dir string
-    var mediaSequenceNumber int
-    var mp3UsableAge time.Duration = time.Second * time.Duration(playlistLengthSeconds)
-    var mp3RemovableAge time.Duration = mp3UsableAge * 2
-    var playlist []byte
-    var playlistLocker sync.Mutex
-    var mp3FileListLocker sync.Mutex
+// Return the duration of the segments in the live edge of a playlist
+func liveDuration(fileList *list.List) time.Duration {
+    var duration time.Duration
 
-    streamTicker := time.NewTicker(time.Millisecond * 100)
-    mux := http.NewServeMux()
+    for element := fileList.Front(); element != nil; element = element.Next() {
+        if element.Value.(*Mp3AudioFile).usable && !element.Value.(*Mp3AudioFile).behindLive {
+            duration += element.Value.(*Mp3AudioFile).duration
+        }
+    }
 
-    MediaControlChannel = channel
+    return duration
+}
 
-    // Initialise the linked list of MP3 output files
-    mp3FileList.Init()
+// Keep the playlist of a pipeline, of up to playlistLengthSeconds,
+// until the pipeline is shut down, at which point the final playlist
+// is written and the pipeline's finished channel is closed.  If
+// dvrWindow is longer than that, segments stay in the playlist, an
+// EVENT playlist, for dvrWindow, so that listeners can pause and
+// rewind, though the live edge, from which the depth of the output
+// buffer is measured, is still playlistLengthSeconds long.
+func operatePlaylist(pipeline *Pipeline, playlistLengthSeconds uint, dvrWindow time.Duration) {
+    var mediaSequenceNumber int
+    var discontinuitySequence int
+    // True if the next segment is the first since the stream was reset
+    var resetDiscontinuity bool
+    var mp3UsableAge time.Duration = time.Second * time.Duration(playlistLengthSeconds)
+    var pendingMarkers []*Marker
+    var playlistType string
+    var mp3Dir = pipeline.Dir
+    var playlistPath = pipeline.PlaylistPath
+    var mp3FileList = pipeline.fileList
+    var channel = pipeline.media
+
+    // How long a segment stays in the playlist and how long it stays
+    // on disk, players being given as long again to finish with it
+    playlistAge := func() time.Duration {
+        if dvrWindow > mp3UsableAge {
+            return dvrWindow
+        }
+        return mp3UsableAge
+    }
+    removableAge := func() time.Duration {
+        return playlistAge() + mp3UsableAge
+    }
+    if dvrWindow > 0 {
+        playlistType = "EVENT"
+    }
 
-    // Set up the MP3 directory
-    mp3Dir = filepath.Dir(playlistPath)
+    streamTicker := time.NewTicker(time.Millisecond * 100)
+    streamTickerMonitor := newTickerMonitor(pipeline.statsName("stream"), time.Millisecond * 100)
 
     // Create an initial (empty) playlist file
-    _, err = makePlaylist(&playlist, &playlistLocker, mediaSequenceNumber, playlistPath)
+    _, err := makePlaylist(mp3FileList, &pipeline.playlist, &pipeline.playlistLocker, mediaSequenceNumber, discontinuitySequence, playlistType, false, playlistPath)
     if err != nil {
         fmt.Fprintf(os.Stderr, "Unable to create playlist file \"%s\" (%s).\n", playlistPath, err.Error())
         os.Exit(-1)
@@ -244,28 +407,35 @@ func operateAudioOut(port string, playlistPath string, playlistLengthSeconds uin
     // Timed function to perform operations on the stream
     go func() {
         for _ = range streamTicker.C {
+            streamTickerMonitor.Tick(time.Now())
             // Go through the file list and mark old files as unusable, then removable,
             // and attempt to delete removable files as we go
-            mp3FileListLocker.Lock()
+            pipeline.fileListLocker.Lock()
             var next *list.Element
             for newElement := mp3FileList.Front(); newElement != nil; newElement = next {
                 next = newElement.Next(); // Get the next value for the following iteration
                                           // as a Remove() would cause newElement.next()
                                           // to return nil
-                if (newElement.Value.(*Mp3AudioFile).usable) && (time.Now().Sub(newElement.Value.(*Mp3AudioFile).timestamp) > mp3UsableAge) {
+                if (newElement.Value.(*Mp3AudioFile).usable) && (time.Now().Sub(newElement.Value.(*Mp3AudioFile).timestamp) > playlistAge()) {
                     newElement.Value.(*Mp3AudioFile).usable = false;
                     mediaSequenceNumber++;
+                    if newElement.Value.(*Mp3AudioFile).discontinuity {
+                        discontinuitySequence++
+                    }
                     log.Printf ("MP3 file \"%s\", received at %s, no longer usable (time now is %s).\n",
                                 newElement.Value.(*Mp3AudioFile).fileName, newElement.Value.(*Mp3AudioFile).timestamp.String(),
                                 time.Now().String())
-                    buffered, _ := makePlaylist(&playlist, &playlistLocker, mediaSequenceNumber, playlistPath)
+                    makePlaylist(mp3FileList, &pipeline.playlist, &pipeline.playlistLocker, mediaSequenceNumber, discontinuitySequence, playlistType, false, playlistPath)
+                }
+                if (!newElement.Value.(*Mp3AudioFile).behindLive) && (time.Now().Sub(newElement.Value.(*Mp3AudioFile).timestamp) > mp3UsableAge) {
+                    newElement.Value.(*Mp3AudioFile).behindLive = true
                     // Let the processing channel know of our buffer depth
                     outputBufferState := new(OutputBufferState)
-                    outputBufferState.Buffered = buffered
+                    outputBufferState.Buffered = liveDuration(mp3FileList)
                     outputBufferState.BufferSize = mp3UsableAge;
-                    ProcessDatagramsChannel <- outputBufferState
+                    pipeline.Queue(outputBufferState)
                 }
-                if (!newElement.Value.(*Mp3AudioFile).usable) && (time.Now().Sub(newElement.Value.(*Mp3AudioFile).timestamp) > mp3RemovableAge) {
+                if (!newElement.Value.(*Mp3AudioFile).usable) && (time.Now().Sub(newElement.Value.(*Mp3AudioFile).timestamp) > removableAge()) {
                     newElement.Value.(*Mp3AudioFile).removable = true;
                     log.Printf ("MP3 file \"%s\", received at %s, can now been deleted (time now is %s).\n",
                                 newElement.Value.(*Mp3AudioFile).fileName, newElement.Value.(*Mp3AudioFile).timestamp.String(),
@@ -273,13 +443,14 @@ func operateAudioOut(port string, playlistPath string, playlistLengthSeconds uin
                 }
                 if newElement.Value.(*Mp3AudioFile).removable {
                     filePath := mp3Dir + string(os.PathSeparator) + newElement.Value.(*Mp3AudioFile).fileName
-                    if os.Remove(filePath) == nil {
+                    if removeSegmentFile(filePath) == nil {
                         log.Printf ("MP3 file \"%s\" successfully deleted and will be removed from the list.\n", filePath)
+                        pipeline.quota.FreeDisk(newElement.Value.(*Mp3AudioFile).size)
                         mp3FileList.Remove(newElement)
                     }
                 }
             }
-            mp3FileListLocker.Unlock()
+            pipeline.fileListLocker.Unlock()
         }
     }()
 
@@ -291,57 +462,223 @@ func operateAudioOut(port string, playlistPath string, playlistLengthSeconds uin
                 case *Mp3AudioFile:
                 {
                     log.Printf("Adding new MP3 file \"%s\", duration %d millisecond(s), to the FIFO list...\n", message.fileName, int(message.duration / time.Millisecond))
+                    message.markers = append(message.markers, pendingMarkers...)
+                    pendingMarkers = nil
+                    if resetDiscontinuity {
+                        message.discontinuity = true
+                        resetDiscontinuity = false
+                    }
+                    pipeline.fileListLocker.Lock()
                     mp3FileList.PushBack(message)
-                    makePlaylist(&playlist, &playlistLocker, mediaSequenceNumber, playlistPath)
+                    pipeline.fileListLocker.Unlock()
+                    makePlaylist(mp3FileList, &pipeline.playlist, &pipeline.playlistLocker, mediaSequenceNumber, discontinuitySequence, playlistType, false, playlistPath)
+                }
+                case *Marker:
+                {
+                    // Markers go into the next segment to be published
+                    log.Printf("Marker \"%s\" will be added to the next segment.\n", message.label)
+                    pendingMarkers = append(pendingMarkers, message)
+                }
+                case *PlaylistLength:
+                {
+                    log.Printf("Playlist length is now %d second(s).\n", message.Seconds)
+                    pipeline.fileListLocker.Lock()
+                    mp3UsableAge = time.Second * time.Duration(message.Seconds)
+                    pipeline.fileListLocker.Unlock()
                 }
                 case *Reset:
                 {
                     log.Printf("Resetting the stream.\n")
-                    // Remove all the files
-                    mp3FileListLocker.Lock()
-                    var next *list.Element
-                    for newElement := mp3FileList.Front(); newElement != nil; newElement = next {
-                        next = newElement.Next(); // Get the next value for the following iteration
-                                                  // as a Remove() would cause newElement.next()
-                                                  // to return nil
-                        filePath := mp3Dir + string(os.PathSeparator) + newElement.Value.(*Mp3AudioFile).fileName
-                        if os.Remove(filePath) == nil {
-                            log.Printf ("MP3 file \"%s\" successfully deleted and will be removed from the list.\n", filePath)
-                            mp3FileList.Remove(newElement)
+                    // The stream has stopped: the playlist is ended, so
+                    // that players stop cleanly, and stays so until there
+                    // is a new segment.  The files in it are taken out
+                    // of it, the sequence numbers carrying on as if they
+                    // had aged out, but are left for players to finish
+                    // with and are deleted as usual.  The next segment
+                    // is marked as a discontinuity so that a player
+                    // holding on to the old playlist picks up the new
+                    // one cleanly
+                    pipeline.fileListLocker.Lock()
+                    makePlaylist(mp3FileList, &pipeline.playlist, &pipeline.playlistLocker, mediaSequenceNumber, discontinuitySequence, playlistType, true, playlistPath)
+                    for newElement := mp3FileList.Front(); newElement != nil; newElement = newElement.Next() {
+                        if newElement.Value.(*Mp3AudioFile).usable {
+                            newElement.Value.(*Mp3AudioFile).usable = false
+                            mediaSequenceNumber++
+                            if newElement.Value.(*Mp3AudioFile).discontinuity {
+                                discontinuitySequence++
+                            }
                         }
+                        newElement.Value.(*Mp3AudioFile).behindLive = true
                     }
-                    mp3FileListLocker.Unlock()
-                    mediaSequenceNumber = 0;
-                    playlist = nil
-                    makePlaylist(&playlist, &playlistLocker, mediaSequenceNumber, playlistPath)
+                    pipeline.fileListLocker.Unlock()
+                    resetDiscontinuity = true
+                }
+                case *Shutdown:
+                {
+                    // The final segment, if there was one, has been added:
+                    // write the final playlist, which is ended
+                    log.Printf("Writing final playlist.\n")
+                    streamTicker.Stop()
+                    makePlaylist(mp3FileList, &pipeline.playlist, &pipeline.playlistLocker, mediaSequenceNumber, discontinuitySequence, playlistType, true, playlistPath)
+                    close(pipeline.finished)
                 }
             }
         }
-        fmt.Printf("HTTP streaming channel closed, stopping.\n")
+        fmt.Printf("Media channel of stream \"%s\" closed, stopping.\n", pipeline.Name)
     }()
+}
+
+// Start HTTP server for streaming output, playlistPath being that of
+// the main stream; this function returns once ctx is done and the
+// final playlist of every pipeline has been written
+func operateAudioOut(ctx context.Context, bindAddresses []string, port string, playlistPath string) {
+    var err error
+    var mp3Dir = filepath.Dir(playlistPath)
+
+    mux := http.NewServeMux()
+    server := &http.Server{Handler: mux}
 
     // Set up the HTTP page handlers
     mux.HandleFunc("/", func(out http.ResponseWriter, in *http.Request) {
         if !filterCrossDomainRequest(out, in) {
-            addCrossDomainToResponse(out)
+            addCrossDomainToResponse(out, in)
             homeHandler(out, in, mp3Dir)
         }
     })
+    mux.HandleFunc("/clip", func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) {
+            addCrossDomainToResponse(out, in)
+            if allowSignedUrl(out, in) {
+                clipHandler(out, in, mp3Dir)
+            }
+        }
+    })
+    mux.HandleFunc("/chuffs", func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) {
+            addCrossDomainToResponse(out, in)
+            if allowSignedUrl(out, in) {
+                chuffsHandler(out, in)
+            }
+        }
+    })
+    mux.HandleFunc("/chuffs/", func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) {
+            addCrossDomainToResponse(out, in)
+            if allowSignedUrl(out, in) {
+                chuffsHandler(out, in)
+            }
+        }
+    })
     mux.HandleFunc(mp3Dir + "/", func(out http.ResponseWriter, in *http.Request) {
         if !filterCrossDomainRequest(out, in) {
-            addCrossDomainToResponse(out)
-            streamHandler(out, in, &playlist, &playlistLocker)
+            addCrossDomainToResponse(out, in)
+            streamHandler(out, in, filepath.Base(playlistPath), &mainPipeline.playlist, &mainPipeline.playlistLocker)
+        }
+    })
+    for _, path := range []string{WHEP_PATH, WHEP_PATH + "/"} {
+        mux.HandleFunc(path, func(out http.ResponseWriter, in *http.Request) {
+            if !filterCrossDomainRequest(out, in) {
+                addCrossDomainToResponse(out, in)
+                if allowSignedUrl(out, in) {
+                    whepHandler(out, in)
+                }
+            }
+        })
+    }
+    mux.HandleFunc(LIVE_WS_PATH, func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) && allowSignedUrl(out, in) {
+            liveWsHandler(out, in)
+        }
+    })
+    mux.HandleFunc(SSE_PATH, func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) {
+            addCrossDomainToResponse(out, in)
+            eventStreamHandler(out, in)
+        }
+    })
+    mux.HandleFunc(STATS_API_PATH, func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) {
+            addCrossDomainToResponse(out, in)
+            statsApiHandler(out, in)
+        }
+    })
+    mux.HandleFunc(SEGMENT_TUNE_BUFFERING_PATH, func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) {
+            addCrossDomainToResponse(out, in)
+            bufferingHandler(out, in)
+        }
+    })
+    mux.HandleFunc(STREAM_PATH_PREFIX, func(out http.ResponseWriter, in *http.Request) {
+        if !filterCrossDomainRequest(out, in) {
+            addCrossDomainToResponse(out, in)
+            pipelineHandler(out, in)
         }
     })
 
-    fmt.Printf("Starting HTTP server for Chuff requests on port %s.\n", port)
+    // Stop the HTTP server once the final playlists have been written
+    go func() {
+        <-ctx.Done()
+        fmt.Printf("Shutting down.\n")
+        systemdNotifier.Stopping()
+        var waitFor []*Pipeline
+        timeout := time.After(SHUTDOWN_TIMEOUT)
+        pipelinesLocker.Lock()
+        for _, pipeline := range pipelines {
+            waitFor = append(waitFor, pipeline)
+        }
+        pipelinesLocker.Unlock()
+        for _, pipeline := range waitFor {
+            select {
+                case <-pipeline.finished:
+                case <-timeout:
+                    log.Printf("Audio processing of stream \"%s\" didn't finish within %d ms, stopping anyway.\n",
+                               pipeline.Name, SHUTDOWN_TIMEOUT / time.Millisecond)
+            }
+        }
+        if eventStream != nil {
+            eventStream.Close()
+        }
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+        err := server.Shutdown(shutdownCtx)
+        if err != nil {
+            log.Printf("HTTP server didn't shut down cleanly (%s).\n", err.Error())
+        }
+        cancel()
+    }()
 
-    // Start the HTTP server (should block)
-    //err = http.ListenAndServeTLS(":" + port, "cert.pem", "privkey.pem", mux)
-    err = http.ListenAndServe(":" + port, mux)
+    fmt.Printf("Starting HTTP server for Chuff requests on port %s.\n", port)
+    if (httpsOut != nil) && (httpsOut.RedirectPort != "") {
+        httpsOut.operateRedirect(ctx, bindAddresses, port)
+    }
 
-    if err != nil {
-        fmt.Fprintf(os.Stderr, "Could not start HTTP server (%s).\n", err.Error())
+    // Start the HTTP server on all the addresses (blocks until shut down)
+    serveErrors := make(chan error)
+    numListening := 0
+    for _, bindAddress := range bindAddressesOrAll(bindAddresses) {
+        network, address := listenNetworkAndAddress("tcp", bindAddress, port)
+        listener, err := net.Listen(network, address)
+        if err == nil {
+            fmt.Printf("HTTP server listening on %s (%s).\n", listener.Addr().String(), network)
+            numListening++
+            go func(listener net.Listener) {
+                if httpsOut != nil {
+                    serveErrors <- httpsOut.serve(server, listener)
+                } else {
+                    serveErrors <- server.Serve(listener)
+                }
+            }(listener)
+        } else {
+            fmt.Fprintf(os.Stderr, "Could not start HTTP server on %s (%s).\n", address, err.Error())
+        }
+    }
+    if numListening > 0 {
+        systemdNotifier.Listening(SYSTEMD_LISTENER_HTTP)
+        err = <-serveErrors
+        if errors.Is(err, http.ErrServerClosed) {
+            fmt.Printf("HTTP server stopped.\n")
+        } else {
+            fmt.Fprintf(os.Stderr, "HTTP server stopped (%s).\n", err.Error())
+        }
     }
 }
 
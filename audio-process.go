@@ -13,18 +13,18 @@
 package main
 
 import (
+    "context"
     "fmt"
+    "io"
     "log"
     "time"
     "os"
     "path/filepath"
-    "io/ioutil"
-    "container/list"
     "bytes"
     "encoding/binary"
     "errors"
     "sync"
-    "github.com/RobMeades/ioc-server/lame"
+    "sync/atomic"
 //    "encoding/hex"
 )
 
@@ -32,26 +32,64 @@ import (
 // Types
 //--------------------------------------------------------------------
 
+// Settings for an MP3 writer; zero values mean the defaults
+type Mp3Settings struct {
+    Bitrate            int
+    Scale              float32
+    LowPassFrequency   int
+    HighPassFrequency  int
+    // The LAME quality plus one, 1 (best) to 10 (fastest), so that
+    // zero means the default
+    Quality            int
+}
+
 // Structure to represent the state of the audio output buffer
-// that we are feeding at MediaControlChannel.
+// that we are feeding through the media channel of a pipeline.
 type OutputBufferState struct {
     Buffered     time.Duration
     BufferSize   time.Duration
 }
 
+// Indication that a heartbeat datagram has arrived: the link to
+// the client is alive even though there's no audio
+type Heartbeat struct {
+    Received     time.Time
+}
+
+// Indication that the client has gone quiet and its connection
+// has been closed
+type ClientLost struct {
+    Address      string
+    Idle         time.Duration
+}
+
 //--------------------------------------------------------------------
 // Constants
 //--------------------------------------------------------------------
 
-// How big the processedDatagramsList can become
-const NUM_PROCESSED_DATAGRAMS int = 1
+// How often to try to recover a failed output stream
+const OUTPUT_RECOVERY_PERIOD time.Duration = time.Second
+
+// The number of messages that the processing channel of a pipeline
+// can hold: ten seconds of datagrams
+const PROCESS_DATAGRAMS_QUEUE_SIZE int = 10000 / BLOCK_DURATION_MS
 
-// Guard against silly sequence number gaps
+// The number of newly arrived datagrams that can wait for the
+// processing loop, the same as the processing channel
+const NEW_DATAGRAMS_SIZE int = PROCESS_DATAGRAMS_QUEUE_SIZE
+
+// The number of messages other than datagrams (the state of the output
+// buffer, lost clients) that the processing of a pipeline can hold
+const PROCESS_CONTROL_QUEUE_SIZE int = 100
+
+// Guard against silly sequence number gaps: the default for the
+// longest gap that is filled
 const MAX_GAP_FILL_MILLISECONDS int = 500
 
-// The minimum size that we allow the buffered audio
-// in MediaControlChannel to get to
-const MIN_OUTPUT_BUFFERED_AUDIO time.Duration = time.Millisecond * 1000
+// A gap between URTP timestamps (which are in microseconds) of no more
+// than this is taken to be jitter in the client's timestamps rather
+// than missing audio
+const GAP_TIMESTAMP_TOLERANCE_MICROSECONDS uint64 = 1000
 
 // The track title to use
 const MP3_TITLE string = "Internet of Chuffs"
@@ -63,12 +101,6 @@ const MP3_ID3_TAG_TIMESTAMP_LEN int = 8
 // Variables
 //--------------------------------------------------------------------
 
-// The channel that processes incoming datagrams
-var ProcessDatagramsChannel chan<- interface{}
-
-// An audio buffer to hold raw PCM samples received from the client
-var pcmAudio bytes.Buffer
-
 // Prefix that represents the fixed portion of a "PRIV" ID3 tag to put at the start of a
 // segment file, see https://tools.ietf.org/html/draft-pantos-http-live-streaming-23#section-3.4
 // and http://id3.org/id3v2.3.0#ID3v2_overview
@@ -99,164 +131,263 @@ var id3Prefix string = "ID3\x04\x00\x00\x00\x00\x00\x3fPRIV\x00\x00\x00\x35\x00\
 // Functions
 //--------------------------------------------------------------------
 
-// Open an MP3 file
-func openMp3File(dirName string) *os.File {
-    handle, err := ioutil.TempFile (dirName, "")
-    if err == nil {
-        filePath := handle.Name()
-        handle.Close()
-        if os.Rename(filePath, filePath + SEGMENT_EXTENSION) == nil {
-            handle, err = os.Create(filePath + SEGMENT_EXTENSION)
-            log.Printf("Opened segment file \"%s\" for MP3 output.\n", handle.Name())
-        } else {
-            log.Printf("Unable to rename temporary file \"%s\" to \"%s\".\n", filePath, filePath + SEGMENT_EXTENSION)
-        }
+// Handle a gap of a given number of samples in the input data
+func (pipeline *Pipeline) handleGap(gap int) {
+    log.Printf("Handling a gap of %d samples...\n", gap)
+    filled := pipeline.gaps.Record(gap, time.Now())
+    publishEvent(EVENT_GAP, map[string]interface{}{"samples": gap, "filled": filled})
+    if filled {
+        log.Printf("Writing %d bytes to the audio buffer...\n", gap * URTP_SAMPLE_SIZE * streamChannels)
+        pipeline.pcm.WriteSamples(pipeline.slowDown.Process(pipeline.concealer.Conceal(gap)))
     } else {
-        log.Printf("Unable to create segment file for MP3 output in directory \"%s\".\n", dirName)
+        log.Printf("Ignored a silly gap.\n")
     }
-
-    return handle
 }
 
-// Create an MP3 writer
-func createMp3Writer(mp3Audio *bytes.Buffer) (*lame.LameWriter, int) {
-    var mp3SamplesPerFrame int
-    // Initialise the MP3 encoder.  This is equivalent to:
-    // lame -V2 -r -s 16000 -m m --bitwidth 16 <input file> <output file>
-    mp3Writer := lame.NewWriter(mp3Audio)
-    if mp3Writer != nil {
-        mp3Writer.Encoder.SetInSamplerate(SAMPLING_FREQUENCY)
-        mp3Writer.Encoder.SetNumChannels(1)
-        mp3Writer.Encoder.SetMode(lame.MONO)
-        // VBR writes tags into the file which makes
-        // hls.js think the file isn't an MP3 file (as
-        // the first MP3 header must appear within the
-        // first 100 bytes of the file).  So don't do that.
-        mp3Writer.Encoder.SetVBR(lame.VBR_OFF)
-        // The encode keeps 4 bits free in case of rapid gain
-        // changes; some of that loss can be recovered here
-        mp3Writer.Encoder.SetScale(7)
-        // Disabling the bit reservoir reduces quality
-        // but allows consecutive MP3 files to be butted
-        // up together without any gaps
-        mp3Writer.Encoder.DisableReservoir()
-        mp3Writer.Encoder.SetGenre("144") // Thrash metal
-        // Note: bit depth defaults to 16
-        if mp3Writer.Encoder.InitParams() >= 0 {
-            mp3SamplesPerFrame = mp3Writer.Encoder.GetMp3FrameSize()
-            log.Printf("Created MP3 writer, MP3 frame size is %d samples, encoder delay is %d samples.\n",
-                       mp3SamplesPerFrame, mp3Writer.Encoder.GetEncoderDelay())
-        } else {
-            mp3Writer.Close()
-            mp3Writer = nil
-            log.Printf("Unable to initialise MP3 writer.\n")
-        }
-    } else {
-        log.Printf("Unable to instantiate MP3 writer.\n")
+// Return the number of samples missing between a datagram and the one
+// before it, going by their timestamps, and true if the timestamps
+// can be relied upon for this; they can't if the client doesn't fill
+// them in or if they go backwards (e.g. the client has restarted).
+// The previous datagram is taken to have lasted as long as its audio,
+// none if it couldn't be decoded, so that blocks of any length are
+// handled and nothing is counted twice.
+func timestampGap(previousDatagram *UrtpDatagram, datagram *UrtpDatagram) (int, bool) {
+    var previousSamples int
+
+    if (previousDatagram.Timestamp == 0) || (datagram.Timestamp <= previousDatagram.Timestamp) {
+        return 0, false
+    }
+    if previousDatagram.Audio != nil {
+        previousSamples = len(*previousDatagram.Audio) / streamChannels
+    }
+    expected := previousDatagram.Timestamp + uint64(previousSamples) * 1000000 / uint64(streamSamplingFrequency)
+    if datagram.Timestamp <= expected + GAP_TIMESTAMP_TOLERANCE_MICROSECONDS {
+        return 0, true
     }
 
-    return mp3Writer, mp3SamplesPerFrame
+    return int(((datagram.Timestamp - expected) * uint64(streamSamplingFrequency) + 500000) / 1000000), true
 }
 
-// Handle a gap of a given number of samples in the input data
-func handleGap(gap int, previousDatagram * UrtpDatagram) {
-    var y int
+// Bring the audio of a datagram to the number of channels and the
+// sampling frequency of the stream, using (and if necessary creating)
+// the given resampler, returning how much short of a block it was, in
+// samples of the stream
+func convertDatagram(datagram *UrtpDatagram, resampler **Resampler) int {
+    shortBy := 0
 
-    log.Printf("Handling a gap of %d samples...\n", gap)
-    if gap < SAMPLING_FREQUENCY * MAX_GAP_FILL_MILLISECONDS / 1000 {
-        // TODO: for now just repeat the last sample we received
-        fill := make([]byte, gap * URTP_SAMPLE_SIZE)
-        if (previousDatagram != nil) && (len(*previousDatagram.Audio) > 0) {
-            for w := 0; w < len(fill); w += URTP_SAMPLE_SIZE {
-                x := (*previousDatagram.Audio)[y]
-                for z := 0; z < URTP_SAMPLE_SIZE; z++ {
-                    fill[w + z] = byte(x >> ((uint(z) * 8)))
-                }
-                y++
-                if y >= len(*previousDatagram.Audio) {
-                    y = 0
-                }
+    if datagram.Audio != nil {
+        frequency := datagram.SamplingFrequency
+        if frequency == 0 {
+            frequency = SAMPLING_FREQUENCY
+        }
+        channels := datagram.Channels
+        if channels == 0 {
+            channels = 1
+        }
+        if clientBlockSamples := frequency * BLOCK_DURATION_MS / 1000; len(*datagram.Audio) / channels < clientBlockSamples {
+            shortBy = (clientBlockSamples - len(*datagram.Audio) / channels) * streamSamplingFrequency / frequency
+        }
+        if channels != streamChannels {
+            audio := remixChannels(*datagram.Audio, channels, streamChannels)
+            putAudio(datagram.Audio)
+            datagram.Audio = &audio
+            datagram.Channels = streamChannels
+        }
+        if frequency != streamSamplingFrequency {
+            if (*resampler == nil) || ((*resampler).From != frequency) || ((*resampler).To != streamSamplingFrequency) ||
+               ((*resampler).Channels != streamChannels) {
+                *resampler = newResampler(frequency, streamSamplingFrequency, streamChannels)
             }
+            audio := (*resampler).Process(*datagram.Audio)
+            putAudio(datagram.Audio)
+            datagram.Audio = &audio
+            datagram.SamplingFrequency = streamSamplingFrequency
         }
-        log.Printf("Writing %d bytes to the audio buffer...\n", len(fill))
-        pcmAudio.Write(fill)
-    } else {
-        log.Printf("Ignored a silly gap.\n")
     }
+
+    return shortBy
 }
 
-// Process a URTP datagram
-func processDatagram(datagram * UrtpDatagram, savedDatagramList * list.List) {
-    var previousDatagram *UrtpDatagram
+// Return the number of samples missing before a datagram, going by
+// the one processed before it (nil if there isn't one); the reorder
+// buffer guarantees that datagrams arrive in order so only a forward
+// gap is of interest
+func datagramGap(datagram *UrtpDatagram, previousDatagram *UrtpDatagram) int {
+    if previousDatagram != nil {
+        missing := sequenceDistance(previousDatagram.SequenceNumber, datagram.SequenceNumber) - 1
+        gap, ok := timestampGap(previousDatagram, datagram)
+        if ok {
+            // If nothing is missing by sequence number, and the previous
+            // datagram was decoded, then a gap means that the client
+            // paused (e.g. it sent heartbeats during silence) rather than
+            // that audio was lost
+            if (gap > 0) && ((missing > 0) || (previousDatagram.Audio == nil)) {
+                log.Printf("Timestamp skip of %d sample(s) (sequence number %d, timestamp %d us after the previous one).\n",
+                           gap, datagram.SequenceNumber, datagram.Timestamp - previousDatagram.Timestamp)
+                return gap
+            }
+        } else if missing > 0 {
+            log.Printf("Sequence number skip (expected %d, received %d).\n", previousDatagram.SequenceNumber + 1, datagram.SequenceNumber)
+            return missing * streamSamplingFrequency * BLOCK_DURATION_MS / 1000
+        }
+    }
+
+    return 0
+}
 
-    if savedDatagramList.Front() != nil {
-        previousDatagram = savedDatagramList.Front().Value.(*UrtpDatagram)
+// Put a block of audio, of the stream's channels and sampling
+// frequency, through the processing chain and into the PCM buffer;
+// the audio may be changed in place
+func (pipeline *Pipeline) processAudio(audio []int16) {
+    if pipeline.noiseReducer != nil {
+        pipeline.noiseReducer.Process(audio)
     }
+    if pipeline.noiseGate != nil {
+        pipeline.noiseGate.Process(audio)
+    }
+    if pipeline.agc != nil {
+        pipeline.agc.Process(audio)
+    }
+    if pipeline.clockDrift != nil {
+        audio = pipeline.clockDrift.Compensate(audio)
+    }
+    pipeline.concealer.Put(audio)
+    audio = pipeline.slowDown.Process(audio)
+    pipeline.comfortNoise.Put(audio)
+    //log.Printf("Writing %d bytes to the audio buffer...\n", len(audio) * URTP_SAMPLE_SIZE)
+    pipeline.pcm.WriteSamples(audio)
+}
 
+// Process a URTP datagram, given the one processed before it (nil if
+// there isn't one)
+func (pipeline *Pipeline) processDatagram(datagram * UrtpDatagram, previousDatagram * UrtpDatagram) {
     //log.Printf("Processing a datagram...\n")
 
+    // A client that fills in the timestamp may send blocks of any
+    // length: the timestamps say how much audio is missing.  For
+    // anything else every block is assumed to be BLOCK_DURATION_MS.
+    timestamped := datagram.Timestamp != 0
+    blockSamples := streamSamplingFrequency * BLOCK_DURATION_MS / 1000
+    shortBy := convertDatagram(datagram, &pipeline.resampler)
+
     // Handle the case where we have missed some datagrams
-    if (previousDatagram != nil) && (datagram.SequenceNumber != previousDatagram.SequenceNumber + 1) {
-        log.Printf("Sequence number skip (expected %d, received %d).\n", previousDatagram.SequenceNumber + 1, datagram.SequenceNumber)
-        handleGap(int(datagram.SequenceNumber - previousDatagram.SequenceNumber) * SAMPLES_PER_BLOCK, previousDatagram)
+    if gap := datagramGap(datagram, previousDatagram); gap > 0 {
+        pipeline.handleGap(gap)
+    }
+
+    // Keep track of how the client's clock is drifting
+    if (pipeline.clockDrift != nil) && timestamped {
+        pipeline.clockDrift.Update(datagram.Timestamp, datagram.Received)
     }
 
     // Copy the received audio into the buffer
     if datagram.Audio != nil {
-        audioBytes := make([]byte, len(*datagram.Audio) * URTP_SAMPLE_SIZE)
-        for x, y := range *datagram.Audio {
-            for z := 0; z < URTP_SAMPLE_SIZE; z++ {
-                audioBytes[(x * URTP_SAMPLE_SIZE) + z] = byte(y >> ((uint(z) * 8)))
-            }
-        }
-        //log.Printf("Writing %d bytes to the audio buffer...\n", len(audioBytes))
-        pcmAudio.Write(audioBytes)
+        pipeline.levels.Put(datagram, time.Now())
+        pipeline.processAudio(*datagram.Audio)
 
         // If the block is shorter than expected, handle that gap too
-        if len(*datagram.Audio) < SAMPLES_PER_BLOCK {
-            handleGap(SAMPLES_PER_BLOCK - len(*datagram.Audio), previousDatagram)
+        if !timestamped && (shortBy > 0) {
+            pipeline.handleGap(shortBy)
         }
-    } else {
-        // And if the audio is entirely missing, handle that
-        handleGap(SAMPLES_PER_BLOCK, previousDatagram)
+    } else if !timestamped {
+        // And if the audio is entirely missing, handle that; if the
+        // datagram is timestamped the next one will show the gap
+        pipeline.handleGap(blockSamples)
     }
 }
 
-// Encode up to numSamples into the output stream
-func encodeOutput (mp3Writer *lame.LameWriter, pcmHandle *os.File, numSamples int) int {
+// Encode up to numSamples into the output stream, returning the
+// number of samples encoded and any error from the encoder; if the
+// encoder is nil the audio goes to everything but the output stream.
+// The extra outputs (--archive, --shadow and so on) are fed only from
+// the main stream.
+func (pipeline *Pipeline) encodeOutput(encoder Encoder, pcmHandle *os.File, numSamples int) (int, error) {
     var err error
+    var encodeErr error
     var bytesRead int
-    var bytesEncoded int
-    buffer := make([]byte, numSamples * URTP_SAMPLE_SIZE)
+    var samplesEncoded int
+    var buffer []byte
 
-    bytesRead, err = pcmAudio.Read(buffer)
+    if (catchUp != nil) && (pipeline == mainPipeline) {
+        buffer = catchUp.Read(pipeline.pcm, numSamples)
+        bytesRead = len(buffer)
+    } else {
+        buffer = make([]byte, numSamples * URTP_SAMPLE_SIZE * streamChannels)
+        bytesRead, err = pipeline.pcm.Read(buffer)
+    }
     if bytesRead > 0 {
         //log.Printf("Encoding %d byte(s) into the output...\n", bytesRead)
-        if mp3Writer != nil {
-            bytesEncoded, err = mp3Writer.Write(buffer[:bytesRead])
-            if err != nil {
-                log.Printf("Unable to encode MP3.\n")
+        if encoder != nil {
+            samplesEncoded, encodeErr = encoder.WriteSamples(buffer[:bytesRead])
+            if encodeErr != nil {
+                log.Printf("Unable to encode output (%s).\n", encodeErr.Error())
             }
         }
+        if pipeline != mainPipeline {
+            return samplesEncoded, encodeErr
+        }
+        if shadowEncoder != nil {
+            shadowEncoder.Write(buffer[:bytesRead])
+        }
+        if abrLadder != nil {
+            abrLadder.Write(buffer[:bytesRead])
+        }
+        if archiveRecorder != nil {
+            archiveRecorder.Write(buffer[:bytesRead])
+        }
+        if icecastSource != nil {
+            icecastSource.Write(buffer[:bytesRead])
+        }
+        if liveWs != nil {
+            liveWs.Write(buffer[:bytesRead])
+        }
+        if whep != nil {
+            whep.Write(buffer[:bytesRead])
+        }
         if pcmHandle != nil {
             _, err = pcmHandle.Write(buffer[:bytesRead])
             if err != nil {
                 log.Printf("Unable to write to PCM file.\n")
             }
         }
+        if wavWriter != nil {
+            wavWriter.Write(buffer[:bytesRead])
+        }
+        if chuffDetector != nil {
+            chuffDetector.Write(buffer[:bytesRead])
+        }
+    }
+
+    return samplesEncoded, encodeErr
+}
+
+// Return the size of the tag that writeSegmentTag() writes
+func segmentTagSize(encoder Encoder) int {
+    if _, ok := encoder.(SegmentEncoder); ok {
+        return 0
     }
 
-    return bytesEncoded / URTP_SAMPLE_SIZE
+    return len(id3Prefix) + MP3_ID3_TAG_TIMESTAMP_LEN
+}
+
+// Write the ID3 tag to the start of a segment file, unless the
+// encoder makes segments that are streams in their own right
+func writeSegmentTag(encoder Encoder, handle io.Writer, offset time.Duration) error {
+    if _, ok := encoder.(SegmentEncoder); ok {
+        return nil
+    }
+
+    return writeTag(handle, offset)
 }
 
 // Write the ID3 tag to the start of an MP3 segment file indicating
 // its time offset from the previous segment file
-func writeTag(mp3Handle *os.File, offset time.Duration) error {
+func writeTag(mp3Handle io.Writer, offset time.Duration) error {
     var timestampBytes bytes.Buffer
     var timestampUint64 uint64 // Must be an uint64 to produce the correct sized timestamp
 
     // First, write the prefix
-    _, err := mp3Handle.WriteString(id3Prefix)
+    _, err := io.WriteString(mp3Handle, id3Prefix)
     if err == nil {
         // Then write the binary timestamp offset on a 90 kHz basis
         timestampUint64 = uint64(float32(offset) / float32(time.Microsecond) * float32(90000) / float32(1000000))
@@ -276,167 +407,618 @@ func writeTag(mp3Handle *os.File, offset time.Duration) error {
     return err
 }
 
-// Do the processing; this function should never return
-func operateAudioProcessing(pcmHandle *os.File, mp3Dir string, maxOosTimeSeconds uint, segmentFileDurationMilliseconds uint) {
-    var newDatagramList = list.New()
-    var newDatagramListLocker sync.Mutex
-    var processedDatagramList = list.New()
-    var mp3Audio bytes.Buffer
-    var mp3Writer *lame.LameWriter
-    var mp3SamplesPerFrame int
-    var mp3Handle *os.File
-    var mp3Duration time.Duration
-    var mp3FileSamples int = int(segmentFileDurationMilliseconds) * SAMPLING_FREQUENCY / 1000
-    var maxOosAge time.Duration = time.Second * time.Duration(maxOosTimeSeconds)
-    var oosAge time.Duration
-    var mp3SamplesToEncode int
-    var samplesEncoded int
-    var mp3Offset time.Duration
-    var minOutputBufferedAudio time.Duration = MIN_OUTPUT_BUFFERED_AUDIO
-    var channel = make(chan interface{})
-    processTicker := time.NewTicker(time.Duration(BLOCK_DURATION_MS) * time.Millisecond)
+// Close the extra outputs (--archive, --wav and so on) that are fed
+// from the main stream
+func closeExtraOutputs() {
+    if wavWriter != nil {
+        wavWriter.Close()
+    }
+    if chuffDetector != nil {
+        chuffDetector.Close()
+    }
+    if icecastSource != nil {
+        icecastSource.Close()
+    }
+    if liveWs != nil {
+        liveWs.Close()
+    }
+    if whep != nil {
+        whep.Close()
+    }
+    if shadowEncoder != nil {
+        shadowEncoder.Close()
+    }
+    if abrLadder != nil {
+        abrLadder.Close()
+    }
+    if archiveRecorder != nil {
+        err := archiveRecorder.Close()
+        if err != nil {
+            log.Printf("Unable to flush archive recorder (%s).\n", err.Error())
+        }
+    }
+}
 
-    ProcessDatagramsChannel = channel
+// Return the most recent depths of the PCM buffer and of the HLS
+// output buffer of the main stream
+func bufferDepths() (time.Duration, time.Duration) {
+    return mainPipeline.BufferDepths()
+}
 
-    // Initialise the linked list of datagrams
-    newDatagramList.Init()
+// Do the processing of a pipeline until ctx is done, at which point
+// the final segment is written; if watchdogSeconds is non-zero the
+// processing loop is watched over (see watchdog.go)
+func operateAudioProcessing(ctx context.Context, pipeline *Pipeline, pcmHandle *os.File, settings Mp3Settings, maxOosTimeSeconds uint,
+                            segmentFileDurationMilliseconds uint, reorderTolerance uint, watchdogSeconds uint) {
+    var newDatagrams = make(chan *UrtpDatagram, NEW_DATAGRAMS_SIZE)
+    var maxOosAge time.Duration = time.Second * time.Duration(maxOosTimeSeconds)
+    var channel = pipeline.datagrams
+    var mp3Dir = pipeline.Dir
+    var codec = pipeline.Codec
+    // The encoder settings and the segment length, which may be changed
+    // while running and which a restarted processing loop starts with
+    // (protected by settingsLocker)
+    var currentSettings = settings
+    var currentFileSamples int = int(segmentFileDurationMilliseconds) * streamSamplingFrequency / 1000
+    var settingsLocker sync.Mutex
+    var watchdog *Watchdog
 
-    // Create the MP3 writer
-    mp3Writer, mp3SamplesPerFrame = createMp3Writer(&mp3Audio)
-    if mp3Writer == nil {
-        fmt.Fprintf(os.Stderr, "Unable to create MP3 writer.\n")
-        os.Exit(-1)
-    }
-    // Encode an exact number of MP3 frames
-    mp3SamplesToEncode = mp3FileSamples / mp3SamplesPerFrame *  mp3SamplesPerFrame
-
-    // Create the first MP3 output file
-    mp3Handle = openMp3File(mp3Dir)
-    if mp3Handle == nil {
-        fmt.Fprintf(os.Stderr, "Unable to create temporary file for MP3 output in directory \"%s\" (permissions?).\n", mp3Dir)
-        os.Exit(-1)
-    }
+    registerStats(pipeline.statsName("output"), pipeline.OutputStats)
 
     fmt.Printf("Audio processing channel created and now being serviced.\n")
 
-    // Timed function that processes received datagrams and feeds the output stream
-    go func() {
-        for _ = range processTicker.C {
-            var next *list.Element
-            // Go through the list of newly arrived datagrams, processing them and moving
-            // them to the processed list
-            newDatagramListLocker.Lock()
-            thingProcessed := false
-            for newElement := newDatagramList.Front(); newElement != nil; newElement = next {
-                next = newElement.Next(); // Get the next value for the following iteration
-                                          // as a Remove() would cause newElement.next()
-                                          // to return nil
-                processDatagram(newElement.Value.(*UrtpDatagram), processedDatagramList)
-                //log.Printf("%d byte(s) in the outgoing audio buffer.\n", pcmAudio.Len())
-                //log.Printf("Moving datagram from the new list to the processed list...\n")
-                processedDatagramList.PushFront(newElement.Value)
-                thingProcessed = true
-                newDatagramList.Remove(newElement)
-            }
-            newDatagramListLocker.Unlock()
-            if thingProcessed {
-                oosAge = time.Duration(0)
-                count := 0
-                for processedElement := processedDatagramList.Front(); processedElement != nil; processedElement = next {
-                    next = processedElement.Next(); // Get the next value for the following iteration
-                                              // as a Remove() would cause newElement.next()
-                                              // to return nil
-                    count++
-                    if count > NUM_PROCESSED_DATAGRAMS {
-                        //log.Printf("Removing a datagram from the processed list...\n")
-                        processedDatagramList.Remove(processedElement)
-                        //log.Printf("%d datagram(s) now in the processed list.\n", processedDatagramList.Len())
-                    }
-                }
-            } else {
-                // If nothing has been processed, add to the out of service age and,
-                // if it gets too large, reset the stream
-                oosAge += time.Duration(BLOCK_DURATION_MS) * time.Millisecond
-                if (oosAge > maxOosAge) {
-                    oosAge = time.Duration(0)
-                    mp3Offset = time.Duration(0)
-                    samplesEncoded = 0;
-                    mp3SamplesToEncode = mp3FileSamples / mp3SamplesPerFrame *  mp3SamplesPerFrame
-                    reset := new(Reset)
-                    MediaControlChannel <- reset
-                }
+    // Timed function that processes received datagrams and feeds the
+    // output stream; generation is that of the pipeline when it was
+    // started, a loop of an older generation having been abandoned by
+    // the watchdog and having to stop as soon as it gets the chance.
+    // Everything that a loop works on is its own, so that an abandoned
+    // loop coming back to life can't upset the one that replaced it
+    processLoop := func(generation uint32) {
+        var reorderBuffer = ReorderBuffer{Tolerance: int(reorderTolerance)}
+        // The last datagram processed, which gaps are measured from
+        var previousDatagram *UrtpDatagram
+        var mp3Audio = new(bytes.Buffer)
+        var encoder Encoder
+        var mp3SamplesPerFrame int
+        var mp3Handle SegmentFile
+        var mp3Duration time.Duration
+        var oosAge time.Duration
+        var outOfService bool
+        var silent bool
+        var mp3SamplesToEncode int
+        var samplesEncoded int
+        var mp3Offset time.Duration
+        var datagramsReceived int
+        var datagramStatsPublished = time.Now()
+        // Why the output stream has failed, empty if it hasn't, and when to
+        // next try to recover it
+        var outputFailure string
+        var nextRecovery time.Time
+        // Whether the next segment doesn't follow on from the one before
+        var discontinuity bool
+        processTicker := time.NewTicker(time.Duration(BLOCK_DURATION_MS) * time.Millisecond)
+        defer processTicker.Stop()
+        processTickerMonitor := newTickerMonitor(pipeline.statsName("process"), time.Duration(BLOCK_DURATION_MS) * time.Millisecond)
+
+        settingsLocker.Lock()
+        settings := currentSettings
+        mp3FileSamples := currentFileSamples
+        settingsLocker.Unlock()
+
+        abandoned := func() bool {
+            if atomic.LoadUint32(&pipeline.processGeneration) != generation {
+                log.Printf("Abandoned processing loop of stream \"%s\" has come back to life, stopping it.\n", pipeline.Name)
+                return true
             }
+            return false
+        }
 
-            // Always have to encode something into the output stream
-            samples := encodeOutput(mp3Writer, pcmHandle, mp3SamplesToEncode)
-            samplesEncoded += samples
-            mp3SamplesToEncode -= samples
+        // Set the segment file being written and let the handler of the
+        // output buffer state know whether there is one
+        setHandle := func(handle SegmentFile) {
+            mp3Handle = handle
+            if atomic.LoadUint32(&pipeline.processGeneration) == generation {
+                var open int32
+                if handle != nil {
+                    open = 1
+                }
+                atomic.StoreInt32(&pipeline.segmentOpen, open)
+            }
+        }
 
-            if mp3SamplesToEncode <= 0 {
-                if mp3Handle != nil {
-                    mp3Duration = time.Duration(samplesEncoded * 1000000 / SAMPLING_FREQUENCY) * time.Microsecond
-                    log.Printf("Writing %d millisecond(s) of MP3 audio (%d samples) to \"%s\" at offset %6.3f (PCM buffer is %6.3f s, MP3 buffer is %d byte(s), URTP list is %d deep).\n",
-                               mp3Duration / time.Millisecond, samplesEncoded, mp3Handle.Name(), float64(mp3Offset) / float64(time.Second),
-                               float64(pcmAudio.Len() / URTP_SAMPLE_SIZE * 1000) / float64(SAMPLING_FREQUENCY) / float64(1000), mp3Audio.Len(), newDatagramList.Len())
-                    err := writeTag(mp3Handle, mp3Offset)
+        // Write the current MP3 segment to file and let the audio output
+        // channel know about it
+        writeSegment := func() error {
+            var err error
+            if mp3Handle != nil {
+                mp3Duration = time.Duration(samplesEncoded * 1000000 / streamSamplingFrequency) * time.Microsecond
+                log.Printf("Writing %d millisecond(s) of MP3 audio (%d samples) to \"%s\" at offset %6.3f (PCM buffer is %6.3f s, MP3 buffer is %d byte(s), %d new datagram(s) waiting).\n",
+                           mp3Duration / time.Millisecond, samplesEncoded, mp3Handle.Name(), float64(mp3Offset) / float64(time.Second),
+                           float64(pcmDuration(pipeline.pcm.Len())) / float64(time.Second), mp3Audio.Len(), len(newDatagrams))
+                size := segmentTagSize(encoder) + mp3Audio.Len()
+                if !pipeline.quota.AllowDisk(size) {
+                    // Over quota, throw the segment away
+                    mp3Audio.Reset()
+                    mp3Handle.Close()
+                    removeSegmentFile(mp3Handle.Name())
+                } else {
+                    err = writeSegmentTag(encoder, mp3Handle, mp3Offset)
                     if err == nil {
                         _, err = mp3Audio.WriteTo(mp3Handle)
                         mp3Handle.Close()
                         //log.Printf("Closed MP3 file.\n")
-                        if err == nil {
+                        if (err == nil) && abandoned() {
+                            // Too late, another loop has taken over the stream
+                            removeSegmentFile(mp3Handle.Name())
+                            pipeline.quota.FreeDisk(size)
+                        } else if err == nil {
                             // Let the audio output channel know of the new audio file
                             mp3AudioFile := new(Mp3AudioFile)
                             mp3AudioFile.fileName = filepath.Base(mp3Handle.Name())
                             mp3AudioFile.title = MP3_TITLE
                             mp3AudioFile.timestamp = time.Now()
                             mp3AudioFile.duration = mp3Duration
+                            mp3AudioFile.size = size
                             mp3AudioFile.usable = true;
                             mp3AudioFile.removable = false;
-                            MediaControlChannel <- mp3AudioFile
+                            mp3AudioFile.discontinuity = discontinuity
+                            discontinuity = false
+                            pipeline.media <- mp3AudioFile
+                            publishEvent(EVENT_SEGMENT, map[string]interface{}{"file": mp3AudioFile.fileName, "duration": mp3Duration})
                         } else {
                             log.Printf("There was an error writing to \"%s\" (%s).\n", mp3Handle.Name(), err.Error())
+                            removeSegmentFile(mp3Handle.Name())
+                            pipeline.quota.FreeDisk(size)
                         }
                     } else {
                         mp3Handle.Close()
                         log.Printf("There was an error writing the ID3 tag to \"%s\", closing MP3 file (%s).\n", mp3Handle.Name(), err.Error())
+                        removeSegmentFile(mp3Handle.Name())
+                        pipeline.quota.FreeDisk(size)
                     }
                 }
+            }
+
+            return err
+        }
+
+        // Note that the output stream has failed, e.g. the disk is full,
+        // so that it is recovered
+        failOutput := func(reason string) {
+            if outputFailure == "" {
+                log.Printf("Output of stream \"%s\" has failed (%s), recovering...\n", pipeline.Name, reason)
+                outputFailure = reason
+                atomic.AddInt64(&pipeline.outputFailures, 1)
+                publishEvent(EVENT_OUTPUT_FAILED, map[string]interface{}{"stream": pipeline.Name, "reason": reason})
+            }
+        }
+
+        // Try to recover a failed output stream by throwing away the
+        // encoder and the segment in progress and starting them again,
+        // returning true on success; the next segment is marked as
+        // discontinuous so that players start decoding afresh
+        recoverOutput := func(now time.Time) bool {
+            if now.Before(nextRecovery) {
+                return false
+            }
+            nextRecovery = now.Add(OUTPUT_RECOVERY_PERIOD)
+            if encoder != nil {
+                runIsolated(pipeline.quota, func() {
+                    encoder.Close()
+                })
+                encoder = nil
+            }
+            mp3Audio.Reset()
+            if mp3Handle != nil {
+                mp3Handle.Close()
+                removeSegmentFile(mp3Handle.Name())
+                setHandle(nil)
+            }
+            newOutputEncoder, err := newEncoder(codec, mp3Audio, &settings)
+            if err != nil {
+                log.Printf("Unable to create %s encoder (%s), will try again in %d second(s).\n",
+                           codec, err.Error(), OUTPUT_RECOVERY_PERIOD / time.Second)
+                return false
+            }
+            handle := openSegmentFile(mp3Dir, newOutputEncoder.Extension())
+            if handle == nil {
+                newOutputEncoder.Close()
+                log.Printf("Unable to open a segment file in directory \"%s\", will try again in %d second(s).\n",
+                           mp3Dir, OUTPUT_RECOVERY_PERIOD / time.Second)
+                return false
+            }
+            encoder = newOutputEncoder
+            setHandle(handle)
+            mp3SamplesPerFrame = encoder.FrameSamples()
+            samplesEncoded = 0
+            mp3SamplesToEncode = mp3FileSamples / mp3SamplesPerFrame *  mp3SamplesPerFrame
+            atomic.StoreInt64(&pipeline.segmentSamples, int64(mp3SamplesToEncode))
+            discontinuity = true
+            atomic.AddInt64(&pipeline.outputRecoveries, 1)
+            log.Printf("Output of stream \"%s\" recovered.\n", pipeline.Name)
+            publishEvent(EVENT_OUTPUT_RECOVERED, map[string]interface{}{"stream": pipeline.Name, "reason": outputFailure})
+
+            return true
+        }
+
+        if generation == 0 {
+            // Create the encoder and the first output file
+            var err error
+            encoder, err = newEncoder(codec, mp3Audio, &settings)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to create %s encoder (%s).\n", codec, err.Error())
+                os.Exit(-1)
+            }
+            mp3SamplesPerFrame = encoder.FrameSamples()
+            // Encode an exact number of frames
+            mp3SamplesToEncode = mp3FileSamples / mp3SamplesPerFrame *  mp3SamplesPerFrame
+            atomic.StoreInt64(&pipeline.segmentSamples, int64(mp3SamplesToEncode))
+            setHandle(openSegmentFile(mp3Dir, encoder.Extension()))
+            if mp3Handle == nil {
+                fmt.Fprintf(os.Stderr, "Unable to create temporary file for MP3 output in directory \"%s\" (permissions?).\n", mp3Dir)
+                os.Exit(-1)
+            }
+        } else {
+            // Start the output again from scratch, leaving the encoder
+            // and segment file of the old loop to it, should it ever
+            // come back
+            setHandle(nil)
+            failOutput("the processing loop was restarted")
+        }
+
+        for {
+            if abandoned() {
+                return
+            }
+            select {
+                case <-ctx.Done():
+                {
+                    // Shutting down: encode what's left of the PCM, flush
+                    // the encoder into the final segment and remove the
+                    // segment file that would have been next
+                    processTicker.Stop()
+                    outputEncoder := encoder
+                    if outputFailure != "" {
+                        outputEncoder = nil
+                    }
+                    samples, _ := pipeline.encodeOutput(outputEncoder, pcmHandle, pipeline.pcm.Len() / URTP_SAMPLE_SIZE / streamChannels)
+                    samplesEncoded += samples
+                    if outputEncoder != nil {
+                        err := outputEncoder.Flush()
+                        if err != nil {
+                            log.Printf("Unable to flush encoder (%s).\n", err.Error())
+                        }
+                    }
+                    if encoder != nil {
+                        encoder.Close()
+                    }
+                    if pipeline == mainPipeline {
+                        closeExtraOutputs()
+                    }
+                    if (outputFailure == "") && (mp3Audio.Len() > 0) {
+                        writeSegment()
+                    } else if mp3Handle != nil {
+                        mp3Handle.Close()
+                        removeSegmentFile(mp3Handle.Name())
+                    }
+                    fmt.Printf("Audio processing stopped.\n")
+                    // Once this is taken the final segment has been dealt with
+                    pipeline.media <- new(Shutdown)
+                    return
+                }
+                case <-processTicker.C:
+            }
+            if abandoned() {
+                return
+            }
+            // Go through the newly arrived datagrams, putting them into the
+            // reorder buffer
+            now := time.Now()
+            // Use the real time since the last tick, which will be longer
+            // than the ticker period if we've been starved of CPU
+            tickElapsed := processTickerMonitor.Tick(now)
+            // The audio lost while starved is made up for, so owe it
+            if late := processTickerMonitor.Late(tickElapsed); late > 0 {
+                pipeline.slowDown.Owe(int(late * time.Duration(streamSamplingFrequency) / time.Second))
+            }
+            thingProcessed := false
+            for waiting := true; waiting; {
+                select {
+                    case datagram := <-newDatagrams:
+                        if (mixer != nil) && (pipeline == mainPipeline) {
+                            mixer.Put(datagram, now)
+                        } else {
+                            reorderBuffer.Put(datagram, now)
+                        }
+                        datagramsReceived++
+                        if pipeline == mainPipeline {
+                            atomic.AddUint64(&datagramsReceivedTotal, 1)
+                        }
+                        thingProcessed = true
+                    default:
+                        waiting = false
+                }
+            }
+            if now.Sub(datagramStatsPublished) >= DATAGRAM_STATS_PERIOD {
+                publishEvent(EVENT_DATAGRAM_STATS, map[string]interface{}{"received": datagramsReceived,
+                                                                         "period": now.Sub(datagramStatsPublished),
+                                                                         "buffered": pcmDuration(pipeline.pcm.Len()),
+                                                                         "dropped": int(atomic.LoadUint64(&pipeline.datagramsDropped))})
+                datagramsReceived = 0
+                datagramStatsPublished = now
+            }
+            // Process the datagrams that are now in order, each becoming
+            // the previous datagram in turn
+            for _, datagram := range reorderBuffer.Get(now) {
+                runIsolated(pipeline.quota, func() {
+                    pipeline.processDatagram(datagram, previousDatagram)
+                })
+                //log.Printf("%d byte(s) in the outgoing audio buffer.\n", pipeline.pcm.Len())
+                if previousDatagram != nil {
+                    putUrtpDatagram(previousDatagram)
+                }
+                previousDatagram = datagram
+            }
+            // Or, if mixing, mix whatever is ready from every client
+            if (mixer != nil) && (pipeline == mainPipeline) {
+                runIsolated(pipeline.quota, func() {
+                    if audio := mixer.Mix(now); audio != nil {
+                        pipeline.processAudio(audio)
+                    }
+                })
+            }
+            heartbeat := atomic.SwapInt32(&pipeline.heartbeatsPending, 0) > 0
+            resetReason := ""
+            if thingProcessed || heartbeat {
+                if outOfService {
+                    log.Printf("Back in service.\n")
+                    publishEvent(EVENT_IN_SERVICE, map[string]interface{}{})
+                    outOfService = false
+                }
+            }
+            if thingProcessed {
+                if silent {
+                    log.Printf("Audio from the client has resumed.\n")
+                    silent = false
+                }
+                oosAge = time.Duration(0)
+            } else if heartbeat {
+                // The link is alive, the client just has nothing to say,
+                // so there's no need to reset the stream
+                if !silent {
+                    log.Printf("Heartbeats but no audio from the client.\n")
+                    publishEvent(EVENT_CLIENT_SILENT, map[string]interface{}{})
+                    silent = true
+                }
+                oosAge = time.Duration(0)
+            } else {
+                // If nothing has been processed, add to the out of service age and,
+                // if it gets too large, reset the stream
+                oosAge += tickElapsed
+                if (oosAge > maxOosAge) {
+                    resetReason = "out of service"
+                    // The stream is reset every maxOosAge while out of
+                    // service but that is only news the first time
+                    if !outOfService {
+                        publishEvent(EVENT_OUT_OF_SERVICE, map[string]interface{}{"duration": oosAge})
+                        outOfService = true
+                    }
+                }
+            }
+            if atomic.SwapInt32(&pipeline.resetsPending, 0) > 0 {
+                resetReason = "requested"
+            }
+            if resetReason != "" {
+                oosAge = time.Duration(0)
+                mp3Offset = time.Duration(0)
+                samplesEncoded = 0;
+                mp3SamplesToEncode = mp3FileSamples / mp3SamplesPerFrame *  mp3SamplesPerFrame
+                reorderBuffer.Reset()
+                if previousDatagram != nil {
+                    putUrtpDatagram(previousDatagram)
+                    previousDatagram = nil
+                }
+                if pipeline == mainPipeline {
+                    if mixer != nil {
+                        mixer.Reset()
+                    }
+                    if shadowEncoder != nil {
+                        shadowEncoder.Reset()
+                    }
+                    if abrLadder != nil {
+                        abrLadder.Reset()
+                    }
+                }
+                if pipeline.clockDrift != nil {
+                    pipeline.clockDrift.Reset()
+                }
+                pipeline.concealer.Reset()
+                pipeline.slowDown.Reset()
+                publishEvent(EVENT_RESET, map[string]interface{}{"stream": pipeline.Name, "reason": resetReason})
+                reset := new(Reset)
+                pipeline.media <- reset
+            }
+
+            // Try to bring back a failed output stream
+            if (outputFailure != "") && recoverOutput(now) {
+                outputFailure = ""
+            }
+
+            // Always have to encode something into the output stream or,
+            // while it has failed, into everything else
+            var samples int
+            var encodeErr error
+            outputEncoder := encoder
+            if outputFailure != "" {
+                outputEncoder = nil
+            }
+            if !runIsolated(pipeline.quota, func() {
+                samples, encodeErr = pipeline.encodeOutput(outputEncoder, pcmHandle, mp3SamplesToEncode)
+            }) {
+                encodeErr = errors.New("the encoder panicked")
+            }
+            if abandoned() {
+                return
+            }
+            if encodeErr != nil {
+                failOutput(encodeErr.Error())
+            }
+            samplesEncoded += samples
+            mp3SamplesToEncode -= samples
+            atomic.StoreInt64(&pipeline.pcmBufferedNs, int64(pcmDuration(pipeline.pcm.Len())))
+
+            segmented := false
+            if (outputFailure == "") && (mp3SamplesToEncode <= 0) {
+                // Pick up any new settings, which need a new encoder,
+                // the old one being flushed into this segment
+                var newSettings *StreamSettings
+                if pipeline == mainPipeline {
+                    select {
+                        case changed := <-streamSettingsChanges:
+                            newSettings = &changed
+                            err := encoder.Flush()
+                            if err != nil {
+                                log.Printf("Unable to flush encoder (%s).\n", err.Error())
+                            }
+                        default:
+                    }
+                }
+                if segmentEncoder, ok := encoder.(SegmentEncoder); ok {
+                    segmentEncoder.EndSegment()
+                }
+                err := writeSegment()
+                if err != nil {
+                    failOutput(fmt.Sprintf("unable to write segment, %s", err.Error()))
+                }
                 mp3Offset += mp3Duration
-                mp3Handle = openMp3File(mp3Dir)
+                setHandle(openSegmentFile(mp3Dir, encoder.Extension()))
+                if mp3Handle == nil {
+                    failOutput("unable to open segment file")
+                }
+                if newSettings != nil {
+                    // A new encoder starts its first segment itself
+                    encoder.Close()
+                    encoder, err = newEncoder(codec, mp3Audio, &newSettings.Encoder)
+                    if err == nil {
+                        settings = newSettings.Encoder
+                        mp3FileSamples = int(newSettings.SegmentMs) * streamSamplingFrequency / 1000
+                        settingsLocker.Lock()
+                        currentSettings = settings
+                        currentFileSamples = mp3FileSamples
+                        settingsLocker.Unlock()
+                        log.Printf("Encoder recreated with new settings.\n")
+                    } else {
+                        log.Printf("Unable to create %s encoder with the new settings (%s), keeping the old ones.\n", codec, err.Error())
+                        encoder, err = newEncoder(codec, mp3Audio, &settings)
+                    }
+                    if err == nil {
+                        mp3SamplesPerFrame = encoder.FrameSamples()
+                    } else {
+                        encoder = nil
+                        failOutput(fmt.Sprintf("unable to create %s encoder, %s", codec, err.Error()))
+                    }
+                } else if segmentEncoder, ok := encoder.(SegmentEncoder); ok {
+                    segmentEncoder.StartSegment()
+                }
                 samplesEncoded = 0
                 mp3SamplesToEncode = mp3FileSamples / mp3SamplesPerFrame *  mp3SamplesPerFrame
+                atomic.StoreInt64(&pipeline.segmentSamples, int64(mp3SamplesToEncode))
+                segmented = true
+            }
+
+            // Let the watchdog know how things are going: while the
+            // output has failed the PCM is drained regardless and no
+            // segments are owed
+            if watchdog != nil {
+                if abandoned() {
+                    return
+                }
+                consumed := (samples > 0) || (pipeline.pcm.Len() == 0) || (outputFailure != "")
+                watchdog.Tick(now, consumed, segmented || (samples == 0) || (outputFailure != ""))
+                if reason := watchdog.Bitten(); reason != "" {
+                    failOutput(reason)
+                }
             }
         }
-    }()
+    }
 
-    // Process datagrams received on the channel
+    if watchdogSeconds > 0 {
+        watchdog = newWatchdog(pipeline, time.Duration(watchdogSeconds) * time.Second, func() {
+            go processLoop(atomic.AddUint32(&pipeline.processGeneration, 1))
+        })
+        go watchdog.Run(ctx)
+    }
+    go processLoop(0)
+
+    // Process datagrams and the other messages received on the channels
     go func() {
-        for cmd := range channel {
+        var cmd interface{}
+        var ok bool
+        // Whether any datagrams have arrived since the output buffer
+        // state was last received
+        var datagramsArriving bool
+
+        for {
+            select {
+                case cmd, ok = <-channel:
+                case cmd, ok = <-pipeline.control:
+            }
+            if !ok {
+                break
+            }
             switch message := cmd.(type) {
                 // Handle datagrams, throw everything else away
                 case *UrtpDatagram:
                 {
-                    //log.Printf("Adding a new datagram to the FIFO list...\n")
-                    newDatagramListLocker.Lock()
-                    newDatagramList.PushBack(message)
-                    newDatagramListLocker.Unlock()
+                    //log.Printf("Adding a new datagram to the FIFO...\n")
+                    datagramsArriving = true
+                    select {
+                        case newDatagrams <- message:
+                        default:
+                            // The processing loop has stopped or is
+                            // hopelessly behind
+                            pipeline.dropDatagram(message)
+                    }
                 }
-                // If the output buffer has got too low then send a silence frame
-                // of one MP3 file duration
+                // If the output buffer is getting low then slow the audio down
+                // and, if it has got too low, send comfort noise of one MP3 file
+                // duration
                 case *OutputBufferState:
                 {
                     log.Printf("Output buffer has %d ms of buffered audio.\n", message.Buffered / time.Millisecond)
-                    if (minOutputBufferedAudio > message.BufferSize / 2) {
-                        minOutputBufferedAudio = message.BufferSize / 2
+                    atomic.StoreInt64(&pipeline.outputBufferedNs, int64(message.Buffered))
+                    lowWater := pipeline.lowWater.Update(message, time.Now())
+                    // The buffer is full less up to a segment, so anything below that
+                    // is slowed down, more so the nearer it gets to the low-water mark
+                    segmentDuration := pcmDuration(int(atomic.LoadInt64(&pipeline.segmentSamples)) * URTP_SAMPLE_SIZE * streamChannels)
+                    stretchBelow := message.BufferSize - segmentDuration
+                    speed := 1.0
+                    if message.Buffered < stretchBelow {
+                        speed -= SLOW_DOWN_MAX_PERCENT / 100
+                        if stretchBelow > lowWater {
+                            speed = 1 - SLOW_DOWN_MAX_PERCENT / 100 * float64(stretchBelow - message.Buffered) /
+                                                                       float64(stretchBelow - lowWater)
+                        }
                     }
-                    if (message.Buffered < MIN_OUTPUT_BUFFERED_AUDIO) && (mp3Handle != nil) {
-                        // Add a sample of silence if it has got too low so that HLS doesn't run dry (which would stop
-                        // the browser requesting refills)
-                        buffer := make([]byte, (mp3FileSamples / mp3SamplesPerFrame *  mp3SamplesPerFrame) * URTP_SAMPLE_SIZE)
-                        log.Printf("Adding %d samples (%d milliseconds) of silence into the PCM stream.\n",
-                                    len(buffer) / URTP_SAMPLE_SIZE, (len(buffer) / URTP_SAMPLE_SIZE) * 1000 / SAMPLING_FREQUENCY)
-                        pcmAudio.Write(buffer)
+                    pipeline.slowDown.SetSpeed(speed)
+                    if (message.Buffered < lowWater) && (atomic.LoadInt32(&pipeline.segmentOpen) != 0) &&
+                       (!datagramsArriving || (message.Buffered < lowWater / 2)) {
+                        // Add a segment of comfort noise if it has got too low, and slowing
+                        // down what is arriving can't help, so that HLS doesn't run dry (which
+                        // would stop the browser requesting refills)
+                        numSamples := int(atomic.LoadInt64(&pipeline.segmentSamples))
+                        log.Printf("Adding %d samples (%d milliseconds) of comfort noise into the PCM stream.\n",
+                                    numSamples, numSamples * 1000 / streamSamplingFrequency)
+                        publishEvent(EVENT_UNDERRUN, map[string]interface{}{"stream": pipeline.Name, "buffered": message.Buffered,
+                                                                            "lowWater": lowWater})
+                        pipeline.pcm.WriteSamples(pipeline.comfortNoise.Generate(numSamples))
                     }
+                    datagramsArriving = false
+                }
+                case *ClientLost:
+                {
+                    log.Printf("Client %s lost after %d second(s) of silence, the stream will be reset after %d second(s) without audio.\n",
+                               message.Address, message.Idle / time.Second, maxOosAge / time.Second)
                 }
             }
         }
@@ -0,0 +1,164 @@
+/* Ingest benchmark for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "math"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/jessevdk/go-flags"
+)
+
+// The bench subcommand is the ingest side of --loadtest: it runs a
+// number of synthetic clients against the input port of a server, each
+// sending a tone of its own as URTP datagrams, as replay does, paced at
+// real time or faster, reporting the rate at which datagrams are sent
+// every LOAD_TEST_REPORT_PERIOD.  What the server makes of them is in
+// its admin API statistics (e.g. the datagrams dropped because
+// processing couldn't keep up).  The server takes one client at a time
+// unless it is run with --mix, and over TCP a new client takes over
+// from the last unless --tcppolicy says otherwise, so more than one
+// client is only of use with --mix.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Command-line items of the bench subcommand
+type BenchOpts struct {
+    Server string `required:"yes" long:"server" description:"the host and input port of the server, e.g. localhost:1234"`
+    Tcp bool `long:"tcp" description:"send over TCP rather than UDP"`
+    Crc bool `long:"crc" description:"add a CRC to the header of each datagram"`
+    Clients uint `default:"1" long:"clients" description:"the number of synthetic clients, each with a connection of its own"`
+    Seconds uint `default:"60" long:"seconds" description:"how long to run for in seconds"`
+    Speed float64 `default:"1" long:"speed" description:"how many times faster than real time each client sends audio (0 for as fast as possible)"`
+    Channels int `default:"1" choice:"1" choice:"2" long:"channels" description:"the number of channels each client sends"`
+}
+
+// The results of a benchmark so far (use atomic operations)
+type BenchStats struct {
+    Datagrams  int64
+    Bytes      int64
+    Errors     int64
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The frequency of the tone of the first client; each one after has
+// a tone this much higher than the last
+const BENCH_TONE_HZ float64 = 440
+
+// The amplitude of the tones
+const BENCH_TONE_AMPLITUDE float64 = 8000
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Report on a benchmark
+func (stats *BenchStats) report(numClients int, elapsed time.Duration) {
+    datagrams := atomic.LoadInt64(&stats.Datagrams)
+    kbitsPerSecond := float64(atomic.LoadInt64(&stats.Bytes)) * 8 / 1000 / elapsed.Seconds()
+    fmt.Printf("Bench, %d client(s), %d s: %d datagram(s) (%.1f per second, %.1f per second per client), %d error(s), %.1f kbits/s.\n",
+               numClients, int(elapsed / time.Second), datagrams, float64(datagrams) / elapsed.Seconds(),
+               float64(datagrams) / elapsed.Seconds() / float64(numClients), atomic.LoadInt64(&stats.Errors), kbitsPerSecond)
+}
+
+// Run a single synthetic client, sending a tone of toneHz, until done
+// is closed
+func benchClient(benchOpts *BenchOpts, toneHz float64, done chan struct{}, stats *BenchStats) {
+    sender, err := newUrtpSender(benchOpts.Server, benchOpts.Tcp, benchOpts.Crc)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Unable to connect to %s (%s).\n", benchOpts.Server, err.Error())
+        atomic.AddInt64(&stats.Errors, 1)
+        return
+    }
+    defer sender.Close()
+
+    pcm := make([]int16, SAMPLES_PER_BLOCK * benchOpts.Channels)
+    started := time.Now()
+    for block := int64(0); ; block++ {
+        select {
+            case <-done:
+                return
+            default:
+        }
+        for x := 0; x < SAMPLES_PER_BLOCK; x++ {
+            sample := int64(x) + block * int64(SAMPLES_PER_BLOCK)
+            value := int16(BENCH_TONE_AMPLITUDE * math.Sin(2 * math.Pi * toneHz * float64(sample) / float64(SAMPLING_FREQUENCY)))
+            for channel := 0; channel < benchOpts.Channels; channel++ {
+                pcm[x * benchOpts.Channels + channel] = value
+            }
+        }
+        paceBlock(started, block, benchOpts.Speed)
+        bytesBefore := sender.Bytes
+        if sender.send(pcm, benchOpts.Channels) == nil {
+            atomic.AddInt64(&stats.Datagrams, 1)
+            atomic.AddInt64(&stats.Bytes, sender.Bytes - bytesBefore)
+        } else {
+            atomic.AddInt64(&stats.Errors, 1)
+        }
+    }
+}
+
+// The bench subcommand
+func bench(args []string) {
+    var benchOpts BenchOpts
+    var stats BenchStats
+    var waitGroup sync.WaitGroup
+
+    parser := flags.NewParser(&benchOpts, flags.Default)
+    parser.Name = "ioc-server bench"
+    _, err := parser.ParseArgs(args)
+    if err != nil {
+        os.Exit(-1)
+    }
+    if (benchOpts.Clients == 0) || (benchOpts.Seconds == 0) || (benchOpts.Speed < 0) {
+        fmt.Fprintf(os.Stderr, "There must be at least one client, for at least one second, at a speed of 0 or more.\n")
+        os.Exit(-1)
+    }
+
+    fmt.Printf("Bench: %d client(s) for %d s against %s.\n", benchOpts.Clients, benchOpts.Seconds, benchOpts.Server)
+    done := make(chan struct{})
+    started := time.Now()
+    for x := uint(0); x < benchOpts.Clients; x++ {
+        waitGroup.Add(1)
+        go func(toneHz float64) {
+            benchClient(&benchOpts, toneHz, done, &stats)
+            waitGroup.Done()
+        }(BENCH_TONE_HZ * float64(x + 1))
+    }
+
+    finished := time.After(time.Duration(benchOpts.Seconds) * time.Second)
+    reportTicker := time.NewTicker(LOAD_TEST_REPORT_PERIOD)
+    for running := true; running; {
+        select {
+            case <-finished:
+                running = false
+            case <-reportTicker.C:
+                stats.report(int(benchOpts.Clients), time.Since(started))
+        }
+    }
+    reportTicker.Stop()
+    close(done)
+    waitGroup.Wait()
+    fmt.Printf("Bench finished.\n")
+    stats.report(int(benchOpts.Clients), time.Since(started))
+}
+
+/* End Of File */
@@ -0,0 +1,160 @@
+/* Catch-up playback for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+// So that a listener can replay a particular run, the playlist of the
+// main stream, asked for with ?start=<RFC 3339 time> (and, optionally,
+// &duration=<seconds>), is a VOD playlist of what was heard from that
+// time rather than the live playlist.  The audio comes from the same
+// place as clips (see clip.go): the MP3 archive files or, failing
+// that, the MP3 segment files still on disk.  Nothing is written for
+// a catch-up playlist: each of its segments, CATCHUP_SEGMENT_DURATION
+// long, is a URL of the form CATCHUP_SEGMENT_NAME?start=<time>&index=<n>
+// that is cut from the archive when it is asked for, with an ID3
+// timestamp giving its offset from the start of the playlist, as for
+// a live segment.  The playlist ends at the end of what has been
+// archived, or when the duration asked for runs out, whichever comes
+// first, and at most CATCHUP_MAX_DURATION after it starts.
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The duration of each segment of a catch-up playlist
+const CATCHUP_SEGMENT_DURATION time.Duration = time.Second * 10
+
+// The longest catch-up playlist
+const CATCHUP_MAX_DURATION time.Duration = time.Hour * 4
+
+// The name under which the segments of a catch-up playlist are served,
+// alongside the playlist
+const CATCHUP_SEGMENT_NAME string = "catchup.mp3"
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the end of the audio that a catch-up from start could be
+// cut from, zero if there is none
+func catchUpEnd(sources []ClipSource, start time.Time) time.Time {
+    var end time.Time
+
+    for _, source := range sources {
+        if source.End.After(start) && source.End.After(end) {
+            end = source.End
+        }
+    }
+
+    return end
+}
+
+// Serve the catch-up playlist of the main stream from the time given
+// in the request
+func catchUpPlaylistHandler(out http.ResponseWriter, in *http.Request, mp3Dir string) {
+    var data bytes.Buffer
+    var eol string = playlistFormat.LineEnding
+    var decimals int = playlistFormat.DurationDecimalPlaces
+
+    start, err := time.Parse(time.RFC3339, in.URL.Query().Get("start"))
+    if err != nil {
+        http.Error(out, "start must be an RFC 3339 time, e.g. 2026-10-16T13:04:05Z", http.StatusBadRequest)
+        return
+    }
+    duration := CATCHUP_MAX_DURATION
+    if value := in.URL.Query().Get("duration"); value != "" {
+        seconds, err := strconv.ParseFloat(value, 64)
+        duration = time.Duration(seconds * float64(time.Second))
+        if (err != nil) || (duration <= 0) || (duration > CATCHUP_MAX_DURATION) {
+            http.Error(out, fmt.Sprintf("duration must be a number of seconds, at most %d", CATCHUP_MAX_DURATION / time.Second),
+                       http.StatusBadRequest)
+            return
+        }
+    }
+    end := catchUpEnd(clipSources(mp3Dir), start)
+    if end.IsZero() {
+        http.Error(out, "there is no audio from that time", http.StatusNotFound)
+        return
+    }
+    if end.After(start.Add(duration)) {
+        end = start.Add(duration)
+    }
+
+    numSegments := int((end.Sub(start) + CATCHUP_SEGMENT_DURATION - 1) / CATCHUP_SEGMENT_DURATION)
+    fmt.Fprintf(&data, "#EXTM3U%s", eol)
+    fmt.Fprintf(&data, "#EXT-X-VERSION:3%s", eol)
+    fmt.Fprintf(&data, "#EXT-X-PLAYLIST-TYPE:VOD%s", eol)
+    fmt.Fprintf(&data, "#EXT-X-TARGETDURATION:%d%s", int(math.Ceil(float64(CATCHUP_SEGMENT_DURATION) / float64(time.Second))), eol)
+    fmt.Fprintf(&data, "#EXT-X-MEDIA-SEQUENCE:0%s", eol)
+    for index := 0; index < numSegments; index++ {
+        segmentDuration := CATCHUP_SEGMENT_DURATION
+        if remaining := end.Sub(start) - time.Duration(index) * CATCHUP_SEGMENT_DURATION; remaining < segmentDuration {
+            segmentDuration = remaining
+        }
+        if index == 0 {
+            fmt.Fprintf(&data, "#EXT-X-PROGRAM-DATE-TIME:%s%s", ukTimeIso8601(start), eol)
+        }
+        fmt.Fprintf(&data, "#EXTINF:%.*f, %s%s", decimals, float32(segmentDuration) / float32(time.Second), MP3_TITLE, eol)
+        fmt.Fprintf(&data, "%s?start=%s&index=%d%s", CATCHUP_SEGMENT_NAME,
+                    url.QueryEscape(start.UTC().Format(time.RFC3339Nano)), index, eol)
+    }
+    fmt.Fprintf(&data, "#EXT-X-ENDLIST%s", eol)
+
+    log.Printf("Serving catch-up playlist of %d segment(s) from %s.\n", numSegments, start.String())
+    out.Header().Set("Content-Type","application/x-mpegurl")
+    http.ServeContent(out, in, "", time.Time{}, bytes.NewReader(signPlaylist(data.Bytes(), in, urlSecret)))
+}
+
+// Serve a segment of a catch-up playlist, cut from the archive
+func catchUpSegmentHandler(out http.ResponseWriter, in *http.Request, mp3Dir string) {
+    var segment bytes.Buffer
+
+    start, err := time.Parse(time.RFC3339Nano, in.URL.Query().Get("start"))
+    if err != nil {
+        http.Error(out, "start must be an RFC 3339 time", http.StatusBadRequest)
+        return
+    }
+    index, err := strconv.Atoi(in.URL.Query().Get("index"))
+    if (err != nil) || (index < 0) || (time.Duration(index) * CATCHUP_SEGMENT_DURATION >= CATCHUP_MAX_DURATION) {
+        http.Error(out, "index must be the number of a segment of the playlist", http.StatusBadRequest)
+        return
+    }
+    offset := time.Duration(index) * CATCHUP_SEGMENT_DURATION
+    from := start.Add(offset)
+    frames, err := cutClip(clipSources(mp3Dir), from, from.Add(CATCHUP_SEGMENT_DURATION))
+    if err != nil {
+        http.Error(out, err.Error(), http.StatusNotFound)
+        return
+    }
+    err = writeTag(&segment, offset)
+    if err != nil {
+        http.Error(out, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    segment.Write(frames)
+    log.Printf("Serving catch-up segment %d from %s (%d byte(s)).\n", index, start.String(), segment.Len())
+    out.Header().Set("Content-Type", "audio/mpeg")
+    http.ServeContent(out, in, "", time.Time{}, bytes.NewReader(segment.Bytes()))
+}
+
+/* End Of File */
@@ -0,0 +1,59 @@
+/* Channel conversion for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+// The stream has a number of channels of its own (see --channels),
+// interleaved in the PCM buffer and everything after it, while a
+// client may send however many channels it has microphones (e.g. one
+// in the cab and one lineside).  On its way into the processing chain
+// the incoming audio is mixed to the number of channels of the stream:
+// when there are fewer channels to go to each channel of the stream
+// is the average of every channel of the client that lands on it
+// (channel modulo the number of channels of the stream), so stereo
+// becomes mono by averaging the two, and when there are more each
+// channel of the stream is a copy of one of the client (again channel
+// modulo the number), so mono becomes the same on both sides.
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return interleaved audio of from channels mixed to to channels
+func remixChannels(audio []int16, from int, to int) []int16 {
+    numFrames := len(audio) / from
+    remixed := make([]int16, numFrames * to)
+
+    if from > to {
+        for frame := 0; frame < numFrames; frame++ {
+            for channel := 0; channel < to; channel++ {
+                var sum int
+                var count int
+                for source := channel; source < from; source += to {
+                    sum += int(audio[frame * from + source])
+                    count++
+                }
+                remixed[frame * to + channel] = int16(sum / count)
+            }
+        }
+    } else {
+        for frame := 0; frame < numFrames; frame++ {
+            for channel := 0; channel < to; channel++ {
+                remixed[frame * to + channel] = audio[frame * from + channel % from]
+            }
+        }
+    }
+
+    return remixed
+}
+
+/* End Of File */
@@ -0,0 +1,294 @@
+/* Chuff detection and capture for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// So that a burst of chuffing is kept even when nobody is listening,
+// the PCM that goes to the encoder is measured in 20 ms blocks and a
+// chuff is detected when the RMS level of a block rises more than the
+// onset threshold above the background level, which follows the
+// level of the quieter blocks slowly.  The detector then captures the
+// audio, starting CHUFF_PRE_ROLL before the onset, until the level has
+// fallen back to within half of the onset threshold of the background
+// for CHUFF_POST_ROLL, or the clip is CHUFF_MAX_DURATION long, and the
+// clip is encoded as MP3, in the background, into a file in a directory
+// of its own, named after the UTC time at which it starts.  Only the
+// newest clips are kept.  The clips are listed, newest first, by
+// GET /chuffs and each is served from /chuffs/<file>.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A captured clip
+type ChuffClip struct {
+    File        string     `json:"file"`
+    Start       time.Time  `json:"start"`
+    DurationMs  int64      `json:"durationMs"`
+    Size        int64      `json:"size"`
+}
+
+// State of a chuff detector
+type ChuffDetector struct {
+    Dir             string
+    OnsetDb         float64
+    MaxClips        int
+    backgroundDbfs  float64
+    primed          bool
+    block           []byte
+    preRoll         []byte
+    // The PCM of the clip being captured, nil if there isn't one
+    capture         []byte
+    captureStart    time.Time
+    quiet           time.Duration
+    clips           []ChuffClip
+    locker          sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How much audio before the onset of a chuff to include in its clip
+const CHUFF_PRE_ROLL time.Duration = time.Second * 2
+
+// How long the level must have fallen back for before a clip ends
+const CHUFF_POST_ROLL time.Duration = time.Second * 2
+
+// The longest clip
+const CHUFF_MAX_DURATION time.Duration = time.Second * 30
+
+// A block must be at least this loud to be the onset of a chuff,
+// however quiet the background
+const CHUFF_MIN_ONSET_DBFS float64 = -50
+
+// How much of the difference between the level of a quiet block and
+// the background level is added to the background level: at 20 ms
+// blocks the background follows over a few seconds
+const CHUFF_BACKGROUND_WEIGHT float64 = 0.01
+
+// The extension of a clip file
+const CHUFF_EXTENSION string = ".mp3"
+
+// The event published when a clip has been captured
+const EVENT_CHUFF string = "chuff"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The chuff detector, nil if there isn't one
+var chuffDetector *ChuffDetector
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the duration of some PCM of the stream
+func pcmDuration(numBytes int) time.Duration {
+    return time.Duration(numBytes / URTP_SAMPLE_SIZE / streamChannels) * time.Second / time.Duration(streamSamplingFrequency)
+}
+
+// Create a chuff detector, writing clips to dirName when the level
+// rises onsetDb above the background and keeping the newest maxClips
+// of them; any clips already in dirName are listed
+func newChuffDetector(dirName string, onsetDb float64, maxClips uint) (*ChuffDetector, error) {
+    detector := &ChuffDetector{Dir: dirName, OnsetDb: onsetDb, MaxClips: int(maxClips)}
+    err := os.MkdirAll(dirName, os.ModePerm)
+    if err != nil {
+        return nil, err
+    }
+    files, err := ioutil.ReadDir(dirName)
+    if err != nil {
+        return nil, err
+    }
+    for _, file := range files {
+        start, err1 := time.Parse(ARCHIVE_FILE_NAME_FORMAT, strings.TrimSuffix(file.Name(), CHUFF_EXTENSION))
+        if (err1 == nil) && strings.HasSuffix(file.Name(), CHUFF_EXTENSION) {
+            data, err1 := ioutil.ReadFile(filepath.Join(dirName, file.Name()))
+            if err1 == nil {
+                var duration time.Duration
+                walkMp3Frames(data, func(frame []byte, frameDuration time.Duration) bool {
+                    duration += frameDuration
+                    return true
+                })
+                detector.clips = append(detector.clips, ChuffClip{File: file.Name(), Start: start,
+                                                                  DurationMs: int64(duration / time.Millisecond),
+                                                                  Size: file.Size()})
+            }
+        }
+    }
+    sort.Slice(detector.clips, func(x, y int) bool {
+        return detector.clips[x].Start.Before(detector.clips[y].Start)
+    })
+    log.Printf("Chuff detector writing clips to \"%s\" (onset %.1f dB above background, keeping %d clip(s), %d already there).\n",
+               dirName, onsetDb, maxClips, len(detector.clips))
+
+    return detector, nil
+}
+
+// Encode a clip and write it to file, in the background, then keep
+// only the newest clips
+func (detector *ChuffDetector) save(pcm []byte, start time.Time) {
+    go func() {
+        var mp3Audio bytes.Buffer
+
+        encoder, err := newEncoder(DEFAULT_CODEC, &mp3Audio, new(Mp3Settings))
+        if err == nil {
+            _, err = encoder.WriteSamples(pcm)
+            if err == nil {
+                err = encoder.Flush()
+            }
+            encoder.Close()
+        }
+        clip := ChuffClip{File: start.UTC().Format(ARCHIVE_FILE_NAME_FORMAT) + CHUFF_EXTENSION, Start: start,
+                          DurationMs: int64(pcmDuration(len(pcm)) / time.Millisecond), Size: int64(mp3Audio.Len())}
+        if err == nil {
+            err = ioutil.WriteFile(filepath.Join(detector.Dir, clip.File), mp3Audio.Bytes(), 0644)
+        }
+        if err != nil {
+            log.Printf("Unable to save chuff clip \"%s\" (%s).\n", clip.File, err.Error())
+            return
+        }
+        log.Printf("Saved chuff clip \"%s\" (%d millisecond(s)).\n", clip.File, clip.DurationMs)
+
+        detector.locker.Lock()
+        detector.clips = append(detector.clips, clip)
+        for (detector.MaxClips > 0) && (len(detector.clips) > detector.MaxClips) {
+            fileName := filepath.Join(detector.Dir, detector.clips[0].File)
+            err = os.Remove(fileName)
+            if err != nil {
+                log.Printf("Unable to delete chuff clip \"%s\" (%s).\n", fileName, err.Error())
+            }
+            detector.clips = detector.clips[1:]
+        }
+        detector.locker.Unlock()
+
+        publishEvent(EVENT_CHUFF, map[string]interface{}{"file": clip.File, "start": clip.Start,
+                                                         "duration": pcmDuration(len(pcm))})
+    }()
+}
+
+// Measure a block of PCM, starting, continuing or ending the capture
+// of a clip
+func (detector *ChuffDetector) processBlock(block []byte, now time.Time) {
+    var samples []int16
+
+    samples = appendScaledPcm(samples, block, 1)
+    rmsDbfs, _ := measureLevel(samples)
+    if !detector.primed {
+        detector.backgroundDbfs = rmsDbfs
+        detector.primed = true
+    }
+    if detector.capture == nil {
+        if (rmsDbfs >= CHUFF_MIN_ONSET_DBFS) && (rmsDbfs - detector.backgroundDbfs >= detector.OnsetDb) {
+            log.Printf("Chuff detected, level %.1f dBFS, background %.1f dBFS.\n", rmsDbfs, detector.backgroundDbfs)
+            detector.capture = append(append([]byte(nil), detector.preRoll...), block...)
+            detector.captureStart = now.Add(-pcmDuration(len(detector.capture)))
+            detector.quiet = 0
+        } else {
+            detector.backgroundDbfs += (rmsDbfs - detector.backgroundDbfs) * CHUFF_BACKGROUND_WEIGHT
+        }
+    } else {
+        detector.capture = append(detector.capture, block...)
+        if rmsDbfs - detector.backgroundDbfs < detector.OnsetDb / 2 {
+            detector.quiet += pcmDuration(len(block))
+        } else {
+            detector.quiet = 0
+        }
+        if (detector.quiet >= CHUFF_POST_ROLL) || (pcmDuration(len(detector.capture)) >= CHUFF_MAX_DURATION) {
+            detector.save(detector.capture, detector.captureStart)
+            detector.capture = nil
+            // The audio just captured is not the lead-in to another clip
+            detector.preRoll = detector.preRoll[:0]
+            return
+        }
+    }
+    if detector.capture == nil {
+        detector.preRoll = append(detector.preRoll, block...)
+        if excess := len(detector.preRoll) - int(CHUFF_PRE_ROLL / time.Millisecond) * streamSamplingFrequency / 1000 * URTP_SAMPLE_SIZE * streamChannels; excess > 0 {
+            detector.preRoll = append(detector.preRoll[:0], detector.preRoll[excess:]...)
+        }
+    }
+}
+
+// Take some little-endian 16-bit PCM as it goes to the encoder
+func (detector *ChuffDetector) Write(pcm []byte) {
+    blockSize := streamSamplingFrequency * BLOCK_DURATION_MS / 1000 * URTP_SAMPLE_SIZE * streamChannels
+    now := time.Now()
+
+    detector.block = append(detector.block, pcm...)
+    for len(detector.block) >= blockSize {
+        detector.processBlock(detector.block[:blockSize], now)
+        detector.block = detector.block[blockSize:]
+    }
+    detector.block = append([]byte(nil), detector.block...)
+}
+
+// Save any clip being captured; the detector may not be used again
+func (detector *ChuffDetector) Close() {
+    if detector.capture != nil {
+        detector.save(detector.capture, detector.captureStart)
+        detector.capture = nil
+    }
+}
+
+// Return the clips, newest first
+func (detector *ChuffDetector) Clips() []ChuffClip {
+    detector.locker.Lock()
+    defer detector.locker.Unlock()
+
+    clips := make([]ChuffClip, 0, len(detector.clips))
+    for x := len(detector.clips) - 1; x >= 0; x-- {
+        clips = append(clips, detector.clips[x])
+    }
+
+    return clips
+}
+
+// Handle a request for the list of clips or for a clip
+func chuffsHandler(out http.ResponseWriter, in *http.Request) {
+    if in.Method != http.MethodGet {
+        http.Error(out, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if chuffDetector == nil {
+        http.NotFound(out, in)
+        return
+    }
+    fileName := strings.TrimPrefix(in.URL.Path, "/chuffs")
+    if (fileName == "") || (fileName == "/") {
+        out.Header().Set("Content-Type", "application/json")
+        stopCache(out)
+        json.NewEncoder(out).Encode(chuffDetector.Clips())
+    } else {
+        // Only the name, so that nothing outside the directory is served
+        out.Header().Set("Content-Type", "audio/mpeg")
+        http.ServeFile(out, in, filepath.Join(chuffDetector.Dir, filepath.Base(fileName)))
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,248 @@
+/* Clip extraction for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// A listener may ask for a clip of what was heard at a given time with
+// GET /clip?start=<RFC 3339 time>&duration=<seconds>, which returns a
+// single MP3 file.  The clip is cut from the MP3 archive files (see
+// archive.go) if there are any, otherwise from the MP3 segment files
+// still on disk.  Since the frames of an MP3 stream stand alone (the
+// bit reservoir is disabled, see createMp3Writer()) a clip is simply
+// the frames that fall within it, found by walking the frame headers
+// of each file from its start time, which, for an archive file, is in
+// its name and, for a segment file, is its duration before it was
+// last modified.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A file that a clip may be cut from
+type ClipSource struct {
+    Path   string
+    Start  time.Time
+    End    time.Time
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The longest clip
+const CLIP_MAX_DURATION time.Duration = time.Minute * 15
+
+// The size of an MPEG audio frame header
+const MP3_FRAME_HEADER_SIZE int = 4
+
+// The size of an ID3v2 tag header
+const ID3_HEADER_SIZE int = 10
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Layer III bitrates in kbits/s, by bitrate index, for MPEG 1 and for
+// MPEG 2 and 2.5
+var mp3Bitrates = [2][16]int{{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+                             {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}}
+
+// Sampling frequencies in Hz, by sampling frequency index, for MPEG 1,
+// 2 and 2.5
+var mp3SamplingFrequencies = [3][4]int{{44100, 48000, 32000, 0}, {22050, 24000, 16000, 0}, {11025, 12000, 8000, 0}}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Parse the header of a Layer III frame, returning its length in bytes
+// and its duration, or a length of 0 if it isn't a frame header
+func parseMp3FrameHeader(header []byte) (int, time.Duration) {
+    var version int
+
+    if (len(header) < MP3_FRAME_HEADER_SIZE) || (header[0] != 0xff) || (header[1] & 0xe0 != 0xe0) ||
+       ((header[1] >> 1) & 0x03 != 0x01) {
+        return 0, 0
+    }
+    switch (header[1] >> 3) & 0x03 {
+        case 0x03:
+            version = 0 // MPEG 1
+        case 0x02:
+            version = 1 // MPEG 2
+        case 0x00:
+            version = 2 // MPEG 2.5
+        default:
+            return 0, 0
+    }
+    table := 0
+    if version > 0 {
+        table = 1
+    }
+    bitrate := mp3Bitrates[table][header[2] >> 4] * 1000
+    samplingFrequency := mp3SamplingFrequencies[version][(header[2] >> 2) & 0x03]
+    if (bitrate == 0) || (samplingFrequency == 0) {
+        return 0, 0
+    }
+    padding := int(header[2] >> 1) & 0x01
+    samples := 1152
+    if version > 0 {
+        samples = 576
+    }
+
+    return samples / 8 * bitrate / samplingFrequency + padding,
+           time.Duration(samples) * time.Second / time.Duration(samplingFrequency)
+}
+
+// Call found for each frame of an MP3 file, in order, skipping
+// anything that isn't a frame (e.g. ID3 tags), until found returns
+// false
+func walkMp3Frames(data []byte, found func(frame []byte, duration time.Duration) bool) {
+    for len(data) >= MP3_FRAME_HEADER_SIZE {
+        if (len(data) >= ID3_HEADER_SIZE) && bytes.HasPrefix(data, []byte("ID3")) {
+            // An ID3v2 tag, with a sync-safe size
+            size := ID3_HEADER_SIZE + (int(data[6]) << 21 | int(data[7]) << 14 | int(data[8]) << 7 | int(data[9]))
+            if size > len(data) {
+                return
+            }
+            data = data[size:]
+            continue
+        }
+        length, duration := parseMp3FrameHeader(data)
+        if (length == 0) || (length > len(data)) {
+            // Not a frame, look further on
+            data = data[1:]
+            continue
+        }
+        if !found(data[:length], duration) {
+            return
+        }
+        data = data[length:]
+    }
+}
+
+// Append the frames of an MP3 file starting at start that fall within
+// [from, to) to clip, returning the result
+func appendMp3Frames(clip []byte, data []byte, start time.Time, from time.Time, to time.Time) []byte {
+    at := start
+    walkMp3Frames(data, func(frame []byte, duration time.Duration) bool {
+        if !at.Before(from) {
+            clip = append(clip, frame...)
+        }
+        at = at.Add(duration)
+        return at.Before(to)
+    })
+
+    return clip
+}
+
+// Return the MP3 files that a clip may be cut from, oldest first
+func clipSources(mp3Dir string) []ClipSource {
+    var sources []ClipSource
+
+    if (archiveRecorder != nil) && (archiveRecorder.Codec == DEFAULT_CODEC) {
+        files, err := ioutil.ReadDir(archiveRecorder.Dir)
+        if err == nil {
+            for _, file := range files {
+                start, err := time.Parse(ARCHIVE_FILE_NAME_FORMAT, strings.TrimSuffix(file.Name(), archiveRecorder.extension))
+                if (err == nil) && strings.HasSuffix(file.Name(), archiveRecorder.extension) {
+                    sources = append(sources, ClipSource{Path: filepath.Join(archiveRecorder.Dir, file.Name()),
+                                                         Start: start, End: file.ModTime()})
+                }
+            }
+        }
+    } else if outputCodec == DEFAULT_CODEC {
+        addSegment := func(path string, data []byte, modTime time.Time) {
+            var duration time.Duration
+            walkMp3Frames(data, func(frame []byte, frameDuration time.Duration) bool {
+                duration += frameDuration
+                return true
+            })
+            sources = append(sources, ClipSource{Path: path, Start: modTime.Add(-duration), End: modTime})
+        }
+        for _, path := range segmentStore.Paths(mp3Dir, SEGMENT_EXTENSION) {
+            if data, modTime, err := segmentStore.Read(path); err == nil {
+                addSegment(path, data, modTime)
+            }
+        }
+    }
+    sort.Slice(sources, func(x, y int) bool {
+        return sources[x].Start.Before(sources[y].Start)
+    })
+
+    return sources
+}
+
+// Cut a clip of MP3 audio from the files in sources
+func cutClip(sources []ClipSource, from time.Time, to time.Time) ([]byte, error) {
+    var clip []byte
+
+    for _, source := range sources {
+        if source.Start.Before(to) && source.End.After(from) {
+            data, err := readSegmentFile(source.Path)
+            if err != nil {
+                return nil, err
+            }
+            clip = appendMp3Frames(clip, data, source.Start, from, to)
+        }
+    }
+    if len(clip) == 0 {
+        return nil, errors.New("there is no audio from that time")
+    }
+
+    return clip, nil
+}
+
+// Handle a request for a clip
+func clipHandler(out http.ResponseWriter, in *http.Request, mp3Dir string) {
+    if in.Method != http.MethodGet {
+        http.Error(out, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    from, err := time.Parse(time.RFC3339, in.URL.Query().Get("start"))
+    if err != nil {
+        http.Error(out, "start must be an RFC 3339 time, e.g. 2026-10-16T13:04:05Z", http.StatusBadRequest)
+        return
+    }
+    seconds, err := strconv.ParseFloat(in.URL.Query().Get("duration"), 64)
+    duration := time.Duration(seconds * float64(time.Second))
+    if (err != nil) || (duration <= 0) || (duration > CLIP_MAX_DURATION) {
+        http.Error(out, fmt.Sprintf("duration must be a number of seconds, at most %d", CLIP_MAX_DURATION / time.Second),
+                   http.StatusBadRequest)
+        return
+    }
+    clip, err := cutClip(clipSources(mp3Dir), from, from.Add(duration))
+    if err != nil {
+        http.Error(out, err.Error(), http.StatusNotFound)
+        return
+    }
+    log.Printf("Serving a clip of %d second(s) from %s (%d byte(s)).\n", int(duration / time.Second), from.String(), len(clip))
+    out.Header().Set("Content-Type", "audio/mpeg")
+    out.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"chuffs-%s.mp3\"",
+                                                         from.UTC().Format(ARCHIVE_FILE_NAME_FORMAT)))
+    http.ServeContent(out, in, "", time.Time{}, bytes.NewReader(clip))
+}
+
+/* End Of File */
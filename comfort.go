@@ -0,0 +1,170 @@
+/* Comfort noise for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "math"
+    "math/rand"
+    "sync"
+    "time"
+)
+
+// When the HLS output buffer runs low a segment's worth of audio is
+// added to the PCM buffer to keep it going; digital silence makes it
+// obvious to a listener that the stream has died, so comfort noise is
+// added instead, matched to the background noise of the audio.  The
+// level of the background is followed in the same way as for noise
+// reduction (see denoise.go): the level of the quietest blocks, rising
+// slowly.  The shape of its spectrum is taken to be that of a one-pole
+// filter, the coefficient of which is the correlation between
+// neighbouring samples of the quiet blocks, and white noise is put
+// through that filter at the level of the background, separately for
+// each channel.  Until some audio has been heard the comfort noise is
+// silence.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of a comfort noise generator
+type ComfortNoise struct {
+    level       float64
+    learned     bool
+    // The coefficient of the shaping filter and its output in each
+    // channel
+    tilt        float64
+    filtered    [MAX_STREAM_CHANNELS]float64
+    inserted    time.Duration
+    locker      sync.Mutex
+}
+
+// Statistics of a comfort noise generator
+type ComfortNoiseStats struct {
+    LevelDbfs   float64  `json:"levelDbfs"`
+    Tilt        float64  `json:"tilt"`
+    InsertedMs  int64    `json:"insertedMs"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// A block within this many dB of the quietest is taken to be the
+// background
+const COMFORT_NOISE_QUIET_MARGIN_DB float64 = 6
+
+// How much the level of the quietest blocks rises each block, about
+// 6 dB a minute
+const COMFORT_NOISE_QUIET_RISE float64 = 1.00023
+
+// How much of the difference between a quiet block's tilt and the
+// current tilt is taken on
+const COMFORT_NOISE_TILT_WEIGHT float64 = 0.05
+
+// The most the shaping filter's coefficient may be, which keeps it
+// well away from instability
+const COMFORT_NOISE_MAX_TILT float64 = 0.95
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Learn the background noise from a block of audio going into the
+// PCM buffer
+func (comfort *ComfortNoise) Put(audio []int16) {
+    var energy float64
+    var correlation float64
+
+    channels := streamChannels
+    if len(audio) < channels * 2 {
+        return
+    }
+    comfort.locker.Lock()
+    defer comfort.locker.Unlock()
+
+    for x, sample := range audio {
+        energy += float64(sample) * float64(sample)
+        if x >= channels {
+            correlation += float64(sample) * float64(audio[x - channels])
+        }
+    }
+    level := math.Sqrt(energy / float64(len(audio)))
+    if !comfort.learned || (level < comfort.level) {
+        comfort.level = level
+    } else {
+        comfort.level *= COMFORT_NOISE_QUIET_RISE
+    }
+    if comfort.level < 1 {
+        // Digital silence, which would otherwise never rise
+        comfort.level = 1
+    }
+    if (energy > 0) && (level <= comfort.level * dbToGain(COMFORT_NOISE_QUIET_MARGIN_DB)) {
+        tilt := correlation / energy
+        if tilt < 0 {
+            tilt = 0
+        } else if tilt > COMFORT_NOISE_MAX_TILT {
+            tilt = COMFORT_NOISE_MAX_TILT
+        }
+        if comfort.learned {
+            comfort.tilt += (tilt - comfort.tilt) * COMFORT_NOISE_TILT_WEIGHT
+        } else {
+            comfort.tilt = tilt
+        }
+    }
+    comfort.learned = true
+}
+
+// Return numSamples of comfort noise in every channel, interleaved
+func (comfort *ComfortNoise) Generate(numSamples int) []int16 {
+    audio := make([]int16, numSamples * streamChannels)
+
+    comfort.locker.Lock()
+    defer comfort.locker.Unlock()
+
+    comfort.inserted += pcmDuration(numSamples * URTP_SAMPLE_SIZE * streamChannels)
+    if !comfort.learned {
+        return audio
+    }
+    // The gain on the white noise that gives the filter an output
+    // at the level of the background
+    gain := comfort.level * math.Sqrt(1 - comfort.tilt * comfort.tilt)
+    for x := range audio {
+        filtered := &comfort.filtered[x % streamChannels]
+        *filtered = *filtered * comfort.tilt + rand.NormFloat64() * gain
+        value := *filtered
+        if value > 32767 {
+            value = 32767
+        } else if value < -32768 {
+            value = -32768
+        }
+        audio[x] = int16(value)
+    }
+
+    return audio
+}
+
+// Return the statistics of the comfort noise generator
+func (comfort *ComfortNoise) Stats() interface{} {
+    comfort.locker.Lock()
+    defer comfort.locker.Unlock()
+
+    stats := ComfortNoiseStats{LevelDbfs: LEVEL_FLOOR_DBFS, Tilt: comfort.tilt,
+                               InsertedMs: int64(comfort.inserted / time.Millisecond)}
+    if comfort.learned {
+        stats.LevelDbfs = dbfs(comfort.level)
+    }
+
+    return stats
+}
+
+/* End Of File */
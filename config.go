@@ -0,0 +1,497 @@
+/* Config files for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+    "github.com/jessevdk/go-flags"
+)
+
+// The settings of the serve subcommand may be kept in a TOML config
+// file, each setting named as its long option, e.g.:
+//
+//   segment = 2000
+//   logfile = "/home/chuffs/ioc-server.log"
+//   corsorigin = ["https://www.example.org", "https://chuffs.example.org"]
+//
+// Only the part of TOML that the settings need is understood: comments,
+// bare or quoted keys at the top level, basic and literal strings,
+// integers, floats, booleans and arrays of those (which may run over
+// several lines).  Each value is checked against the type of the
+// setting and then set through the command line parser, so a value is
+// checked just as it would be on the command line.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The type of a TOML value
+type TomlType int
+
+// A TOML value, held as the string that would be given on the command line
+type TomlValue struct {
+    Type   TomlType
+    Value  string
+}
+
+// A TOML setting: the key and its values, more than one if it is an array
+type TomlSetting struct {
+    Line     int
+    Key      string
+    Values   []TomlValue
+    IsArray  bool
+}
+
+// The state of parsing a TOML file
+type TomlParser struct {
+    data  string
+    pos   int
+    line  int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The types of TOML value
+const (
+    TOML_STRING TomlType = iota
+    TOML_INTEGER
+    TOML_FLOAT
+    TOML_BOOLEAN
+)
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The names of the types of TOML value, for error messages
+var tomlTypeNames = map[TomlType]string{TOML_STRING: "a string", TOML_INTEGER: "an integer",
+                                        TOML_FLOAT: "a float", TOML_BOOLEAN: "a boolean"}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return an error at the current line of a TOML file
+func (parser *TomlParser) errorf(format string, args ...interface{}) error {
+    return errors.New(fmt.Sprintf("line %d: %s", parser.line, fmt.Sprintf(format, args...)))
+}
+
+// Return true if the end of the TOML file has been reached
+func (parser *TomlParser) atEnd() bool {
+    return parser.pos >= len(parser.data)
+}
+
+// Skip spaces and tabs and, if newlines is true, newlines and
+// comments as well
+func (parser *TomlParser) skipSpace(newlines bool) {
+    for !parser.atEnd() {
+        switch parser.data[parser.pos] {
+            case ' ', '\t':
+                parser.pos++
+            case '\r', '\n':
+                if !newlines {
+                    return
+                }
+                if parser.data[parser.pos] == '\n' {
+                    parser.line++
+                }
+                parser.pos++
+            case '#':
+                if !newlines {
+                    return
+                }
+                for !parser.atEnd() && (parser.data[parser.pos] != '\n') {
+                    parser.pos++
+                }
+            default:
+                return
+        }
+    }
+}
+
+// Expect the end of a line, allowing a comment before it
+func (parser *TomlParser) endOfLine() error {
+    parser.skipSpace(false)
+    if !parser.atEnd() && (parser.data[parser.pos] == '#') {
+        for !parser.atEnd() && (parser.data[parser.pos] != '\n') {
+            parser.pos++
+        }
+    }
+    if parser.atEnd() {
+        return nil
+    }
+    if strings.HasPrefix(parser.data[parser.pos:], "\r\n") {
+        parser.pos++
+    }
+    if parser.data[parser.pos] != '\n' {
+        return parser.errorf("expected the end of the line, found \"%c\"", parser.data[parser.pos])
+    }
+
+    return nil
+}
+
+// Parse a basic (double-quoted) string, the opening quote having been
+// consumed
+func (parser *TomlParser) basicString() (string, error) {
+    var value strings.Builder
+
+    for !parser.atEnd() {
+        character := parser.data[parser.pos]
+        parser.pos++
+        switch character {
+            case '"':
+                return value.String(), nil
+            case '\n':
+                return "", parser.errorf("string not closed before the end of the line")
+            case '\\':
+                if parser.atEnd() {
+                    return "", parser.errorf("string not closed before the end of the file")
+                }
+                escape := parser.data[parser.pos]
+                parser.pos++
+                switch escape {
+                    case 'b':
+                        value.WriteByte('\b')
+                    case 't':
+                        value.WriteByte('\t')
+                    case 'n':
+                        value.WriteByte('\n')
+                    case 'f':
+                        value.WriteByte('\f')
+                    case 'r':
+                        value.WriteByte('\r')
+                    case '"', '\\':
+                        value.WriteByte(escape)
+                    case 'u', 'U':
+                        length := 4
+                        if escape == 'U' {
+                            length = 8
+                        }
+                        if parser.pos + length > len(parser.data) {
+                            return "", parser.errorf("incomplete \\%c escape", escape)
+                        }
+                        code, err := strconv.ParseUint(parser.data[parser.pos:parser.pos + length], 16, 32)
+                        if (err != nil) || !utf8.ValidRune(rune(code)) {
+                            return "", parser.errorf("invalid \\%c escape \"%s\"", escape, parser.data[parser.pos:parser.pos + length])
+                        }
+                        value.WriteRune(rune(code))
+                        parser.pos += length
+                    default:
+                        return "", parser.errorf("invalid escape \"\\%c\"", escape)
+                }
+            default:
+                value.WriteByte(character)
+        }
+    }
+
+    return "", parser.errorf("string not closed before the end of the file")
+}
+
+// Parse a literal (single-quoted) string, the opening quote having
+// been consumed
+func (parser *TomlParser) literalString() (string, error) {
+    end := strings.IndexAny(parser.data[parser.pos:], "'\n")
+    if (end < 0) || (parser.data[parser.pos + end] != '\'') {
+        return "", parser.errorf("string not closed before the end of the line")
+    }
+    value := parser.data[parser.pos:parser.pos + end]
+    parser.pos += end + 1
+
+    return value, nil
+}
+
+// Parse a key
+func (parser *TomlParser) key() (string, error) {
+    if parser.atEnd() {
+        return "", parser.errorf("expected a key")
+    }
+    switch parser.data[parser.pos] {
+        case '"':
+            parser.pos++
+            return parser.basicString()
+        case '\'':
+            parser.pos++
+            return parser.literalString()
+        case '[':
+            return "", parser.errorf("tables aren't supported, settings go at the top level of the file")
+    }
+    start := parser.pos
+    for !parser.atEnd() {
+        character := parser.data[parser.pos]
+        if !(((character >= 'a') && (character <= 'z')) || ((character >= 'A') && (character <= 'Z')) ||
+             ((character >= '0') && (character <= '9')) || (character == '_') || (character == '-')) {
+            break
+        }
+        parser.pos++
+    }
+    if parser.pos == start {
+        return "", parser.errorf("expected a key, found \"%c\"", parser.data[parser.pos])
+    }
+
+    return parser.data[start:parser.pos], nil
+}
+
+// Parse a value that isn't an array
+func (parser *TomlParser) scalar() (TomlValue, error) {
+    if parser.atEnd() {
+        return TomlValue{}, parser.errorf("expected a value")
+    }
+    switch parser.data[parser.pos] {
+        case '"':
+            parser.pos++
+            value, err := parser.basicString()
+            return TomlValue{Type: TOML_STRING, Value: value}, err
+        case '\'':
+            parser.pos++
+            value, err := parser.literalString()
+            return TomlValue{Type: TOML_STRING, Value: value}, err
+    }
+    end := parser.pos + strings.IndexAny(parser.data[parser.pos:] + "\n", " \t\r\n#,]")
+    word := parser.data[parser.pos:end]
+    parser.pos = end
+    if (word == "true") || (word == "false") {
+        return TomlValue{Type: TOML_BOOLEAN, Value: word}, nil
+    }
+    number := strings.Replace(word, "_", "", -1)
+    if _, err := strconv.ParseInt(number, 10, 64); err == nil {
+        return TomlValue{Type: TOML_INTEGER, Value: number}, nil
+    }
+    if _, err := strconv.ParseFloat(number, 64); (err == nil) && (strings.ContainsAny(number, ".eE") ||
+                                                                  strings.HasSuffix(number, "inf") || strings.HasSuffix(number, "nan")) {
+        return TomlValue{Type: TOML_FLOAT, Value: number}, nil
+    }
+
+    return TomlValue{}, parser.errorf("invalid value \"%s\" (strings must be quoted)", word)
+}
+
+// Parse the next setting from a TOML file, returning nil at the end
+// of the file
+func (parser *TomlParser) next() (*TomlSetting, error) {
+    var err error
+
+    parser.skipSpace(true)
+    if parser.atEnd() {
+        return nil, nil
+    }
+    setting := TomlSetting{Line: parser.line}
+    setting.Key, err = parser.key()
+    if err != nil {
+        return nil, err
+    }
+    parser.skipSpace(false)
+    if parser.atEnd() || (parser.data[parser.pos] != '=') {
+        return nil, parser.errorf("expected \"=\" after \"%s\"", setting.Key)
+    }
+    parser.pos++
+    parser.skipSpace(false)
+    if !parser.atEnd() && (parser.data[parser.pos] == '[') {
+        // An array, which may run over several lines and end with a comma
+        setting.IsArray = true
+        parser.pos++
+        for {
+            parser.skipSpace(true)
+            if parser.atEnd() {
+                return nil, parser.errorf("array not closed before the end of the file")
+            }
+            if parser.data[parser.pos] == ']' {
+                parser.pos++
+                break
+            }
+            value, err := parser.scalar()
+            if err != nil {
+                return nil, err
+            }
+            if (len(setting.Values) > 0) && (value.Type != setting.Values[0].Type) {
+                return nil, parser.errorf("the values of \"%s\" are not all of the same type", setting.Key)
+            }
+            setting.Values = append(setting.Values, value)
+            parser.skipSpace(true)
+            if !parser.atEnd() && (parser.data[parser.pos] == ',') {
+                parser.pos++
+            } else if parser.atEnd() || (parser.data[parser.pos] != ']') {
+                return nil, parser.errorf("expected \",\" or \"]\" in the array of \"%s\"", setting.Key)
+            }
+        }
+    } else {
+        value, err := parser.scalar()
+        if err != nil {
+            return nil, err
+        }
+        setting.Values = append(setting.Values, value)
+    }
+
+    return &setting, parser.endOfLine()
+}
+
+// Return true if an option may be kept in a config file
+func configurable(option *flags.Option) bool {
+    return (option.LongName != "") && (option.Field().Tag.Get("no-ini") == "") &&
+           (reflect.ValueOf(option.Value()).Kind() != reflect.Func)
+}
+
+// Return the TOML type that an option of the given kind takes
+func tomlType(kind reflect.Kind) TomlType {
+    switch kind {
+        case reflect.Bool:
+            return TOML_BOOLEAN
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+             reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+            return TOML_INTEGER
+        case reflect.Float32, reflect.Float64:
+            return TOML_FLOAT
+    }
+
+    return TOML_STRING
+}
+
+// Load the settings in a TOML config file into the command line parser
+func loadConfigFile(parser *flags.Parser, fileName string) error {
+    data, err := os.ReadFile(fileName)
+    if err != nil {
+        return err
+    }
+    tomlParser := TomlParser{data: string(data), line: 1}
+    done := map[string]bool{}
+    for {
+        setting, err := tomlParser.next()
+        if err != nil {
+            return err
+        }
+        if setting == nil {
+            break
+        }
+        option := parser.FindOptionByLongName(setting.Key)
+        if (option == nil) || !configurable(option) {
+            return errors.New(fmt.Sprintf("line %d: unknown setting \"%s\"", setting.Line, setting.Key))
+        }
+        if done[setting.Key] {
+            return errors.New(fmt.Sprintf("line %d: \"%s\" is set more than once", setting.Line, setting.Key))
+        }
+        done[setting.Key] = true
+        valueType := reflect.TypeOf(option.Value())
+        if valueType.Kind() == reflect.Slice {
+            valueType = valueType.Elem()
+        } else if setting.IsArray {
+            return errors.New(fmt.Sprintf("line %d: \"%s\" takes a single value, not an array", setting.Line, setting.Key))
+        }
+        wanted := tomlType(valueType.Kind())
+        for _, value := range setting.Values {
+            // An integer will do for a float
+            if (value.Type != wanted) && !((wanted == TOML_FLOAT) && (value.Type == TOML_INTEGER)) {
+                return errors.New(fmt.Sprintf("line %d: \"%s\" takes %s, not %s", setting.Line, setting.Key,
+                                              tomlTypeNames[wanted], tomlTypeNames[value.Type]))
+            }
+            err = option.Set(&value.Value)
+            if err != nil {
+                return errors.New(fmt.Sprintf("line %d: \"%s\": %s", setting.Line, setting.Key, err.Error()))
+            }
+        }
+    }
+
+    return nil
+}
+
+// Return a string as a TOML basic string
+func tomlQuote(value string) string {
+    var quoted strings.Builder
+
+    quoted.WriteByte('"')
+    for _, character := range value {
+        switch character {
+            case '"', '\\':
+                quoted.WriteByte('\\')
+                quoted.WriteRune(character)
+            case '\t':
+                quoted.WriteString("\\t")
+            case '\n':
+                quoted.WriteString("\\n")
+            case '\r':
+                quoted.WriteString("\\r")
+            default:
+                if (character < 0x20) || (character == 0x7f) {
+                    fmt.Fprintf(&quoted, "\\u%04x", character)
+                } else {
+                    quoted.WriteRune(character)
+                }
+        }
+    }
+    quoted.WriteByte('"')
+
+    return quoted.String()
+}
+
+// Return a value as TOML
+func tomlFormat(value reflect.Value) string {
+    switch value.Kind() {
+        case reflect.Bool:
+            return strconv.FormatBool(value.Bool())
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            return strconv.FormatInt(value.Int(), 10)
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+            return strconv.FormatUint(value.Uint(), 10)
+        case reflect.Float32, reflect.Float64:
+            formatted := strconv.FormatFloat(value.Float(), 'g', -1, value.Type().Bits())
+            if !strings.ContainsAny(formatted, ".eEIN") {
+                formatted += ".0"
+            }
+            return strings.ToLower(strings.TrimPrefix(formatted, "+"))
+        case reflect.Slice:
+            elements := make([]string, value.Len())
+            for x := range elements {
+                elements[x] = tomlFormat(value.Index(x))
+            }
+            return "[" + strings.Join(elements, ", ") + "]"
+    }
+
+    return tomlQuote(fmt.Sprint(value.Interface()))
+}
+
+// Write the settings known to the command line parser to a TOML config
+// file, each with its description; those that haven't been given are
+// written commented out at their defaults
+func writeConfigFile(parser *flags.Parser, fileName string) error {
+    var data strings.Builder
+
+    groups := parser.Groups()
+    for len(groups) > 0 {
+        group := groups[0]
+        groups = append(groups[1:], group.Groups()...)
+        for _, option := range group.Options() {
+            if !configurable(option) {
+                continue
+            }
+            if data.Len() > 0 {
+                data.WriteString("\n")
+            }
+            if option.Description != "" {
+                fmt.Fprintf(&data, "# %s\n", option.Description)
+            }
+            if !option.IsSet() || option.IsSetDefault() {
+                data.WriteString("# ")
+            }
+            fmt.Fprintf(&data, "%s = %s\n", option.LongName, tomlFormat(reflect.ValueOf(option.Value())))
+        }
+    }
+
+    return os.WriteFile(fileName, []byte(data.String()), 0644)
+}
+
+/* End Of File */
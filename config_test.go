@@ -0,0 +1,170 @@
+/* Tests of the config files of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "github.com/jessevdk/go-flags"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The settings that the config file tests load
+type configTestOpts struct {
+    Segment  uint      `long:"segment" default:"1000" description:"segment duration"`
+    Scale    float64   `long:"scale" description:"scale"`
+    LogFile  string    `long:"logfile" description:"log file"`
+    Verbose  bool      `long:"verbose" description:"verbose"`
+    Policy   string    `long:"policy" default:"takeover" choice:"takeover" choice:"reject" description:"policy"`
+    Origins  []string  `long:"corsorigin" description:"origins"`
+    Ladder   []uint    `long:"ladder" description:"ladder"`
+    Config   string    `long:"config" no-ini:"true" description:"config file"`
+}
+
+// A config file test case: the file and the settings it should give,
+// or the error it should give
+type configTest struct {
+    name     string
+    file     string
+    args     []string
+    wanted   configTestOpts
+    err      string
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a parser of the config file test settings
+func configTestParser(opts *configTestOpts) *flags.Parser {
+    return flags.NewParser(opts, flags.None)
+}
+
+// Load config files and then command lines
+func TestLoadConfigFile(t *testing.T) {
+    defaults := configTestOpts{Segment: 1000, Policy: "takeover"}
+    tests := []configTest{
+        {"empty", "", nil, defaults, ""},
+        {"comments", "# nothing\n\n   # at all\n", nil, defaults, ""},
+        {"values", "segment = 2_000\nscale = 1.5 # comment\nlogfile = \"/x/y.log\"\nverbose = true\npolicy = 'reject'\n", nil,
+         configTestOpts{Segment: 2000, Scale: 1.5, LogFile: "/x/y.log", Verbose: true, Policy: "reject"}, ""},
+        {"integer float", "scale = 2", nil, configTestOpts{Segment: 1000, Scale: 2, Policy: "takeover"}, ""},
+        {"escapes", "logfile = \"a\\tb\\\"c\\u00e9\"", nil, configTestOpts{Segment: 1000, LogFile: "a\tb\"c\u00e9", Policy: "takeover"}, ""},
+        {"quoted key", "\"segment\" = 500", nil, configTestOpts{Segment: 500, Policy: "takeover"}, ""},
+        {"crlf", "segment = 500\r\nverbose = false\r\n", nil, configTestOpts{Segment: 500, Policy: "takeover"}, ""},
+        {"arrays", "corsorigin = [\n  \"https://a.org\", # first\n  \"https://b.org\",\n]\nladder = [32, 64]", nil,
+         configTestOpts{Segment: 1000, Policy: "takeover", Origins: []string{"https://a.org", "https://b.org"}, Ladder: []uint{32, 64}}, ""},
+        {"single value array", "corsorigin = \"https://a.org\"", nil,
+         configTestOpts{Segment: 1000, Policy: "takeover", Origins: []string{"https://a.org"}}, ""},
+        {"command line overrides", "segment = 2000\ncorsorigin = [\"https://a.org\"]",
+         []string{"--segment", "3000", "--corsorigin", "https://b.org"},
+         configTestOpts{Segment: 3000, Policy: "takeover", Origins: []string{"https://b.org"}}, ""},
+        {"unknown", "nosuch = 1", nil, configTestOpts{}, "line 1: unknown setting \"nosuch\""},
+        {"not configurable", "config = \"x\"", nil, configTestOpts{}, "line 1: unknown setting \"config\""},
+        {"twice", "segment = 1\n\nsegment = 2", nil, configTestOpts{}, "line 3: \"segment\" is set more than once"},
+        {"wrong type", "segment = \"2000\"", nil, configTestOpts{}, "line 1: \"segment\" takes an integer, not a string"},
+        {"wrong bool", "verbose = 1", nil, configTestOpts{}, "line 1: \"verbose\" takes a boolean, not an integer"},
+        {"array for single", "segment = [1]", nil, configTestOpts{}, "line 1: \"segment\" takes a single value, not an array"},
+        {"mixed array", "ladder = [1, \"2\"]", nil, configTestOpts{}, "line 1: the values of \"ladder\" are not all of the same type"},
+        {"bad choice", "policy = \"maybe\"", nil, configTestOpts{}, "line 1: \"policy\": Invalid value"},
+        {"unquoted", "logfile = /x", nil, configTestOpts{}, "line 1: invalid value \"/x\""},
+        {"unclosed string", "logfile = \"/x\nsegment = 1", nil, configTestOpts{}, "line 1: string not closed"},
+        {"unclosed array", "ladder = [1,\n2", nil, configTestOpts{}, "line 2: expected \",\" or \"]\""},
+        {"unclosed empty array", "ladder = [\n", nil, configTestOpts{}, "line 2: array not closed"},
+        {"bad escape", "logfile = \"\\q\"", nil, configTestOpts{}, "line 1: invalid escape"},
+        {"no equals", "segment 1", nil, configTestOpts{}, "line 1: expected \"=\""},
+        {"trailing", "segment = 1 2", nil, configTestOpts{}, "line 1: expected the end of the line"},
+        {"table", "[options]\nsegment = 1", nil, configTestOpts{}, "line 1: tables aren't supported"},
+    }
+
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            var opts configTestOpts
+
+            fileName := filepath.Join(t.TempDir(), "config.toml")
+            err := os.WriteFile(fileName, []byte(test.file), 0644)
+            if err != nil {
+                t.Fatal(err)
+            }
+            parser := configTestParser(&opts)
+            err = loadConfigFile(parser, fileName)
+            if test.err != "" {
+                if (err == nil) || !strings.HasPrefix(err.Error(), test.err) {
+                    t.Fatalf("expected error \"%s...\", got %v.", test.err, err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error (%s).", err.Error())
+            }
+            _, err = parser.ParseArgs(test.args)
+            if err != nil {
+                t.Fatalf("unexpected error parsing the command line (%s).", err.Error())
+            }
+            if !reflect.DeepEqual(opts, test.wanted) {
+                t.Errorf("expected %+v, got %+v.", test.wanted, opts)
+            }
+        })
+    }
+}
+
+// Write a config file and load it back
+func TestWriteConfigFile(t *testing.T) {
+    var opts configTestOpts
+    var loaded configTestOpts
+
+    parser := configTestParser(&opts)
+    _, err := parser.ParseArgs([]string{"--scale", "0.25", "--logfile", "C:\\logs\\\"chuffs\".log", "--verbose",
+                                        "--corsorigin", "https://a.org", "--corsorigin", "https://b.org"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    fileName := filepath.Join(t.TempDir(), "config.toml")
+    err = writeConfigFile(parser, fileName)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data, err := os.ReadFile(fileName)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, line := range []string{"# segment duration\n# segment = 1000\n", "scale = 0.25\n",
+                                  "corsorigin = [\"https://a.org\", \"https://b.org\"]\n", "# ladder = []\n"} {
+        if !strings.Contains(string(data), line) {
+            t.Errorf("expected \"%s\" in:\n%s", line, data)
+        }
+    }
+    if strings.Contains(string(data), "config") {
+        t.Errorf("expected no \"config\" setting in:\n%s", data)
+    }
+
+    loadedParser := configTestParser(&loaded)
+    err = loadConfigFile(loadedParser, fileName)
+    if err == nil {
+        _, err = loadedParser.ParseArgs(nil)
+    }
+    if err != nil {
+        t.Fatalf("unable to load the written config file (%s).", err.Error())
+    }
+    if !reflect.DeepEqual(loaded, opts) {
+        t.Errorf("expected %+v, got %+v.", opts, loaded)
+    }
+}
+
+/* End Of File */
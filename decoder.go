@@ -0,0 +1,273 @@
+/* Audio decoders for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+    "github.com/RobMeades/ioc-server/urtp"
+)
+
+// Each audio coding scheme has a decoder, registered here against the
+// audio coding scheme byte of the URTP header.  What is registered is
+// a factory: a set of decoders creates its own decoder for a scheme
+// when that scheme is first seen, so a decoder may keep whatever state
+// it needs between datagrams (e.g. predictor or filter state) without
+// it being shared with anything else.  A stateless decoder can simply
+// be a DecoderFunc.  Each TCP connection, and each UDP client address,
+// has its own set of decoders.  Each channel of a payload of more than
+// one channel is decoded by a decoder of its own and the channels are
+// interleaved afterwards, so decoders only ever see one channel.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Something that decodes the payload of a URTP datagram into 16-bit
+// samples, at the sampling frequency the client sends at unless it is
+// a SamplingFrequencyFixer, returning nil if it can't
+type Decoder interface {
+    Decode(payload []byte) *[]int16
+}
+
+// An ordinary function as a Decoder
+type DecoderFunc func(payload []byte) *[]int16
+
+// A function that creates a decoder
+type DecoderFactory func() (Decoder, error)
+
+// What a decoder may also be if it can say what the highest UNICAM
+// shift value in the last payload it decoded was
+type PeakShifter interface {
+    PeakShift() int
+}
+
+// What a decoder may also be if it always decodes to the same sampling
+// frequency, whatever the client sends at
+type SamplingFrequencyFixer interface {
+    SamplingFrequency() int
+}
+
+// The audio coding scheme and channel of a decoder
+type DecoderChannel struct {
+    CodingScheme  byte
+    Channel       int
+}
+
+// A set of decoders, one per audio coding scheme and channel, created
+// as needed
+type Decoders struct {
+    // The client the decoders are for: its address, or the serial
+    // device it is attached to
+    Source    string
+    decoders  map[DecoderChannel]Decoder
+    locker    sync.Mutex
+    // When the decoders were last used, maintained by clientDecoders()
+    lastUsed  time.Time
+    // The receiving end of FEC for the client, nil until it sends
+    // a FEC shard
+    fec       *urtp.FecReceiver
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The registered decoder factories, keyed by audio coding scheme
+var decoderFactories = make(map[byte]DecoderFactory)
+var decoderFactoriesLocker sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Decode with an ordinary function
+func (function DecoderFunc) Decode(payload []byte) *[]int16 {
+    return function(payload)
+}
+
+// Register a decoder factory for an audio coding scheme, replacing any
+// factory already registered for that scheme
+func registerDecoder(codingScheme byte, factory DecoderFactory) {
+    decoderFactoriesLocker.Lock()
+    decoderFactories[codingScheme] = factory
+    decoderFactoriesLocker.Unlock()
+}
+
+// Return a factory for a stateless decoder
+func statelessDecoder(function DecoderFunc) DecoderFactory {
+    return func() (Decoder, error) {
+        return function, nil
+    }
+}
+
+// Register a stateless decoder for an audio coding scheme
+func registerDecoderFunc(codingScheme byte, function DecoderFunc) {
+    registerDecoder(codingScheme, statelessDecoder(function))
+}
+
+// Register the decoders for the built-in audio coding schemes; UNICAM
+// always has the DSP chain applied, the others only if
+// dspAllCodingSchemes is set
+func registerBuiltInDecoders() {
+    registerDecoder(urtp.UNICAM_COMPRESSED_8_BIT, unicamDecoderFactory(8))
+    registerDecoder(urtp.UNICAM_COMPRESSED_10_BIT, unicamDecoderFactory(10))
+    registerDecoder(urtp.UNICAM_COMPRESSED_12_BIT, unicamDecoderFactory(12))
+    for codingScheme, factory := range map[byte]DecoderFactory{urtp.PCM_SIGNED_16_BIT: statelessDecoder(decodePcm),
+                                                               urtp.PCM_SIGNED_16_BIT_LITTLE_ENDIAN: statelessDecoder(decodePcmLittleEndian),
+                                                               urtp.PCM_UNSIGNED_8_BIT: statelessDecoder(decodePcmUnsigned8),
+                                                               urtp.IMA_ADPCM_4_BIT: statelessDecoder(decodeImaAdpcm),
+                                                               urtp.OPUS_COMPRESSED: newOpusDecoder} {
+        if dspAllCodingSchemes {
+            factory = withDsp(factory)
+        }
+        registerDecoder(codingScheme, factory)
+    }
+}
+
+// Create an empty set of decoders
+func newDecoders() *Decoders {
+    return &Decoders{decoders: make(map[DecoderChannel]Decoder)}
+}
+
+// Decode the payload of one channel, creating the decoder for the
+// scheme and channel if this is the first time it has been used; the
+// lock must be held
+func (decoders *Decoders) decode(key DecoderChannel, payload []byte) *[]int16 {
+    var audio *[]int16
+
+    decoder := decoders.decoders[key]
+    if decoder == nil {
+        decoderFactoriesLocker.Lock()
+        factory := decoderFactories[key.CodingScheme]
+        decoderFactoriesLocker.Unlock()
+        if factory != nil {
+            var err error
+            decoder, err = factory()
+            if err == nil {
+                decoders.decoders[key] = decoder
+            } else {
+                log.Printf("Unable to create a decoder for audio coding scheme %d (%s).\n", key.CodingScheme, err.Error())
+            }
+        }
+    }
+    if decoder != nil {
+        audio = decoder.Decode(payload)
+    }
+
+    return audio
+}
+
+// Decode a payload of the given number of channels coded with the
+// given audio coding scheme, returning the channels interleaved;
+// returns nil if there is no decoder for the scheme or the payload
+// can't be decoded
+func (decoders *Decoders) Decode(codingScheme byte, channels int, payload []byte) *[]int16 {
+    decoders.locker.Lock()
+    defer decoders.locker.Unlock()
+
+    if channels <= 1 {
+        return decoders.decode(DecoderChannel{CodingScheme: codingScheme}, payload)
+    }
+    if len(payload) % channels != 0 {
+        return nil
+    }
+
+    // Decode each channel, the shortest setting the length
+    size := len(payload) / channels
+    decoded := make([]*[]int16, 0, channels)
+    length := -1
+    for channel := 0; channel < channels; channel++ {
+        audio := decoders.decode(DecoderChannel{CodingScheme: codingScheme, Channel: channel},
+                                 payload[channel * size:(channel + 1) * size])
+        if (audio != nil) && ((length < 0) || (len(*audio) < length)) {
+            length = len(*audio)
+        }
+        decoded = append(decoded, audio)
+    }
+    var interleaved *[]int16
+    if length >= 0 {
+        interleaved = getAudio(length * channels)
+    }
+    for channel, audio := range decoded {
+        if audio == nil {
+            putAudio(interleaved)
+            interleaved = nil
+        } else if interleaved != nil {
+            for x := 0; x < length; x++ {
+                (*interleaved)[x * channels + channel] = (*audio)[x]
+            }
+        }
+        putAudio(audio)
+    }
+
+    return interleaved
+}
+
+// Return the highest UNICAM shift value, in any channel, in the
+// payload last decoded with the given audio coding scheme, -1 if the
+// decoder for the scheme doesn't have shift values
+func (decoders *Decoders) PeakShift(codingScheme byte) int {
+    peak := -1
+
+    decoders.locker.Lock()
+    defer decoders.locker.Unlock()
+
+    for key, decoder := range decoders.decoders {
+        if peakShifter, ok := decoder.(PeakShifter); ok && (key.CodingScheme == codingScheme) {
+            if shift := peakShifter.PeakShift(); shift > peak {
+                peak = shift
+            }
+        }
+    }
+
+    return peak
+}
+
+// Return the sampling frequency of what is decoded with the given
+// audio coding scheme, given that of the client
+func (decoders *Decoders) SamplingFrequency(codingScheme byte, clientFrequency int) int {
+    decoders.locker.Lock()
+    defer decoders.locker.Unlock()
+
+    fixer, ok := decoders.decoders[DecoderChannel{CodingScheme: codingScheme}].(SamplingFrequencyFixer)
+    if !ok {
+        return clientFrequency
+    }
+
+    return fixer.SamplingFrequency()
+}
+
+// Return the decoders of a client, keyed by its address in
+// decodersByClient, creating them if this is a new client and
+// forgetting those of clients that have been quiet for longer than
+// SESSION_IDLE_TIME, so that a returning client starts afresh
+func clientDecoders(decodersByClient map[string]*Decoders, client string, now time.Time) *Decoders {
+    decoders := decodersByClient[client]
+    if (decoders == nil) || (now.Sub(decoders.lastUsed) > SESSION_IDLE_TIME) {
+        for key, item := range decodersByClient {
+            if now.Sub(item.lastUsed) > SESSION_IDLE_TIME {
+                delete(decodersByClient, key)
+            }
+        }
+        decoders = newDecoders()
+        decoders.Source = client
+        decodersByClient[client] = decoders
+    }
+    decoders.lastUsed = now
+
+    return decoders
+}
+
+/* End Of File */
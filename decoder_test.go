@@ -0,0 +1,102 @@
+/* Benchmarks of the decoders of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "testing"
+    "github.com/RobMeades/ioc-server/urtp"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A decoding benchmark: a block of a coding scheme
+type decodeBenchmark struct {
+    name          string
+    codingScheme  byte
+    channels      int
+    payload       []byte
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return size bytes of something that looks like coded audio
+func benchmarkPayload(size int) []byte {
+    payload := make([]byte, size)
+    for x := range payload {
+        payload[x] = byte(x * 37 + x / 7)
+    }
+
+    return payload
+}
+
+// Return the size of a block of UNICAM data of sampleSizeBits
+func unicamBlockSize(sampleSizeBits int) int {
+    numBlocks := SAMPLING_FREQUENCY * BLOCK_DURATION_MS / 1000 / SAMPLES_PER_UNICAM_BLOCK
+
+    return numBlocks * SAMPLES_PER_UNICAM_BLOCK * sampleSizeBits / 8 + (numBlocks + 1) / 2
+}
+
+// Decode a block of each of the built-in audio coding schemes, as a
+// client would send it, the audio being given back to the pool as the
+// processing loop would
+func BenchmarkDecode(b *testing.B) {
+    blockSamples := SAMPLING_FREQUENCY * BLOCK_DURATION_MS / 1000
+    benchmarks := []decodeBenchmark{
+        {"unicam8", urtp.UNICAM_COMPRESSED_8_BIT, 1, benchmarkPayload(unicamBlockSize(8))},
+        {"unicam10", urtp.UNICAM_COMPRESSED_10_BIT, 1, benchmarkPayload(unicamBlockSize(10))},
+        {"unicam12", urtp.UNICAM_COMPRESSED_12_BIT, 1, benchmarkPayload(unicamBlockSize(12))},
+        {"unicam8_stereo", urtp.UNICAM_COMPRESSED_8_BIT, 2, benchmarkPayload(unicamBlockSize(8) * 2)},
+        {"pcm16", urtp.PCM_SIGNED_16_BIT, 1, benchmarkPayload(blockSamples * 2)},
+        {"pcm16le", urtp.PCM_SIGNED_16_BIT_LITTLE_ENDIAN, 1, benchmarkPayload(blockSamples * 2)},
+        {"pcm8", urtp.PCM_UNSIGNED_8_BIT, 1, benchmarkPayload(blockSamples)},
+        {"ima_adpcm", urtp.IMA_ADPCM_4_BIT, 1, benchmarkPayload(IMA_ADPCM_HEADER_SIZE + blockSamples / 2)},
+    }
+
+    registerBuiltInDecoders()
+    for _, benchmark := range benchmarks {
+        b.Run(benchmark.name, func(b *testing.B) {
+            decoders := newDecoders()
+            b.ReportAllocs()
+            b.SetBytes(int64(len(benchmark.payload)))
+            for x := 0; x < b.N; x++ {
+                audio := decoders.Decode(benchmark.codingScheme, benchmark.channels, benchmark.payload)
+                if audio == nil {
+                    b.Fatalf("unable to decode %s.", benchmark.name)
+                }
+                putAudio(audio)
+            }
+        })
+    }
+}
+
+// Read the compressed values of a UNICAM block of each sample size
+func BenchmarkUnicamValues(b *testing.B) {
+    for _, sampleSizeBits := range []int{8, 10, 12} {
+        table := unicamSignExtendTable(sampleSizeBits)
+        data := benchmarkPayload(SAMPLES_PER_UNICAM_BLOCK * sampleSizeBits / 8)
+        values := make([]int16, SAMPLES_PER_UNICAM_BLOCK)
+        b.Run(fmt.Sprintf("%dbit", sampleSizeBits), func(b *testing.B) {
+            b.ReportAllocs()
+            for x := 0; x < b.N; x++ {
+                unicamValues(data, sampleSizeBits, table, values)
+            }
+        })
+    }
+}
+
+/* End Of File */
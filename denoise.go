@@ -0,0 +1,246 @@
+/* Spectral noise reduction for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "math"
+    "math/cmplx"
+    "sync"
+)
+
+// Recordings from the cab have a lot of steady hiss, which no fixed
+// filter can take out without taking the chuffs with it, so the decoded
+// audio may be put through spectral subtraction.  The audio is cut
+// into frames of DENOISE_FRAME_SIZE samples, overlapping by half, each
+// with a square-root Hann window; the spectrum of each frame has an
+// estimate of the spectrum of the noise subtracted from it, times the
+// strength, but is never taken below the floor (a fraction of what
+// it was, which avoids "musical noise"), and the frames are windowed
+// again and added back together, which costs a delay of one frame.  The
+// noise spectrum is learned from the frames that are quiet: the level
+// of the quietest frames is followed, rising slowly so that it keeps
+// up with the hiss getting louder, and a frame within
+// DENOISE_QUIET_MARGIN_DB of it counts as quiet.  Each channel of a
+// stereo stream is reduced separately, with a noise spectrum of its
+// own, since the microphones may be in quite different places.  Noise
+// reduction comes before the noise gate and the AGC.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of noise reduction for one channel
+type DenoiseChannel struct {
+    // The last DENOISE_FRAME_SIZE samples in
+    input       []float64
+    // Samples in since the last frame was processed
+    hop         []float64
+    // The overlap-add of the processed frames
+    overlap     []float64
+    // Processed samples waiting to go out
+    output      []float64
+    noise       []float64
+    quietLevel  float64
+    learned     bool
+}
+
+// State of a noise reducer
+type NoiseReducer struct {
+    Strength    float64
+    Floor       float64
+    window      []float64
+    channels    []*DenoiseChannel
+    spectrum    []complex128
+    locker      sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of samples in a frame, a power of two
+const DENOISE_FRAME_SIZE int = 512
+
+// The number of samples between frames
+const DENOISE_HOP_SIZE int = DENOISE_FRAME_SIZE / 2
+
+// A frame within this many dB of the quietest is taken to be noise
+const DENOISE_QUIET_MARGIN_DB float64 = 6
+
+// How much the level of the quietest frames rises each frame, about
+// 6 dB a minute
+const DENOISE_QUIET_RISE float64 = 1.0005
+
+// How much of the difference between a quiet frame's spectrum and the
+// noise spectrum is added to the noise spectrum
+const DENOISE_NOISE_WEIGHT float64 = 0.05
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Do an in-place radix-2 FFT of data, the length of which must be a
+// power of two, or the inverse FFT (without scaling) if inverse is true
+func fft(data []complex128, inverse bool) {
+    length := len(data)
+
+    // Bit-reversal permutation
+    for x, y := 1, 0; x < length; x++ {
+        bit := length >> 1
+        for ; y & bit != 0; bit >>= 1 {
+            y ^= bit
+        }
+        y ^= bit
+        if x < y {
+            data[x], data[y] = data[y], data[x]
+        }
+    }
+    sign := -1.0
+    if inverse {
+        sign = 1
+    }
+    for size := 2; size <= length; size <<= 1 {
+        step := cmplx.Exp(complex(0, sign * 2 * math.Pi / float64(size)))
+        for start := 0; start < length; start += size {
+            twiddle := complex(1, 0)
+            for x := 0; x < size / 2; x++ {
+                even := data[start + x]
+                odd := data[start + x + size / 2] * twiddle
+                data[start + x] = even + odd
+                data[start + x + size / 2] = even - odd
+                twiddle *= step
+            }
+        }
+    }
+}
+
+// Create a noise reducer that subtracts strength times the noise
+// spectrum, taking no bin below floorDb of what it was
+func newNoiseReducer(strength float64, floorDb float64) *NoiseReducer {
+    reducer := &NoiseReducer{Strength: strength, Floor: dbToGain(floorDb),
+                             window: make([]float64, DENOISE_FRAME_SIZE),
+                             spectrum: make([]complex128, DENOISE_FRAME_SIZE)}
+    for x := 0; x < streamChannels; x++ {
+        reducer.channels = append(reducer.channels,
+                                  &DenoiseChannel{input: make([]float64, DENOISE_FRAME_SIZE),
+                                                  hop: make([]float64, 0, DENOISE_HOP_SIZE),
+                                                  overlap: make([]float64, DENOISE_FRAME_SIZE),
+                                                  // One hop of delay
+                                                  output: make([]float64, DENOISE_HOP_SIZE),
+                                                  noise: make([]float64, DENOISE_FRAME_SIZE / 2 + 1)})
+    }
+    // Square-root periodic Hann, applied going in and coming out, so
+    // that frames overlapping by half add up to one
+    for x := range reducer.window {
+        reducer.window[x] = math.Sqrt(0.5 - 0.5 * math.Cos(2 * math.Pi * float64(x) / float64(DENOISE_FRAME_SIZE)))
+    }
+    log.Printf("Noise reduction enabled: strength %.1f, floor %.1f dB.\n", strength, floorDb)
+
+    return reducer
+}
+
+// Process the frame in the input buffer of a channel, adding the
+// result to its overlap buffer and moving a hop of finished samples to
+// its output
+func (reducer *NoiseReducer) processFrame(channel *DenoiseChannel) {
+    var energy float64
+
+    for x, sample := range channel.input {
+        reducer.spectrum[x] = complex(sample * reducer.window[x], 0)
+        energy += sample * sample
+    }
+    level := math.Sqrt(energy / float64(DENOISE_FRAME_SIZE))
+    fft(reducer.spectrum, false)
+
+    // Learn the noise from the quiet frames
+    if !channel.learned || (level < channel.quietLevel) {
+        channel.quietLevel = level
+    } else {
+        channel.quietLevel *= DENOISE_QUIET_RISE
+    }
+    if channel.quietLevel < 1 {
+        // Digital silence, which would otherwise never rise
+        channel.quietLevel = 1
+    }
+    if level <= channel.quietLevel * dbToGain(DENOISE_QUIET_MARGIN_DB) {
+        for x := range channel.noise {
+            magnitude := cmplx.Abs(reducer.spectrum[x])
+            if channel.learned {
+                channel.noise[x] += (magnitude - channel.noise[x]) * DENOISE_NOISE_WEIGHT
+            } else {
+                channel.noise[x] = magnitude
+            }
+        }
+        channel.learned = true
+    }
+
+    // Subtract the noise, keeping the phase, the upper half of the
+    // spectrum mirroring the lower half
+    for x := range channel.noise {
+        magnitude := cmplx.Abs(reducer.spectrum[x])
+        if magnitude > 0 {
+            reduced := magnitude - reducer.Strength * channel.noise[x]
+            if reduced < magnitude * reducer.Floor {
+                reduced = magnitude * reducer.Floor
+            }
+            reducer.spectrum[x] *= complex(reduced / magnitude, 0)
+            if (x > 0) && (x < DENOISE_FRAME_SIZE / 2) {
+                reducer.spectrum[DENOISE_FRAME_SIZE - x] = cmplx.Conj(reducer.spectrum[x])
+            }
+        }
+    }
+    fft(reducer.spectrum, true)
+
+    for x := range channel.overlap {
+        channel.overlap[x] += real(reducer.spectrum[x]) / float64(DENOISE_FRAME_SIZE) * reducer.window[x]
+    }
+    channel.output = append(channel.output, channel.overlap[:DENOISE_HOP_SIZE]...)
+    copy(channel.overlap, channel.overlap[DENOISE_HOP_SIZE:])
+    for x := DENOISE_FRAME_SIZE - DENOISE_HOP_SIZE; x < DENOISE_FRAME_SIZE; x++ {
+        channel.overlap[x] = 0
+    }
+}
+
+// Apply noise reduction to a block of interleaved audio in place; what
+// comes out is one frame behind what went in
+func (reducer *NoiseReducer) Process(audio []int16) {
+    reducer.locker.Lock()
+    defer reducer.locker.Unlock()
+
+    numChannels := len(reducer.channels)
+    numSamples := len(audio) / numChannels
+    for index, channel := range reducer.channels {
+        for x := 0; x < numSamples; x++ {
+            channel.hop = append(channel.hop, float64(audio[x * numChannels + index]))
+            if len(channel.hop) == DENOISE_HOP_SIZE {
+                copy(channel.input, channel.input[DENOISE_HOP_SIZE:])
+                copy(channel.input[DENOISE_FRAME_SIZE - DENOISE_HOP_SIZE:], channel.hop)
+                reducer.processFrame(channel)
+                channel.hop = channel.hop[:0]
+            }
+        }
+        for x := 0; x < numSamples; x++ {
+            value := channel.output[x]
+            if value > 32767 {
+                value = 32767
+            } else if value < -32768 {
+                value = -32768
+            }
+            audio[x * numChannels + index] = int16(value)
+        }
+        channel.output = append(channel.output[:0], channel.output[numSamples:]...)
+    }
+}
+
+/* End Of File */
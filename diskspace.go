@@ -0,0 +1,132 @@
+/* Disk space monitoring for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "context"
+    "log"
+    "sync"
+    "time"
+)
+
+// A Raspberry Pi with a full SD card stops writing segments, and so
+// stops streaming, so the file systems that the server writes to (that
+// of the segment files and that of the log file) are checked every
+// DISK_SPACE_CHECK_PERIOD: once the space free on one falls below
+// --diskwarn percent a disk_space event is published, for webhooks
+// and scripts, and it isn't published again for that file system until
+// the space free has risen back above the threshold by
+// DISK_SPACE_HYSTERESIS_PERCENT.  Disk space is only known on Linux.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The disk space monitor
+type DiskSpaceMonitor struct {
+    Paths        []string
+    WarnPercent  float64
+    locker       sync.Mutex
+    // The paths that have been warned about
+    warned       map[string]bool
+    warnings     int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How often disk space is checked
+const DISK_SPACE_CHECK_PERIOD time.Duration = time.Minute
+
+// How far above the threshold the space free must rise before there
+// is another warning
+const DISK_SPACE_HYSTERESIS_PERCENT float64 = 2
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The disk space monitor, nil if disk space isn't monitored
+var diskSpaceMonitor *DiskSpaceMonitor
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a disk space monitor for the file systems of paths, warning
+// when less than warnPercent is free
+func newDiskSpaceMonitor(paths []string, warnPercent uint) *DiskSpaceMonitor {
+    log.Printf("A warning will be given if less than %d%% of the disk is free for %v.\n", warnPercent, paths)
+
+    return &DiskSpaceMonitor{Paths: paths, WarnPercent: float64(warnPercent), warned: make(map[string]bool)}
+}
+
+// Check the space free for each path
+func (monitor *DiskSpaceMonitor) check() {
+    for _, path := range monitor.Paths {
+        free, total, err := diskSpace(path)
+        if (err != nil) || (total == 0) {
+            continue
+        }
+        percent := float64(free) * 100 / float64(total)
+        monitor.locker.Lock()
+        warn := !monitor.warned[path] && (percent < monitor.WarnPercent)
+        if warn {
+            monitor.warned[path] = true
+            monitor.warnings++
+        } else if percent >= monitor.WarnPercent + DISK_SPACE_HYSTERESIS_PERCENT {
+            monitor.warned[path] = false
+        }
+        monitor.locker.Unlock()
+        if warn {
+            log.Printf("Only %.1f%% (%d Mbyte(s)) of the disk is free for \"%s\".\n", percent, free / 1024 / 1024, path)
+            publishEvent(EVENT_DISK_SPACE, map[string]interface{}{"path": path, "freeBytes": int64(free), "totalBytes": int64(total),
+                                                                  "freePercent": percent})
+        }
+    }
+}
+
+// Check the disk space until ctx is done
+func (monitor *DiskSpaceMonitor) Run(ctx context.Context) {
+    ticker := time.NewTicker(DISK_SPACE_CHECK_PERIOD)
+    defer ticker.Stop()
+
+    monitor.check()
+    for {
+        select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                monitor.check()
+        }
+    }
+}
+
+// Return the statistics of the disk space monitor
+func (monitor *DiskSpaceMonitor) Stats() interface{} {
+    paths := make(map[string]interface{})
+
+    for _, path := range monitor.Paths {
+        free, total, err := diskSpace(path)
+        if err == nil {
+            paths[path] = map[string]interface{}{"freeBytes": free, "totalBytes": total}
+        }
+    }
+    monitor.locker.Lock()
+    defer monitor.locker.Unlock()
+
+    return map[string]interface{}{"paths": paths, "warnings": monitor.warnings}
+}
+
+/* End Of File */
@@ -0,0 +1,38 @@
+/* Disk space for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+//go:build linux
+
+package main
+
+import (
+    "syscall"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the bytes free, to an unprivileged user, and the total bytes
+// of the file system that a path is on
+func diskSpace(path string) (uint64, uint64, error) {
+    var stat syscall.Statfs_t
+
+    err := syscall.Statfs(path, &stat)
+    if err != nil {
+        return 0, 0, err
+    }
+
+    return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+/* End Of File */
@@ -0,0 +1,30 @@
+/* Disk space stub for non-Linux platforms for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+//go:build !linux
+
+package main
+
+import (
+    "errors"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Disk space is only known on Linux
+func diskSpace(path string) (uint64, uint64, error) {
+    return 0, 0, errors.New("disk space is not known on this platform")
+}
+
+/* End Of File */
@@ -0,0 +1,166 @@
+/* Downlink audio for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/RobMeades/ioc-server/urtp"
+)
+
+// Audio (e.g. an announcement or talkback) may be sent to a client
+// connected over TCP.  It is queued here as 16-bit PCM at the incoming
+// sampling frequency and sent at real time, one block every
+// BLOCK_DURATION_MS, as downlink datagrams.  A downlink datagram mirrors
+// a URTP datagram, with DOWNLINK_SYNC_BYTE in place of SYNC_BYTE so that
+// it can't be confused with a timing datagram:
+//
+//   - DOWNLINK_SYNC_BYTE,
+//   - one byte, the audio coding scheme (always PCM_SIGNED_16_BIT),
+//   - two bytes (big-endian), the sequence number,
+//   - eight bytes (big-endian), the timestamp in microseconds since
+//     the downlink audio started,
+//   - two bytes (big-endian), the number of bytes of payload,
+//   - the payload, big-endian 16-bit samples.
+//
+// A client that doesn't support downlink audio can ignore it.
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// Marker at the start of a downlink datagram
+const DOWNLINK_SYNC_BYTE byte = 0xa9
+
+// The most audio that can be waiting to go to the client
+const DOWNLINK_MAX_QUEUED_MILLISECONDS int = 30000
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Downlink audio waiting to be sent, and the sequence number and
+// timestamp of the next downlink datagram
+var downlinkAudio []int16
+var downlinkSequenceNumber uint16
+var downlinkStarted time.Time
+var downlinkLocker sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Encode samples as PCM_SIGNED_16_BIT for a datagram
+func encodePcm(audio []int16) []byte {
+    audioDataPcm := make([]byte, len(audio) * URTP_SAMPLE_SIZE)
+
+    x := 0
+    for _, sample := range audio {
+        audioDataPcm[x] = byte(sample >> 8)
+        audioDataPcm[x + 1] = byte(sample)
+        x += 2
+    }
+
+    return audioDataPcm
+}
+
+// Queue little-endian 16-bit PCM (the same format as the raw PCM
+// output file) to be sent to the client
+func queueDownlinkAudio(pcm []byte) error {
+    var err error
+
+    numSamples := len(pcm) / URTP_SAMPLE_SIZE
+    downlinkLocker.Lock()
+    if (len(downlinkAudio) + numSamples) * 1000 / SAMPLING_FREQUENCY <= DOWNLINK_MAX_QUEUED_MILLISECONDS {
+        if len(downlinkAudio) == 0 {
+            downlinkStarted = time.Time{}
+        }
+        for x := 0; x < numSamples; x++ {
+            downlinkAudio = append(downlinkAudio, int16(pcm[x * URTP_SAMPLE_SIZE]) | (int16(pcm[x * URTP_SAMPLE_SIZE + 1]) << 8))
+        }
+        log.Printf("%d ms of downlink audio queued, %d ms now waiting.\n", numSamples * 1000 / SAMPLING_FREQUENCY,
+                   len(downlinkAudio) * 1000 / SAMPLING_FREQUENCY)
+    } else {
+        err = errors.New(fmt.Sprintf("no more than %d ms of downlink audio may be waiting to be sent", DOWNLINK_MAX_QUEUED_MILLISECONDS))
+    }
+    downlinkLocker.Unlock()
+
+    return err
+}
+
+// Make the next downlink datagram from the queued audio, returning
+// nil if there is none
+func makeDownlinkDatagram(now time.Time) []byte {
+    var downlinkDatagram []byte
+
+    downlinkLocker.Lock()
+    if len(downlinkAudio) > 0 {
+        if downlinkStarted.IsZero() {
+            downlinkStarted = now
+        }
+        numSamples := len(downlinkAudio)
+        if numSamples > SAMPLES_PER_BLOCK {
+            numSamples = SAMPLES_PER_BLOCK
+        }
+        payload := encodePcm(downlinkAudio[:numSamples])
+        downlinkAudio = downlinkAudio[numSamples:]
+        timestamp := uint64(now.Sub(downlinkStarted) / time.Microsecond)
+        downlinkDatagram = append(downlinkDatagram, DOWNLINK_SYNC_BYTE, urtp.PCM_SIGNED_16_BIT,
+                                  byte(downlinkSequenceNumber >> 8), byte(downlinkSequenceNumber))
+        for x := 7; x >= 0; x-- {
+            downlinkDatagram = append(downlinkDatagram, byte(timestamp >> (uint(x) * 8)))
+        }
+        downlinkDatagram = append(downlinkDatagram, byte(len(payload) >> 8), byte(len(payload)))
+        downlinkDatagram = append(downlinkDatagram, payload...)
+        downlinkSequenceNumber++
+        if len(downlinkAudio) == 0 {
+            log.Printf("All downlink audio sent.\n")
+        }
+    }
+    downlinkLocker.Unlock()
+
+    return downlinkDatagram
+}
+
+// Send any queued downlink audio to a TCP client at real time until
+// done is closed; if framed is non-zero the client has asked for
+// length-prefixed framing (use atomic operations)
+func operateDownlink(server net.Conn, done <-chan struct{}, framed *int32) {
+    ticker := time.NewTicker(time.Duration(BLOCK_DURATION_MS) * time.Millisecond)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-done:
+                return
+            case now := <-ticker.C:
+                downlinkDatagram := makeDownlinkDatagram(now)
+                if downlinkDatagram != nil {
+                    if atomic.LoadInt32(framed) != 0 {
+                        downlinkDatagram = urtp.LengthPrefixed([][]byte{downlinkDatagram})[0]
+                    }
+                    _, err := server.Write(downlinkDatagram)
+                    if err != nil {
+                        log.Printf("Couldn't send downlink datagram (%s).\n", err.Error())
+                    }
+                }
+        }
+    }
+}
+
+/* End Of File */
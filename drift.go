@@ -0,0 +1,237 @@
+/* Clock drift compensation for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// The client's sample clock and the server's clock never run at quite
+// the same rate so, over hours, the PCM buffer slowly fills up or runs
+// dry.  The drift is estimated by comparing the URTP timestamps of the
+// datagrams with the times they arrive: the offset between the two
+// varies with network delay but its minimum over a window of
+// DRIFT_WINDOW is a good measure of the clocks alone, and the slope of
+// a straight line fitted through the minima of the last
+// DRIFT_NUM_WINDOWS windows is the drift.  Once there are enough
+// windows to go on, a sample is dropped from (or added to) the audio,
+// in every channel at once, every so often to take up the difference.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The minimum offset between arrival time and timestamp over a window
+type DriftWindow struct {
+    Elapsed    time.Duration
+    MinOffset  time.Duration
+}
+
+// State of clock drift compensation
+type ClockDrift struct {
+    firstArrival    time.Time
+    firstTimestamp  uint64
+    lastOffset      time.Duration
+    window          DriftWindow
+    windowStarted   time.Duration
+    windowEmpty     bool
+    windows         []DriftWindow
+    // How much faster the client's clock runs than the server's, in
+    // parts per million
+    ppm             float64
+    // Samples owed (positive) or to be given back (negative)
+    correction      float64
+    samplesDropped  int
+    samplesAdded    int
+    locker          sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The period over which the minimum offset is found
+const DRIFT_WINDOW time.Duration = time.Second * 10
+
+// The number of windows the drift is estimated over
+const DRIFT_NUM_WINDOWS int = 30
+
+// The number of windows needed before the drift is compensated for
+const DRIFT_MIN_WINDOWS int = 6
+
+// The largest drift believed, in parts per million; anything larger
+// is more likely to be a client with a broken clock
+const DRIFT_MAX_PPM float64 = 1000
+
+// A jump in the offset larger than this (e.g. the client has
+// restarted) starts the estimate again
+const DRIFT_RESET_THRESHOLD time.Duration = time.Second * 2
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Set up clock drift compensation
+func newClockDrift() *ClockDrift {
+    drift := new(ClockDrift)
+    log.Printf("Clock drift compensation enabled.\n")
+
+    return drift
+}
+
+// Start the estimate again; the lock must be held
+func (drift *ClockDrift) reset() {
+    drift.firstArrival = time.Time{}
+    drift.windows = nil
+    drift.ppm = 0
+    drift.correction = 0
+}
+
+// Start the estimate again from a datagram; the lock must be held
+func (drift *ClockDrift) restart(timestamp uint64, arrival time.Time) {
+    drift.reset()
+    drift.firstArrival = arrival
+    drift.firstTimestamp = timestamp
+    drift.lastOffset = 0
+    drift.windowStarted = 0
+    drift.windowEmpty = true
+}
+
+// Start the estimate again, e.g. because the stream has been reset
+func (drift *ClockDrift) Reset() {
+    drift.locker.Lock()
+    drift.reset()
+    drift.locker.Unlock()
+}
+
+// Fit a straight line through the windows and set the drift from its
+// slope; the lock must be held
+func (drift *ClockDrift) estimate() {
+    var sumX, sumY, sumXX, sumXY float64
+
+    if len(drift.windows) < DRIFT_MIN_WINDOWS {
+        return
+    }
+    for _, window := range drift.windows {
+        x := window.Elapsed.Seconds()
+        y := window.MinOffset.Seconds()
+        sumX += x
+        sumY += y
+        sumXX += x * x
+        sumXY += x * y
+    }
+    n := float64(len(drift.windows))
+    denominator := n * sumXX - sumX * sumX
+    if denominator == 0 {
+        return
+    }
+    // The offset shrinks if the client's clock runs fast
+    ppm := -(n * sumXY - sumX * sumY) / denominator * 1000000
+    if (ppm > DRIFT_MAX_PPM) || (ppm < -DRIFT_MAX_PPM) {
+        log.Printf("Clock drift of %.1f ppm is not believable, ignoring it.\n", ppm)
+        ppm = 0
+    }
+    drift.ppm = ppm
+}
+
+// Note the arrival of a datagram with the given URTP timestamp (in
+// microseconds)
+func (drift *ClockDrift) Update(timestamp uint64, arrival time.Time) {
+    drift.locker.Lock()
+    defer drift.locker.Unlock()
+
+    if drift.firstArrival.IsZero() || (timestamp < drift.firstTimestamp) {
+        drift.restart(timestamp, arrival)
+    }
+    elapsed := arrival.Sub(drift.firstArrival)
+    offset := elapsed - time.Duration(timestamp - drift.firstTimestamp) * time.Microsecond
+    if !drift.windowEmpty && ((offset - drift.lastOffset > DRIFT_RESET_THRESHOLD) || (drift.lastOffset - offset > DRIFT_RESET_THRESHOLD)) {
+        log.Printf("Client timestamps have jumped by %d ms, starting the clock drift estimate again.\n",
+                   (offset - drift.lastOffset) / time.Millisecond)
+        drift.restart(timestamp, arrival)
+        elapsed = 0
+        offset = 0
+    }
+    drift.lastOffset = offset
+
+    if drift.windowEmpty || (offset < drift.window.MinOffset) {
+        drift.window.MinOffset = offset
+    }
+    drift.windowEmpty = false
+    if elapsed - drift.windowStarted >= DRIFT_WINDOW {
+        drift.window.Elapsed = drift.windowStarted + (elapsed - drift.windowStarted) / 2
+        drift.windows = append(drift.windows, drift.window)
+        if len(drift.windows) > DRIFT_NUM_WINDOWS {
+            drift.windows = drift.windows[1:]
+        }
+        drift.estimate()
+        drift.windowStarted = elapsed
+        drift.windowEmpty = true
+    }
+}
+
+// Return interleaved audio of the stream with samples dropped or
+// added to take up the drift
+func (drift *ClockDrift) Compensate(audio []int16) []int16 {
+    drift.locker.Lock()
+    defer drift.locker.Unlock()
+
+    channels := streamChannels
+    numSamples := len(audio) / channels
+    if (drift.ppm == 0) || (numSamples < 2) {
+        return audio
+    }
+    drift.correction += float64(numSamples) * drift.ppm / 1000000
+    middle := numSamples / 2 * channels
+    if drift.correction >= 1 {
+        // The client is running fast: drop a sample, averaging it into
+        // the one before so as not to leave a step
+        drift.correction--
+        drift.samplesDropped++
+        compensated := make([]int16, 0, len(audio) - channels)
+        compensated = append(compensated, audio[:middle - channels]...)
+        for channel := 0; channel < channels; channel++ {
+            compensated = append(compensated, int16((int(audio[middle - channels + channel]) + int(audio[middle + channel])) / 2))
+        }
+        return append(compensated, audio[middle + channels:]...)
+    } else if drift.correction <= -1 {
+        // The client is running slow: add a sample between two others
+        drift.correction++
+        drift.samplesAdded++
+        compensated := make([]int16, 0, len(audio) + channels)
+        compensated = append(compensated, audio[:middle]...)
+        for channel := 0; channel < channels; channel++ {
+            compensated = append(compensated, int16((int(audio[middle - channels + channel]) + int(audio[middle + channel])) / 2))
+        }
+        return append(compensated, audio[middle:]...)
+    }
+
+    return audio
+}
+
+// Return the clock drift statistics
+func (drift *ClockDrift) stats() interface{} {
+    drift.locker.Lock()
+    defer drift.locker.Unlock()
+
+    return map[string]interface{}{
+        "ppm": drift.ppm,
+        "windows": len(drift.windows),
+        "samplesDropped": drift.samplesDropped,
+        "samplesAdded": drift.samplesAdded,
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,353 @@
+/* Configurable DSP chain for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+)
+
+// Decoded audio may be put through a chain of filter stages.  By
+// default the chain is the deemphasis filter followed by the notch
+// filter that removes squeal from the Hologram Nova modem but a
+// different chain can be given in a JSON file, e.g.:
+//
+//   {"stages": [{"type": "fir", "taps": [0.25, 0.5, 0.25]},
+//               {"type": "biquad", "b0": 0.97, "b1": -1.94, "b2": 0.97, "a1": -1.94, "a2": 0.94},
+//               {"type": "gain", "gain": 1.5}]}
+//
+// The stages are:
+//
+//   - "fir": a FIR filter with the given taps,
+//   - "biquad": a biquad filter with the given coefficients, normalised
+//     so that a0 is 1,
+//   - "gain": a multiplication by the given gain,
+//   - "deemphasis" and "desqueal": the built-in filters.
+//
+// Each stream gets its own instance of the chain, so that the filter
+// state of one stream doesn't upset another.  Either built-in filter
+// may be removed from the chain (e.g. the notch filter is of no use to
+// a client without the Hologram Nova modem) and the chain may be
+// applied to the output of every decoder rather than just UNICAM.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A stage of a DSP chain, taking one sample at a time or a block of
+// samples in place
+type DspStage interface {
+    Process(sample float32) float32
+    ProcessBlock(samples []float32)
+}
+
+// A DSP chain, the stages being applied in order
+type DspChain struct {
+    stages   []DspStage
+    scratch  []float32
+}
+
+// The configuration of one stage of a DSP chain
+type DspStageConfig struct {
+    Type  string     `json:"type"`
+    Taps  []float32  `json:"taps"`
+    B0    float32    `json:"b0"`
+    B1    float32    `json:"b1"`
+    B2    float32    `json:"b2"`
+    A1    float32    `json:"a1"`
+    A2    float32    `json:"a2"`
+    Gain  float32    `json:"gain"`
+}
+
+// The configuration of a DSP chain
+type DspChainConfig struct {
+    Stages  []DspStageConfig  `json:"stages"`
+}
+
+// A FIR filter stage
+type FirStage struct {
+    taps       []float32
+    history    []float32
+    lastIndex  int
+}
+
+// A biquad filter stage (direct form I)
+type BiquadStage struct {
+    config  DspStageConfig
+    x1, x2  float32
+    y1, y2  float32
+}
+
+// A gain stage
+type GainStage struct {
+    gain  float32
+}
+
+// The built-in deemphasis filter as a stage
+type DeemphasisStage struct {
+    fir  Fir
+}
+
+// The built-in notch filter as a stage
+type DesquealStage struct {
+    fir  DeSquealFir
+}
+
+// A decoder whose output is put through a DSP chain
+type DspDecoder struct {
+    decoder  Decoder
+    dsp      *DspChain
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The stage types
+const DSP_STAGE_FIR string = "fir"
+const DSP_STAGE_BIQUAD string = "biquad"
+const DSP_STAGE_GAIN string = "gain"
+const DSP_STAGE_DEEMPHASIS string = "deemphasis"
+const DSP_STAGE_DESQUEAL string = "desqueal"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The configuration of the DSP chain applied to each stream
+var dspChainConfig = DspChainConfig{Stages: []DspStageConfig{{Type: DSP_STAGE_DEEMPHASIS}, {Type: DSP_STAGE_DESQUEAL}}}
+
+// Whether the DSP chain is applied to all audio coding schemes, rather
+// than just UNICAM
+var dspAllCodingSchemes bool
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Filter a sample with a FIR stage
+func (stage *FirStage) Process(sample float32) float32 {
+    var acc float32
+
+    stage.history[stage.lastIndex] = sample
+    stage.lastIndex++
+    if stage.lastIndex == len(stage.taps) {
+        stage.lastIndex = 0
+    }
+    index := stage.lastIndex
+    for i := 0; i < len(stage.taps); i++ {
+        if index != 0 {
+            index = index - 1
+        } else {
+            index = len(stage.taps) - 1
+        }
+        acc += stage.history[index] * stage.taps[i]
+    }
+
+    return acc
+}
+
+// Filter a block of samples with a FIR stage
+func (stage *FirStage) ProcessBlock(samples []float32) {
+    for x, sample := range samples {
+        samples[x] = stage.Process(sample)
+    }
+}
+
+// Filter a sample with a biquad stage
+func (stage *BiquadStage) Process(sample float32) float32 {
+    output := stage.config.B0 * sample + stage.config.B1 * stage.x1 + stage.config.B2 * stage.x2 -
+              stage.config.A1 * stage.y1 - stage.config.A2 * stage.y2
+    stage.x2 = stage.x1
+    stage.x1 = sample
+    stage.y2 = stage.y1
+    stage.y1 = output
+
+    return output
+}
+
+// Filter a block of samples with a biquad stage
+func (stage *BiquadStage) ProcessBlock(samples []float32) {
+    for x, sample := range samples {
+        samples[x] = stage.Process(sample)
+    }
+}
+
+// Apply a gain stage to a sample
+func (stage *GainStage) Process(sample float32) float32 {
+    return sample * stage.gain
+}
+
+// Apply a gain stage to a block of samples
+func (stage *GainStage) ProcessBlock(samples []float32) {
+    for x := range samples {
+        samples[x] *= stage.gain
+    }
+}
+
+// Filter a sample with the built-in deemphasis filter
+func (stage *DeemphasisStage) Process(sample float32) float32 {
+    FirPut(&stage.fir, sample)
+    return FirGet(&stage.fir)
+}
+
+// Filter a block of samples with the built-in deemphasis filter
+func (stage *DeemphasisStage) ProcessBlock(samples []float32) {
+    for x, sample := range samples {
+        FirPut(&stage.fir, sample)
+        samples[x] = FirGet(&stage.fir)
+    }
+}
+
+// Filter a sample with the built-in notch filter
+func (stage *DesquealStage) Process(sample float32) float32 {
+    DeSquealFirPut(&stage.fir, sample)
+    return DeSquealFirGet(&stage.fir)
+}
+
+// Filter a block of samples with the built-in notch filter
+func (stage *DesquealStage) ProcessBlock(samples []float32) {
+    for x, sample := range samples {
+        DeSquealFirPut(&stage.fir, sample)
+        samples[x] = DeSquealFirGet(&stage.fir)
+    }
+}
+
+// Create a stage from its configuration
+func newDspStage(config DspStageConfig) (DspStage, error) {
+    switch config.Type {
+        case DSP_STAGE_FIR:
+            if len(config.Taps) == 0 {
+                return nil, errors.New("a FIR stage must have at least one tap")
+            }
+            return &FirStage{taps: config.Taps, history: make([]float32, len(config.Taps))}, nil
+        case DSP_STAGE_BIQUAD:
+            return &BiquadStage{config: config}, nil
+        case DSP_STAGE_GAIN:
+            return &GainStage{gain: config.Gain}, nil
+        case DSP_STAGE_DEEMPHASIS:
+            stage := new(DeemphasisStage)
+            FirInit(&stage.fir)
+            return stage, nil
+        case DSP_STAGE_DESQUEAL:
+            stage := new(DesquealStage)
+            DeSquealFirInit(&stage.fir)
+            return stage, nil
+    }
+
+    return nil, errors.New(fmt.Sprintf("\"%s\" is not a DSP stage type", config.Type))
+}
+
+// Create a DSP chain from its configuration
+func newDspChainFromConfig(config DspChainConfig) (*DspChain, error) {
+    chain := new(DspChain)
+    for x, stageConfig := range config.Stages {
+        stage, err := newDspStage(stageConfig)
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("stage %d: %s", x + 1, err.Error()))
+        }
+        chain.stages = append(chain.stages, stage)
+    }
+
+    return chain, nil
+}
+
+// Create a DSP chain for a stream from the configuration, which has
+// been checked already
+func newDspChain() *DspChain {
+    chain, _ := newDspChainFromConfig(dspChainConfig)
+    return chain
+}
+
+// Put a block of samples through a DSP chain, a stage at a time,
+// writing the result, clipped to 16 bits, to output (which must be
+// at least as long); samples is overwritten
+func (chain *DspChain) ProcessBlock(samples []float32, output []int16) {
+    for _, stage := range chain.stages {
+        stage.ProcessBlock(samples)
+    }
+    for x, sample := range samples {
+        if sample > 32767 {
+            sample = 32767
+        } else if sample < -32768 {
+            sample = -32768
+        }
+        output[x] = int16(sample)
+    }
+}
+
+// Remove all stages of a given type from the DSP chain configuration
+func removeDspStages(stageType string) {
+    var stages []DspStageConfig
+
+    for _, stage := range dspChainConfig.Stages {
+        if stage.Type != stageType {
+            stages = append(stages, stage)
+        }
+    }
+    if len(stages) < len(dspChainConfig.Stages) {
+        log.Printf("\"%s\" removed from the DSP chain.\n", stageType)
+    }
+    dspChainConfig.Stages = stages
+}
+
+// Decode and put the result through the DSP chain
+func (decoder *DspDecoder) Decode(payload []byte) *[]int16 {
+    audio := decoder.decoder.Decode(payload)
+    if audio != nil {
+        chain := decoder.dsp
+        chain.scratch = chain.scratch[:0]
+        for _, sample := range *audio {
+            chain.scratch = append(chain.scratch, float32(sample))
+        }
+        chain.ProcessBlock(chain.scratch, *audio)
+    }
+
+    return audio
+}
+
+// Return a factory for decoders whose output is put through the DSP chain
+func withDsp(factory DecoderFactory) DecoderFactory {
+    return func() (Decoder, error) {
+        decoder, err := factory()
+        if err != nil {
+            return nil, err
+        }
+
+        return &DspDecoder{decoder: decoder, dsp: newDspChain()}, nil
+    }
+}
+
+// Load the DSP chain configuration from a JSON file, checking it
+func loadDspChainConfig(fileName string) error {
+    var config DspChainConfig
+
+    contents, err := os.ReadFile(fileName)
+    if err == nil {
+        err = json.Unmarshal(contents, &config)
+        if err == nil {
+            _, err = newDspChainFromConfig(config)
+            if err == nil {
+                dspChainConfig = config
+                log.Printf("DSP chain of %d stage(s) loaded from \"%s\".\n", len(config.Stages), fileName)
+            }
+        }
+    }
+
+    return err
+}
+
+/* End Of File */
@@ -0,0 +1,124 @@
+/* Benchmarks of the DSP chain and the processing stages of the
+ * Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "math"
+    "path/filepath"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A DSP chain benchmark: a chain and the samples it is given at a time
+type dspBenchmark struct {
+    name        string
+    config      DspChainConfig
+    numSamples  int
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return numSamples of a tone with a little noise on it
+func benchmarkAudio(numSamples int) []int16 {
+    audio := make([]int16, numSamples)
+    for x := range audio {
+        audio[x] = int16(8000 * math.Sin(float64(x) * 2 * math.Pi * 440 / float64(SAMPLING_FREQUENCY))) + int16(x * 7919 % 200 - 100)
+    }
+
+    return audio
+}
+
+// Put blocks of samples through DSP chains: the default one, as UNICAM
+// blocks and as whole datagrams (as with --dspall), and each type of
+// stage on its own
+func BenchmarkDspChain(b *testing.B) {
+    blockSamples := SAMPLES_PER_BLOCK
+    benchmarks := []dspBenchmark{
+        {"default_unicam_block", dspChainConfig, SAMPLES_PER_UNICAM_BLOCK},
+        {"default_datagram", dspChainConfig, blockSamples},
+        {"deemphasis", DspChainConfig{Stages: []DspStageConfig{{Type: DSP_STAGE_DEEMPHASIS}}}, blockSamples},
+        {"desqueal", DspChainConfig{Stages: []DspStageConfig{{Type: DSP_STAGE_DESQUEAL}}}, blockSamples},
+        {"fir_16", DspChainConfig{Stages: []DspStageConfig{{Type: DSP_STAGE_FIR, Taps: make([]float32, 16)}}}, blockSamples},
+        {"biquad", DspChainConfig{Stages: []DspStageConfig{{Type: DSP_STAGE_BIQUAD, B0: 0.5, B1: 0.3, B2: 0.2, A1: -0.1, A2: 0.05}}}, blockSamples},
+        {"gain", DspChainConfig{Stages: []DspStageConfig{{Type: DSP_STAGE_GAIN, Gain: 2}}}, blockSamples},
+    }
+
+    for _, benchmark := range benchmarks {
+        b.Run(benchmark.name, func(b *testing.B) {
+            chain, err := newDspChainFromConfig(benchmark.config)
+            if err != nil {
+                b.Fatalf("unable to create DSP chain (%s).", err.Error())
+            }
+            audio := benchmarkAudio(benchmark.numSamples)
+            samples := make([]float32, benchmark.numSamples)
+            output := make([]int16, benchmark.numSamples)
+            b.ReportAllocs()
+            b.SetBytes(int64(benchmark.numSamples * URTP_SAMPLE_SIZE))
+            for x := 0; x < b.N; x++ {
+                for y, sample := range audio {
+                    samples[y] = float32(sample)
+                }
+                chain.ProcessBlock(samples, output)
+            }
+        })
+    }
+}
+
+// Put datagrams of audio through the processing stages of a pipeline,
+// with none of the optional stages and with all of them, as the
+// processing loop does on its way to the PCM buffer
+func BenchmarkProcessAudio(b *testing.B) {
+    blockSamples := SAMPLES_PER_BLOCK
+    settings := PipelineSettings{PcmBufferSeconds: 1, MaxGapFillMs: 500, LowWaterMs: 1000}
+    all := settings
+    all.Denoise = true
+    all.DenoiseStrength = 2
+    all.DenoiseFloorDb = -20
+    all.Gate = true
+    all.GateThresholdDbfs = -50
+    all.GateHoldMs = 1000
+    all.Agc = true
+    all.AgcTargetDbfs = -24
+    all.AgcMaxGainDb = 30
+    all.AgcAttackMs = 10
+    all.AgcReleaseMs = 2000
+
+    for name, settings := range map[string]PipelineSettings{"plain": settings, "all_stages": all} {
+        b.Run(name, func(b *testing.B) {
+            pipeline := newPipeline("benchmark_" + name, filepath.Join(b.TempDir(), name + PLAYLIST_EXTENSION), DEFAULT_CODEC,
+                                    settings, newStreamQuota(name, 0, 0, 0))
+            b.Cleanup(func() {
+                removePipeline("benchmark_" + name)
+            })
+            audio := benchmarkAudio(blockSamples)
+            block := make([]int16, blockSamples)
+            buffer := make([]byte, blockSamples * URTP_SAMPLE_SIZE)
+            b.ReportAllocs()
+            b.SetBytes(int64(blockSamples * URTP_SAMPLE_SIZE))
+            for x := 0; x < b.N; x++ {
+                copy(block, audio)
+                pipeline.processAudio(block)
+                // Keep the PCM buffer from filling up, as the encoder would
+                pipeline.pcm.Read(buffer)
+            }
+        })
+    }
+}
+
+/* End Of File */
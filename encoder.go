@@ -0,0 +1,607 @@
+/* Output encoders for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+    "encoding/binary"
+    "github.com/RobMeades/ioc-server/fdkaac"
+    "github.com/RobMeades/ioc-server/lame"
+    "gopkg.in/hraban/opus.v2"
+)
+
+// The PCM audio is encoded into segment files by an output encoder,
+// registered here by codec name, as decoders are by audio coding scheme
+// (see decoder.go).  What is registered is a factory that creates an
+// encoder writing to a given buffer, the main stream and the shadow
+// stream each having their own, along with the extension and content
+// type of its segment files.  MP3, through LAME, Opus in Ogg and AAC,
+// through FDK AAC, in an MPEG transport stream are built in, as are
+// MP3 and AAC packaged as fragmented MP4 (see fmp4.go).
+//
+// An MP3 segment is a run of frames cut from one continuous stream,
+// tagged with its offset in the stream (see writeTag()).  An Ogg Opus
+// segment can't be that: a player must be able to start from any
+// segment and an Ogg stream is no good without its headers, so each
+// segment is a complete Ogg stream, the segments being chained
+// together.  The Opus encoder carries on across segments, so nothing
+// is lost at the joins, and the pre-skip is zero since the encoder's
+// lookahead only delays the very first segment.  An AAC segment starts
+// with the tables of the transport stream (see mpegts.go) and needs no
+// tag as every frame has a timestamp.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Something that encodes little-endian 16-bit PCM at the stream's
+// sampling frequency, with the stream's number of channels
+// interleaved, into the buffer it was created with
+type Encoder interface {
+    // Encode PCM, returning the number of samples taken from each
+    // channel
+    WriteSamples(pcm []byte) (int, error)
+    // Write anything held inside the encoder to the buffer
+    Flush() error
+    // The number of samples in a frame of output; a segment is always
+    // a whole number of frames
+    FrameSamples() int
+    // The file extension, including the dot, of segment files
+    Extension() string
+    // Release the encoder; it may not be used again
+    Close()
+}
+
+// What an encoder may also be if each segment must be a stream in its
+// own right, with headers of its own, rather than a run of frames
+// tagged with its offset
+type SegmentEncoder interface {
+    // Finish the segment in the buffer so that it can be written
+    EndSegment()
+    // Start a new segment in the buffer, which has been emptied
+    StartSegment()
+}
+
+// The extension and content type of the segment files of a codec
+type SegmentType struct {
+    Extension    string
+    ContentType  string
+}
+
+// A function that creates an encoder writing to output
+type EncoderFactory func(output *bytes.Buffer, settings *Mp3Settings) (Encoder, error)
+
+// The MP3 encoder
+type Mp3Encoder struct {
+    writer        *lame.LameWriter
+    frameSamples  int
+}
+
+// The Opus encoder, writing Ogg
+type OpusEncoder struct {
+    encoder          *opus.Encoder
+    output           *bytes.Buffer
+    scale            float32
+    ogg              OggStream
+    // Samples waiting to make up a whole frame
+    pcm              []int16
+    // The last packet encoded, held back in case it ends the segment
+    packet           []byte
+    packetGranule    uint64
+    granulePosition  uint64
+}
+
+// The AAC encoder, writing an MPEG transport stream
+type AacEncoder struct {
+    encoder      *fdkaac.Encoder
+    output       *bytes.Buffer
+    scale        float32
+    stream       *TransportStream
+    pcm          []int16
+    // The number of frames written, from which the PTS follows
+    frames       int64
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The codec used if none is given
+const DEFAULT_CODEC string = "mp3"
+
+// The default gain applied by the MP3 encoder and, so that the two
+// sound alike, the Opus encoder
+const MP3_DEFAULT_SCALE float32 = 7
+
+// The codec name of Opus in Ogg
+const OPUS_CODEC string = "opus"
+
+// The extension of Ogg Opus segment files
+const OGG_OPUS_EXTENSION string = ".opus"
+
+// The duration of an Opus frame on output
+const OPUS_OUTPUT_FRAME_MS int = 20
+
+// Ogg Opus granule positions are always at 48 kHz
+const OPUS_GRANULE_RATE int = 48000
+
+// The largest Opus packet
+const OPUS_MAX_PACKET_SIZE int = 1275
+
+// The codec name of AAC in an MPEG transport stream
+const AAC_CODEC string = "aac"
+
+// The extension of AAC segment files
+const AAC_EXTENSION string = ".ts"
+
+// The size of an ADTS header
+const ADTS_HEADER_SIZE int = 7
+
+// MPEG timestamps have 33 bits
+const MPEG_TIMESTAMP_MASK int64 = (1 << 33) - 1
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The registered encoder factories, and the types of their segment
+// files, keyed by codec name
+var encoderFactories = make(map[string]EncoderFactory)
+var segmentTypes = make(map[string]SegmentType)
+var encoderFactoriesLocker sync.Mutex
+
+// The codec of the HLS stream
+var outputCodec string = DEFAULT_CODEC
+
+// The serial number of the last Ogg stream (use atomic operations)
+var oggSerial uint32 = uint32(time.Now().UnixNano())
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Register an encoder factory for a codec, and the extension and
+// content type of the segment files that its encoders produce,
+// replacing any factory already registered for that codec
+func registerEncoder(codec string, extension string, contentType string, factory EncoderFactory) {
+    encoderFactoriesLocker.Lock()
+    encoderFactories[codec] = factory
+    segmentTypes[codec] = SegmentType{Extension: extension, ContentType: contentType}
+    encoderFactoriesLocker.Unlock()
+}
+
+// Register the encoders for the built-in codecs
+func registerBuiltInEncoders() {
+    registerEncoder(DEFAULT_CODEC, SEGMENT_EXTENSION, "audio/mpeg", newMp3Encoder)
+    registerEncoder(OPUS_CODEC, OGG_OPUS_EXTENSION, "audio/ogg", newOpusEncoder)
+    registerEncoder(AAC_CODEC, AAC_EXTENSION, "video/mp2t", newAacEncoder)
+    registerEncoder(DEFAULT_CODEC + FMP4_CODEC_SUFFIX, FMP4_EXTENSION, FMP4_CONTENT_TYPE, newFmp4Mp3Encoder)
+    registerEncoder(AAC_CODEC + FMP4_CODEC_SUFFIX, FMP4_EXTENSION, FMP4_CONTENT_TYPE, newFmp4AacEncoder)
+}
+
+// Return the extensions of segment files, in alphabetical order
+func segmentExtensions() []string {
+    var extensions []string
+
+    encoderFactoriesLocker.Lock()
+    for _, segmentType := range segmentTypes {
+        found := false
+        for _, extension := range extensions {
+            if extension == segmentType.Extension {
+                found = true
+            }
+        }
+        if !found {
+            extensions = append(extensions, segmentType.Extension)
+        }
+    }
+    encoderFactoriesLocker.Unlock()
+    sort.Strings(extensions)
+
+    return extensions
+}
+
+// Return the content type of segment files with an extension, empty
+// if the extension is not that of a segment file; where codecs share
+// an extension that of outputCodec wins
+func segmentContentType(extension string) string {
+    var contentType string
+
+    encoderFactoriesLocker.Lock()
+    defer encoderFactoriesLocker.Unlock()
+
+    if segmentType, ok := segmentTypes[outputCodec]; ok && (segmentType.Extension == extension) {
+        return segmentType.ContentType
+    }
+    for _, segmentType := range segmentTypes {
+        if segmentType.Extension == extension {
+            contentType = segmentType.ContentType
+        }
+    }
+
+    return contentType
+}
+
+// Return the names of the registered codecs, in alphabetical order
+func encoderCodecs() []string {
+    var codecs []string
+
+    encoderFactoriesLocker.Lock()
+    for codec := range encoderFactories {
+        codecs = append(codecs, codec)
+    }
+    encoderFactoriesLocker.Unlock()
+    sort.Strings(codecs)
+
+    return codecs
+}
+
+// Return true if there is an encoder for a codec
+func hasEncoder(codec string) bool {
+    encoderFactoriesLocker.Lock()
+    defer encoderFactoriesLocker.Unlock()
+
+    return encoderFactories[codec] != nil
+}
+
+// Create an encoder for a codec, writing to output
+func newEncoder(codec string, output *bytes.Buffer, settings *Mp3Settings) (Encoder, error) {
+    encoderFactoriesLocker.Lock()
+    factory := encoderFactories[codec]
+    encoderFactoriesLocker.Unlock()
+    if factory == nil {
+        return nil, errors.New(fmt.Sprintf("there is no encoder for codec \"%s\"", codec))
+    }
+
+    return factory(output, settings)
+}
+
+// Create an MP3 writer
+func createMp3Writer(mp3Audio *bytes.Buffer, settings *Mp3Settings) (*lame.LameWriter, int) {
+    var mp3SamplesPerFrame int
+    // Initialise the MP3 encoder.  This is equivalent to:
+    // lame -V2 -r -s 16000 -m m --bitwidth 16 <input file> <output file>
+    // or, for a stereo stream, -m j
+    mp3Writer := lame.NewWriter(mp3Audio)
+    if mp3Writer != nil {
+        mp3Writer.Encoder.SetInSamplerate(streamSamplingFrequency)
+        mp3Writer.Encoder.SetNumChannels(streamChannels)
+        if streamChannels > 1 {
+            mp3Writer.Encoder.SetMode(lame.JOINT_STEREO)
+        } else {
+            mp3Writer.Encoder.SetMode(lame.MONO)
+        }
+        // VBR writes tags into the file which makes
+        // hls.js think the file isn't an MP3 file (as
+        // the first MP3 header must appear within the
+        // first 100 bytes of the file).  So don't do that.
+        mp3Writer.Encoder.SetVBR(lame.VBR_OFF)
+        // The encode keeps 4 bits free in case of rapid gain
+        // changes; some of that loss can be recovered here
+        if settings.Scale != 0 {
+            mp3Writer.Encoder.SetScale(settings.Scale)
+        } else {
+            mp3Writer.Encoder.SetScale(MP3_DEFAULT_SCALE)
+        }
+        if settings.Bitrate != 0 {
+            mp3Writer.Encoder.SetBitrate(settings.Bitrate)
+        }
+        if settings.LowPassFrequency != 0 {
+            mp3Writer.Encoder.LowPassFrequency(settings.LowPassFrequency)
+        }
+        if settings.HighPassFrequency != 0 {
+            mp3Writer.Encoder.HighPassFrequency(settings.HighPassFrequency)
+        }
+        if settings.Quality != 0 {
+            mp3Writer.Encoder.SetQuality(settings.Quality - 1)
+        }
+        // Disabling the bit reservoir reduces quality
+        // but allows consecutive MP3 files to be butted
+        // up together without any gaps
+        mp3Writer.Encoder.DisableReservoir()
+        mp3Writer.Encoder.SetGenre("144") // Thrash metal
+        // Note: bit depth defaults to 16
+        if mp3Writer.Encoder.InitParams() >= 0 {
+            mp3SamplesPerFrame = mp3Writer.Encoder.GetMp3FrameSize()
+            log.Printf("Created MP3 writer, MP3 frame size is %d samples, encoder delay is %d samples.\n",
+                       mp3SamplesPerFrame, mp3Writer.Encoder.GetEncoderDelay())
+        } else {
+            mp3Writer.Close()
+            mp3Writer = nil
+            log.Printf("Unable to initialise MP3 writer.\n")
+        }
+    } else {
+        log.Printf("Unable to instantiate MP3 writer.\n")
+    }
+
+    return mp3Writer, mp3SamplesPerFrame
+}
+
+// Create an MP3 encoder
+func newMp3Encoder(output *bytes.Buffer, settings *Mp3Settings) (Encoder, error) {
+    writer, frameSamples := createMp3Writer(output, settings)
+    if writer == nil {
+        return nil, errors.New("unable to create MP3 writer")
+    }
+
+    return &Mp3Encoder{writer: writer, frameSamples: frameSamples}, nil
+}
+
+// Encode PCM into MP3
+func (encoder *Mp3Encoder) WriteSamples(pcm []byte) (int, error) {
+    bytesEncoded, err := encoder.writer.Write(pcm)
+
+    return bytesEncoded / URTP_SAMPLE_SIZE / streamChannels, err
+}
+
+// Flush the MP3 writer
+func (encoder *Mp3Encoder) Flush() error {
+    _, err := encoder.writer.Close()
+
+    return err
+}
+
+// The number of samples in an MP3 frame
+func (encoder *Mp3Encoder) FrameSamples() int {
+    return encoder.frameSamples
+}
+
+// The extension of MP3 segment files
+func (encoder *Mp3Encoder) Extension() string {
+    return SEGMENT_EXTENSION
+}
+
+// Release the LAME encoder
+func (encoder *Mp3Encoder) Close() {
+    encoder.writer.Encoder.Close()
+}
+
+// Return true if Opus can encode at the given sampling frequency
+func opusSamplingFrequency(frequency int) bool {
+    switch frequency {
+        case 8000, 12000, 16000, 24000, 48000:
+            return true
+    }
+
+    return false
+}
+
+// Create an Opus encoder writing Ogg, which starts the first segment
+func newOpusEncoder(output *bytes.Buffer, settings *Mp3Settings) (Encoder, error) {
+    encoder, err := opus.NewEncoder(streamSamplingFrequency, streamChannels, opus.AppAudio)
+    if err != nil {
+        return nil, err
+    }
+    if settings.Bitrate != 0 {
+        err = encoder.SetBitrate(settings.Bitrate * 1000)
+        if err != nil {
+            return nil, err
+        }
+    }
+    opusEncoder := &OpusEncoder{encoder: encoder, output: output, scale: settings.Scale}
+    if opusEncoder.scale == 0 {
+        opusEncoder.scale = MP3_DEFAULT_SCALE
+    }
+    log.Printf("Created Opus writer, Opus frame size is %d samples.\n", opusEncoder.FrameSamples())
+    opusEncoder.StartSegment()
+
+    return opusEncoder, nil
+}
+
+// Write the packet being held back, if there is one
+func (encoder *OpusEncoder) writePacket(flags byte) {
+    if encoder.packet != nil {
+        encoder.ogg.WritePacket(encoder.output, encoder.packet, encoder.packetGranule, flags)
+        encoder.packet = nil
+    }
+}
+
+// Encode a frame of interleaved samples, holding the packet back
+func (encoder *OpusEncoder) encodeFrame(frame []int16) error {
+    packet := make([]byte, OPUS_MAX_PACKET_SIZE)
+    length, err := encoder.encoder.Encode(frame, packet)
+    if err != nil {
+        return err
+    }
+    encoder.writePacket(0)
+    encoder.granulePosition += uint64(len(frame) / streamChannels * OPUS_GRANULE_RATE / streamSamplingFrequency)
+    encoder.packet = packet[:length]
+    encoder.packetGranule = encoder.granulePosition
+
+    return nil
+}
+
+// Append little-endian 16-bit PCM to samples, applying a gain,
+// returning the result
+func appendScaledPcm(samples []int16, pcm []byte, scale float32) []int16 {
+    for x := 0; x + 1 < len(pcm); x += URTP_SAMPLE_SIZE {
+        sample := float32(int16(binary.LittleEndian.Uint16(pcm[x:]))) * scale
+        if sample > 32767 {
+            sample = 32767
+        } else if sample < -32768 {
+            sample = -32768
+        }
+        samples = append(samples, int16(sample))
+    }
+
+    return samples
+}
+
+// Encode PCM into Opus, applying the gain
+func (encoder *OpusEncoder) WriteSamples(pcm []byte) (int, error) {
+    var err error
+
+    encoder.pcm = appendScaledPcm(encoder.pcm, pcm, encoder.scale)
+    frameSamples := encoder.FrameSamples() * streamChannels
+    for (err == nil) && (len(encoder.pcm) >= frameSamples) {
+        err = encoder.encodeFrame(encoder.pcm[:frameSamples])
+        encoder.pcm = append(encoder.pcm[:0], encoder.pcm[frameSamples:]...)
+    }
+
+    return len(pcm) / URTP_SAMPLE_SIZE / streamChannels, err
+}
+
+// Encode any part frame, padded with silence, and end the segment
+func (encoder *OpusEncoder) Flush() error {
+    var err error
+
+    if len(encoder.pcm) > 0 {
+        frame := make([]int16, encoder.FrameSamples() * streamChannels)
+        copy(frame, encoder.pcm)
+        encoder.pcm = encoder.pcm[:0]
+        err = encoder.encodeFrame(frame)
+    }
+    encoder.EndSegment()
+
+    return err
+}
+
+// The number of samples in each channel of an Opus frame
+func (encoder *OpusEncoder) FrameSamples() int {
+    return streamSamplingFrequency * OPUS_OUTPUT_FRAME_MS / 1000
+}
+
+// The extension of Ogg Opus segment files
+func (encoder *OpusEncoder) Extension() string {
+    return OGG_OPUS_EXTENSION
+}
+
+// Nothing to release, the Opus encoder is garbage collected
+func (encoder *OpusEncoder) Close() {
+    encoder.encoder = nil
+}
+
+// End the Ogg stream of the segment
+func (encoder *OpusEncoder) EndSegment() {
+    encoder.writePacket(OGG_EOS)
+}
+
+// Start a new Ogg stream, writing the identification header (RFC 7845
+// section 5.1) and the comment header (section 5.2)
+func (encoder *OpusEncoder) StartSegment() {
+    var head bytes.Buffer
+    var tags bytes.Buffer
+    vendor := "ioc-server " + SERVER_VERSION
+    comment := "TITLE=" + MP3_TITLE
+
+    encoder.ogg.Restart(atomic.AddUint32(&oggSerial, 1))
+    encoder.granulePosition = 0
+
+    head.WriteString("OpusHead")
+    head.WriteByte(1) // Version
+    head.WriteByte(byte(streamChannels)) // Channels
+    binary.Write(&head, binary.LittleEndian, uint16(0)) // Pre-skip
+    binary.Write(&head, binary.LittleEndian, uint32(streamSamplingFrequency))
+    binary.Write(&head, binary.LittleEndian, int16(0)) // Output gain
+    head.WriteByte(0) // Channel mapping family
+    encoder.ogg.WritePacket(encoder.output, head.Bytes(), 0, OGG_BOS)
+
+    tags.WriteString("OpusTags")
+    binary.Write(&tags, binary.LittleEndian, uint32(len(vendor)))
+    tags.WriteString(vendor)
+    binary.Write(&tags, binary.LittleEndian, uint32(1))
+    binary.Write(&tags, binary.LittleEndian, uint32(len(comment)))
+    tags.WriteString(comment)
+    encoder.ogg.WritePacket(encoder.output, tags.Bytes(), 0, 0)
+}
+
+// Create an AAC encoder writing an MPEG transport stream, which starts
+// the first segment
+func newAacEncoder(output *bytes.Buffer, settings *Mp3Settings) (Encoder, error) {
+    encoder, err := fdkaac.NewEncoder(streamSamplingFrequency, streamChannels, settings.Bitrate * 1000)
+    if err != nil {
+        return nil, err
+    }
+    aacEncoder := &AacEncoder{encoder: encoder, output: output, scale: settings.Scale, stream: newTransportStream()}
+    if aacEncoder.scale == 0 {
+        aacEncoder.scale = MP3_DEFAULT_SCALE
+    }
+    log.Printf("Created AAC writer, AAC frame size is %d samples.\n", encoder.FrameLength())
+    aacEncoder.StartSegment()
+
+    return aacEncoder, nil
+}
+
+// Write ADTS frames to the transport stream, each with its PTS
+func (encoder *AacEncoder) writeFrames(data []byte) error {
+    for len(data) >= ADTS_HEADER_SIZE {
+        length := (int(data[3] & 0x03) << 11) | (int(data[4]) << 3) | (int(data[5]) >> 5)
+        if (data[0] != 0xff) || (data[1] & 0xf0 != 0xf0) || (length < ADTS_HEADER_SIZE) || (length > len(data)) {
+            return errors.New(fmt.Sprintf("AAC encoder output is not ADTS (%d byte(s) left)", len(data)))
+        }
+        pts := encoder.frames * int64(encoder.encoder.FrameLength() * MPEG_CLOCK_RATE / streamSamplingFrequency)
+        encoder.stream.WriteAudio(encoder.output, data[:length], pts & MPEG_TIMESTAMP_MASK)
+        encoder.frames++
+        data = data[length:]
+    }
+
+    return nil
+}
+
+// Encode PCM into AAC, applying the gain
+func (encoder *AacEncoder) WriteSamples(pcm []byte) (int, error) {
+    encoder.pcm = appendScaledPcm(encoder.pcm[:0], pcm, encoder.scale)
+    data, samples, err := encoder.encoder.Encode(encoder.pcm)
+    if err == nil {
+        err = encoder.writeFrames(data)
+    }
+
+    return samples / streamChannels, err
+}
+
+// Flush what the AAC encoder is holding into the transport stream
+func (encoder *AacEncoder) Flush() error {
+    for {
+        data, err := encoder.encoder.Flush()
+        if (err != nil) || (len(data) == 0) {
+            return err
+        }
+        err = encoder.writeFrames(data)
+        if err != nil {
+            return err
+        }
+    }
+}
+
+// The number of samples in each channel of an AAC frame
+func (encoder *AacEncoder) FrameSamples() int {
+    return encoder.encoder.FrameLength()
+}
+
+// The extension of AAC segment files
+func (encoder *AacEncoder) Extension() string {
+    return AAC_EXTENSION
+}
+
+// Release the AAC encoder
+func (encoder *AacEncoder) Close() {
+    encoder.encoder.Close()
+}
+
+// Nothing is held back at the end of an AAC segment
+func (encoder *AacEncoder) EndSegment() {
+}
+
+// Start a new segment with the tables of the transport stream
+func (encoder *AacEncoder) StartSegment() {
+    encoder.stream.WriteTables(encoder.output)
+}
+
+/* End Of File */
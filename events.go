@@ -0,0 +1,127 @@
+/* Pipeline events for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Something that has happened in the pipeline
+type Event struct {
+    Name     string
+    Time     time.Time
+    Fields   map[string]interface{}
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The event names
+const (
+    EVENT_CLIENT_CONNECTED = "client_connected"
+    EVENT_CLIENT_DISCONNECTED = "client_disconnected"
+    EVENT_CLIENT_REJECTED = "client_rejected"
+    EVENT_CLIENT_SILENT = "client_silent"
+    EVENT_DATAGRAM_STATS = "datagram_stats"
+    EVENT_GAP = "gap"
+    EVENT_SEGMENT = "segment"
+    EVENT_RESET = "reset"
+    EVENT_OUTPUT_FAILED = "output_failed"
+    EVENT_OUTPUT_RECOVERED = "output_recovered"
+    EVENT_STALLED = "stalled"
+    EVENT_UNDERRUN = "underrun"
+    EVENT_OUT_OF_SERVICE = "out_of_service"
+    EVENT_IN_SERVICE = "in_service"
+    EVENT_DISK_SPACE = "disk_space"
+)
+
+// How often to publish datagram statistics
+const DATAGRAM_STATS_PERIOD time.Duration = time.Second * 10
+
+// How long to wait for a webhook to respond
+const WEBHOOK_TIMEOUT time.Duration = time.Second * 10
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The channels of those interested in events
+var eventSubscribers []chan *Event
+var eventSubscribersLocker sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Subscribe to events, returning the channel on which they
+// will arrive; if the subscriber doesn't keep up events are
+// dropped rather than holding up the pipeline
+func subscribeEvents(bufferSize int) <-chan *Event {
+    channel := make(chan *Event, bufferSize)
+    eventSubscribersLocker.Lock()
+    eventSubscribers = append(eventSubscribers, channel)
+    eventSubscribersLocker.Unlock()
+
+    return channel
+}
+
+// Stop a subscription to events
+func unsubscribeEvents(channel <-chan *Event) {
+    eventSubscribersLocker.Lock()
+    for x, subscriber := range eventSubscribers {
+        if (<-chan *Event)(subscriber) == channel {
+            eventSubscribers = append(eventSubscribers[:x], eventSubscribers[x + 1:]...)
+            break
+        }
+    }
+    eventSubscribersLocker.Unlock()
+}
+
+// Publish an event to all subscribers
+func publishEvent(name string, fields map[string]interface{}) {
+    event := &Event{Name: name, Time: time.Now(), Fields: fields}
+    eventSubscribersLocker.Lock()
+    for _, channel := range eventSubscribers {
+        select {
+            case channel <- event:
+            default:
+                log.Printf("Event subscriber not keeping up, \"%s\" event dropped.\n", name)
+        }
+    }
+    eventSubscribersLocker.Unlock()
+}
+
+// POST a body to a webhook URL in the background
+func postWebhook(url string, contentType string, body []byte) {
+    go func() {
+        client := http.Client{Timeout: WEBHOOK_TIMEOUT}
+        response, err := client.Post(url, contentType, bytes.NewReader(body))
+        if err == nil {
+            response.Body.Close()
+            log.Printf("Webhook \"%s\" returned %s.\n", url, response.Status)
+        } else {
+            log.Printf("Webhook \"%s\" failed (%s).\n", url, err.Error())
+        }
+    }()
+}
+
+/* End Of File */
@@ -0,0 +1,340 @@
+/* Archive export for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// An export copies the archive files last modified within a date range
+// to a destination, which is either a directory (e.g. on a mounted
+// external drive) or an rsync target (e.g. user@host:/path).  Every file
+// is verified after copying, by SHA-256 hash for a directory or with an
+// rsync checksum pass for an rsync target, and the local copies are only
+// pruned, if requested, once all of them have been verified.  Each
+// export is recorded, one JSON object per line, in EXPORT_JOURNAL_NAME
+// in the archive directory, and is published as an export event, so
+// that it goes in the journal (see journal.go) along with everything
+// else that happened to the stream.  Exports are started, and their
+// records read back, through the admin API.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An export to be performed
+type ExportJob struct {
+    ArchiveDir   string
+    From         time.Time
+    To           time.Time
+    Destination  string
+    Prune        bool
+}
+
+// The record of an export
+type ExportRecord struct {
+    Started      time.Time  `json:"started"`
+    Finished     time.Time  `json:"finished"`
+    From         time.Time  `json:"from"`
+    To           time.Time  `json:"to"`
+    Destination  string     `json:"destination"`
+    Files        []string   `json:"files"`
+    Bytes        int64      `json:"bytes"`
+    Verified     bool       `json:"verified"`
+    Pruned       bool       `json:"pruned"`
+    Error        string     `json:"error,omitempty"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The name of the file, in the archive directory, where exports
+// are recorded
+const EXPORT_JOURNAL_NAME string = "exports.jsonl"
+
+// A file modified more recently than this may still be being written
+// by the archive recorder, so isn't exported
+const EXPORT_SETTLE_TIME time.Duration = time.Minute
+
+// The event published when an export has finished
+const EVENT_EXPORT string = "export"
+
+// The largest line that may be read from EXPORT_JOURNAL_NAME
+const EXPORT_MAX_RECORD_SIZE int = 1024 * 1024
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Only one export may run at a time
+var exportRunning bool
+var exportLocker sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return true if a destination is an rsync target rather than a
+// local directory
+func isRsyncTarget(destination string) bool {
+    colon := strings.Index(destination, ":")
+
+    return (colon > 1) && !strings.Contains(destination[:colon], string(os.PathSeparator))
+}
+
+// Return the files in the archive directory last modified in
+// [from, to), oldest first, other than those that may still be being
+// written
+func exportFiles(archiveDir string, from time.Time, to time.Time) ([]os.FileInfo, error) {
+    var selected []os.FileInfo
+
+    if settled := time.Now().Add(-EXPORT_SETTLE_TIME); to.After(settled) {
+        to = settled
+    }
+    files, err := ioutil.ReadDir(archiveDir)
+    if err == nil {
+        for _, file := range files {
+            if file.Mode().IsRegular() && (file.Name() != EXPORT_JOURNAL_NAME) &&
+               !file.ModTime().Before(from) && file.ModTime().Before(to) {
+                selected = append(selected, file)
+            }
+        }
+        sort.Slice(selected, func(x, y int) bool {
+            return selected[x].ModTime().Before(selected[y].ModTime())
+        })
+    }
+
+    return selected, err
+}
+
+// Return the SHA-256 hash of a file
+func hashFile(filePath string) ([]byte, error) {
+    var hash []byte
+
+    handle, err := os.Open(filePath)
+    if err == nil {
+        hasher := sha256.New()
+        _, err = io.Copy(hasher, handle)
+        handle.Close()
+        hash = hasher.Sum(nil)
+    }
+
+    return hash, err
+}
+
+// Copy a file to a directory, verifying the copy by hash
+func copyAndVerify(source string, destinationDir string, modTime time.Time) error {
+    destination := filepath.Join(destinationDir, filepath.Base(source))
+    in, err := os.Open(source)
+    if err == nil {
+        var out *os.File
+        hasher := sha256.New()
+        out, err = os.Create(destination)
+        if err == nil {
+            _, err = io.Copy(io.MultiWriter(out, hasher), in)
+            if err == nil {
+                err = out.Sync()
+            }
+            err1 := out.Close()
+            if err == nil {
+                err = err1
+            }
+        }
+        in.Close()
+        if err == nil {
+            // Keep the timestamp, it is what the archive is indexed by
+            os.Chtimes(destination, modTime, modTime)
+            var copied []byte
+            copied, err = hashFile(destination)
+            if (err == nil) && !bytes.Equal(copied, hasher.Sum(nil)) {
+                err = errors.New(fmt.Sprintf("hash of \"%s\" doesn't match the original", destination))
+            }
+        }
+    }
+
+    return err
+}
+
+// Copy files to an rsync target and then check, with a checksum
+// pass, that rsync finds nothing left to do
+func rsyncAndVerify(filePaths []string, destination string) error {
+    arguments := append([]string{"--times", "--checksum"}, filePaths...)
+    output, err := exec.Command("rsync", append(arguments, destination)...).CombinedOutput()
+    if err == nil {
+        arguments = append([]string{"--dry-run", "--itemize-changes", "--times", "--checksum"}, filePaths...)
+        output, err = exec.Command("rsync", append(arguments, destination)...).CombinedOutput()
+        if (err == nil) && (len(bytes.TrimSpace(output)) > 0) {
+            err = errors.New(fmt.Sprintf("rsync verification found differences (%s)", strings.TrimSpace(string(output))))
+        }
+    } else {
+        err = errors.New(fmt.Sprintf("%s (%s)", err.Error(), strings.TrimSpace(string(output))))
+    }
+
+    return err
+}
+
+// Add an export record to the journal and publish it
+func recordExport(archiveDir string, record *ExportRecord) {
+    line, err := json.Marshal(record)
+    if err == nil {
+        var handle *os.File
+        handle, err = os.OpenFile(filepath.Join(archiveDir, EXPORT_JOURNAL_NAME), os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+        if err == nil {
+            _, err = handle.Write(append(line, '\n'))
+            handle.Close()
+        }
+    }
+    if err != nil {
+        log.Printf("Unable to record export (%s).\n", err.Error())
+    }
+    publishEvent(EVENT_EXPORT, map[string]interface{}{"destination": record.Destination, "files": len(record.Files),
+                                                      "bytes": record.Bytes, "verified": record.Verified,
+                                                      "pruned": record.Pruned, "error": record.Error,
+                                                      "duration": record.Finished.Sub(record.Started)})
+}
+
+// Return the records of the exports from an archive directory, oldest
+// first
+func exportRecords(archiveDir string) ([]ExportRecord, error) {
+    records := []ExportRecord{}
+
+    handle, err := os.Open(filepath.Join(archiveDir, EXPORT_JOURNAL_NAME))
+    if err != nil {
+        if os.IsNotExist(err) {
+            err = nil
+        }
+        return records, err
+    }
+    defer handle.Close()
+    scanner := bufio.NewScanner(handle)
+    scanner.Buffer(make([]byte, 0, 4096), EXPORT_MAX_RECORD_SIZE)
+    for scanner.Scan() {
+        var record ExportRecord
+        if json.Unmarshal(scanner.Bytes(), &record) == nil {
+            records = append(records, record)
+        }
+    }
+
+    return records, scanner.Err()
+}
+
+// Return true if an export is running
+func isExportRunning() bool {
+    exportLocker.Lock()
+    defer exportLocker.Unlock()
+
+    return exportRunning
+}
+
+// Check an export job and start it in its own go routine, returning an
+// error if it isn't valid or another export is running
+func startExport(job *ExportJob) error {
+    if job.Destination == "" {
+        return errors.New("a destination is required")
+    }
+    if strings.HasPrefix(job.Destination, "-") {
+        // Would be taken by rsync as an option
+        return errors.New(fmt.Sprintf("\"%s\" is not a valid destination", job.Destination))
+    }
+    if !job.From.Before(job.To) {
+        return errors.New("from must be before to")
+    }
+    if !isRsyncTarget(job.Destination) {
+        absolute, err := filepath.Abs(job.Destination)
+        archive, err1 := filepath.Abs(job.ArchiveDir)
+        if (err != nil) || (err1 != nil) || (absolute == archive) {
+            return errors.New(fmt.Sprintf("\"%s\" can't be exported to", job.Destination))
+        }
+    }
+
+    exportLocker.Lock()
+    defer exportLocker.Unlock()
+    if exportRunning {
+        return errors.New("an export is already running")
+    }
+    exportRunning = true
+    go runExport(job)
+
+    return nil
+}
+
+// Perform an export started by startExport(), returning the record of
+// it; this may take a long time so is run in its own go routine
+func runExport(job *ExportJob) *ExportRecord {
+    var err error
+    var files []os.FileInfo
+    var filePaths []string
+    record := &ExportRecord{Started: time.Now(), From: job.From, To: job.To, Destination: job.Destination}
+
+    log.Printf("Exporting archive files from %s to %s to \"%s\".\n", job.From.Format(time.RFC3339), job.To.Format(time.RFC3339), job.Destination)
+    files, err = exportFiles(job.ArchiveDir, job.From, job.To)
+    if err == nil {
+        for _, file := range files {
+            filePaths = append(filePaths, filepath.Join(job.ArchiveDir, file.Name()))
+            record.Files = append(record.Files, file.Name())
+            record.Bytes += file.Size()
+        }
+        if len(files) > 0 {
+            if isRsyncTarget(job.Destination) {
+                err = rsyncAndVerify(filePaths, job.Destination)
+            } else {
+                err = os.MkdirAll(job.Destination, os.ModePerm)
+                for x := 0; (err == nil) && (x < len(files)); x++ {
+                    err = copyAndVerify(filePaths[x], job.Destination, files[x].ModTime())
+                }
+            }
+        }
+    }
+    if err == nil {
+        record.Verified = true
+        if job.Prune {
+            for _, filePath := range filePaths {
+                err1 := os.Remove(filePath)
+                if err1 != nil {
+                    log.Printf("Unable to prune \"%s\" after export (%s).\n", filePath, err1.Error())
+                }
+            }
+            record.Pruned = true
+        }
+        log.Printf("Exported and verified %d file(s), %d byte(s), to \"%s\".\n", len(files), record.Bytes, job.Destination)
+    } else {
+        record.Error = err.Error()
+        log.Printf("Export to \"%s\" failed (%s).\n", job.Destination, err.Error())
+    }
+    record.Finished = time.Now()
+    recordExport(job.ArchiveDir, record)
+
+    exportLocker.Lock()
+    exportRunning = false
+    exportLocker.Unlock()
+
+    return record
+}
+
+/* End Of File */
@@ -0,0 +1,164 @@
+package fdkaac
+
+/*
+#cgo pkg-config: fdk-aac
+#include <fdk-aac/aacenc_lib.h>
+
+// Encode numSamples of 16-bit PCM (or flush, if numSamples is -1) into
+// out, returning the number of bytes written or -1 on error, and the
+// number of samples taken in *numInUsed
+static int encode(HANDLE_AACENCODER handle, INT_PCM *pcm, int numSamples,
+                  UCHAR *out, int outSize, int *numInUsed) {
+	AACENC_BufDesc inBufDesc = {0};
+	AACENC_BufDesc outBufDesc = {0};
+	AACENC_InArgs inArgs = {0};
+	AACENC_OutArgs outArgs = {0};
+	void *inPtr = pcm;
+	void *outPtr = out;
+	INT inIdentifier = IN_AUDIO_DATA;
+	INT outIdentifier = OUT_BITSTREAM_DATA;
+	INT inSize = (numSamples > 0) ? numSamples * sizeof(INT_PCM) : 0;
+	INT inElementSize = sizeof(INT_PCM);
+	INT outElementSize = 1;
+
+	inBufDesc.numBufs = 1;
+	inBufDesc.bufs = &inPtr;
+	inBufDesc.bufferIdentifiers = &inIdentifier;
+	inBufDesc.bufSizes = &inSize;
+	inBufDesc.bufElSizes = &inElementSize;
+	outBufDesc.numBufs = 1;
+	outBufDesc.bufs = &outPtr;
+	outBufDesc.bufferIdentifiers = &outIdentifier;
+	outBufDesc.bufSizes = &outSize;
+	outBufDesc.bufElSizes = &outElementSize;
+	inArgs.numInSamples = numSamples;
+
+	if (aacEncEncode(handle, &inBufDesc, &outBufDesc, &inArgs, &outArgs) != AACENC_OK) {
+		return -1;
+	}
+	*numInUsed = outArgs.numInSamples;
+	return outArgs.numOutBytes;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	AOT_AAC_LC      = 2
+	TRANSMUX_ADTS   = 2
+	MAX_OUTPUT_SIZE = 8192
+)
+
+type Encoder struct {
+	handle      C.HANDLE_AACENCODER
+	frameLength int
+	closed      bool
+}
+
+// Create an AAC-LC encoder writing ADTS; bitRate is in bits/s, 0 for the
+// library default
+func NewEncoder(sampleRate int, channels int, bitRate int) (*Encoder, error) {
+	e := new(Encoder)
+	if C.aacEncOpen(&e.handle, 0, C.UINT(channels)) != C.AACENC_OK {
+		return nil, errors.New("unable to open AAC encoder")
+	}
+	params := []struct {
+		param C.AACENC_PARAM
+		value int
+	}{
+		{C.AACENC_AOT, AOT_AAC_LC},
+		{C.AACENC_SAMPLERATE, sampleRate},
+		{C.AACENC_CHANNELMODE, channels},
+		{C.AACENC_TRANSMUX, TRANSMUX_ADTS},
+		{C.AACENC_AFTERBURNER, 1},
+	}
+	if bitRate > 0 {
+		params = append(params, struct {
+			param C.AACENC_PARAM
+			value int
+		}{C.AACENC_BITRATE, bitRate})
+	}
+	for _, p := range params {
+		if C.aacEncoder_SetParam(e.handle, p.param, C.UINT(p.value)) != C.AACENC_OK {
+			e.Close()
+			return nil, errors.New(fmt.Sprintf("unable to set AAC encoder parameter 0x%x to %d", int(p.param), p.value))
+		}
+	}
+	if C.aacEncEncode(e.handle, nil, nil, nil, nil) != C.AACENC_OK {
+		e.Close()
+		return nil, errors.New("unable to initialise AAC encoder")
+	}
+	var info C.AACENC_InfoStruct
+	if C.aacEncInfo(e.handle, &info) != C.AACENC_OK {
+		e.Close()
+		return nil, errors.New("unable to get AAC encoder information")
+	}
+	e.frameLength = int(info.frameLength)
+	runtime.SetFinalizer(e, finalize)
+	return e, nil
+}
+
+// The number of samples per channel in an AAC frame
+func (e *Encoder) FrameLength() int {
+	return e.frameLength
+}
+
+// Encode PCM, returning the ADTS frames produced and the number of
+// samples taken; the encoder produces at most one frame per call to
+// the library so it is called until it has nothing more to give
+func (e *Encoder) Encode(pcm []int16) ([]byte, int, error) {
+	var frames []byte
+	var taken int
+
+	out := make([]byte, MAX_OUTPUT_SIZE)
+	for {
+		var numInUsed C.int
+		var pcmPtr *C.INT_PCM
+		if len(pcm) > 0 {
+			pcmPtr = (*C.INT_PCM)(unsafe.Pointer(&pcm[0]))
+		}
+		bytesOut := C.encode(e.handle, pcmPtr, C.int(len(pcm)), (*C.UCHAR)(unsafe.Pointer(&out[0])),
+			C.int(len(out)), &numInUsed)
+		if bytesOut < 0 {
+			return frames, taken, errors.New("AAC encoding failed")
+		}
+		frames = append(frames, out[:bytesOut]...)
+		pcm = pcm[numInUsed:]
+		taken += int(numInUsed)
+		if (bytesOut == 0) && (numInUsed == 0) {
+			break
+		}
+	}
+	return frames, taken, nil
+}
+
+// Flush the encoder, returning what remained as ADTS frames; call this
+// until nothing is returned
+func (e *Encoder) Flush() ([]byte, error) {
+	var numInUsed C.int
+
+	out := make([]byte, MAX_OUTPUT_SIZE)
+	bytesOut := C.encode(e.handle, nil, -1, (*C.UCHAR)(unsafe.Pointer(&out[0])), C.int(len(out)), &numInUsed)
+	if bytesOut < 0 {
+		return nil, errors.New("AAC flush failed")
+	}
+	return out[:bytesOut], nil
+}
+
+func (e *Encoder) Close() {
+	if e.closed {
+		return
+	}
+	C.aacEncClose(&e.handle)
+	e.closed = true
+}
+
+func finalize(e *Encoder) {
+	e.Close()
+}
@@ -0,0 +1,448 @@
+/* Fragmented MP4 (CMAF) segments for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "path/filepath"
+    "strings"
+    "github.com/RobMeades/ioc-server/fdkaac"
+)
+
+// Some players don't like MP3 segments and LL-HLS and DASH both want
+// fragmented MP4, so with --fmp4 the encoded audio is packaged as CMAF
+// instead: each segment is a single fragment (a moof box describing
+// the frames followed by an mdat box holding them) and what a player
+// needs to decode the fragments, the ftyp and moov boxes, is in an
+// initialisation segment, written once to the playlist directory
+// and named in the playlist by EXT-X-MAP.  MP3 and AAC can be packaged
+// this way, each as a codec of its own, the name of the codec with
+// FMP4_CODEC_SUFFIX on the end, the encoders of which are registered
+// alongside the others.  The timescale of the track is the sampling
+// frequency of the stream, so that the duration of a frame is its
+// number of samples, and the decode time of each fragment carries on
+// from the one before, as the timestamps of an MPEG transport stream
+// do, so the initialisation segment is the same for every encoder of
+// a codec (e.g. the shadow encoder), whatever its bitrate.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An encoder writing fragmented MP4
+type Fmp4Encoder struct {
+    // For MP3, the MP3 encoder, writing to elementary
+    mp3          Encoder
+    // For AAC, the AAC encoder, ADTS frames going to elementary
+    aac          *fdkaac.Encoder
+    scale        float32
+    pcm          []int16
+    elementary   bytes.Buffer
+    output       *bytes.Buffer
+    // The frames of the segment so far
+    frames       [][]byte
+    frameSamples int
+    sequence     uint32
+    decodeTime   uint64
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// What is added to the name of a codec to package it as fragmented
+// MP4
+const FMP4_CODEC_SUFFIX string = "-fmp4"
+
+// The extension of fragmented MP4 segment files
+const FMP4_EXTENSION string = ".m4s"
+
+// The content type of fragmented MP4 segment files
+const FMP4_CONTENT_TYPE string = "audio/mp4"
+
+// The name of the initialisation segment of a codec is this, then the
+// name of the codec, then FMP4_EXTENSION
+const FMP4_INIT_PREFIX string = "init-"
+
+// MPEG-4 object type indications (ISO/IEC 14496-1 table 5)
+const MP4_OBJECT_TYPE_AAC byte = 0x40
+const MP4_OBJECT_TYPE_MPEG2_AUDIO byte = 0x69
+const MP4_OBJECT_TYPE_MPEG1_AUDIO byte = 0x6b
+
+// The MPEG-4 audio object type of AAC-LC
+const AAC_OBJECT_TYPE_LC int = 2
+
+// The track ID of the audio, the only track
+const FMP4_TRACK_ID uint32 = 1
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The sampling frequencies of MPEG-4 audio, by sampling frequency index
+var aacSamplingFrequencies = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// The identity matrix of a movie or track header
+var mp4Matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a box of the given type holding payloads
+func mp4Box(boxType string, payloads ...[]byte) []byte {
+    var box bytes.Buffer
+
+    size := 8
+    for _, payload := range payloads {
+        size += len(payload)
+    }
+    binary.Write(&box, binary.BigEndian, uint32(size))
+    box.WriteString(boxType)
+    for _, payload := range payloads {
+        box.Write(payload)
+    }
+
+    return box.Bytes()
+}
+
+// Return a full box, with a version and flags, of the given type
+// holding payloads
+func mp4FullBox(boxType string, version byte, flags uint32, payloads ...[]byte) []byte {
+    header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+
+    return mp4Box(boxType, append([][]byte{header}, payloads...)...)
+}
+
+// Return the big-endian bytes of some values
+func mp4Fields(values ...interface{}) []byte {
+    var fields bytes.Buffer
+
+    for _, value := range values {
+        binary.Write(&fields, binary.BigEndian, value)
+    }
+
+    return fields.Bytes()
+}
+
+// Return an MPEG-4 descriptor (ISO/IEC 14496-1 section 8.3.3)
+func mp4Descriptor(tag byte, payloads ...[]byte) []byte {
+    var body []byte
+
+    for _, payload := range payloads {
+        body = append(body, payload...)
+    }
+
+    return append([]byte{tag, byte(len(body))}, body...)
+}
+
+// Return the codec packaged by a fragmented MP4 codec, empty if the
+// codec isn't one
+func fmp4InnerCodec(codec string) string {
+    if !strings.HasSuffix(codec, FMP4_CODEC_SUFFIX) {
+        return ""
+    }
+
+    return strings.TrimSuffix(codec, FMP4_CODEC_SUFFIX)
+}
+
+// Return the AudioSpecificConfig (ISO/IEC 14496-3 section 1.6.2.1) of
+// AAC-LC at the stream's sampling frequency and number of channels
+func aacAudioSpecificConfig() ([]byte, error) {
+    for index, frequency := range aacSamplingFrequencies {
+        if frequency == streamSamplingFrequency {
+            return []byte{byte(AAC_OBJECT_TYPE_LC << 3) | byte(index >> 1),
+                          byte(index << 7) | byte(streamChannels << 3)}, nil
+        }
+    }
+
+    return nil, errors.New(fmt.Sprintf("AAC can't be at a sampling frequency of %d Hz", streamSamplingFrequency))
+}
+
+// Return the sample entry (ISO/IEC 14496-12 section 12.2.3 and
+// ISO/IEC 14496-14 section 5.6) of the audio of a codec
+func fmp4SampleEntry(codec string) ([]byte, error) {
+    var objectType byte
+    var decoderSpecificInfo []byte
+
+    switch fmp4InnerCodec(codec) {
+        case DEFAULT_CODEC:
+            objectType = MP4_OBJECT_TYPE_MPEG2_AUDIO
+            if streamSamplingFrequency >= 32000 {
+                objectType = MP4_OBJECT_TYPE_MPEG1_AUDIO
+            }
+        case AAC_CODEC:
+            audioSpecificConfig, err := aacAudioSpecificConfig()
+            if err != nil {
+                return nil, err
+            }
+            objectType = MP4_OBJECT_TYPE_AAC
+            decoderSpecificInfo = mp4Descriptor(0x05, audioSpecificConfig)
+        default:
+            return nil, errors.New(fmt.Sprintf("codec \"%s\" can't be packaged as fragmented MP4", codec))
+    }
+    // Audio stream, upstream flag clear, reserved bit set
+    decoderConfig := mp4Descriptor(0x04, []byte{objectType, (0x05 << 2) | 0x01, 0, 0, 0},
+                                   mp4Fields(uint32(0), uint32(0)), decoderSpecificInfo)
+    esDescriptor := mp4Descriptor(0x03, mp4Fields(uint16(0), uint8(0)), decoderConfig,
+                                  mp4Descriptor(0x06, []byte{0x02}))
+
+    return mp4Box("mp4a", make([]byte, 6), mp4Fields(uint16(1)), make([]byte, 8),
+                  mp4Fields(uint16(streamChannels), uint16(16), uint16(0), uint16(0),
+                            uint32(streamSamplingFrequency) << 16),
+                  mp4FullBox("esds", 0, 0, esDescriptor)), nil
+}
+
+// Return the initialisation segment of a codec: the ftyp and moov
+// boxes, with no samples and the track extended by movie fragments
+func fmp4InitSegment(codec string) ([]byte, error) {
+    sampleEntry, err := fmp4SampleEntry(codec)
+    if err != nil {
+        return nil, err
+    }
+    timescale := uint32(streamSamplingFrequency)
+
+    ftyp := mp4Box("ftyp", []byte("iso6"), mp4Fields(uint32(0)), []byte("iso6cmfcmp41"))
+    mvhd := mp4FullBox("mvhd", 0, 0, mp4Fields(uint32(0), uint32(0), timescale, uint32(0),
+                                                uint32(0x00010000), uint16(0x0100), uint16(0), uint64(0)),
+                       mp4Fields(mp4Matrix), make([]byte, 24), mp4Fields(FMP4_TRACK_ID + 1))
+    tkhd := mp4FullBox("tkhd", 0, 0x000003, mp4Fields(uint32(0), uint32(0), FMP4_TRACK_ID, uint32(0), uint32(0),
+                                                       uint64(0), uint16(0), uint16(0), uint16(0x0100), uint16(0)),
+                       mp4Fields(mp4Matrix), mp4Fields(uint32(0), uint32(0)))
+    // The language is "und", packed
+    mdhd := mp4FullBox("mdhd", 0, 0, mp4Fields(uint32(0), uint32(0), timescale, uint32(0), uint16(0x55c4), uint16(0)))
+    hdlr := mp4FullBox("hdlr", 0, 0, mp4Fields(uint32(0)), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+    smhd := mp4FullBox("smhd", 0, 0, mp4Fields(uint16(0), uint16(0)))
+    dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Fields(uint32(1)), mp4FullBox("url ", 0, 0x000001)))
+    stbl := mp4Box("stbl", mp4FullBox("stsd", 0, 0, mp4Fields(uint32(1)), sampleEntry),
+                   mp4FullBox("stts", 0, 0, mp4Fields(uint32(0))),
+                   mp4FullBox("stsc", 0, 0, mp4Fields(uint32(0))),
+                   mp4FullBox("stsz", 0, 0, mp4Fields(uint32(0), uint32(0))),
+                   mp4FullBox("stco", 0, 0, mp4Fields(uint32(0))))
+    trak := mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", smhd, dinf, stbl)))
+    mvex := mp4Box("mvex", mp4FullBox("trex", 0, 0, mp4Fields(FMP4_TRACK_ID, uint32(1), uint32(0), uint32(0), uint32(0))))
+
+    return append(ftyp, mp4Box("moov", mvhd, trak, mvex)...), nil
+}
+
+// Return the name of the initialisation segment of a codec
+func fmp4InitName(codec string) string {
+    return FMP4_INIT_PREFIX + codec + FMP4_EXTENSION
+}
+
+// Write the initialisation segment of a codec to a directory, returning
+// its name
+func writeFmp4InitSegment(dirName string, codec string) (string, error) {
+    initSegment, err := fmp4InitSegment(codec)
+    if err != nil {
+        return "", err
+    }
+    name := fmp4InitName(codec)
+    err = ioutil.WriteFile(filepath.Join(dirName, name), initSegment, 0644)
+    if err != nil {
+        return "", err
+    }
+    log.Printf("Wrote fragmented MP4 initialisation segment \"%s\" to \"%s\".\n", name, dirName)
+
+    return name, nil
+}
+
+// Create an encoder of MP3 packaged as fragmented MP4, which starts
+// the first segment
+func newFmp4Mp3Encoder(output *bytes.Buffer, settings *Mp3Settings) (Encoder, error) {
+    var err error
+
+    encoder := &Fmp4Encoder{output: output}
+    encoder.mp3, err = newMp3Encoder(&encoder.elementary, settings)
+    if err != nil {
+        return nil, err
+    }
+    encoder.frameSamples = encoder.mp3.FrameSamples()
+
+    return encoder, nil
+}
+
+// Create an encoder of AAC packaged as fragmented MP4, which starts
+// the first segment
+func newFmp4AacEncoder(output *bytes.Buffer, settings *Mp3Settings) (Encoder, error) {
+    var err error
+
+    if _, err = aacAudioSpecificConfig(); err != nil {
+        return nil, err
+    }
+    encoder := &Fmp4Encoder{output: output, scale: settings.Scale}
+    if encoder.scale == 0 {
+        encoder.scale = MP3_DEFAULT_SCALE
+    }
+    encoder.aac, err = fdkaac.NewEncoder(streamSamplingFrequency, streamChannels, settings.Bitrate * 1000)
+    if err != nil {
+        return nil, err
+    }
+    encoder.frameSamples = encoder.aac.FrameLength()
+
+    return encoder, nil
+}
+
+// Take the whole frames out of the elementary stream: MP3 frames as
+// they are, AAC frames without their ADTS headers
+func (encoder *Fmp4Encoder) takeFrames() error {
+    data := encoder.elementary.Bytes()
+    for {
+        var frame []byte
+        length := 0
+        if encoder.aac != nil {
+            if len(data) >= ADTS_HEADER_SIZE {
+                length = (int(data[3] & 0x03) << 11) | (int(data[4]) << 3) | (int(data[5]) >> 5)
+                if (data[0] != 0xff) || (data[1] & 0xf0 != 0xf0) || (length < ADTS_HEADER_SIZE) {
+                    return errors.New(fmt.Sprintf("AAC encoder output is not ADTS (%d byte(s) left)", len(data)))
+                }
+                headerSize := ADTS_HEADER_SIZE
+                if data[1] & 0x01 == 0 {
+                    // There is a CRC
+                    headerSize += 2
+                }
+                if length <= len(data) {
+                    frame = data[headerSize:length]
+                }
+            }
+        } else {
+            length, _ = parseMp3FrameHeader(data)
+            if (length == 0) && (len(data) >= MP3_FRAME_HEADER_SIZE) {
+                // Not a frame (e.g. a tag), look further on
+                data = data[1:]
+                continue
+            }
+            if (length > 0) && (length <= len(data)) {
+                frame = data[:length]
+            }
+        }
+        if frame == nil {
+            break
+        }
+        encoder.frames = append(encoder.frames, append([]byte(nil), frame...))
+        data = data[length:]
+    }
+    remaining := append([]byte(nil), data...)
+    encoder.elementary.Reset()
+    encoder.elementary.Write(remaining)
+
+    return nil
+}
+
+// Encode PCM, keeping the frames for the fragment of the segment
+func (encoder *Fmp4Encoder) WriteSamples(pcm []byte) (int, error) {
+    var samples int
+    var err error
+
+    if encoder.aac != nil {
+        var data []byte
+        encoder.pcm = appendScaledPcm(encoder.pcm[:0], pcm, encoder.scale)
+        data, samples, err = encoder.aac.Encode(encoder.pcm)
+        samples /= streamChannels
+        encoder.elementary.Write(data)
+    } else {
+        samples, err = encoder.mp3.WriteSamples(pcm)
+    }
+    if err == nil {
+        err = encoder.takeFrames()
+    }
+
+    return samples, err
+}
+
+// Flush what the encoder is holding into the fragment of the segment
+// and finish it
+func (encoder *Fmp4Encoder) Flush() error {
+    var err error
+
+    if encoder.aac != nil {
+        for {
+            var data []byte
+            data, err = encoder.aac.Flush()
+            if (err != nil) || (len(data) == 0) {
+                break
+            }
+            encoder.elementary.Write(data)
+        }
+    } else {
+        err = encoder.mp3.Flush()
+    }
+    if err == nil {
+        err = encoder.takeFrames()
+    }
+    encoder.EndSegment()
+
+    return err
+}
+
+// The number of samples in each channel of a frame
+func (encoder *Fmp4Encoder) FrameSamples() int {
+    return encoder.frameSamples
+}
+
+// The extension of fragmented MP4 segment files
+func (encoder *Fmp4Encoder) Extension() string {
+    return FMP4_EXTENSION
+}
+
+// Release the encoder inside
+func (encoder *Fmp4Encoder) Close() {
+    if encoder.aac != nil {
+        encoder.aac.Close()
+    } else {
+        encoder.mp3.Close()
+    }
+}
+
+// Write the frames of the segment as a fragment
+func (encoder *Fmp4Encoder) EndSegment() {
+    if len(encoder.frames) == 0 {
+        return
+    }
+    encoder.sequence++
+    var samples bytes.Buffer
+    var mdat []byte
+    for _, frame := range encoder.frames {
+        binary.Write(&samples, binary.BigEndian, uint32(encoder.frameSamples))
+        binary.Write(&samples, binary.BigEndian, uint32(len(frame)))
+        mdat = append(mdat, frame...)
+    }
+    // The data offset, from the start of the moof box to the first
+    // sample, is filled in once the size of the moof box is known;
+    // trun flags are data offset, sample duration and sample size
+    trunFields := mp4Fields(uint32(len(encoder.frames)), uint32(0))
+    moof := mp4Box("moof", mp4FullBox("mfhd", 0, 0, mp4Fields(encoder.sequence)),
+                   mp4Box("traf", mp4FullBox("tfhd", 0, 0x020000, mp4Fields(FMP4_TRACK_ID)),
+                          mp4FullBox("tfdt", 1, 0, mp4Fields(encoder.decodeTime)),
+                          mp4FullBox("trun", 0, 0x000301, trunFields, samples.Bytes())))
+    // The data offset is the last field of the trun box before the
+    // samples
+    offset := len(moof) - samples.Len() - 4
+    binary.BigEndian.PutUint32(moof[offset:], uint32(len(moof) + 8))
+    encoder.output.Write(moof)
+    encoder.output.Write(mp4Box("mdat", mdat))
+    encoder.decodeTime += uint64(len(encoder.frames) * encoder.frameSamples)
+    encoder.frames = encoder.frames[:0]
+}
+
+// Nothing is needed at the start of a segment, the initialisation
+// segment being separate
+func (encoder *Fmp4Encoder) StartSegment() {
+}
+
+/* End Of File */
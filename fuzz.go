@@ -0,0 +1,118 @@
+/* go-fuzz targets for the decoders of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+//go:build gofuzz
+
+package main
+
+import (
+    "sync"
+    "github.com/RobMeades/ioc-server/urtp"
+)
+
+// Targets for go-fuzz (https://github.com/dvyukov/go-fuzz), only built
+// with the gofuzz build tag.  They drive the urtp package, and the
+// decoders behind it, with none of the server's side effects: nothing is
+// queued for processing and no session state is changed.  Each returns
+// 1 if the input got as far as being decoded, so that go-fuzz favours
+// inputs like it, else 0.  The urtp package has its own targets for
+// the parsers alone.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A urtp.Handler that parses and decodes but does nothing else
+type FuzzUrtpHandler struct {
+    decoders  *Decoders
+    decoded   *bool
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Make sure the decoders are registered once only
+var fuzzOnce sync.Once
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check a capabilities acknowledgement
+func (handler FuzzUrtpHandler) HandleCapabilitiesAck(data []byte) {
+    urtp.IsCapabilitiesAck(data)
+}
+
+// Parse a hello
+func (handler FuzzUrtpHandler) HandleHello(data []byte) []byte {
+    parseHello(data)
+    return nil
+}
+
+// Parse a time report
+func (handler FuzzUrtpHandler) HandleTimeReport(data []byte) {
+    urtp.ParseTimeReport(data)
+}
+
+// Parse and decode a URTP datagram
+func (handler FuzzUrtpHandler) HandleDatagram(version byte, datagram []byte) [][]byte {
+    parsed, err := urtp.Parse(datagram)
+    if (err == nil) && !parsed.Heartbeat && (handler.decoders.Decode(parsed.AudioCodingScheme, parsed.Channels, parsed.Payload) != nil) {
+        *handler.decoded = true
+    }
+
+    return nil
+}
+
+// Fuzz a single datagram, as would arrive over UDP
+func FuzzUrtpDatagram(data []byte) int {
+    var decoded bool
+
+    fuzzOnce.Do(registerBuiltInDecoders)
+    handler := FuzzUrtpHandler{decoders: newDecoders(), decoded: &decoded}
+    if urtp.IsCapabilitiesAck(data) {
+        handler.HandleCapabilitiesAck(data)
+    } else if urtp.IsHello(data) {
+        handler.HandleHello(data)
+    } else if urtp.IsTimeReport(data) {
+        handler.HandleTimeReport(data)
+    } else {
+        datagram, version := urtp.Normalise(data)
+        if datagram != nil {
+            handler.HandleDatagram(version, datagram)
+        }
+    }
+    if decoded {
+        return 1
+    }
+
+    return 0
+}
+
+// Fuzz a stream, as would arrive over TCP, delivered in one go
+func FuzzUrtpStream(data []byte) int {
+    var decoded bool
+
+    fuzzOnce.Do(registerBuiltInDecoders)
+    reassembler := urtp.NewReassembler(FuzzUrtpHandler{decoders: newDecoders(), decoded: &decoded})
+    // Throw away anything left from the last input
+    reassembler.Leftover()
+    reassembler.Handle(data)
+    if decoded {
+        return 1
+    }
+
+    return 0
+}
+
+/* End Of File */
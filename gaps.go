@@ -0,0 +1,125 @@
+/* Gap statistics for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+// Every gap in the incoming audio is counted here, whether or not it
+// is filled: a gap longer than the maximum fill is taken to be silly
+// (e.g. a client that has restarted) and is not filled.  As well as
+// the totals, the number of gaps, the milliseconds filled and the
+// largest gap are kept for each of the last GAP_STATS_HOURS hours, so
+// that a bad patch of coverage shows up against the time it happened.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The gaps in an hour
+type GapHour struct {
+    Hour       time.Time  `json:"hour"`
+    Gaps       int        `json:"gaps"`
+    Silly      int        `json:"silly"`
+    FilledMs   int64      `json:"filledMs"`
+    LargestMs  int64      `json:"largestMs"`
+}
+
+// A count of the gaps
+type GapCounter struct {
+    MaxFill     time.Duration
+    gaps        int
+    silly       int
+    filled      time.Duration
+    largest     time.Duration
+    // Oldest first
+    hours       []GapHour
+    locker      sync.Mutex
+}
+
+// Statistics of the gaps
+type GapStats struct {
+    MaxFillMs  int64      `json:"maxFillMs"`
+    Gaps       int        `json:"gaps"`
+    Silly      int        `json:"silly"`
+    FilledMs   int64      `json:"filledMs"`
+    LargestMs  int64      `json:"largestMs"`
+    Hours      []GapHour  `json:"hours"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of hours for which gaps are kept hour by hour
+const GAP_STATS_HOURS int = 24
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a gap counter, gaps of up to maxFillMilliseconds being filled
+func newGapCounter(maxFillMilliseconds uint) *GapCounter {
+    return &GapCounter{MaxFill: time.Duration(maxFillMilliseconds) * time.Millisecond}
+}
+
+// Record a gap of the given number of samples, returning true if it
+// should be filled
+func (counter *GapCounter) Record(numSamples int, now time.Time) bool {
+    counter.locker.Lock()
+    defer counter.locker.Unlock()
+
+    duration := pcmDuration(numSamples * URTP_SAMPLE_SIZE * streamChannels)
+    filled := duration < counter.MaxFill
+    hour := now.UTC().Truncate(time.Hour)
+    if (len(counter.hours) == 0) || !counter.hours[len(counter.hours) - 1].Hour.Equal(hour) {
+        counter.hours = append(counter.hours, GapHour{Hour: hour})
+        if len(counter.hours) > GAP_STATS_HOURS {
+            counter.hours = append(counter.hours[:0], counter.hours[len(counter.hours) - GAP_STATS_HOURS:]...)
+        }
+    }
+    thisHour := &counter.hours[len(counter.hours) - 1]
+    counter.gaps++
+    thisHour.Gaps++
+    if filled {
+        counter.filled += duration
+        thisHour.FilledMs += int64(duration / time.Millisecond)
+    } else {
+        counter.silly++
+        thisHour.Silly++
+    }
+    if duration > counter.largest {
+        counter.largest = duration
+    }
+    if int64(duration / time.Millisecond) > thisHour.LargestMs {
+        thisHour.LargestMs = int64(duration / time.Millisecond)
+    }
+
+    return filled
+}
+
+// Return the statistics of the gaps
+func (counter *GapCounter) Stats() interface{} {
+    counter.locker.Lock()
+    defer counter.locker.Unlock()
+
+    return GapStats{MaxFillMs: int64(counter.MaxFill / time.Millisecond),
+                    Gaps: counter.gaps, Silly: counter.silly,
+                    FilledMs: int64(counter.filled / time.Millisecond),
+                    LargestMs: int64(counter.largest / time.Millisecond),
+                    Hours: append([]GapHour(nil), counter.hours...)}
+}
+
+/* End Of File */
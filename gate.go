@@ -0,0 +1,130 @@
+/* Noise gate for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// Overnight the input may be nothing but modem hiss and wind, which
+// there is no point in anyone hearing, so a noise gate can silence the
+// decoded audio while its level stays below a threshold.  The level is
+// the RMS level of each datagram's audio: the gate opens as soon as a
+// block reaches the threshold and closes once the blocks have been
+// below it for the hold time, so that the tail of a chuff isn't cut
+// off.  The channels of a stereo stream are measured together and
+// share the gate.  The gain is faded between open and closed over
+// GATE_FADE_MILLISECONDS so that there are no clicks.  The gate comes
+// before the AGC (see agc.go), which would otherwise bring the hiss up
+// to the target level.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of a noise gate
+type NoiseGate struct {
+    ThresholdDbfs  float64
+    Hold           time.Duration
+    open           bool
+    // How long the blocks have been below the threshold
+    below          time.Duration
+    gain           float32
+    step           float32
+    closedFor      time.Duration
+    started        time.Time
+    locker         sync.Mutex
+}
+
+// Statistics of a noise gate
+type NoiseGateStats struct {
+    Open           bool     `json:"open"`
+    ClosedPercent  float64  `json:"closedPercent"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How long the gate takes to open or close
+const GATE_FADE_MILLISECONDS int = 20
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a noise gate that is open while the level is at least
+// thresholdDbfs and closes after holdMilliseconds below it
+func newNoiseGate(thresholdDbfs float64, holdMilliseconds uint) *NoiseGate {
+    gate := &NoiseGate{ThresholdDbfs: thresholdDbfs, Hold: time.Duration(holdMilliseconds) * time.Millisecond,
+                       step: 1 / float32(GATE_FADE_MILLISECONDS * streamSamplingFrequency / 1000 * streamChannels), started: time.Now()}
+    log.Printf("Noise gate enabled: threshold %.1f dBFS, hold %d ms.\n", thresholdDbfs, holdMilliseconds)
+
+    return gate
+}
+
+// Apply the noise gate to a block of audio in place
+func (gate *NoiseGate) Process(audio []int16) {
+    gate.locker.Lock()
+    defer gate.locker.Unlock()
+
+    duration := pcmDuration(len(audio) * URTP_SAMPLE_SIZE)
+    rmsDbfs, _ := measureLevel(audio)
+    if rmsDbfs >= gate.ThresholdDbfs {
+        if !gate.open {
+            log.Printf("Noise gate opened, level %.1f dBFS.\n", rmsDbfs)
+            gate.open = true
+        }
+        gate.below = 0
+    } else if gate.open {
+        gate.below += duration
+        if gate.below >= gate.Hold {
+            log.Printf("Noise gate closed.\n")
+            gate.open = false
+        }
+    }
+    if !gate.open {
+        gate.closedFor += duration
+    }
+    for x, sample := range audio {
+        if gate.open && (gate.gain < 1) {
+            gate.gain += gate.step
+            if gate.gain > 1 {
+                gate.gain = 1
+            }
+        } else if !gate.open && (gate.gain > 0) {
+            gate.gain -= gate.step
+            if gate.gain < 0 {
+                gate.gain = 0
+            }
+        }
+        audio[x] = int16(float32(sample) * gate.gain)
+    }
+}
+
+// Return the statistics of the noise gate
+func (gate *NoiseGate) Stats() interface{} {
+    gate.locker.Lock()
+    defer gate.locker.Unlock()
+
+    stats := NoiseGateStats{Open: gate.open}
+    if uptime := time.Since(gate.started); uptime > 0 {
+        stats.ClosedPercent = float64(gate.closedFor) * 100 / float64(uptime)
+    }
+
+    return stats
+}
+
+/* End Of File */
@@ -0,0 +1,151 @@
+/* HTTPS for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "golang.org/x/crypto/acme/autocert"
+)
+
+// Browsers won't play a stream served over HTTP from a page served
+// over HTTPS, so the HTTP server may serve HTTPS instead, with either
+// a certificate and key of its own (see --tlscert and --tlskey) or a
+// certificate issued, and renewed before it expires, automatically by
+// Let's Encrypt through ACME for the given host names (see
+// --acmehost), the certificates being kept in a cache directory (see
+// --acmecache) so that they aren't issued again every time the server
+// starts.  ACME uses the TLS-ALPN-01 challenge on the HTTPS port,
+// which must therefore be 443, and, if there is a redirect port (see
+// --httpredirect, normally 80), the HTTP-01 challenge there too; the
+// redirect port otherwise redirects every request to the same URL
+// over HTTPS.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// HTTPS settings of the HTTP server
+type Https struct {
+    CertFile      string
+    KeyFile       string
+    // The port on which plain HTTP is redirected to HTTPS, none if empty
+    RedirectPort  string
+    manager       *autocert.Manager
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The HTTPS settings of the HTTP server, nil if it serves plain HTTP
+var httpsOut *Https
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Set up HTTPS, either with certFile and keyFile or with certificates
+// issued by Let's Encrypt for acmeHosts, kept in acmeCacheDir, with
+// acmeEmail, if not empty, as the contact address for the account;
+// plain HTTP requests to redirectPort, if not empty, are redirected
+func newHttps(certFile string, keyFile string, acmeHosts []string, acmeCacheDir string, acmeEmail string,
+              redirectPort string) (*Https, error) {
+    https := &Https{CertFile: certFile, KeyFile: keyFile, RedirectPort: redirectPort}
+
+    if len(acmeHosts) > 0 {
+        if (certFile != "") || (keyFile != "") {
+            return nil, errors.New("give either a certificate and key or ACME host names, not both")
+        }
+        if acmeCacheDir == "" {
+            return nil, errors.New("ACME needs a cache directory for the certificates")
+        }
+        err := os.MkdirAll(acmeCacheDir, 0700)
+        if err != nil {
+            return nil, err
+        }
+        https.manager = &autocert.Manager{Prompt: autocert.AcceptTOS, HostPolicy: autocert.HostWhitelist(acmeHosts...),
+                                          Cache: autocert.DirCache(acmeCacheDir), Email: acmeEmail}
+        log.Printf("HTTPS certificates for %v will be issued by Let's Encrypt and kept in \"%s\".\n", acmeHosts, acmeCacheDir)
+    } else {
+        if (certFile == "") || (keyFile == "") {
+            return nil, errors.New("HTTPS needs both a certificate and a key")
+        }
+        for _, fileName := range []string{certFile, keyFile} {
+            if _, err := os.Stat(fileName); err != nil {
+                return nil, err
+            }
+        }
+        log.Printf("HTTPS will use the certificate in \"%s\".\n", certFile)
+    }
+
+    return https, nil
+}
+
+// Serve HTTPS on a listener, blocking until the server is shut down
+func (https *Https) serve(server *http.Server, listener net.Listener) error {
+    if https.manager != nil {
+        server.TLSConfig = https.manager.TLSConfig()
+        return server.ServeTLS(listener, "", "")
+    }
+
+    return server.ServeTLS(listener, https.CertFile, https.KeyFile)
+}
+
+// Redirect plain HTTP requests on the redirect port to HTTPS on
+// httpsPort, answering ACME HTTP-01 challenges along the way, until
+// ctx is done
+func (https *Https) operateRedirect(ctx context.Context, bindAddresses []string, httpsPort string) {
+    var handler http.Handler = http.HandlerFunc(func(out http.ResponseWriter, in *http.Request) {
+        host, _, err := net.SplitHostPort(in.Host)
+        if err != nil {
+            host = in.Host
+        }
+        if httpsPort != "443" {
+            host = net.JoinHostPort(host, httpsPort)
+        }
+        http.Redirect(out, in, "https://" + host + in.URL.RequestURI(), http.StatusMovedPermanently)
+    })
+    if https.manager != nil {
+        handler = https.manager.HTTPHandler(handler)
+    }
+    server := &http.Server{Handler: handler}
+
+    go func() {
+        <-ctx.Done()
+        server.Close()
+    }()
+
+    for _, bindAddress := range bindAddressesOrAll(bindAddresses) {
+        network, address := listenNetworkAndAddress("tcp", bindAddress, https.RedirectPort)
+        listener, err := net.Listen(network, address)
+        if err == nil {
+            fmt.Printf("Redirecting HTTP on %s (%s) to HTTPS.\n", listener.Addr().String(), network)
+            go func(listener net.Listener) {
+                err := server.Serve(listener)
+                if (err != nil) && !errors.Is(err, http.ErrServerClosed) {
+                    log.Printf("HTTP redirect on %s stopped (%s).\n", listener.Addr().String(), err.Error())
+                }
+            }(listener)
+        } else {
+            fmt.Fprintf(os.Stderr, "Could not redirect HTTP on %s (%s).\n", address, err.Error())
+        }
+    }
+}
+
+/* End Of File */
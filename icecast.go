@@ -0,0 +1,261 @@
+/* Icecast source output for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "strings"
+    "sync"
+    "time"
+)
+
+// So that internet radio infrastructure and apps can carry the chuffs,
+// an Icecast source (see --icecast) takes the same PCM as the main
+// encoder, encodes it as MP3 with an encoder of its own and pushes it
+// to a mount on an Icecast server (or a Shoutcast server that accepts
+// Icecast sources), as a source client would: a SOURCE request with
+// the source password, after which the MP3 just keeps flowing.  The
+// connection is made from a go routine of its own, so that a slow or
+// absent server never holds up the processing loop: the encoded audio
+// is queued for it and, if the queue fills up, the oldest is thrown
+// away.  If the connection can't be made, or breaks, it is made again
+// after ICECAST_RETRY_PERIOD.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of an Icecast source
+type IcecastSource struct {
+    // The host and port of the Icecast server
+    Server      string
+    Mount       string
+    password    string
+    encoder     Encoder
+    audio       bytes.Buffer
+    queue       chan []byte
+    locker      sync.Mutex
+    connected   bool
+    connects    int
+    failures    int
+    sentBytes   int64
+    dropped     int
+}
+
+// Statistics of an Icecast source
+type IcecastSourceStats struct {
+    Server     string  `json:"server"`
+    Mount      string  `json:"mount"`
+    Connected  bool    `json:"connected"`
+    Connects   int     `json:"connects"`
+    Failures   int     `json:"failures"`
+    SentBytes  int64   `json:"sentBytes"`
+    Dropped    int     `json:"dropped"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How long to wait before trying again to connect to the server
+const ICECAST_RETRY_PERIOD time.Duration = time.Second * 10
+
+// How long to wait for the server to connect, to answer and to take
+// each write
+const ICECAST_TIMEOUT time.Duration = time.Second * 10
+
+// The number of blocks of encoded audio that may be queued for the
+// server, each being what was encoded in a processing tick
+const ICECAST_QUEUE_SIZE int = 500
+
+// The user name that Icecast expects of a source
+const ICECAST_USER string = "source"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The Icecast source, nil if there isn't one
+var icecastSource *IcecastSource
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create an Icecast source pushing MP3 with the given settings to
+// mount on server, of the form host:port, with the given password
+func newIcecastSource(server string, mount string, password string, settings Mp3Settings) (*IcecastSource, error) {
+    var err error
+
+    if _, _, err = net.SplitHostPort(server); err != nil {
+        return nil, errors.New(fmt.Sprintf("\"%s\" is not of the form host:port", server))
+    }
+    if !strings.HasPrefix(mount, "/") {
+        mount = "/" + mount
+    }
+    if password == "" {
+        return nil, errors.New("a source password must be given")
+    }
+    source := &IcecastSource{Server: server, Mount: mount, password: password,
+                             queue: make(chan []byte, ICECAST_QUEUE_SIZE)}
+    source.encoder, err = newEncoder(DEFAULT_CODEC, &source.audio, &settings)
+    if err != nil {
+        return nil, err
+    }
+    log.Printf("Icecast source will push MP3 to mount \"%s\" on %s.\n", mount, server)
+
+    return source, nil
+}
+
+// Encode some little-endian 16-bit PCM and queue it for the server
+func (source *IcecastSource) Write(pcm []byte) {
+    _, err := source.encoder.WriteSamples(pcm)
+    if err != nil {
+        log.Printf("Unable to encode Icecast audio (%s).\n", err.Error())
+    }
+    if source.audio.Len() > 0 {
+        audio := make([]byte, source.audio.Len())
+        copy(audio, source.audio.Bytes())
+        source.audio.Reset()
+        for queued := false; !queued; {
+            select {
+                case source.queue <- audio:
+                    queued = true
+                default:
+                    select {
+                        case <-source.queue:
+                            source.locker.Lock()
+                            source.dropped++
+                            source.locker.Unlock()
+                        default:
+                    }
+            }
+        }
+    }
+}
+
+// Connect to the server, returning the connection once the server has
+// accepted the source
+func (source *IcecastSource) connect() (net.Conn, error) {
+    connection, err := net.DialTimeout("tcp", source.Server, ICECAST_TIMEOUT)
+    if err != nil {
+        return nil, err
+    }
+    credentials := base64.StdEncoding.EncodeToString([]byte(ICECAST_USER + ":" + source.password))
+    request := fmt.Sprintf("SOURCE %s HTTP/1.0\r\n", source.Mount) +
+               fmt.Sprintf("Authorization: Basic %s\r\n", credentials) +
+               fmt.Sprintf("User-Agent: ioc-server/%s\r\n", SERVER_VERSION) +
+               "Content-Type: audio/mpeg\r\n" +
+               "Ice-Name: Internet of Chuffs\r\n" +
+               "Ice-Public: 0\r\n" +
+               "\r\n"
+    connection.SetDeadline(time.Now().Add(ICECAST_TIMEOUT))
+    _, err = connection.Write([]byte(request))
+    if err == nil {
+        var status string
+        status, err = bufio.NewReader(connection).ReadString('\n')
+        if (err == nil) && !strings.Contains(status, " 200") {
+            err = errors.New(fmt.Sprintf("the server said \"%s\"", strings.TrimSpace(status)))
+        }
+    }
+    if err != nil {
+        connection.Close()
+        return nil, err
+    }
+
+    return connection, nil
+}
+
+// Push the queued audio to the server until the connection breaks or
+// ctx is done
+func (source *IcecastSource) push(ctx context.Context, connection net.Conn) error {
+    for {
+        select {
+            case <-ctx.Done():
+                return nil
+            case audio := <-source.queue:
+                connection.SetWriteDeadline(time.Now().Add(ICECAST_TIMEOUT))
+                _, err := connection.Write(audio)
+                if err != nil {
+                    return err
+                }
+                source.locker.Lock()
+                source.sentBytes += int64(len(audio))
+                source.locker.Unlock()
+        }
+    }
+}
+
+// Keep connected to the server, pushing audio to it, until ctx is done
+func (source *IcecastSource) Run(ctx context.Context) {
+    for {
+        connection, err := source.connect()
+        if err == nil {
+            log.Printf("Connected to Icecast server %s, pushing to mount \"%s\".\n", source.Server, source.Mount)
+            source.locker.Lock()
+            source.connected = true
+            source.connects++
+            source.locker.Unlock()
+            // Start from the audio that is live now
+            for flushed := false; !flushed; {
+                select {
+                    case <-source.queue:
+                    default:
+                        flushed = true
+                }
+            }
+            err = source.push(ctx, connection)
+            connection.Close()
+            source.locker.Lock()
+            source.connected = false
+            source.locker.Unlock()
+        }
+        if err != nil {
+            log.Printf("Unable to push to Icecast server %s (%s), will try again in %d second(s).\n",
+                       source.Server, err.Error(), ICECAST_RETRY_PERIOD / time.Second)
+            source.locker.Lock()
+            source.failures++
+            source.locker.Unlock()
+        }
+        select {
+            case <-ctx.Done():
+                return
+            case <-time.After(ICECAST_RETRY_PERIOD):
+        }
+    }
+}
+
+// Finish with the encoder; the Icecast source may not be written to
+// again
+func (source *IcecastSource) Close() {
+    source.encoder.Close()
+}
+
+// Return the statistics of an Icecast source
+func (source *IcecastSource) Stats() interface{} {
+    source.locker.Lock()
+    defer source.locker.Unlock()
+
+    return IcecastSourceStats{Server: source.Server, Mount: source.Mount, Connected: source.connected,
+                              Connects: source.connects, Failures: source.failures,
+                              SentBytes: source.sentBytes, Dropped: source.dropped}
+}
+
+/* End Of File */
@@ -0,0 +1,176 @@
+/* Session and event journal for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "log"
+    "os"
+    "time"
+)
+
+// So that "why did the stream die at 14:32" can be answered after the
+// fact, without trawling the log, the events that tell the story of a
+// session (clients connecting, disconnecting and being rejected,
+// resets, gaps, underruns, stalls, the output failing and recovering,
+// going out of and back into service, each segment produced and each
+// export of the archive) may be written to a journal (see --journal),
+// a file of JSON lines, one per event, each being an object of the
+// `time` (RFC 3339, UTC), the `event` name and the fields of the event,
+// durations being in milliseconds.  It is append-only, so a restart loses nothing, and a
+// JSONL file needs no database engine: it can be read with jq or
+// grep as well as through the admin API (GET /admin/journal).  So that
+// it doesn't grow forever it is rotated daily, in the same way as the
+// log file (see logfile.go), and --journalkeep days are kept.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The journal
+type Journal struct {
+    file     *LogFile
+    events   map[string]bool
+}
+
+// An entry in the journal, as read back
+type JournalEntry map[string]interface{}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of events that may be queued for the journal
+const JOURNAL_QUEUE_SIZE int = 1000
+
+// How often the journal is rotated
+const JOURNAL_ROTATE_PERIOD time.Duration = time.Hour * 24
+
+// The most entries returned by a query of the journal
+const JOURNAL_QUERY_LIMIT int = 10000
+
+// The largest line that may be read from the journal
+const JOURNAL_MAX_LINE_SIZE int = 1024 * 1024
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The journal, nil if there isn't one
+var journal *Journal
+
+// The events that are written to the journal
+var journalEvents = []string{EVENT_CLIENT_CONNECTED, EVENT_CLIENT_DISCONNECTED, EVENT_CLIENT_REJECTED,
+                             EVENT_CLIENT_SILENT, EVENT_RESET, EVENT_GAP, EVENT_UNDERRUN, EVENT_STALLED,
+                             EVENT_OUTPUT_FAILED, EVENT_OUTPUT_RECOVERED, EVENT_OUT_OF_SERVICE,
+                             EVENT_IN_SERVICE, EVENT_DISK_SPACE, EVENT_SEGMENT, EVENT_EXPORT}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Open the journal fileName, keeping keepDays days of it
+func newJournal(fileName string, keepDays uint) (*Journal, error) {
+    file, err := newLogFile(fileName, 0, JOURNAL_ROTATE_PERIOD, int(keepDays))
+    if err != nil {
+        return nil, err
+    }
+    journal := &Journal{file: file, events: make(map[string]bool)}
+    for _, name := range journalEvents {
+        journal.events[name] = true
+    }
+    log.Printf("Events will be journalled to \"%s\", %d day(s) being kept.\n", fileName, keepDays)
+
+    return journal, nil
+}
+
+// Write an event to the journal
+func (journal *Journal) write(event *Event) {
+    entry := JournalEntry{"time": event.Time.UTC().Format(time.RFC3339Nano), "event": event.Name}
+    for key, value := range event.Fields {
+        if duration, ok := value.(time.Duration); ok {
+            value = int64(duration / time.Millisecond)
+        }
+        if _, ok := entry[key]; !ok {
+            entry[key] = value
+        }
+    }
+    line, err := json.Marshal(entry)
+    if err == nil {
+        _, err = journal.file.Write(append(line, '\n'))
+    }
+    if err != nil {
+        log.Printf("Unable to write \"%s\" event to the journal (%s).\n", event.Name, err.Error())
+    }
+}
+
+// Write the events to the journal until ctx is done
+func (journal *Journal) Run(ctx context.Context) {
+    events := subscribeEvents(JOURNAL_QUEUE_SIZE)
+    defer unsubscribeEvents(events)
+    defer journal.file.Close()
+
+    for {
+        select {
+            case <-ctx.Done():
+                return
+            case event := <-events:
+                if journal.events[event.Name] {
+                    journal.write(event)
+                }
+        }
+    }
+}
+
+// Return the entries of the journal from from up to to (either may be
+// zero for no limit), only of the given events (all of them if none
+// are given), oldest first; if there are more than limit, the most
+// recent limit entries are returned and truncated is true
+func (journal *Journal) Query(from time.Time, to time.Time, names map[string]bool, limit int) ([]JournalEntry, bool) {
+    entries := []JournalEntry{}
+    truncated := false
+
+    for _, fileName := range append(journal.file.rotatedNames(), journal.file.Name) {
+        handle, err := os.Open(fileName)
+        if err != nil {
+            continue
+        }
+        scanner := bufio.NewScanner(handle)
+        scanner.Buffer(make([]byte, 0, 4096), JOURNAL_MAX_LINE_SIZE)
+        for scanner.Scan() {
+            var entry JournalEntry
+            if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+                continue
+            }
+            name, _ := entry["event"].(string)
+            timeString, _ := entry["time"].(string)
+            when, err := time.Parse(time.RFC3339Nano, timeString)
+            if (err != nil) || ((len(names) > 0) && !names[name]) ||
+               (!from.IsZero() && when.Before(from)) || (!to.IsZero() && when.After(to)) {
+                continue
+            }
+            entries = append(entries, entry)
+            if len(entries) > limit {
+                entries = entries[1:]
+                truncated = true
+            }
+        }
+        handle.Close()
+    }
+
+    return entries, truncated
+}
+
+/* End Of File */
@@ -0,0 +1,163 @@
+/* Adaptive bitrate ladder for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// So that listeners on poor connections can still hear something, the
+// same PCM can be encoded at lower bitrates alongside the main stream,
+// each rendition being published to a playlist of its own in the
+// playlist directory in the same way as the shadow stream (see
+// shadow.go).  A master playlist then lists the main playlist and the
+// renditions, with their bandwidths, so that an HLS player can pick
+// the one that suits its connection and switch between them as that
+// changes.  The renditions have the settings of the main stream apart
+// from the bitrate.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A bitrate ladder
+type AbrLadder struct {
+    MasterPath    string
+    PlaylistName  string
+    Codec         string
+    Bitrates      []int
+    Renditions    []*ShadowEncoder
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// What is added to the name of the main playlist to make the name of
+// the master playlist
+const LADDER_MASTER_SUFFIX string = "_master"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The bitrate ladder, nil if there isn't one
+var abrLadder *AbrLadder
+
+// The HLS CODECS attribute of each codec
+var hlsCodecs = map[string]string{DEFAULT_CODEC: "mp4a.40.34", OPUS_CODEC: "opus", AAC_CODEC: "mp4a.40.2",
+                                  AAC_CODEC + FMP4_CODEC_SUFFIX: "mp4a.40.2"}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a bitrate ladder for the main playlist at playlistPath,
+// encoded with codec and settings, adding renditions at bitrates
+// (in kbits/s), and write its master playlist
+func newAbrLadder(playlistPath string, codec string, settings Mp3Settings, bitrates []uint,
+                  segmentFileDurationMilliseconds uint, playlistLengthSeconds uint) (*AbrLadder, error) {
+    mp3Dir := filepath.Dir(playlistPath)
+    name := strings.TrimSuffix(filepath.Base(playlistPath), PLAYLIST_EXTENSION)
+    ladder := &AbrLadder{MasterPath: filepath.Join(mp3Dir, name + LADDER_MASTER_SUFFIX + PLAYLIST_EXTENSION),
+                         PlaylistName: filepath.Base(playlistPath), Codec: codec}
+
+    if settings.Bitrate == 0 {
+        return nil, errors.New("the main stream must have a bitrate for the master playlist to give")
+    }
+    // Highest first
+    for _, bitrate := range bitrates {
+        if (bitrate == 0) || (int(bitrate) == settings.Bitrate) {
+            return nil, errors.New(fmt.Sprintf("a rendition bitrate of %d kbits/s is not useful", bitrate))
+        }
+        ladder.Bitrates = append(ladder.Bitrates, int(bitrate))
+    }
+    sort.Sort(sort.Reverse(sort.IntSlice(ladder.Bitrates)))
+    for _, bitrate := range ladder.Bitrates {
+        renditionSettings := settings
+        renditionSettings.Bitrate = bitrate
+        rendition := newShadowEncoder(mp3Dir, fmt.Sprintf("%s_%dk", name, bitrate), codec, renditionSettings,
+                                      segmentFileDurationMilliseconds, playlistLengthSeconds)
+        if rendition == nil {
+            return nil, errors.New(fmt.Sprintf("unable to create the %d kbits/s rendition", bitrate))
+        }
+        ladder.Renditions = append(ladder.Renditions, rendition)
+    }
+    err := ladder.WriteMaster(settings.Bitrate)
+    if err != nil {
+        return nil, err
+    }
+
+    return ladder, nil
+}
+
+// Write the master playlist, given the bitrate of the main stream
+// in kbits/s
+func (ladder *AbrLadder) WriteMaster(bitrate int) error {
+    var data bytes.Buffer
+    var eol string = playlistFormat.LineEnding
+
+    writeVariant := func(bitrate int, playlistName string) {
+        fmt.Fprintf(&data, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bitrate * 1000)
+        if codecs, found := hlsCodecs[ladder.Codec]; found {
+            fmt.Fprintf(&data, ",CODECS=\"%s\"", codecs)
+        }
+        fmt.Fprintf(&data, "%s%s%s", eol, playlistName, eol)
+    }
+
+    fmt.Fprintf(&data, "#EXTM3U%s", eol)
+    fmt.Fprintf(&data, "#EXT-X-VERSION:3%s", eol)
+    // The main stream first, since players start with the first
+    writeVariant(bitrate, ladder.PlaylistName)
+    for x, rendition := range ladder.Renditions {
+        writeVariant(ladder.Bitrates[x], filepath.Base(rendition.PlaylistPath))
+    }
+    err := ioutil.WriteFile(ladder.MasterPath, data.Bytes(), 0644)
+    if err == nil {
+        log.Printf("Wrote master playlist \"%s\" (main stream %d kbits/s, renditions %v kbits/s).\n",
+                   ladder.MasterPath, bitrate, ladder.Bitrates)
+    }
+
+    return err
+}
+
+// Encode some little-endian 16-bit PCM into the renditions
+func (ladder *AbrLadder) Write(pcm []byte) {
+    for _, rendition := range ladder.Renditions {
+        rendition.Write(pcm)
+    }
+}
+
+// Flush the renditions into their final segments and release their
+// encoders
+func (ladder *AbrLadder) Close() {
+    for _, rendition := range ladder.Renditions {
+        rendition.Close()
+    }
+}
+
+// Reset the renditions
+func (ladder *AbrLadder) Reset() {
+    for _, rendition := range ladder.Renditions {
+        rendition.Reset()
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,130 @@
+/* Audio level metering for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "math"
+    "sync"
+    "time"
+)
+
+// The level of each block of decoded audio is measured as it is
+// processed and the last LEVEL_HISTORY_SECONDS of levels are kept, so
+// that it is easy to see whether there is any sound coming from the
+// client at all.  For UNICAM audio the highest shift value in the block
+// is kept too, which shows how hard the client's compression is
+// working.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The level of a block of audio
+type BlockLevel struct {
+    Time             time.Time  `json:"time"`
+    SequenceNumber   uint16     `json:"sequenceNumber"`
+    RmsDbfs          float64    `json:"rmsDbfs"`
+    PeakDbfs         float64    `json:"peakDbfs"`
+    // The highest UNICAM shift value, -1 if not UNICAM
+    UnicamPeakShift  int        `json:"unicamPeakShift"`
+}
+
+// The levels of recent blocks, oldest first, those before first
+// being out of date
+type LevelMeter struct {
+    levels  []BlockLevel
+    first   int
+    locker  sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How many seconds of levels to keep
+const LEVEL_HISTORY_SECONDS int = 60
+
+// The level given to silence, which would otherwise be minus infinity
+const LEVEL_FLOOR_DBFS float64 = -96
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Convert a level, relative to full scale 16-bit, to dBFS
+func dbfs(level float64) float64 {
+    if level <= 0 {
+        return LEVEL_FLOOR_DBFS
+    }
+    value := 20 * math.Log10(level / 32768)
+    if value < LEVEL_FLOOR_DBFS {
+        value = LEVEL_FLOOR_DBFS
+    }
+
+    return value
+}
+
+// Measure the level of a block of audio
+func measureLevel(audio []int16) (float64, float64) {
+    var sumSquares float64
+    var peak float64
+
+    for _, sample := range audio {
+        value := math.Abs(float64(sample))
+        sumSquares += value * value
+        if value > peak {
+            peak = value
+        }
+    }
+    if len(audio) == 0 {
+        return LEVEL_FLOOR_DBFS, LEVEL_FLOOR_DBFS
+    }
+
+    return dbfs(math.Sqrt(sumSquares / float64(len(audio)))), dbfs(peak)
+}
+
+// Measure and keep the level of the audio in a datagram
+func (meter *LevelMeter) Put(datagram *UrtpDatagram, now time.Time) {
+    level := BlockLevel{Time: now, SequenceNumber: datagram.SequenceNumber, UnicamPeakShift: datagram.UnicamPeakShift}
+    level.RmsDbfs, level.PeakDbfs = measureLevel(*datagram.Audio)
+
+    meter.locker.Lock()
+    meter.levels = append(meter.levels, level)
+    // Skip over those that are too old, throwing them away once they
+    // are half of the total rather than copying every time
+    cutOff := now.Add(-time.Duration(LEVEL_HISTORY_SECONDS) * time.Second)
+    for (meter.first < len(meter.levels)) && meter.levels[meter.first].Time.Before(cutOff) {
+        meter.first++
+    }
+    if meter.first > len(meter.levels) / 2 {
+        meter.levels = append(meter.levels[:0], meter.levels[meter.first:]...)
+        meter.first = 0
+    }
+    meter.locker.Unlock()
+}
+
+// Return the levels of the last so many seconds, oldest first
+func (meter *LevelMeter) Get(seconds int, now time.Time) []BlockLevel {
+    meter.locker.Lock()
+    defer meter.locker.Unlock()
+
+    cutOff := now.Add(-time.Duration(seconds) * time.Second)
+    start := len(meter.levels)
+    for (start > meter.first) && !meter.levels[start - 1].Time.Before(cutOff) {
+        start--
+    }
+
+    return append([]BlockLevel(nil), meter.levels[start:]...)
+}
+
+/* End Of File */
@@ -0,0 +1,56 @@
+/* Listen address handling for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "net"
+    "strings"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Work out the network (e.g. "tcp", "udp6") and address to listen on
+// for a given bind address and port.  An empty bind address means all
+// interfaces, v4 and v6.  An IP literal (IPv6 ones with or without
+// square brackets) restricts the network to that IP version so that,
+// for instance, "0.0.0.0" and "::" can be listened on at the same time.
+func listenNetworkAndAddress(network string, bindAddress string, port string) (string, string) {
+    if bindAddress == "" {
+        return network, ":" + port
+    }
+
+    host := strings.TrimSuffix(strings.TrimPrefix(bindAddress, "["), "]")
+    ip := net.ParseIP(host)
+    if ip != nil {
+        if ip.To4() != nil {
+            network += "4"
+        } else {
+            network += "6"
+        }
+    }
+
+    return network, net.JoinHostPort(host, port)
+}
+
+// Return the bind addresses to use, all interfaces if none are given
+func bindAddressesOrAll(bindAddresses []string) []string {
+    if len(bindAddresses) == 0 {
+        return []string{""}
+    }
+
+    return bindAddresses
+}
+
+/* End Of File */
@@ -0,0 +1,248 @@
+/* Listener tracking for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// HLS has no connection to count, just requests, so a listener is
+// taken to be a distinct client, its IP address and user agent, that
+// has asked for a playlist or segment of a stream within the last
+// --listenerwindow seconds; a player polls the playlist every segment
+// or so, so a window of a few segments is enough to keep hold of a
+// listener without counting one that has gone for long.  For each
+// listener the time it joined, when it was last seen and the bytes
+// served to it are kept; the number of listeners, in total and for
+// each stream, the most there have been at once and how many have
+// joined are under "listeners" in the admin API statistics and the
+// listeners themselves are at GET /admin/listeners.  So that a small
+// server isn't overwhelmed when a stream gets popular there may be a
+// limit on the number of listeners (see --maxlisteners) and on the
+// rate at which bytes are served to them, measured over
+// LISTENER_RATE_PERIOD (see --maxbandwidth): beyond either a new
+// listener is turned away with a 503 and a Retry-After of
+// LISTENER_RETRY_AFTER, while those already listening carry on.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A listener to a stream
+type Listener struct {
+    Address    string     `json:"address"`
+    UserAgent  string     `json:"userAgent"`
+    Stream     string     `json:"stream"`
+    Joined     time.Time  `json:"joined"`
+    LastSeen   time.Time  `json:"lastSeen"`
+    Playlists  int        `json:"playlists"`
+    Segments   int        `json:"segments"`
+    Bytes      int64      `json:"bytes"`
+}
+
+// The listeners to the streams
+type ListenerTracker struct {
+    Window     time.Duration
+    // The most listeners there may be at once, 0 for no limit
+    MaxListeners  int
+    // The highest rate at which bytes may be served, 0 for no limit
+    MaxBytesPerSecond  int64
+    locker     sync.Mutex
+    listeners  map[string]*Listener
+    peak       int
+    peakTime   time.Time
+    joined     int
+    bytes      int64
+    refused    int
+    rateStart  time.Time
+    rateBytes  int64
+    rate       int64
+}
+
+// Statistics of the listeners
+type ListenerTrackerStats struct {
+    Listeners       int             `json:"listeners"`
+    Streams         map[string]int  `json:"streams"`
+    Peak            int             `json:"peak"`
+    PeakTime        time.Time       `json:"peakTime"`
+    Joined          int             `json:"joined"`
+    Bytes           int64           `json:"bytes"`
+    BytesPerSecond  int64           `json:"bytesPerSecond"`
+    Refused         int             `json:"refused"`
+}
+
+// A response writer that counts the bytes served to a listener
+type ListenerResponseWriter struct {
+    http.ResponseWriter
+    tracker   *ListenerTracker
+    listener  *Listener
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The period over which the rate at which bytes are served is measured
+const LISTENER_RATE_PERIOD time.Duration = time.Second * 5
+
+// How long a listener that is turned away is asked to wait
+const LISTENER_RETRY_AFTER time.Duration = time.Second * 30
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The listener tracker, nil if listeners aren't tracked
+var listenerTracker *ListenerTracker
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a listener tracker, a listener being one that has been seen
+// within window, allowing at most maxListeners and maxBytesPerSecond
+// (0 for no limit)
+func newListenerTracker(window time.Duration, maxListeners int, maxBytesPerSecond int64) *ListenerTracker {
+    if maxListeners > 0 {
+        log.Printf("At most %d listener(s) will be served.\n", maxListeners)
+    }
+    if maxBytesPerSecond > 0 {
+        log.Printf("New listeners will be turned away while more than %d byte(s) per second are being served.\n",
+                   maxBytesPerSecond)
+    }
+
+    return &ListenerTracker{Window: window, MaxListeners: maxListeners, MaxBytesPerSecond: maxBytesPerSecond,
+                            listeners: make(map[string]*Listener), rateStart: time.Now()}
+}
+
+// Forget the listeners that haven't been seen within the window; the
+// tracker must be locked
+func (tracker *ListenerTracker) expire(now time.Time) {
+    for key, listener := range tracker.listeners {
+        if now.Sub(listener.LastSeen) > tracker.Window {
+            delete(tracker.listeners, key)
+        }
+    }
+}
+
+// Measure the rate at which bytes are being served; the tracker must
+// be locked
+func (tracker *ListenerTracker) measure(now time.Time) {
+    if period := now.Sub(tracker.rateStart); period >= LISTENER_RATE_PERIOD {
+        tracker.rate = (tracker.bytes - tracker.rateBytes) * int64(time.Second) / int64(period)
+        tracker.rateBytes = tracker.bytes
+        tracker.rateStart = now
+    }
+}
+
+// Note a request for a playlist or a segment of a stream, returning
+// the response writer through which to serve it, so that the bytes
+// served are counted, or, if it is from a new listener that would go
+// beyond the limits, answering it with a 503 and returning false
+func (tracker *ListenerTracker) track(out http.ResponseWriter, in *http.Request, stream string, playlist bool) (http.ResponseWriter, bool) {
+    if tracker == nil {
+        return out, true
+    }
+    address, _, err := net.SplitHostPort(in.RemoteAddr)
+    if err != nil {
+        address = in.RemoteAddr
+    }
+    now := time.Now()
+
+    tracker.locker.Lock()
+    defer tracker.locker.Unlock()
+
+    tracker.expire(now)
+    tracker.measure(now)
+    key := address + " " + stream + " " + in.UserAgent()
+    listener, ok := tracker.listeners[key]
+    if !ok {
+        if ((tracker.MaxListeners > 0) && (len(tracker.listeners) >= tracker.MaxListeners)) ||
+           ((tracker.MaxBytesPerSecond > 0) && (tracker.rate > tracker.MaxBytesPerSecond)) {
+            tracker.refused++
+            log.Printf("Turning away listener %s to stream \"%s\", the server is full (%d listener(s), %d byte(s) per second).\n",
+                       address, stream, len(tracker.listeners), tracker.rate)
+            out.Header().Set("Retry-After", fmt.Sprintf("%d", LISTENER_RETRY_AFTER / time.Second))
+            http.Error(out, "too many listeners, try again later", http.StatusServiceUnavailable)
+            return out, false
+        }
+        listener = &Listener{Address: address, UserAgent: in.UserAgent(), Stream: stream, Joined: now}
+        tracker.listeners[key] = listener
+        tracker.joined++
+        if len(tracker.listeners) > tracker.peak {
+            tracker.peak = len(tracker.listeners)
+            tracker.peakTime = now
+        }
+    }
+    listener.LastSeen = now
+    if playlist {
+        listener.Playlists++
+    } else {
+        listener.Segments++
+    }
+
+    return &ListenerResponseWriter{ResponseWriter: out, tracker: tracker, listener: listener}, true
+}
+
+// Write to a listener, counting the bytes
+func (writer *ListenerResponseWriter) Write(data []byte) (int, error) {
+    length, err := writer.ResponseWriter.Write(data)
+    writer.tracker.locker.Lock()
+    writer.listener.Bytes += int64(length)
+    writer.tracker.bytes += int64(length)
+    writer.tracker.locker.Unlock()
+
+    return length, err
+}
+
+// Return the listeners, the most recent to join first
+func (tracker *ListenerTracker) Listeners() []Listener {
+    var listeners []Listener
+
+    tracker.locker.Lock()
+    tracker.expire(time.Now())
+    for _, listener := range tracker.listeners {
+        listeners = append(listeners, *listener)
+    }
+    tracker.locker.Unlock()
+    sort.Slice(listeners, func(x, y int) bool {
+        return listeners[x].Joined.After(listeners[y].Joined)
+    })
+
+    return listeners
+}
+
+// Return the statistics of the listeners
+func (tracker *ListenerTracker) Stats() interface{} {
+    tracker.locker.Lock()
+    defer tracker.locker.Unlock()
+
+    tracker.expire(time.Now())
+    tracker.measure(time.Now())
+    streams := make(map[string]int)
+    for _, listener := range tracker.listeners {
+        streams[listener.Stream]++
+    }
+
+    return ListenerTrackerStats{Listeners: len(tracker.listeners), Streams: streams, Peak: tracker.peak,
+                                PeakTime: tracker.peakTime, Joined: tracker.joined, Bytes: tracker.bytes,
+                                BytesPerSecond: tracker.rate, Refused: tracker.refused}
+}
+
+/* End Of File */
@@ -0,0 +1,231 @@
+/* Low-latency WebSocket audio output for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "log"
+    "net/http"
+    "sync"
+)
+
+// HLS can't get below a few seconds of latency, since a player needs
+// a whole segment, and usually more, before it plays anything.  For an
+// operator who needs to hear what is happening now the live WebSocket
+// output (see --livews) sends the audio to each listener at
+// LIVE_WS_PATH as it is encoded, every processing tick, as MP3 from an
+// encoder of its own or, with ?format=pcm, as raw PCM.  The first
+// message to a listener is a text one, JSON, describing the audio
+// (format, sampling frequency and number of channels); every message
+// after that is binary, MP3 that can be appended to a MediaSource
+// buffer or little-endian 16-bit PCM with the channels interleaved
+// that can be played through Web Audio.  Each listener has a queue
+// of LIVE_WS_QUEUE_SIZE messages: one that can't keep up is
+// disconnected rather than being allowed to fall behind.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A listener to the live WebSocket output
+type LiveWsListener struct {
+    Pcm     bool
+    socket  *WebSocket
+    queue   chan []byte
+}
+
+// State of the live WebSocket output
+type LiveWs struct {
+    encoder      Encoder
+    audio        bytes.Buffer
+    locker       sync.Mutex
+    listeners    map[*LiveWsListener]bool
+    connected    int
+    disconnected int
+    tooSlow      int
+}
+
+// Statistics of the live WebSocket output
+type LiveWsStats struct {
+    Listeners     int  `json:"listeners"`
+    Connected     int  `json:"connected"`
+    Disconnected  int  `json:"disconnected"`
+    TooSlow       int  `json:"tooSlow"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The path at which the live WebSocket output is served
+const LIVE_WS_PATH string = "/live-ws"
+
+// The number of messages that may be queued for a listener, each
+// being what was encoded in a processing tick
+const LIVE_WS_QUEUE_SIZE int = 50
+
+// The most listeners there may be at once
+const LIVE_WS_MAX_LISTENERS int = 20
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The live WebSocket output, nil if there isn't one
+var liveWs *LiveWs
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create the live WebSocket output, MP3 being encoded with the given
+// settings
+func newLiveWs(settings Mp3Settings) (*LiveWs, error) {
+    var err error
+
+    live := &LiveWs{listeners: make(map[*LiveWsListener]bool)}
+    live.encoder, err = newEncoder(DEFAULT_CODEC, &live.audio, &settings)
+    if err != nil {
+        return nil, err
+    }
+    log.Printf("Live audio will be served over WebSocket at %s.\n", LIVE_WS_PATH)
+
+    return live, nil
+}
+
+// Queue a message for a listener, returning false if it can't keep up
+func (listener *LiveWsListener) put(message []byte) bool {
+    select {
+        case listener.queue <- message:
+            return true
+        default:
+    }
+
+    return false
+}
+
+// Encode some little-endian 16-bit PCM and send it to the listeners
+func (live *LiveWs) Write(pcm []byte) {
+    var mp3 []byte
+
+    live.locker.Lock()
+    defer live.locker.Unlock()
+
+    if len(live.listeners) == 0 {
+        return
+    }
+    _, err := live.encoder.WriteSamples(pcm)
+    if err != nil {
+        log.Printf("Unable to encode live audio (%s).\n", err.Error())
+    }
+    if live.audio.Len() > 0 {
+        mp3 = make([]byte, live.audio.Len())
+        copy(mp3, live.audio.Bytes())
+        live.audio.Reset()
+    }
+    pcmCopy := append([]byte(nil), pcm...)
+    for listener := range live.listeners {
+        message := mp3
+        if listener.Pcm {
+            message = pcmCopy
+        }
+        if (len(message) > 0) && !listener.put(message) {
+            log.Printf("Live WebSocket listener can't keep up, disconnecting it.\n")
+            live.tooSlow++
+            delete(live.listeners, listener)
+            listener.socket.Close()
+        }
+    }
+}
+
+// Serve a listener until it goes
+func (live *LiveWs) serve(out http.ResponseWriter, in *http.Request) {
+    live.locker.Lock()
+    full := len(live.listeners) >= LIVE_WS_MAX_LISTENERS
+    live.locker.Unlock()
+    if full {
+        http.Error(out, "too many listeners", http.StatusServiceUnavailable)
+        return
+    }
+    socket, err := upgradeWebSocket(out, in)
+    if err != nil {
+        log.Printf("Unable to open live WebSocket for %s (%s).\n", in.RemoteAddr, err.Error())
+        return
+    }
+    listener := &LiveWsListener{Pcm: in.URL.Query().Get("format") == "pcm", socket: socket,
+                                queue: make(chan []byte, LIVE_WS_QUEUE_SIZE)}
+    format := DEFAULT_CODEC
+    if listener.Pcm {
+        format = "pcm"
+    }
+    description, _ := json.Marshal(map[string]interface{}{"format": format, "rate": streamSamplingFrequency,
+                                                          "channels": streamChannels})
+    if socket.WriteText(string(description)) != nil {
+        return
+    }
+    log.Printf("Live WebSocket listener %s connected (%s).\n", in.RemoteAddr, format)
+    live.locker.Lock()
+    live.listeners[listener] = true
+    live.connected++
+    live.locker.Unlock()
+
+    for done := false; !done; {
+        select {
+            case message := <-listener.queue:
+                done = socket.WriteBinary(message) != nil
+            case <-socket.Closed():
+                done = true
+        }
+    }
+
+    live.locker.Lock()
+    delete(live.listeners, listener)
+    live.disconnected++
+    live.locker.Unlock()
+    socket.Close()
+    log.Printf("Live WebSocket listener %s disconnected.\n", in.RemoteAddr)
+}
+
+// Disconnect all the listeners and finish with the encoder; the live
+// WebSocket output may not be written to again
+func (live *LiveWs) Close() {
+    live.locker.Lock()
+    defer live.locker.Unlock()
+
+    for listener := range live.listeners {
+        listener.socket.Close()
+        delete(live.listeners, listener)
+    }
+    live.encoder.Close()
+}
+
+// Handle a request for the live WebSocket output
+func liveWsHandler(out http.ResponseWriter, in *http.Request) {
+    if liveWs == nil {
+        http.NotFound(out, in)
+        return
+    }
+    liveWs.serve(out, in)
+}
+
+// Return the statistics of the live WebSocket output
+func (live *LiveWs) Stats() interface{} {
+    live.locker.Lock()
+    defer live.locker.Unlock()
+
+    return LiveWsStats{Listeners: len(live.listeners), Connected: live.connected,
+                       Disconnected: live.disconnected, TooSlow: live.tooSlow}
+}
+
+/* End Of File */
@@ -0,0 +1,265 @@
+/* Listener load test for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math/rand"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The load test runs a number of synthetic HLS listeners against this
+// server, each behaving like a player: it polls the playlist once per
+// target duration and fetches every segment it hasn't seen before.
+// The throughput achieved and the errors encountered are reported
+// periodically so that an operator can find out how many real
+// listeners their uplink and hardware will support.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The results of a load test so far
+type LoadTestStats struct {
+    locker            sync.Mutex
+    PlaylistRequests  int
+    SegmentRequests   int
+    Errors            int
+    LateSegments      int
+    Bytes             int64
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How often to report on a load test
+const LOAD_TEST_REPORT_PERIOD time.Duration = time.Second * 10
+
+// The playlist polling period to use if the playlist doesn't
+// give a target duration
+const LOAD_TEST_DEFAULT_POLL_PERIOD time.Duration = time.Second
+
+// How long to wait for the HTTP server to start before beginning
+const LOAD_TEST_START_DELAY time.Duration = time.Second * 2
+
+// How long a synthetic listener waits for a response
+const LOAD_TEST_HTTP_TIMEOUT time.Duration = time.Second * 10
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Note the outcome of a request
+func (stats *LoadTestStats) add(segment bool, numBytes int64, err error, late bool) {
+    stats.locker.Lock()
+    if segment {
+        stats.SegmentRequests++
+    } else {
+        stats.PlaylistRequests++
+    }
+    stats.Bytes += numBytes
+    if err != nil {
+        stats.Errors++
+    }
+    if late {
+        stats.LateSegments++
+    }
+    stats.locker.Unlock()
+}
+
+// Report on a load test
+func (stats *LoadTestStats) report(numListeners int, elapsed time.Duration) {
+    stats.locker.Lock()
+    requests := stats.PlaylistRequests + stats.SegmentRequests
+    errorPercent := float64(0)
+    if requests > 0 {
+        errorPercent = float64(stats.Errors) * 100 / float64(requests)
+    }
+    kbitsPerSecond := float64(stats.Bytes) * 8 / 1000 / elapsed.Seconds()
+    report := fmt.Sprintf("Load test, %d listener(s), %d s: %d playlist and %d segment request(s), %d error(s) (%.1f%%), %d late segment(s), %.1f kbits/s (%.1f kbits/s per listener).\n",
+                          numListeners, int(elapsed / time.Second), stats.PlaylistRequests, stats.SegmentRequests, stats.Errors, errorPercent,
+                          stats.LateSegments, kbitsPerSecond, kbitsPerSecond / float64(numListeners))
+    stats.locker.Unlock()
+    fmt.Print(report)
+    log.Print(report)
+}
+
+// GET a URL, returning the body if wanted and the number of bytes read
+func loadTestGet(client *http.Client, address string, keepBody bool) ([]byte, int64, error) {
+    var body []byte
+    var numBytes int64
+
+    response, err := client.Get(address)
+    if err == nil {
+        if response.StatusCode == http.StatusOK {
+            if keepBody {
+                body, err = io.ReadAll(response.Body)
+                numBytes = int64(len(body))
+            } else {
+                numBytes, err = io.Copy(io.Discard, response.Body)
+            }
+        } else {
+            err = errors.New(fmt.Sprintf("%s returned %s", address, response.Status))
+        }
+        response.Body.Close()
+    }
+
+    return body, numBytes, err
+}
+
+// Parse a playlist, returning the segment URIs and the target duration
+func parseLoadTestPlaylist(playlist []byte) ([]string, time.Duration) {
+    var segments []string
+    targetDuration := LOAD_TEST_DEFAULT_POLL_PERIOD
+
+    scanner := bufio.NewScanner(strings.NewReader(string(playlist)))
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if strings.HasPrefix(line, "#EXT-X-TARGETDURATION:") {
+            seconds, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"))
+            if (err == nil) && (seconds > 0) {
+                targetDuration = time.Duration(seconds) * time.Second
+            }
+        } else if (line != "") && !strings.HasPrefix(line, "#") {
+            segments = append(segments, line)
+        }
+    }
+
+    return segments, targetDuration
+}
+
+// Run a single synthetic listener until ctx is done
+func loadTestListener(ctx context.Context, playlistUrl *url.URL, stats *LoadTestStats) {
+    client := &http.Client{Timeout: LOAD_TEST_HTTP_TIMEOUT}
+    if playlistUrl.Scheme == "https" {
+        // The certificate won't be for the address being talked to
+        client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+    }
+    fetched := make(map[string]bool)
+    pollPeriod := LOAD_TEST_DEFAULT_POLL_PERIOD
+
+    // Don't all start at once
+    select {
+        case <-ctx.Done():
+            return
+        case <-time.After(time.Duration(rand.Int63n(int64(pollPeriod)))):
+    }
+
+    for ctx.Err() == nil {
+        polled := time.Now()
+        playlist, numBytes, err := loadTestGet(client, playlistUrl.String(), true)
+        stats.add(false, numBytes, err, false)
+        if err == nil {
+            var segments []string
+            segments, pollPeriod = parseLoadTestPlaylist(playlist)
+            current := make(map[string]bool)
+            for _, segment := range segments {
+                current[segment] = true
+                if !fetched[segment] && (ctx.Err() == nil) {
+                    segmentUrl, err1 := playlistUrl.Parse(segment)
+                    if err1 == nil {
+                        started := time.Now()
+                        _, numBytes, err1 = loadTestGet(client, segmentUrl.String(), false)
+                        // A segment that takes longer than a target duration to
+                        // arrive would leave a real player short of audio
+                        stats.add(true, numBytes, err1, time.Since(started) > pollPeriod)
+                    } else {
+                        stats.add(true, 0, err1, false)
+                    }
+                    fetched[segment] = true
+                }
+            }
+            // Forget segments that have left the playlist
+            for segment := range fetched {
+                if !current[segment] {
+                    delete(fetched, segment)
+                }
+            }
+        }
+        select {
+            case <-ctx.Done():
+            case <-time.After(pollPeriod - time.Since(polled)):
+        }
+    }
+}
+
+// Run a load test of numListeners synthetic listeners for the given
+// duration against the playlist served on port at playlistPath,
+// reporting as it goes
+func operateLoadTest(ctx context.Context, bindAddresses []string, port string, playlistPath string,
+                     numListeners uint, duration time.Duration) {
+    var waitGroup sync.WaitGroup
+    var stats LoadTestStats
+
+    // Talk to the first address we are listening on, or to ourselves
+    host := "localhost"
+    if len(bindAddresses) > 0 {
+        ip := net.ParseIP(strings.Trim(bindAddresses[0], "[]"))
+        if (ip == nil) || !ip.IsUnspecified() {
+            host = strings.Trim(bindAddresses[0], "[]")
+        }
+    }
+    playlistUrl := &url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: playlistPath}
+    if httpsOut != nil {
+        playlistUrl.Scheme = "https"
+    }
+    if urlSecret != nil {
+        // Sign the URL, with time to spare for the start delay
+        playlistUrl.RawQuery, _, _ = signUrlQuery(urlSecret, duration + LOAD_TEST_START_DELAY * 2)
+    }
+
+    select {
+        case <-ctx.Done():
+            return
+        case <-time.After(LOAD_TEST_START_DELAY):
+    }
+    fmt.Printf("Load test: %d listener(s) for %d s against %s.\n", numListeners, int(duration / time.Second), playlistUrl.String())
+    testCtx, cancel := context.WithTimeout(ctx, duration)
+    started := time.Now()
+    for x := uint(0); x < numListeners; x++ {
+        waitGroup.Add(1)
+        go func() {
+            loadTestListener(testCtx, playlistUrl, &stats)
+            waitGroup.Done()
+        }()
+    }
+
+    reportTicker := time.NewTicker(LOAD_TEST_REPORT_PERIOD)
+    for testCtx.Err() == nil {
+        select {
+            case <-testCtx.Done():
+            case <-reportTicker.C:
+                stats.report(int(numListeners), time.Since(started))
+        }
+    }
+    reportTicker.Stop()
+    waitGroup.Wait()
+    cancel()
+    fmt.Printf("Load test finished.\n")
+    stats.report(int(numListeners), time.Since(started))
+}
+
+/* End Of File */
@@ -0,0 +1,180 @@
+/* Log file rotation for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// A server that runs for months would otherwise fill the disk with
+// its log file, so the log file may be rotated: once it is bigger
+// than --logmaxsize or older than --logmaxage it is renamed, the UTC
+// time of the rotation being inserted before the extension of its
+// name, as for WAV files, and a new one is started; only the newest
+// --logkeep rotated files are kept.  When the log file is rotated it
+// is appended to, rather than truncated, when the server starts, so
+// that a restart doesn't lose what went before.  The log file is
+// written through the log package, which holds its lock while writing,
+// so problems with the log file itself are reported on stderr rather
+// than logged.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A log file that is rotated
+type LogFile struct {
+    Name      string
+    // The size and age beyond which the file is rotated, 0 for no limit
+    MaxBytes  int64
+    MaxAge    time.Duration
+    // The number of rotated files to keep, 0 to keep them all
+    Keep      int
+    locker    sync.Mutex
+    handle    *os.File
+    bytes     int64
+    opened    time.Time
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Open the log file fileName, rotating it once it is bigger than
+// maxBytes or older than maxAge (0 for no limit), keeping keep of the
+// rotated files (0 for all of them); without a limit the file is
+// truncated, else it is appended to
+func newLogFile(fileName string, maxBytes int64, maxAge time.Duration, keep int) (*LogFile, error) {
+    logFile := &LogFile{Name: fileName, MaxBytes: maxBytes, MaxAge: maxAge, Keep: keep}
+    err := logFile.open()
+    if err != nil {
+        return nil, err
+    }
+
+    return logFile, nil
+}
+
+// Return true if the log file is rotated
+func (logFile *LogFile) rotates() bool {
+    return (logFile.MaxBytes > 0) || (logFile.MaxAge > 0)
+}
+
+// Open the log file; the log file must be locked
+func (logFile *LogFile) open() error {
+    flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+    if logFile.rotates() {
+        flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+    }
+    handle, err := os.OpenFile(logFile.Name, flags, 0644)
+    if err != nil {
+        return err
+    }
+    logFile.handle = handle
+    logFile.bytes = 0
+    logFile.opened = time.Now()
+    if info, err := handle.Stat(); err == nil {
+        logFile.bytes = info.Size()
+    }
+
+    return nil
+}
+
+// Return the name of a rotated log file, given the time of rotation
+func (logFile *LogFile) rotatedName(now time.Time) string {
+    extension := filepath.Ext(logFile.Name)
+
+    return strings.TrimSuffix(logFile.Name, extension) + "-" + now.UTC().Format(ARCHIVE_FILE_NAME_FORMAT) + extension
+}
+
+// Return the names of the rotated log files, oldest first
+func (logFile *LogFile) rotatedNames() []string {
+    var names []string
+
+    extension := filepath.Ext(logFile.Name)
+    prefix := strings.TrimSuffix(logFile.Name, extension) + "-"
+    matches, _ := filepath.Glob(prefix + "*" + extension)
+    for _, name := range matches {
+        _, err := time.Parse(ARCHIVE_FILE_NAME_FORMAT, strings.TrimSuffix(strings.TrimPrefix(name, prefix), extension))
+        if err == nil {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+
+    return names
+}
+
+// Rename the log file, start a new one and delete the rotated files
+// beyond those to keep; the log file must be locked
+func (logFile *LogFile) rotate(now time.Time) {
+    logFile.handle.Close()
+    logFile.handle = nil
+    err := os.Rename(logFile.Name, logFile.rotatedName(now))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Unable to rotate log file \"%s\" (%s).\n", logFile.Name, err.Error())
+    }
+    err = logFile.open()
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Unable to open log file \"%s\" (%s), logging has stopped.\n", logFile.Name, err.Error())
+    }
+    if logFile.Keep > 0 {
+        names := logFile.rotatedNames()
+        for len(names) > logFile.Keep {
+            err = os.Remove(names[0])
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to delete old log file \"%s\" (%s).\n", names[0], err.Error())
+            }
+            names = names[1:]
+        }
+    }
+}
+
+// Write to the log file, rotating it first if it is time to
+func (logFile *LogFile) Write(data []byte) (int, error) {
+    logFile.locker.Lock()
+    defer logFile.locker.Unlock()
+
+    now := time.Now()
+    if (logFile.handle != nil) && (logFile.bytes > 0) &&
+       (((logFile.MaxBytes > 0) && (logFile.bytes + int64(len(data)) > logFile.MaxBytes)) ||
+        ((logFile.MaxAge > 0) && (now.Sub(logFile.opened) >= logFile.MaxAge))) {
+        logFile.rotate(now)
+    }
+    if logFile.handle == nil {
+        // Logging has stopped: don't fail whatever is logging
+        return len(data), nil
+    }
+    length, err := logFile.handle.Write(data)
+    logFile.bytes += int64(length)
+
+    return length, err
+}
+
+// Close the log file
+func (logFile *LogFile) Close() {
+    logFile.locker.Lock()
+    defer logFile.locker.Unlock()
+
+    if logFile.handle != nil {
+        logFile.handle.Close()
+        logFile.handle = nil
+    }
+}
+
+/* End Of File */
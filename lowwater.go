@@ -0,0 +1,143 @@
+/* Output buffer low-water mark for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// The low-water mark is the depth of the HLS output buffer which it
+// should never get below: as the buffer heads towards it the audio is
+// slowed down, more so the nearer it gets, and if it gets below it
+// anyway that is an underrun and comfort noise may be added (see the
+// handling of OutputBufferState in audio-process.go).  It is never
+// more than half the length of the playlist.  In adaptive mode, if
+// LOW_WATER_UNDERRUNS underruns happen within LOW_WATER_WINDOW the
+// mark is raised by LOW_WATER_STEP, so that the slowing down starts
+// sooner and harder, and once there have been no underruns for
+// LOW_WATER_RELAX it is lowered by a step again, never below where it
+// started.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of the low-water mark
+type LowWaterMark struct {
+    Configured    time.Duration
+    Adaptive      bool
+    current       time.Duration
+    underruns     []time.Time
+    total         int
+    lastUnderrun  time.Time
+    changed       time.Time
+    locker        sync.Mutex
+}
+
+// Statistics of the low-water mark
+type LowWaterMarkStats struct {
+    LowWaterMs  int64  `json:"lowWaterMs"`
+    Adaptive    bool   `json:"adaptive"`
+    Underruns   int    `json:"underruns"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The default low-water mark in milliseconds
+const LOW_WATER_DEFAULT_MILLISECONDS uint = 1000
+
+// The number of underruns within LOW_WATER_WINDOW that raises the
+// low-water mark in adaptive mode
+const LOW_WATER_UNDERRUNS int = 3
+const LOW_WATER_WINDOW time.Duration = time.Minute * 5
+
+// How much the low-water mark is raised or lowered by at a time
+const LOW_WATER_STEP time.Duration = time.Millisecond * 500
+
+// How long without an underrun before the low-water mark is lowered
+const LOW_WATER_RELAX time.Duration = time.Minute * 30
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a low-water mark of the given number of milliseconds, which
+// is raised when underruns keep happening if adaptive is true
+func newLowWaterMark(milliseconds uint, adaptive bool) *LowWaterMark {
+    configured := time.Duration(milliseconds) * time.Millisecond
+
+    return &LowWaterMark{Configured: configured, Adaptive: adaptive,
+                         current: configured, changed: time.Now()}
+}
+
+// Update the low-water mark with the state of the output buffer,
+// returning the low-water mark to use
+func (mark *LowWaterMark) Update(state *OutputBufferState, now time.Time) time.Duration {
+    mark.locker.Lock()
+    defer mark.locker.Unlock()
+
+    if state.Buffered < mark.limit(state.BufferSize) {
+        mark.total++
+        mark.underruns = append(mark.underruns, now)
+        mark.lastUnderrun = now
+    }
+    for (len(mark.underruns) > 0) && (now.Sub(mark.underruns[0]) > LOW_WATER_WINDOW) {
+        mark.underruns = mark.underruns[1:]
+    }
+    if mark.Adaptive {
+        if len(mark.underruns) >= LOW_WATER_UNDERRUNS {
+            if mark.current + LOW_WATER_STEP <= state.BufferSize / 2 {
+                mark.current += LOW_WATER_STEP
+                log.Printf("%d output buffer underruns in %d minute(s), low-water mark raised to %d ms.\n",
+                           len(mark.underruns), LOW_WATER_WINDOW / time.Minute, mark.current / time.Millisecond)
+            }
+            mark.underruns = mark.underruns[:0]
+            mark.changed = now
+        } else if (mark.current > mark.Configured) && (now.Sub(mark.changed) > LOW_WATER_RELAX) &&
+                  (now.Sub(mark.lastUnderrun) > LOW_WATER_RELAX) {
+            mark.current -= LOW_WATER_STEP
+            if mark.current < mark.Configured {
+                mark.current = mark.Configured
+            }
+            log.Printf("No output buffer underruns for %d minute(s), low-water mark lowered to %d ms.\n",
+                       LOW_WATER_RELAX / time.Minute, mark.current / time.Millisecond)
+            mark.changed = now
+        }
+    }
+
+    return mark.limit(state.BufferSize)
+}
+
+// Return the low-water mark for an output buffer of the given size
+func (mark *LowWaterMark) limit(bufferSize time.Duration) time.Duration {
+    if mark.current > bufferSize / 2 {
+        return bufferSize / 2
+    }
+
+    return mark.current
+}
+
+// Return the statistics of the low-water mark
+func (mark *LowWaterMark) Stats() interface{} {
+    mark.locker.Lock()
+    defer mark.locker.Unlock()
+
+    return LowWaterMarkStats{LowWaterMs: int64(mark.current / time.Millisecond),
+                             Adaptive: mark.Adaptive, Underruns: mark.total}
+}
+
+/* End Of File */
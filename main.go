@@ -13,11 +13,15 @@
 package main
 
 import (
+    "context"
     "fmt"
     "os"
+    "os/signal"
     "log"
     "path/filepath"
     "strings"
+    "syscall"
+    "time"
     "github.com/jessevdk/go-flags"
 //    "encoding/hex"
 )
@@ -34,64 +38,268 @@ import (
 // Constants
 //--------------------------------------------------------------------
 
+// The version of this server, reported to clients
+const SERVER_VERSION string = "1.1.0"
+
 // The extension of an HLS playlist file
 const PLAYLIST_EXTENSION string = ".m3u8"
 
-// The extension used for audio segment files
+// The extension used for MP3 segment files
 const SEGMENT_EXTENSION string = ".ts"
 
+// The subcommand that is run if none is given
+const SUBCOMMAND_SERVE string = "serve"
+
 //--------------------------------------------------------------------
 // Variables
 //--------------------------------------------------------------------
 
-// Command-line items
+// The subcommands, by name
+var subcommands = map[string]func(args []string) {
+    SUBCOMMAND_SERVE: serve,
+    "replay": replay,
+    "bench": bench,
+    "probe": probe,
+}
+
+// Command-line items of the serve subcommand
 var opts struct {
     Required struct {
         In string `positional-arg-name:"input-port" description:"the input port for incoming raw PCM chuffs"`
         Out string `positional-arg-name:"output-port" description:"the output port for HTTP service"`
         PlaylistPath string `positional-arg-name:"playlistpath" description:"path to the live playlist file (any file extension will be replaced with .m3u8); the playlist file will be created by this program and the audio files will be stored in the same directory as the playlist file.  The HTML file that serves the playlist file should be placed in this directory."`
     } `positional-args:"true" required:"yes"`
-    SegmentFileDurationMs uint `default:"1000" short:"s" long:"segment" description:"the duration of each HLS segment file in milliseconds"`
+    ConfigFile string `short:"c" long:"config" no-ini:"true" description:"a TOML config file, each setting named as its long option (see --writeconfig), from which to load settings; settings given on the command line override it"`
+    WriteConfigFile string `long:"writeconfig" no-ini:"true" description:"write the settings, as given on the command line and in any --config file, with all the defaults and descriptions, to this config file and exit"`
+    InBindAddresses []string `long:"inbind" description:"an address (e.g. 0.0.0.0 or ::1) on which to listen for incoming audio (may be given more than once, defaults to all interfaces, v4 and v6)"`
+    OutBindAddresses []string `long:"outbind" description:"an address (e.g. 0.0.0.0 or ::1) on which to listen for HTTP requests (may be given more than once, defaults to all interfaces, v4 and v6)"`
+    SegmentFileDurationMs uint `default:"1000" short:"s" long:"segment" description:"the duration of each HLS segment file in milliseconds (100 to 10000, may be changed through the admin API while running)"`
+    LatencyTargetMs uint `long:"latencytarget" description:"tune the segment duration automatically, shortening segments while the estimated end-to-end latency is above this many milliseconds and lengthening them when listeners keep running dry (0 to disable)"`
+    SegmentMinMs uint `default:"500" long:"segmentmin" description:"the shortest segment duration in milliseconds that --latencytarget will go to"`
+    SegmentMaxMs uint `default:"4000" long:"segmentmax" description:"the longest segment duration in milliseconds that --latencytarget will go to"`
+    MemorySegments bool `long:"memsegments" description:"keep segment files in memory, serving them from there, rather than on disk (e.g. to save the SD card of a Raspberry Pi from wear); with --segmentstore s3, keep them in memory until they are uploaded"`
+    SegmentStore string `default:"disk" long:"segmentstore" choice:"disk" choice:"memory" choice:"s3" description:"where to keep segment files: disk, memory (the same as --memsegments) or s3, uploading them to an S3-compatible object store (e.g. AWS S3 or Google Cloud Storage) from where a CDN serves them"`
+    S3Endpoint string `long:"s3endpoint" description:"the URL of the S3-compatible object store for --segmentstore s3 (e.g. https://s3.eu-west-2.amazonaws.com or https://storage.googleapis.com)"`
+    S3Bucket string `long:"s3bucket" description:"the bucket to which --segmentstore s3 uploads segment files"`
+    S3Region string `default:"us-east-1" long:"s3region" description:"the region of the --s3bucket (auto for Google Cloud Storage)"`
+    S3Prefix string `long:"s3prefix" description:"a prefix (e.g. chuffs/) for the keys of segment files in the --s3bucket"`
+    S3AccessKey string `long:"s3accesskey" description:"the access key (HMAC key for Google Cloud Storage) with which --segmentstore s3 signs requests"`
+    S3SecretKey string `long:"s3secretkey" description:"the secret key with which --segmentstore s3 signs requests"`
+    CdnUrl string `long:"cdnurl" description:"the URL of the CDN in front of the --s3bucket, to which playlists refer for uploaded segment files (defaults to the bucket at --s3endpoint)"`
     PlaylistLengthSeconds uint `default:"7" short:"p" long:"playlist" description:"the maximum duration of the HLS playlist in seconds"`
+    DvrMinutes uint `long:"dvr" description:"keep this many minutes of segments in the playlist, as an EVENT playlist, so that listeners can pause and rewind the live stream (0 for just the --playlist sliding window)"`
+    ExtinfDecimalPlaces uint `default:"6" long:"extinfdecimals" description:"the number of decimal places to use for durations in playlists"`
+    PlaylistLf bool `long:"lf" description:"end lines in playlists with LF rather than CRLF"`
+    AllowCache string `long:"allowcache" choice:"YES" choice:"NO" description:"include an EXT-X-ALLOW-CACHE tag with this value in playlists"`
+    Codec string `default:"mp3" long:"codec" description:"the codec with which to encode the HLS stream"`
+    Fmp4 bool `long:"fmp4" description:"package the HLS stream as fragmented MP4 (CMAF) segments, with an EXT-X-MAP initialisation segment, rather than as raw segments (mp3 or aac only)"`
+    Bitrate uint `long:"bitrate" description:"the bitrate in kbits/s with which to encode the HLS stream (0 for the encoder default)"`
+    Scale float32 `long:"scale" description:"the gain applied to the audio before it is encoded (0 for the default)"`
+    LowPassHz int `long:"lowpass" description:"the MP3 low pass filter frequency in Hz (0 for the LAME default, -1 to disable)"`
+    HighPassHz int `long:"highpass" description:"the MP3 high pass filter frequency in Hz (0 for the LAME default, -1 to disable)"`
+    Mp3Quality int `default:"-1" long:"mp3quality" description:"the LAME quality, 0 (best, slowest) to 9 (worst, fastest) (-1 for the LAME default)"`
     OOSTimeSeconds uint `default:"300" short:"o" long:"oostime" description:"the number of seconds of inactivity after which to assume that we are out of service and reset the stream"`
-    LogName string `short:"l" long:"logfile" description:"file for logging output (will be truncated if it already exists)"`
-    RawPcmName string `short:"r" long:"rawpcmfile" description:"file for 16 bit PCM output (will be truncated if it already exists); format is little-endian 16-bit signed PCM, mono, 16000 Hz"`
+    SamplingFrequency int `default:"16000" long:"rate" description:"the sampling frequency in Hz of the stream, to which incoming audio at any other sampling frequency is resampled (8000 to 48000; 8000, 12000, 16000, 24000 or 48000 if any encoder is Opus)"`
+    Channels int `default:"1" long:"channels" description:"the number of channels of the stream, 1 or 2, to which incoming audio with any other number of channels is mixed (e.g. 2 for a client with a microphone in the cab and another lineside)"`
+    PcmBufferSeconds uint `default:"60" long:"pcmbuffer" description:"the number of seconds of audio that may build up waiting to be encoded, beyond which the oldest is dropped"`
+    MaxGapFillMs uint `default:"500" long:"maxgapfill" description:"the longest gap in the incoming audio, in milliseconds, that is filled; anything longer is taken to be silly (e.g. the client has restarted) and is ignored"`
+    LowWaterMs uint `default:"1000" long:"lowwater" description:"the number of milliseconds of audio below which the HLS output buffer should never get: the audio is slowed down as it heads there and, if it gets there, comfort noise is added (at most half the playlist length)"`
+    AdaptiveLowWater bool `long:"adaptivelowwater" description:"raise the --lowwater mark automatically when the output buffer keeps getting below it, lowering it again once things have settled down"`
+    ReorderTolerance uint `default:"0" short:"t" long:"reorder" description:"the number of 20 ms blocks to wait for a missing datagram to turn up out of order before treating it as lost"`
+    SerialPath string `long:"serial" description:"a serial device (e.g. /dev/ttyAMA0) from which to read a stream of URTP, as it would arrive over TCP, from directly attached capture hardware (Linux only)"`
+    SerialBaudRate uint `default:"115200" long:"serialbaud" description:"the baud rate of the --serial device"`
+    UdpSockets uint `default:"1" long:"udpsockets" description:"the number of UDP sockets (and reader go routines) to open on the input port; more than one uses SO_REUSEPORT (Linux only)"`
+    TcpIdleSeconds uint `default:"30" long:"tcpidle" description:"the number of seconds without data after which a TCP client is assumed to have gone and its connection is closed (0 to wait forever)"`
+    TcpPolicy string `default:"takeover" long:"tcppolicy" choice:"takeover" choice:"reject" choice:"sameip" description:"what to do when a TCP client connects while another is connected: takeover (close the existing connection), reject (refuse the new connection) or sameip (take over only if the new connection is from the same IP address)"`
+    Streams []string `long:"stream" description:"a further stream, given as <name>=<port>, fed by URTP over UDP on that port, its playlist being written as <name>.m3u8 alongside the main one and served at /stream/<name>/playlist.m3u8; may be given more than once"`
+    Mix bool `long:"mix" description:"mix the audio of all the clients streaming at the same time (e.g. one in the cab and one on the platform) into the stream, rather than taking one client at a time; every TCP connection is kept, whatever the --tcppolicy"`
+    MixGains []string `long:"mixgain" description:"the gain in dB, -60 to 20, applied to the audio of a client when mixing, as <client>=<dB> where <client> is the IP address of the client or the --serial device (may be given more than once, may be changed through the admin API while running)"`
+    UdpMaxDatagrams uint `long:"udpmaxdatagrams" description:"the maximum number of UDP datagrams per second accepted from any one source (0 for no limit)"`
+    UdpMaxBytes uint `long:"udpmaxbytes" description:"the maximum number of bytes per second of UDP datagrams accepted from any one source (0 for no limit)"`
+    TcpMaxConnections uint `long:"tcpmaxconnections" description:"the maximum number of TCP connections per minute accepted from any one source (0 for no limit)"`
+    Nack bool `short:"n" long:"nack" description:"send NACK datagrams back to the client listing missing sequence numbers so that it can retransmit them over TCP; use with -t so that there is time for them to arrive"`
+    Fec bool `long:"fec" description:"accept URTP datagrams over UDP protected by Reed-Solomon forward error correction, with interleaving, from clients that support it, so that bursts of lost datagrams can be recovered"`
+    AdaptCoding bool `long:"adaptcoding" description:"measure loss and throughput from the client and advise it to switch between PCM and UNICAM audio coding to suit conditions"`
+    CatchUpMs uint `long:"catchup" description:"enable catch-up mode: output is paced at real time and, if more than this many milliseconds of audio builds up (e.g. after a stall), it is played slightly fast, without changing pitch, until the backlog has halved (0 to disable)"`
+    CatchUpSpeedPercent uint `default:"5" long:"catchupspeed" description:"how much faster than real time, in percent, to play audio in catch-up mode"`
+    Drift bool `long:"drift" description:"estimate the drift between the client's sample clock and the server's clock from the URTP timestamps and drop or add the odd sample to keep the PCM buffer depth stable"`
+    LadderBitrates []uint `long:"ladder" description:"also encode the stream at this bitrate in kbits/s, publishing it to a playlist of its own and listing it in a master playlist so that players can pick the bitrate that suits their connection (may be given more than once, requires --bitrate)"`
+    ShadowName string `long:"shadow" description:"run a shadow encoder with the --shadow* settings on the same audio, publishing to a playlist of this name (no extension) in the playlist directory, so that new settings can be auditioned before they go live"`
+    ShadowBitrate uint `long:"shadowbitrate" description:"the MP3 bitrate in kbits/s for the shadow encoder (0 for the LAME default)"`
+    ShadowScale float32 `long:"shadowscale" description:"the gain applied by the shadow encoder (0 for the default)"`
+    ShadowLowPassHz int `long:"shadowlowpass" description:"the low pass filter frequency in Hz for the shadow encoder (0 for the LAME default, -1 to disable)"`
+    ShadowHighPassHz int `long:"shadowhighpass" description:"the high pass filter frequency in Hz for the shadow encoder (0 for the LAME default, -1 to disable)"`
+    ArchiveDir string `long:"archive" description:"a directory in which to keep a continuous archive of the audio, in files that each cover an hour and are named after the UTC time at which they start"`
+    ArchiveCodec string `default:"mp3" long:"archivecodec" description:"the codec with which to encode the --archive files"`
+    ArchiveMaxAgeHours uint `long:"archivemaxage" description:"the number of hours after which --archive files are deleted (0 for no limit)"`
+    ArchiveMaxMegabytes uint `long:"archivemaxsize" description:"the maximum number of megabytes of --archive files, the oldest being deleted to stay within it (0 for no limit)"`
+    IcecastServer string `long:"icecast" description:"an Icecast server, as host:port, to which to push the stream as MP3, in parallel with HLS, so that internet radio apps can play it"`
+    IcecastMount string `default:"/chuffs" long:"icecastmount" description:"the mount on the --icecast server to push to"`
+    IcecastPassword string `long:"icecastpassword" description:"the source password of the --icecast server"`
+    IcecastBitrate uint `long:"icecastbitrate" description:"the MP3 bitrate in kbits/s of the stream pushed to the --icecast server (0 for the LAME default)"`
+    LiveWs bool `long:"livews" description:"serve the audio at /live-ws over WebSocket as it is encoded, as MP3 or, with ?format=pcm, raw PCM, for monitoring with about a second of latency rather than the several seconds of HLS"`
+    Webhooks []string `long:"webhook" description:"a URL to which to POST events (see --webhookevents) as JSON, e.g. so that the operator gets a ping on their phone when the chuffs stop (may be given more than once)"`
+    WebhookEvents string `default:"client_connected,client_disconnected,reset,out_of_service,in_service,disk_space" long:"webhookevents" description:"the comma-separated events that are POSTed to the --webhook URLs"`
+    WebhookSecretFile string `long:"webhooksecret" description:"a file containing a secret (at least 16 characters) with which to sign what is POSTed to the --webhook URLs"`
+    DiskWarnPercent uint `default:"10" long:"diskwarn" description:"publish a disk_space event when less than this percentage of the disk is free for the segment files or the --logfile (0 to disable, Linux only)"`
+    JournalName string `long:"journal" description:"a file to which to append, as JSON lines, the events that tell the story of a session (connections, disconnections, resets, gaps, underruns, segments produced and so on), queried with GET /admin/journal"`
+    JournalKeepDays uint `default:"30" long:"journalkeep" description:"the number of days of --journal to keep, the journal being rotated daily (0 to keep them all)"`
+    StatsHistoryMinutes uint `long:"statshistory" description:"serve a JSON snapshot of the ingest, pipeline and output statistics at /api/stats, along with a history of them over this many minutes, sampled every 10 seconds, so that a dashboard can graph loss and buffer depth (0 to disable)"`
+    Sse bool `long:"sse" description:"serve the events of the pipeline (client connected, reset, segment, underrun and so on) as server-sent events at /events so that web pages and monitors can react to them as they happen"`
+    Whep bool `long:"whep" description:"serve the audio over WebRTC, as Opus, to players that connect with WHEP at /whep, for listeners who want less than a second of latency (needs an Opus --rate)"`
+    WhepStunServers []string `long:"whepstun" description:"a STUN server, e.g. stun:stun.l.google.com:19302, through which --whep finds the public address of the server (may be given more than once)"`
+    ChuffDir string `long:"chuffs" description:"a directory in which to save a clip of the audio around each burst of chuffing detected, named after the UTC time at which it starts"`
+    ChuffOnsetDb float64 `default:"12" long:"chuffonset" description:"how far, in dB, the level must rise above the background level for a burst of chuffing to be detected"`
+    ChuffMaxClips uint `default:"100" long:"chuffsmax" description:"the number of --chuffs clips to keep, the oldest being deleted (0 for no limit)"`
+    WatchdogSeconds uint `default:"10" long:"watchdog" description:"the number of seconds for which the processing of the stream may make no progress (e.g. the encoder has wedged or the disk has filled up) before the encoder and segment files, or the whole processing loop, are restarted (0 to disable)"`
+    IngestQuota uint `long:"ingestquota" description:"the maximum number of bytes per second of incoming audio that will be accepted for the stream (0 for no limit)"`
+    DiskQuotaMegabytes uint `long:"diskquota" description:"the maximum number of megabytes of segment files that the stream may occupy on disk (0 for no limit)"`
+    CpuQuotaPercent uint `long:"cpuquota" description:"the maximum percentage of one CPU that the stream may use for decoding, processing and encoding, measured as the elapsed time of those steps, before incoming audio is shed (0 for no limit)"`
+    DspConfigName string `long:"dspconfig" description:"a JSON file describing the chain of filter stages to apply to decoded UNICAM audio, replacing the built-in deemphasis and desqueal filters"`
+    NoDeemphasis bool `long:"nodeemphasis" description:"remove the deemphasis filter from the DSP chain"`
+    NoDesqueal bool `long:"nodesqueal" description:"remove the notch filter for Hologram Nova modem squeal from the DSP chain"`
+    Denoise bool `long:"denoise" description:"reduce steady noise, e.g. hiss, in the decoded audio by spectral subtraction, the spectrum of the noise being learned from the quiet parts of the audio"`
+    DenoiseStrength float64 `default:"2" long:"denoisestrength" description:"how many times the learned noise spectrum --denoise subtracts"`
+    DenoiseFloorDb float64 `default:"-20" long:"denoisefloor" description:"the most, in dB, that --denoise takes any part of the spectrum down by"`
+    Gate bool `long:"gate" description:"silence the decoded audio while its level stays below --gatethreshold, e.g. overnight when there is nothing but hiss and wind"`
+    GateThresholdDbfs float64 `default:"-50" long:"gatethreshold" description:"the level in dBFS below which --gate silences the audio"`
+    GateHoldMs uint `default:"1000" long:"gatehold" description:"how long, in milliseconds, the level must stay below --gatethreshold before --gate silences the audio"`
+    Agc bool `long:"agc" description:"apply automatic gain control to the decoded audio, so that quiet and loud audio both come out at a listenable level"`
+    AgcTargetDbfs float64 `default:"-24" long:"agctarget" description:"the level in dBFS to which --agc brings the envelope of the audio, before the gain applied by the encoder"`
+    AgcMaxGainDb float64 `default:"30" long:"agcmaxgain" description:"the most gain in dB that --agc will apply"`
+    AgcAttackMs uint `default:"10" long:"agcattack" description:"how quickly, in milliseconds, --agc turns the gain down when the audio gets louder"`
+    AgcReleaseMs uint `default:"2000" long:"agcrelease" description:"how quickly, in milliseconds, --agc turns the gain up when the audio gets quieter"`
+    DspAll bool `long:"dspall" description:"apply the DSP chain to audio of all coding schemes, not just UNICAM"`
+    Scripts []string `long:"script" description:"a Lua script to run against pipeline events (may be given more than once)"`
+    AdminPort string `long:"adminport" description:"the port on which to serve the admin API (requires --adminsecret)"`
+    AdminBindAddresses []string `long:"adminbind" description:"an address on which to listen for admin API requests (may be given more than once, defaults to all interfaces, v4 and v6)"`
+    AdminSecretFile string `long:"adminsecret" description:"a file containing the secret (at least 16 characters) that admin API tokens are signed with"`
+    Pprof bool `long:"pprof" description:"serve the Go profiles of the server (see net/http/pprof), e.g. of CPU and allocations, through the admin API at /admin/debug/pprof/ (requires --adminport)"`
+    ListenerWindowSeconds uint `default:"30" long:"listenerwindow" description:"a client that has asked for a playlist or segment within this many seconds is counted as a listener, in the admin API statistics (0 to not track listeners)"`
+    MaxListeners uint `long:"maxlisteners" description:"the most listeners (see --listenerwindow) there may be at once, any more being turned away with a 503 (0 for no limit)"`
+    MaxBandwidthKbits uint `long:"maxbandwidth" description:"the rate in kbits/s at which the streams may be served to listeners, new listeners being turned away with a 503 while it is exceeded (0 for no limit)"`
+    TlsCertFile string `long:"tlscert" description:"a certificate (PEM, with any intermediate certificates) with which to serve HTTPS rather than HTTP (requires --tlskey)"`
+    TlsKeyFile string `long:"tlskey" description:"the private key (PEM) of the --tlscert certificate"`
+    AcmeHosts []string `long:"acmehost" description:"a host name for which to have a certificate issued, and renewed, automatically by Let's Encrypt, serving HTTPS rather than HTTP (may be given more than once, the output port must be 443)"`
+    AcmeCacheDir string `default:"acme-cache" long:"acmecache" description:"the directory in which to keep the --acmehost certificates"`
+    AcmeEmail string `long:"acmeemail" description:"the contact email address for the Let's Encrypt account of --acmehost"`
+    HttpRedirectPort string `long:"httpredirect" description:"with HTTPS, a port (e.g. 80) on which to redirect plain HTTP requests to HTTPS (and answer Let's Encrypt HTTP-01 challenges)"`
+    CorsOrigins []string `long:"corsorigin" description:"an origin (e.g. https://www.example.org) allowed to make cross-domain requests of the HTTP server (may be given more than once, defaults to any origin)"`
+    CorsMethods string `default:"GET, POST, DELETE, OPTIONS" long:"corsmethods" description:"the methods allowed in cross-domain requests of the HTTP server"`
+    CorsHeaders string `default:"Content-Type, X-Requested-With" long:"corsheaders" description:"the headers allowed in cross-domain requests of the HTTP server"`
+    UrlSecretFile string `long:"urlsecret" description:"a file containing the secret (at least 16 characters) that stream URLs must be signed with, so that they expire; signed URLs are issued through the admin API"`
+    StreamSecrets []string `long:"streamsecret" description:"a URL secret of a further stream's own, given as <name>=<file>, that the requests for it at /stream/<name>/ must be signed with rather than the --urlsecret one; may be given more than once"`
+    LoadTestListeners uint `long:"loadtest" description:"run this many synthetic HLS listeners against the server and report the throughput and error rates achieved"`
+    LoadTestSeconds uint `default:"60" long:"loadtestseconds" description:"how long to run the --loadtest listeners for in seconds"`
+    LogName string `short:"l" long:"logfile" description:"file for logging output (will be truncated if it already exists, unless it is rotated)"`
+    LogMaxSize uint `long:"logmaxsize" description:"rotate the --logfile once it would be bigger than this many Mbytes (0 for no limit)"`
+    LogMaxAge uint `long:"logmaxage" description:"rotate the --logfile once it is this many hours old (0 for no limit)"`
+    LogKeep uint `default:"10" long:"logkeep" description:"the number of rotated --logfile files to keep, the oldest being deleted (0 to keep them all)"`
+    Syslog bool `long:"syslog" description:"log to the local syslog (journald under systemd) rather than to stderr or a --logfile"`
+    WavName string `long:"wavfile" description:"file for WAV output of the same audio as --rawpcmfile (will be truncated if it already exists)"`
+    WavRotateMinutes uint `long:"wavrotate" description:"start a new --wavfile every this many minutes, the UTC time at which each starts being inserted before the extension of its name (0 for one file)"`
+    RawPcmName string `short:"r" long:"rawpcmfile" description:"file for 16 bit PCM output (will be truncated if it already exists); format is little-endian 16-bit signed PCM at the --rate of the stream, with its --channels interleaved"`
 }
 
 //--------------------------------------------------------------------
 // Functions
 //--------------------------------------------------------------------
 
-// Deal with command-line parameters
-func cli() {
-     _, err := flags.Parse(&opts)
+// Return the config file named in the command-line arguments, if there
+// is one, so that it can be loaded before they are parsed
+func cliConfigFile(args []string) string {
+    var configOpts struct {
+        ConfigFile string `short:"c" long:"config"`
+    }
+
+    flags.NewParser(&configOpts, flags.IgnoreUnknown).ParseArgs(args)
+
+    return configOpts.ConfigFile
+}
 
+// Deal with the command-line arguments of the serve subcommand, and
+// any config file, the command line overriding the config file
+func cli(args []string) {
+    parser := flags.NewParser(&opts, flags.Default)
+    parser.Usage = "[serve] [OPTIONS] input-port output-port playlistpath\n\n" +
+                   "Other subcommands: replay, bench and probe (see ioc-server <subcommand> --help)."
+
+    if configFileName := cliConfigFile(args); configFileName != "" {
+        err := loadConfigFile(parser, configFileName)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Unable to load config file \"%s\" (%s).\n", configFileName, err.Error())
+            os.Exit(-1)
+        }
+    }
+
+    _, err := parser.ParseArgs(args)
     if err != nil {
         os.Exit(-1)
     }
+
+    if opts.WriteConfigFile != "" {
+        err = writeConfigFile(parser, opts.WriteConfigFile)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Unable to write config file \"%s\" (%s).\n", opts.WriteConfigFile, err.Error())
+            os.Exit(-1)
+        }
+        fmt.Printf("Settings written to config file \"%s\".\n", opts.WriteConfigFile)
+        os.Exit(0)
+    }
 }
 
-// Entry point
+// Entry point: the first argument is the subcommand, serve if it
+// isn't one
 func main() {
+    args := os.Args[1:]
+    subcommand := SUBCOMMAND_SERVE
+    if len(args) > 0 {
+        if _, ok := subcommands[args[0]]; ok {
+            subcommand = args[0]
+            args = args[1:]
+        }
+    }
+    subcommands[subcommand](args)
+}
+
+// The serve subcommand: run the server
+func serve(args []string) {
     var rawPcmHandle *os.File
-    var logHandle *os.File
+    var logFile *LogFile
     var err error
     var mp3Dir string
     var playlistPath string
 
     // Handle the command line
-    cli()
+    cli(args)
 
     // Open the log and raw PCM files
+    log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+    if opts.Syslog {
+        if opts.LogName != "" {
+            fmt.Fprintf(os.Stderr, "Log to either syslog or a log file, not both.\n")
+            os.Exit(-1)
+        }
+        syslogWriter, err1 := openSyslog("ioc-server")
+        if err1 != nil {
+            fmt.Fprintf(os.Stderr, "Unable to open syslog for logging output (%s).\n", err1.Error())
+            os.Exit(-1)
+        }
+        log.SetOutput(syslogWriter)
+        log.SetFlags(0)
+        logOutput = syslogWriter
+    }
     if opts.LogName != "" {
-        logHandle, err = os.Create(opts.LogName);
+        logFile, err = newLogFile(opts.LogName, int64(opts.LogMaxSize) * 1024 * 1024,
+                                  time.Duration(opts.LogMaxAge) * time.Hour, int(opts.LogKeep))
         // Point logging at the right place
-        if logHandle != nil {
-            defer logHandle.Close()
-            log.SetOutput(logHandle)
+        if logFile != nil {
+            defer logFile.Close()
+            log.SetOutput(logFile)
+            logOutput = logFile
         }
     }
-    log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+    fmt.Printf("Internet of Chuffs server version %s.\n", SERVER_VERSION)
     
     if (opts.RawPcmName != "") && (err == nil) {
         log.Printf("Opening \"%s\" for raw PCM output.\n", opts.RawPcmName)
@@ -102,21 +310,24 @@ func main() {
     mp3Dir = filepath.Dir(opts.Required.PlaylistPath)
     playlistPath = strings.TrimSuffix(opts.Required.PlaylistPath, filepath.Ext(opts.Required.PlaylistPath)) + PLAYLIST_EXTENSION
 
-    // Clear the TS files from the live playlist directory
+    // Clear the segment files from the live playlist directory
+    registerBuiltInEncoders()
     if mp3Dir != "" {
         _ = os.MkdirAll(mp3Dir, os.ModePerm)
         if err == nil {
-            log.Printf("Clearing %s files from directory \"%s\".\n", SEGMENT_EXTENSION, mp3Dir)
-            segmentFiles, err1 := filepath.Glob(mp3Dir + string(os.PathSeparator) + "*" + SEGMENT_EXTENSION)
-            if err1 == nil {
-                for _, segmentFile := range segmentFiles {
-                    err1 = os.Remove(segmentFile)
-                    if err1 != nil {
-                        log.Printf("Unable to delete file \"%s\" (%s).\n", segmentFile, err1.Error())
+            for _, extension := range segmentExtensions() {
+                log.Printf("Clearing %s files from directory \"%s\".\n", extension, mp3Dir)
+                segmentFiles, err1 := filepath.Glob(mp3Dir + string(os.PathSeparator) + "*" + extension)
+                if err1 == nil {
+                    for _, segmentFile := range segmentFiles {
+                        err1 = os.Remove(segmentFile)
+                        if err1 != nil {
+                            log.Printf("Unable to delete file \"%s\" (%s).\n", segmentFile, err1.Error())
+                        }
                     }
+                } else {
+                    log.Printf("Unable to delete %s files (%s).\n", extension, err1.Error())
                 }
-            } else {
-                log.Printf("Unable to delete %s files (%s).\n", SEGMENT_EXTENSION, err1.Error())
             }
         }
     }
@@ -124,19 +335,464 @@ func main() {
     if err == nil {
         defer rawPcmHandle.Close()
 
-        // Run the audio processing loop
-        go operateAudioProcessing(rawPcmHandle, mp3Dir, opts.OOSTimeSeconds, opts.SegmentFileDurationMs)
+        // Set up where segment files are kept
+        if opts.MemorySegments || (opts.SegmentStore == "memory") {
+            memorySegments := newMemorySegmentStore()
+            registerStats("memory_segments", memorySegments.Stats)
+            segmentStore = memorySegments
+        }
+        if opts.SegmentStore == "s3" {
+            objectStore, err1 := newObjectSegmentStore(segmentStore, opts.S3Endpoint, opts.S3Bucket, opts.S3Region,
+                                                       opts.S3Prefix, opts.S3AccessKey, opts.S3SecretKey, opts.CdnUrl, mp3Dir)
+            if err1 != nil {
+                fmt.Fprintf(os.Stderr, "Unable to set up object store (%s).\n", err1.Error())
+                os.Exit(-1)
+            }
+            registerStats("segment_store", objectStore.Stats)
+            segmentStore = objectStore
+        }
+
+        // Set up HTTPS
+        if (opts.TlsCertFile != "") || (opts.TlsKeyFile != "") || (len(opts.AcmeHosts) > 0) {
+            httpsOut, err = newHttps(opts.TlsCertFile, opts.TlsKeyFile, opts.AcmeHosts, opts.AcmeCacheDir,
+                                     opts.AcmeEmail, opts.HttpRedirectPort)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to set up HTTPS (%s).\n", err.Error())
+                os.Exit(-1)
+            }
+        } else if opts.HttpRedirectPort != "" {
+            fmt.Fprintf(os.Stderr, "--httpredirect needs HTTPS (--tlscert and --tlskey or --acmehost).\n")
+            os.Exit(-1)
+        }
+
+        // Set up the cross-domain policy
+        corsPolicy = CorsPolicy{Origins: opts.CorsOrigins, Methods: opts.CorsMethods, Headers: opts.CorsHeaders}
+
+        // Require stream URLs to be signed
+        if opts.UrlSecretFile != "" {
+            err1 := readUrlSecret(opts.UrlSecretFile)
+            if err1 != nil {
+                fmt.Fprintf(os.Stderr, "Unable to read URL secret (%s).\n", err1.Error())
+                os.Exit(-1)
+            }
+        }
+
+        // Set up listener tracking
+        if ((opts.MaxListeners > 0) || (opts.MaxBandwidthKbits > 0)) && (opts.ListenerWindowSeconds == 0) {
+            fmt.Fprintf(os.Stderr, "--maxlisteners and --maxbandwidth need listeners to be tracked (--listenerwindow).\n")
+            os.Exit(-1)
+        }
+        if opts.ListenerWindowSeconds > 0 {
+            listenerTracker = newListenerTracker(time.Second * time.Duration(opts.ListenerWindowSeconds),
+                                                 int(opts.MaxListeners), int64(opts.MaxBandwidthKbits) * 1000 / 8)
+            registerStats("listeners", listenerTracker.Stats)
+        }
+
+        // Set up the playlist format
+        playlistFormat.DurationDecimalPlaces = int(opts.ExtinfDecimalPlaces)
+        if opts.PlaylistLf {
+            playlistFormat.LineEnding = "\n"
+        }
+        playlistFormat.AllowCache = opts.AllowCache
+
+        // Set the sampling frequency of the stream
+        if (opts.SamplingFrequency < MIN_SAMPLING_FREQUENCY) || (opts.SamplingFrequency > MAX_SAMPLING_FREQUENCY) {
+            fmt.Fprintf(os.Stderr, "The sampling frequency must be between %d and %d Hz.\n", MIN_SAMPLING_FREQUENCY, MAX_SAMPLING_FREQUENCY)
+            os.Exit(-1)
+        }
+        if ((opts.Codec == OPUS_CODEC) || (opts.ArchiveCodec == OPUS_CODEC)) && !opusSamplingFrequency(opts.SamplingFrequency) {
+            fmt.Fprintf(os.Stderr, "Opus needs a sampling frequency of 8000, 12000, 16000, 24000 or 48000 Hz.\n")
+            os.Exit(-1)
+        }
+        streamSamplingFrequency = opts.SamplingFrequency
+
+        // Set the number of channels of the stream
+        if (opts.Channels < 1) || (opts.Channels > MAX_STREAM_CHANNELS) {
+            fmt.Fprintf(os.Stderr, "The number of channels must be between 1 and %d.\n", MAX_STREAM_CHANNELS)
+            os.Exit(-1)
+        }
+        streamChannels = opts.Channels
+
+        // Package the stream as fragmented MP4, writing the
+        // initialisation segment that every playlist will point to
+        if opts.Fmp4 {
+            if !hasEncoder(opts.Codec + FMP4_CODEC_SUFFIX) {
+                fmt.Fprintf(os.Stderr, "Codec \"%s\" can't be packaged as fragmented MP4.\n", opts.Codec)
+                os.Exit(-1)
+            }
+            opts.Codec += FMP4_CODEC_SUFFIX
+        }
+        if fmp4InnerCodec(opts.Codec) != "" {
+            playlistFormat.MapUri, err = writeFmp4InitSegment(mp3Dir, opts.Codec)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to write fragmented MP4 initialisation segment (%s).\n", err.Error())
+                os.Exit(-1)
+            }
+        }
+        if fmp4InnerCodec(opts.ArchiveCodec) != "" {
+            fmt.Fprintf(os.Stderr, "The archive can't be fragmented MP4, use --archivecodec %s.\n", fmp4InnerCodec(opts.ArchiveCodec))
+            os.Exit(-1)
+        }
+
+        // Set up the pipeline of the main stream, named after the
+        // playlist, with its processing stages and resource quotas
+        if opts.PcmBufferSeconds == 0 {
+            fmt.Fprintf(os.Stderr, "The PCM buffer must be at least 1 second long.\n")
+            os.Exit(-1)
+        }
+        if opts.LowWaterMs == 0 {
+            fmt.Fprintf(os.Stderr, "The low-water mark must be at least 1 millisecond.\n")
+            os.Exit(-1)
+        }
+        if opts.Mix && opts.Drift {
+            fmt.Fprintf(os.Stderr, "Clock drift compensation (--drift) follows a single client so can't be used with --mix.\n")
+            os.Exit(-1)
+        }
+        pipelineSettings := PipelineSettings{PcmBufferSeconds: opts.PcmBufferSeconds, MaxGapFillMs: opts.MaxGapFillMs,
+                                             LowWaterMs: opts.LowWaterMs, AdaptiveLowWater: opts.AdaptiveLowWater,
+                                             Denoise: opts.Denoise, DenoiseStrength: opts.DenoiseStrength,
+                                             DenoiseFloorDb: opts.DenoiseFloorDb,
+                                             Gate: opts.Gate, GateThresholdDbfs: opts.GateThresholdDbfs, GateHoldMs: opts.GateHoldMs,
+                                             Agc: opts.Agc, AgcTargetDbfs: opts.AgcTargetDbfs, AgcMaxGainDb: opts.AgcMaxGainDb,
+                                             AgcAttackMs: opts.AgcAttackMs, AgcReleaseMs: opts.AgcReleaseMs,
+                                             Drift: opts.Drift}
+        mainStreamName := strings.TrimSuffix(filepath.Base(playlistPath), PLAYLIST_EXTENSION)
+        streamQuota = newStreamQuota(mainStreamName, opts.IngestQuota, opts.DiskQuotaMegabytes, opts.CpuQuotaPercent)
+        mainPipeline = newPipeline(mainStreamName, playlistPath, opts.Codec, pipelineSettings, streamQuota)
+        mainPipeline.RegisterStats()
+
+        // Set up the pipelines of any further streams, each fed on a
+        // port of its own and with quotas of its own
+        streamPorts := make(map[string]*Pipeline)
+        for _, streamOption := range opts.Streams {
+            name, port, err := parseStreamOption(streamOption)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to set up stream \"%s\" (%s).\n", streamOption, err.Error())
+                os.Exit(-1)
+            }
+            if (findPipeline(name) != nil) || (port == opts.Required.In) || (streamPorts[port] != nil) {
+                fmt.Fprintf(os.Stderr, "Stream \"%s\" must have a name and a port different to those of every other stream.\n", streamOption)
+                os.Exit(-1)
+            }
+            streamPorts[port] = newPipeline(name, filepath.Join(mp3Dir, name + PLAYLIST_EXTENSION), opts.Codec, pipelineSettings,
+                                            newStreamQuota(name, opts.IngestQuota, opts.DiskQuotaMegabytes, opts.CpuQuotaPercent))
+            streamPorts[port].RegisterStats()
+        }
+
+        // Require the URLs of those further streams that have secrets
+        // of their own to be signed with them
+        for _, secretOption := range opts.StreamSecrets {
+            err1 := readStreamUrlSecret(secretOption)
+            if err1 != nil {
+                fmt.Fprintf(os.Stderr, "Unable to read stream secret \"%s\" (%s).\n", secretOption, err1.Error())
+                os.Exit(-1)
+            }
+        }
+
+        // Set up the per-source ingest rate limits
+        udpSourceLimiter = newSourceLimiter(opts.UdpMaxDatagrams, opts.UdpMaxBytes)
+        tcpConnectionLimiter = newConnectionLimiter(opts.TcpMaxConnections)
+
+        // Load the DSP chain
+        if opts.DspConfigName != "" {
+            err = loadDspChainConfig(opts.DspConfigName)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to load DSP chain from \"%s\" (%s).\n", opts.DspConfigName, err.Error())
+                os.Exit(-1)
+            }
+        }
+        if opts.NoDeemphasis {
+            removeDspStages(DSP_STAGE_DEEMPHASIS)
+        }
+        if opts.NoDesqueal {
+            removeDspStages(DSP_STAGE_DESQUEAL)
+        }
+        dspAllCodingSchemes = opts.DspAll
+
+        // Load any scripts
+        err = operateScripts(opts.Scripts)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Unable to load script (%s).\n", err.Error())
+            os.Exit(-1)
+        }
+
+        // Check that there is an encoder for the codec
+        if !hasEncoder(opts.Codec) {
+            fmt.Fprintf(os.Stderr, "Unknown codec \"%s\" (must be one of %s).\n", opts.Codec, strings.Join(encoderCodecs(), ", "))
+            os.Exit(-1)
+        }
+        outputCodec = opts.Codec
+        if (opts.Mp3Quality < -1) || (opts.Mp3Quality > 9) {
+            fmt.Fprintf(os.Stderr, "The MP3 quality must be between 0 and 9 (or -1 for the LAME default).\n")
+            os.Exit(-1)
+        }
+
+        // Keep the settings that may be changed while running
+        if (opts.SegmentFileDurationMs < SETTINGS_MIN_SEGMENT_MS) || (opts.SegmentFileDurationMs > SETTINGS_MAX_SEGMENT_MS) {
+            fmt.Fprintf(os.Stderr, "The segment duration must be between %d and %d ms.\n", SETTINGS_MIN_SEGMENT_MS, SETTINGS_MAX_SEGMENT_MS)
+            os.Exit(-1)
+        }
+        streamSettings = StreamSettings{Encoder: Mp3Settings{Bitrate: int(opts.Bitrate), Scale: opts.Scale,
+                                                             LowPassFrequency: opts.LowPassHz, HighPassFrequency: opts.HighPassHz,
+                                                             Quality: opts.Mp3Quality + 1},
+                                        SegmentMs: opts.SegmentFileDurationMs, PlaylistSeconds: opts.PlaylistLengthSeconds}
+
+        // Set up segment duration tuning
+        if opts.LatencyTargetMs > 0 {
+            segmentTuner, err = newSegmentTuner(opts.LatencyTargetMs, opts.SegmentMinMs, opts.SegmentMaxMs)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to set up segment duration tuning (%s).\n", err.Error())
+                os.Exit(-1)
+            }
+            registerStats("segment_tuning", segmentTuner.Stats)
+        }
+
+        // Set up the shadow encoder
+        if opts.ShadowName != "" {
+            shadowEncoder = newShadowEncoder(mp3Dir, opts.ShadowName, opts.Codec,
+                                             Mp3Settings{Bitrate: int(opts.ShadowBitrate), Scale: opts.ShadowScale,
+                                                         LowPassFrequency: opts.ShadowLowPassHz, HighPassFrequency: opts.ShadowHighPassHz},
+                                             opts.SegmentFileDurationMs, opts.PlaylistLengthSeconds)
+            if shadowEncoder == nil {
+                fmt.Fprintf(os.Stderr, "Unable to create shadow encoder.\n")
+                os.Exit(-1)
+            }
+        }
+
+        // Set up the bitrate ladder
+        if len(opts.LadderBitrates) > 0 {
+            abrLadder, err = newAbrLadder(playlistPath, opts.Codec, streamSettings.Encoder, opts.LadderBitrates,
+                                          opts.SegmentFileDurationMs, opts.PlaylistLengthSeconds)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to create bitrate ladder (%s).\n", err.Error())
+                os.Exit(-1)
+            }
+        }
+
+        // Set up WAV output
+        if opts.WavName != "" {
+            wavWriter, err = newWavWriter(opts.WavName, opts.WavRotateMinutes)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to open %s for WAV output (%s).\n", opts.WavName, err.Error())
+                os.Exit(-1)
+            }
+        }
+
+        // Set up the archive recorder
+        if opts.ArchiveDir != "" {
+            archiveRecorder, err = newArchiveRecorder(opts.ArchiveDir, opts.ArchiveCodec, opts.ArchiveMaxAgeHours, opts.ArchiveMaxMegabytes)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to create archive recorder in \"%s\" (%s).\n", opts.ArchiveDir, err.Error())
+                os.Exit(-1)
+            }
+        }
+
+        // Set up the Icecast source
+        if opts.IcecastServer != "" {
+            icecastSource, err = newIcecastSource(opts.IcecastServer, opts.IcecastMount, opts.IcecastPassword,
+                                                  Mp3Settings{Bitrate: int(opts.IcecastBitrate), Scale: opts.Scale,
+                                                              LowPassFrequency: opts.LowPassHz, HighPassFrequency: opts.HighPassHz})
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to set up Icecast source for %s (%s).\n", opts.IcecastServer, err.Error())
+                os.Exit(-1)
+            }
+            registerStats("icecast", icecastSource.Stats)
+        }
+
+        // Set up the live WebSocket output
+        if opts.LiveWs {
+            liveWs, err = newLiveWs(Mp3Settings{Bitrate: int(opts.Bitrate), Scale: opts.Scale,
+                                                LowPassFrequency: opts.LowPassHz, HighPassFrequency: opts.HighPassHz})
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to set up the live WebSocket output (%s).\n", err.Error())
+                os.Exit(-1)
+            }
+            registerStats("live_ws", liveWs.Stats)
+        }
+
+        // Set up the webhooks
+        if len(opts.Webhooks) > 0 {
+            webhooks, err = newWebhooks(opts.Webhooks, opts.WebhookEvents, opts.WebhookSecretFile)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to set up webhooks (%s).\n", err.Error())
+                os.Exit(-1)
+            }
+            registerStats("webhooks", webhooks.Stats)
+        }
+
+        // Set up disk space monitoring
+        if opts.DiskWarnPercent > 0 {
+            diskPaths := []string{mp3Dir}
+            if opts.LogName != "" {
+                diskPaths = append(diskPaths, filepath.Dir(opts.LogName))
+            }
+            diskSpaceMonitor = newDiskSpaceMonitor(diskPaths, opts.DiskWarnPercent)
+            registerStats("disk_space", diskSpaceMonitor.Stats)
+        }
+
+        // Set up the journal
+        if opts.JournalName != "" {
+            journal, err = newJournal(opts.JournalName, opts.JournalKeepDays)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to open journal \"%s\" (%s).\n", opts.JournalName, err.Error())
+                os.Exit(-1)
+            }
+        }
+
+        // Set up the statistics history
+        if opts.StatsHistoryMinutes > 0 {
+            statsHistory = newStatsHistory(opts.StatsHistoryMinutes)
+        }
+
+        // Set up the server-sent events output
+        if opts.Sse {
+            eventStream = newEventStream()
+            registerStats("sse", eventStream.Stats)
+        }
+
+        // Set up the WebRTC output
+        if opts.Whep {
+            whep, err = newWhep(Mp3Settings{Bitrate: int(opts.Bitrate), Scale: opts.Scale}, opts.WhepStunServers)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to set up the WebRTC output (%s).\n", err.Error())
+                os.Exit(-1)
+            }
+            registerStats("whep", whep.Stats)
+        }
+
+        // Set up chuff detection
+        if opts.ChuffDir != "" {
+            chuffDetector, err = newChuffDetector(opts.ChuffDir, opts.ChuffOnsetDb, opts.ChuffMaxClips)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to create chuff detector in \"%s\" (%s).\n", opts.ChuffDir, err.Error())
+                os.Exit(-1)
+            }
+        }
+
+        // Set up adaptive audio coding
+        if opts.AdaptCoding {
+            codingAdvisor = newCodingAdvisor()
+        }
+
+        // Set up catch-up mode
+        if opts.CatchUpMs > 0 {
+            catchUp = newCatchUp(opts.CatchUpMs, opts.CatchUpSpeedPercent)
+        }
+
+        // Set up mixing of several clients
+        tcpPolicy := opts.TcpPolicy
+        if opts.Mix {
+            mixer, err = newMixer(opts.ReorderTolerance, opts.MixGains)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to set up mixing (%s).\n", err.Error())
+                os.Exit(-1)
+            }
+            registerStats("mixer", mixer.Stats)
+            tcpPolicy = TCP_POLICY_MIX
+        }
+
+        // Check the serial device settings
+        if opts.SerialPath != "" {
+            err = checkSerialBaudRate(opts.SerialBaudRate)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to read from serial device \"%s\" (%s).\n", opts.SerialPath, err.Error())
+                os.Exit(-1)
+            }
+        }
+
+        // Shut down cleanly on SIGINT or SIGTERM
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+        defer stop()
+        // ...or when asked to through the admin API
+        ctx, requestShutdown = context.WithCancel(ctx)
+
+        // Tell systemd how things are going, if it is listening; without
+        // a watchdog of the main stream to ping the systemd watchdog,
+        // ping it regardless
+        systemdNotifier = newSystemdNotifier()
+        if (systemdNotifier != nil) && (opts.WatchdogSeconds == 0) {
+            go systemdNotifier.Run(ctx)
+        }
+
+        // Run the audio processing loop and the playlist of the main stream
+        go operateAudioProcessing(ctx, mainPipeline, rawPcmHandle, streamSettings.Encoder, opts.OOSTimeSeconds, opts.SegmentFileDurationMs, opts.ReorderTolerance, opts.WatchdogSeconds)
+        operatePlaylist(mainPipeline, opts.PlaylistLengthSeconds, time.Minute * time.Duration(opts.DvrMinutes))
+
+        // ...and those of any further streams
+        for _, pipeline := range streamPorts {
+            go operateAudioProcessing(ctx, pipeline, nil, streamSettings.Encoder, opts.OOSTimeSeconds, opts.SegmentFileDurationMs, opts.ReorderTolerance, opts.WatchdogSeconds)
+            operatePlaylist(pipeline, opts.PlaylistLengthSeconds, time.Minute * time.Duration(opts.DvrMinutes))
+        }
 
         // Run the server loop for incoming audio
-        go operateAudioIn(opts.Required.In)
+        go operateAudioIn(ctx, opts.InBindAddresses, opts.Required.In, streamPorts, opts.Nack, opts.Fec, opts.UdpSockets, opts.TcpIdleSeconds, tcpPolicy)
+
+        // Read incoming audio from a serial device as well, if requested
+        if opts.SerialPath != "" {
+            go operateSerialIn(ctx, opts.SerialPath, opts.SerialBaudRate)
+        }
+
+        // Upload segment files to the object store if requested
+        if objectStore, ok := segmentStore.(*ObjectSegmentStore); ok {
+            go objectStore.Run(ctx)
+        }
+
+        // Push to the Icecast server if requested
+        if icecastSource != nil {
+            go icecastSource.Run(ctx)
+        }
+
+        // POST events to the webhooks if requested
+        if webhooks != nil {
+            go webhooks.Run(ctx)
+        }
+
+        // Keep an eye on the disk space if requested
+        if diskSpaceMonitor != nil {
+            go diskSpaceMonitor.Run(ctx)
+        }
+
+        // Write the journal if requested
+        if journal != nil {
+            go journal.Run(ctx)
+        }
+
+        // Sample the statistics history if requested
+        if statsHistory != nil {
+            go statsHistory.Run(ctx)
+        }
+
+        // Tune the segment duration if requested
+        if segmentTuner != nil {
+            go segmentTuner.Run(ctx)
+        }
+
+        // Run the admin API
+        if opts.Pprof && (opts.AdminPort == "") {
+            fmt.Fprintf(os.Stderr, "--pprof needs the admin API (--adminport).\n")
+            os.Exit(-1)
+        }
+        if opts.AdminPort != "" {
+            err = operateAdmin(ctx, opts.AdminBindAddresses, opts.AdminPort, opts.AdminSecretFile, opts.Pprof)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Unable to start admin API (%s).\n", err.Error())
+                os.Exit(-1)
+            }
+        }
+
+        // Run a load test if requested
+        if opts.LoadTestListeners > 0 {
+            go operateLoadTest(ctx, opts.OutBindAddresses, opts.Required.Out, playlistPath,
+                               opts.LoadTestListeners, time.Duration(opts.LoadTestSeconds) * time.Second)
+        }
 
-        // Run the HTTP server for audio output (which should block)
-        operateAudioOut(opts.Required.Out, playlistPath, opts.PlaylistLengthSeconds)
+        // Run the HTTP server for audio output (which blocks until shut down)
+        operateAudioOut(ctx, opts.OutBindAddresses, opts.Required.Out, playlistPath)
     } else {
         if (opts.RawPcmName != "") && (rawPcmHandle == nil) {
             fmt.Fprintf(os.Stderr, "Unable to open %s for raw PCM output (%s).\n", opts.RawPcmName, err.Error())
         }
-        if (opts.LogName != "") && (logHandle == nil) {
+        if (opts.LogName != "") && (logFile == nil) {
             fmt.Fprintf(os.Stderr, "Unable to open %s for logging output (%s).\n", opts.LogName, err.Error())
         }
         os.Exit(-1)
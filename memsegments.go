@@ -0,0 +1,230 @@
+/* In-memory segment storage for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// A segment file lives for a few seconds, which, on a Raspberry Pi,
+// means a constant cycle of creating and deleting files on an SD card
+// that wears it out and adds IO latency.  With --memsegments the
+// segment files, of every stream, are kept in memory instead: a
+// segment file is written to a buffer which, when the file is closed,
+// goes into the store under the path that the file would have had on
+// disk, from where it is served, cut into clips and, as the playlist
+// moves on, removed.  Everything else (the playlists, the archive, the
+// fragmented MP4 initialisation segment and so on) is still written
+// to disk, where nothing is created and deleted at anything like the
+// same rate.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A segment file held in memory
+type MemorySegment struct {
+    data     []byte
+    modTime  time.Time
+}
+
+// The store of segment files held in memory, keyed by path
+type MemorySegmentStore struct {
+    locker   sync.Mutex
+    files    map[string]*MemorySegment
+    bytes    int64
+    written  int
+    removed  int
+}
+
+// A segment file being written to the store, which it goes into
+// when it is closed
+type MemorySegmentFile struct {
+    bytes.Buffer
+    name   string
+    store  *MemorySegmentStore
+}
+
+// Statistics of the store of segment files held in memory
+type MemorySegmentStoreStats struct {
+    Files    int    `json:"files"`
+    Bytes    int64  `json:"bytes"`
+    Written  int    `json:"written"`
+    Removed  int    `json:"removed"`
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The number of the last segment file created in memory, from which
+// its name follows (use atomic operations)
+var memorySegmentNumber uint64 = uint64(time.Now().Unix())
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a store of segment files held in memory
+func newMemorySegmentStore() *MemorySegmentStore {
+    log.Printf("Segment files will be kept in memory.\n")
+
+    return &MemorySegmentStore{files: make(map[string]*MemorySegment)}
+}
+
+// Create a segment file with the given extension, named as if it were
+// in dirName
+func (store *MemorySegmentStore) Create(dirName string, extension string) SegmentFile {
+    name := fmt.Sprintf("%d%s", atomic.AddUint64(&memorySegmentNumber, 1), extension)
+
+    return &MemorySegmentFile{name: filepath.Join(dirName, name), store: store}
+}
+
+// Put a segment file into the store
+func (store *MemorySegmentStore) put(filePath string, data []byte) {
+    store.locker.Lock()
+    defer store.locker.Unlock()
+
+    if file, ok := store.files[filepath.Clean(filePath)]; ok {
+        store.bytes -= int64(len(file.data))
+    }
+    store.files[filepath.Clean(filePath)] = &MemorySegment{data: data, modTime: time.Now()}
+    store.bytes += int64(len(data))
+    store.written++
+}
+
+// Return the contents of a segment file and when it was written,
+// false if it isn't in the store
+func (store *MemorySegmentStore) Get(filePath string) ([]byte, time.Time, bool) {
+    store.locker.Lock()
+    defer store.locker.Unlock()
+
+    file, ok := store.files[filepath.Clean(filePath)]
+    if !ok {
+        return nil, time.Time{}, false
+    }
+
+    return file.data, file.modTime, true
+}
+
+// Return the contents of a segment file and when it was written,
+// from disk if it isn't in the store
+func (store *MemorySegmentStore) Read(filePath string) ([]byte, time.Time, error) {
+    data, modTime, ok := store.Get(filePath)
+    if !ok {
+        return new(DiskSegmentStore).Read(filePath)
+    }
+
+    return data, modTime, nil
+}
+
+// Remove a segment file from the store or, if it isn't there, from
+// disk
+func (store *MemorySegmentStore) Remove(filePath string) error {
+    store.locker.Lock()
+    file, ok := store.files[filepath.Clean(filePath)]
+    if ok {
+        store.bytes -= int64(len(file.data))
+        store.removed++
+        delete(store.files, filepath.Clean(filePath))
+    }
+    store.locker.Unlock()
+    if !ok {
+        return os.Remove(filePath)
+    }
+
+    return nil
+}
+
+// Return the paths of the segment files in dirName with the given
+// extension, in alphabetical order
+func (store *MemorySegmentStore) Paths(dirName string, extension string) []string {
+    var paths []string
+
+    store.locker.Lock()
+    for filePath := range store.files {
+        if (filepath.Dir(filePath) == filepath.Clean(dirName)) && strings.HasSuffix(filePath, extension) {
+            paths = append(paths, filePath)
+        }
+    }
+    store.locker.Unlock()
+    sort.Strings(paths)
+
+    return paths
+}
+
+// Return the number of bytes of the segment files in dirName
+func (store *MemorySegmentStore) Size(dirName string) int64 {
+    var size int64
+
+    store.locker.Lock()
+    defer store.locker.Unlock()
+
+    for filePath, file := range store.files {
+        if filepath.Dir(filePath) == filepath.Clean(dirName) {
+            size += int64(len(file.data))
+        }
+    }
+
+    return size
+}
+
+// Serve a segment file from the store or, if it isn't there (e.g. the
+// fragmented MP4 initialisation segment), from disk
+func (store *MemorySegmentStore) Serve(out http.ResponseWriter, in *http.Request, filePath string) {
+    data, modTime, ok := store.Get(filePath)
+    if !ok {
+        http.ServeFile(out, in, filePath)
+        return
+    }
+    http.ServeContent(out, in, filepath.Base(filePath), modTime, bytes.NewReader(data))
+}
+
+// A segment file in memory is referred to by its name, as if it were
+// alongside the playlist
+func (store *MemorySegmentStore) Uri(filePath string) string {
+    return filepath.Base(filePath)
+}
+
+// Return the statistics of the store of segment files held in memory
+func (store *MemorySegmentStore) Stats() interface{} {
+    store.locker.Lock()
+    defer store.locker.Unlock()
+
+    return MemorySegmentStoreStats{Files: len(store.files), Bytes: store.bytes,
+                                   Written: store.written, Removed: store.removed}
+}
+
+// The path of a segment file being written to the store
+func (file *MemorySegmentFile) Name() string {
+    return file.name
+}
+
+// Put a segment file into the store
+func (file *MemorySegmentFile) Close() error {
+    file.store.put(file.name, append([]byte(nil), file.Bytes()...))
+
+    return nil
+}
+
+/* End Of File */
@@ -0,0 +1,339 @@
+/* Mixing of several clients for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// When mixing (see --mix) several clients may stream at the same time,
+// e.g. a microphone in the cab and another on the platform, and their
+// audio is mixed into the one stream.  Each client is an input of the
+// mixer, named after its IP address (or the serial device it is
+// attached to), with a reorder buffer, a resampler and gap handling of
+// its own; gaps in an input are filled with silence, so that the other
+// inputs carry on regardless.  Every processing tick each input is
+// brought to the channels and sampling frequency of the stream and the
+// inputs are then summed, each multiplied by its gain, and clipped, the
+// result going on down the processing chain as the audio of a single
+// client would.  The inputs are lined up by arrival: the mix goes only
+// as far as the input that is furthest behind, unless that input is
+// more than MIXER_WAIT_MILLISECONDS behind the one furthest ahead, or
+// hasn't been heard from for that long, in which case it is taken to
+// be silent for the difference.  The gain of an input, in dB, may be
+// set on the command line (--mixgain) and changed while running
+// through the admin API, and is kept for the input's name even when
+// the client isn't there.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An input of the mixer
+type MixerInput struct {
+    Name       string
+    reorder    ReorderBuffer
+    // The last datagram taken from the reorder buffer, which gaps are
+    // measured from
+    previous   *UrtpDatagram
+    resampler  *Resampler
+    // Audio of the stream's channels and sampling frequency waiting to
+    // be mixed, interleaved
+    audio      []int16
+    lastHeard  time.Time
+    datagrams  int
+}
+
+// State of the mixer
+type Mixer struct {
+    inputs     map[string]*MixerInput
+    // The gain of each input in dB, by name
+    gains      map[string]float64
+    tolerance  int
+    locker     sync.Mutex
+}
+
+// Statistics of an input of the mixer
+type MixerInputStats struct {
+    Name        string     `json:"name"`
+    GainDb      float64    `json:"gainDb"`
+    Connected   bool       `json:"connected"`
+    BufferedMs  int64      `json:"bufferedMs"`
+    LastHeard   time.Time  `json:"lastHeard"`
+    Datagrams   int        `json:"datagrams"`
+}
+
+// Statistics of the mixer
+type MixerStats struct {
+    Inputs  []MixerInputStats  `json:"inputs"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How far an input may fall behind before it is taken to be silent
+const MIXER_WAIT_MILLISECONDS int = 200
+
+// How long an input may go without being heard from before it is
+// forgotten (its gain is kept)
+const MIXER_INPUT_IDLE time.Duration = SESSION_IDLE_TIME
+
+// The range of gains of an input in dB
+const MIXER_MIN_GAIN_DB float64 = -60
+const MIXER_MAX_GAIN_DB float64 = 20
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The mixer, nil if not mixing
+var mixer *Mixer
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the name of the input of the mixer for the source of a
+// datagram: the IP address of a client, so that one that reconnects
+// from another port is the same input, else the source as it is
+func mixerInputName(source string) string {
+    host, _, err := net.SplitHostPort(source)
+    if err != nil {
+        return source
+    }
+
+    return host
+}
+
+// Check a gain in dB
+func checkMixerGain(gainDb float64) error {
+    if (gainDb < MIXER_MIN_GAIN_DB) || (gainDb > MIXER_MAX_GAIN_DB) || math.IsNaN(gainDb) {
+        return errors.New(fmt.Sprintf("the gain must be between %g and %g dB", MIXER_MIN_GAIN_DB, MIXER_MAX_GAIN_DB))
+    }
+
+    return nil
+}
+
+// Create a mixer, waiting for datagrams that are out of order for
+// the given number of blocks (as --reorder) and with gains, each of
+// the form <name>=<dB>, for some of the inputs
+func newMixer(tolerance uint, gains []string) (*Mixer, error) {
+    mixer := &Mixer{inputs: make(map[string]*MixerInput), gains: make(map[string]float64),
+                    tolerance: int(tolerance)}
+
+    for _, gain := range gains {
+        parts := strings.SplitN(gain, "=", 2)
+        if (len(parts) != 2) || (parts[0] == "") {
+            return nil, errors.New(fmt.Sprintf("\"%s\" is not of the form <client>=<dB>", gain))
+        }
+        gainDb, err := strconv.ParseFloat(parts[1], 64)
+        if err == nil {
+            err = checkMixerGain(gainDb)
+        }
+        if err != nil {
+            return nil, errors.New(fmt.Sprintf("bad gain for \"%s\" (%s)", parts[0], err.Error()))
+        }
+        mixer.gains[parts[0]] = gainDb
+    }
+
+    return mixer, nil
+}
+
+// Set the gain of an input, which need not be there yet, in dB
+func (mixer *Mixer) SetGain(name string, gainDb float64) error {
+    err := checkMixerGain(gainDb)
+    if err == nil {
+        mixer.locker.Lock()
+        mixer.gains[name] = gainDb
+        mixer.locker.Unlock()
+        log.Printf("Mixer gain of %s set to %.1f dB.\n", name, gainDb)
+    }
+
+    return err
+}
+
+// Put a newly arrived datagram into the input of its source
+func (mixer *Mixer) Put(datagram *UrtpDatagram, now time.Time) {
+    mixer.locker.Lock()
+    defer mixer.locker.Unlock()
+
+    name := mixerInputName(datagram.Source)
+    input := mixer.inputs[name]
+    if input == nil {
+        input = &MixerInput{Name: name, reorder: ReorderBuffer{Tolerance: mixer.tolerance}}
+        mixer.inputs[name] = input
+        log.Printf("Mixing in audio from %s (%.1f dB).\n", name, mixer.gains[name])
+    }
+    input.reorder.Put(datagram, now)
+    input.lastHeard = now
+    input.datagrams++
+}
+
+// Fill a gap of the given number of samples in an input with silence,
+// unless it is silly
+func (input *MixerInput) fill(gap int, now time.Time) {
+    log.Printf("Handling a gap of %d samples from %s...\n", gap, input.Name)
+    filled := mainPipeline.gaps.Record(gap, now)
+    publishEvent(EVENT_GAP, map[string]interface{}{"samples": gap, "filled": filled, "input": input.Name})
+    if filled {
+        input.audio = append(input.audio, make([]int16, gap * streamChannels)...)
+    }
+}
+
+// Take a datagram that is in order into an input
+func (input *MixerInput) take(datagram *UrtpDatagram, now time.Time) {
+    timestamped := datagram.Timestamp != 0
+    shortBy := convertDatagram(datagram, &input.resampler)
+
+    if gap := datagramGap(datagram, input.previous); gap > 0 {
+        input.fill(gap, now)
+    }
+    if datagram.Audio != nil {
+        mainPipeline.levels.Put(datagram, now)
+        input.audio = append(input.audio, *datagram.Audio...)
+        if !timestamped && (shortBy > 0) {
+            input.fill(shortBy, now)
+        }
+    } else if !timestamped {
+        input.fill(streamSamplingFrequency * BLOCK_DURATION_MS / 1000, now)
+    }
+    if input.previous != nil {
+        putUrtpDatagram(input.previous)
+    }
+    input.previous = datagram
+}
+
+// Forget the state of an input
+func (input *MixerInput) reset() {
+    input.reorder.Reset()
+    if input.previous != nil {
+        putUrtpDatagram(input.previous)
+        input.previous = nil
+    }
+    input.audio = input.audio[:0]
+}
+
+// Return the audio of the inputs that is ready to be mixed, mixed,
+// nil if there is none
+func (mixer *Mixer) Mix(now time.Time) []int16 {
+    var mixed []int16
+    wait := MIXER_WAIT_MILLISECONDS * streamSamplingFrequency / 1000
+    numSamples := -1
+    most := 0
+
+    mixer.locker.Lock()
+    defer mixer.locker.Unlock()
+
+    // Bring each input up to date, working out how much can be mixed
+    for _, input := range mixer.inputs {
+        for _, datagram := range input.reorder.Get(now) {
+            input.take(datagram, now)
+        }
+        frames := len(input.audio) / streamChannels
+        if frames > most {
+            most = frames
+        }
+        if (now.Sub(input.lastHeard) < time.Duration(MIXER_WAIT_MILLISECONDS) * time.Millisecond) &&
+           ((numSamples < 0) || (frames < numSamples)) {
+            numSamples = frames
+        }
+    }
+    if numSamples < 0 {
+        // Nothing has been heard from lately, mix what there is
+        numSamples = most
+    } else if numSamples < most - wait {
+        numSamples = most - wait
+    }
+
+    if numSamples > 0 {
+        sums := make([]float64, numSamples * streamChannels)
+        for _, input := range mixer.inputs {
+            gain := math.Pow(10, mixer.gains[input.Name] / 20)
+            length := len(sums)
+            if length > len(input.audio) {
+                length = len(input.audio)
+            }
+            for x, sample := range input.audio[:length] {
+                sums[x] += float64(sample) * gain
+            }
+            input.audio = append(input.audio[:0], input.audio[length:]...)
+        }
+        mixed = make([]int16, len(sums))
+        for x, sum := range sums {
+            if sum > 32767 {
+                sum = 32767
+            } else if sum < -32768 {
+                sum = -32768
+            }
+            mixed[x] = int16(sum)
+        }
+    }
+
+    // Forget the inputs that have gone
+    for name, input := range mixer.inputs {
+        if (now.Sub(input.lastHeard) > MIXER_INPUT_IDLE) && (len(input.audio) == 0) {
+            input.reset()
+            delete(mixer.inputs, name)
+            log.Printf("Nothing from %s for %d second(s), no longer mixing it in.\n", name, MIXER_INPUT_IDLE / time.Second)
+        }
+    }
+
+    return mixed
+}
+
+// Reset the mixer, e.g. when the stream is reset; the gains are kept
+func (mixer *Mixer) Reset() {
+    mixer.locker.Lock()
+    defer mixer.locker.Unlock()
+
+    for name, input := range mixer.inputs {
+        input.reset()
+        delete(mixer.inputs, name)
+    }
+}
+
+// Return the statistics of the mixer
+func (mixer *Mixer) Stats() interface{} {
+    var stats MixerStats
+
+    mixer.locker.Lock()
+    defer mixer.locker.Unlock()
+
+    for name, input := range mixer.inputs {
+        stats.Inputs = append(stats.Inputs, MixerInputStats{Name: name, GainDb: mixer.gains[name], Connected: true,
+                                                            BufferedMs: int64(pcmDuration(len(input.audio) * URTP_SAMPLE_SIZE) / time.Millisecond),
+                                                            LastHeard: input.lastHeard, Datagrams: input.datagrams})
+    }
+    for name, gainDb := range mixer.gains {
+        if mixer.inputs[name] == nil {
+            stats.Inputs = append(stats.Inputs, MixerInputStats{Name: name, GainDb: gainDb})
+        }
+    }
+    sort.Slice(stats.Inputs, func(x, y int) bool {
+        return stats.Inputs[x].Name < stats.Inputs[y].Name
+    })
+
+    return stats
+}
+
+/* End Of File */
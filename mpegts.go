@@ -0,0 +1,183 @@
+/* MPEG transport stream packaging for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+)
+
+// Just enough of an MPEG-2 transport stream (ISO/IEC 13818-1) to carry
+// one stream of ADTS AAC for HLS: each segment starts with a program
+// association table (PAT) and a program map table (PMT), then each
+// ADTS frame goes in a packetised elementary stream (PES) packet of its
+// own, with its presentation timestamp (PTS), split across as many
+// 188 byte transport stream packets as it needs.  The first transport
+// stream packet of each PES packet also carries the program clock
+// reference (PCR), there being no other stream to carry it.  The
+// continuity counters and the timestamps carry on from one segment to
+// the next, so that the segments play back to back.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An MPEG transport stream being written
+type TransportStream struct {
+    // Continuity counters, keyed by PID
+    continuity  map[uint16]byte
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The size of a transport stream packet
+const TS_PACKET_SIZE int = 188
+
+// The size of a transport stream packet header
+const TS_HEADER_SIZE int = 4
+
+// The sync byte at the start of a transport stream packet
+const TS_SYNC_BYTE byte = 0x47
+
+// The PIDs of the PAT, the PMT and the audio
+const TS_PAT_PID uint16 = 0x0000
+const TS_PMT_PID uint16 = 0x1000
+const TS_AUDIO_PID uint16 = 0x0100
+
+// The stream type of ADTS AAC
+const TS_STREAM_TYPE_ADTS byte = 0x0f
+
+// The PES stream ID of the first audio stream
+const PES_STREAM_ID_AUDIO byte = 0xc0
+
+// The rate of MPEG timestamps
+const MPEG_CLOCK_RATE int = 90000
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the MPEG-2 CRC of a table section, which uses the same
+// polynomial as Ogg but starts from all ones
+func mpegCrc(data []byte) uint32 {
+    var crc uint32 = 0xffffffff
+
+    for _, item := range data {
+        crc = (crc << 8) ^ oggCrcTable[byte(crc >> 24) ^ item]
+    }
+
+    return crc
+}
+
+// Create a transport stream
+func newTransportStream() *TransportStream {
+    return &TransportStream{continuity: make(map[uint16]byte)}
+}
+
+// Write a payload to output in transport stream packets on a PID,
+// the first packet marked as starting the payload and, if pcr is not
+// negative, carrying the PCR
+func (stream *TransportStream) writePackets(output *bytes.Buffer, pid uint16, payload []byte, pcr int64) {
+    for first := true; first || (len(payload) > 0); first = false {
+        var adaptation []byte
+        packet := make([]byte, TS_HEADER_SIZE, TS_PACKET_SIZE)
+        packet[0] = TS_SYNC_BYTE
+        packet[1] = byte(pid >> 8) & 0x1f
+        if first {
+            packet[1] |= 0x40 // Payload unit start
+        }
+        packet[2] = byte(pid)
+        if first && (pcr >= 0) {
+            // Random access, PCR, base of 33 bits, 6 reserved bits and
+            // an extension of 9 bits, which is zero
+            base := uint64(pcr)
+            adaptation = []byte{0x50, byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1),
+                                byte(base << 7) | 0x7e, 0x00}
+        }
+        // Fill the rest of the packet, stuffing the adaptation field if
+        // the payload won't fill it
+        room := TS_PACKET_SIZE - TS_HEADER_SIZE
+        if adaptation != nil {
+            room -= len(adaptation) + 1
+        }
+        if len(payload) < room {
+            if adaptation == nil {
+                // Room for the adaptation field length as well
+                room--
+                if room > len(payload) {
+                    adaptation = []byte{0x00}
+                    room--
+                } else {
+                    adaptation = []byte{}
+                }
+            }
+            for ; room > len(payload); room-- {
+                adaptation = append(adaptation, 0xff)
+            }
+        }
+        continuity := stream.continuity[pid]
+        stream.continuity[pid] = (continuity + 1) & 0x0f
+        if adaptation != nil {
+            packet[3] = 0x30 | continuity
+            packet = append(packet, byte(len(adaptation)))
+            packet = append(packet, adaptation...)
+        } else {
+            packet[3] = 0x10 | continuity
+        }
+        packet = append(packet, payload[:room]...)
+        payload = payload[room:]
+        output.Write(packet)
+    }
+}
+
+// Write a table section, with a pointer field in front and the CRC
+// added, on a PID
+func (stream *TransportStream) writeSection(output *bytes.Buffer, pid uint16, tableId byte, tableIdExtension uint16, body []byte) {
+    // Section length covers everything after it, including the
+    // CRC: the five bytes of extension, version and section numbers,
+    // the body and four bytes of CRC
+    length := 5 + len(body) + 4
+    section := []byte{tableId, 0xb0 | byte(length >> 8), byte(length), byte(tableIdExtension >> 8), byte(tableIdExtension),
+                      0xc1, 0x00, 0x00}
+    section = append(section, body...)
+    crc := mpegCrc(section)
+    section = append(section, byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc))
+    stream.writePackets(output, pid, append([]byte{0x00}, section...), -1)
+}
+
+// Write the PAT and the PMT, which must start every segment
+func (stream *TransportStream) WriteTables(output *bytes.Buffer) {
+    // One program, number 1
+    stream.writeSection(output, TS_PAT_PID, 0x00, 1, []byte{0x00, 0x01, 0xe0 | byte(TS_PMT_PID >> 8), byte(TS_PMT_PID & 0xff)})
+    // The PCR is on the audio PID, no program information and the one
+    // stream with no elementary stream information
+    stream.writeSection(output, TS_PMT_PID, 0x02, 1, []byte{0xe0 | byte(TS_AUDIO_PID >> 8), byte(TS_AUDIO_PID & 0xff), 0xf0, 0x00,
+                                                            TS_STREAM_TYPE_ADTS, 0xe0 | byte(TS_AUDIO_PID >> 8), byte(TS_AUDIO_PID & 0xff),
+                                                            0xf0, 0x00})
+}
+
+// Write a frame of audio in a PES packet with the given PTS, which is
+// also used as the PCR
+func (stream *TransportStream) WriteAudio(output *bytes.Buffer, frame []byte, pts int64) {
+    // PTS only, in five bytes with marker bits
+    ptsBytes := []byte{0x21 | byte(pts >> 29) & 0x0e, byte(pts >> 22), byte(pts >> 14) | 0x01, byte(pts >> 7), byte(pts << 1) | 0x01}
+    // The length of the PES packet after the length field
+    length := 3 + len(ptsBytes) + len(frame)
+    pes := []byte{0x00, 0x00, 0x01, PES_STREAM_ID_AUDIO, byte(length >> 8), byte(length), 0x80, 0x80, byte(len(ptsBytes))}
+    pes = append(pes, ptsBytes...)
+    pes = append(pes, frame...)
+    stream.writePackets(output, TS_AUDIO_PID, pes, pts)
+}
+
+/* End Of File */
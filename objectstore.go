@@ -0,0 +1,352 @@
+/* Object store (S3/GCS) segment storage for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// So that listeners need not all be served by the server itself, which
+// may be a Raspberry Pi at the end of a mobile connection, the object
+// store (see --segmentstore s3) uploads each segment file, once it is
+// complete, to a bucket of an S3-compatible object store, from where a
+// CDN serves it; Google Cloud Storage is S3-compatible through its
+// XML API (endpoint https://storage.googleapis.com with HMAC keys).
+// A segment file is written locally first, to disk or, with
+// --memsegments, to memory, and is served from there until it has been
+// uploaded, after which the playlist refers to it by its CDN URL; when
+// it leaves the playlist it is deleted from the bucket as well as
+// locally.  Uploads and deletions are done, in order, by a go routine
+// of their own, requests being signed with AWS signature version 4,
+// so that nothing waits on the network; if it can't keep up, new jobs
+// are dropped, a segment file that isn't uploaded simply being served
+// locally (a segment file that isn't deleted is left in the bucket, so
+// give the bucket a lifecycle rule that expires old objects).  The
+// playlists themselves are always served by the server.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Something for the object store go routine to do
+type ObjectStoreJob struct {
+    filePath  string
+    key       string
+    data      []byte
+    remove    bool
+}
+
+// A segment file being written locally, uploaded when it is closed
+type ObjectStoreFile struct {
+    SegmentFile
+    store  *ObjectSegmentStore
+}
+
+// Segment files uploaded to an object store
+type ObjectSegmentStore struct {
+    Endpoint   string
+    Bucket     string
+    Region     string
+    Prefix     string
+    CdnUrl     string
+    // The directory from which keys are relative
+    BaseDir    string
+    local      SegmentStore
+    accessKey  string
+    secretKey  string
+    client     http.Client
+    jobs       chan *ObjectStoreJob
+    locker     sync.Mutex
+    uploaded   map[string]string
+    uploads    int
+    deleted    int
+    failures   int
+    dropped    int
+}
+
+// Statistics of the object store
+type ObjectSegmentStoreStats struct {
+    Uploaded  int  `json:"uploaded"`
+    Deleted   int  `json:"deleted"`
+    Failures  int  `json:"failures"`
+    Dropped   int  `json:"dropped"`
+    Queued    int  `json:"queued"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of uploads and deletions that may be waiting
+const OBJECT_STORE_QUEUE_SIZE int = 100
+
+// How long an upload or deletion may take
+const OBJECT_STORE_TIMEOUT time.Duration = time.Second * 10
+
+// The format of the date and time in a signed request
+const OBJECT_STORE_AMZ_DATE_FORMAT string = "20060102T150405Z"
+
+// The default region of the object store
+const OBJECT_STORE_DEFAULT_REGION string = "us-east-1"
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create an object store for the bucket at endpoint (e.g.
+// https://s3.eu-west-2.amazonaws.com), keys being prefix followed by
+// the path of a segment file relative to baseDir and segment files
+// being kept locally in local until they are uploaded; cdnUrl,
+// defaulting to the bucket at endpoint, is what a key is appended to
+// in the playlist
+func newObjectSegmentStore(local SegmentStore, endpoint string, bucket string, region string, prefix string,
+                           accessKey string, secretKey string, cdnUrl string, baseDir string) (*ObjectSegmentStore, error) {
+    if (endpoint == "") || (bucket == "") {
+        return nil, errors.New("an object store needs an endpoint and a bucket")
+    }
+    if (accessKey == "") || (secretKey == "") {
+        return nil, errors.New("an object store needs an access key and a secret key")
+    }
+    if region == "" {
+        region = OBJECT_STORE_DEFAULT_REGION
+    }
+    endpoint = strings.TrimSuffix(endpoint, "/")
+    if cdnUrl == "" {
+        cdnUrl = endpoint + "/" + bucket
+    }
+    store := &ObjectSegmentStore{Endpoint: endpoint, Bucket: bucket, Region: region, Prefix: prefix,
+                                 CdnUrl: strings.TrimSuffix(cdnUrl, "/"), BaseDir: baseDir, local: local,
+                                 accessKey: accessKey, secretKey: secretKey,
+                                 client: http.Client{Timeout: OBJECT_STORE_TIMEOUT},
+                                 jobs: make(chan *ObjectStoreJob, OBJECT_STORE_QUEUE_SIZE),
+                                 uploaded: make(map[string]string)}
+    log.Printf("Segment files will be uploaded to bucket \"%s\" at %s and served from %s.\n",
+               bucket, endpoint, store.CdnUrl)
+
+    return store, nil
+}
+
+// Return the key of a segment file
+func (store *ObjectSegmentStore) key(filePath string) string {
+    relativePath, err := filepath.Rel(store.BaseDir, filePath)
+    if (err != nil) || strings.HasPrefix(relativePath, "..") {
+        relativePath = filepath.Base(filePath)
+    }
+
+    return store.Prefix + filepath.ToSlash(relativePath)
+}
+
+// Queue a job for the object store go routine, dropping it if the
+// queue is full
+func (store *ObjectSegmentStore) queue(job *ObjectStoreJob) {
+    select {
+        case store.jobs <- job:
+        default:
+            log.Printf("Object store can't keep up, not %s \"%s\".\n",
+                       map[bool]string{false: "uploading", true: "deleting"}[job.remove], job.key)
+            store.locker.Lock()
+            store.dropped++
+            store.locker.Unlock()
+    }
+}
+
+// Open a segment file locally, for upload when it is closed
+func (store *ObjectSegmentStore) Create(dirName string, extension string) SegmentFile {
+    file := store.local.Create(dirName, extension)
+    if file == nil {
+        return nil
+    }
+
+    return &ObjectStoreFile{SegmentFile: file, store: store}
+}
+
+// Close a segment file and queue it for upload
+func (file *ObjectStoreFile) Close() error {
+    err := file.SegmentFile.Close()
+    if err == nil {
+        var data []byte
+        data, _, err = file.store.local.Read(file.Name())
+        if err == nil {
+            file.store.queue(&ObjectStoreJob{filePath: file.Name(), key: file.store.key(file.Name()), data: data})
+        }
+    }
+
+    return err
+}
+
+// Return the contents of a segment file, from where it is kept locally
+func (store *ObjectSegmentStore) Read(filePath string) ([]byte, time.Time, error) {
+    return store.local.Read(filePath)
+}
+
+// Remove a segment file locally and queue it for deletion from the
+// bucket
+func (store *ObjectSegmentStore) Remove(filePath string) error {
+    store.queue(&ObjectStoreJob{filePath: filePath, key: store.key(filePath), remove: true})
+
+    return store.local.Remove(filePath)
+}
+
+// Serve a segment file from where it is kept locally, for a player
+// that asks before it has been uploaded
+func (store *ObjectSegmentStore) Serve(out http.ResponseWriter, in *http.Request, filePath string) {
+    store.local.Serve(out, in, filePath)
+}
+
+// Return the paths of the segment files kept locally in dirName with
+// the given extension
+func (store *ObjectSegmentStore) Paths(dirName string, extension string) []string {
+    return store.local.Paths(dirName, extension)
+}
+
+// Return the number of bytes of segment files kept locally in dirName
+func (store *ObjectSegmentStore) Size(dirName string) int64 {
+    return store.local.Size(dirName)
+}
+
+// Return the CDN URL of a segment file once it has been uploaded,
+// until then its local name
+func (store *ObjectSegmentStore) Uri(filePath string) string {
+    store.locker.Lock()
+    defer store.locker.Unlock()
+
+    if url, ok := store.uploaded[filepath.Clean(filePath)]; ok {
+        return url
+    }
+
+    return store.local.Uri(filePath)
+}
+
+// Return the HMAC-SHA256 of data with key
+func hmacSha256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+
+    return mac.Sum(nil)
+}
+
+// Sign a request with AWS signature version 4
+func (store *ObjectSegmentStore) sign(request *http.Request, payload []byte) {
+    payloadHash := sha256.Sum256(payload)
+    payloadHashHex := hex.EncodeToString(payloadHash[:])
+    now := time.Now().UTC()
+    amzDate := now.Format(OBJECT_STORE_AMZ_DATE_FORMAT)
+    date := now.Format("20060102")
+
+    request.Header.Set("x-amz-date", amzDate)
+    request.Header.Set("x-amz-content-sha256", payloadHashHex)
+    signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+    canonicalRequest := request.Method + "\n" + request.URL.EscapedPath() + "\n" + request.URL.RawQuery + "\n" +
+                        "host:" + request.URL.Host + "\n" +
+                        "x-amz-content-sha256:" + payloadHashHex + "\n" +
+                        "x-amz-date:" + amzDate + "\n\n" +
+                        signedHeaders + "\n" + payloadHashHex
+    canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+    scope := date + "/" + store.Region + "/s3/aws4_request"
+    stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+    key := hmacSha256([]byte("AWS4" + store.secretKey), date)
+    key = hmacSha256(key, store.Region)
+    key = hmacSha256(key, "s3")
+    key = hmacSha256(key, "aws4_request")
+    request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+                                                    store.accessKey, scope, signedHeaders,
+                                                    hex.EncodeToString(hmacSha256(key, stringToSign))))
+}
+
+// Do a job: upload a segment file or delete one from the bucket
+func (store *ObjectSegmentStore) do(ctx context.Context, job *ObjectStoreJob) error {
+    var body io.Reader
+    var method string = http.MethodPut
+
+    if job.remove {
+        method = http.MethodDelete
+    } else {
+        body = bytes.NewReader(job.data)
+    }
+    request, err := http.NewRequestWithContext(ctx, method, store.Endpoint + "/" + store.Bucket + "/" + job.key, body)
+    if err != nil {
+        return err
+    }
+    if !job.remove {
+        if contentType := segmentContentType(filepath.Ext(job.key)); contentType != "" {
+            request.Header.Set("Content-Type", contentType)
+        }
+    }
+    store.sign(request, job.data)
+    response, err := store.client.Do(request)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+    if (response.StatusCode < 200) || (response.StatusCode >= 300) {
+        message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+        return errors.New(fmt.Sprintf("%s gave status %d: %s", method, response.StatusCode, strings.TrimSpace(string(message))))
+    }
+
+    return nil
+}
+
+// Upload and delete segment files until ctx is done
+func (store *ObjectSegmentStore) Run(ctx context.Context) {
+    for {
+        select {
+            case <-ctx.Done():
+                return
+            case job := <-store.jobs:
+                err := store.do(ctx, job)
+                store.locker.Lock()
+                if err == nil {
+                    if job.remove {
+                        delete(store.uploaded, filepath.Clean(job.filePath))
+                        store.deleted++
+                    } else {
+                        store.uploaded[filepath.Clean(job.filePath)] = store.CdnUrl + "/" + job.key
+                        store.uploads++
+                    }
+                } else {
+                    log.Printf("Unable to %s \"%s\" in object store (%s).\n",
+                               map[bool]string{false: "upload", true: "delete"}[job.remove], job.key, err.Error())
+                    store.failures++
+                    if job.remove {
+                        delete(store.uploaded, filepath.Clean(job.filePath))
+                    }
+                }
+                store.locker.Unlock()
+        }
+    }
+}
+
+// Return the statistics of the object store
+func (store *ObjectSegmentStore) Stats() interface{} {
+    store.locker.Lock()
+    defer store.locker.Unlock()
+
+    return ObjectSegmentStoreStats{Uploaded: store.uploads, Deleted: store.deleted, Failures: store.failures,
+                                   Dropped: store.dropped, Queued: len(store.jobs)}
+}
+
+/* End Of File */
@@ -0,0 +1,136 @@
+/* Ogg encapsulation for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+)
+
+// Just enough Ogg (RFC 3533) to carry Opus (RFC 7845): each packet
+// goes in a page of its own, which costs a little over a kbit/s at
+// 20 ms packets but means a page never has to be held back waiting for
+// more.  A page is:
+//
+//   - "OggS",
+//   - one byte of version, 0,
+//   - one byte of header type flags (OGG_CONTINUED, OGG_BOS, OGG_EOS),
+//   - eight bytes of granule position, little-endian,
+//   - four bytes of stream serial number, little-endian,
+//   - four bytes of page sequence number, little-endian,
+//   - four bytes of CRC, little-endian, calculated with these four
+//     bytes set to zero,
+//   - one byte, the number of lacing values,
+//   - the lacing values, the packet length in chunks of 255 ending with
+//     one of less than 255,
+//
+// followed by the packet.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An Ogg logical stream being written
+type OggStream struct {
+    Serial    uint32
+    sequence  uint32
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// Header type flags of an Ogg page
+const OGG_CONTINUED byte = 0x01
+const OGG_BOS byte = 0x02
+const OGG_EOS byte = 0x04
+
+// The size of an Ogg page header without its lacing values
+const OGG_PAGE_HEADER_SIZE int = 27
+
+// The offset of the CRC in an Ogg page
+const OGG_CRC_OFFSET int = 22
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The CRC table for Ogg: polynomial 0x04c11db7, not reflected
+var oggCrcTable = makeOggCrcTable()
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Make the CRC table for Ogg
+func makeOggCrcTable() [256]uint32 {
+    var table [256]uint32
+
+    for x := range table {
+        crc := uint32(x) << 24
+        for y := 0; y < 8; y++ {
+            if crc & 0x80000000 != 0 {
+                crc = (crc << 1) ^ 0x04c11db7
+            } else {
+                crc <<= 1
+            }
+        }
+        table[x] = crc
+    }
+
+    return table
+}
+
+// Return the Ogg CRC of some data
+func oggCrc(data []byte) uint32 {
+    var crc uint32
+
+    for _, item := range data {
+        crc = (crc << 8) ^ oggCrcTable[byte(crc >> 24) ^ item]
+    }
+
+    return crc
+}
+
+// Write a packet, in a page of its own, to output
+func (stream *OggStream) WritePacket(output *bytes.Buffer, packet []byte, granulePosition uint64, flags byte) {
+    var lacing []byte
+
+    for length := len(packet); ; length -= 255 {
+        if length < 255 {
+            lacing = append(lacing, byte(length))
+            break
+        }
+        lacing = append(lacing, 255)
+    }
+    page := make([]byte, OGG_PAGE_HEADER_SIZE, OGG_PAGE_HEADER_SIZE + len(lacing) + len(packet))
+    copy(page, "OggS")
+    page[5] = flags
+    binary.LittleEndian.PutUint64(page[6:], granulePosition)
+    binary.LittleEndian.PutUint32(page[14:], stream.Serial)
+    binary.LittleEndian.PutUint32(page[18:], stream.sequence)
+    page[26] = byte(len(lacing))
+    page = append(page, lacing...)
+    page = append(page, packet...)
+    binary.LittleEndian.PutUint32(page[OGG_CRC_OFFSET:], oggCrc(page))
+    output.Write(page)
+    stream.sequence++
+}
+
+// Start the stream again with a new serial number
+func (stream *OggStream) Restart(serial uint32) {
+    stream.Serial = serial
+    stream.sequence = 0
+}
+
+/* End Of File */
@@ -0,0 +1,169 @@
+/* Bounded PCM buffer for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// The PCM between the incoming datagrams and the encoder is held in a
+// ring buffer of fixed size so that, if the encoder stalls or the input
+// outruns the output, memory doesn't grow without limit.  When there
+// isn't room for new audio the oldest audio is dropped to make room,
+// since a listener would rather hear what is happening now than
+// something from minutes ago, and the amount dropped is counted.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A ring buffer of little-endian 16-bit PCM
+type PcmRing struct {
+    buffer        []byte
+    start         int
+    length        int
+    // Scratch space for converting samples to bytes
+    scratch       []byte
+    droppedBytes  uint64
+    overflows     uint64
+    // True while audio is being dropped, so that an overflow is only
+    // logged once
+    overflowing   bool
+    locker        sync.Mutex
+}
+
+// Statistics of a PCM ring buffer
+type PcmRingStats struct {
+    CapacityMs  int64   `json:"capacityMs"`
+    BufferedMs  int64   `json:"bufferedMs"`
+    DroppedMs   int64   `json:"droppedMs"`
+    Overflows   uint64  `json:"overflows"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The default duration of the PCM buffer
+const PCM_BUFFER_DEFAULT_SECONDS uint = 60
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a PCM ring buffer that holds seconds of audio
+func newPcmRing(seconds uint) *PcmRing {
+    return &PcmRing{buffer: make([]byte, int(seconds) * streamSamplingFrequency * URTP_SAMPLE_SIZE * streamChannels)}
+}
+
+// Return the number of bytes buffered
+func (ring *PcmRing) Len() int {
+    ring.locker.Lock()
+    defer ring.locker.Unlock()
+
+    return ring.length
+}
+
+// Write bytes to the buffer, dropping the oldest if there isn't room;
+// the lock must be held
+func (ring *PcmRing) write(data []byte) {
+    if len(data) > len(ring.buffer) {
+        // Only the newest will fit
+        ring.dropped(len(data) - len(ring.buffer))
+        data = data[len(data) - len(ring.buffer):]
+    }
+    if excess := ring.length + len(data) - len(ring.buffer); excess > 0 {
+        ring.start = (ring.start + excess) % len(ring.buffer)
+        ring.length -= excess
+        ring.dropped(excess)
+    } else {
+        ring.overflowing = false
+    }
+    end := (ring.start + ring.length) % len(ring.buffer)
+    copied := copy(ring.buffer[end:], data)
+    copy(ring.buffer, data[copied:])
+    ring.length += len(data)
+}
+
+// Count some dropped bytes; the lock must be held
+func (ring *PcmRing) dropped(numBytes int) {
+    ring.droppedBytes += uint64(numBytes)
+    if !ring.overflowing {
+        ring.overflowing = true
+        ring.overflows++
+        log.Printf("PCM buffer full (%d ms), dropping the oldest audio.\n",
+                   int64(pcmDuration(len(ring.buffer)) / time.Millisecond))
+    }
+}
+
+// Write little-endian 16-bit PCM to the buffer, dropping the oldest
+// audio if there isn't room; there is never an error
+func (ring *PcmRing) Write(data []byte) (int, error) {
+    ring.locker.Lock()
+    ring.write(data)
+    ring.locker.Unlock()
+
+    return len(data), nil
+}
+
+// Write samples to the buffer as little-endian 16-bit PCM
+func (ring *PcmRing) WriteSamples(audio []int16) {
+    ring.locker.Lock()
+    ring.scratch = appendPcm(ring.scratch[:0], audio)
+    ring.write(ring.scratch)
+    ring.locker.Unlock()
+}
+
+// Write numSamples of silence, in every channel, to the buffer
+func (ring *PcmRing) WriteSilence(numSamples int) {
+    ring.locker.Lock()
+    ring.scratch = ring.scratch[:0]
+    for x := 0; x < numSamples * URTP_SAMPLE_SIZE * streamChannels; x++ {
+        ring.scratch = append(ring.scratch, 0)
+    }
+    ring.write(ring.scratch)
+    ring.locker.Unlock()
+}
+
+// Read up to len(data) bytes from the buffer, returning the number read;
+// there is never an error
+func (ring *PcmRing) Read(data []byte) (int, error) {
+    ring.locker.Lock()
+    defer ring.locker.Unlock()
+
+    numBytes := len(data)
+    if numBytes > ring.length {
+        numBytes = ring.length
+    }
+    copied := copy(data[:numBytes], ring.buffer[ring.start:])
+    copy(data[copied:numBytes], ring.buffer)
+    ring.start = (ring.start + numBytes) % len(ring.buffer)
+    ring.length -= numBytes
+
+    return numBytes, nil
+}
+
+// Return the statistics of the buffer
+func (ring *PcmRing) Stats() interface{} {
+    ring.locker.Lock()
+    defer ring.locker.Unlock()
+
+    return PcmRingStats{CapacityMs: int64(pcmDuration(len(ring.buffer)) / time.Millisecond),
+                        BufferedMs: int64(pcmDuration(ring.length) / time.Millisecond),
+                        DroppedMs: int64(pcmDuration(int(ring.droppedBytes)) / time.Millisecond),
+                        Overflows: ring.overflows}
+}
+
+/* End Of File */
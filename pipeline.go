@@ -0,0 +1,395 @@
+/* Stream pipelines for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "container/list"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// A pipeline is everything between the datagrams of a stream and the
+// playlist of it that is served: the state of the processing loop
+// (operateAudioProcessing()), which reorders the datagrams, fills the
+// gaps, puts the audio into the PCM buffer and encodes it into
+// segments, and that of the playlist loop (operatePlaylist()), which
+// keeps the list of segments and makes the playlist from it.  Each
+// pipeline is named and is served by the HTTP server at
+// /stream/<name>/playlist.m3u8, its segments alongside, as well as, for
+// the main stream, at the path of the playlist given on the command
+// line.  The main stream is named after its playlist file and is the
+// one that the clients feed; further streams may be given with
+// --stream <name>=<port>, each fed by URTP over UDP on a port of its
+// own, its playlist being <name>.m3u8 alongside that of the main
+// stream.  Each pipeline has its own processing stages (the gap
+// filling, the time-stretching, the comfort noise, the optional
+// --denoise, --gate, --agc and --drift and so on), made from the same
+// settings, so that one stream can't disturb the state of another.
+// The session with the client (capabilities, NACKs, timing, control
+// datagrams), mixing and the extra outputs (--archive, --shadow and so
+// on) are those of the main stream only.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The pipeline of a stream
+type Pipeline struct {
+    Name                string
+    // The directory of the segment files
+    Dir                 string
+    // The playlist file, written whenever the playlist changes
+    PlaylistPath        string
+    Codec               string
+    // The datagrams for the processing loop, the other messages for it
+    // (the state of the output buffer, lost clients and so on), kept
+    // apart so that they are never thrown away to make room for
+    // datagrams, and the messages for the playlist loop (segments,
+    // markers and so on)
+    datagrams           chan interface{}
+    control             chan interface{}
+    media               chan interface{}
+    // The audio waiting to be encoded
+    pcm                 *PcmRing
+    concealer           Concealer
+    // The resampler of the incoming audio, nil if there hasn't been any
+    // that needed resampling
+    resampler           *Resampler
+    // The processing stages, the optional ones nil if not wanted
+    noiseReducer        *NoiseReducer
+    noiseGate           *NoiseGate
+    agc                 *Agc
+    clockDrift          *ClockDrift
+    slowDown            *SlowDown
+    comfortNoise        ComfortNoise
+    gaps                *GapCounter
+    levels              LevelMeter
+    lowWater            *LowWaterMark
+    quota               *StreamQuota
+    // The playlist, as served, and the segments in it
+    playlist            []byte
+    playlistLocker      sync.Mutex
+    fileList            *list.List
+    fileListLocker      sync.Mutex
+    // Closed once the final playlist has been written
+    finished            chan struct{}
+    // The most recent depths of the PCM buffer and of the HLS output
+    // buffer, the number of samples in a segment and the number of
+    // heartbeats received, and of resets asked for (e.g. through the
+    // admin API), since the processing loop last looked (use atomic
+    // operations)
+    pcmBufferedNs       int64
+    outputBufferedNs    int64
+    segmentSamples      int64
+    heartbeatsPending   int32
+    // Non-zero while the processing loop has a segment file open (use
+    // atomic operations)
+    segmentOpen         int32
+    resetsPending       int32
+    // The number of datagrams and of other messages thrown away because
+    // the processing channels were full (use atomic operations)
+    datagramsDropped    uint64
+    controlDropped      uint64
+    // The number of times the output stream (the encoder or the segment
+    // files) has failed and been recovered (use atomic operations)
+    outputFailures      int64
+    outputRecoveries    int64
+    // Incremented by the watchdog each time it starts a new processing
+    // loop in place of one that has stalled (use atomic operations)
+    processGeneration   uint32
+}
+
+// The settings of the processing stages of a pipeline
+type PipelineSettings struct {
+    PcmBufferSeconds   uint
+    MaxGapFillMs       uint
+    LowWaterMs         uint
+    AdaptiveLowWater   bool
+    Denoise            bool
+    DenoiseStrength    float64
+    DenoiseFloorDb     float64
+    Gate               bool
+    GateThresholdDbfs  float64
+    GateHoldMs         uint
+    Agc                bool
+    AgcTargetDbfs      float64
+    AgcMaxGainDb       float64
+    AgcAttackMs        uint
+    AgcReleaseMs       uint
+    Drift              bool
+}
+
+// Statistics of the output stream of a pipeline
+type PipelineOutputStats struct {
+    Failures    int64  `json:"failures"`
+    Recoveries  int64  `json:"recoveries"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The path under which the pipelines are served, each at
+// STREAM_PATH_PREFIX + <name> + "/" + STREAM_PLAYLIST_NAME
+const STREAM_PATH_PREFIX string = "/stream/"
+
+// The name of the playlist of a pipeline when served under
+// STREAM_PATH_PREFIX
+const STREAM_PLAYLIST_NAME string = "playlist" + PLAYLIST_EXTENSION
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The pipelines, by name
+var pipelines = make(map[string]*Pipeline)
+var pipelinesLocker sync.Mutex
+
+// The pipeline of the main stream, the one that the clients feed
+var mainPipeline *Pipeline
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a pipeline, and add it to those served, for a stream of the
+// given name, its playlist being written to playlistPath, its segments
+// encoded with codec and kept alongside, its processing stages made
+// from settings and its resources limited by quota
+func newPipeline(name string, playlistPath string, codec string, settings PipelineSettings, quota *StreamQuota) *Pipeline {
+    pipeline := &Pipeline{Name: name, Dir: filepath.Dir(playlistPath), PlaylistPath: playlistPath, Codec: codec,
+                          datagrams: make(chan interface{}, PROCESS_DATAGRAMS_QUEUE_SIZE),
+                          control: make(chan interface{}, PROCESS_CONTROL_QUEUE_SIZE),
+                          media: make(chan interface{}),
+                          pcm: newPcmRing(settings.PcmBufferSeconds), fileList: list.New(),
+                          finished: make(chan struct{}),
+                          slowDown: newSlowDown(), gaps: newGapCounter(settings.MaxGapFillMs),
+                          lowWater: newLowWaterMark(settings.LowWaterMs, settings.AdaptiveLowWater),
+                          quota: quota}
+    if settings.Denoise {
+        pipeline.noiseReducer = newNoiseReducer(settings.DenoiseStrength, settings.DenoiseFloorDb)
+    }
+    if settings.Gate {
+        pipeline.noiseGate = newNoiseGate(settings.GateThresholdDbfs, settings.GateHoldMs)
+    }
+    if settings.Agc {
+        pipeline.agc = newAgc(settings.AgcTargetDbfs, settings.AgcMaxGainDb, settings.AgcAttackMs, settings.AgcReleaseMs)
+    }
+    if settings.Drift {
+        pipeline.clockDrift = newClockDrift()
+    }
+
+    pipelinesLocker.Lock()
+    pipelines[name] = pipeline
+    pipelinesLocker.Unlock()
+    log.Printf("Stream \"%s\" will be served at %s.\n", name, STREAM_PATH_PREFIX + name + "/" + STREAM_PLAYLIST_NAME)
+
+    return pipeline
+}
+
+// Parse a --stream option, of the form <name>=<port>, returning the
+// name and the port
+func parseStreamOption(option string) (string, string, error) {
+    parts := strings.SplitN(option, "=", 2)
+    if (len(parts) != 2) || (parts[0] == "") || strings.ContainsAny(parts[0], "/\\.") {
+        return "", "", errors.New(fmt.Sprintf("\"%s\" is not of the form <name>=<port>, <name> being a plain name", option))
+    }
+    port, err := strconv.ParseUint(parts[1], 10, 16)
+    if (err != nil) || (port == 0) {
+        return "", "", errors.New(fmt.Sprintf("\"%s\" is not a port number", parts[1]))
+    }
+
+    return parts[0], parts[1], nil
+}
+
+// Return the pipeline of the given name, nil if there isn't one
+func findPipeline(name string) *Pipeline {
+    pipelinesLocker.Lock()
+    defer pipelinesLocker.Unlock()
+
+    return pipelines[name]
+}
+
+// Stop serving the pipeline of the given name
+func removePipeline(name string) {
+    pipelinesLocker.Lock()
+    defer pipelinesLocker.Unlock()
+
+    delete(pipelines, name)
+}
+
+// Return the name under which to register the statistics of the
+// given name for a pipeline: as it is for the main stream, else with
+// the name of the stream appended
+func (pipeline *Pipeline) statsName(name string) string {
+    if pipeline == mainPipeline {
+        return name
+    }
+
+    return name + "_" + pipeline.Name
+}
+
+// Register the statistics of the processing stages of a pipeline,
+// which must be done once it is known whether it is the main stream
+func (pipeline *Pipeline) RegisterStats() {
+    registerStats(pipeline.statsName("pcm_buffer"), pipeline.pcm.Stats)
+    registerStats(pipeline.statsName("comfort_noise"), pipeline.comfortNoise.Stats)
+    registerStats(pipeline.statsName("slow_down"), pipeline.slowDown.Stats)
+    registerStats(pipeline.statsName("gaps"), pipeline.gaps.Stats)
+    registerStats(pipeline.statsName("low_water"), pipeline.lowWater.Stats)
+    if pipeline.noiseGate != nil {
+        registerStats(pipeline.statsName("noise_gate"), pipeline.noiseGate.Stats)
+    }
+    if pipeline.agc != nil {
+        registerStats(pipeline.statsName("agc"), pipeline.agc.Stats)
+    }
+    if pipeline.clockDrift != nil {
+        registerStats(pipeline.statsName("drift"), pipeline.clockDrift.stats)
+    }
+}
+
+// Queue a message for the processing loop of a pipeline without ever
+// blocking: if the datagram channel is full the oldest datagram in it
+// is thrown away to make room; other messages go on their own channel
+// and are only thrown away, counted, if that is full
+func (pipeline *Pipeline) Queue(message interface{}) {
+    switch message := message.(type) {
+        case *UrtpDatagram:
+            for {
+                select {
+                    case pipeline.datagrams <- message:
+                        return
+                    default:
+                        select {
+                            case oldest := <-pipeline.datagrams:
+                                pipeline.dropDatagram(oldest.(*UrtpDatagram))
+                            default:
+                        }
+                }
+            }
+        case *Heartbeat:
+            // All the processing loop needs is the count
+            atomic.AddInt32(&pipeline.heartbeatsPending, 1)
+        default:
+            select {
+                case pipeline.control <- message:
+                default:
+                    dropped := atomic.AddUint64(&pipeline.controlDropped, 1)
+                    log.Printf("Processing of stream \"%s\" isn't keeping up, %T thrown away (%d message(s) so far).\n",
+                               pipeline.Name, message, dropped)
+            }
+    }
+}
+
+// Throw away a datagram that the processing of a pipeline can't keep
+// up with, counting it
+func (pipeline *Pipeline) dropDatagram(datagram *UrtpDatagram) {
+    putUrtpDatagram(datagram)
+    dropped := atomic.AddUint64(&pipeline.datagramsDropped, 1)
+    if dropped % 100 == 1 {
+        log.Printf("Processing of stream \"%s\" isn't keeping up, %d datagram(s) dropped so far.\n",
+                   pipeline.Name, dropped)
+    }
+}
+
+// Return the most recent depths of the PCM buffer and of the HLS
+// output buffer of a pipeline
+func (pipeline *Pipeline) BufferDepths() (time.Duration, time.Duration) {
+    return time.Duration(atomic.LoadInt64(&pipeline.pcmBufferedNs)), time.Duration(atomic.LoadInt64(&pipeline.outputBufferedNs))
+}
+
+// Return the statistics of the output stream of a pipeline
+func (pipeline *Pipeline) OutputStats() interface{} {
+    return PipelineOutputStats{Failures: atomic.LoadInt64(&pipeline.outputFailures),
+                               Recoveries: atomic.LoadInt64(&pipeline.outputRecoveries)}
+}
+
+// Serve a file of a pipeline, given its name: the playlist from the
+// buffer, one of its own segments from the directory; for the
+// main stream a playlist asked for from a given start time is a
+// catch-up playlist (see catchup.go)
+func (pipeline *Pipeline) serve(out http.ResponseWriter, in *http.Request, fileName string) {
+    log.Printf("Stream \"%s\" was asked for \"%s\"...\n", pipeline.Name, fileName)
+    stopCache(out)
+    if !allowStreamSignedUrl(out, in, pipeline.Name) {
+        return
+    }
+    out, allowed := listenerTracker.track(out, in, pipeline.Name, fileName == STREAM_PLAYLIST_NAME)
+    if !allowed {
+        return
+    }
+    if (pipeline == mainPipeline) && (fileName == STREAM_PLAYLIST_NAME) && (in.URL.Query().Get("start") != "") {
+        catchUpPlaylistHandler(out, in, pipeline.Dir)
+    } else if (pipeline == mainPipeline) && (fileName == CATCHUP_SEGMENT_NAME) {
+        catchUpSegmentHandler(out, in, pipeline.Dir)
+    } else if fileName == STREAM_PLAYLIST_NAME {
+        out.Header().Set("Content-Type","application/x-mpegurl")
+        pipeline.playlistLocker.Lock()
+        playlist := pipeline.playlist
+        pipeline.playlistLocker.Unlock()
+        log.Printf("Serving playlist from buffer (%d byte(s)).\n", len(playlist))
+        http.ServeContent(out, in, fileName, time.Time{}, bytes.NewReader(signPlaylist(playlist, in, streamUrlSecret(pipeline.Name))))
+    } else if contentType := segmentContentType(filepath.Ext(fileName)); (contentType != "") && pipeline.hasSegment(fileName) {
+        log.Printf("Serving segment file \"%s\".\n", fileName)
+        out.Header().Set("Content-Type", contentType)
+        serveSegmentFile(out, in, pipeline.Dir + string(os.PathSeparator) + fileName)
+    } else {
+        http.NotFound(out, in)
+    }
+}
+
+// Return true if fileName is one of the segment files of a pipeline,
+// or the initialisation segment that every playlist maps (fMP4),
+// rather than a segment file of another stream or of an extra output
+// that shares its directory
+func (pipeline *Pipeline) hasSegment(fileName string) bool {
+    if (playlistFormat.MapUri != "") && (fileName == playlistFormat.MapUri) {
+        return true
+    }
+    pipeline.fileListLocker.Lock()
+    defer pipeline.fileListLocker.Unlock()
+
+    for element := pipeline.fileList.Front(); element != nil; element = element.Next() {
+        if element.Value.(*Mp3AudioFile).fileName == fileName {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Handle a request under STREAM_PATH_PREFIX, passing it to the
+// pipeline it is for
+func pipelineHandler(out http.ResponseWriter, in *http.Request) {
+    parts := strings.Split(strings.TrimPrefix(in.URL.Path, STREAM_PATH_PREFIX), "/")
+    if (len(parts) == 2) && (parts[1] != "") {
+        if pipeline := findPipeline(parts[0]); pipeline != nil {
+            pipeline.serve(out, in, parts[1])
+            return
+        }
+    }
+    log.Printf("No stream for \"%s\".\n", in.URL.Path)
+    http.NotFound(out, in)
+}
+
+/* End Of File */
@@ -0,0 +1,130 @@
+/* Tests of the pipelines of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check that, when datagrams arrive faster than they are processed,
+// only datagrams are thrown away to make room, the other messages
+// being kept
+func TestQueueKeepsControlMessages(t *testing.T) {
+    pipeline := newPipeline("test", filepath.Join(t.TempDir(), "test" + PLAYLIST_EXTENSION), DEFAULT_CODEC,
+                            PipelineSettings{PcmBufferSeconds: 1, MaxGapFillMs: 500, LowWaterMs: 1000},
+                            newStreamQuota("test", 0, 0, 0))
+    t.Cleanup(func() {
+        removePipeline("test")
+    })
+
+    pipeline.Queue(&OutputBufferState{})
+    pipeline.Queue(&Heartbeat{})
+    pipeline.Queue(&ClientLost{})
+    for x := 0; x < PROCESS_DATAGRAMS_QUEUE_SIZE * 2; x++ {
+        pipeline.Queue(getUrtpDatagram())
+    }
+
+    if dropped := atomic.LoadUint64(&pipeline.datagramsDropped); dropped != uint64(PROCESS_DATAGRAMS_QUEUE_SIZE) {
+        t.Errorf("expected %d datagram(s) to be dropped, got %d.", PROCESS_DATAGRAMS_QUEUE_SIZE, dropped)
+    }
+    if dropped := atomic.LoadUint64(&pipeline.controlDropped); dropped != 0 {
+        t.Errorf("expected no other messages to be dropped, got %d.", dropped)
+    }
+    if pending := atomic.LoadInt32(&pipeline.heartbeatsPending); pending != 1 {
+        t.Errorf("expected 1 heartbeat pending, got %d.", pending)
+    }
+    if _, ok := (<-pipeline.control).(*OutputBufferState); !ok {
+        t.Errorf("expected the output buffer state to have been kept.")
+    }
+    if _, ok := (<-pipeline.control).(*ClientLost); !ok {
+        t.Errorf("expected the lost client to have been kept.")
+    }
+}
+
+// Check that a stream with a URL secret of its own is only served to
+// requests signed with that secret
+func TestStreamSecret(t *testing.T) {
+    newPipeline("loco", filepath.Join(t.TempDir(), "loco" + PLAYLIST_EXTENSION), DEFAULT_CODEC,
+                PipelineSettings{PcmBufferSeconds: 1, MaxGapFillMs: 500, LowWaterMs: 1000},
+                newStreamQuota("loco", 0, 0, 0))
+    savedUrlSecret := urlSecret
+    urlSecret = []byte("the secret of the main stream")
+    streamUrlSecrets["loco"] = []byte("the secret of the loco stream")
+    t.Cleanup(func() {
+        removePipeline("loco")
+        delete(streamUrlSecrets, "loco")
+        urlSecret = savedUrlSecret
+    })
+
+    path := STREAM_PATH_PREFIX + "loco/" + STREAM_PLAYLIST_NAME
+    mainQuery, _, err := signUrlQuery(urlSecret, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    streamQuery, _, err := signUrlQuery(streamUrlSecret("loco"), time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, test := range []struct {
+        query   string
+        wanted  int
+    }{{"", http.StatusForbidden}, {mainQuery, http.StatusForbidden}, {streamQuery, http.StatusOK}} {
+        out := httptest.NewRecorder()
+        pipelineHandler(out, httptest.NewRequest(http.MethodGet, signUri(path, test.query), nil))
+        if out.Code != test.wanted {
+            t.Errorf("expected status %d for \"%s\", got %d.", test.wanted, signUri(path, test.query), out.Code)
+        }
+    }
+}
+
+// Check that a stream serves only its own segment files, not those of
+// another stream in the same directory
+func TestServeOwnSegments(t *testing.T) {
+    dir := t.TempDir()
+    settings := PipelineSettings{PcmBufferSeconds: 1, MaxGapFillMs: 500, LowWaterMs: 1000}
+    first := newPipeline("first", filepath.Join(dir, "first" + PLAYLIST_EXTENSION), DEFAULT_CODEC, settings,
+                         newStreamQuota("first", 0, 0, 0))
+    newPipeline("second", filepath.Join(dir, "second" + PLAYLIST_EXTENSION), DEFAULT_CODEC, settings,
+                newStreamQuota("second", 0, 0, 0))
+    t.Cleanup(func() {
+        removePipeline("first")
+        removePipeline("second")
+    })
+
+    registerBuiltInEncoders()
+    fileName := "segment" + SEGMENT_EXTENSION
+    err := os.WriteFile(filepath.Join(dir, fileName), []byte("audio"), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    first.fileList.PushBack(&Mp3AudioFile{fileName: fileName})
+    for name, wanted := range map[string]int{"first": http.StatusOK, "second": http.StatusNotFound} {
+        out := httptest.NewRecorder()
+        pipelineHandler(out, httptest.NewRequest(http.MethodGet, STREAM_PATH_PREFIX + name + "/" + fileName, nil))
+        if out.Code != wanted {
+            t.Errorf("expected status %d from stream \"%s\", got %d.", wanted, name, out.Code)
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,205 @@
+/* Packet loss concealment for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "math"
+)
+
+// A gap in the audio is filled by pitch repetition, much as in ITU-T
+// G.711 Appendix I.  The concealer keeps the last few tens of
+// milliseconds written to the PCM buffer and, when a gap starts, finds the
+// pitch period of the end of them by autocorrelation.  The last pitch
+// period is then played over and over, the end of each repeat being
+// crossfaded with what came before the start of it so that it loops
+// without a click, and faded out from PLC_FADE_START_MILLISECONDS
+// into the gap so that it is silent by PLC_FADE_END_MILLISECONDS;
+// repeating a waveform for any longer than that sounds like a buzz.
+// When audio resumes the repetition is carried on under the first
+// PLC_CROSSFADE_MILLISECONDS of it and crossfaded into it.  In a stereo
+// stream the pitch period is found from the sum of the channels and
+// the same period of both channels is repeated.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of packet loss concealment
+type Concealer struct {
+    // Interleaved, as are cycle and position
+    history     []int16
+    // The pitch period being repeated, empty if not concealing
+    cycle       []float64
+    // Position in the cycle and the number of samples concealed, in
+    // every channel
+    position    int
+    concealed   int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The highest and lowest pitches looked for, in Hz
+const PLC_MAX_PITCH_HZ int = 400
+const PLC_MIN_PITCH_HZ int = 50
+
+// How much audio is compared when looking for the pitch period
+const PLC_CORRELATION_MILLISECONDS int = 10
+
+// How far into a gap the repetition starts and finishes fading out
+const PLC_FADE_START_MILLISECONDS int = 10
+const PLC_FADE_END_MILLISECONDS int = 60
+
+// How long the repetition is crossfaded into the audio that resumes
+const PLC_CROSSFADE_MILLISECONDS int = 5
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the sum of the channels of a sample of the history
+func (concealer *Concealer) mixed(x int) float64 {
+    var sum float64
+
+    for _, sample := range concealer.history[x * streamChannels:(x + 1) * streamChannels] {
+        sum += float64(sample)
+    }
+
+    return sum
+}
+
+// Return the pitch period, in samples, at the end of the history
+func (concealer *Concealer) findPeriod() int {
+    minPeriod := streamSamplingFrequency / PLC_MAX_PITCH_HZ
+    maxPeriod := streamSamplingFrequency / PLC_MIN_PITCH_HZ
+    var bestCorrelation float64 = -1
+    var bestPeriod int = maxPeriod
+
+    end := len(concealer.history) / streamChannels
+    for period := minPeriod; period <= maxPeriod; period++ {
+        var correlation float64
+        var energy float64
+        for x := end - PLC_CORRELATION_MILLISECONDS * streamSamplingFrequency / 1000; x < end; x++ {
+            delayed := concealer.mixed(x - period)
+            correlation += concealer.mixed(x) * delayed
+            energy += delayed * delayed
+        }
+        if energy > 0 {
+            correlation /= math.Sqrt(energy)
+            if correlation > bestCorrelation {
+                bestCorrelation = correlation
+                bestPeriod = period
+            }
+        }
+    }
+
+    return bestPeriod
+}
+
+// Return the number of samples of history kept, in each channel:
+// enough to look for the longest pitch period
+func historySize() int {
+    return (1000 / PLC_MIN_PITCH_HZ + PLC_CORRELATION_MILLISECONDS) * streamSamplingFrequency / 1000
+}
+
+// Start concealing, returning false if there isn't enough history
+func (concealer *Concealer) start() bool {
+    channels := streamChannels
+    if len(concealer.history) < historySize() * channels {
+        return false
+    }
+    period := concealer.findPeriod()
+    end := len(concealer.history) / channels
+    concealer.cycle = make([]float64, period * channels)
+    for x := range concealer.cycle {
+        concealer.cycle[x] = float64(concealer.history[(end - period) * channels + x])
+    }
+    // Crossfade the end of the cycle into what came before the start
+    // of it, so that the end leads into the start
+    overlap := period / 4
+    for x := 0; x < overlap * channels; x++ {
+        weight := float64(x / channels + 1) / float64(overlap + 1)
+        y := (period - overlap) * channels + x
+        concealer.cycle[y] = concealer.cycle[y] * (1 - weight) + float64(concealer.history[(end - period - overlap) * channels + x]) * weight
+    }
+    concealer.position = 0
+    concealer.concealed = 0
+
+    return true
+}
+
+// Return the next sample of the repetition
+func (concealer *Concealer) next() float64 {
+    fadeStart := PLC_FADE_START_MILLISECONDS * streamSamplingFrequency / 1000
+    fadeEnd := PLC_FADE_END_MILLISECONDS * streamSamplingFrequency / 1000
+    concealed := concealer.concealed / streamChannels
+    gain := 1.0
+    if concealed >= fadeEnd {
+        gain = 0
+    } else if concealed > fadeStart {
+        gain = float64(fadeEnd - concealed) / float64(fadeEnd - fadeStart)
+    }
+    sample := concealer.cycle[concealer.position] * gain
+    concealer.position = (concealer.position + 1) % len(concealer.cycle)
+    concealer.concealed++
+
+    return sample
+}
+
+// Add audio to the history
+func (concealer *Concealer) remember(audio []int16) {
+    concealer.history = append(concealer.history, audio...)
+    if size := historySize() * streamChannels; len(concealer.history) > size {
+        concealer.history = append(concealer.history[:0], concealer.history[len(concealer.history) - size:]...)
+    }
+}
+
+// Return numSamples of audio, in every channel, to fill a gap
+func (concealer *Concealer) Conceal(numSamples int) []int16 {
+    audio := make([]int16, numSamples * streamChannels)
+    if (concealer.cycle != nil) || concealer.start() {
+        for x := range audio {
+            audio[x] = int16(concealer.next())
+        }
+    }
+    concealer.remember(audio)
+
+    return audio
+}
+
+// Crossfade any concealment into a block of audio, in place, that is
+// about to go into the PCM buffer, and remember it
+func (concealer *Concealer) Put(audio []int16) {
+    if concealer.cycle != nil {
+        channels := streamChannels
+        crossfade := PLC_CROSSFADE_MILLISECONDS * streamSamplingFrequency / 1000
+        if crossfade > len(audio) / channels {
+            crossfade = len(audio) / channels
+        }
+        for x := 0; x < crossfade * channels; x++ {
+            weight := float64(x / channels + 1) / float64(crossfade + 1)
+            audio[x] = int16(concealer.next() * (1 - weight) + float64(audio[x]) * weight)
+        }
+        concealer.cycle = nil
+    }
+    concealer.remember(audio)
+}
+
+// Forget the history, e.g. when the stream is reset
+func (concealer *Concealer) Reset() {
+    concealer.history = concealer.history[:0]
+    concealer.cycle = nil
+}
+
+/* End Of File */
@@ -0,0 +1,99 @@
+/* Buffer reuse for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "sync"
+)
+
+// Every datagram from the client, 50 a second for each stream, needs a
+// UrtpDatagram and a slice of decoded audio, so rather than leave them
+// all to the garbage collector they are taken from pools here and given
+// back once processing has finished with them.  Giving back is only an
+// optimisation: anything not given back is collected as usual, so a
+// datagram must only be given back when nothing can refer to it again.
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The capacity of a pooled audio slice, enough for the largest payload
+// of any audio coding scheme
+const POOLED_AUDIO_SAMPLES int = SAMPLING_FREQUENCY * OPUS_MAX_FRAME_MS / 1000
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Pool of decoded audio slices
+var audioPool = sync.Pool{
+    New: func() interface{} {
+        audio := make([]int16, 0, POOLED_AUDIO_SAMPLES)
+        return &audio
+    },
+}
+
+// Pool of URTP datagrams
+var urtpDatagramPool = sync.Pool{
+    New: func() interface{} {
+        return new(UrtpDatagram)
+    },
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a slice for numSamples of decoded audio, from the pool if it
+// fits; the contents are not cleared
+func getAudio(numSamples int) *[]int16 {
+    if numSamples > POOLED_AUDIO_SAMPLES {
+        audio := make([]int16, numSamples)
+        return &audio
+    }
+    audio := audioPool.Get().(*[]int16)
+    *audio = (*audio)[:numSamples]
+
+    return audio
+}
+
+// Give a slice of decoded audio back to the pool
+func putAudio(audio *[]int16) {
+    if (audio != nil) && (cap(*audio) == POOLED_AUDIO_SAMPLES) {
+        audioPool.Put(audio)
+    }
+}
+
+// Return an empty URTP datagram, from the pool
+func getUrtpDatagram() *UrtpDatagram {
+    return urtpDatagramPool.Get().(*UrtpDatagram)
+}
+
+// Give a URTP datagram, and its audio, back to the pool
+func putUrtpDatagram(datagram *UrtpDatagram) {
+    putAudio(datagram.Audio)
+    *datagram = UrtpDatagram{}
+    urtpDatagramPool.Put(datagram)
+}
+
+// Append audio to a byte slice as 16-bit little-endian samples,
+// returning the result
+func appendPcm(data []byte, audio []int16) []byte {
+    for _, sample := range audio {
+        data = append(data, byte(sample), byte(sample >> 8))
+    }
+
+    return data
+}
+
+/* End Of File */
@@ -0,0 +1,257 @@
+/* HLS output probe for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bufio"
+    "crypto/tls"
+    "fmt"
+    "math"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/jessevdk/go-flags"
+)
+
+// The probe subcommand checks the HLS output of a server, this one or
+// any other, as a player would find it: it fetches a playlist, follows
+// a master playlist to each of its variants and, for each media
+// playlist, checks the things that players are fussy about (the
+// #EXTM3U at the start, a target duration that no segment, rounded,
+// goes beyond, a media sequence) and fetches every segment; a live
+// playlist is then fetched again after a target duration to check that
+// it is moving.  Each problem found is printed and the exit code is 0
+// only if there were none.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Command-line items of the probe subcommand
+type ProbeOpts struct {
+    Insecure bool `long:"insecure" description:"don't check the certificate of an HTTPS server"`
+    Polls uint `default:"2" long:"polls" description:"the number of times to fetch a live playlist, a target duration apart, to check that it is moving"`
+    Required struct {
+        Url string `positional-arg-name:"url" description:"the URL of the playlist (master or media) to probe"`
+    } `positional-args:"true" required:"yes"`
+}
+
+// A probe of HLS output
+type Probe struct {
+    client    *http.Client
+    Polls     uint
+    Problems  int
+}
+
+// A media playlist as parsed by a probe
+type ProbePlaylist struct {
+    TargetDuration  int
+    MediaSequence   int64
+    HasSequence     bool
+    Ended           bool
+    Durations       []float64
+    Segments        []string
+    Variants        []string
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Note a problem found by a probe
+func (probe *Probe) problem(format string, args ...interface{}) {
+    probe.Problems++
+    fmt.Printf("PROBLEM: " + format + "\n", args...)
+}
+
+// Parse a playlist, noting anything that isn't right
+func (probe *Probe) parse(address string, playlist []byte) *ProbePlaylist {
+    parsed := &ProbePlaylist{TargetDuration: -1}
+    nextIsVariant := false
+
+    scanner := bufio.NewScanner(strings.NewReader(string(playlist)))
+    for lineNumber := 1; scanner.Scan(); lineNumber++ {
+        line := strings.TrimSpace(scanner.Text())
+        if (lineNumber == 1) && (line != "#EXTM3U") {
+            probe.problem("%s doesn't start with #EXTM3U.", address)
+        }
+        switch {
+            case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+                targetDuration, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"))
+                if (err != nil) || (targetDuration < 0) {
+                    probe.problem("%s has an invalid target duration (\"%s\").", address, line)
+                } else {
+                    parsed.TargetDuration = targetDuration
+                }
+            case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+                mediaSequence, err := strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+                if err != nil {
+                    probe.problem("%s has an invalid media sequence (\"%s\").", address, line)
+                } else {
+                    parsed.MediaSequence = mediaSequence
+                    parsed.HasSequence = true
+                }
+            case strings.HasPrefix(line, "#EXTINF:"):
+                duration, err := strconv.ParseFloat(strings.Split(strings.TrimPrefix(line, "#EXTINF:"), ",")[0], 64)
+                if (err != nil) || (duration < 0) {
+                    probe.problem("%s has an invalid segment duration (\"%s\").", address, line)
+                }
+                parsed.Durations = append(parsed.Durations, duration)
+            case line == "#EXT-X-ENDLIST":
+                parsed.Ended = true
+            case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+                nextIsVariant = true
+            case (line != "") && !strings.HasPrefix(line, "#"):
+                if nextIsVariant {
+                    parsed.Variants = append(parsed.Variants, line)
+                    nextIsVariant = false
+                } else {
+                    parsed.Segments = append(parsed.Segments, line)
+                }
+        }
+    }
+
+    return parsed
+}
+
+// Check a media playlist
+func (probe *Probe) check(address string, parsed *ProbePlaylist) {
+    if parsed.TargetDuration < 0 {
+        probe.problem("%s has no #EXT-X-TARGETDURATION.", address)
+    }
+    if !parsed.HasSequence {
+        fmt.Printf("%s has no #EXT-X-MEDIA-SEQUENCE, players will take it to be 0.\n", address)
+    }
+    if len(parsed.Segments) == 0 {
+        probe.problem("%s has no segments.", address)
+    }
+    if len(parsed.Durations) != len(parsed.Segments) {
+        probe.problem("%s has %d #EXTINF tag(s) for %d segment(s).", address, len(parsed.Durations), len(parsed.Segments))
+    }
+    for x, duration := range parsed.Durations {
+        if (parsed.TargetDuration >= 0) && (int(math.Floor(duration + 0.5)) > parsed.TargetDuration) {
+            probe.problem("%s has a segment (number %d) of %g second(s), longer than the target duration of %d second(s).",
+                          address, x + 1, duration, parsed.TargetDuration)
+        }
+    }
+}
+
+// Fetch the segments of a media playlist
+func (probe *Probe) fetchSegments(playlistUrl *url.URL, parsed *ProbePlaylist) {
+    var totalBytes int64
+
+    for _, segment := range parsed.Segments {
+        segmentUrl, err := playlistUrl.Parse(segment)
+        if err != nil {
+            probe.problem("segment URI \"%s\" is invalid (%s).", segment, err.Error())
+            continue
+        }
+        _, numBytes, err := loadTestGet(probe.client, segmentUrl.String(), false)
+        if err != nil {
+            probe.problem("unable to fetch segment %s (%s).", segmentUrl.String(), err.Error())
+        } else if numBytes == 0 {
+            probe.problem("segment %s is empty.", segmentUrl.String())
+        }
+        totalBytes += numBytes
+    }
+    fmt.Printf("Fetched %d segment(s), %d byte(s), of %s.\n", len(parsed.Segments), totalBytes, playlistUrl.String())
+}
+
+// Probe a playlist, following a master playlist to its variants
+func (probe *Probe) probePlaylist(playlistUrl *url.URL, isVariant bool) {
+    var last *ProbePlaylist
+
+    address := playlistUrl.String()
+    for poll := uint(0); poll < probe.Polls; poll++ {
+        playlist, _, err := loadTestGet(probe.client, address, true)
+        if err != nil {
+            probe.problem("unable to fetch playlist %s (%s).", address, err.Error())
+            return
+        }
+        parsed := probe.parse(address, playlist)
+        if len(parsed.Variants) > 0 {
+            if isVariant {
+                probe.problem("%s is a master playlist but is a variant of one.", address)
+                return
+            }
+            fmt.Printf("%s is a master playlist of %d variant(s).\n", address, len(parsed.Variants))
+            for _, variant := range parsed.Variants {
+                variantUrl, err := playlistUrl.Parse(variant)
+                if err != nil {
+                    probe.problem("variant URI \"%s\" is invalid (%s).", variant, err.Error())
+                } else {
+                    probe.probePlaylist(variantUrl, true)
+                }
+            }
+            return
+        }
+        if last == nil {
+            fmt.Printf("%s is a media playlist of %d segment(s), target duration %d second(s).\n",
+                       address, len(parsed.Segments), parsed.TargetDuration)
+            probe.check(address, parsed)
+            probe.fetchSegments(playlistUrl, parsed)
+        } else if (parsed.MediaSequence == last.MediaSequence) &&
+                  (strings.Join(parsed.Segments, "\n") == strings.Join(last.Segments, "\n")) {
+            probe.problem("%s hasn't changed in %d second(s) but has no #EXT-X-ENDLIST.", address, last.TargetDuration)
+        } else {
+            fmt.Printf("%s is moving: media sequence %d, was %d.\n", address, parsed.MediaSequence, last.MediaSequence)
+        }
+        if parsed.Ended {
+            fmt.Printf("%s has ended (#EXT-X-ENDLIST).\n", address)
+            return
+        }
+        last = parsed
+        if poll + 1 < probe.Polls {
+            wait := time.Duration(parsed.TargetDuration) * time.Second
+            if wait < time.Second {
+                wait = time.Second
+            }
+            time.Sleep(wait)
+        }
+    }
+}
+
+// The probe subcommand
+func probe(args []string) {
+    var probeOpts ProbeOpts
+
+    parser := flags.NewParser(&probeOpts, flags.Default)
+    parser.Name = "ioc-server probe"
+    _, err := parser.ParseArgs(args)
+    if err != nil {
+        os.Exit(-1)
+    }
+    playlistUrl, err := url.Parse(probeOpts.Required.Url)
+    if (err != nil) || ((playlistUrl.Scheme != "http") && (playlistUrl.Scheme != "https")) {
+        fmt.Fprintf(os.Stderr, "\"%s\" is not an HTTP or HTTPS URL.\n", probeOpts.Required.Url)
+        os.Exit(-1)
+    }
+
+    hlsProbe := &Probe{client: &http.Client{Timeout: LOAD_TEST_HTTP_TIMEOUT}, Polls: probeOpts.Polls}
+    if probeOpts.Insecure {
+        hlsProbe.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+    }
+    if hlsProbe.Polls == 0 {
+        hlsProbe.Polls = 1
+    }
+    hlsProbe.probePlaylist(playlistUrl, false)
+    fmt.Printf("Probe finished, %d problem(s).\n", hlsProbe.Problems)
+    if hlsProbe.Problems > 0 {
+        os.Exit(1)
+    }
+}
+
+/* End Of File */
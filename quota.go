@@ -0,0 +1,197 @@
+/* Per-stream resource quotas for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "runtime/debug"
+    "sync"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The resource limits applied to a stream; a zero limit means
+// unlimited
+type StreamQuota struct {
+    Name                     string
+    MaxIngestBytesPerSecond  int
+    MaxDiskBytes             int64
+    MaxCpuPercent            int
+    locker                   sync.Mutex
+    ingestTokens             int
+    ingestRefilled           time.Time
+    cpuUsed                  time.Duration
+    cpuWindowStart           time.Time
+    cpuExceeded              bool
+    // The bytes of the segment files of the stream on disk, which
+    // share a directory with those of other streams and of the extra
+    // outputs, so can't simply be measured
+    diskUsed                 int64
+    ingestDropped            int
+    diskDropped              int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The window over which CPU usage is measured
+const QUOTA_CPU_WINDOW time.Duration = time.Second
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The quota for the stream
+var streamQuota *StreamQuota = newStreamQuota("", 0, 0, 0)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a stream quota
+func newStreamQuota(name string, maxIngestBytesPerSecond uint, maxDiskMegabytes uint, maxCpuPercent uint) *StreamQuota {
+    quota := new(StreamQuota)
+    quota.Name = name
+    quota.MaxIngestBytesPerSecond = int(maxIngestBytesPerSecond)
+    quota.MaxDiskBytes = int64(maxDiskMegabytes) * 1024 * 1024
+    quota.MaxCpuPercent = int(maxCpuPercent)
+    quota.ingestTokens = quota.MaxIngestBytesPerSecond
+    quota.ingestRefilled = time.Now()
+    quota.cpuWindowStart = time.Now()
+    if (maxIngestBytesPerSecond > 0) || (maxDiskMegabytes > 0) || (maxCpuPercent > 0) {
+        log.Printf("Stream \"%s\" quota: ingest %d byte(s)/s, disk %d byte(s), CPU %d%% (0 means unlimited).\n",
+                   name, quota.MaxIngestBytesPerSecond, quota.MaxDiskBytes, quota.MaxCpuPercent)
+    }
+
+    return quota
+}
+
+// Return true if numBytes of ingest may be accepted for the stream;
+// a token bucket of one second's worth of bytes is used.  If the CPU
+// quota is exceeded ingest is also refused so that the stream sheds
+// load rather than starving everything else on the box
+func (quota *StreamQuota) AllowIngest(numBytes int) bool {
+    allowed := true
+
+    quota.locker.Lock()
+    if quota.MaxIngestBytesPerSecond > 0 {
+        now := time.Now()
+        quota.ingestTokens += int(now.Sub(quota.ingestRefilled) * time.Duration(quota.MaxIngestBytesPerSecond) / time.Second)
+        if quota.ingestTokens > quota.MaxIngestBytesPerSecond {
+            quota.ingestTokens = quota.MaxIngestBytesPerSecond
+        }
+        quota.ingestRefilled = now
+        if quota.ingestTokens >= numBytes {
+            quota.ingestTokens -= numBytes
+        } else {
+            allowed = false
+        }
+    }
+    if quota.cpuExceeded {
+        allowed = false
+    }
+    if !allowed {
+        quota.ingestDropped++
+        if quota.ingestDropped % 100 == 1 {
+            log.Printf("Stream \"%s\" is over its ingest or CPU quota, %d datagram(s) dropped so far.\n", quota.Name, quota.ingestDropped)
+        }
+    }
+    quota.locker.Unlock()
+
+    return allowed
+}
+
+// Charge some CPU time to the stream; Go can't tell how much CPU a
+// go routine has used so this is the elapsed time of the processing
+// steps of the stream (see runIsolated()), which will be more than the
+// CPU time if the box is busy or a step waits on something, but
+// doesn't include the time the stream spends waiting for work
+func (quota *StreamQuota) ChargeCpu(used time.Duration) {
+    if quota.MaxCpuPercent > 0 {
+        quota.locker.Lock()
+        quota.cpuUsed += used
+        now := time.Now()
+        window := now.Sub(quota.cpuWindowStart)
+        if window >= QUOTA_CPU_WINDOW {
+            exceeded := quota.cpuUsed * 100 > window * time.Duration(quota.MaxCpuPercent)
+            if exceeded && !quota.cpuExceeded {
+                log.Printf("Stream \"%s\" used %d ms of CPU in the last %d ms, exceeding its quota of %d%%.\n", quota.Name,
+                           quota.cpuUsed / time.Millisecond, window / time.Millisecond, quota.MaxCpuPercent)
+            } else if !exceeded && quota.cpuExceeded {
+                log.Printf("Stream \"%s\" is back within its CPU quota of %d%%.\n", quota.Name, quota.MaxCpuPercent)
+            }
+            quota.cpuExceeded = exceeded
+            quota.cpuUsed = 0
+            quota.cpuWindowStart = now
+        }
+        quota.locker.Unlock()
+    }
+}
+
+// Return true if a segment file of numBytes may be written for the
+// stream without exceeding the disk quota, in which case it is counted
+// against the quota until given back with FreeDisk()
+func (quota *StreamQuota) AllowDisk(numBytes int) bool {
+    allowed := true
+    quota.locker.Lock()
+    if quota.MaxDiskBytes > 0 {
+        used := quota.diskUsed + int64(numBytes)
+        if used > quota.MaxDiskBytes {
+            allowed = false
+            quota.diskDropped++
+            log.Printf("Stream \"%s\" would use %d byte(s) of disk, more than its quota of %d, %d segment(s) dropped so far.\n",
+                       quota.Name, used, quota.MaxDiskBytes, quota.diskDropped)
+        }
+    }
+    if allowed {
+        quota.diskUsed += int64(numBytes)
+    }
+    quota.locker.Unlock()
+
+    return allowed
+}
+
+// Give back to the disk quota of the stream a segment file of
+// numBytes that has been removed
+func (quota *StreamQuota) FreeDisk(numBytes int) {
+    quota.locker.Lock()
+    quota.diskUsed -= int64(numBytes)
+    if quota.diskUsed < 0 {
+        quota.diskUsed = 0
+    }
+    quota.locker.Unlock()
+}
+
+// Run a processing step (decoding, processing or encoding) on behalf
+// of a stream, charging the time it takes to the CPU quota of the
+// stream and recovering from any panic so that a failure in one stream
+// doesn't take the server down; returns false if a panic occurred
+func runIsolated(quota *StreamQuota, function func()) (ok bool) {
+    started := time.Now()
+    defer func() {
+        quota.ChargeCpu(time.Since(started))
+        if recovered := recover(); recovered != nil {
+            log.Printf("Stream \"%s\" recovered from a failure (%v):\n%s", quota.Name, recovered, debug.Stack())
+            ok = false
+        }
+    }()
+    function()
+
+    return true
+}
+
+/* End Of File */
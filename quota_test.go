@@ -0,0 +1,88 @@
+/* Tests of the stream quotas of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check that only the processing steps run by runIsolated() are
+// charged to the CPU quota and that a step that panics is survived
+func TestRunIsolated(t *testing.T) {
+    quota := newStreamQuota("test", 0, 0, 10)
+
+    // Time spent outside a step isn't charged
+    time.Sleep(QUOTA_CPU_WINDOW / 10)
+    if !runIsolated(quota, func() {}) {
+        t.Fatalf("expected the step to succeed.")
+    }
+    if quota.cpuUsed >= QUOTA_CPU_WINDOW / 20 {
+        t.Fatalf("expected almost nothing to be charged, got %v.", quota.cpuUsed)
+    }
+
+    // A step that takes a fifth of the window is, which is over the
+    // quota of 10%, and so is a step that panics
+    if !runIsolated(quota, func() {
+        time.Sleep(QUOTA_CPU_WINDOW / 5)
+    }) {
+        t.Fatalf("expected the step to succeed.")
+    }
+    if quota.cpuUsed < QUOTA_CPU_WINDOW / 5 {
+        t.Fatalf("expected at least %v to be charged, got %v.", QUOTA_CPU_WINDOW / 5, quota.cpuUsed)
+    }
+    quota.cpuWindowStart = time.Now().Add(-QUOTA_CPU_WINDOW)
+    if runIsolated(quota, func() {
+        panic("test")
+    }) {
+        t.Fatalf("expected the step to fail.")
+    }
+    if quota.AllowIngest(1) {
+        t.Fatalf("expected ingest to be refused when over the CPU quota.")
+    }
+
+    // And the next window, with nothing charged, is back within it
+    quota.cpuWindowStart = time.Now().Add(-QUOTA_CPU_WINDOW)
+    runIsolated(quota, func() {})
+    if !quota.AllowIngest(1) {
+        t.Fatalf("expected ingest to be allowed when back within the CPU quota.")
+    }
+}
+
+// Check that each stream is charged only for its own segment files,
+// getting back what a removed one took up
+func TestDiskQuota(t *testing.T) {
+    quota := newStreamQuota("test", 0, 1, 0)
+    other := newStreamQuota("other", 0, 1, 0)
+    segmentSize := 400 * 1024
+
+    if !quota.AllowDisk(segmentSize) || !quota.AllowDisk(segmentSize) {
+        t.Fatalf("expected two segments to be within the disk quota.")
+    }
+    if quota.AllowDisk(segmentSize) {
+        t.Fatalf("expected a third segment to be over the disk quota.")
+    }
+    if !other.AllowDisk(segmentSize) {
+        t.Fatalf("expected another stream to be unaffected by the disk used by the first.")
+    }
+    quota.FreeDisk(segmentSize)
+    if !quota.AllowDisk(segmentSize) {
+        t.Fatalf("expected a segment to be within the disk quota once one has been removed.")
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,194 @@
+/* Ingest rate limiting for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// Rate limits are applied per source IP address so that a misbehaving
+// or malicious sender can't drive the encoder and the disk at an
+// unbounded rate, nor crowd out the real client.  UDP datagrams are
+// limited with token buckets (datagrams and bytes per second) and TCP
+// connections with a sliding one minute window.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The token buckets of one source
+type SourceBucket struct {
+    datagramTokens  float64
+    byteTokens      float64
+    refilled        time.Time
+    dropped         int
+}
+
+// Per-source limits on UDP datagrams; a zero limit means unlimited
+type SourceLimiter struct {
+    MaxDatagramsPerSecond  int
+    MaxBytesPerSecond      int
+    locker                 sync.Mutex
+    sources                map[string]*SourceBucket
+    pruned                 time.Time
+}
+
+// Per-source limit on TCP connections; a zero limit means unlimited
+type ConnectionLimiter struct {
+    MaxPerMinute  int
+    locker        sync.Mutex
+    sources       map[string][]time.Time
+    pruned        time.Time
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How often to forget about sources that have gone quiet
+const RATE_LIMIT_PRUNE_PERIOD time.Duration = time.Minute
+
+// The window over which TCP connections are counted
+const CONNECTION_LIMIT_WINDOW time.Duration = time.Minute
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The limits on incoming UDP datagrams and TCP connections
+var udpSourceLimiter = newSourceLimiter(0, 0)
+var tcpConnectionLimiter = newConnectionLimiter(0)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a UDP source limiter
+func newSourceLimiter(maxDatagramsPerSecond uint, maxBytesPerSecond uint) *SourceLimiter {
+    limiter := new(SourceLimiter)
+    limiter.MaxDatagramsPerSecond = int(maxDatagramsPerSecond)
+    limiter.MaxBytesPerSecond = int(maxBytesPerSecond)
+    limiter.sources = make(map[string]*SourceBucket)
+    limiter.pruned = time.Now()
+    if (maxDatagramsPerSecond > 0) || (maxBytesPerSecond > 0) {
+        log.Printf("UDP ingest limited to %d datagram(s)/s and %d byte(s)/s per source (0 means unlimited).\n",
+                   maxDatagramsPerSecond, maxBytesPerSecond)
+    }
+
+    return limiter
+}
+
+// Return true if a datagram of numBytes from source may be accepted
+func (limiter *SourceLimiter) Allow(source string, numBytes int) bool {
+    allowed := true
+
+    if (limiter.MaxDatagramsPerSecond > 0) || (limiter.MaxBytesPerSecond > 0) {
+        now := time.Now()
+        limiter.locker.Lock()
+        bucket := limiter.sources[source]
+        if bucket == nil {
+            // Start with a full bucket
+            bucket = &SourceBucket{datagramTokens: float64(limiter.MaxDatagramsPerSecond),
+                                   byteTokens: float64(limiter.MaxBytesPerSecond), refilled: now}
+            limiter.sources[source] = bucket
+        }
+        elapsed := now.Sub(bucket.refilled).Seconds()
+        bucket.refilled = now
+        if limiter.MaxDatagramsPerSecond > 0 {
+            bucket.datagramTokens += elapsed * float64(limiter.MaxDatagramsPerSecond)
+            if bucket.datagramTokens > float64(limiter.MaxDatagramsPerSecond) {
+                bucket.datagramTokens = float64(limiter.MaxDatagramsPerSecond)
+            }
+            allowed = bucket.datagramTokens >= 1
+        }
+        if limiter.MaxBytesPerSecond > 0 {
+            bucket.byteTokens += elapsed * float64(limiter.MaxBytesPerSecond)
+            if bucket.byteTokens > float64(limiter.MaxBytesPerSecond) {
+                bucket.byteTokens = float64(limiter.MaxBytesPerSecond)
+            }
+            allowed = allowed && (bucket.byteTokens >= float64(numBytes))
+        }
+        if allowed {
+            bucket.datagramTokens--
+            bucket.byteTokens -= float64(numBytes)
+        } else {
+            bucket.dropped++
+            if bucket.dropped % 100 == 1 {
+                log.Printf("UDP source %s is over its rate limit, %d datagram(s) dropped so far.\n", source, bucket.dropped)
+            }
+        }
+        // Forget sources that have been quiet for a while
+        if now.Sub(limiter.pruned) > RATE_LIMIT_PRUNE_PERIOD {
+            for address, item := range limiter.sources {
+                if now.Sub(item.refilled) > RATE_LIMIT_PRUNE_PERIOD {
+                    delete(limiter.sources, address)
+                }
+            }
+            limiter.pruned = now
+        }
+        limiter.locker.Unlock()
+    }
+
+    return allowed
+}
+
+// Create a TCP connection limiter
+func newConnectionLimiter(maxPerMinute uint) *ConnectionLimiter {
+    limiter := new(ConnectionLimiter)
+    limiter.MaxPerMinute = int(maxPerMinute)
+    limiter.sources = make(map[string][]time.Time)
+    limiter.pruned = time.Now()
+    if maxPerMinute > 0 {
+        log.Printf("TCP connections limited to %d per minute per source.\n", maxPerMinute)
+    }
+
+    return limiter
+}
+
+// Return true if a connection from source may be accepted
+func (limiter *ConnectionLimiter) Allow(source string) bool {
+    allowed := true
+
+    if limiter.MaxPerMinute > 0 {
+        now := time.Now()
+        limiter.locker.Lock()
+        var recent []time.Time
+        for _, connected := range limiter.sources[source] {
+            if now.Sub(connected) < CONNECTION_LIMIT_WINDOW {
+                recent = append(recent, connected)
+            }
+        }
+        if len(recent) < limiter.MaxPerMinute {
+            recent = append(recent, now)
+        } else {
+            allowed = false
+        }
+        limiter.sources[source] = recent
+        // Forget sources that haven't connected for a while
+        if now.Sub(limiter.pruned) > RATE_LIMIT_PRUNE_PERIOD {
+            for address, times := range limiter.sources {
+                if (len(times) == 0) || (now.Sub(times[len(times) - 1]) > CONNECTION_LIMIT_WINDOW) {
+                    delete(limiter.sources, address)
+                }
+            }
+            limiter.pruned = now
+        }
+        limiter.locker.Unlock()
+    }
+
+    return allowed
+}
+
+/* End Of File */
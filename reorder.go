@@ -0,0 +1,136 @@
+/* Sequence number handling for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A datagram waiting in the reorder buffer
+type reorderItem struct {
+    datagram  *UrtpDatagram
+    arrived   time.Time
+}
+
+// Buffer that puts URTP datagrams back into sequence number order,
+// holding on to them for up to Tolerance blocks while waiting for
+// any that are missing
+type ReorderBuffer struct {
+    Tolerance   int
+    Started     bool
+    Expected    uint16
+    Pending     []reorderItem
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// A sequence number this far behind the expected one is assumed to be
+// a client that has restarted rather than a late datagram
+const SEQUENCE_RESYNC_THRESHOLD int = MAX_GAP_FILL_MILLISECONDS / BLOCK_DURATION_MS
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the distance from one 16-bit sequence number to another,
+// taking wrap-around into account; the result is negative if "to"
+// is older than "from"
+func sequenceDistance(from uint16, to uint16) int {
+    return int(int16(to - from))
+}
+
+// Throw away the datagrams waiting in a reorder buffer
+func (reorder *ReorderBuffer) discardPending() {
+    for _, item := range reorder.Pending {
+        putUrtpDatagram(item.datagram)
+    }
+    reorder.Pending = nil
+}
+
+// Reset a reorder buffer, e.g. when the stream is reset
+func (reorder *ReorderBuffer) Reset() {
+    reorder.Started = false
+    reorder.Expected = 0
+    reorder.discardPending()
+}
+
+// Put a newly arrived datagram into the reorder buffer
+func (reorder *ReorderBuffer) Put(datagram *UrtpDatagram, now time.Time) {
+    if !reorder.Started {
+        reorder.Started = true
+        reorder.Expected = datagram.SequenceNumber
+    }
+
+    distance := sequenceDistance(reorder.Expected, datagram.SequenceNumber)
+    if distance < 0 {
+        if -distance <= SEQUENCE_RESYNC_THRESHOLD {
+            log.Printf("Dropping late datagram (expected sequence number %d or later, received %d).\n",
+                       reorder.Expected, datagram.SequenceNumber)
+            putUrtpDatagram(datagram)
+            return
+        }
+        log.Printf("Sequence number jumped back from %d to %d, resynchronising.\n",
+                   reorder.Expected, datagram.SequenceNumber)
+        reorder.Expected = datagram.SequenceNumber
+        reorder.discardPending()
+        distance = 0
+    }
+
+    // Insert in sequence number order, throwing away duplicates
+    position := len(reorder.Pending)
+    for x, item := range reorder.Pending {
+        itemDistance := sequenceDistance(reorder.Expected, item.datagram.SequenceNumber)
+        if itemDistance == distance {
+            log.Printf("Dropping duplicate datagram (sequence number %d).\n", datagram.SequenceNumber)
+            putUrtpDatagram(datagram)
+            return
+        }
+        if itemDistance > distance {
+            position = x
+            break
+        }
+    }
+    reorder.Pending = append(reorder.Pending, reorderItem{})
+    copy(reorder.Pending[position + 1:], reorder.Pending[position:])
+    reorder.Pending[position] = reorderItem{datagram: datagram, arrived: now}
+}
+
+// Get the datagrams that are ready to be processed, in order.  A
+// datagram is ready if it is the next one expected or if we have
+// waited long enough (in datagrams or in time) for the ones before it
+func (reorder *ReorderBuffer) Get(now time.Time) []*UrtpDatagram {
+    var ready []*UrtpDatagram
+    maxWait := time.Duration(reorder.Tolerance * BLOCK_DURATION_MS) * time.Millisecond
+
+    for len(reorder.Pending) > 0 {
+        item := reorder.Pending[0]
+        if (item.datagram.SequenceNumber != reorder.Expected) && (len(reorder.Pending) <= reorder.Tolerance) &&
+           (now.Sub(item.arrived) <= maxWait) {
+            break
+        }
+        ready = append(ready, item.datagram)
+        reorder.Expected = item.datagram.SequenceNumber + 1
+        reorder.Pending = reorder.Pending[1:]
+    }
+
+    return ready
+}
+
+/* End Of File */
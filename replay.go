@@ -0,0 +1,330 @@
+/* Capture replay for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "time"
+    "github.com/jessevdk/go-flags"
+    "github.com/RobMeades/ioc-server/urtp"
+)
+
+// The replay subcommand feeds a capture file to a server as a client
+// would, so that a problem heard on the stream can be reproduced, or a
+// change tried, with the same audio again and again.  A capture is
+// either a WAV file, e.g. one written with --wavfile, or a headerless
+// file of 16-bit little-endian PCM, e.g. one written with --rawpcmfile,
+// for which the sampling frequency and number of channels must be
+// given.  The audio is resampled, if necessary, to SAMPLING_FREQUENCY,
+// which the server assumes of a client that hasn't said otherwise, and
+// is sent in blocks of BLOCK_DURATION_MS as URTP datagrams of
+// little-endian PCM over UDP or TCP, paced at real time or faster.
+// The UrtpSender here is also what the bench subcommand uses.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Command-line items of the replay subcommand
+type ReplayOpts struct {
+    Server string `required:"yes" long:"server" description:"the host and input port of the server, e.g. localhost:1234"`
+    Tcp bool `long:"tcp" description:"send over TCP rather than UDP"`
+    Crc bool `long:"crc" description:"add a CRC to the header of each datagram"`
+    Speed float64 `default:"1" long:"speed" description:"how many times faster than real time to send the audio"`
+    Loop bool `long:"loop" description:"start the capture again each time it ends, until interrupted"`
+    SamplingFrequency int `default:"16000" long:"rate" description:"the sampling frequency in Hz of a raw PCM capture"`
+    Channels int `default:"1" long:"channels" description:"the number of channels, 1 or 2, of a raw PCM capture"`
+    Required struct {
+        Capture string `positional-arg-name:"capture" description:"the WAV or raw 16-bit little-endian PCM file to replay"`
+    } `positional-args:"true" required:"yes"`
+}
+
+// A capture file being read
+type Capture struct {
+    handle             *os.File
+    reader             io.Reader
+    SamplingFrequency  int
+    Channels           int
+}
+
+// Something that sends audio to a server as a client would
+type UrtpSender struct {
+    connection      net.Conn
+    crc             bool
+    sequenceNumber  uint16
+    timestamp       uint64
+    Datagrams       int64
+    Bytes           int64
+    Errors          int64
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Open a capture file: a WAV file, else raw PCM of the given sampling
+// frequency and number of channels
+func openCapture(fileName string, samplingFrequency int, channels int) (*Capture, error) {
+    handle, err := os.Open(fileName)
+    if err != nil {
+        return nil, err
+    }
+    capture := &Capture{handle: handle, reader: bufio.NewReader(handle), SamplingFrequency: samplingFrequency,
+                        Channels: channels}
+    header := make([]byte, 12)
+    numBytes, _ := io.ReadFull(capture.reader, header)
+    if (numBytes == len(header)) && (string(header[0:4]) == "RIFF") && (string(header[8:12]) == "WAVE") {
+        err = capture.readWavHeader()
+    } else {
+        // Raw PCM: what has been read is audio
+        capture.reader = io.MultiReader(bytes.NewReader(header[:numBytes]), capture.reader)
+    }
+    if (err == nil) && ((capture.Channels < 1) || (capture.Channels > 2)) {
+        err = errors.New(fmt.Sprintf("%d channel(s) can't be replayed, only 1 or 2", capture.Channels))
+    }
+    if (err == nil) && ((capture.SamplingFrequency < MIN_SAMPLING_FREQUENCY) || (capture.SamplingFrequency > MAX_SAMPLING_FREQUENCY)) {
+        err = errors.New(fmt.Sprintf("a sampling frequency of %d Hz can't be replayed, only %d to %d Hz",
+                                     capture.SamplingFrequency, MIN_SAMPLING_FREQUENCY, MAX_SAMPLING_FREQUENCY))
+    }
+    if err != nil {
+        handle.Close()
+        return nil, err
+    }
+
+    return capture, nil
+}
+
+// Read the chunks of a WAV file up to the audio, which must be 16-bit
+// PCM, leaving the reader at the start of it
+func (capture *Capture) readWavHeader() error {
+    var haveFormat bool
+
+    for {
+        chunkHeader := make([]byte, 8)
+        _, err := io.ReadFull(capture.reader, chunkHeader)
+        if err != nil {
+            return errors.New("no audio in WAV file")
+        }
+        chunkSize := int64(binary.LittleEndian.Uint32(chunkHeader[4:]))
+        switch string(chunkHeader[0:4]) {
+            case "fmt ":
+                format := make([]byte, chunkSize + chunkSize % 2)
+                _, err = io.ReadFull(capture.reader, format)
+                if (err != nil) || (len(format) < 16) {
+                    return errors.New("WAV format chunk is too short")
+                }
+                formatTag := binary.LittleEndian.Uint16(format[0:])
+                if ((formatTag != 1) && (formatTag != 0xfffe)) || (binary.LittleEndian.Uint16(format[14:]) != 16) {
+                    return errors.New("only 16-bit PCM WAV files can be replayed")
+                }
+                capture.Channels = int(binary.LittleEndian.Uint16(format[2:]))
+                capture.SamplingFrequency = int(binary.LittleEndian.Uint32(format[4:]))
+                haveFormat = true
+            case "data":
+                if !haveFormat {
+                    return errors.New("WAV file has no format chunk before its audio")
+                }
+                if chunkSize > 0 {
+                    // A WAV file that has only just been opened has a
+                    // size of 0, in which case read to the end
+                    capture.reader = io.LimitReader(capture.reader, chunkSize)
+                }
+                return nil
+            default:
+                _, err = io.CopyN(io.Discard, capture.reader, chunkSize + chunkSize % 2)
+                if err != nil {
+                    return errors.New("no audio in WAV file")
+                }
+        }
+    }
+}
+
+// Read up to a block of audio, interleaved, from a capture, returning
+// io.EOF at the end
+func (capture *Capture) readBlock() ([]int16, error) {
+    data := make([]byte, capture.SamplingFrequency * BLOCK_DURATION_MS / 1000 * capture.Channels * URTP_SAMPLE_SIZE)
+    numBytes, err := io.ReadFull(capture.reader, data)
+    numBytes -= numBytes % (capture.Channels * URTP_SAMPLE_SIZE)
+    if numBytes == 0 {
+        if (err == nil) || (err == io.ErrUnexpectedEOF) {
+            err = io.EOF
+        }
+        return nil, err
+    }
+    pcm := make([]int16, numBytes / URTP_SAMPLE_SIZE)
+    for x := range pcm {
+        pcm[x] = int16(binary.LittleEndian.Uint16(data[x * URTP_SAMPLE_SIZE:]))
+    }
+
+    return pcm, nil
+}
+
+// Start a capture again from the beginning
+func (capture *Capture) rewind() error {
+    reopened, err := openCapture(capture.handle.Name(), capture.SamplingFrequency, capture.Channels)
+    if err != nil {
+        return err
+    }
+    capture.handle.Close()
+    *capture = *reopened
+
+    return nil
+}
+
+// Close a capture
+func (capture *Capture) Close() {
+    capture.handle.Close()
+}
+
+// Connect to the input port of a server at address, over TCP if tcp
+// is true, else UDP, adding a CRC to each datagram if crc is true
+func newUrtpSender(address string, tcp bool, crc bool) (*UrtpSender, error) {
+    network := "udp"
+    if tcp {
+        network = "tcp"
+    }
+    connection, err := net.Dial(network, address)
+    if err != nil {
+        return nil, err
+    }
+    // Whatever the server sends back (capabilities, timing, NACKs) is
+    // of no interest but must be read so that it doesn't back up
+    go io.Copy(io.Discard, connection)
+
+    return &UrtpSender{connection: connection, crc: crc,
+                       timestamp: uint64(time.Now().UnixNano() / int64(time.Microsecond))}, nil
+}
+
+// Send a block of interleaved PCM to the server
+func (sender *UrtpSender) send(pcm []int16, channels int) error {
+    // The payload of more than one channel is the payload of each
+    // channel one after another
+    samples := len(pcm) / channels
+    payload := make([]byte, len(pcm) * URTP_SAMPLE_SIZE)
+    for x, sample := range pcm {
+        offset := ((x % channels) * samples + x / channels) * URTP_SAMPLE_SIZE
+        binary.LittleEndian.PutUint16(payload[offset:], uint16(sample))
+    }
+    datagram := urtp.Format(urtp.PCM_SIGNED_16_BIT_LITTLE_ENDIAN, channels, sender.sequenceNumber, sender.timestamp,
+                            payload, sender.crc)
+    sender.sequenceNumber++
+    sender.timestamp += uint64(BLOCK_DURATION_MS * 1000)
+    _, err := sender.connection.Write(datagram)
+    if err == nil {
+        sender.Datagrams++
+        sender.Bytes += int64(len(datagram))
+    } else {
+        sender.Errors++
+    }
+
+    return err
+}
+
+// Close the connection to the server
+func (sender *UrtpSender) Close() {
+    sender.connection.Close()
+}
+
+// Wait until it is time to send block number block of a stream
+// started at started, sent at speed times real time (flat out if 0)
+func paceBlock(started time.Time, block int64, speed float64) {
+    if speed > 0 {
+        due := started.Add(time.Duration(float64(block) * float64(BLOCK_DURATION_MS) * float64(time.Millisecond) / speed))
+        if wait := time.Until(due); wait > 0 {
+            time.Sleep(wait)
+        }
+    }
+}
+
+// The replay subcommand
+func replay(args []string) {
+    var replayOpts ReplayOpts
+    var resampler *Resampler
+    var pending []int16
+    var block int64
+
+    parser := flags.NewParser(&replayOpts, flags.Default)
+    parser.Name = "ioc-server replay"
+    _, err := parser.ParseArgs(args)
+    if err != nil {
+        os.Exit(-1)
+    }
+    if replayOpts.Speed <= 0 {
+        fmt.Fprintf(os.Stderr, "The speed must be more than 0.\n")
+        os.Exit(-1)
+    }
+
+    capture, err := openCapture(replayOpts.Required.Capture, replayOpts.SamplingFrequency, replayOpts.Channels)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Unable to open capture \"%s\" (%s).\n", replayOpts.Required.Capture, err.Error())
+        os.Exit(-1)
+    }
+    defer capture.Close()
+    sender, err := newUrtpSender(replayOpts.Server, replayOpts.Tcp, replayOpts.Crc)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Unable to connect to %s (%s).\n", replayOpts.Server, err.Error())
+        os.Exit(-1)
+    }
+    defer sender.Close()
+    if capture.SamplingFrequency != SAMPLING_FREQUENCY {
+        resampler = newResampler(capture.SamplingFrequency, SAMPLING_FREQUENCY, capture.Channels)
+    }
+    fmt.Printf("Replaying \"%s\" (%d Hz, %d channel(s)) to %s at %g times real time.\n", replayOpts.Required.Capture,
+               capture.SamplingFrequency, capture.Channels, replayOpts.Server, replayOpts.Speed)
+
+    blockSize := SAMPLES_PER_BLOCK * capture.Channels
+    started := time.Now()
+    for {
+        pcm, err := capture.readBlock()
+        if (err == io.EOF) && replayOpts.Loop {
+            err = capture.rewind()
+            if err == nil {
+                continue
+            }
+        }
+        if err != nil {
+            if err != io.EOF {
+                fmt.Fprintf(os.Stderr, "Unable to read capture (%s).\n", err.Error())
+            }
+            break
+        }
+        if resampler != nil {
+            pcm = resampler.Process(pcm)
+        }
+        pending = append(pending, pcm...)
+        for len(pending) >= blockSize {
+            paceBlock(started, block, replayOpts.Speed)
+            err = sender.send(pending[:blockSize], capture.Channels)
+            if (err != nil) && (sender.Errors == 1) {
+                fmt.Fprintf(os.Stderr, "Unable to send to %s (%s).\n", replayOpts.Server, err.Error())
+            }
+            pending = pending[blockSize:]
+            block++
+        }
+    }
+    if len(pending) > 0 {
+        paceBlock(started, block, replayOpts.Speed)
+        sender.send(pending, capture.Channels)
+    }
+    fmt.Printf("Replay finished: %d datagram(s), %d byte(s), %d error(s) in %d s.\n", sender.Datagrams, sender.Bytes,
+               sender.Errors, int(time.Since(started) / time.Second))
+}
+
+/* End Of File */
@@ -0,0 +1,139 @@
+/* Resampling for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "math"
+)
+
+// The stream has a sampling frequency of its own (see --rate) while
+// each client sends at the sampling frequency agreed in its hello, or
+// at SAMPLING_FREQUENCY if it doesn't send one, so the incoming audio
+// is resampled to the stream's sampling frequency on its way into the
+// processing chain.  The resampler is a windowed-sinc interpolator:
+// each output sample is the sum of the RESAMPLE_TAPS input samples
+// around it, weighted by a sinc function, Hann windowed, that also
+// low-pass filters below the lower of the two Nyquist frequencies so
+// that nothing aliases.  The weights are worked out in advance for
+// RESAMPLE_PHASES positions between input samples.  Each channel is
+// resampled separately, with the same weights.  The resampler
+// keeps its state from one block to the next, so there are no clicks
+// at the joins, and is created again whenever the sampling frequency
+// of the incoming audio changes, e.g. a new client.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of a resampler
+type Resampler struct {
+    From      int
+    To        int
+    Channels  int
+    // The number of input samples for each output sample
+    step      float64
+    // The weights, RESAMPLE_TAPS for each phase
+    weights   [][]float64
+    // Input samples still needed, interleaved, the first
+    // RESAMPLE_TAPS / 2 - 1 of each channel being those before position
+    history   []float64
+    // Where the next output sample is, in input samples from the start
+    // of history
+    position  float64
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of input samples that go into each output sample
+const RESAMPLE_TAPS int = 32
+
+// The number of positions between input samples for which the weights
+// are worked out
+const RESAMPLE_PHASES int = 256
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a resampler of interleaved audio of the given number of
+// channels from one sampling frequency to another
+func newResampler(from int, to int, channels int) *Resampler {
+    half := RESAMPLE_TAPS / 2
+    resampler := &Resampler{From: from, To: to, Channels: channels, step: float64(from) / float64(to),
+                            weights: make([][]float64, RESAMPLE_PHASES)}
+    // Filter below the lower Nyquist frequency
+    cutoff := 1.0
+    if to < from {
+        cutoff = float64(to) / float64(from)
+    }
+    for phase := range resampler.weights {
+        resampler.weights[phase] = make([]float64, RESAMPLE_TAPS)
+        fraction := float64(phase) / float64(RESAMPLE_PHASES)
+        for tap := range resampler.weights[phase] {
+            // The distance of this input sample from the output sample
+            distance := float64(tap - half + 1) - fraction
+            weight := cutoff
+            if distance != 0 {
+                weight = math.Sin(math.Pi * cutoff * distance) / (math.Pi * distance)
+            }
+            weight *= 0.5 + 0.5 * math.Cos(math.Pi * distance / float64(half))
+            resampler.weights[phase][tap] = weight
+        }
+    }
+    // Start as though silence had gone before
+    resampler.history = make([]float64, (half - 1) * channels)
+    resampler.position = float64(half - 1)
+    log.Printf("Resampling incoming audio from %d Hz to %d Hz.\n", from, to)
+
+    return resampler
+}
+
+// Resample a block of interleaved audio
+func (resampler *Resampler) Process(audio []int16) []int16 {
+    half := RESAMPLE_TAPS / 2
+    channels := resampler.Channels
+    output := make([]int16, 0, (int(float64(len(audio) / channels) / resampler.step) + 1) * channels)
+
+    for _, sample := range audio {
+        resampler.history = append(resampler.history, float64(sample))
+    }
+    for int(resampler.position) + half < len(resampler.history) / channels {
+        whole := int(resampler.position)
+        phase := int((resampler.position - float64(whole)) * float64(RESAMPLE_PHASES))
+        for channel := 0; channel < channels; channel++ {
+            var value float64
+            for tap, weight := range resampler.weights[phase] {
+                value += resampler.history[(whole - half + 1 + tap) * channels + channel] * weight
+            }
+            if value > 32767 {
+                value = 32767
+            } else if value < -32768 {
+                value = -32768
+            }
+            output = append(output, int16(value))
+        }
+        resampler.position += resampler.step
+    }
+    // Let go of the input that won't be needed again
+    if unused := int(resampler.position) - half + 1; unused > 0 {
+        resampler.history = append(resampler.history[:0], resampler.history[unused * channels:]...)
+        resampler.position -= float64(unused)
+    }
+
+    return output
+}
+
+/* End Of File */
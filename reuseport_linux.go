@@ -0,0 +1,40 @@
+/* SO_REUSEPORT support on Linux for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "syscall"
+    "golang.org/x/sys/unix"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Socket control function that sets SO_REUSEPORT, allowing several
+// sockets to be bound to the same port with the kernel spreading
+// incoming packets between them
+func reusePortControl(network string, address string, connection syscall.RawConn) error {
+    var err error
+
+    err1 := connection.Control(func(fd uintptr) {
+        err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+    })
+    if err1 != nil {
+        err = err1
+    }
+
+    return err
+}
+
+/* End Of File */
@@ -0,0 +1,31 @@
+/* SO_REUSEPORT stub for non-Linux platforms for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+//go:build !linux
+
+package main
+
+import (
+    "errors"
+    "syscall"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// SO_REUSEPORT is only supported on Linux
+func reusePortControl(network string, address string, connection syscall.RawConn) error {
+    return errors.New("SO_REUSEPORT is not supported on this platform")
+}
+
+/* End Of File */
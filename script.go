@@ -0,0 +1,172 @@
+/* Scripting hooks for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+    "github.com/yuin/gopher-lua"
+)
+
+// Scripts are written in Lua (https://www.lua.org).  When an event occurs,
+// the function on_<event name> is called if the script defines it,
+// otherwise on_event is called if the script defines that; either is
+// passed a table containing "name", "time" (Unix milliseconds) and the
+// fields of the event.  The following actions are available to scripts:
+//
+//   log(message)             write to the log,
+//   send_control(payload)    send a control datagram to the client,
+//   webhook(url [, body])    POST the body (JSON, say) to a URL,
+//   marker(label)            mark the current point in the stream.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A loaded script
+type Script struct {
+    FileName  string
+    State     *lua.LState
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The maximum time a script may take to handle an event
+const SCRIPT_TIMEOUT time.Duration = time.Second
+
+// The number of events that may be queued for the scripts
+const SCRIPT_EVENT_QUEUE_SIZE int = 100
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Convert an event field to a Lua value
+func toLuaValue(value interface{}) lua.LValue {
+    switch typedValue := value.(type) {
+        case string:
+            return lua.LString(typedValue)
+        case bool:
+            return lua.LBool(typedValue)
+        case int:
+            return lua.LNumber(typedValue)
+        case int64:
+            return lua.LNumber(typedValue)
+        case uint16:
+            return lua.LNumber(typedValue)
+        case float64:
+            return lua.LNumber(typedValue)
+        case time.Duration:
+            return lua.LNumber(typedValue / time.Millisecond)
+    }
+
+    return lua.LString(fmt.Sprint(value))
+}
+
+// Add the actions available to scripts
+func addScriptActions(fileName string, state *lua.LState) {
+    state.SetGlobal("log", state.NewFunction(func(state *lua.LState) int {
+        log.Printf("Script %s: %s\n", fileName, state.CheckString(1))
+        return 0
+    }))
+    state.SetGlobal("send_control", state.NewFunction(func(state *lua.LState) int {
+        err := queueControlDatagram([]byte(state.CheckString(1)))
+        if err != nil {
+            state.RaiseError("%s", err.Error())
+        }
+        return 0
+    }))
+    state.SetGlobal("webhook", state.NewFunction(func(state *lua.LState) int {
+        postWebhook(state.CheckString(1), "application/json", []byte(state.OptString(2, "")))
+        return 0
+    }))
+    state.SetGlobal("marker", state.NewFunction(func(state *lua.LState) int {
+        marker := new(Marker)
+        marker.label = state.CheckString(1)
+        marker.timestamp = time.Now()
+        mainPipeline.media <- marker
+        return 0
+    }))
+}
+
+// Load a script
+func loadScript(fileName string) (*Script, error) {
+    script := new(Script)
+    script.FileName = fileName
+    script.State = lua.NewState()
+    addScriptActions(fileName, script.State)
+    err := script.State.DoFile(fileName)
+    if err != nil {
+        script.State.Close()
+    }
+
+    return script, err
+}
+
+// Pass an event to a script
+func (script *Script) handleEvent(event *Event) {
+    function := script.State.GetGlobal("on_" + event.Name)
+    if function.Type() != lua.LTFunction {
+        function = script.State.GetGlobal("on_event")
+    }
+    if function.Type() == lua.LTFunction {
+        table := script.State.NewTable()
+        table.RawSetString("name", lua.LString(event.Name))
+        table.RawSetString("time", lua.LNumber(event.Time.UnixNano() / int64(time.Millisecond)))
+        for key, value := range event.Fields {
+            table.RawSetString(key, toLuaValue(value))
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), SCRIPT_TIMEOUT)
+        script.State.SetContext(ctx)
+        err := script.State.CallByParam(lua.P{Fn: function, NRet: 0, Protect: true}, table)
+        script.State.RemoveContext()
+        cancel()
+        if err != nil {
+            log.Printf("Script %s failed handling \"%s\" event (%s).\n", script.FileName, event.Name, err.Error())
+        }
+    }
+}
+
+// Load the given scripts and run them against pipeline events
+// forever; returns an error if any script fails to load
+func operateScripts(fileNames []string) error {
+    var scripts []*Script
+
+    for _, fileName := range fileNames {
+        script, err := loadScript(fileName)
+        if err != nil {
+            return err
+        }
+        log.Printf("Loaded script \"%s\".\n", fileName)
+        scripts = append(scripts, script)
+    }
+
+    if len(scripts) > 0 {
+        events := subscribeEvents(SCRIPT_EVENT_QUEUE_SIZE)
+        go func() {
+            for event := range events {
+                for _, script := range scripts {
+                    script.handleEvent(event)
+                }
+            }
+        }()
+    }
+
+    return nil
+}
+
+/* End Of File */
@@ -0,0 +1,181 @@
+/* systemd notification for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// When run by systemd as a Type=notify service, systemd gives the
+// server a socket (NOTIFY_SOCKET) on which to say how it is getting
+// on, as sd_notify() would: READY=1 once the UDP and TCP servers for
+// incoming audio and the HTTP server are all listening, so that units
+// ordered after ioc-server start only once it can be used, and
+// STOPPING=1 when it begins to shut down cleanly.  If the service also
+// has a WatchdogSec, systemd gives the period (WATCHDOG_USEC) within
+// which it must hear WATCHDOG=1 or it kills and, with Restart=, starts
+// the server again; the pings come from the watchdog of the main
+// stream (see watchdog.go), which only sends them while the processing
+// loop is ticking, so that a server that is running but has stopped
+// processing audio is restarted too.  Without --watchdog the pings are
+// sent regardless.  Nothing is done if NOTIFY_SOCKET isn't set.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The state of notification to systemd
+type SystemdNotifier struct {
+    // The period within which systemd must be pinged, 0 if it needn't be
+    WatchdogPeriod  time.Duration
+    address         *net.UnixAddr
+    locker          sync.Mutex
+    listening       map[string]bool
+    ready           bool
+    lastPing        time.Time
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The servers that must be listening before the server is ready
+const (
+    SYSTEMD_LISTENER_UDP = "UDP"
+    SYSTEMD_LISTENER_TCP = "TCP"
+    SYSTEMD_LISTENER_HTTP = "HTTP"
+)
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Notification to systemd, nil if the server isn't run by systemd as
+// a Type=notify service
+var systemdNotifier *SystemdNotifier
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create notification to systemd from the environment, returning nil
+// if there is no NOTIFY_SOCKET
+func newSystemdNotifier() *SystemdNotifier {
+    socket := os.Getenv("NOTIFY_SOCKET")
+    if socket == "" {
+        return nil
+    }
+    if strings.HasPrefix(socket, "@") {
+        // An abstract socket
+        socket = "\x00" + socket[1:]
+    }
+    notifier := &SystemdNotifier{address: &net.UnixAddr{Name: socket, Net: "unixgram"}, listening: make(map[string]bool)}
+    pid := os.Getenv("WATCHDOG_PID")
+    if microseconds, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); (err == nil) && (microseconds > 0) &&
+       ((pid == "") || (pid == strconv.Itoa(os.Getpid()))) {
+        notifier.WatchdogPeriod = time.Duration(microseconds) * time.Microsecond
+    }
+    log.Printf("systemd will be told when the server is ready and when it is stopping.\n")
+    if notifier.WatchdogPeriod > 0 {
+        log.Printf("The systemd watchdog will be pinged every %d ms.\n", notifier.WatchdogPeriod / 2 / time.Millisecond)
+    }
+
+    return notifier
+}
+
+// Send a state to systemd
+func (notifier *SystemdNotifier) notify(state string) {
+    connection, err := net.DialUnix("unixgram", nil, notifier.address)
+    if err == nil {
+        _, err = connection.Write([]byte(state))
+        connection.Close()
+    }
+    if err != nil {
+        log.Printf("Unable to notify systemd of \"%s\" (%s).\n", state, err.Error())
+    }
+}
+
+// Note that one of the servers is listening, telling systemd that the
+// server is ready once they all are
+func (notifier *SystemdNotifier) Listening(name string) {
+    if notifier == nil {
+        return
+    }
+    notifier.locker.Lock()
+    notifier.listening[name] = true
+    ready := !notifier.ready && notifier.listening[SYSTEMD_LISTENER_UDP] &&
+             notifier.listening[SYSTEMD_LISTENER_TCP] && notifier.listening[SYSTEMD_LISTENER_HTTP]
+    if ready {
+        notifier.ready = true
+    }
+    notifier.locker.Unlock()
+    if ready {
+        log.Printf("Telling systemd that the server is ready.\n")
+        notifier.notify(fmt.Sprintf("READY=1\nSTATUS=Serving version %s", SERVER_VERSION))
+    }
+}
+
+// Ping the systemd watchdog, if there is one, at most every half of
+// its period
+func (notifier *SystemdNotifier) Ping(now time.Time) {
+    if (notifier == nil) || (notifier.WatchdogPeriod == 0) {
+        return
+    }
+    notifier.locker.Lock()
+    due := now.Sub(notifier.lastPing) >= notifier.WatchdogPeriod / 2
+    if due {
+        notifier.lastPing = now
+    }
+    notifier.locker.Unlock()
+    if due {
+        notifier.notify("WATCHDOG=1")
+    }
+}
+
+// Tell systemd that the server is shutting down
+func (notifier *SystemdNotifier) Stopping() {
+    if notifier == nil {
+        return
+    }
+    log.Printf("Telling systemd that the server is stopping.\n")
+    notifier.notify("STOPPING=1")
+}
+
+// Ping the systemd watchdog regardless, for when there is no watchdog
+// of the main stream to do it, until ctx is done
+func (notifier *SystemdNotifier) Run(ctx context.Context) {
+    if notifier.WatchdogPeriod == 0 {
+        return
+    }
+    ticker := time.NewTicker(notifier.WatchdogPeriod / 4)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-ctx.Done():
+                return
+            case now := <-ticker.C:
+                notifier.Ping(now)
+        }
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,185 @@
+/* Segment storage for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "time"
+)
+
+// Where segment files are kept is up to a segment store (see
+// --segmentstore): on disk in the playlist directory, which may be a
+// tmpfs mount, as always (DiskSegmentStore, below), in memory (see
+// memsegments.go) or uploaded to an object store, S3 or GCS, for a CDN
+// to serve (see objectstore.go).  A segment file is always named by
+// the path that it would have on disk, in the playlist directory, and
+// playlists refer to it by the URI that the store gives it.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A segment file being written, on disk (an *os.File) or otherwise
+type SegmentFile interface {
+    io.Writer
+    Name() string
+    Close() error
+}
+
+// Somewhere to keep segment files
+type SegmentStore interface {
+    // Open a new segment file in dirName with the given extension,
+    // returning nil on failure; the segment file is complete once it
+    // has been closed
+    Create(dirName string, extension string) SegmentFile
+    // Return the contents of a segment file and when it was written
+    Read(filePath string) ([]byte, time.Time, error)
+    // Remove a segment file
+    Remove(filePath string) error
+    // Serve a segment file over HTTP
+    Serve(out http.ResponseWriter, in *http.Request, filePath string)
+    // Return the paths of the segment files in dirName with the given
+    // extension, in alphabetical order
+    Paths(dirName string, extension string) []string
+    // Return the number of bytes of segment files in dirName
+    Size(dirName string) int64
+    // Return the URI by which a playlist refers to a segment file
+    Uri(filePath string) string
+}
+
+// Segment files on disk
+type DiskSegmentStore struct {
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Where segment files are kept
+var segmentStore SegmentStore = new(DiskSegmentStore)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Open a segment file with the given extension, nil on failure
+func openSegmentFile(dirName string, extension string) SegmentFile {
+    return segmentStore.Create(dirName, extension)
+}
+
+// Read a segment file
+func readSegmentFile(filePath string) ([]byte, error) {
+    data, _, err := segmentStore.Read(filePath)
+
+    return data, err
+}
+
+// Remove a segment file
+func removeSegmentFile(filePath string) error {
+    return segmentStore.Remove(filePath)
+}
+
+// Serve a segment file
+func serveSegmentFile(out http.ResponseWriter, in *http.Request, filePath string) {
+    segmentStore.Serve(out, in, filePath)
+}
+
+// Open a segment file on disk
+func (store *DiskSegmentStore) Create(dirName string, extension string) SegmentFile {
+    handle, err := ioutil.TempFile (dirName, "")
+    if err == nil {
+        filePath := handle.Name()
+        handle.Close()
+        if os.Rename(filePath, filePath + extension) == nil {
+            handle, err = os.Create(filePath + extension)
+            if err == nil {
+                log.Printf("Opened segment file \"%s\" for output.\n", handle.Name())
+            } else {
+                log.Printf("Unable to open segment file \"%s\" (%s).\n", filePath + extension, err.Error())
+                os.Remove(filePath + extension)
+                handle = nil
+            }
+        } else {
+            log.Printf("Unable to rename temporary file \"%s\" to \"%s\".\n", filePath, filePath + extension)
+            os.Remove(filePath)
+            handle = nil
+        }
+    } else {
+        log.Printf("Unable to create segment file for output in directory \"%s\".\n", dirName)
+    }
+    if handle == nil {
+        return nil
+    }
+
+    return handle
+}
+
+// Read a segment file from disk
+func (store *DiskSegmentStore) Read(filePath string) ([]byte, time.Time, error) {
+    info, err := os.Stat(filePath)
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+    data, err := ioutil.ReadFile(filePath)
+
+    return data, info.ModTime(), err
+}
+
+// Remove a segment file from disk
+func (store *DiskSegmentStore) Remove(filePath string) error {
+    return os.Remove(filePath)
+}
+
+// Serve a segment file from disk
+func (store *DiskSegmentStore) Serve(out http.ResponseWriter, in *http.Request, filePath string) {
+    http.ServeFile(out, in, filePath)
+}
+
+// Return the paths of the segment files on disk in dirName with the
+// given extension
+func (store *DiskSegmentStore) Paths(dirName string, extension string) []string {
+    paths, _ := filepath.Glob(dirName + string(os.PathSeparator) + "*" + extension)
+    sort.Strings(paths)
+
+    return paths
+}
+
+// Return the number of bytes of segment files on disk in dirName
+func (store *DiskSegmentStore) Size(dirName string) int64 {
+    var size int64
+
+    for _, extension := range segmentExtensions() {
+        for _, file := range store.Paths(dirName, extension) {
+            info, err := os.Stat(file)
+            if err == nil {
+                size += info.Size()
+            }
+        }
+    }
+
+    return size
+}
+
+// A segment file on disk is referred to by its name, being alongside
+// the playlist
+func (store *DiskSegmentStore) Uri(filePath string) string {
+    return filepath.Base(filePath)
+}
+
+/* End Of File */
@@ -0,0 +1,224 @@
+/* Segment duration tuning for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// The duration of a segment trades latency against robustness: a
+// player can't have audio until the segment it is in has been written
+// and holds a segment or so back from the live edge, so shorter
+// segments mean less latency, but a player with a poor connection
+// then has less in hand and runs dry (buffers) more often.  When
+// auto-tuning (see --latencytarget) the end-to-end latency is
+// estimated every SEGMENT_TUNE_PERIOD, as the latency from the client
+// (if it does time synchronisation) plus the depth of the PCM buffer
+// plus two segments, and listeners report each time they run dry with
+// a POST to SEGMENT_TUNE_BUFFERING_PATH (the sample page does this).
+// If SEGMENT_TUNE_BUFFERINGS or more listeners ran dry in the period
+// the segments are lengthened by SEGMENT_TUNE_STEP_PERCENT, else if
+// the latency is above the target they are shortened by the same,
+// always staying within the bounds given.  The change is made exactly
+// as a change of segment duration through the admin API would be, at
+// the next segment boundary.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of segment duration tuning
+type SegmentTuner struct {
+    TargetLatency  time.Duration
+    MinMs          uint
+    MaxMs          uint
+    locker         sync.Mutex
+    // The listeners that have reported running dry in this period, by
+    // IP address, each counted once per period
+    buffering      map[string]bool
+    bufferings     int
+    latency        time.Duration
+    lengthened     int
+    shortened      int
+}
+
+// Statistics of segment duration tuning
+type SegmentTunerStats struct {
+    TargetLatencyMs  int64  `json:"targetLatencyMs"`
+    LatencyMs        int64  `json:"latencyMs"`
+    SegmentMs        uint   `json:"segmentMs"`
+    MinMs            uint   `json:"minMs"`
+    MaxMs            uint   `json:"maxMs"`
+    Bufferings       int    `json:"bufferings"`
+    Lengthened       int    `json:"lengthened"`
+    Shortened        int    `json:"shortened"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How often the segment duration is looked at
+const SEGMENT_TUNE_PERIOD time.Duration = time.Second * 30
+
+// The number of listeners running dry within SEGMENT_TUNE_PERIOD that
+// lengthens the segments
+const SEGMENT_TUNE_BUFFERINGS int = 2
+
+// How much the segment duration is changed by at a time
+const SEGMENT_TUNE_STEP_PERCENT uint = 25
+
+// The path to which listeners POST when they run dry
+const SEGMENT_TUNE_BUFFERING_PATH string = "/buffering"
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The segment duration tuner, nil if not tuning
+var segmentTuner *SegmentTuner
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a segment duration tuner aiming for a latency of
+// targetMilliseconds, keeping the segment duration between minMs and
+// maxMs
+func newSegmentTuner(targetMilliseconds uint, minMs uint, maxMs uint) (*SegmentTuner, error) {
+    if (minMs < SETTINGS_MIN_SEGMENT_MS) || (maxMs > SETTINGS_MAX_SEGMENT_MS) || (minMs > maxMs) {
+        return nil, errors.New(fmt.Sprintf("the segment duration bounds must be between %d and %d ms, the minimum no more than the maximum",
+                                           SETTINGS_MIN_SEGMENT_MS, SETTINGS_MAX_SEGMENT_MS))
+    }
+
+    return &SegmentTuner{TargetLatency: time.Duration(targetMilliseconds) * time.Millisecond,
+                         MinMs: minMs, MaxMs: maxMs, buffering: make(map[string]bool)}, nil
+}
+
+// Estimate the end-to-end latency with segments of the given duration
+func estimateLatency(segmentMs uint) time.Duration {
+    var network time.Duration
+
+    ingestLocker.Lock()
+    if session.TimeSync != nil {
+        network = session.TimeSync.Latency
+    }
+    ingestLocker.Unlock()
+    pcmBuffered, _ := bufferDepths()
+
+    return network + pcmBuffered + time.Duration(segmentMs) * time.Millisecond * 2
+}
+
+// Note that a listener has run dry
+func (tuner *SegmentTuner) Buffering(address string) {
+    tuner.locker.Lock()
+    defer tuner.locker.Unlock()
+
+    if !tuner.buffering[address] {
+        tuner.buffering[address] = true
+        tuner.bufferings++
+        log.Printf("Listener %s has run dry.\n", address)
+    }
+}
+
+// Look at the segment duration, returning the new one, zero if it
+// should stay as it is
+func (tuner *SegmentTuner) tune(segmentMs uint) uint {
+    var newSegmentMs uint
+
+    tuner.locker.Lock()
+    defer tuner.locker.Unlock()
+
+    tuner.latency = estimateLatency(segmentMs)
+    step := segmentMs * SEGMENT_TUNE_STEP_PERCENT / 100
+    if len(tuner.buffering) >= SEGMENT_TUNE_BUFFERINGS {
+        if segmentMs < tuner.MaxMs {
+            newSegmentMs = segmentMs + step
+            if newSegmentMs > tuner.MaxMs {
+                newSegmentMs = tuner.MaxMs
+            }
+            log.Printf("%d listener(s) ran dry in the last %d second(s), lengthening segments to %d ms.\n",
+                       len(tuner.buffering), SEGMENT_TUNE_PERIOD / time.Second, newSegmentMs)
+            tuner.lengthened++
+        }
+    } else if (tuner.latency > tuner.TargetLatency) && (segmentMs > tuner.MinMs) {
+        newSegmentMs = segmentMs - step
+        if newSegmentMs < tuner.MinMs {
+            newSegmentMs = tuner.MinMs
+        }
+        log.Printf("Latency is about %d ms, more than the target of %d ms, shortening segments to %d ms.\n",
+                   tuner.latency / time.Millisecond, tuner.TargetLatency / time.Millisecond, newSegmentMs)
+        tuner.shortened++
+    }
+    tuner.buffering = make(map[string]bool)
+
+    return newSegmentMs
+}
+
+// Tune the segment duration until ctx is done
+func (tuner *SegmentTuner) Run(ctx context.Context) {
+    ticker := time.NewTicker(SEGMENT_TUNE_PERIOD)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                if segmentMs := tuner.tune(getStreamSettings().SegmentMs); segmentMs > 0 {
+                    _, err := changeStreamSettings(StreamSettingsChange{SegmentMs: &segmentMs})
+                    if err != nil {
+                        log.Printf("Unable to change the segment duration to %d ms (%s).\n", segmentMs, err.Error())
+                    }
+                }
+        }
+    }
+}
+
+// Handle a POST from a listener that has run dry
+func bufferingHandler(out http.ResponseWriter, in *http.Request) {
+    if in.Method != http.MethodPost {
+        http.Error(out, "", http.StatusMethodNotAllowed)
+        return
+    }
+    if segmentTuner != nil {
+        address, _, err := net.SplitHostPort(in.RemoteAddr)
+        if err != nil {
+            address = in.RemoteAddr
+        }
+        segmentTuner.Buffering(address)
+    }
+    out.WriteHeader(http.StatusNoContent)
+}
+
+// Return the statistics of segment duration tuning
+func (tuner *SegmentTuner) Stats() interface{} {
+    segmentMs := getStreamSettings().SegmentMs
+
+    tuner.locker.Lock()
+    defer tuner.locker.Unlock()
+
+    return SegmentTunerStats{TargetLatencyMs: int64(tuner.TargetLatency / time.Millisecond),
+                             LatencyMs: int64(tuner.latency / time.Millisecond), SegmentMs: segmentMs,
+                             MinMs: tuner.MinMs, MaxMs: tuner.MaxMs, Bufferings: tuner.bufferings,
+                             Lengthened: tuner.lengthened, Shortened: tuner.shortened}
+}
+
+/* End Of File */
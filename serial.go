@@ -0,0 +1,94 @@
+/* Serial ingest for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+    "github.com/RobMeades/ioc-server/urtp"
+)
+
+// Where the capture hardware is wired straight to the machine running
+// the server (e.g. an MCU on the UART of a Raspberry Pi) the URTP byte
+// stream can be read from a serial device rather than a socket.  The
+// stream is handled exactly as a TCP stream would be (so transport
+// requests, length-prefixing and compression all work) and datagrams
+// to be sent back go out on the same device.  If the device goes away
+// (e.g. a USB serial adapter is unplugged) it is opened again every
+// SERIAL_RETRY_PERIOD.
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How long to wait before trying to open a serial device again
+const SERIAL_RETRY_PERIOD time.Duration = time.Second * 5
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Read URTP from a serial device at the given baud rate until ctx is done
+func operateSerialIn(ctx context.Context, path string, baudRate uint) {
+    for {
+        device, err := openSerial(path, baudRate)
+        if err == nil {
+            var framed int32
+            done := make(chan struct{})
+            fmt.Printf("Reading Chuffs from serial device %s at %d baud.\n", path, baudRate)
+            ingestLocker.Lock()
+            startSession(time.Now())
+            ingestLocker.Unlock()
+            publishEvent(EVENT_CLIENT_CONNECTED, map[string]interface{}{"address": path})
+            // Close the device, so that the read below returns, when
+            // ctx is done
+            go func() {
+                select {
+                    case <-ctx.Done():
+                        device.Close()
+                    case <-done:
+                }
+            }()
+            decoders := newDecoders()
+            decoders.Source = path
+            reassembler := urtp.NewReassembler(&ServerUrtpHandler{decoders: decoders})
+            err = handleUrtpStream(reassembler, device, device, &framed, nil)
+            close(done)
+            device.Close()
+            publishEvent(EVENT_CLIENT_DISCONNECTED, map[string]interface{}{"address": path, "reason": "closed"})
+            if ctx.Err() != nil {
+                return
+            }
+            if err != nil {
+                log.Printf("Error reading serial device %s (%s).\n", path, err.Error())
+            }
+        } else {
+            log.Printf("Unable to open serial device %s (%s).\n", path, err.Error())
+        }
+        select {
+            case <-ctx.Done():
+                return
+            case <-time.After(SERIAL_RETRY_PERIOD):
+        }
+    }
+}
+
+// Return an error if a baud rate can't be used for a serial device
+func checkSerialBaudRate(baudRate uint) error {
+    _, err := serialSpeed(baudRate)
+    return err
+}
+
+/* End Of File */
@@ -0,0 +1,78 @@
+/* Serial device support on Linux for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "golang.org/x/sys/unix"
+)
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The baud rates supported and their termios speeds
+var serialSpeeds = map[uint]uint32{9600: unix.B9600, 19200: unix.B19200, 38400: unix.B38400, 57600: unix.B57600,
+                                   115200: unix.B115200, 230400: unix.B230400, 460800: unix.B460800, 921600: unix.B921600}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the termios speed for a baud rate
+func serialSpeed(baudRate uint) (uint32, error) {
+    speed, ok := serialSpeeds[baudRate]
+    if !ok {
+        return 0, errors.New(fmt.Sprintf("%d is not a supported baud rate", baudRate))
+    }
+
+    return speed, nil
+}
+
+// Open a serial device raw, 8N1 with no flow control, at the given
+// baud rate
+func openSerial(path string, baudRate uint) (*os.File, error) {
+    speed, err := serialSpeed(baudRate)
+    if err != nil {
+        return nil, err
+    }
+    device, err := os.OpenFile(path, os.O_RDWR | unix.O_NOCTTY, 0)
+    if err != nil {
+        return nil, err
+    }
+    termios, err := unix.IoctlGetTermios(int(device.Fd()), unix.TCGETS)
+    if err == nil {
+        termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL |
+                          unix.IXON | unix.IXOFF | unix.IXANY
+        termios.Oflag &^= unix.OPOST
+        termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+        termios.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+        termios.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+        termios.Ispeed = speed
+        termios.Ospeed = speed
+        // Block until there is at least one byte
+        termios.Cc[unix.VMIN] = 1
+        termios.Cc[unix.VTIME] = 0
+        err = unix.IoctlSetTermios(int(device.Fd()), unix.TCSETS, termios)
+    }
+    if err != nil {
+        device.Close()
+        return nil, err
+    }
+
+    return device, nil
+}
+
+/* End Of File */
@@ -0,0 +1,37 @@
+/* Serial device stub for non-Linux platforms for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+//go:build !linux
+
+package main
+
+import (
+    "errors"
+    "os"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Serial devices are only supported on Linux
+func serialSpeed(baudRate uint) (uint32, error) {
+    return 0, errors.New("serial devices are not supported on this platform")
+}
+
+// Serial devices are only supported on Linux
+func openSerial(path string, baudRate uint) (*os.File, error) {
+    _, err := serialSpeed(baudRate)
+    return nil, err
+}
+
+/* End Of File */
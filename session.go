@@ -0,0 +1,355 @@
+/* Client sessions for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "github.com/RobMeades/ioc-server/urtp"
+)
+
+// At the start of a session (a new TCP connection, or UDP datagrams
+// arriving after a period of silence) the server sends the client a
+// capabilities datagram:
+//
+//   - urtp.CAPABILITIES_SYNC_BYTE,
+//   - one byte, CAPABILITIES_VERSION,
+//   - one byte, the number of audio coding schemes supported, followed
+//     by that many bytes, each an audio coding scheme,
+//   - two bytes (big-endian), the preferred block duration in ms,
+//   - one byte, the length of the server version string, followed by
+//     the server version string (ASCII, not terminated),
+//   - one byte, the highest URTP version the server understands (from
+//     version 3),
+//   - one byte, the most data shards in a FEC group that the server
+//     accepts, zero if it doesn't accept FEC, and one byte, the most
+//     parity shards (from version 5, see urtp/fec.go).
+//
+// A client that understands this replies with a capabilities
+// acknowledgement (on the same socket as its audio):
+//
+//   - urtp.CAPABILITIES_SYNC_BYTE,
+//   - one byte, the capabilities version the client is using,
+//   - one byte, the audio coding scheme the client will use.
+//
+// A client may also, at any time, send a hello datagram describing
+// itself:
+//
+//   - urtp.HELLO_SYNC_BYTE,
+//   - one byte, the length of the client firmware version string,
+//     followed by the firmware version string (ASCII, not terminated),
+//   - one byte, the number of audio coding schemes the client supports,
+//     followed by that many bytes, each an audio coding scheme,
+//   - one byte, the number of sampling frequencies the client supports,
+//     followed by that many two-byte (big-endian) frequencies in Hz.
+//
+// The server records this and replies with its preferred audio coding
+// scheme from those the client supports:
+//
+//   - urtp.HELLO_SYNC_BYTE,
+//   - one byte, the preferred audio coding scheme, HELLO_NO_CODING_SCHEME
+//     if there is nothing in common,
+//   - two bytes (big-endian), the sampling frequency the server expects:
+//     the stream's own (see --rate) if the client supports it, else
+//     SAMPLING_FREQUENCY if the client supports that, else the highest
+//     the client supports; whatever it is, the server resamples the
+//     client's audio to the stream's sampling frequency.
+//
+// What the server sends depends on the version the client acknowledges:
+// from version 2 timing datagrams include the server's buffer depths
+// and from version 4 the times for two-way time synchronisation; from
+// version 5 the client may send its URTP datagrams over UDP as FEC
+// shards, if the server accepts them.
+// Clients that don't know about capabilities will never acknowledge,
+// so the datagram is only sent CAPABILITIES_MAX_ATTEMPTS times per
+// session.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of a session with a client
+type Session struct {
+    Started              time.Time
+    LastDatagram         time.Time
+    CapabilitiesAttempts int
+    CapabilitiesSent     time.Time
+    Acknowledged         bool
+    ClientVersion        byte
+    ClientCodingScheme   byte
+    Hello                *ClientHello
+    UrtpVersion          byte
+    TimeSync             *TimeSync
+}
+
+// What a client has said about itself in a hello datagram
+type ClientHello struct {
+    Received             time.Time  `json:"received"`
+    FirmwareVersion      string     `json:"firmwareVersion"`
+    CodingSchemes        []int      `json:"codingSchemes"`
+    SamplingFrequencies  []int      `json:"samplingFrequencies"`
+    PreferredScheme      int        `json:"preferredScheme"`
+    // The sampling frequency the client has been asked for
+    SamplingFrequency    int        `json:"samplingFrequency"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The version of the capabilities datagram
+const CAPABILITIES_VERSION byte = 5
+
+// The capabilities version from which timing datagrams include the
+// server's buffer depths
+const CAPABILITIES_VERSION_EXTENDED_TIMING byte = 2
+
+// The capabilities version from which timing datagrams include the
+// times for two-way time synchronisation
+const CAPABILITIES_VERSION_TIME_SYNC byte = 4
+
+// The capabilities version from which the client may send FEC shards
+const CAPABILITIES_VERSION_FEC byte = 5
+
+// How long to wait for an acknowledgement before sending the
+// capabilities datagram again
+const CAPABILITIES_RETRY_PERIOD time.Duration = time.Second * 2
+
+// The number of times to send the capabilities datagram in a session
+const CAPABILITIES_MAX_ATTEMPTS int = 5
+
+// The preferred audio coding scheme in a hello reply if the client
+// supports none of ours
+const HELLO_NO_CODING_SCHEME byte = 0xff
+
+// A gap in UDP datagrams longer than this starts a new session
+const SESSION_IDLE_TIME time.Duration = time.Second * 10
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The current session, protected by ingestLocker
+var session Session
+
+// The audio coding schemes in the order that the server prefers them
+var preferredCodingSchemes = []byte{urtp.OPUS_COMPRESSED, urtp.PCM_SIGNED_16_BIT, urtp.PCM_SIGNED_16_BIT_LITTLE_ENDIAN,
+                                    urtp.UNICAM_COMPRESSED_12_BIT, urtp.UNICAM_COMPRESSED_10_BIT, urtp.UNICAM_COMPRESSED_8_BIT,
+                                    urtp.IMA_ADPCM_4_BIT, urtp.PCM_UNSIGNED_8_BIT}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Start a new session; ingestLocker must be held
+func startSession(now time.Time) {
+    session = Session{Started: now, LastDatagram: now}
+    log.Printf("New client session started.\n")
+}
+
+// Make a capabilities datagram
+func makeCapabilitiesDatagram() []byte {
+    capabilitiesDatagram := []byte{urtp.CAPABILITIES_SYNC_BYTE, CAPABILITIES_VERSION, byte(urtp.MAX_NUM_AUDIO_CODING_SCHEMES)}
+    for codingScheme := 0; codingScheme < urtp.MAX_NUM_AUDIO_CODING_SCHEMES; codingScheme++ {
+        capabilitiesDatagram = append(capabilitiesDatagram, byte(codingScheme))
+    }
+    capabilitiesDatagram = append(capabilitiesDatagram, byte(BLOCK_DURATION_MS >> 8), byte(BLOCK_DURATION_MS))
+    capabilitiesDatagram = append(capabilitiesDatagram, byte(len(SERVER_VERSION)))
+    capabilitiesDatagram = append(capabilitiesDatagram, SERVER_VERSION...)
+    capabilitiesDatagram = append(capabilitiesDatagram, urtp.VERSION)
+    if fecEnabled {
+        capabilitiesDatagram = append(capabilitiesDatagram, byte(urtp.FEC_MAX_DATA_SHARDS), byte(urtp.FEC_MAX_PARITY_SHARDS))
+    } else {
+        capabilitiesDatagram = append(capabilitiesDatagram, 0, 0)
+    }
+
+    return capabilitiesDatagram
+}
+
+// Continue the current session, starting a new one if the client
+// has been quiet for too long; ingestLocker must be held
+func continueSession(now time.Time) {
+    if session.Started.IsZero() || (now.Sub(session.LastDatagram) > SESSION_IDLE_TIME) {
+        startSession(now)
+    }
+    session.LastDatagram = now
+}
+
+// Note that a datagram has arrived, returning a capabilities datagram
+// if one should be sent to the client; ingestLocker must be held
+func sessionDatagramReceived(now time.Time) []byte {
+    var capabilitiesDatagram []byte
+
+    continueSession(now)
+    if !session.Acknowledged && (session.CapabilitiesAttempts < CAPABILITIES_MAX_ATTEMPTS) &&
+       (now.Sub(session.CapabilitiesSent) > CAPABILITIES_RETRY_PERIOD) {
+        capabilitiesDatagram = makeCapabilitiesDatagram()
+        session.CapabilitiesAttempts++
+        session.CapabilitiesSent = now
+        if session.CapabilitiesAttempts == CAPABILITIES_MAX_ATTEMPTS {
+            log.Printf("Capabilities sent %d times without acknowledgement, assuming the client doesn't support them.\n",
+                       CAPABILITIES_MAX_ATTEMPTS)
+        }
+    }
+
+    return capabilitiesDatagram
+}
+
+// Handle a capabilities acknowledgement from the client
+func handleCapabilitiesAck(data []byte) {
+    if urtp.IsCapabilitiesAck(data) {
+        ingestLocker.Lock()
+        session.ClientVersion = data[1]
+        session.ClientCodingScheme = data[2]
+        if (session.ClientVersion <= CAPABILITIES_VERSION) && (int(session.ClientCodingScheme) < urtp.MAX_NUM_AUDIO_CODING_SCHEMES) {
+            session.Acknowledged = true
+            log.Printf("Client acknowledged capabilities (version %d, audio coding scheme %d).\n",
+                       session.ClientVersion, session.ClientCodingScheme)
+        } else {
+            log.Printf("Client capabilities acknowledgement not understood (version %d, audio coding scheme %d).\n",
+                       session.ClientVersion, session.ClientCodingScheme)
+        }
+        ingestLocker.Unlock()
+    }
+}
+
+// Parse a hello datagram from the client, returning nil if it isn't one
+func parseHello(data []byte) *ClientHello {
+    var hello *ClientHello
+
+    parsed := urtp.ParseHello(data)
+    if parsed != nil {
+        hello = &ClientHello{Received: time.Now(), FirmwareVersion: parsed.FirmwareVersion,
+                             CodingSchemes: parsed.CodingSchemes, SamplingFrequencies: parsed.SamplingFrequencies,
+                             PreferredScheme: int(HELLO_NO_CODING_SCHEME),
+                             SamplingFrequency: SAMPLING_FREQUENCY}
+        for _, codingScheme := range preferredCodingSchemes {
+            if hello.supportsCodingScheme(int(codingScheme)) {
+                hello.PreferredScheme = int(codingScheme)
+                break
+            }
+        }
+        if hello.supportsSamplingFrequency(streamSamplingFrequency) {
+            hello.SamplingFrequency = streamSamplingFrequency
+        } else if !hello.supportsSamplingFrequency(SAMPLING_FREQUENCY) {
+            // The highest that can be resampled
+            highest := 0
+            for _, frequency := range hello.SamplingFrequencies {
+                if (frequency > highest) && (frequency >= MIN_SAMPLING_FREQUENCY) && (frequency <= MAX_SAMPLING_FREQUENCY) {
+                    highest = frequency
+                }
+            }
+            if highest > 0 {
+                hello.SamplingFrequency = highest
+            }
+        }
+    }
+
+    return hello
+}
+
+// Handle a hello datagram from the client, returning the reply
+func handleHello(data []byte) []byte {
+    var reply []byte
+
+    hello := parseHello(data)
+    if hello != nil {
+        ingestLocker.Lock()
+        continueSession(hello.Received)
+        session.Hello = hello
+        ingestLocker.Unlock()
+
+        log.Printf("Client hello: firmware version \"%s\", audio coding schemes %v, sampling frequencies %v Hz, preferred audio coding scheme %d.\n",
+                   hello.FirmwareVersion, hello.CodingSchemes, hello.SamplingFrequencies, hello.PreferredScheme)
+        if hello.PreferredScheme == int(HELLO_NO_CODING_SCHEME) {
+            log.Printf("Client supports none of our audio coding schemes, its audio won't be understood.\n")
+        }
+        if hello.SamplingFrequency != streamSamplingFrequency {
+            log.Printf("Client asked to send at %d Hz, which will be resampled to %d Hz.\n", hello.SamplingFrequency, streamSamplingFrequency)
+        }
+        reply = []byte{urtp.HELLO_SYNC_BYTE, byte(hello.PreferredScheme), byte(hello.SamplingFrequency >> 8), byte(hello.SamplingFrequency & 0xFF)}
+    }
+
+    return reply
+}
+
+// Note the URTP version the client is using, logging any change;
+// ingestLocker must be held
+func noteUrtpVersion(version byte) {
+    if session.UrtpVersion != version {
+        if session.UrtpVersion == 0 {
+            log.Printf("Client is using URTP version %d.\n", version)
+        } else {
+            log.Printf("Client has switched from URTP version %d to %d.\n", session.UrtpVersion, version)
+        }
+        session.UrtpVersion = version
+    }
+}
+
+// Return true if a client supports an audio coding scheme
+func (hello *ClientHello) supportsCodingScheme(codingScheme int) bool {
+    for _, item := range hello.CodingSchemes {
+        if item == codingScheme {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Return true if a client supports a sampling frequency
+func (hello *ClientHello) supportsSamplingFrequency(frequency int) bool {
+    for _, item := range hello.SamplingFrequencies {
+        if item == frequency {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Return the sampling frequency of the audio from the client, that
+// agreed in its hello or SAMPLING_FREQUENCY if it hasn't sent one;
+// ingestLocker must be held
+func clientSamplingFrequency() int {
+    if session.Hello != nil {
+        return session.Hello.SamplingFrequency
+    }
+
+    return SAMPLING_FREQUENCY
+}
+
+// Return the statistics of the client, as far as we know them
+func clientStats() interface{} {
+    var timeSync *TimeSync
+
+    ingestLocker.Lock()
+    defer ingestLocker.Unlock()
+
+    // A copy, since it changes after the lock is released
+    if session.TimeSync != nil {
+        copied := *session.TimeSync
+        timeSync = &copied
+    }
+
+    return map[string]interface{}{
+        "sessionStarted": session.Started,
+        "capabilitiesAcknowledged": session.Acknowledged,
+        "capabilitiesVersion": session.ClientVersion,
+        "hello": session.Hello,
+        "urtpVersion": session.UrtpVersion,
+        "timeSync": timeSync,
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,180 @@
+/* Runtime settings for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+)
+
+// Some settings of the stream can be changed through the admin API
+// while it is running, so that tuning doesn't mean restarting and
+// dropping every listener.  A change to the playlist length goes
+// straight to the audio output channel, which applies it from its
+// next tick.  A change to the encoder or to the segment duration is
+// queued for the processing loop which, at the next segment boundary,
+// flushes the encoder into the segment it is finishing and creates a
+// new encoder with the new settings for the next segment.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The settings of the stream that may be changed while it is running
+type StreamSettings struct {
+    Encoder          Mp3Settings
+    SegmentMs        uint
+    PlaylistSeconds  uint
+}
+
+// A change to the settings of the stream, as sent to the admin API;
+// those not given stay as they are
+type StreamSettingsChange struct {
+    Bitrate          *uint     `json:"bitrate"`
+    Scale            *float32  `json:"scale"`
+    SegmentMs        *uint     `json:"segmentMs"`
+    PlaylistSeconds  *uint     `json:"playlistSeconds"`
+}
+
+// A new length for the playlist, for the audio output channel
+type PlaylistLength struct {
+    Seconds  uint
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The highest bitrate that may be set in kbits/s
+const SETTINGS_MAX_BITRATE uint = 320
+
+// The highest gain that may be set
+const SETTINGS_MAX_SCALE float32 = 100
+
+// The shortest and longest segment durations that may be set
+const SETTINGS_MIN_SEGMENT_MS uint = 100
+const SETTINGS_MAX_SEGMENT_MS uint = 10000
+
+// The longest playlist that may be set
+const SETTINGS_MAX_PLAYLIST_SECONDS uint = 600
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The current settings of the stream
+var streamSettings StreamSettings
+var streamSettingsLocker sync.Mutex
+
+// Encoder and segment settings waiting for the processing loop to
+// pick them up at the next segment boundary; only the latest matters
+var streamSettingsChanges = make(chan StreamSettings, 1)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the current settings of the stream
+func getStreamSettings() StreamSettings {
+    streamSettingsLocker.Lock()
+    defer streamSettingsLocker.Unlock()
+
+    return streamSettings
+}
+
+// Return the settings of the stream in the form the admin API uses
+func (settings StreamSettings) Json() map[string]interface{} {
+    return map[string]interface{}{
+        "bitrate": settings.Encoder.Bitrate,
+        "scale": settings.Encoder.Scale,
+        "segmentMs": settings.SegmentMs,
+        "playlistSeconds": settings.PlaylistSeconds,
+    }
+}
+
+// Queue settings for the processing loop, replacing any that it hasn't
+// yet picked up; the lock must be held
+func queueStreamSettings(settings StreamSettings) {
+    for {
+        select {
+            case streamSettingsChanges <- settings:
+                return
+            default:
+                select {
+                    case <-streamSettingsChanges:
+                    default:
+                }
+        }
+    }
+}
+
+// Change the settings of the stream, returning the new settings
+func changeStreamSettings(change StreamSettingsChange) (StreamSettings, error) {
+    streamSettingsLocker.Lock()
+    defer streamSettingsLocker.Unlock()
+
+    settings := streamSettings
+    if change.Bitrate != nil {
+        if *change.Bitrate > SETTINGS_MAX_BITRATE {
+            return streamSettings, errors.New(fmt.Sprintf("bitrate must be at most %d kbits/s (0 for the encoder default)", SETTINGS_MAX_BITRATE))
+        }
+        if (*change.Bitrate == 0) && (abrLadder != nil) {
+            return streamSettings, errors.New("bitrate must be given for the master playlist of the bitrate ladder")
+        }
+        settings.Encoder.Bitrate = int(*change.Bitrate)
+    }
+    if change.Scale != nil {
+        if (*change.Scale < 0) || (*change.Scale > SETTINGS_MAX_SCALE) {
+            return streamSettings, errors.New(fmt.Sprintf("scale must be between 0 (the default) and %g", SETTINGS_MAX_SCALE))
+        }
+        settings.Encoder.Scale = *change.Scale
+    }
+    if change.SegmentMs != nil {
+        if (*change.SegmentMs < SETTINGS_MIN_SEGMENT_MS) || (*change.SegmentMs > SETTINGS_MAX_SEGMENT_MS) {
+            return streamSettings, errors.New(fmt.Sprintf("segmentMs must be between %d and %d", SETTINGS_MIN_SEGMENT_MS, SETTINGS_MAX_SEGMENT_MS))
+        }
+        settings.SegmentMs = *change.SegmentMs
+    }
+    if change.PlaylistSeconds != nil {
+        if (*change.PlaylistSeconds == 0) || (*change.PlaylistSeconds > SETTINGS_MAX_PLAYLIST_SECONDS) {
+            return streamSettings, errors.New(fmt.Sprintf("playlistSeconds must be between 1 and %d", SETTINGS_MAX_PLAYLIST_SECONDS))
+        }
+        settings.PlaylistSeconds = *change.PlaylistSeconds
+    }
+    if settings.PlaylistSeconds * 1000 < settings.SegmentMs {
+        return streamSettings, errors.New("the playlist must be at least as long as a segment")
+    }
+
+    if (settings.Encoder != streamSettings.Encoder) || (settings.SegmentMs != streamSettings.SegmentMs) {
+        log.Printf("Encoder settings will change at the next segment boundary: bitrate %d kbits/s, scale %g, segment %d ms.\n",
+                   settings.Encoder.Bitrate, settings.Encoder.Scale, settings.SegmentMs)
+        queueStreamSettings(settings)
+    }
+    if (settings.Encoder.Bitrate != streamSettings.Encoder.Bitrate) && (abrLadder != nil) {
+        err := abrLadder.WriteMaster(settings.Encoder.Bitrate)
+        if err != nil {
+            log.Printf("Unable to update master playlist \"%s\" (%s).\n", abrLadder.MasterPath, err.Error())
+        }
+    }
+    if settings.PlaylistSeconds != streamSettings.PlaylistSeconds {
+        log.Printf("Playlist length will change to %d second(s).\n", settings.PlaylistSeconds)
+        mainPipeline.media <- &PlaylistLength{Seconds: settings.PlaylistSeconds}
+    }
+    streamSettings = settings
+
+    return settings, nil
+}
+
+/* End Of File */
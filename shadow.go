@@ -0,0 +1,222 @@
+/* Shadow encoding for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "container/list"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// A shadow encoder takes the same PCM as the main encoder but encodes
+// it with candidate settings, publishing the result to a playlist of its
+// own that is not linked from anywhere, so that new settings can be
+// auditioned on the live feed before they are used for the public stream.
+// The renditions of a bitrate ladder (see ladder.go) are shadow encoders
+// too, only they are linked from the master playlist.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of a shadow encoder
+type ShadowEncoder struct {
+    Dir                    string
+    PlaylistPath           string
+    Settings               Mp3Settings
+    PlaylistLength         time.Duration
+    encoder                Encoder
+    audio                  bytes.Buffer
+    segmentSamples         int
+    samples                int
+    offset                 time.Duration
+    fileList               *list.List
+    mediaSequenceNumber    int
+    discontinuitySequence  int
+    // True if the next segment is the first since a reset
+    resetDiscontinuity     bool
+    playlist               []byte
+    playlistLocker         sync.Mutex
+}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The shadow encoder, nil if there isn't one
+var shadowEncoder *ShadowEncoder
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a shadow encoder writing segments of segmentFileDurationMilliseconds
+// and a playlist, named playlistName, in mp3Dir
+func newShadowEncoder(mp3Dir string, playlistName string, codec string, settings Mp3Settings,
+                      segmentFileDurationMilliseconds uint, playlistLengthSeconds uint) *ShadowEncoder {
+    var err error
+
+    shadow := new(ShadowEncoder)
+    shadow.Dir = mp3Dir
+    shadow.PlaylistPath = mp3Dir + string(os.PathSeparator) + playlistName + PLAYLIST_EXTENSION
+    shadow.Settings = settings
+    shadow.PlaylistLength = time.Second * time.Duration(playlistLengthSeconds)
+    shadow.fileList = list.New()
+    shadow.encoder, err = newEncoder(codec, &shadow.audio, &shadow.Settings)
+    if err != nil {
+        log.Printf("Unable to create shadow %s encoder (%s).\n", codec, err.Error())
+        return nil
+    }
+    samplesPerFrame := shadow.encoder.FrameSamples()
+    shadow.segmentSamples = int(segmentFileDurationMilliseconds) * streamSamplingFrequency / 1000 / samplesPerFrame * samplesPerFrame
+    if shadow.segmentSamples < samplesPerFrame {
+        shadow.segmentSamples = samplesPerFrame
+    }
+    log.Printf("Shadow %s encoder (bitrate %d, scale %f, low pass %d Hz, high pass %d Hz) publishing to \"%s\".\n",
+               codec, settings.Bitrate, settings.Scale, settings.LowPassFrequency, settings.HighPassFrequency, shadow.PlaylistPath)
+    makePlaylist(shadow.fileList, &shadow.playlist, &shadow.playlistLocker, shadow.mediaSequenceNumber, shadow.discontinuitySequence, "", false, shadow.PlaylistPath)
+
+    return shadow
+}
+
+// Write the current segment to file and update the playlist
+func (shadow *ShadowEncoder) writeSegment() {
+    segmentEncoder, selfContained := shadow.encoder.(SegmentEncoder)
+    if selfContained {
+        segmentEncoder.EndSegment()
+    }
+    duration := time.Duration(shadow.samples * 1000000 / streamSamplingFrequency) * time.Microsecond
+    handle := openSegmentFile(shadow.Dir, shadow.encoder.Extension())
+    if handle != nil {
+        err := writeSegmentTag(shadow.encoder, handle, shadow.offset)
+        if err == nil {
+            _, err = shadow.audio.WriteTo(handle)
+        }
+        handle.Close()
+        if err == nil {
+            mp3AudioFile := new(Mp3AudioFile)
+            mp3AudioFile.fileName = filepath.Base(handle.Name())
+            mp3AudioFile.title = MP3_TITLE
+            mp3AudioFile.timestamp = time.Now()
+            mp3AudioFile.duration = duration
+            mp3AudioFile.usable = true
+            mp3AudioFile.discontinuity = shadow.resetDiscontinuity
+            shadow.resetDiscontinuity = false
+            shadow.fileList.PushBack(mp3AudioFile)
+        } else {
+            log.Printf("There was an error writing shadow segment \"%s\" (%s).\n", handle.Name(), err.Error())
+            removeSegmentFile(handle.Name())
+        }
+    }
+    shadow.audio.Reset()
+    if selfContained {
+        segmentEncoder.StartSegment()
+    }
+    shadow.offset += duration
+    shadow.samples = 0
+
+    // Age out old segments; unlike the main stream nothing depends on
+    // the shadow segments so they can be deleted as soon as they leave
+    // the playlist
+    var next *list.Element
+    for element := shadow.fileList.Front(); element != nil; element = next {
+        next = element.Next()
+        if time.Now().Sub(element.Value.(*Mp3AudioFile).timestamp) > shadow.PlaylistLength * 2 {
+            removeSegmentFile(shadow.Dir + string(os.PathSeparator) + element.Value.(*Mp3AudioFile).fileName)
+            shadow.fileList.Remove(element)
+        } else if time.Now().Sub(element.Value.(*Mp3AudioFile).timestamp) > shadow.PlaylistLength {
+            if element.Value.(*Mp3AudioFile).usable {
+                element.Value.(*Mp3AudioFile).usable = false
+                shadow.mediaSequenceNumber++
+                if element.Value.(*Mp3AudioFile).discontinuity {
+                    shadow.discontinuitySequence++
+                }
+            }
+        }
+    }
+    makePlaylist(shadow.fileList, &shadow.playlist, &shadow.playlistLocker, shadow.mediaSequenceNumber, shadow.discontinuitySequence, "", false, shadow.PlaylistPath)
+}
+
+// Encode some little-endian 16-bit PCM into the shadow stream; as for
+// the main stream, no more than is left of a segment is encoded into
+// it, so that each segment is a whole number of encoder frames and the
+// rest of the PCM starts the next
+func (shadow *ShadowEncoder) Write(pcm []byte) {
+    bytesPerSample := URTP_SAMPLE_SIZE * streamChannels
+    for len(pcm) >= bytesPerSample {
+        numBytes := (shadow.segmentSamples - shadow.samples) * bytesPerSample
+        if numBytes > len(pcm) {
+            numBytes = len(pcm) / bytesPerSample * bytesPerSample
+        }
+        samples, err := shadow.encoder.WriteSamples(pcm[:numBytes])
+        if err != nil {
+            log.Printf("Unable to encode shadow stream (%s).\n", err.Error())
+            return
+        }
+        pcm = pcm[numBytes:]
+        shadow.samples += samples
+        if shadow.samples >= shadow.segmentSamples {
+            shadow.writeSegment()
+        }
+    }
+}
+
+// Flush the shadow stream into a final segment, as for the main stream
+// on shutdown, and release the encoder
+func (shadow *ShadowEncoder) Close() {
+    if shadow.encoder == nil {
+        return
+    }
+    err := shadow.encoder.Flush()
+    if err != nil {
+        log.Printf("Unable to flush shadow encoder (%s).\n", err.Error())
+    }
+    if shadow.audio.Len() > 0 {
+        shadow.writeSegment()
+    }
+    shadow.encoder.Close()
+    shadow.encoder = nil
+}
+
+// Reset the shadow stream; as for the main stream, the sequence
+// numbers carry on and the next segment is a discontinuity
+func (shadow *ShadowEncoder) Reset() {
+    for element := shadow.fileList.Front(); element != nil; element = element.Next() {
+        removeSegmentFile(shadow.Dir + string(os.PathSeparator) + element.Value.(*Mp3AudioFile).fileName)
+        if element.Value.(*Mp3AudioFile).usable {
+            shadow.mediaSequenceNumber++
+            if element.Value.(*Mp3AudioFile).discontinuity {
+                shadow.discontinuitySequence++
+            }
+        }
+    }
+    shadow.fileList.Init()
+    segmentEncoder, selfContained := shadow.encoder.(SegmentEncoder)
+    if selfContained {
+        segmentEncoder.EndSegment()
+    }
+    shadow.audio.Reset()
+    if selfContained {
+        segmentEncoder.StartSegment()
+    }
+    shadow.samples = 0
+    shadow.offset = 0
+    shadow.resetDiscontinuity = true
+    makePlaylist(shadow.fileList, &shadow.playlist, &shadow.playlistLocker, shadow.mediaSequenceNumber, shadow.discontinuitySequence, "", false, shadow.PlaylistPath)
+}
+
+/* End Of File */
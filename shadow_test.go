@@ -0,0 +1,130 @@
+/* Tests of the shadow encoder of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "container/list"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// An encoder that, like LAME, only writes whole frames, each frame
+// being a byte giving its number
+type frameTestEncoder struct {
+    output      *bytes.Buffer
+    frameSize   int
+    pending     int
+    frames      int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of samples in a frame of the test encoder
+const FRAME_TEST_SAMPLES int = 1152
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+func (encoder *frameTestEncoder) WriteSamples(pcm []byte) (int, error) {
+    samples := len(pcm) / URTP_SAMPLE_SIZE / streamChannels
+    encoder.pending += samples
+    for ; encoder.pending >= encoder.frameSize; encoder.pending -= encoder.frameSize {
+        encoder.output.WriteByte(byte(encoder.frames))
+        encoder.frames++
+    }
+
+    return samples, nil
+}
+
+func (encoder *frameTestEncoder) Flush() error {
+    if encoder.pending > 0 {
+        encoder.output.WriteByte(byte(encoder.frames))
+        encoder.frames++
+        encoder.pending = 0
+    }
+
+    return nil
+}
+
+func (encoder *frameTestEncoder) FrameSamples() int {
+    return encoder.frameSize
+}
+
+func (encoder *frameTestEncoder) Extension() string {
+    return ".test"
+}
+
+func (encoder *frameTestEncoder) Close() {
+}
+
+// Check that, however the PCM is written to it, a shadow encoder cuts
+// segments on frame boundaries, each segment being a whole number of
+// frames and lasting as long as those frames
+func TestShadowSegmentFrames(t *testing.T) {
+    dir := t.TempDir()
+    shadow := &ShadowEncoder{Dir: dir, PlaylistPath: filepath.Join(dir, "shadow" + PLAYLIST_EXTENSION),
+                             PlaylistLength: time.Hour, fileList: list.New()}
+    encoder := &frameTestEncoder{output: &shadow.audio, frameSize: FRAME_TEST_SAMPLES}
+    shadow.encoder = encoder
+    framesPerSegment := 3
+    shadow.segmentSamples = FRAME_TEST_SAMPLES * framesPerSegment
+    frameDuration := time.Duration(FRAME_TEST_SAMPLES * 1000000 / streamSamplingFrequency) * time.Microsecond
+
+    // Blocks of awkward sizes, one bigger than a segment
+    for _, numSamples := range []int{1000, 333, 5000, 7, SAMPLES_PER_BLOCK, 4444, 1, 2048, 3456, 10000} {
+        shadow.Write(make([]byte, numSamples * URTP_SAMPLE_SIZE * streamChannels))
+    }
+    shadow.Close()
+
+    segments := 0
+    tagSize := segmentTagSize(encoder)
+    for element := shadow.fileList.Front(); element != nil; element = element.Next() {
+        file := element.Value.(*Mp3AudioFile)
+        data, err := os.ReadFile(filepath.Join(dir, file.fileName))
+        if err != nil {
+            t.Fatal(err)
+        }
+        // All but the last segment, which has what was flushed, are
+        // exactly a segment's worth of frames, in order
+        if element.Next() != nil {
+            if file.duration != frameDuration * time.Duration(framesPerSegment) {
+                t.Errorf("segment %d: expected a duration of %v, got %v.", segments, frameDuration * time.Duration(framesPerSegment), file.duration)
+            }
+            if len(data) != tagSize + framesPerSegment {
+                t.Fatalf("segment %d: expected %d frame(s), got %d.", segments, framesPerSegment, len(data) - tagSize)
+            }
+            for x, frame := range data[tagSize:] {
+                if int(frame) != segments * framesPerSegment + x {
+                    t.Errorf("segment %d: expected frame %d, got frame %d.", segments, segments * framesPerSegment + x, frame)
+                }
+            }
+        }
+        segments++
+    }
+    totalSamples := 1000 + 333 + 5000 + 7 + SAMPLES_PER_BLOCK + 4444 + 1 + 2048 + 3456 + 10000
+    if wanted := (totalSamples + shadow.segmentSamples - 1) / shadow.segmentSamples; segments != wanted {
+        t.Errorf("expected %d segments, got %d.", wanted, segments)
+    }
+}
+
+/* End Of File */
@@ -0,0 +1,257 @@
+/* Signed stream URLs for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// So that a playlist handed to a paying member can't simply be shared
+// and hot-linked forever, with --urlsecret every request for the audio
+// (an HLS playlist or segment, the live WebSocket, WHEP, a clip or a
+// chuff clip) must carry the query parameters
+// SIGNED_URL_EXPIRES, the Unix time at which the URL expires, and
+// SIGNED_URL_SIGNATURE, the HMAC-SHA256 of the expiry time signed with
+// the URL secret; a request without them, with a signature that
+// doesn't match or after the expiry time is refused with a 403.
+// Signed URLs are issued through the admin API.  A signature covers
+// the whole of the stream, rather than a single path, since a player
+// doesn't carry the query of a playlist over to the URIs in it: when a
+// playlist is served the query parameters that it was asked for with
+// are added to every relative URI in it, so a player goes on fetching
+// segments until the expiry time.  Absolute URIs, e.g. those of a CDN
+// (see objectstore.go), are left alone.  A further stream may be given
+// a URL secret of its own with --streamsecret, e.g. where it is hosted
+// for another railway, in which case the requests for it at
+// /stream/<name>/ must be signed with that secret rather than with
+// --urlsecret.
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The query parameter giving the Unix time at which a URL expires
+const SIGNED_URL_EXPIRES string = "expires"
+
+// The query parameter giving the signature of a URL
+const SIGNED_URL_SIGNATURE string = "signature"
+
+// The longest a signed URL may be issued for
+const SIGNED_URL_MAX_LIFETIME time.Duration = time.Hour * 24 * 31
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The secret that URLs are signed with, nil if URLs aren't signed
+var urlSecret []byte
+
+// The secrets of the further streams that have URL secrets of their
+// own (--streamsecret), by stream name
+var streamUrlSecrets = make(map[string][]byte)
+
+// Matches the URI attribute of a tag in a playlist (e.g. EXT-X-MAP)
+var signedUrlUriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Read a URL secret from secretFileName
+func readSecretFile(secretFileName string) ([]byte, error) {
+    secret, err := os.ReadFile(secretFileName)
+    if err != nil {
+        return nil, err
+    }
+    secret = []byte(strings.TrimSpace(string(secret)))
+    if len(secret) < 16 {
+        return nil, errors.New(fmt.Sprintf("the URL secret in \"%s\" must be at least 16 characters long", secretFileName))
+    }
+
+    return secret, nil
+}
+
+// Read the secret that URLs are signed with from secretFileName
+func readUrlSecret(secretFileName string) error {
+    secret, err := readSecretFile(secretFileName)
+    if err != nil {
+        return err
+    }
+    urlSecret = secret
+    log.Printf("Requests for the stream must be signed.\n")
+
+    return nil
+}
+
+// Read the URL secret of a further stream from a --streamsecret
+// option, given as <name>=<file>
+func readStreamUrlSecret(option string) error {
+    name, secretFileName, found := strings.Cut(option, "=")
+    if !found || (name == "") || (secretFileName == "") {
+        return errors.New("a stream secret must be given as <name>=<file>")
+    }
+    pipeline := findPipeline(name)
+    if (pipeline == nil) || (pipeline == mainPipeline) {
+        return errors.New(fmt.Sprintf("there is no further stream \"%s\" (see --stream)", name))
+    }
+    secret, err := readSecretFile(secretFileName)
+    if err != nil {
+        return err
+    }
+    streamUrlSecrets[name] = secret
+    log.Printf("Requests for stream \"%s\" must be signed with a secret of its own.\n", name)
+
+    return nil
+}
+
+// Return the secret that the requests for a stream, at
+// /stream/<name>/, must be signed with, nil if they needn't be
+func streamUrlSecret(name string) []byte {
+    if secret, ok := streamUrlSecrets[name]; ok {
+        return secret
+    }
+
+    return urlSecret
+}
+
+// Return the signature for an expiry time
+func signUrlExpiry(secret []byte, expires int64) string {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(strconv.FormatInt(expires, 10)))
+
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Return the signed query, signed with secret, for URLs lasting for
+// the given time and the time at which they expire
+func signUrlQuery(secret []byte, lifetime time.Duration) (string, time.Time, error) {
+    if secret == nil {
+        return "", time.Time{}, errors.New("URLs aren't signed (see --urlsecret and --streamsecret)")
+    }
+    if (lifetime <= 0) || (lifetime > SIGNED_URL_MAX_LIFETIME) {
+        return "", time.Time{}, errors.New(fmt.Sprintf("a signed URL must last for between 1 second and %d hours",
+                                                      SIGNED_URL_MAX_LIFETIME / time.Hour))
+    }
+    expires := time.Now().Add(lifetime)
+
+    return fmt.Sprintf("%s=%d&%s=%s", SIGNED_URL_EXPIRES, expires.Unix(), SIGNED_URL_SIGNATURE,
+                       signUrlExpiry(secret, expires.Unix())), expires, nil
+}
+
+// Check that a request is signed with secret
+func checkSignedUrl(in *http.Request, secret []byte) error {
+    expires, err := strconv.ParseInt(in.URL.Query().Get(SIGNED_URL_EXPIRES), 10, 64)
+    if err != nil {
+        return errors.New("the URL isn't signed")
+    }
+    if !hmac.Equal([]byte(in.URL.Query().Get(SIGNED_URL_SIGNATURE)), []byte(signUrlExpiry(secret, expires))) {
+        return errors.New("the signature of the URL isn't valid")
+    }
+    if time.Now().Unix() > expires {
+        return errors.New("the URL has expired")
+    }
+
+    return nil
+}
+
+// Return true if a request for the stream may be served, else answer
+// it with a 403 and return false; every handler that serves the audio,
+// in whatever form, must call this or, for a request under
+// /stream/<name>/, allowStreamSignedUrl()
+func allowSignedUrl(out http.ResponseWriter, in *http.Request) bool {
+    return allowUrlSignedWith(out, in, urlSecret)
+}
+
+// Return true if a request for the stream of the given name may be
+// served, else answer it with a 403 and return false
+func allowStreamSignedUrl(out http.ResponseWriter, in *http.Request, name string) bool {
+    return allowUrlSignedWith(out, in, streamUrlSecret(name))
+}
+
+// Return true if a request is signed with secret, or secret is nil,
+// else answer it with a 403 and return false
+func allowUrlSignedWith(out http.ResponseWriter, in *http.Request, secret []byte) bool {
+    if secret == nil {
+        return true
+    }
+    err := checkSignedUrl(in, secret)
+    if err != nil {
+        log.Printf("Refusing \"%s\" from %s (%s).\n", in.URL.Path, in.RemoteAddr, err.Error())
+        http.Error(out, err.Error(), http.StatusForbidden)
+        return false
+    }
+
+    return true
+}
+
+// Add the signed query to a URI, unless it is absolute or there is no
+// query
+func signUri(uri string, query string) string {
+    if (uri == "") || (query == "") || strings.Contains(uri, "://") {
+        return uri
+    }
+    if strings.Contains(uri, "?") {
+        return uri + "&" + query
+    }
+
+    return uri + "?" + query
+}
+
+// Return the signed query of a request, empty if secret, that it is
+// signed with, is nil
+func signedQuery(in *http.Request, secret []byte) string {
+    if secret == nil {
+        return ""
+    }
+
+    return fmt.Sprintf("%s=%s&%s=%s", SIGNED_URL_EXPIRES, in.URL.Query().Get(SIGNED_URL_EXPIRES),
+                       SIGNED_URL_SIGNATURE, in.URL.Query().Get(SIGNED_URL_SIGNATURE))
+}
+
+// Return a playlist with the signed query of the request it was asked
+// for with, signed with secret, added to every relative URI in it
+func signPlaylist(playlist []byte, in *http.Request, secret []byte) []byte {
+    if secret == nil {
+        return playlist
+    }
+    query := signedQuery(in, secret)
+    lines := bytes.Split(playlist, []byte("\n"))
+    for x, line := range lines {
+        text := strings.TrimSuffix(string(line), "\r")
+        eol := string(line[len(text):])
+        if strings.HasPrefix(text, "#") {
+            text = signedUrlUriAttribute.ReplaceAllStringFunc(text, func(attribute string) string {
+                return "URI=\"" + signUri(signedUrlUriAttribute.FindStringSubmatch(attribute)[1], query) + "\""
+            })
+        } else {
+            text = signUri(strings.TrimSpace(text), query)
+        }
+        lines[x] = []byte(text + eol)
+    }
+
+    return bytes.Join(lines, []byte("\n"))
+}
+
+/* End Of File */
@@ -0,0 +1,204 @@
+/* Server-sent events output for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// So that web pages and monitors can react to what is happening to
+// the stream as it happens, rather than polling, the events of the
+// pipeline (see events.go), e.g. client_connected, reset, segment and
+// underrun, are served as server-sent events at SSE_PATH (see --sse),
+// for an EventSource in a browser.  Each event is an SSE event of the
+// same name with, as its data, a JSON object of the time (Unix
+// milliseconds) and the fields of the event, durations being in
+// milliseconds, as for scripts.  Since anyone may listen only the
+// fields in sseFields are included, so that nothing that identifies a
+// client (its address, or the name of its mixer input, which is made
+// from its address) gets out, whatever fields events grow in future.  ?events=<name>,<name>... limits
+// the events sent to those named.  A comment is sent every
+// SSE_KEEP_ALIVE_PERIOD so that proxies don't close a quiet connection.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of the server-sent events output
+type EventStream struct {
+    locker     sync.Mutex
+    clients    int
+    connected  int
+    closed     chan struct{}
+}
+
+// Statistics of the server-sent events output
+type EventStreamStats struct {
+    Clients    int  `json:"clients"`
+    Connected  int  `json:"connected"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The path at which server-sent events are served
+const SSE_PATH string = "/events"
+
+// The most clients there may be at once
+const SSE_MAX_CLIENTS int = 50
+
+// The number of events that may be queued for a client
+const SSE_QUEUE_SIZE int = 100
+
+// How often to send a comment to keep a quiet connection open
+const SSE_KEEP_ALIVE_PERIOD time.Duration = time.Second * 15
+
+// How long a client should wait before connecting again if the
+// connection is lost
+const SSE_RETRY_PERIOD time.Duration = time.Second * 5
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The server-sent events output, nil if there isn't one
+var eventStream *EventStream
+
+// The fields of events that may be served to anyone
+var sseFields = map[string]bool{"reason": true, "samples": true, "filled": true, "file": true,
+                                "duration": true, "stream": true, "received": true, "period": true,
+                                "buffered": true, "dropped": true, "lowWater": true, "start": true,
+                                "freePercent": true}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create the server-sent events output
+func newEventStream() *EventStream {
+    log.Printf("Events will be served as server-sent events at %s.\n", SSE_PATH)
+
+    return &EventStream{closed: make(chan struct{})}
+}
+
+// Return the data of an event as JSON
+func eventStreamData(event *Event) []byte {
+    data := map[string]interface{}{"time": event.Time.UnixNano() / int64(time.Millisecond)}
+    for key, value := range event.Fields {
+        if !sseFields[key] {
+            continue
+        }
+        switch value := value.(type) {
+            case time.Duration:
+                data[key] = int64(value / time.Millisecond)
+            default:
+                data[key] = value
+        }
+    }
+    encoded, _ := json.Marshal(data)
+
+    return encoded
+}
+
+// Serve events to a client until it goes
+func (stream *EventStream) serve(out http.ResponseWriter, in *http.Request) {
+    flusher, ok := out.(http.Flusher)
+    if !ok {
+        http.Error(out, "streaming is not supported", http.StatusInternalServerError)
+        return
+    }
+    stream.locker.Lock()
+    full := stream.clients >= SSE_MAX_CLIENTS
+    if !full {
+        stream.clients++
+        stream.connected++
+    }
+    stream.locker.Unlock()
+    if full {
+        http.Error(out, "too many clients", http.StatusServiceUnavailable)
+        return
+    }
+    wanted := make(map[string]bool)
+    for _, name := range strings.Split(in.URL.Query().Get("events"), ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            wanted[name] = true
+        }
+    }
+    events := subscribeEvents(SSE_QUEUE_SIZE)
+    log.Printf("Server-sent events client %s connected.\n", in.RemoteAddr)
+
+    out.Header().Set("Content-Type", "text/event-stream")
+    out.Header().Set("Cache-Control", "no-cache")
+    out.WriteHeader(http.StatusOK)
+    fmt.Fprintf(out, "retry: %d\n\n", SSE_RETRY_PERIOD / time.Millisecond)
+    flusher.Flush()
+    keepAlive := time.NewTicker(SSE_KEEP_ALIVE_PERIOD)
+    for done := false; !done; {
+        var err error
+        select {
+            case event := <-events:
+                if (len(wanted) == 0) || wanted[event.Name] {
+                    _, err = fmt.Fprintf(out, "event: %s\ndata: %s\n\n", event.Name, eventStreamData(event))
+                }
+            case <-keepAlive.C:
+                _, err = fmt.Fprintf(out, ": keep-alive\n\n")
+            case <-in.Context().Done():
+                done = true
+            case <-stream.closed:
+                done = true
+        }
+        if err != nil {
+            done = true
+        }
+        flusher.Flush()
+    }
+    keepAlive.Stop()
+    unsubscribeEvents(events)
+
+    stream.locker.Lock()
+    stream.clients--
+    stream.locker.Unlock()
+    log.Printf("Server-sent events client %s disconnected.\n", in.RemoteAddr)
+}
+
+// Disconnect all the clients, e.g. so that the HTTP server can shut
+// down; the server-sent events output may not be served again
+func (stream *EventStream) Close() {
+    close(stream.closed)
+}
+
+// Handle a request for server-sent events
+func eventStreamHandler(out http.ResponseWriter, in *http.Request) {
+    if eventStream == nil {
+        http.NotFound(out, in)
+        return
+    }
+    eventStream.serve(out, in)
+}
+
+// Return the statistics of the server-sent events output
+func (stream *EventStream) Stats() interface{} {
+    stream.locker.Lock()
+    defer stream.locker.Unlock()
+
+    return EventStreamStats{Clients: stream.clients, Connected: stream.connected}
+}
+
+/* End Of File */
@@ -0,0 +1,127 @@
+/* Ticker starvation detection for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// If the machine is overloaded, or stalls writing to an SD card, the
+// pipeline tickers fire late (a Go ticker drops ticks the receiver
+// isn't ready for).  A ticker monitor measures this so that the
+// slippage can be compensated for and so that "pipeline starvation"
+// is visible rather than just showing up as buffers draining and
+// silence being inserted.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// Monitor of a ticker
+type TickerMonitor struct {
+    Name           string
+    Period         time.Duration
+    locker         sync.Mutex
+    last           time.Time
+    lastLogged     time.Time
+    ticks          uint64
+    lateTicks      uint64
+    totalSlippage  time.Duration
+    maxSlippage    time.Duration
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// A tick is late if it arrives more than this percentage of the
+// ticker period after it should have
+const TICKER_LATE_PERCENT time.Duration = 50
+
+// The minimum time between logs of late ticks for a ticker
+const TICKER_LOG_PERIOD time.Duration = time.Second * 10
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a ticker monitor, registering its statistics
+func newTickerMonitor(name string, period time.Duration) *TickerMonitor {
+    monitor := &TickerMonitor{Name: name, Period: period}
+    registerStats("ticker_" + name, monitor.Stats)
+
+    return monitor
+}
+
+// Return how late a tick was, given the time since the previous one,
+// zero if it wasn't late
+func (monitor *TickerMonitor) Late(elapsed time.Duration) time.Duration {
+    if slippage := elapsed - monitor.Period; slippage > monitor.Period * TICKER_LATE_PERCENT / 100 {
+        return slippage
+    }
+
+    return 0
+}
+
+// Note a tick, returning the time since the previous one
+func (monitor *TickerMonitor) Tick(now time.Time) time.Duration {
+    elapsed := monitor.Period
+
+    monitor.locker.Lock()
+    if !monitor.last.IsZero() {
+        elapsed = now.Sub(monitor.last)
+    }
+    monitor.last = now
+    monitor.ticks++
+    if slippage := monitor.Late(elapsed); slippage > 0 {
+        monitor.lateTicks++
+        monitor.totalSlippage += slippage
+        if slippage > monitor.maxSlippage {
+            monitor.maxSlippage = slippage
+        }
+        if now.Sub(monitor.lastLogged) > TICKER_LOG_PERIOD {
+            log.Printf("The %s ticker (period %d ms) fired %d ms late, %d late tick(s) so far, %d ms in total; the server may be overloaded.\n",
+                       monitor.Name, monitor.Period / time.Millisecond, slippage / time.Millisecond, monitor.lateTicks,
+                       monitor.totalSlippage / time.Millisecond)
+            monitor.lastLogged = now
+        }
+    }
+    monitor.locker.Unlock()
+
+    return elapsed
+}
+
+// Return the statistics of a ticker monitor
+func (monitor *TickerMonitor) Stats() interface{} {
+    var starvationPercent float64
+
+    monitor.locker.Lock()
+    defer monitor.locker.Unlock()
+    if monitor.ticks > 0 {
+        // The proportion of time the ticker has been late by
+        starvationPercent = float64(monitor.totalSlippage) * 100 / (float64(monitor.ticks) * float64(monitor.Period) + float64(monitor.totalSlippage))
+    }
+
+    return map[string]interface{}{
+        "periodMs": int64(monitor.Period / time.Millisecond),
+        "ticks": monitor.ticks,
+        "lateTicks": monitor.lateTicks,
+        "totalSlippageMs": int64(monitor.totalSlippage / time.Millisecond),
+        "maxSlippageMs": int64(monitor.maxSlippage / time.Millisecond),
+        "starvationPercent": starvationPercent,
+    }
+}
+
+/* End Of File */
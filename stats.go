@@ -0,0 +1,63 @@
+/* Statistics for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "sync"
+)
+
+// Parts of the server that keep statistics register a provider
+// here, under a name, and a snapshot of all of them can then be
+// served by the admin API.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A function returning the current statistics of something, in a
+// form that can be marshalled to JSON
+type StatsProvider func() interface{}
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The registered statistics providers
+var statsProviders = make(map[string]StatsProvider)
+var statsProvidersLocker sync.Mutex
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Register a statistics provider under a name, replacing any
+// provider already registered under that name
+func registerStats(name string, provider StatsProvider) {
+    statsProvidersLocker.Lock()
+    statsProviders[name] = provider
+    statsProvidersLocker.Unlock()
+}
+
+// Return a snapshot of all the statistics
+func statsSnapshot() map[string]interface{} {
+    snapshot := make(map[string]interface{})
+    statsProvidersLocker.Lock()
+    for name, provider := range statsProviders {
+        snapshot[name] = provider()
+    }
+    statsProvidersLocker.Unlock()
+
+    return snapshot
+}
+
+/* End Of File */
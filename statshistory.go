@@ -0,0 +1,264 @@
+/* Statistics history for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// So that a dashboard can graph loss and buffer depth without a full
+// metrics stack, the HTTP server may serve (see --statshistory), at
+// STATS_API_PATH, a JSON snapshot of the things that matter about the
+// ingest, the pipeline and the output of the main stream, along with a
+// history of them: every STATS_HISTORY_PERIOD a sample of what happened
+// in the period (datagrams received and dropped, gaps and the audio
+// filled in for them, as a percentage loss) and of the state at the
+// end of it (the buffer depths, the listeners) is added to a ring
+// buffer holding the last --statshistory minutes.  Unlike the admin
+// API statistics anyone may ask, so nothing that identifies a client
+// or a listener is included.  ?since=<Unix milliseconds> returns only
+// the samples after that time, so that a dashboard polling for new
+// samples needn't fetch the whole history each time.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A sample of the statistics over a period
+type StatsSample struct {
+    // Unix milliseconds at the end of the period
+    Time               int64    `json:"time"`
+    DatagramsReceived  uint64   `json:"datagramsReceived"`
+    DatagramsDropped   uint64   `json:"datagramsDropped"`
+    Gaps               int      `json:"gaps"`
+    FilledMs           int64    `json:"filledMs"`
+    LossPercent        float64  `json:"lossPercent"`
+    PcmBufferedMs      int64    `json:"pcmBufferedMs"`
+    OutputBufferedMs   int64    `json:"outputBufferedMs"`
+    Underruns          int      `json:"underruns"`
+    Listeners          int      `json:"listeners"`
+    BytesPerSecond     int64    `json:"bytesPerSecond"`
+}
+
+// The totals from which a sample is worked out
+type StatsTotals struct {
+    datagramsReceived  uint64
+    datagramsDropped   uint64
+    gaps               int
+    filledMs           int64
+    underruns          int
+}
+
+// The statistics history
+type StatsHistory struct {
+    Length     int
+    locker     sync.Mutex
+    // A ring buffer, the oldest at next once full
+    samples    []StatsSample
+    next       int
+    last       StatsTotals
+    lastTime   time.Time
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The path at which the statistics are served
+const STATS_API_PATH string = "/api/stats"
+
+// How often a sample is added to the history
+const STATS_HISTORY_PERIOD time.Duration = time.Second * 10
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The statistics history, nil if the statistics aren't served
+var statsHistory *StatsHistory
+
+// The total number of datagrams received by the processing loop of
+// the main stream (use atomic operations)
+var datagramsReceivedTotal uint64
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a statistics history of the given number of minutes
+func newStatsHistory(minutes uint) *StatsHistory {
+    history := &StatsHistory{Length: int(time.Duration(minutes) * time.Minute / STATS_HISTORY_PERIOD)}
+    history.last = statsTotals()
+    history.lastTime = time.Now()
+
+    return history
+}
+
+// Return the totals from which a sample is worked out
+func statsTotals() StatsTotals {
+    totals := StatsTotals{datagramsReceived: atomic.LoadUint64(&datagramsReceivedTotal),
+                          datagramsDropped: atomic.LoadUint64(&mainPipeline.datagramsDropped)}
+    if gapStats, ok := mainPipeline.gaps.Stats().(GapStats); ok {
+        totals.gaps = gapStats.Gaps
+        totals.filledMs = gapStats.FilledMs
+    }
+    if lowWaterStats, ok := mainPipeline.lowWater.Stats().(LowWaterMarkStats); ok {
+        totals.underruns = lowWaterStats.Underruns
+    }
+
+    return totals
+}
+
+// Add a sample of the period up to now to the history
+func (history *StatsHistory) sample(now time.Time) {
+    totals := statsTotals()
+    pcmBuffered, outputBuffered := bufferDepths()
+
+    history.locker.Lock()
+    defer history.locker.Unlock()
+
+    sample := StatsSample{Time: now.UnixNano() / int64(time.Millisecond),
+                          DatagramsReceived: totals.datagramsReceived - history.last.datagramsReceived,
+                          DatagramsDropped: totals.datagramsDropped - history.last.datagramsDropped,
+                          Gaps: totals.gaps - history.last.gaps, FilledMs: totals.filledMs - history.last.filledMs,
+                          PcmBufferedMs: int64(pcmBuffered / time.Millisecond),
+                          OutputBufferedMs: int64(outputBuffered / time.Millisecond),
+                          Underruns: totals.underruns - history.last.underruns}
+    if periodMs := int64(now.Sub(history.lastTime) / time.Millisecond); periodMs > 0 {
+        sample.LossPercent = float64(sample.FilledMs) * 100 / float64(periodMs)
+    }
+    if listenerTracker != nil {
+        if listenerStats, ok := listenerTracker.Stats().(ListenerTrackerStats); ok {
+            sample.Listeners = listenerStats.Listeners
+            sample.BytesPerSecond = listenerStats.BytesPerSecond
+        }
+    }
+    history.last = totals
+    history.lastTime = now
+
+    if len(history.samples) < history.Length {
+        history.samples = append(history.samples, sample)
+    } else if history.Length > 0 {
+        history.samples[history.next] = sample
+        history.next = (history.next + 1) % history.Length
+    }
+}
+
+// Return the samples after the given Unix milliseconds, oldest first
+func (history *StatsHistory) Samples(since int64) []StatsSample {
+    samples := []StatsSample{}
+
+    history.locker.Lock()
+    defer history.locker.Unlock()
+
+    for x := 0; x < len(history.samples); x++ {
+        sample := history.samples[(history.next + x) % len(history.samples)]
+        if sample.Time > since {
+            samples = append(samples, sample)
+        }
+    }
+
+    return samples
+}
+
+// Add a sample to the history every STATS_HISTORY_PERIOD until ctx
+// is done
+func (history *StatsHistory) Run(ctx context.Context) {
+    ticker := time.NewTicker(STATS_HISTORY_PERIOD)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-ctx.Done():
+                return
+            case now := <-ticker.C:
+                history.sample(now)
+        }
+    }
+}
+
+// Return a snapshot of the ingest, the pipeline and the output of the
+// main stream
+func statsApiSnapshot() map[string]interface{} {
+    ingestLocker.Lock()
+    sessionStarted := session.Started
+    lastDatagram := session.LastDatagram
+    ingestLocker.Unlock()
+    totals := statsTotals()
+    pcmBuffered, outputBuffered := bufferDepths()
+
+    ingest := map[string]interface{}{
+        "sessionStarted": sessionStarted,
+        "lastDatagram": lastDatagram,
+        "datagramsReceived": totals.datagramsReceived,
+        "datagramsDropped": totals.datagramsDropped,
+        "gaps": totals.gaps,
+        "filledMs": totals.filledMs,
+    }
+    pipeline := map[string]interface{}{
+        "pcmBufferedMs": int64(pcmBuffered / time.Millisecond),
+        "outputBufferedMs": int64(outputBuffered / time.Millisecond),
+        "lowWater": mainPipeline.lowWater.Stats(),
+    }
+    output := make(map[string]interface{})
+    if mainPipeline != nil {
+        output["stream"] = mainPipeline.OutputStats()
+    }
+    if listenerTracker != nil {
+        if listenerStats, ok := listenerTracker.Stats().(ListenerTrackerStats); ok {
+            output["listeners"] = listenerStats.Listeners
+            output["peakListeners"] = listenerStats.Peak
+            output["bytesPerSecond"] = listenerStats.BytesPerSecond
+        }
+    }
+
+    return map[string]interface{}{"version": SERVER_VERSION, "time": time.Now().UnixNano() / int64(time.Millisecond),
+                                  "ingest": ingest, "pipeline": pipeline, "output": output}
+}
+
+// Handle a request for the statistics
+func statsApiHandler(out http.ResponseWriter, in *http.Request) {
+    var since int64
+
+    if statsHistory == nil {
+        http.NotFound(out, in)
+        return
+    }
+    if in.Method != http.MethodGet {
+        http.Error(out, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if sinceString := in.URL.Query().Get("since"); sinceString != "" {
+        var err error
+        since, err = strconv.ParseInt(sinceString, 10, 64)
+        if err != nil {
+            http.Error(out, "since must be Unix milliseconds", http.StatusBadRequest)
+            return
+        }
+    }
+    snapshot := statsApiSnapshot()
+    snapshot["historyPeriodMs"] = int64(STATS_HISTORY_PERIOD / time.Millisecond)
+    snapshot["history"] = statsHistory.Samples(since)
+
+    stopCache(out)
+    out.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(out).Encode(snapshot)
+}
+
+/* End Of File */
@@ -0,0 +1,37 @@
+/* Syslog output for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+//go:build linux
+
+package main
+
+import (
+    "io"
+    "log/syslog"
+)
+
+// Rather than to a log file or stderr, the server may log to the
+// local syslog (see --syslog) which, where systemd is in use, is
+// journald, so that the log outlives a reboot and is rotated along
+// with everything else; syslog and journald keep the time of each
+// message, so the log package doesn't add one of its own.
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Open the local syslog for logging, each message marked with tag
+func openSyslog(tag string) (io.Writer, error) {
+    return syslog.New(syslog.LOG_INFO | syslog.LOG_DAEMON, tag)
+}
+
+/* End Of File */
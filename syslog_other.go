@@ -0,0 +1,31 @@
+/* Syslog output stub for non-Linux platforms for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+//go:build !linux
+
+package main
+
+import (
+    "errors"
+    "io"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Syslog is only supported on Linux
+func openSyslog(tag string) (io.Writer, error) {
+    return nil, errors.New("syslog is not supported on this platform")
+}
+
+/* End Of File */
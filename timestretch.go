@@ -0,0 +1,436 @@
+/* Time-stretching for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "math"
+    "sync"
+    "time"
+)
+
+// The time-stretcher here is a WSOLA (waveform similarity overlap-add)
+// implementation: output is built from Hann-windowed frames overlapped
+// by 50%, each frame being taken from the input at the nominal position
+// for the required speed, adjusted by up to half a hop either way
+// so that it lines up best with the natural continuation of the
+// previous frame.  This changes speed without changing pitch.  In a
+// stereo stream the best match is found from the sum of the channels
+// and both channels are taken from the same place, so that they stay
+// in step.
+//
+// It is used in two places: catch-up mode plays the output slightly
+// fast while too much audio has built up, and the audio going into
+// the PCM buffer is always put through a time-stretcher which plays it
+// slightly slow, by up to SLOW_DOWN_MAX_PERCENT, while the HLS output
+// buffer is low (e.g. because the throughput of a cellular link has
+// dropped), which is much less audible than topping the buffer up.
+// Once the buffer is healthy again, what was made up for while the
+// pipeline was starved of CPU is paid back by playing the audio going
+// into the PCM buffer slightly fast in the same way.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of a time-stretcher; hop, tolerance and positions are in
+// samples of each channel
+type TimeStretcher struct {
+    channels  int
+    hop       int
+    tolerance int
+    window    []float32
+    // Interleaved, as are overlap and output
+    input     []float32
+    // The sum of the channels of input
+    mixed     []float32
+    nominal   float64
+    previous  int
+    overlap   []float32
+    output    []int16
+}
+
+// State of catch-up mode, where the output is paced at real time and
+// played slightly fast while too much audio is buffered
+type CatchUp struct {
+    Stretcher         *TimeStretcher
+    ThresholdSamples  int
+    Speed             float64
+    active            bool
+    credit            int
+    lastRead          time.Time
+}
+
+// State of slowing down the audio going into the PCM buffer; owed is
+// the number of samples to be paid back after the pipeline has been
+// starved (see starvation.go)
+type SlowDown struct {
+    Stretcher   *TimeStretcher
+    Speed       float64
+    samplesIn   int64
+    samplesOut  int64
+    owed        int64
+    locker      sync.Mutex
+}
+
+// Statistics of slowing down
+type SlowDownStats struct {
+    Speed      float64  `json:"speed"`
+    // How much longer the audio has been made
+    AddedMs    int64    `json:"addedMs"`
+    // How much is still to be paid back after starvation
+    OwedMs     int64    `json:"owedMs"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The hop between output frames (frames are twice this long); the
+// distance either side of the nominal position to search for the best
+// matching frame is half this
+const TIME_STRETCH_HOP_MILLISECONDS int = 10
+
+// The most output that catch-up mode will save up while there is no
+// audio to send
+const CATCH_UP_MAX_CREDIT_MILLISECONDS int = BLOCK_DURATION_MS * 5
+
+// The most, in percent, that the audio going into the PCM buffer is
+// slowed down by, and sped up by when paying back after starvation
+const SLOW_DOWN_MAX_PERCENT float64 = 2
+
+// The most that may be owed after starvation
+const SLOW_DOWN_MAX_OWED_MILLISECONDS int = 10000
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Catch-up mode, nil if not enabled
+var catchUp *CatchUp
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a time-stretcher
+func newTimeStretcher() *TimeStretcher {
+    stretcher := new(TimeStretcher)
+    stretcher.channels = streamChannels
+    stretcher.hop = streamSamplingFrequency * TIME_STRETCH_HOP_MILLISECONDS / 1000
+    stretcher.tolerance = stretcher.hop / 2
+    stretcher.window = make([]float32, stretcher.hop * 2)
+    for x := range stretcher.window {
+        stretcher.window[x] = float32(0.5 - 0.5 * math.Cos(2 * math.Pi * float64(x) / float64(len(stretcher.window))))
+    }
+    stretcher.overlap = make([]float32, stretcher.hop * stretcher.channels)
+    stretcher.previous = -1
+    // Start far enough in that the search never goes off the front
+    stretcher.nominal = float64(stretcher.tolerance)
+
+    return stretcher
+}
+
+// Put interleaved samples into a time-stretcher
+func (stretcher *TimeStretcher) Put(samples []int16) {
+    var sum float32
+
+    for x, sample := range samples {
+        stretcher.input = append(stretcher.input, float32(sample))
+        sum += float32(sample)
+        if (x + 1) % stretcher.channels == 0 {
+            stretcher.mixed = append(stretcher.mixed, sum)
+            sum = 0
+        }
+    }
+}
+
+// Return the number of input samples, in each channel, held by the
+// time-stretcher that have not yet been used
+func (stretcher *TimeStretcher) Buffered() int {
+    return len(stretcher.mixed) - int(stretcher.nominal)
+}
+
+// Return how well a candidate frame start matches a target
+func similarity(candidate []float32, target []float32) float64 {
+    var correlation float64
+    var energy float64
+
+    for x := range target {
+        correlation += float64(candidate[x]) * float64(target[x])
+        energy += float64(candidate[x]) * float64(candidate[x])
+    }
+
+    return correlation / math.Sqrt(energy + 1)
+}
+
+// Produce one hop of output at the given speed, returning false if
+// there is not enough input to do so
+func (stretcher *TimeStretcher) step(speed float64) bool {
+    hop := stretcher.hop
+    channels := stretcher.channels
+    nominal := int(stretcher.nominal)
+    best := nominal
+
+    if nominal + stretcher.tolerance + hop * 2 > len(stretcher.mixed) {
+        return false
+    }
+
+    if stretcher.previous >= 0 {
+        natural := stretcher.previous + hop
+        if speed == 1 {
+            // Just carry on from where we are, which gives perfect
+            // reconstruction of the input
+            best = natural
+            if best + hop * 2 > len(stretcher.mixed) {
+                return false
+            }
+        } else {
+            target := stretcher.mixed[natural:natural + hop]
+            bestSimilarity := math.Inf(-1)
+            for candidate := nominal - stretcher.tolerance; candidate <= nominal + stretcher.tolerance; candidate++ {
+                if candidate >= 0 {
+                    value := similarity(stretcher.mixed[candidate:candidate + hop], target)
+                    if value > bestSimilarity {
+                        bestSimilarity = value
+                        best = candidate
+                    }
+                }
+            }
+        }
+    }
+
+    // Overlap-add the first half of the frame with the second half of
+    // the previous one, keeping the second half for next time
+    for x := 0; x < hop * channels; x++ {
+        position := x / channels
+        value := stretcher.overlap[x] + stretcher.window[position] * stretcher.input[best * channels + x]
+        if value > math.MaxInt16 {
+            value = math.MaxInt16
+        } else if value < math.MinInt16 {
+            value = math.MinInt16
+        }
+        stretcher.output = append(stretcher.output, int16(value))
+        stretcher.overlap[x] = stretcher.window[hop + position] * stretcher.input[(best + hop) * channels + x]
+    }
+    stretcher.previous = best
+    if speed == 1 {
+        stretcher.nominal = float64(best + hop)
+    } else {
+        stretcher.nominal += float64(hop) * speed
+    }
+
+    // Throw away the input that can no longer be used
+    unused := int(stretcher.nominal) - stretcher.tolerance
+    if unused > stretcher.previous + hop {
+        unused = stretcher.previous + hop
+    }
+    if unused > 0 {
+        stretcher.input = append(stretcher.input[:0], stretcher.input[unused * channels:]...)
+        stretcher.mixed = append(stretcher.mixed[:0], stretcher.mixed[unused:]...)
+        stretcher.nominal -= float64(unused)
+        stretcher.previous -= unused
+    }
+
+    return true
+}
+
+// Get up to numSamples, in every channel, of interleaved output from a
+// time-stretcher at the given speed (e.g. 1.05 is 5% faster)
+func (stretcher *TimeStretcher) Get(numSamples int, speed float64) []int16 {
+    for (len(stretcher.output) / stretcher.channels < numSamples) && stretcher.step(speed) {
+    }
+    length := len(stretcher.output)
+    if numSamples < length / stretcher.channels {
+        length = numSamples * stretcher.channels
+    }
+    samples := make([]int16, length)
+    copy(samples, stretcher.output)
+    stretcher.output = append(stretcher.output[:0], stretcher.output[length:]...)
+
+    return samples
+}
+
+// Set up catch-up mode
+func newCatchUp(thresholdMilliseconds uint, speedPercent uint) *CatchUp {
+    catchUp := new(CatchUp)
+    catchUp.Stretcher = newTimeStretcher()
+    catchUp.ThresholdSamples = int(thresholdMilliseconds) * streamSamplingFrequency / 1000
+    catchUp.Speed = 1 + float64(speedPercent) / 100
+    log.Printf("Catch-up mode enabled: audio will be played %d%% fast while more than %d ms is buffered.\n",
+               speedPercent, thresholdMilliseconds)
+
+    return catchUp
+}
+
+// Read up to numSamples of audio from a PCM buffer as little-endian
+// bytes, at no more than real time, playing it slightly fast if too
+// much has built up
+func (catchUp *CatchUp) Read(pcm *PcmRing, numSamples int) []byte {
+    var speed float64 = 1
+
+    // Work out how much we are allowed to output
+    now := time.Now()
+    if !catchUp.lastRead.IsZero() {
+        catchUp.credit += int(now.Sub(catchUp.lastRead) * time.Duration(streamSamplingFrequency) / time.Second)
+    }
+    catchUp.lastRead = now
+    if maxCredit := CATCH_UP_MAX_CREDIT_MILLISECONDS * streamSamplingFrequency / 1000; catchUp.credit > maxCredit {
+        catchUp.credit = maxCredit
+    }
+    if numSamples > catchUp.credit {
+        numSamples = catchUp.credit
+    }
+
+    // Decide whether we need to catch up, with some hysteresis
+    channels := catchUp.Stretcher.channels
+    buffered := pcm.Len() / URTP_SAMPLE_SIZE / channels + catchUp.Stretcher.Buffered()
+    if !catchUp.active && (buffered > catchUp.ThresholdSamples) {
+        catchUp.active = true
+        log.Printf("%d ms of audio buffered, catching up.\n", buffered * 1000 / streamSamplingFrequency)
+    } else if catchUp.active && (buffered < catchUp.ThresholdSamples / 2) {
+        catchUp.active = false
+        log.Printf("Caught up, %d ms of audio buffered.\n", buffered * 1000 / streamSamplingFrequency)
+    }
+    if catchUp.active {
+        speed = catchUp.Speed
+    }
+
+    // Feed the time-stretcher with enough input for the output required
+    needed := int(float64(numSamples) * speed) + (catchUp.Stretcher.hop + catchUp.Stretcher.tolerance) * 2 - catchUp.Stretcher.Buffered()
+    if needed > 0 {
+        input := make([]byte, needed * URTP_SAMPLE_SIZE * channels)
+        bytesRead, _ := pcm.Read(input)
+        samples := make([]int16, bytesRead / URTP_SAMPLE_SIZE)
+        for x := range samples {
+            samples[x] = int16(input[x * URTP_SAMPLE_SIZE]) | (int16(input[x * URTP_SAMPLE_SIZE + 1]) << 8)
+        }
+        catchUp.Stretcher.Put(samples)
+    }
+
+    samples := catchUp.Stretcher.Get(numSamples, speed)
+    catchUp.credit -= len(samples) / channels
+    output := make([]byte, len(samples) * URTP_SAMPLE_SIZE)
+    for x, sample := range samples {
+        output[x * URTP_SAMPLE_SIZE] = byte(sample)
+        output[x * URTP_SAMPLE_SIZE + 1] = byte(sample >> 8)
+    }
+
+    return output
+}
+
+// Set up slowing down, at normal speed to begin with
+func newSlowDown() *SlowDown {
+    return &SlowDown{Stretcher: newTimeStretcher(), Speed: 1}
+}
+
+// Set the speed of the audio going into the PCM buffer, which is kept
+// within SLOW_DOWN_MAX_PERCENT of normal speed and is never faster
+// unless something is owed; if the audio has to be slowed down again
+// nothing is owed any more since the buffer needs all it can get
+func (slowDown *SlowDown) SetSpeed(speed float64) {
+    if speed < 1 - SLOW_DOWN_MAX_PERCENT / 100 {
+        speed = 1 - SLOW_DOWN_MAX_PERCENT / 100
+    } else if speed > 1 {
+        speed = 1
+    }
+
+    slowDown.locker.Lock()
+    defer slowDown.locker.Unlock()
+
+    if speed < 1 {
+        slowDown.owed = 0
+    } else if slowDown.owed > 0 {
+        speed = 1 + SLOW_DOWN_MAX_PERCENT / 100
+    }
+    slowDown.setSpeed(speed)
+}
+
+// Set the speed, logging the change; the lock must be held
+func (slowDown *SlowDown) setSpeed(speed float64) {
+    if (speed == 1) && (slowDown.Speed != 1) {
+        log.Printf("Audio back to normal speed.\n")
+    } else if (speed < 1) && (slowDown.Speed >= 1) {
+        log.Printf("Slowing audio down by %.1f%% while the output buffer is low.\n", (1 - speed) * 100)
+    } else if (speed > 1) && (slowDown.Speed <= 1) {
+        log.Printf("Speeding audio up by %.1f%% to pay back %d ms after starvation.\n", (speed - 1) * 100,
+                   slowDown.owed * 1000 / int64(streamSamplingFrequency))
+    }
+    slowDown.Speed = speed
+}
+
+// Owe numSamples, in each channel, after the pipeline has been starved;
+// they are paid back the next time the speed is set to normal
+func (slowDown *SlowDown) Owe(numSamples int) {
+    slowDown.locker.Lock()
+    defer slowDown.locker.Unlock()
+
+    slowDown.owed += int64(numSamples)
+    if maxOwed := int64(SLOW_DOWN_MAX_OWED_MILLISECONDS * streamSamplingFrequency / 1000); slowDown.owed > maxOwed {
+        slowDown.owed = maxOwed
+    }
+}
+
+// Put a block of audio through the time-stretcher at the current
+// speed, returning what is ready to go into the PCM buffer
+func (slowDown *SlowDown) Process(audio []int16) []int16 {
+    slowDown.locker.Lock()
+    defer slowDown.locker.Unlock()
+
+    slowDown.Stretcher.Put(audio)
+    // Everything that can be produced
+    samples := slowDown.Stretcher.Get(math.MaxInt32 / MAX_STREAM_CHANNELS, slowDown.Speed)
+    samplesIn := int64(len(audio) / slowDown.Stretcher.channels)
+    samplesOut := int64(len(samples) / slowDown.Stretcher.channels)
+    slowDown.samplesIn += samplesIn
+    slowDown.samplesOut += samplesOut
+    if slowDown.Speed > 1 {
+        // Paying back
+        slowDown.owed -= samplesIn - samplesOut
+        if slowDown.owed <= 0 {
+            slowDown.owed = 0
+            slowDown.setSpeed(1)
+        }
+    }
+
+    return samples
+}
+
+// Start again, e.g. when the stream is reset, throwing away any audio
+// in the time-stretcher
+func (slowDown *SlowDown) Reset() {
+    slowDown.locker.Lock()
+    defer slowDown.locker.Unlock()
+
+    slowDown.samplesIn -= int64(slowDown.Stretcher.Buffered())
+    slowDown.Stretcher = newTimeStretcher()
+    slowDown.owed = 0
+    if slowDown.Speed > 1 {
+        slowDown.setSpeed(1)
+    }
+}
+
+// Return the statistics of slowing down
+func (slowDown *SlowDown) Stats() interface{} {
+    slowDown.locker.Lock()
+    defer slowDown.locker.Unlock()
+
+    // Not counting what is on its way through the time-stretcher
+    added := slowDown.samplesOut - slowDown.samplesIn + int64(slowDown.Stretcher.Buffered())
+
+    return SlowDownStats{Speed: slowDown.Speed,
+                         AddedMs: added * 1000 / int64(streamSamplingFrequency),
+                         OwedMs: slowDown.owed * 1000 / int64(streamSamplingFrequency)}
+}
+
+/* End Of File */
@@ -0,0 +1,73 @@
+/* Tests of the time-stretching of the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check that what is owed after starvation is paid back by playing the
+// audio fast while the output buffer is healthy, and no more
+func TestSlowDownPayBack(t *testing.T) {
+    slowDown := newSlowDown()
+    owed := streamSamplingFrequency / 10
+    slowDown.Owe(owed)
+
+    // Nothing is paid back until the speed is next set to normal
+    slowDown.Process(benchmarkAudio(SAMPLES_PER_BLOCK))
+    if slowDown.Speed != 1 {
+        t.Fatalf("expected normal speed before the speed is set, got %f.", slowDown.Speed)
+    }
+    slowDown.SetSpeed(1)
+    if slowDown.Speed <= 1 {
+        t.Fatalf("expected to be sped up while something is owed, got %f.", slowDown.Speed)
+    }
+
+    // Pay back, which takes about owed / SLOW_DOWN_MAX_PERCENT % of audio
+    samplesIn := slowDown.Stretcher.Buffered()
+    samplesOut := 0
+    for x := 0; (slowDown.Speed > 1) && (x < 1000); x++ {
+        samplesIn += SAMPLES_PER_BLOCK
+        samplesOut += len(slowDown.Process(benchmarkAudio(SAMPLES_PER_BLOCK))) / streamChannels
+    }
+    if slowDown.Speed != 1 {
+        t.Fatalf("expected normal speed once paid back, got %f.", slowDown.Speed)
+    }
+    paid := samplesIn - samplesOut - slowDown.Stretcher.Buffered()
+    if (paid < owed - SAMPLES_PER_BLOCK) || (paid > owed + SAMPLES_PER_BLOCK) {
+        t.Fatalf("expected about %d samples to be paid back, got %d.", owed, paid)
+    }
+    if stats := slowDown.Stats().(SlowDownStats); stats.OwedMs != 0 {
+        t.Fatalf("expected nothing owed, got %d ms.", stats.OwedMs)
+    }
+
+    // Nothing is owed once the audio has to be slowed down again
+    slowDown.Owe(owed)
+    slowDown.SetSpeed(0.99)
+    slowDown.SetSpeed(1)
+    if slowDown.Speed != 1 {
+        t.Fatalf("expected normal speed after slowing down, got %f.", slowDown.Speed)
+    }
+
+    // And what is owed is limited
+    slowDown.Owe(SLOW_DOWN_MAX_OWED_MILLISECONDS * streamSamplingFrequency)
+    if stats := slowDown.Stats().(SlowDownStats); stats.OwedMs != int64(SLOW_DOWN_MAX_OWED_MILLISECONDS) {
+        t.Fatalf("expected %d ms owed, got %d ms.", SLOW_DOWN_MAX_OWED_MILLISECONDS, stats.OwedMs)
+    }
+}
+
+/* End Of File */
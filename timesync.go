@@ -0,0 +1,141 @@
+/* Two-way time synchronisation for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "log"
+    "time"
+    "github.com/RobMeades/ioc-server/urtp"
+)
+
+// For a client that has acknowledged capabilities version
+// CAPABILITIES_VERSION_TIME_SYNC or later, each timing datagram ends
+// with the times (in microseconds since the Unix epoch, on the server's
+// clock) at which the server received the URTP datagram that prompted
+// it and at which the timing datagram was sent.  The client may send
+// these back in a time report (see the urtp package), along with the
+// time it sent the URTP datagram and the time it received the timing
+// datagram on its own clock, so that, as in NTP, the round trip time
+// and the offset between the two clocks can be worked out from the
+// four:
+//
+//   round trip = (client received - client sent) - (server sent - server received)
+//   offset     = ((server received - client sent) + (server sent - client received)) / 2
+//
+// The offset is that of the server's clock from the client's and, by
+// watching how it changes, the skew between the two clocks follows.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// What has been measured of the timing of a stream
+type TimeSync struct {
+    Updated       time.Time      `json:"updated"`
+    Reports       int            `json:"reports"`
+    RoundTrip     time.Duration  `json:"roundTrip"`
+    MinRoundTrip  time.Duration  `json:"minRoundTrip"`
+    Latency       time.Duration  `json:"latency"`
+    Offset        time.Duration  `json:"offset"`
+    SkewPpm       float64        `json:"skewPpm"`
+    first         time.Time
+    firstOffset   time.Duration
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The least time over which the skew is worked out
+const TIME_SYNC_MIN_SKEW_PERIOD time.Duration = time.Minute
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a time as microseconds since the Unix epoch
+func unixMicroseconds(at time.Time) uint64 {
+    return uint64(at.UnixNano() / int64(time.Microsecond))
+}
+
+// Return the end of a timing datagram for two-way time synchronisation
+func timeSyncTimes(received time.Time, sent time.Time) []byte {
+    var times []byte
+
+    for _, at := range []time.Time{received, sent} {
+        microseconds := unixMicroseconds(at)
+        for x := urtp.TIMESTAMP_SIZE - 1; x >= 0; x-- {
+            times = append(times, byte(microseconds >> (uint(x) * 8)))
+        }
+    }
+
+    return times
+}
+
+// Note a time report; ingestLocker must be held
+func (timeSync *TimeSync) report(report *urtp.TimeReport, now time.Time) bool {
+    if (report.ServerSent < report.ServerReceived) || (report.ClientReceived < report.ClientSent) ||
+       (report.ServerSent > unixMicroseconds(now)) {
+        return false
+    }
+    roundTrip := time.Duration((int64(report.ClientReceived) - int64(report.ClientSent)) -
+                               (int64(report.ServerSent) - int64(report.ServerReceived))) * time.Microsecond
+    if roundTrip < 0 {
+        return false
+    }
+    offset := time.Duration(((int64(report.ServerReceived) - int64(report.ClientSent)) +
+                             (int64(report.ServerSent) - int64(report.ClientReceived))) / 2) * time.Microsecond
+
+    if timeSync.Reports == 0 {
+        timeSync.first = now
+        timeSync.firstOffset = offset
+        timeSync.MinRoundTrip = roundTrip
+    }
+    timeSync.Reports++
+    timeSync.Updated = now
+    timeSync.RoundTrip = roundTrip
+    if roundTrip < timeSync.MinRoundTrip {
+        timeSync.MinRoundTrip = roundTrip
+    }
+    timeSync.Latency = roundTrip / 2
+    timeSync.Offset = offset
+    if now.Sub(timeSync.first) >= TIME_SYNC_MIN_SKEW_PERIOD {
+        timeSync.SkewPpm = float64(offset - timeSync.firstOffset) / float64(now.Sub(timeSync.first)) * 1000000
+    }
+
+    return true
+}
+
+// Handle a time report from the client
+func handleTimeReport(data []byte) {
+    report := urtp.ParseTimeReport(data)
+    if report != nil {
+        now := time.Now()
+        ingestLocker.Lock()
+        continueSession(now)
+        if session.TimeSync == nil {
+            session.TimeSync = new(TimeSync)
+        }
+        if session.TimeSync.report(report, now) {
+            if session.TimeSync.Reports == 1 {
+                log.Printf("First time report from the client: round trip %d ms, server clock %d ms ahead of the client's.\n",
+                           session.TimeSync.RoundTrip / time.Millisecond, session.TimeSync.Offset / time.Millisecond)
+            }
+        } else {
+            log.Printf("Time report from the client doesn't make sense, ignoring it.\n")
+        }
+        ingestLocker.Unlock()
+    }
+}
+
+/* End Of File */
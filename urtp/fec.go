@@ -0,0 +1,298 @@
+/* Forward error correction over UDP for the Internet of Chuffs.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package urtp
+
+import (
+    "log"
+)
+
+// Over a very lossy link (e.g. cellular) a client may protect its URTP
+// datagrams with forward error correction (FEC), if the server says
+// that it accepts it (see the capabilities datagram in ioc-server).
+// The datagrams are taken in groups of dataShards; each becomes a data
+// shard, its length (two bytes, big-endian) followed by the datagram,
+// padded with zeroes to the length of the longest in the group, and
+// parityShards parity shards of the same length are added with a
+// Reed-Solomon erasure code (see reedsolomon.go).  Every shard is sent
+// in a UDP datagram of its own:
+//
+//   - FEC_SYNC_BYTE,
+//   - one byte, the group number, which goes up by one with each group
+//     and wraps,
+//   - one byte, dataShards,
+//   - one byte, parityShards,
+//   - one byte, the index of the shard in the group, data shards first,
+//
+// followed by the shard.  Any dataShards of the shards of a group are
+// enough to get back all of its datagrams.  Since losses on a cellular
+// link come in bursts, the client should interleave the shards of
+// several groups (FecInterleave()) so that a burst takes no more than
+// a shard or two from each.  Data shards are passed on as soon as they
+// arrive, so FEC adds no delay unless a datagram has to be recovered.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A FEC shard as parsed
+type FecShard struct {
+    Group         byte
+    DataShards    int
+    ParityShards  int
+    Index         int
+    Data          []byte
+}
+
+// A group of FEC shards being received
+type fecGroup struct {
+    number        byte
+    dataShards    int
+    parityShards  int
+    shards        [][]byte
+    received      int
+    passedOn      []bool
+    done          bool
+}
+
+// What has happened to FEC shards in a call to FecReceiver.Receive()
+type FecCounts struct {
+    // Shards received
+    Shards     int
+    // Datagrams recovered from the parity shards
+    Recovered  int
+    // Datagrams lost for good, because their group had too few shards
+    Lost       int
+}
+
+// The receiving end of FEC for one client
+type FecReceiver struct {
+    // The groups being received, oldest first
+    groups  []*fecGroup
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// Marker at the start of a FEC shard
+const FEC_SYNC_BYTE byte = 0xad
+
+// The size of the header of a FEC shard
+const FEC_HEADER_SIZE int = 5
+
+// The size of the length at the start of a data shard
+const FEC_LENGTH_SIZE int = 2
+
+// The largest UDP datagram carrying a FEC shard
+const FEC_MAX_SIZE int = FEC_HEADER_SIZE + FEC_LENGTH_SIZE + DATAGRAM_MAX_SIZE + VERSION_PREFIX_SIZE
+
+// The most data shards and parity shards in a group
+const FEC_MAX_DATA_SHARDS int = 32
+const FEC_MAX_PARITY_SHARDS int = 16
+
+// The number of groups that can be received at once, enough for the
+// shards of this many groups to be interleaved
+const FEC_MAX_GROUPS int = 16
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return true if data looks like a FEC shard
+func IsFec(data []byte) bool {
+    return (len(data) > FEC_HEADER_SIZE) && (data[0] == FEC_SYNC_BYTE)
+}
+
+// Parse a FEC shard, returning nil if it isn't a valid one; the shard
+// data is a slice of data
+func ParseFec(data []byte) *FecShard {
+    var shard *FecShard
+
+    if IsFec(data) {
+        dataShards := int(data[2])
+        parityShards := int(data[3])
+        index := int(data[4])
+        if (dataShards > 0) && (dataShards <= FEC_MAX_DATA_SHARDS) && (parityShards <= FEC_MAX_PARITY_SHARDS) &&
+           (index < dataShards + parityShards) && (len(data) - FEC_HEADER_SIZE >= FEC_LENGTH_SIZE) {
+            shard = &FecShard{Group: data[1], DataShards: dataShards, ParityShards: parityShards,
+                              Index: index, Data: data[FEC_HEADER_SIZE:]}
+        }
+    }
+
+    return shard
+}
+
+// Return the datagram in a data shard, nil if its length is wrong
+func fecDatagram(shard []byte) []byte {
+    length := (int(shard[0]) << 8) + int(shard[1])
+    if (length == 0) || (length > len(shard) - FEC_LENGTH_SIZE) {
+        return nil
+    }
+
+    return shard[FEC_LENGTH_SIZE:FEC_LENGTH_SIZE + length]
+}
+
+// Return the FEC shards, as UDP datagrams, for a group of URTP
+// datagrams, with parityShards of parity
+func FecEncode(group byte, datagrams [][]byte, parityShards int) [][]byte {
+    var size int
+    var fecDatagrams [][]byte
+
+    for _, datagram := range datagrams {
+        if len(datagram) > size {
+            size = len(datagram)
+        }
+    }
+    shards := make([][]byte, len(datagrams))
+    for x, datagram := range datagrams {
+        shards[x] = make([]byte, FEC_LENGTH_SIZE + size)
+        shards[x][0] = byte(len(datagram) >> 8)
+        shards[x][1] = byte(len(datagram))
+        copy(shards[x][FEC_LENGTH_SIZE:], datagram)
+    }
+    shards = append(shards, rsEncode(shards, parityShards)...)
+    for x, shard := range shards {
+        header := []byte{FEC_SYNC_BYTE, group, byte(len(datagrams)), byte(parityShards), byte(x)}
+        fecDatagrams = append(fecDatagrams, append(header, shard...))
+    }
+
+    return fecDatagrams
+}
+
+// Return the FEC shards of several groups in the order they should be
+// sent: the first shard of each group, then the second, and so on
+func FecInterleave(groups [][][]byte) [][]byte {
+    var interleaved [][]byte
+
+    for x, added := 0, true; added; x++ {
+        added = false
+        for _, group := range groups {
+            if x < len(group) {
+                interleaved = append(interleaved, group[x])
+                added = true
+            }
+        }
+    }
+
+    return interleaved
+}
+
+// Create a FecReceiver
+func NewFecReceiver() *FecReceiver {
+    return new(FecReceiver)
+}
+
+// Return the number of datagrams of a group that have not been passed
+// on, none once the group is done
+func (group *fecGroup) lost() int {
+    var lost int
+
+    if !group.done {
+        for _, passedOn := range group.passedOn {
+            if !passedOn {
+                lost++
+            }
+        }
+    }
+
+    return lost
+}
+
+// Find the group a shard belongs to, starting a new one (and giving up
+// on the oldest if there are too many) if necessary
+func (receiver *FecReceiver) group(shard *FecShard, counts *FecCounts) *fecGroup {
+    for x, group := range receiver.groups {
+        if group.number == shard.Group {
+            if (group.dataShards == shard.DataShards) && (group.parityShards == shard.ParityShards) {
+                return group
+            }
+            // The client has moved on and reused the group number
+            // with different parameters: give up on the old group
+            counts.Lost += group.lost()
+            receiver.groups = append(receiver.groups[:x], receiver.groups[x + 1:]...)
+            break
+        }
+    }
+    if len(receiver.groups) >= FEC_MAX_GROUPS {
+        counts.Lost += receiver.groups[0].lost()
+        receiver.groups = receiver.groups[1:]
+    }
+    group := &fecGroup{number: shard.Group, dataShards: shard.DataShards, parityShards: shard.ParityShards,
+                       shards: make([][]byte, shard.DataShards + shard.ParityShards),
+                       passedOn: make([]bool, shard.DataShards)}
+    receiver.groups = append(receiver.groups, group)
+
+    return group
+}
+
+// Receive a FEC shard, returning the URTP datagrams that can be passed
+// on as a result: the one in the shard if it is a data shard, and any
+// that can be recovered now that the shard has arrived
+func (receiver *FecReceiver) Receive(data []byte) ([][]byte, FecCounts) {
+    var datagrams [][]byte
+    var counts FecCounts
+
+    shard := ParseFec(data)
+    if shard == nil {
+        log.Printf("FEC: shard of %d byte(s) is not valid.\n", len(data))
+        return nil, counts
+    }
+    counts.Shards++
+    group := receiver.group(shard, &counts)
+    if group.done || (group.shards[shard.Index] != nil) {
+        return nil, counts
+    }
+    for _, item := range group.shards {
+        if (item != nil) && (len(item) != len(shard.Data)) {
+            log.Printf("FEC: shard %d of group %d is %d byte(s) but the group has %d byte shards.\n",
+                       shard.Index, shard.Group, len(shard.Data), len(item))
+            return nil, counts
+        }
+    }
+    group.shards[shard.Index] = append([]byte(nil), shard.Data...)
+    group.received++
+
+    if shard.Index < group.dataShards {
+        datagram := fecDatagram(group.shards[shard.Index])
+        if datagram != nil {
+            datagrams = append(datagrams, datagram)
+        }
+        group.passedOn[shard.Index] = true
+    }
+    if group.received >= group.dataShards {
+        // Enough to recover anything missing
+        if group.lost() > 0 {
+            err := rsReconstruct(group.shards, group.dataShards)
+            if err == nil {
+                for x := 0; x < group.dataShards; x++ {
+                    if !group.passedOn[x] {
+                        datagram := fecDatagram(group.shards[x])
+                        if datagram != nil {
+                            datagrams = append(datagrams, datagram)
+                            counts.Recovered++
+                        }
+                        group.passedOn[x] = true
+                    }
+                }
+            } else {
+                log.Printf("FEC: unable to recover group %d (%s).\n", group.number, err.Error())
+                counts.Lost += group.lost()
+            }
+        }
+        group.done = true
+    }
+
+    return datagrams, counts
+}
+
+/* End Of File */
@@ -0,0 +1,215 @@
+/* Tests of forward error correction in the URTP package of the
+ * Internet of Chuffs.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package urtp
+
+import (
+    "bytes"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A FEC test case: a group of datagrams and the shards of it that
+// don't arrive
+type fecTest struct {
+    name          string
+    dataShards    int
+    parityShards  int
+    missing       []int
+    recovered     int
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a group of URTP datagrams, of different sizes, starting at
+// the given sequence number
+func testGroup(sequenceNumber uint16, numDatagrams int) [][]byte {
+    var datagrams [][]byte
+
+    for x := 0; x < numDatagrams; x++ {
+        datagrams = append(datagrams, Format(PCM_SIGNED_16_BIT, 1, sequenceNumber + uint16(x), uint64(x) * 20000,
+                                             testPayload(100 + x * 37), x % 2 == 0))
+    }
+
+    return datagrams
+}
+
+// Return true if set has the same datagrams as expected, in any order
+func testSameDatagrams(set [][]byte, expected [][]byte) bool {
+    if len(set) != len(expected) {
+        return false
+    }
+    for _, datagram := range expected {
+        found := false
+        for _, item := range set {
+            if bytes.Equal(item, datagram) {
+                found = true
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+
+    return true
+}
+
+// Any dataShards of the shards of a group must be enough to get all of
+// its datagrams back, and no fewer
+func TestFecRecovery(t *testing.T) {
+    tests := []fecTest{
+        {"nothing lost", 4, 2, nil, 0},
+        {"one data shard lost", 4, 2, []int{1}, 1},
+        {"two data shards lost", 4, 2, []int{0, 3}, 2},
+        {"data and parity lost", 4, 2, []int{2, 5}, 1},
+        {"parity lost", 4, 2, []int{4, 5}, 0},
+        {"too many lost", 4, 2, []int{0, 1, 2}, 0},
+        {"no parity", 5, 0, []int{}, 0},
+        {"one of one", 1, 1, []int{0}, 1},
+        {"largest group", FEC_MAX_DATA_SHARDS, FEC_MAX_PARITY_SHARDS,
+         []int{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30}, 16},
+    }
+
+    for _, test := range tests {
+        var received [][]byte
+        var counts FecCounts
+        datagrams := testGroup(0xfff0, test.dataShards)
+        shards := FecEncode(7, datagrams, test.parityShards)
+        if len(shards) != test.dataShards + test.parityShards {
+            t.Errorf("%s: %d shard(s), expected %d.", test.name, len(shards), test.dataShards + test.parityShards)
+            continue
+        }
+        missing := make(map[int]bool)
+        for _, index := range test.missing {
+            missing[index] = true
+        }
+        receiver := NewFecReceiver()
+        for x, shard := range shards {
+            if !IsFec(shard) || (len(shard) > FEC_MAX_SIZE) {
+                t.Errorf("%s: shard %d isn't a valid FEC datagram.", test.name, x)
+            }
+            if !missing[x] {
+                shardDatagrams, shardCounts := receiver.Receive(shard)
+                received = append(received, shardDatagrams...)
+                counts.Shards += shardCounts.Shards
+                counts.Recovered += shardCounts.Recovered
+                counts.Lost += shardCounts.Lost
+            }
+        }
+        expected := datagrams
+        if len(test.missing) > test.parityShards {
+            // Only the data shards that arrived get through
+            expected = nil
+            for x, datagram := range datagrams {
+                if !missing[x] {
+                    expected = append(expected, datagram)
+                }
+            }
+        }
+        if !testSameDatagrams(received, expected) {
+            t.Errorf("%s: %d datagram(s) received, expected %d.", test.name, len(received), len(expected))
+        }
+        if (counts.Shards != len(shards) - len(test.missing)) || (counts.Recovered != test.recovered) {
+            t.Errorf("%s: counts %+v, expected %d shard(s) and %d recovered.", test.name, counts,
+                     len(shards) - len(test.missing), test.recovered)
+        }
+    }
+}
+
+// Interleaved groups, numbered across the wrap of the group number,
+// must each be recovered from a burst of loss; a shard that arrives
+// twice counts once
+func TestFecInterleaved(t *testing.T) {
+    var groups [][][]byte
+    var datagrams [][]byte
+    var received [][]byte
+    var recovered int
+    receiver := NewFecReceiver()
+
+    for x, group := range []byte{254, 255, 0, 1} {
+        groupDatagrams := testGroup(uint16(0xfffe + x * 4), 4)
+        datagrams = append(datagrams, groupDatagrams...)
+        groups = append(groups, FecEncode(group, groupDatagrams, 1))
+    }
+    shards := FecInterleave(groups)
+    if len(shards) != 20 {
+        t.Fatalf("%d interleaved shard(s), expected 20.", len(shards))
+    }
+    for x, shard := range shards {
+        // A burst of four consecutive shards, one from each group
+        if (x >= 6) && (x < 10) {
+            continue
+        }
+        shardDatagrams, counts := receiver.Receive(shard)
+        received = append(received, shardDatagrams...)
+        recovered += counts.Recovered
+        if x == 0 {
+            if again, _ := receiver.Receive(shard); len(again) > 0 {
+                t.Errorf("a shard received twice gave %d datagram(s) the second time.", len(again))
+            }
+        }
+    }
+    if !testSameDatagrams(received, datagrams) || (recovered != 4) {
+        t.Errorf("%d datagram(s) received (%d recovered), expected %d (4 recovered).", len(received), recovered, len(datagrams))
+    }
+}
+
+// The Reed-Solomon erasure code must fill in any missing data shards
+// from any dataShards of the shards
+func TestReedSolomon(t *testing.T) {
+    tests := []struct {
+        dataShards    int
+        parityShards  int
+        missing       []int
+        ok            bool
+    }{
+        {1, 1, []int{0}, true},
+        {3, 2, []int{0, 1}, true},
+        {3, 2, []int{2, 4}, true},
+        {10, 4, []int{0, 3, 7, 9}, true},
+        {10, 4, []int{1, 11, 12, 13}, true},
+        {10, 4, []int{0, 1, 2, 3, 4}, false},
+        {FEC_MAX_DATA_SHARDS, FEC_MAX_PARITY_SHARDS, []int{31, 30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 16}, true},
+    }
+
+    for _, test := range tests {
+        data := make([][]byte, test.dataShards)
+        for x := range data {
+            data[x] = testPayload(64)
+            data[x][0] = byte(x)
+        }
+        shards := append(append([][]byte(nil), data...), rsEncode(data, test.parityShards)...)
+        for _, index := range test.missing {
+            shards[index] = nil
+        }
+        err := rsReconstruct(shards, test.dataShards)
+        if (err == nil) != test.ok {
+            t.Errorf("%d+%d missing %v: rsReconstruct() gave error %v.", test.dataShards, test.parityShards, test.missing, err)
+            continue
+        }
+        if test.ok {
+            for x := range data {
+                if !bytes.Equal(shards[x], data[x]) {
+                    t.Errorf("%d+%d missing %v: data shard %d wasn't recovered.", test.dataShards, test.parityShards, test.missing, x)
+                }
+            }
+        }
+    }
+}
+
+/* End Of File */
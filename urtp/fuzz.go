@@ -0,0 +1,105 @@
+/* go-fuzz targets for the URTP package of the Internet of Chuffs.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+//go:build gofuzz
+
+package urtp
+
+// Targets for go-fuzz (https://github.com/dvyukov/go-fuzz), only built
+// with the gofuzz build tag.  Each returns 1 if the input got as far as
+// being parsed as a URTP datagram, so that go-fuzz favours inputs like
+// it, else 0.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A Handler that parses but does nothing else
+type fuzzHandler struct {
+    parsed  *bool
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Check a capabilities acknowledgement
+func (handler fuzzHandler) HandleCapabilitiesAck(data []byte) {
+    IsCapabilitiesAck(data)
+}
+
+// Parse a hello
+func (handler fuzzHandler) HandleHello(data []byte) []byte {
+    ParseHello(data)
+    return nil
+}
+
+// Parse a time report
+func (handler fuzzHandler) HandleTimeReport(data []byte) {
+    ParseTimeReport(data)
+}
+
+// Parse a URTP datagram
+func (handler fuzzHandler) HandleDatagram(version byte, datagram []byte) [][]byte {
+    _, err := Parse(datagram)
+    if err == nil {
+        *handler.parsed = true
+    }
+
+    return nil
+}
+
+// Fuzz a single datagram, as would arrive over UDP
+func FuzzDatagram(data []byte) int {
+    var parsed bool
+
+    handler := fuzzHandler{parsed: &parsed}
+    if IsCapabilitiesAck(data) {
+        handler.HandleCapabilitiesAck(data)
+    } else if IsHello(data) {
+        handler.HandleHello(data)
+    } else if IsTimeReport(data) {
+        handler.HandleTimeReport(data)
+    } else if IsFec(data) {
+        datagrams, _ := NewFecReceiver().Receive(data)
+        for _, datagram := range datagrams {
+            datagram, version := Normalise(datagram)
+            if datagram != nil {
+                handler.HandleDatagram(version, datagram)
+            }
+        }
+    } else {
+        datagram, version := Normalise(data)
+        if datagram != nil {
+            handler.HandleDatagram(version, datagram)
+        }
+    }
+    if parsed {
+        return 1
+    }
+
+    return 0
+}
+
+// Fuzz a stream, as would arrive over TCP, delivered in one go
+func FuzzStream(data []byte) int {
+    var parsed bool
+
+    NewReassembler(fuzzHandler{parsed: &parsed}).Handle(data)
+    if parsed {
+        return 1
+    }
+
+    return 0
+}
+
+/* End Of File */
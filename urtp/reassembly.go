@@ -0,0 +1,402 @@
+/* URTP stream reassembly for the Internet of Chuffs.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package urtp
+
+import (
+    "bytes"
+    "log"
+)
+
+// Over a stream (e.g. TCP) the datagrams from a client are found either
+// by looking for their sync bytes or, if the client asks for it with a
+// transport request, by a length in front of each.  A client may send
+// a transport request as the very first bytes of a stream:
+// TRANSPORT_SYNC_BYTE followed by one byte of TRANSPORT_ flags.  The
+// reply is the same two bytes, the flags being those accepted, and
+// both sides then switch to the accepted transport.  A server that
+// doesn't reply doesn't support transport requests.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// What is done with the things that a Reassembler finds, each method
+// returning any datagrams that should be sent back to the source;
+// HandleDatagram() is given datagrams normalised to the original
+// layout, along with the URTP version they arrived in
+type Handler interface {
+    HandleCapabilitiesAck(data []byte)
+    HandleHello(data []byte) []byte
+    HandleTimeReport(data []byte)
+    HandleDatagram(version byte, datagram []byte) [][]byte
+}
+
+// Where we are in reassembling a URTP datagram from a stream; each
+// stream must have its own
+type Reassembler struct {
+    State           int
+    ByteCount       int
+    PayloadSize     int
+    Header          bytes.Buffer
+    Datagram        bytes.Buffer
+    Started         bool
+    LengthPrefixed  bool
+    Compression     byte
+    Version         byte
+    Handler         Handler
+    // What has been received from the stream but not yet reassembled
+    buffer          bytes.Buffer
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// Marker at the start of a transport request and its reply
+const TRANSPORT_SYNC_BYTE byte = 0xa8
+
+// Transport flag: each datagram, in both directions, is preceded by a
+// two-byte (big-endian) length, rather than being found by looking
+// for sync bytes
+const TRANSPORT_LENGTH_PREFIXED byte = 0x01
+
+// Transport flags: the rest of the stream from the client is
+// compressed with zlib (RFC 1950) or with zstd (RFC 8878); if both
+// are requested zstd is used
+const TRANSPORT_ZLIB byte = 0x02
+const TRANSPORT_ZSTD byte = 0x04
+
+// The transport flags supported
+const TRANSPORT_FLAGS_SUPPORTED byte = TRANSPORT_LENGTH_PREFIXED | TRANSPORT_ZLIB | TRANSPORT_ZSTD
+
+// The size of the length that precedes length-prefixed datagrams
+const TRANSPORT_LENGTH_SIZE int = 2
+
+// URTP reassembly states
+const (
+    STATE_WAITING_SYNC = iota
+    STATE_WAITING_AUDIO_CODING = iota
+    STATE_WAITING_SEQUENCE_NUMBER = iota
+    STATE_WAITING_TIMESTAMP = iota
+    STATE_WAITING_PAYLOAD_SIZE = iota
+    STATE_WAITING_PAYLOAD = iota
+    STATE_WAITING_CAPABILITIES_ACK = iota
+    STATE_WAITING_TRANSPORT_FLAGS = iota
+    STATE_WAITING_FRAME_LENGTH = iota
+    STATE_WAITING_FRAME = iota
+    STATE_WAITING_HELLO = iota
+    STATE_WAITING_CRC = iota
+    STATE_WAITING_VERSION = iota
+    STATE_WAITING_TIME_REPORT = iota
+)
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a Reassembler for the start of a stream, passing what it
+// finds to handler
+func NewReassembler(handler Handler) *Reassembler {
+    return &Reassembler{State: STATE_WAITING_SYNC, Handler: handler}
+}
+
+// Put the length in front of each of a set of datagrams
+func LengthPrefixed(datagrams [][]byte) [][]byte {
+    for x, datagram := range datagrams {
+        datagrams[x] = append([]byte{byte(len(datagram) >> 8), byte(len(datagram))}, datagram...)
+    }
+
+    return datagrams
+}
+
+// Return what has been received but not yet reassembled, emptying
+// the buffer; once Compression has been set by a transport request
+// this is the start of the compressed stream, which must be
+// decompressed before it is given to Handle(); the bytes are a copy,
+// since the buffer is reused
+func (reassembler *Reassembler) Leftover() []byte {
+    return append([]byte(nil), reassembler.buffer.Next(reassembler.buffer.Len())...)
+}
+
+// Move on to the payload of a URTP datagram whose header has been
+// reassembled, handling the datagram straight away if there is no
+// payload; any datagrams that should be sent back to the source are
+// returned
+func (reassembler *Reassembler) startPayload() [][]byte {
+    var returnDatagrams [][]byte
+
+    reassembler.State = STATE_WAITING_PAYLOAD
+    reassembler.Datagram.Write(reassembler.Header.Bytes())
+    if reassembler.PayloadSize == 0 {
+        // Nothing more to come (e.g. a heartbeat)
+        returnDatagrams = reassembler.Handler.HandleDatagram(reassembler.Version, reassembler.Datagram.Next(reassembler.Datagram.Len()))
+        reassembler.Header.Reset()
+        reassembler.State = STATE_WAITING_SYNC
+    }
+
+    return returnDatagrams
+}
+
+// Handle a stream of (e.g. TCP) bytes containing URTP datagrams
+// For details of the format, see the client code (ioc-client)
+// Any datagrams that should be sent back to the source are returned
+func (reassembler *Reassembler) Handle(data []byte) [][]byte {
+    var err error
+    var item byte
+    var returnDatagrams [][]byte
+    handler := reassembler.Handler
+
+    // Write all the data to the stream buffer
+    streamBuffer := &reassembler.buffer
+    streamBuffer.Write(data)
+
+    //log.Printf("URTP reassembly: %d byte(s) received.\n", len(data))
+    for item, err = streamBuffer.ReadByte(); err == nil; item, err = streamBuffer.ReadByte() {
+        //log.Printf("URTP reassembly: state %d, byte %d (0x%x).\n", reassembler.State, item, item)
+        switch (reassembler.State) {
+            case STATE_WAITING_SYNC:
+                // Look for the sync byte, or a transport request if
+                // this is the start of the connection
+                if (item == TRANSPORT_SYNC_BYTE) && !reassembler.Started {
+                    reassembler.State = STATE_WAITING_TRANSPORT_FLAGS
+                } else if item == SYNC_BYTE {
+                    reassembler.Header.WriteByte(item)
+                    reassembler.Version = VERSION_ORIGINAL
+                    reassembler.State = STATE_WAITING_AUDIO_CODING
+                } else if item == VERSIONED_SYNC_BYTE {
+                    reassembler.State = STATE_WAITING_VERSION
+                } else if item == CAPABILITIES_SYNC_BYTE {
+                    reassembler.Header.WriteByte(item)
+                    reassembler.State = STATE_WAITING_CAPABILITIES_ACK
+                } else if item == HELLO_SYNC_BYTE {
+                    reassembler.Header.WriteByte(item)
+                    reassembler.State = STATE_WAITING_HELLO
+                } else if item == TIME_REPORT_SYNC_BYTE {
+                    reassembler.Header.WriteByte(item)
+                    reassembler.State = STATE_WAITING_TIME_REPORT
+                } else {                
+                    //log.Printf("URTP reassembly: awaiting initial sync byte but 0x%x isn't one (0x%x).\n", item, SYNC_BYTE)
+                    reassembler.Header.Reset()
+                    reassembler.State = STATE_WAITING_SYNC
+                }
+            case STATE_WAITING_VERSION:
+                // A versioned URTP datagram can only be reassembled here
+                // if it has the original layout after the version; it
+                // then continues as if it had started with SYNC_BYTE
+                if isVersionOriginalLayout(item) {
+                    reassembler.Header.WriteByte(SYNC_BYTE)
+                    reassembler.Version = item
+                    reassembler.State = STATE_WAITING_AUDIO_CODING
+                } else {
+                    log.Printf("URTP reassembly: URTP version %d can't be reassembled without length-prefixed framing.\n", item)
+                    reassembler.Header.Reset()
+                    reassembler.State = STATE_WAITING_SYNC
+                }
+            case STATE_WAITING_AUDIO_CODING:
+                // Look for the audio coding scheme and check it
+                if isValidCoding(item) {
+                    reassembler.Header.WriteByte(item)
+                    //log.Printf("URTP reassembly: audio coding scheme 0x%x.\n", item)
+                    reassembler.State = STATE_WAITING_SEQUENCE_NUMBER
+                } else {
+                    log.Printf("URTP reassembly: audio coding scheme in the second byte (0x%0x) is not a valid audio coding scheme.\n", item)
+                    reassembler.Header.Reset()
+                    reassembler.State = STATE_WAITING_SYNC
+                }
+            case STATE_WAITING_SEQUENCE_NUMBER:
+                // Read in the two-byte sequence number
+                reassembler.Header.WriteByte(item)
+                reassembler.ByteCount++
+                //log.Printf("URTP reassembly: sequence number byte %d is 0x%x.\n", reassembler.ByteCount, item)
+                if reassembler.ByteCount >= SEQUENCE_NUMBER_SIZE {
+                    reassembler.ByteCount = 0
+                    reassembler.State = STATE_WAITING_TIMESTAMP
+                }
+            case STATE_WAITING_TIMESTAMP:
+                // Read in the eight-byte timestamp
+                reassembler.Header.WriteByte(item)
+                reassembler.ByteCount++
+                //log.Printf("URTP reassembly: timestamp byte %d is 0x%x.\n", reassembler.ByteCount, item)
+                if reassembler.ByteCount >= TIMESTAMP_SIZE {
+                    reassembler.ByteCount = 0
+                    reassembler.State = STATE_WAITING_PAYLOAD_SIZE
+                }
+            case STATE_WAITING_PAYLOAD_SIZE:
+                // Read in the two-byte payload size
+                reassembler.Header.WriteByte(item)
+                reassembler.PayloadSize += int (uint(item) << uint((8 * (PAYLOAD_SIZE_SIZE - reassembler.ByteCount - 1))))
+                reassembler.ByteCount++
+                if reassembler.ByteCount >= PAYLOAD_SIZE_SIZE {
+                    // Got the payload size, check it and, if it is OK, write the header
+                    reassembler.ByteCount = 0
+                    //log.Printf("URTP reassembly: URTP payload is %d byte(s).\n", reassembler.PayloadSize)
+                    if reassembler.PayloadSize <= MAX_PAYLOAD_SIZE {
+                        if reassembler.Header.Bytes()[1] & CRC_FLAG != 0 {
+                            reassembler.State = STATE_WAITING_CRC
+                        } else {
+                            returnDatagrams = append(returnDatagrams, reassembler.startPayload()...)
+                        }
+                    } else {
+                        //log.Printf("URTP reassembly: NOT a URTP header, payload length %d (0x%x, in the last two bytes) is larger than the maximum number of payload bytes (%d)).\n",
+                        //           reassembler.PayloadSize, reassembler.PayloadSize, MAX_PAYLOAD_SIZE)
+                        reassembler.PayloadSize = 0
+                        reassembler.Header.Reset()
+                        reassembler.State = STATE_WAITING_SYNC
+                    }
+                }
+            case STATE_WAITING_CRC:
+                // Read in the two-byte CRC of an extended header
+                reassembler.Header.WriteByte(item)
+                reassembler.ByteCount++
+                if reassembler.ByteCount >= CRC_SIZE {
+                    reassembler.ByteCount = 0
+                    returnDatagrams = append(returnDatagrams, reassembler.startPayload()...)
+                }
+            case STATE_WAITING_PAYLOAD:
+                // Write the one byte we have
+                reassembler.Datagram.WriteByte(item)
+                if reassembler.PayloadSize > 0 {
+                    reassembler.PayloadSize--
+                }
+                // Read in as much of the rest of the payload as possible
+                bytesToRead := streamBuffer.Len()
+                if bytesToRead > reassembler.PayloadSize {
+                    bytesToRead = reassembler.PayloadSize
+                }
+                reassembler.Datagram.Write(streamBuffer.Next(bytesToRead))
+                reassembler.PayloadSize -= bytesToRead
+                if reassembler.PayloadSize == 0 {
+                    // Got the lot, handle the complete datagram now and reset the state machine
+                    //log.Printf("URTP reassembly: URTP packet (%d bytes) fully received.\n", urtpDatagram.Len())
+                    returnDatagrams = append(returnDatagrams, handler.HandleDatagram(reassembler.Version, reassembler.Datagram.Next(reassembler.Datagram.Len()))...)
+                    reassembler.Header.Reset()
+                    reassembler.State = STATE_WAITING_SYNC
+                } else {
+                    //log.Printf("URTP reassembly: %d byte(s) of payload remaining to be read.\n", reassembler.PayloadSize)
+                }
+            case STATE_WAITING_CAPABILITIES_ACK:
+                // Read in the rest of the capabilities acknowledgement
+                reassembler.Header.WriteByte(item)
+                if reassembler.Header.Len() >= CAPABILITIES_ACK_SIZE {
+                    handler.HandleCapabilitiesAck(reassembler.Header.Bytes())
+                    reassembler.Header.Reset()
+                    reassembler.State = STATE_WAITING_SYNC
+                }
+            case STATE_WAITING_TIME_REPORT:
+                // Read in the rest of the time report
+                reassembler.Header.WriteByte(item)
+                if reassembler.Header.Len() >= TIME_REPORT_SIZE {
+                    handler.HandleTimeReport(reassembler.Header.Bytes())
+                    reassembler.Header.Reset()
+                    reassembler.State = STATE_WAITING_SYNC
+                }
+            case STATE_WAITING_HELLO:
+                // Read in the rest of the hello, the size of which only
+                // becomes clear as it arrives
+                reassembler.Header.WriteByte(item)
+                size := HelloSize(reassembler.Header.Bytes())
+                if size > HELLO_MAX_SIZE {
+                    log.Printf("URTP reassembly: hello of %d byte(s) is too large.\n", size)
+                    reassembler.Header.Reset()
+                    reassembler.State = STATE_WAITING_SYNC
+                } else if (size > 0) && (reassembler.Header.Len() >= size) {
+                    returnDatagrams = append(returnDatagrams, handler.HandleHello(reassembler.Header.Bytes()))
+                    reassembler.Header.Reset()
+                    reassembler.State = STATE_WAITING_SYNC
+                }
+            case STATE_WAITING_TRANSPORT_FLAGS:
+                // Accept what we can of the transport requested and tell
+                // the client; the reply is the switch-over point so it
+                // is not itself length-prefixed
+                accepted := item & TRANSPORT_FLAGS_SUPPORTED
+                if (accepted & TRANSPORT_ZSTD) != 0 {
+                    accepted &^= TRANSPORT_ZLIB
+                }
+                reassembler.LengthPrefixed = (accepted & TRANSPORT_LENGTH_PREFIXED) != 0
+                reassembler.Compression = accepted & (TRANSPORT_ZLIB | TRANSPORT_ZSTD)
+                log.Printf("URTP reassembly: client requested transport flags 0x%02x, 0x%02x accepted.\n", item, accepted)
+                returnDatagrams = append(returnDatagrams, []byte{TRANSPORT_SYNC_BYTE, accepted})
+                reassembler.State = STATE_WAITING_SYNC
+                if reassembler.LengthPrefixed {
+                    reassembler.State = STATE_WAITING_FRAME_LENGTH
+                }
+            case STATE_WAITING_FRAME_LENGTH:
+                // Read in the two-byte length of a length-prefixed datagram
+                reassembler.PayloadSize += int (uint(item) << uint((8 * (TRANSPORT_LENGTH_SIZE - reassembler.ByteCount - 1))))
+                reassembler.ByteCount++
+                if reassembler.ByteCount >= TRANSPORT_LENGTH_SIZE {
+                    reassembler.ByteCount = 0
+                    if (reassembler.PayloadSize > 0) && (reassembler.PayloadSize <= DATAGRAM_MAX_SIZE) {
+                        reassembler.Datagram.Reset()
+                        reassembler.State = STATE_WAITING_FRAME
+                    } else {
+                        // Can't happen unless the client has gone wrong: fall
+                        // back to looking for sync bytes
+                        log.Printf("URTP reassembly: length-prefixed datagram of %d byte(s) is not valid, reverting to sync byte framing.\n",
+                                   reassembler.PayloadSize)
+                        reassembler.PayloadSize = 0
+                        reassembler.LengthPrefixed = false
+                        reassembler.State = STATE_WAITING_SYNC
+                    }
+                }
+            case STATE_WAITING_FRAME:
+                // Read in as much of the datagram as possible
+                reassembler.Datagram.WriteByte(item)
+                reassembler.PayloadSize--
+                bytesToRead := streamBuffer.Len()
+                if bytesToRead > reassembler.PayloadSize {
+                    bytesToRead = reassembler.PayloadSize
+                }
+                reassembler.Datagram.Write(streamBuffer.Next(bytesToRead))
+                reassembler.PayloadSize -= bytesToRead
+                if reassembler.PayloadSize == 0 {
+                    // Got the lot: it's a capabilities acknowledgement, a
+                    // hello, a time report or a URTP datagram
+                    frame := reassembler.Datagram.Next(reassembler.Datagram.Len())
+                    if IsCapabilitiesAck(frame) {
+                        handler.HandleCapabilitiesAck(frame)
+                    } else if IsHello(frame) {
+                        returnDatagrams = append(returnDatagrams, LengthPrefixed([][]byte{handler.HandleHello(frame)})...)
+                    } else if IsTimeReport(frame) {
+                        handler.HandleTimeReport(frame)
+                    } else {
+                        frame, version := Normalise(frame)
+                        if frame != nil {
+                            returnDatagrams = append(returnDatagrams, LengthPrefixed(handler.HandleDatagram(version, frame))...)
+                        }
+                    }
+                    reassembler.State = STATE_WAITING_FRAME_LENGTH
+                }
+            default:
+                reassembler.ByteCount = 0
+                reassembler.PayloadSize = 0
+                reassembler.Header.Reset()
+                reassembler.State = STATE_WAITING_SYNC
+        }
+        // Once anything other than a transport request has arrived
+        // it is too late to make one
+        if reassembler.State != STATE_WAITING_TRANSPORT_FLAGS {
+            if !reassembler.Started && (reassembler.Compression != 0) {
+                // Everything after the transport request is compressed
+                // and must be decompressed before it comes back here
+                reassembler.Started = true
+                break
+            }
+            reassembler.Started = true
+        }
+    }
+    
+    return returnDatagrams
+}
+
+/* End Of File */
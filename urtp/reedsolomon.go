@@ -0,0 +1,200 @@
+/* Reed-Solomon erasure coding for the Internet of Chuffs.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package urtp
+
+import (
+    "errors"
+    "fmt"
+)
+
+// A systematic Reed-Solomon erasure code over GF(2^8) (polynomial
+// 0x11d): the data shards are sent as they are and each parity shard
+// is a sum of the data shards weighted by a row of a Cauchy matrix,
+// element (i, j) being 1 / ((dataShards + i) XOR j).  Any square matrix
+// made from rows of the identity and of the Cauchy matrix can be
+// inverted, so any dataShards of the shards of a group, data or parity,
+// are enough to get back all of the data shards.  Since a lost UDP
+// datagram is known to be lost only erasures need to be corrected.
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// Exponent and logarithm tables for GF(2^8), the exponent table
+// doubled up so that the sum of two logarithms can index it directly
+var gfExp, gfLog = gfTables()
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Make the exponent and logarithm tables for GF(2^8)
+func gfTables() ([512]byte, [256]byte) {
+    var exponents [512]byte
+    var logarithms [256]byte
+
+    x := 1
+    for y := 0; y < 255; y++ {
+        exponents[y] = byte(x)
+        logarithms[x] = byte(y)
+        x <<= 1
+        if x & 0x100 != 0 {
+            x ^= 0x11d
+        }
+    }
+    for y := 255; y < len(exponents); y++ {
+        exponents[y] = exponents[y - 255]
+    }
+
+    return exponents, logarithms
+}
+
+// Multiply in GF(2^8)
+func gfMul(a byte, b byte) byte {
+    if (a == 0) || (b == 0) {
+        return 0
+    }
+
+    return gfExp[int(gfLog[a]) + int(gfLog[b])]
+}
+
+// Return the inverse of a non-zero element of GF(2^8)
+func gfInv(a byte) byte {
+    return gfExp[255 - int(gfLog[a])]
+}
+
+// Return the coefficient of data shard j in parity shard i
+func rsCoefficient(dataShards int, i int, j int) byte {
+    return gfInv(byte(dataShards + i) ^ byte(j))
+}
+
+// Add a shard, multiplied by a coefficient, into another
+func rsMulAdd(out []byte, coefficient byte, shard []byte) {
+    if coefficient == 0 {
+        return
+    }
+    logCoefficient := int(gfLog[coefficient])
+    for x, item := range shard {
+        if item != 0 {
+            out[x] ^= gfExp[logCoefficient + int(gfLog[item])]
+        }
+    }
+}
+
+// Return the parity shards for a set of data shards, all of which must
+// be the same size
+func rsEncode(data [][]byte, parityShards int) [][]byte {
+    parity := make([][]byte, parityShards)
+
+    for i := range parity {
+        parity[i] = make([]byte, len(data[0]))
+        for j, shard := range data {
+            rsMulAdd(parity[i], rsCoefficient(len(data), i, j), shard)
+        }
+    }
+
+    return parity
+}
+
+// Invert a square matrix in GF(2^8), in place
+func gfInvert(matrix [][]byte) error {
+    size := len(matrix)
+    inverse := make([][]byte, size)
+    for x := range inverse {
+        inverse[x] = make([]byte, size)
+        inverse[x][x] = 1
+    }
+
+    for column := 0; column < size; column++ {
+        // Find a row with something in this column
+        pivot := column
+        for (pivot < size) && (matrix[pivot][column] == 0) {
+            pivot++
+        }
+        if pivot == size {
+            return errors.New("matrix is singular")
+        }
+        matrix[column], matrix[pivot] = matrix[pivot], matrix[column]
+        inverse[column], inverse[pivot] = inverse[pivot], inverse[column]
+
+        // Scale it to put a one on the diagonal
+        scale := gfInv(matrix[column][column])
+        for x := 0; x < size; x++ {
+            matrix[column][x] = gfMul(matrix[column][x], scale)
+            inverse[column][x] = gfMul(inverse[column][x], scale)
+        }
+
+        // Clear the column in every other row
+        for row := 0; row < size; row++ {
+            if (row != column) && (matrix[row][column] != 0) {
+                factor := matrix[row][column]
+                for x := 0; x < size; x++ {
+                    matrix[row][x] ^= gfMul(factor, matrix[column][x])
+                    inverse[row][x] ^= gfMul(factor, inverse[column][x])
+                }
+            }
+        }
+    }
+    copy(matrix, inverse)
+
+    return nil
+}
+
+// Fill in the missing (nil) data shards of a group from those present,
+// data shards first, then parity; at least dataShards of the shards
+// must be present and they must all be the same size
+func rsReconstruct(shards [][]byte, dataShards int) error {
+    var rows []int
+
+    for x, shard := range shards {
+        if (shard != nil) && (len(rows) < dataShards) {
+            rows = append(rows, x)
+        }
+    }
+    if len(rows) < dataShards {
+        return errors.New(fmt.Sprintf("%d shard(s) present but %d needed", len(rows), dataShards))
+    }
+
+    // The rows of the encoding matrix for the shards present
+    matrix := make([][]byte, dataShards)
+    for x, row := range rows {
+        matrix[x] = make([]byte, dataShards)
+        if row < dataShards {
+            matrix[x][row] = 1
+        } else {
+            for j := 0; j < dataShards; j++ {
+                matrix[x][j] = rsCoefficient(dataShards, row - dataShards, j)
+            }
+        }
+    }
+    err := gfInvert(matrix)
+    if err != nil {
+        return err
+    }
+
+    // Each missing data shard is a row of the inverse times the
+    // shards present
+    for j := 0; j < dataShards; j++ {
+        if shards[j] == nil {
+            shard := make([]byte, len(shards[rows[0]]))
+            for x, row := range rows {
+                rsMulAdd(shard, matrix[j][x], shards[row])
+            }
+            shards[j] = shard
+        }
+    }
+
+    return nil
+}
+
+/* End Of File */
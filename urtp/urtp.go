@@ -0,0 +1,374 @@
+/* URTP datagrams for the Internet of Chuffs.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+// Package urtp parses what an Internet of Chuffs client sends: URTP
+// datagrams with Parse() and streams of bytes (e.g. TCP) with a
+// Reassembler, which passes what it finds to a Handler.  It is used by
+// ioc-server and may be used by anything else that needs to understand
+// URTP (e.g. capture analysers or test clients).  Since the bytes may
+// come from the public internet nothing is assumed: every length is
+// checked against the data that is actually there.  fuzz.go has
+// go-fuzz targets for both.
+//
+// A URTP datagram in the original layout is:
+//
+//   - SYNC_BYTE,
+//   - one byte, the audio coding scheme, with CRC_FLAG set if the
+//     header has a CRC and the number of channels less one in the
+//     CHANNELS_MASK bits (so zero for mono),
+//   - two bytes (big-endian), the sequence number,
+//   - eight bytes (big-endian), the timestamp in microseconds,
+//   - two bytes (big-endian), the number of bytes of payload,
+//   - if CRC_FLAG is set, two bytes (big-endian), the CRC of the
+//     payload,
+//
+// followed by the payload.  A payload of more than one channel is the
+// payloads of each channel, all the same size, one after another.  For
+// more details see the client code (ioc-client).
+package urtp
+
+import (
+    "errors"
+    "fmt"
+    "log"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A URTP datagram as parsed
+type Datagram struct {
+    AudioCodingScheme  byte
+    SequenceNumber     uint16
+    Timestamp          uint64
+    Channels           int
+    Heartbeat          bool
+    Crc                bool
+    Payload            []byte
+}
+
+// What a client has said about itself in a hello datagram
+type Hello struct {
+    FirmwareVersion      string
+    CodingSchemes        []int
+    SamplingFrequencies  []int
+}
+
+// A time report from the client, completing a two-way exchange of
+// times: all are in microseconds, those of the client on its clock and
+// those of the server on the server's
+type TimeReport struct {
+    ClientSent      uint64
+    ServerReceived  uint64
+    ServerSent      uint64
+    ClientReceived  uint64
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The URTP datagram parameters
+const SYNC_BYTE byte = 0x5a
+const TIMESTAMP_SIZE int = 8
+const SEQUENCE_NUMBER_SIZE int = 2
+const PAYLOAD_SIZE_SIZE int = 2
+const HEADER_SIZE int = 14
+const CRC_SIZE int = 2
+
+// The duration of the audio in a datagram in ms
+const BLOCK_DURATION_MS int = 20
+
+// The highest sampling frequency that a client may agree in its hello
+const MAX_SAMPLING_FREQUENCY int = 48000
+
+// The size of a sample of uncompressed audio
+const SAMPLE_SIZE int = 2
+
+// The largest payload: a block of 16-bit audio at the highest sampling
+// frequency with the most channels
+const MAX_PAYLOAD_SIZE int = MAX_SAMPLING_FREQUENCY * BLOCK_DURATION_MS / 1000 * SAMPLE_SIZE * MAX_CHANNELS
+
+// The largest URTP datagram
+const DATAGRAM_MAX_SIZE int = HEADER_SIZE + CRC_SIZE + MAX_PAYLOAD_SIZE
+
+// Offset to the number of bytes part of the URTP header
+const NUM_BYTES_AUDIO_OFFSET int = 12
+
+// If this bit is set in the audio coding scheme byte the URTP header is
+// extended by a CRC16 (CCITT, initial value 0xFFFF, big-endian) over
+// the payload, which is checked before the payload is decoded
+const CRC_FLAG byte = 0x80
+
+// The number of channels less one is in these bits of the audio coding
+// scheme byte
+const CHANNELS_MASK byte = 0x60
+const CHANNELS_SHIFT uint = 5
+
+// The most channels a datagram may carry
+const MAX_CHANNELS int = int(CHANNELS_MASK >> CHANNELS_SHIFT) + 1
+
+// The CRC16 polynomial
+const CRC_POLYNOMIAL uint16 = 0x1021
+
+// The audio coding schemes
+const (
+    PCM_SIGNED_16_BIT = 0
+    UNICAM_COMPRESSED_8_BIT = 1
+    OPUS_COMPRESSED = 2
+    IMA_ADPCM_4_BIT = 3
+    UNICAM_COMPRESSED_10_BIT = 4
+    UNICAM_COMPRESSED_12_BIT = 5
+    PCM_SIGNED_16_BIT_LITTLE_ENDIAN = 6
+    PCM_UNSIGNED_8_BIT = 7
+    MAX_NUM_AUDIO_CODING_SCHEMES = iota
+)
+
+// The value in the audio coding scheme byte of a heartbeat datagram:
+// a URTP header with no payload which the client sends during silence
+// to show that the link is alive and to keep NAT bindings open; the
+// sequence number is that of the last audio datagram sent
+const HEARTBEAT_CODING byte = 0x7f
+
+// Marker at the start of a capabilities acknowledgement from the client
+const CAPABILITIES_SYNC_BYTE byte = 0xa7
+
+// The size of a capabilities acknowledgement
+const CAPABILITIES_ACK_SIZE int = 3
+
+// Marker at the start of a hello datagram from the client
+const HELLO_SYNC_BYTE byte = 0xaa
+
+// The largest hello datagram accepted
+const HELLO_MAX_SIZE int = 256
+
+// Marker at the start of a time report from the client: this byte
+// followed by four eight-byte (big-endian) times in microseconds, those
+// of the client sending the datagram that prompted a timing datagram,
+// of the server receiving it, of the server sending the timing
+// datagram and of the client receiving that
+const TIME_REPORT_SYNC_BYTE byte = 0xac
+
+// The size of a time report
+const TIME_REPORT_SIZE int = 1 + TIMESTAMP_SIZE * 4
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The error returned by Parse() if the CRC is wrong
+var ErrCrc = errors.New("CRC is wrong")
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return the CRC16 of some data
+func Crc16(data []byte) uint16 {
+    crc := uint16(0xFFFF)
+
+    for _, item := range data {
+        crc ^= uint16(item) << 8
+        for x := 0; x < 8; x++ {
+            if crc & 0x8000 != 0 {
+                crc = (crc << 1) ^ CRC_POLYNOMIAL
+            } else {
+                crc <<= 1
+            }
+        }
+    }
+
+    return crc
+}
+
+// Return the size of a URTP header given its audio coding scheme byte
+func HeaderSize(audioCodingByte byte) int {
+    if audioCodingByte & CRC_FLAG != 0 {
+        return HEADER_SIZE + CRC_SIZE
+    }
+
+    return HEADER_SIZE
+}
+
+// Return true if an audio coding scheme byte, with any CRC_FLAG
+// removed, is valid
+func isValidCoding(audioCodingByte byte) bool {
+    audioCodingScheme := audioCodingByte &^ CRC_FLAG
+
+    return (audioCodingScheme &^ CHANNELS_MASK < MAX_NUM_AUDIO_CODING_SCHEMES) || (audioCodingScheme == HEARTBEAT_CODING)
+}
+
+// Verify that a sequence of byte represents URTP header
+func VerifyHeader(header []byte) bool {
+    var isHeader bool
+
+    if len(header) >= HEADER_SIZE {
+        if header[0] == SYNC_BYTE {
+            if isValidCoding(header[1]) {
+                bytesOfPayload := ((int(header[NUM_BYTES_AUDIO_OFFSET]) << 8) + (int(header[NUM_BYTES_AUDIO_OFFSET + 1])))
+                if bytesOfPayload <= MAX_PAYLOAD_SIZE {
+                    isHeader = true;
+                } else {
+                    log.Printf("NOT a URTP header %x (%d (0x%x, in the last two bytes) is larger than the maximum number of payload bytes (%d)).\n", header,
+                               bytesOfPayload, bytesOfPayload, MAX_PAYLOAD_SIZE)
+                }
+            } else {
+                log.Printf("NOT a URTP header %x (0x%x in the second byte is not a valid audio coding scheme).\n", header, header[1])
+            }
+        } else {
+            log.Printf("NOT a URTP header %x (0x%x at the start is not a sync byte (%x)).\n", header, header[0], SYNC_BYTE)
+        }
+    } else {
+        log.Printf("NOT a URTP header %x (must be at least %d bytes long).\n", header, HEADER_SIZE)
+    }
+
+    return isHeader
+}
+
+// Parse a URTP datagram, which must be in the original layout (see
+// Normalise()), checking that the header is valid, that the payload is
+// the size the header says it is and, if there is one, the CRC (ErrCrc
+// is returned, with the parsed datagram, if the CRC is wrong); the
+// payload is a slice of the datagram
+func Parse(datagram []byte) (*Datagram, error) {
+    if (len(datagram) < HEADER_SIZE) || !VerifyHeader(datagram[:HEADER_SIZE]) {
+        return nil, errors.New(fmt.Sprintf("not a URTP header (%d byte(s))", len(datagram)))
+    }
+    headerSize := HeaderSize(datagram[1])
+    if len(datagram) < headerSize {
+        return nil, errors.New(fmt.Sprintf("%d byte(s) is too short for a header with a CRC", len(datagram)))
+    }
+    payloadSize := (int(datagram[NUM_BYTES_AUDIO_OFFSET]) << 8) + int(datagram[NUM_BYTES_AUDIO_OFFSET + 1])
+    if len(datagram) - headerSize != payloadSize {
+        return nil, errors.New(fmt.Sprintf("header says %d byte(s) of payload but there are %d", payloadSize, len(datagram) - headerSize))
+    }
+
+    parsed := new(Datagram)
+    parsed.AudioCodingScheme = datagram[1] &^ CRC_FLAG
+    parsed.Heartbeat = parsed.AudioCodingScheme == HEARTBEAT_CODING
+    parsed.Channels = 1
+    if !parsed.Heartbeat {
+        parsed.Channels = int((parsed.AudioCodingScheme & CHANNELS_MASK) >> CHANNELS_SHIFT) + 1
+        parsed.AudioCodingScheme &^= CHANNELS_MASK
+    }
+    parsed.Crc = headerSize > HEADER_SIZE
+    parsed.SequenceNumber = (uint16(datagram[2]) << 8) + uint16(datagram[3])
+    for x := 0; x < TIMESTAMP_SIZE; x++ {
+        parsed.Timestamp = (parsed.Timestamp << 8) + uint64(datagram[4 + x])
+    }
+    parsed.Payload = datagram[headerSize:]
+    if parsed.Crc && (Crc16(parsed.Payload) != (uint16(datagram[HEADER_SIZE]) << 8) + uint16(datagram[HEADER_SIZE + 1])) {
+        return parsed, ErrCrc
+    }
+
+    return parsed, nil
+}
+
+// Format a URTP datagram in the original layout, as a client would
+// send it: the payload of more than one channel must already be the
+// payloads of each channel one after another and, if crc is true, the
+// header is extended by the CRC of the payload; the inverse of Parse()
+func Format(audioCodingScheme byte, channels int, sequenceNumber uint16, timestamp uint64,
+            payload []byte, crc bool) []byte {
+    codingByte := audioCodingScheme | (byte(channels - 1) << CHANNELS_SHIFT) & CHANNELS_MASK
+    if crc {
+        codingByte |= CRC_FLAG
+    }
+    datagram := make([]byte, HeaderSize(codingByte), HeaderSize(codingByte) + len(payload))
+    datagram[0] = SYNC_BYTE
+    datagram[1] = codingByte
+    datagram[2] = byte(sequenceNumber >> 8)
+    datagram[3] = byte(sequenceNumber)
+    for x := 0; x < TIMESTAMP_SIZE; x++ {
+        datagram[4 + x] = byte(timestamp >> (uint(TIMESTAMP_SIZE - 1 - x) * 8))
+    }
+    datagram[NUM_BYTES_AUDIO_OFFSET] = byte(len(payload) >> 8)
+    datagram[NUM_BYTES_AUDIO_OFFSET + 1] = byte(len(payload))
+    if crc {
+        payloadCrc := Crc16(payload)
+        datagram[HEADER_SIZE] = byte(payloadCrc >> 8)
+        datagram[HEADER_SIZE + 1] = byte(payloadCrc)
+    }
+
+    return append(datagram, payload...)
+}
+
+// Return true if data looks like a capabilities acknowledgement
+func IsCapabilitiesAck(data []byte) bool {
+    return (len(data) == CAPABILITIES_ACK_SIZE) && (data[0] == CAPABILITIES_SYNC_BYTE)
+}
+
+// Return the size that a hello datagram will be, as far as can be
+// told from the start of it, or zero if more is needed to tell
+func HelloSize(data []byte) int {
+    size := 1
+    for _, itemSize := range []int{1, 1, 2} {
+        if len(data) <= size {
+            return 0
+        }
+        size += 1 + int(data[size]) * itemSize
+    }
+
+    return size
+}
+
+// Return true if data looks like a complete hello datagram
+func IsHello(data []byte) bool {
+    return (len(data) > 0) && (data[0] == HELLO_SYNC_BYTE) && (HelloSize(data) == len(data))
+}
+
+// Parse a hello datagram, returning nil if it isn't one
+func ParseHello(data []byte) *Hello {
+    var hello *Hello
+
+    if IsHello(data) {
+        hello = new(Hello)
+        offset := 1
+        hello.FirmwareVersion = string(data[offset + 1:offset + 1 + int(data[offset])])
+        offset += 1 + int(data[offset])
+        for x := 0; x < int(data[offset]); x++ {
+            hello.CodingSchemes = append(hello.CodingSchemes, int(data[offset + 1 + x]))
+        }
+        offset += 1 + int(data[offset])
+        for x := 0; x < int(data[offset]); x++ {
+            hello.SamplingFrequencies = append(hello.SamplingFrequencies,
+                                               (int(data[offset + 1 + x * 2]) << 8) + int(data[offset + 2 + x * 2]))
+        }
+    }
+
+    return hello
+}
+
+// Return true if data looks like a time report
+func IsTimeReport(data []byte) bool {
+    return (len(data) == TIME_REPORT_SIZE) && (data[0] == TIME_REPORT_SYNC_BYTE)
+}
+
+// Parse a time report, returning nil if it isn't one
+func ParseTimeReport(data []byte) *TimeReport {
+    var report *TimeReport
+
+    if IsTimeReport(data) {
+        var times [4]uint64
+        for x := range times {
+            for y := 0; y < TIMESTAMP_SIZE; y++ {
+                times[x] = (times[x] << 8) + uint64(data[1 + x * TIMESTAMP_SIZE + y])
+            }
+        }
+        report = &TimeReport{ClientSent: times[0], ServerReceived: times[1], ServerSent: times[2], ClientReceived: times[3]}
+    }
+
+    return report
+}
+
+/* End Of File */
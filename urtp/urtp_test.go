@@ -0,0 +1,463 @@
+/* Tests of the URTP package of the Internet of Chuffs.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package urtp
+
+import (
+    "bytes"
+    "testing"
+)
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A Handler that keeps what it is given
+type testHandler struct {
+    datagrams    [][]byte
+    versions     []byte
+    acks         [][]byte
+    hellos       [][]byte
+    timeReports  [][]byte
+}
+
+// A URTP header test case
+type headerTest struct {
+    name            string
+    coding          byte
+    channels        int
+    sequenceNumber  uint16
+    timestamp       uint64
+    payloadSize     int
+    crc             bool
+}
+
+// A reassembly test case: the stream, as the pieces it arrives in, and
+// what should come out of it
+type reassemblyTest struct {
+    name         string
+    pieces       [][]byte
+    datagrams    [][]byte
+    versions     []byte
+    acks         int
+    hellos       int
+    timeReports  int
+    returned     [][]byte
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Keep a copy of a capabilities acknowledgement
+func (handler *testHandler) HandleCapabilitiesAck(data []byte) {
+    handler.acks = append(handler.acks, append([]byte(nil), data...))
+}
+
+// Keep a copy of a hello, replying with a capabilities datagram
+func (handler *testHandler) HandleHello(data []byte) []byte {
+    handler.hellos = append(handler.hellos, append([]byte(nil), data...))
+
+    return []byte{CAPABILITIES_SYNC_BYTE, 0}
+}
+
+// Keep a copy of a time report
+func (handler *testHandler) HandleTimeReport(data []byte) {
+    handler.timeReports = append(handler.timeReports, append([]byte(nil), data...))
+}
+
+// Keep a copy of a URTP datagram
+func (handler *testHandler) HandleDatagram(version byte, datagram []byte) [][]byte {
+    handler.datagrams = append(handler.datagrams, append([]byte(nil), datagram...))
+    handler.versions = append(handler.versions, version)
+
+    return nil
+}
+
+// Return a payload of size bytes that isn't all the same
+func testPayload(size int) []byte {
+    payload := make([]byte, size)
+    for x := range payload {
+        payload[x] = byte(x * 7 + x / 256)
+    }
+
+    return payload
+}
+
+// A block of 16-bit audio at the highest sampling frequency, with the
+// most channels, must get through Parse() and the Reassembler intact
+func TestMaxSizeBlock(t *testing.T) {
+    payload := testPayload(MAX_SAMPLING_FREQUENCY * BLOCK_DURATION_MS / 1000 * SAMPLE_SIZE * MAX_CHANNELS)
+    if len(payload) != MAX_PAYLOAD_SIZE {
+        t.Fatalf("MAX_PAYLOAD_SIZE is %d but a block at %d Hz with %d channel(s) is %d byte(s).",
+                 MAX_PAYLOAD_SIZE, MAX_SAMPLING_FREQUENCY, MAX_CHANNELS, len(payload))
+    }
+    for _, crc := range []bool{false, true} {
+        datagram := Format(PCM_SIGNED_16_BIT, MAX_CHANNELS, 0xfffe, 123456789, payload, crc)
+        if len(datagram) > DATAGRAM_MAX_SIZE {
+            t.Fatalf("datagram of %d byte(s) is larger than DATAGRAM_MAX_SIZE (%d).", len(datagram), DATAGRAM_MAX_SIZE)
+        }
+        parsed, err := Parse(datagram)
+        if err != nil {
+            t.Fatalf("Parse() of a maximum-size block (CRC %t) failed (%s).", crc, err.Error())
+        }
+        if (parsed.Channels != MAX_CHANNELS) || (parsed.SequenceNumber != 0xfffe) || (parsed.Timestamp != 123456789) ||
+           (parsed.Crc != crc) || !bytes.Equal(parsed.Payload, payload) {
+            t.Fatalf("Parse() of a maximum-size block (CRC %t) gave %+v.", crc, parsed)
+        }
+
+        handler := &testHandler{}
+        reassembler := NewReassembler(handler)
+        // Split the stream so that the payload straddles reads
+        stream := append(append([]byte(nil), datagram...), datagram...)
+        for len(stream) > 0 {
+            size := 1000
+            if size > len(stream) {
+                size = len(stream)
+            }
+            reassembler.Handle(stream[:size])
+            stream = stream[size:]
+        }
+        if len(handler.datagrams) != 2 {
+            t.Fatalf("Reassembler found %d maximum-size block(s) (CRC %t), expected 2.", len(handler.datagrams), crc)
+        }
+        for _, reassembled := range handler.datagrams {
+            if !bytes.Equal(reassembled, datagram) {
+                t.Fatalf("Reassembler changed a maximum-size block (CRC %t).", crc)
+            }
+        }
+    }
+
+    // One byte more than the maximum must be refused
+    datagram := Format(PCM_SIGNED_16_BIT, MAX_CHANNELS, 0, 0, testPayload(MAX_PAYLOAD_SIZE + 1), false)
+    if _, err := Parse(datagram); err == nil {
+        t.Fatalf("Parse() accepted a payload of %d byte(s).", MAX_PAYLOAD_SIZE + 1)
+    }
+}
+
+// Return a hello datagram
+func testHello(firmwareVersion string, codingSchemes []byte, samplingFrequencies []int) []byte {
+    hello := []byte{HELLO_SYNC_BYTE, byte(len(firmwareVersion))}
+    hello = append(hello, firmwareVersion...)
+    hello = append(hello, byte(len(codingSchemes)))
+    hello = append(hello, codingSchemes...)
+    hello = append(hello, byte(len(samplingFrequencies)))
+    for _, frequency := range samplingFrequencies {
+        hello = append(hello, byte(frequency >> 8), byte(frequency))
+    }
+
+    return hello
+}
+
+// Return a time report datagram
+func testTimeReport(times [4]uint64) []byte {
+    report := []byte{TIME_REPORT_SYNC_BYTE}
+    for _, time := range times {
+        for x := TIMESTAMP_SIZE - 1; x >= 0; x-- {
+            report = append(report, byte(time >> (uint(x) * 8)))
+        }
+    }
+
+    return report
+}
+
+// Return a URTP datagram in the layout of URTP version 2
+func testVersioned(datagram []byte) []byte {
+    return append([]byte{VERSIONED_SYNC_BYTE, 2}, datagram[1:]...)
+}
+
+// Return data split into pieces of size bytes
+func testPieces(data []byte, size int) [][]byte {
+    var pieces [][]byte
+
+    for len(data) > size {
+        pieces = append(pieces, data[:size])
+        data = data[size:]
+    }
+
+    return append(pieces, data)
+}
+
+// Return the datagrams joined together
+func testJoin(datagrams ...[]byte) []byte {
+    var joined []byte
+
+    for _, datagram := range datagrams {
+        joined = append(joined, datagram...)
+    }
+
+    return joined
+}
+
+// A URTP header must be formatted, verified and parsed back to what
+// went in, whatever the coding, channels, sequence number (including
+// where it wraps), timestamp and CRC
+func TestHeader(t *testing.T) {
+    tests := []headerTest{
+        {"PCM mono", PCM_SIGNED_16_BIT, 1, 1, 20000, 640, false},
+        {"PCM mono with CRC", PCM_SIGNED_16_BIT, 1, 2, 40000, 640, true},
+        {"UNICAM stereo", UNICAM_COMPRESSED_8_BIT, 2, 1000, 123456789, 340, false},
+        {"Opus most channels with CRC", OPUS_COMPRESSED, MAX_CHANNELS, 7, 1, 100, true},
+        {"last sequence number before wrap", IMA_ADPCM_4_BIT, 1, 0xffff, 1 << 40, 164, false},
+        {"first sequence number after wrap", IMA_ADPCM_4_BIT, 1, 0, (1 << 40) + 20000, 164, true},
+        {"largest timestamp", PCM_UNSIGNED_8_BIT, 1, 0x8000, 0xffffffffffffffff, 320, false},
+        {"empty payload", PCM_SIGNED_16_BIT_LITTLE_ENDIAN, 1, 5, 0, 0, true},
+        {"heartbeat", HEARTBEAT_CODING, 1, 42, 999, 0, false},
+        {"largest payload", PCM_SIGNED_16_BIT, MAX_CHANNELS, 3, 3, MAX_PAYLOAD_SIZE, true},
+    }
+
+    for _, test := range tests {
+        payload := testPayload(test.payloadSize)
+        datagram := Format(test.coding, test.channels, test.sequenceNumber, test.timestamp, payload, test.crc)
+        if len(datagram) != HeaderSize(datagram[1]) + test.payloadSize {
+            t.Errorf("%s: datagram is %d byte(s), expected %d.", test.name, len(datagram), HeaderSize(datagram[1]) + test.payloadSize)
+            continue
+        }
+        if !VerifyHeader(datagram[:HEADER_SIZE]) {
+            t.Errorf("%s: header not verified.", test.name)
+            continue
+        }
+        parsed, err := Parse(datagram)
+        if err != nil {
+            t.Errorf("%s: Parse() failed (%s).", test.name, err.Error())
+            continue
+        }
+        heartbeat := test.coding == HEARTBEAT_CODING
+        if (parsed.AudioCodingScheme != test.coding) || (parsed.Channels != test.channels) ||
+           (parsed.SequenceNumber != test.sequenceNumber) || (parsed.Timestamp != test.timestamp) ||
+           (parsed.Crc != test.crc) || (parsed.Heartbeat != heartbeat) || !bytes.Equal(parsed.Payload, payload) {
+            t.Errorf("%s: Parse() gave %+v.", test.name, parsed)
+        }
+    }
+}
+
+// Things that aren't URTP headers, or datagrams, must be refused
+func TestHeaderRejected(t *testing.T) {
+    good := Format(PCM_SIGNED_16_BIT, 1, 1, 1, testPayload(640), true)
+    badSync := append([]byte(nil), good...)
+    badSync[0] = VERSIONED_SYNC_BYTE
+    badCoding := append([]byte(nil), good...)
+    badCoding[1] = CRC_FLAG | byte(MAX_NUM_AUDIO_CODING_SCHEMES)
+    tooLarge := append([]byte(nil), good...)
+    tooLarge[NUM_BYTES_AUDIO_OFFSET] = byte((MAX_PAYLOAD_SIZE + 1) >> 8)
+    tooLarge[NUM_BYTES_AUDIO_OFFSET + 1] = byte((MAX_PAYLOAD_SIZE + 1) & 0xff)
+    badCrc := append([]byte(nil), good...)
+    badCrc[len(badCrc) - 1] ^= 0x01
+
+    tests := []struct {
+        name      string
+        datagram  []byte
+        header    bool
+        crcError  bool
+    }{
+        {"too short", good[:HEADER_SIZE - 1], false, false},
+        {"wrong sync byte", badSync, false, false},
+        {"invalid coding", badCoding, false, false},
+        {"payload too large", tooLarge, false, false},
+        {"no room for the CRC", good[:HEADER_SIZE + 1], true, false},
+        {"payload truncated", good[:len(good) - 1], true, false},
+        {"payload too long", append(append([]byte(nil), good...), 0), true, false},
+        {"CRC wrong", badCrc, true, true},
+    }
+
+    for _, test := range tests {
+        if (len(test.datagram) >= HEADER_SIZE) && (VerifyHeader(test.datagram[:HEADER_SIZE]) != test.header) {
+            t.Errorf("%s: VerifyHeader() gave %t, expected %t.", test.name, !test.header, test.header)
+        }
+        parsed, err := Parse(test.datagram)
+        if err == nil {
+            t.Errorf("%s: Parse() accepted it.", test.name)
+        } else if test.crcError && ((err != ErrCrc) || (parsed == nil)) {
+            t.Errorf("%s: Parse() gave %v (%s), expected the datagram with ErrCrc.", test.name, parsed, err.Error())
+        } else if !test.crcError && ((err == ErrCrc) || (parsed != nil)) {
+            t.Errorf("%s: Parse() gave %v (%s), expected no datagram.", test.name, parsed, err.Error())
+        }
+    }
+}
+
+// The CRC must be CRC-16/CCITT-FALSE, as the client works it out
+func TestCrc16(t *testing.T) {
+    tests := []struct {
+        data  string
+        crc   uint16
+    }{
+        {"", 0xffff},
+        {"123456789", 0x29b1},
+        {"A", 0xb915},
+    }
+
+    for _, test := range tests {
+        if crc := Crc16([]byte(test.data)); crc != test.crc {
+            t.Errorf("Crc16(\"%s\") is 0x%04x, expected 0x%04x.", test.data, crc, test.crc)
+        }
+    }
+}
+
+// Datagrams of every URTP version understood must come out in the
+// original layout, along with their version; anything else is dropped
+func TestNormalise(t *testing.T) {
+    original := Format(PCM_SIGNED_16_BIT, 1, 0xffff, 20000, testPayload(64), true)
+
+    tests := []struct {
+        name      string
+        datagram  []byte
+        expected  []byte
+        version   byte
+    }{
+        {"original", original, original, VERSION_ORIGINAL},
+        {"version 2", testVersioned(original), original, 2},
+        {"unknown version", append([]byte{VERSIONED_SYNC_BYTE, VERSION + 1}, original[1:]...), nil, VERSION + 1},
+        {"version missing", []byte{VERSIONED_SYNC_BYTE}, nil, 0},
+        {"empty", []byte{}, []byte{}, VERSION_ORIGINAL},
+    }
+
+    for _, test := range tests {
+        normalised, version := Normalise(append([]byte{}, test.datagram...))
+        if (version != test.version) || !bytes.Equal(normalised, test.expected) || ((normalised == nil) != (test.expected == nil)) {
+            t.Errorf("%s: Normalise() gave version %d, %x; expected version %d, %x.", test.name, version, normalised,
+                     test.version, test.expected)
+        }
+    }
+}
+
+// What a client says about itself, as used to negotiate the coding
+// scheme and sampling frequency, must be parsed from a hello, which
+// can only be told to be complete as it arrives
+func TestHello(t *testing.T) {
+    tests := []struct {
+        name                 string
+        firmwareVersion      string
+        codingSchemes        []byte
+        samplingFrequencies  []int
+    }{
+        {"nothing", "", nil, nil},
+        {"old client", "1.0", []byte{PCM_SIGNED_16_BIT, UNICAM_COMPRESSED_8_BIT}, []int{16000}},
+        {"new client", "ioc-client 3.2.1", []byte{OPUS_COMPRESSED, PCM_SIGNED_16_BIT, IMA_ADPCM_4_BIT},
+         []int{8000, 16000, 48000}},
+    }
+
+    for _, test := range tests {
+        data := testHello(test.firmwareVersion, test.codingSchemes, test.samplingFrequencies)
+        for x := 1; x < len(data); x++ {
+            if IsHello(data[:x]) || ((HelloSize(data[:x]) != 0) && (HelloSize(data[:x]) != len(data))) {
+                t.Errorf("%s: the first %d byte(s) of a %d byte hello were taken to be a hello of %d byte(s).",
+                         test.name, x, len(data), HelloSize(data[:x]))
+            }
+        }
+        hello := ParseHello(data)
+        if hello == nil {
+            t.Errorf("%s: ParseHello() failed.", test.name)
+            continue
+        }
+        if (hello.FirmwareVersion != test.firmwareVersion) || (len(hello.CodingSchemes) != len(test.codingSchemes)) ||
+           (len(hello.SamplingFrequencies) != len(test.samplingFrequencies)) {
+            t.Errorf("%s: ParseHello() gave %+v.", test.name, hello)
+            continue
+        }
+        for x, codingScheme := range test.codingSchemes {
+            if hello.CodingSchemes[x] != int(codingScheme) {
+                t.Errorf("%s: coding scheme %d is %d, expected %d.", test.name, x, hello.CodingSchemes[x], codingScheme)
+            }
+        }
+        for x, frequency := range test.samplingFrequencies {
+            if hello.SamplingFrequencies[x] != frequency {
+                t.Errorf("%s: sampling frequency %d is %d, expected %d.", test.name, x, hello.SamplingFrequencies[x], frequency)
+            }
+        }
+    }
+
+    report := ParseTimeReport(testTimeReport([4]uint64{1, 1 << 32, 0xffffffffffffffff, 12345}))
+    if (report == nil) || (report.ClientSent != 1) || (report.ServerReceived != 1 << 32) ||
+       (report.ServerSent != 0xffffffffffffffff) || (report.ClientReceived != 12345) {
+        t.Errorf("ParseTimeReport() gave %+v.", report)
+    }
+}
+
+// A stream must be reassembled into what was sent, however it is split
+// up, whatever is mixed in with the datagrams and whatever the URTP
+// version and the transport asked for
+func TestReassembly(t *testing.T) {
+    first := Format(PCM_SIGNED_16_BIT, 1, 0xfffe, 20000, testPayload(640), false)
+    second := Format(UNICAM_COMPRESSED_8_BIT, 2, 0xffff, 40000, testPayload(340), true)
+    third := Format(IMA_ADPCM_4_BIT, 1, 0, 60000, testPayload(164), false)
+    heartbeat := Format(HEARTBEAT_CODING, 1, 0, 80000, nil, false)
+    // Nothing in this can be taken for a sync byte
+    silent := Format(PCM_SIGNED_16_BIT, 1, 1, 20000, make([]byte, 640), false)
+    ack := []byte{CAPABILITIES_SYNC_BYTE, 0x01, 0x02}
+    hello := testHello("1.2", []byte{PCM_SIGNED_16_BIT}, []int{16000})
+    timeReport := testTimeReport([4]uint64{1, 2, 3, 4})
+    stream := testJoin(first, second, third)
+
+    tests := []reassemblyTest{
+        {name: "whole", pieces: [][]byte{stream},
+         datagrams: [][]byte{first, second, third}, versions: []byte{1, 1, 1}},
+        {name: "a byte at a time", pieces: testPieces(stream, 1),
+         datagrams: [][]byte{first, second, third}, versions: []byte{1, 1, 1}},
+        {name: "odd pieces", pieces: testPieces(stream, 13),
+         datagrams: [][]byte{first, second, third}, versions: []byte{1, 1, 1}},
+        {name: "rubbish in between", pieces: [][]byte{{0x00, 0xff, 0x12}, first, {0x5a, 0x1f}, second},
+         datagrams: [][]byte{first, second}, versions: []byte{1, 1}},
+        {name: "heartbeat", pieces: [][]byte{testJoin(first, heartbeat, third)},
+         datagrams: [][]byte{first, heartbeat, third}, versions: []byte{1, 1, 1}},
+        {name: "version 2", pieces: testPieces(testJoin(testVersioned(first), second, testVersioned(third)), 7),
+         datagrams: [][]byte{first, second, third}, versions: []byte{2, 1, 2}},
+        {name: "unknown version", pieces: [][]byte{testJoin(append([]byte{VERSIONED_SYNC_BYTE, VERSION + 1}, silent[1:]...), second)},
+         datagrams: [][]byte{second}, versions: []byte{1}},
+        {name: "session datagrams", pieces: testPieces(testJoin(hello, first, ack, timeReport, second), 5),
+         datagrams: [][]byte{first, second}, versions: []byte{1, 1}, acks: 1, hellos: 1, timeReports: 1,
+         returned: [][]byte{{CAPABILITIES_SYNC_BYTE, 0}}},
+        {name: "length-prefixed", pieces: testPieces(testJoin(append([][]byte{{TRANSPORT_SYNC_BYTE, TRANSPORT_LENGTH_PREFIXED}},
+                                                                       LengthPrefixed([][]byte{hello, testVersioned(first), ack, second})...)...), 11),
+         datagrams: [][]byte{first, second}, versions: []byte{2, 1}, acks: 1, hellos: 1,
+         returned: [][]byte{{TRANSPORT_SYNC_BYTE, TRANSPORT_LENGTH_PREFIXED}, {0, 2, CAPABILITIES_SYNC_BYTE, 0}}},
+    }
+
+    for _, test := range tests {
+        var returned [][]byte
+        handler := &testHandler{}
+        reassembler := NewReassembler(handler)
+        for _, piece := range test.pieces {
+            returned = append(returned, reassembler.Handle(append([]byte(nil), piece...))...)
+        }
+        if len(handler.datagrams) != len(test.datagrams) {
+            t.Errorf("%s: %d datagram(s) reassembled, expected %d.", test.name, len(handler.datagrams), len(test.datagrams))
+            continue
+        }
+        for x, datagram := range test.datagrams {
+            if !bytes.Equal(handler.datagrams[x], datagram) || (handler.versions[x] != test.versions[x]) {
+                t.Errorf("%s: datagram %d is version %d, %x; expected version %d, %x.", test.name, x,
+                         handler.versions[x], handler.datagrams[x], test.versions[x], datagram)
+            }
+        }
+        if (len(handler.acks) != test.acks) || (len(handler.hellos) != test.hellos) || (len(handler.timeReports) != test.timeReports) {
+            t.Errorf("%s: %d capabilities acknowledgement(s), %d hello(s) and %d time report(s), expected %d, %d and %d.",
+                     test.name, len(handler.acks), len(handler.hellos), len(handler.timeReports), test.acks, test.hellos, test.timeReports)
+        }
+        if (test.acks > 0) && !bytes.Equal(handler.acks[0], ack) {
+            t.Errorf("%s: capabilities acknowledgement is %x, expected %x.", test.name, handler.acks[0], ack)
+        }
+        if (test.hellos > 0) && !bytes.Equal(handler.hellos[0], hello) {
+            t.Errorf("%s: hello is %x, expected %x.", test.name, handler.hellos[0], hello)
+        }
+        if len(returned) != len(test.returned) {
+            t.Errorf("%s: %d datagram(s) returned, expected %d.", test.name, len(returned), len(test.returned))
+            continue
+        }
+        for x, datagram := range test.returned {
+            if !bytes.Equal(returned[x], datagram) {
+                t.Errorf("%s: returned datagram %d is %x, expected %x.", test.name, x, returned[x], datagram)
+            }
+        }
+    }
+}
+
+/* End Of File */
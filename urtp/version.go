@@ -0,0 +1,126 @@
+/* URTP protocol versions for the Internet of Chuffs.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package urtp
+
+import (
+    "log"
+)
+
+// A URTP datagram beginning with SYNC_BYTE is VERSION_ORIGINAL, which
+// carries no version.  Any later version begins:
+//
+//   - VERSIONED_SYNC_BYTE,
+//   - one byte, the URTP version,
+//
+// followed by the rest of the datagram in the layout of that version.
+// Each version that is understood has a normaliser which converts it
+// to the original layout, which is what Parse() handles, so a client
+// can move to a new version once the server understands it rather than
+// both having to change at once.  The highest version understood is
+// VERSION, which the server gives in its capabilities datagram.
+//
+// The versions are:
+//
+//   - 1: the original layout; the top bit of the audio coding scheme
+//     byte may be set to add a CRC to the header,
+//   - 2: the version 1 layout after the version byte.
+//
+// In a stream without length-prefixed framing the end of a datagram
+// can only be found in a layout that can be reassembled byte by byte,
+// which is that of version 1, so versions with a different layout need
+// length-prefixed framing.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A URTP version that is understood
+type Version struct {
+    // Convert a datagram of this version, starting with
+    // VERSIONED_SYNC_BYTE, to the original layout, returning nil if
+    // it can't be converted; may work in place
+    Normalise  func(datagram []byte) []byte
+    // True if, after the version byte, the datagram has the layout
+    // of the original version
+    Original   bool
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// Marker at the start of a URTP datagram that carries its version
+const VERSIONED_SYNC_BYTE byte = 0x5b
+
+// The size of the start of a versioned URTP datagram
+const VERSION_PREFIX_SIZE int = 2
+
+// The URTP version of datagrams that start with SYNC_BYTE
+const VERSION_ORIGINAL byte = 1
+
+// The highest URTP version understood
+const VERSION byte = 2
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The URTP versions understood, other than the original
+var versions = map[byte]Version{
+    2: {Normalise: normaliseOriginal, Original: true},
+}
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Normalise a datagram which has the original layout after the
+// version byte
+func normaliseOriginal(datagram []byte) []byte {
+    if len(datagram) < VERSION_PREFIX_SIZE {
+        return nil
+    }
+    datagram[1] = SYNC_BYTE
+
+    return datagram[1:]
+}
+
+// Return true if a versioned URTP datagram can be reassembled byte by
+// byte
+func isVersionOriginalLayout(version byte) bool {
+    urtpVersion, ok := versions[version]
+
+    return ok && urtpVersion.Original
+}
+
+// Convert a datagram to the original layout, returning it (which may
+// be the same slice) and its version; nil is returned if the datagram
+// is of a version that isn't understood
+func Normalise(datagram []byte) ([]byte, byte) {
+    if (len(datagram) == 0) || (datagram[0] != VERSIONED_SYNC_BYTE) {
+        return datagram, VERSION_ORIGINAL
+    }
+    if len(datagram) < VERSION_PREFIX_SIZE {
+        return nil, 0
+    }
+    version := datagram[1]
+    urtpVersion, ok := versions[version]
+    if !ok {
+        log.Printf("URTP version %d is not understood (the highest understood is %d), datagram ignored.\n", version, VERSION)
+        return nil, version
+    }
+
+    return urtpVersion.Normalise(datagram), version
+}
+
+/* End Of File */
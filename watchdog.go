@@ -0,0 +1,189 @@
+/* Processing watchdog for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "context"
+    "log"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// The processing loop of a pipeline can stall in ways that it can't
+// see for itself: LAME can wedge, a write to a full or failing SD card
+// can block forever, or the encoder can keep returning without taking
+// any audio.  The watchdog of a pipeline (see --watchdog) is told by
+// the processing loop, every tick, whether the PCM buffer is being
+// drained and whether segments are coming out and, from a go routine
+// of its own, checks that this keeps happening.  If the loop stops
+// ticking altogether it is abandoned and a new one started in its
+// place, with a new encoder; if it is ticking but no audio is being
+// consumed, or no segments are being produced, the loop is told to
+// recover its output (as it would after an error from the encoder).
+// Either way a stall is logged, counted in the statistics and
+// published as an event, so that a script can raise the alarm.  While
+// the processing loop of the main stream is ticking its watchdog also
+// pings the systemd watchdog, if there is one (see sdnotify.go).
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The watchdog of the processing loop of a pipeline
+type Watchdog struct {
+    Timeout      time.Duration
+    pipeline     *Pipeline
+    // Called, from the go routine of the watchdog, to start a new
+    // processing loop in place of one that has stopped ticking
+    restart      func()
+    // Stalls that the processing loop should recover from itself
+    bites        chan string
+    locker       sync.Mutex
+    lastTick     time.Time
+    lastConsumed time.Time
+    lastSegment  time.Time
+    stalls       uint64
+    restarts     uint64
+    lastStall    time.Time
+    lastReason   string
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// How often the watchdog checks the processing loop
+const WATCHDOG_CHECK_PERIOD time.Duration = time.Second
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create a watchdog for the processing loop of a pipeline, which is
+// taken to have stalled if it makes no progress for timeout, restart
+// being called to start a new loop if the old one stops ticking;
+// its statistics are registered
+func newWatchdog(pipeline *Pipeline, timeout time.Duration, restart func()) *Watchdog {
+    now := time.Now()
+    watchdog := &Watchdog{Timeout: timeout, pipeline: pipeline, restart: restart, bites: make(chan string, 1),
+                          lastTick: now, lastConsumed: now, lastSegment: now}
+    registerStats(pipeline.statsName("watchdog"), watchdog.Stats)
+
+    return watchdog
+}
+
+// Note a tick of the processing loop; consumed is true if the PCM
+// buffer was drained (or there was nothing in it) and segmented is
+// true if a segment was finished (or none was owed, because nothing
+// was encoded)
+func (watchdog *Watchdog) Tick(now time.Time, consumed bool, segmented bool) {
+    watchdog.locker.Lock()
+    watchdog.lastTick = now
+    if consumed {
+        watchdog.lastConsumed = now
+    }
+    if segmented {
+        watchdog.lastSegment = now
+    }
+    watchdog.locker.Unlock()
+}
+
+// Return the reason for a stall that the processing loop should
+// recover its output from, empty if there isn't one
+func (watchdog *Watchdog) Bitten() string {
+    select {
+        case reason := <-watchdog.bites:
+            return reason
+        default:
+    }
+
+    return ""
+}
+
+// Deal with a stall of the processing loop; must be called with the
+// lock held
+func (watchdog *Watchdog) stall(now time.Time, reason string) {
+    watchdog.stalls++
+    watchdog.lastStall = now
+    watchdog.lastReason = reason
+    // Give whatever is done about it time to work
+    watchdog.lastTick = now
+    watchdog.lastConsumed = now
+    watchdog.lastSegment = now
+    log.Printf("Processing of stream \"%s\" has stalled (%s).\n", watchdog.pipeline.Name, reason)
+    publishEvent(EVENT_STALLED, map[string]interface{}{"stream": watchdog.pipeline.Name, "reason": reason})
+}
+
+// Check on the processing loop until ctx is done
+func (watchdog *Watchdog) Run(ctx context.Context) {
+    ticker := time.NewTicker(WATCHDOG_CHECK_PERIOD)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-ctx.Done():
+                return
+            case now := <-ticker.C:
+            {
+                // Segments may legitimately take a couple of segment
+                // durations to come out
+                segmentTimeout := watchdog.Timeout + pcmDuration(int(atomic.LoadInt64(&watchdog.pipeline.segmentSamples)) *
+                                                                  URTP_SAMPLE_SIZE * streamChannels) * 2
+                restart := false
+                watchdog.locker.Lock()
+                if now.Sub(watchdog.lastTick) > watchdog.Timeout {
+                    watchdog.stall(now, "the processing loop has stopped")
+                    watchdog.restarts++
+                    restart = true
+                } else if now.Sub(watchdog.lastConsumed) > watchdog.Timeout {
+                    watchdog.stall(now, "no audio has been encoded")
+                } else if now.Sub(watchdog.lastSegment) > segmentTimeout {
+                    watchdog.stall(now, "no segments have been produced")
+                }
+                reason := watchdog.lastReason
+                stalled := watchdog.lastStall.Equal(now)
+                watchdog.locker.Unlock()
+                if !restart && (watchdog.pipeline == mainPipeline) {
+                    // The processing loop is ticking: keep systemd happy
+                    systemdNotifier.Ping(now)
+                }
+                if restart {
+                    log.Printf("Abandoning the processing loop of stream \"%s\" and starting a new one.\n", watchdog.pipeline.Name)
+                    watchdog.restart()
+                } else if stalled {
+                    select {
+                        case watchdog.bites <- reason:
+                        default:
+                    }
+                }
+            }
+        }
+    }
+}
+
+// Return the statistics of a watchdog
+func (watchdog *Watchdog) Stats() interface{} {
+    watchdog.locker.Lock()
+    defer watchdog.locker.Unlock()
+
+    return map[string]interface{}{
+        "timeoutMs": int64(watchdog.Timeout / time.Millisecond),
+        "stalls": watchdog.stalls,
+        "restarts": watchdog.restarts,
+        "lastStall": watchdog.lastStall,
+        "lastReason": watchdog.lastReason,
+    }
+}
+
+/* End Of File */
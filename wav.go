@@ -0,0 +1,183 @@
+/* WAV file output for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "encoding/binary"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// The PCM that goes to the encoder can also be written to WAV files,
+// which anything will open, unlike the headerless raw PCM file.  A WAV
+// header holds the size of the audio, which isn't known until the end,
+// so the header is written with the size so far when the file is opened
+// and brought up to date once a minute and when the file is closed.  If
+// asked, a new file is started every so often; the file names then have
+// the UTC time at which they start inserted before the extension.  A
+// new file is also started, whether asked or not, before a file would
+// be too big for the sizes in its header.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of a WAV writer
+type WavWriter struct {
+    Name           string
+    RotatePeriod   time.Duration
+    handle         *os.File
+    dataBytes      int64
+    opened         time.Time
+    headerUpdated  time.Time
+    files          int
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The size of a WAV header
+const WAV_HEADER_SIZE int = 44
+
+// The most audio a WAV file can hold, its sizes being 32 bits
+const WAV_MAX_DATA_BYTES int64 = 0xffffffff - int64(WAV_HEADER_SIZE)
+
+// How often the header of the WAV file being written is updated
+const WAV_HEADER_UPDATE_PERIOD time.Duration = time.Minute
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The WAV writer, nil if there isn't one
+var wavWriter *WavWriter
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return a WAV header for dataBytes of audio
+func wavHeader(dataBytes int64) []byte {
+    header := make([]byte, WAV_HEADER_SIZE)
+
+    copy(header[0:], "RIFF")
+    binary.LittleEndian.PutUint32(header[4:], uint32(dataBytes) + uint32(WAV_HEADER_SIZE - 8))
+    copy(header[8:], "WAVE")
+    copy(header[12:], "fmt ")
+    binary.LittleEndian.PutUint32(header[16:], 16)
+    binary.LittleEndian.PutUint16(header[20:], 1) // PCM
+    binary.LittleEndian.PutUint16(header[22:], uint16(streamChannels))
+    binary.LittleEndian.PutUint32(header[24:], uint32(streamSamplingFrequency))
+    binary.LittleEndian.PutUint32(header[28:], uint32(streamSamplingFrequency * URTP_SAMPLE_SIZE * streamChannels))
+    binary.LittleEndian.PutUint16(header[32:], uint16(URTP_SAMPLE_SIZE * streamChannels))
+    binary.LittleEndian.PutUint16(header[34:], uint16(URTP_SAMPLE_SIZE * 8))
+    copy(header[36:], "data")
+    binary.LittleEndian.PutUint32(header[40:], uint32(dataBytes))
+
+    return header
+}
+
+// Create a WAV writer, writing to the file fileName or, if
+// rotateMinutes is not 0, starting a new file, named after fileName,
+// every rotateMinutes
+func newWavWriter(fileName string, rotateMinutes uint) (*WavWriter, error) {
+    wav := &WavWriter{Name: fileName, RotatePeriod: time.Duration(rotateMinutes) * time.Minute}
+    err := wav.open(time.Now())
+    if err != nil {
+        return nil, err
+    }
+
+    return wav, nil
+}
+
+// Return the name of the next file
+func (wav *WavWriter) fileName(now time.Time) string {
+    if (wav.RotatePeriod == 0) && (wav.files == 0) {
+        return wav.Name
+    }
+    extension := filepath.Ext(wav.Name)
+
+    return strings.TrimSuffix(wav.Name, extension) + "-" + now.UTC().Format(ARCHIVE_FILE_NAME_FORMAT) + extension
+}
+
+// Open the next file and write its header
+func (wav *WavWriter) open(now time.Time) error {
+    handle, err := os.Create(wav.fileName(now))
+    if err != nil {
+        return err
+    }
+    _, err = handle.Write(wavHeader(0))
+    if err != nil {
+        handle.Close()
+        return err
+    }
+    log.Printf("Opened \"%s\" for WAV output.\n", handle.Name())
+    wav.handle = handle
+    wav.dataBytes = 0
+    wav.opened = now
+    wav.headerUpdated = now
+    wav.files++
+
+    return nil
+}
+
+// Bring the header of the current file up to date
+func (wav *WavWriter) updateHeader(now time.Time) {
+    _, err := wav.handle.WriteAt(wavHeader(wav.dataBytes), 0)
+    if err != nil {
+        log.Printf("Unable to update the header of WAV file \"%s\" (%s).\n", wav.handle.Name(), err.Error())
+    }
+    wav.headerUpdated = now
+}
+
+// Close the current file, if there is one
+func (wav *WavWriter) Close() {
+    if wav.handle != nil {
+        wav.updateHeader(time.Now())
+        wav.handle.Close()
+        log.Printf("Closed WAV file \"%s\" (%d byte(s) of audio).\n", wav.handle.Name(), wav.dataBytes)
+        wav.handle = nil
+    }
+}
+
+// Write some little-endian 16-bit PCM, starting a new file first if
+// it is time to or the current one is full
+func (wav *WavWriter) Write(pcm []byte) {
+    now := time.Now()
+    if (wav.handle != nil) &&
+       (((wav.RotatePeriod > 0) && (now.Sub(wav.opened) >= wav.RotatePeriod)) ||
+        (wav.dataBytes + int64(len(pcm)) > WAV_MAX_DATA_BYTES)) {
+        wav.Close()
+        err := wav.open(now)
+        if err != nil {
+            log.Printf("Unable to open WAV file \"%s\" (%s), WAV output has stopped.\n", wav.fileName(now), err.Error())
+        }
+    }
+    if wav.handle != nil {
+        _, err := wav.handle.Write(pcm)
+        if err == nil {
+            wav.dataBytes += int64(len(pcm))
+            if now.Sub(wav.headerUpdated) >= WAV_HEADER_UPDATE_PERIOD {
+                wav.updateHeader(now)
+            }
+        } else {
+            log.Printf("Unable to write to WAV file \"%s\" (%s).\n", wav.handle.Name(), err.Error())
+        }
+    }
+}
+
+/* End Of File */
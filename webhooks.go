@@ -0,0 +1,243 @@
+/* Webhook notifications for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// So that the operator hears about it when the chuffs stop, without
+// having to write a script, events (see events.go) may be POSTed to
+// one or more webhooks (see --webhook), by default those that matter
+// to a person: a client connecting or disconnecting, the stream being
+// reset, the stream going out of service for --oostime and coming back
+// and the disk filling up (see diskspace.go); --webhookevents changes
+// the events.  The body is a JSON object of the event name, the time
+// (RFC 3339), the host name of the server, a line of text saying what
+// happened (so that it can go straight to a chat service, e.g. a Slack
+// or Discord incoming webhook, or a phone notification service such as
+// ntfy) and the fields of the event, durations being in milliseconds.
+// If there is a webhook secret (see --webhooksecret) the body is signed
+// with it, the X-Ioc-Signature header being "sha256=" followed by the
+// HMAC-SHA256 (hex) of the X-Ioc-Timestamp header, a ".", and the body,
+// so that the receiver can check that the POST came from the server and
+// isn't a replay.  A POST that fails, or gets anything but a 2xx, is
+// tried again up to WEBHOOK_RETRIES times.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// The webhooks
+type Webhooks struct {
+    Urls     []string
+    Events   map[string]bool
+    secret   []byte
+    host     string
+    locker   sync.Mutex
+    posted   int
+    failed   int
+}
+
+// Statistics of the webhooks
+type WebhooksStats struct {
+    Posted  int  `json:"posted"`
+    Failed  int  `json:"failed"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The number of events that may be queued for the webhooks
+const WEBHOOK_QUEUE_SIZE int = 100
+
+// The number of times a failed POST is tried again
+const WEBHOOK_RETRIES int = 3
+
+// How long to wait before trying a failed POST again, doubling each time
+const WEBHOOK_RETRY_PERIOD time.Duration = time.Second * 5
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The webhooks, nil if there are none
+var webhooks *Webhooks
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create the webhooks at urls for the comma-separated eventNames,
+// signing with the secret in secretFileName if it isn't empty
+func newWebhooks(urls []string, eventNames string, secretFileName string) (*Webhooks, error) {
+    webhooks := &Webhooks{Urls: urls, Events: make(map[string]bool)}
+
+    for _, url := range urls {
+        if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+            return nil, errors.New(fmt.Sprintf("\"%s\" is not an HTTP or HTTPS URL", url))
+        }
+    }
+    for _, name := range strings.Split(eventNames, ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            webhooks.Events[name] = true
+        }
+    }
+    if len(webhooks.Events) == 0 {
+        return nil, errors.New("no events for the webhooks")
+    }
+    if secretFileName != "" {
+        secret, err := os.ReadFile(secretFileName)
+        if err != nil {
+            return nil, err
+        }
+        webhooks.secret = []byte(strings.TrimSpace(string(secret)))
+        if len(webhooks.secret) < 16 {
+            return nil, errors.New(fmt.Sprintf("the webhook secret in \"%s\" must be at least 16 characters long", secretFileName))
+        }
+    }
+    webhooks.host, _ = os.Hostname()
+    log.Printf("Events %s will be POSTed to %d webhook(s).\n", eventNames, len(urls))
+
+    return webhooks, nil
+}
+
+// Return a line of text saying what an event means
+func webhookText(event *Event) string {
+    switch event.Name {
+        case EVENT_CLIENT_CONNECTED:
+            return fmt.Sprintf("A client has connected from %v.", event.Fields["address"])
+        case EVENT_CLIENT_DISCONNECTED:
+            return fmt.Sprintf("The client at %v has disconnected (%v).", event.Fields["address"], event.Fields["reason"])
+        case EVENT_RESET:
+            return fmt.Sprintf("The stream has been reset (%v).", event.Fields["reason"])
+        case EVENT_OUT_OF_SERVICE:
+            return "The chuffs have stopped: nothing has been heard from a client for a while."
+        case EVENT_IN_SERVICE:
+            return "The chuffs are back."
+        case EVENT_DISK_SPACE:
+            return fmt.Sprintf("The disk is filling up: only %.1f%% is free for %v.", event.Fields["freePercent"], event.Fields["path"])
+        case EVENT_STALLED:
+            return fmt.Sprintf("Processing of stream \"%v\" has stalled (%v).", event.Fields["stream"], event.Fields["reason"])
+        case EVENT_OUTPUT_FAILED:
+            return "The output stream has failed."
+    }
+
+    return fmt.Sprintf("Event %s.", event.Name)
+}
+
+// Return the body to POST for an event
+func (webhooks *Webhooks) body(event *Event) []byte {
+    data := map[string]interface{}{"event": event.Name, "time": event.Time.UTC().Format(time.RFC3339),
+                                   "host": webhooks.host, "text": webhookText(event)}
+    for key, value := range event.Fields {
+        if duration, ok := value.(time.Duration); ok {
+            value = int64(duration / time.Millisecond)
+        }
+        if _, ok := data[key]; !ok {
+            data[key] = value
+        }
+    }
+    encoded, _ := json.Marshal(data)
+
+    return encoded
+}
+
+// POST a body to a webhook, trying again if it fails
+func (webhooks *Webhooks) post(url string, body []byte) {
+    client := http.Client{Timeout: WEBHOOK_TIMEOUT}
+    retryPeriod := WEBHOOK_RETRY_PERIOD
+
+    for attempt := 0; ; attempt++ {
+        request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+        if err != nil {
+            log.Printf("Webhook \"%s\" failed (%s).\n", url, err.Error())
+            break
+        }
+        request.Header.Set("Content-Type", "application/json")
+        if webhooks.secret != nil {
+            timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+            mac := hmac.New(sha256.New, webhooks.secret)
+            mac.Write([]byte(timestamp + "."))
+            mac.Write(body)
+            request.Header.Set("X-Ioc-Timestamp", timestamp)
+            request.Header.Set("X-Ioc-Signature", "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+        }
+        response, err := client.Do(request)
+        if err == nil {
+            response.Body.Close()
+            if (response.StatusCode >= 200) && (response.StatusCode < 300) {
+                webhooks.locker.Lock()
+                webhooks.posted++
+                webhooks.locker.Unlock()
+                return
+            }
+            err = errors.New(response.Status)
+        }
+        if attempt >= WEBHOOK_RETRIES {
+            log.Printf("Webhook \"%s\" failed (%s), giving up.\n", url, err.Error())
+            break
+        }
+        log.Printf("Webhook \"%s\" failed (%s), trying again in %d s.\n", url, err.Error(), retryPeriod / time.Second)
+        time.Sleep(retryPeriod)
+        retryPeriod *= 2
+    }
+    webhooks.locker.Lock()
+    webhooks.failed++
+    webhooks.locker.Unlock()
+}
+
+// POST the events to the webhooks until ctx is done
+func (webhooks *Webhooks) Run(ctx context.Context) {
+    events := subscribeEvents(WEBHOOK_QUEUE_SIZE)
+    defer unsubscribeEvents(events)
+
+    for {
+        select {
+            case <-ctx.Done():
+                return
+            case event := <-events:
+                if webhooks.Events[event.Name] {
+                    body := webhooks.body(event)
+                    for _, url := range webhooks.Urls {
+                        go webhooks.post(url, body)
+                    }
+                }
+        }
+    }
+}
+
+// Return the statistics of the webhooks
+func (webhooks *Webhooks) Stats() interface{} {
+    webhooks.locker.Lock()
+    defer webhooks.locker.Unlock()
+
+    return WebhooksStats{Posted: webhooks.posted, Failed: webhooks.failed}
+}
+
+/* End Of File */
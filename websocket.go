@@ -0,0 +1,244 @@
+/* WebSocket server connections for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Just enough of WebSocket (RFC 6455) for the server to push messages
+// to a browser: the opening handshake, unmasked frames from the
+// server and, from the client, which is only expected to answer pings
+// and to close, masked frames that are read and thrown away.  Messages
+// are never fragmented and extensions (e.g. compression) aren't
+// offered.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// A WebSocket connection, server side
+type WebSocket struct {
+    connection  net.Conn
+    reader      *bufio.Reader
+    // Held while writing a frame, since control frames may be sent
+    // from the reading side
+    writeLocker sync.Mutex
+    closed      chan struct{}
+    closeOnce   sync.Once
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The GUID that is appended to the key of the client in the handshake
+const WEBSOCKET_GUID string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes
+const (
+    WEBSOCKET_OPCODE_TEXT   byte = 0x1
+    WEBSOCKET_OPCODE_BINARY byte = 0x2
+    WEBSOCKET_OPCODE_CLOSE  byte = 0x8
+    WEBSOCKET_OPCODE_PING   byte = 0x9
+    WEBSOCKET_OPCODE_PONG   byte = 0xa
+)
+
+// The largest payload of a control frame
+const WEBSOCKET_MAX_CONTROL_PAYLOAD uint64 = 125
+
+// How long a write to a WebSocket may take before the client is taken
+// to have gone
+const WEBSOCKET_WRITE_TIMEOUT time.Duration = time.Second * 5
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Return true if an HTTP request header, a comma separated list,
+// contains the given token (case insensitively)
+func headerHasToken(in *http.Request, header string, token string) bool {
+    for _, value := range strings.Split(in.Header.Get(header), ",") {
+        if strings.EqualFold(strings.TrimSpace(value), token) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Upgrade an HTTP request to a WebSocket; if this fails an HTTP error
+// has been sent
+func upgradeWebSocket(out http.ResponseWriter, in *http.Request) (*WebSocket, error) {
+    key := in.Header.Get("Sec-WebSocket-Key")
+    if (in.Method != http.MethodGet) || !headerHasToken(in, "Connection", "upgrade") ||
+       !headerHasToken(in, "Upgrade", "websocket") || (key == "") {
+        http.Error(out, "a WebSocket is required", http.StatusBadRequest)
+        return nil, errors.New("not a WebSocket request")
+    }
+    if in.Header.Get("Sec-WebSocket-Version") != "13" {
+        out.Header().Set("Sec-WebSocket-Version", "13")
+        http.Error(out, "unsupported WebSocket version", http.StatusUpgradeRequired)
+        return nil, errors.New("unsupported WebSocket version")
+    }
+    hijacker, ok := out.(http.Hijacker)
+    if !ok {
+        http.Error(out, "", http.StatusInternalServerError)
+        return nil, errors.New("the connection can't be taken over")
+    }
+    connection, readWriter, err := hijacker.Hijack()
+    if err != nil {
+        return nil, err
+    }
+    hash := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+    response := "HTTP/1.1 101 Switching Protocols\r\n" +
+                "Upgrade: websocket\r\n" +
+                "Connection: Upgrade\r\n" +
+                "Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n"
+    connection.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+    _, err = connection.Write([]byte(response))
+    if err != nil {
+        connection.Close()
+        return nil, err
+    }
+    socket := &WebSocket{connection: connection, reader: readWriter.Reader, closed: make(chan struct{})}
+    go socket.read()
+
+    return socket, nil
+}
+
+// Write a frame
+func (socket *WebSocket) writeFrame(opcode byte, payload []byte) error {
+    var header []byte
+
+    header = append(header, 0x80 | opcode)
+    length := len(payload)
+    switch {
+        case length < 126:
+            header = append(header, byte(length))
+        case length <= 0xffff:
+            header = append(header, 126, byte(length >> 8), byte(length))
+        default:
+            header = append(header, 127)
+            header = append(header, make([]byte, 8)...)
+            binary.BigEndian.PutUint64(header[2:], uint64(length))
+    }
+
+    socket.writeLocker.Lock()
+    defer socket.writeLocker.Unlock()
+    socket.connection.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+    _, err := socket.connection.Write(append(header, payload...))
+    if err != nil {
+        socket.Close()
+    }
+
+    return err
+}
+
+// Send a text message
+func (socket *WebSocket) WriteText(text string) error {
+    return socket.writeFrame(WEBSOCKET_OPCODE_TEXT, []byte(text))
+}
+
+// Send a binary message
+func (socket *WebSocket) WriteBinary(data []byte) error {
+    return socket.writeFrame(WEBSOCKET_OPCODE_BINARY, data)
+}
+
+// Read frames from the client until it closes, answering pings and
+// throwing everything else away
+func (socket *WebSocket) read() {
+    defer socket.Close()
+
+    for {
+        var header [2]byte
+        _, err := io.ReadFull(socket.reader, header[:])
+        if err != nil {
+            return
+        }
+        opcode := header[0] & 0x0f
+        masked := header[1] & 0x80 != 0
+        length := uint64(header[1] & 0x7f)
+        switch length {
+            case 126:
+                var extended [2]byte
+                _, err = io.ReadFull(socket.reader, extended[:])
+                length = uint64(binary.BigEndian.Uint16(extended[:]))
+            case 127:
+                var extended [8]byte
+                _, err = io.ReadFull(socket.reader, extended[:])
+                length = binary.BigEndian.Uint64(extended[:])
+        }
+        if (err != nil) || !masked {
+            // Frames from the client must be masked
+            return
+        }
+        var mask [4]byte
+        _, err = io.ReadFull(socket.reader, mask[:])
+        if err != nil {
+            return
+        }
+        if opcode & 0x08 != 0 {
+            // A control frame, which is short
+            if length > WEBSOCKET_MAX_CONTROL_PAYLOAD {
+                return
+            }
+            payload := make([]byte, length)
+            _, err = io.ReadFull(socket.reader, payload)
+            if err != nil {
+                return
+            }
+            for x := range payload {
+                payload[x] ^= mask[x % 4]
+            }
+            switch opcode {
+                case WEBSOCKET_OPCODE_CLOSE:
+                    socket.writeFrame(WEBSOCKET_OPCODE_CLOSE, nil)
+                    return
+                case WEBSOCKET_OPCODE_PING:
+                    socket.writeFrame(WEBSOCKET_OPCODE_PONG, payload)
+            }
+        } else {
+            _, err = io.CopyN(ioutil.Discard, socket.reader, int64(length))
+            if err != nil {
+                return
+            }
+        }
+    }
+}
+
+// Return a channel that is closed once the WebSocket has closed
+func (socket *WebSocket) Closed() <-chan struct{} {
+    return socket.closed
+}
+
+// Close a WebSocket
+func (socket *WebSocket) Close() {
+    socket.closeOnce.Do(func() {
+        close(socket.closed)
+        socket.connection.Close()
+    })
+}
+
+/* End Of File */
@@ -0,0 +1,321 @@
+/* WebRTC (WHEP) output for the Internet of Chuffs server.
+ *
+ * Copyright (C) u-blox Melbourn Ltd
+ * u-blox Melbourn Ltd, Melbourn, UK
+ *
+ * All rights reserved.
+ *
+ * This source file is the sole property of u-blox Melbourn Ltd.
+ * Reproduction or utilization of this source in whole or part is
+ * forbidden without the written consent of u-blox Melbourn Ltd.
+ */
+
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media"
+    "gopkg.in/hraban/opus.v2"
+)
+
+// For listeners who want less than a second of latency the WebRTC
+// output (see --whep) plays the stream straight into a browser over
+// WebRTC, HLS remaining the path that scales.  Signalling is WHEP
+// (WebRTC-HTTP Egress Protocol): the player POSTs an SDP offer to
+// WHEP_PATH and gets back, in a 201, the SDP answer, with all the ICE
+// candidates of the server in it, and in the Location header the URL
+// of the session, to which it sends a DELETE when it is done.  The
+// audio is encoded once, as Opus in WHEP_FRAME_MS packets, by an
+// encoder of its own, and written to a single track that every
+// session shares; the encoder only runs while there is a session.
+// A session whose connection fails or closes is forgotten.
+
+//--------------------------------------------------------------------
+// Types
+//--------------------------------------------------------------------
+
+// State of the WebRTC output
+type Whep struct {
+    configuration webrtc.Configuration
+    track         *webrtc.TrackLocalStaticSample
+    encoder       *opus.Encoder
+    scale         float32
+    // Samples waiting to make up a frame, interleaved
+    pcm           []int16
+    locker        sync.Mutex
+    sessions      map[string]*webrtc.PeerConnection
+    started       int
+    failed        int
+}
+
+// Statistics of the WebRTC output
+type WhepStats struct {
+    Sessions  int  `json:"sessions"`
+    Started   int  `json:"started"`
+    Failed    int  `json:"failed"`
+}
+
+//--------------------------------------------------------------------
+// Constants
+//--------------------------------------------------------------------
+
+// The path to which WHEP offers are POSTed, sessions being at
+// WHEP_PATH + "/" + <id>
+const WHEP_PATH string = "/whep"
+
+// The duration of an Opus packet
+const WHEP_FRAME_MS int = 20
+
+// The most sessions there may be at once
+const WHEP_MAX_SESSIONS int = 20
+
+// The longest SDP offer that will be read
+const WHEP_MAX_OFFER_SIZE int64 = 64 * 1024
+
+// How long to wait for the ICE candidates of the server to be gathered
+const WHEP_GATHER_TIMEOUT time.Duration = time.Second * 5
+
+//--------------------------------------------------------------------
+// Variables
+//--------------------------------------------------------------------
+
+// The WebRTC output, nil if there isn't one
+var whep *Whep
+
+//--------------------------------------------------------------------
+// Functions
+//--------------------------------------------------------------------
+
+// Create the WebRTC output, encoding Opus with the given settings and
+// using the given STUN servers, e.g. stun:stun.l.google.com:19302, to
+// find the public address of the server
+func newWhep(settings Mp3Settings, stunServers []string) (*Whep, error) {
+    var err error
+
+    if !opusSamplingFrequency(streamSamplingFrequency) {
+        return nil, errors.New("Opus needs a sampling frequency of 8000, 12000, 16000, 24000 or 48000 Hz")
+    }
+    output := &Whep{scale: settings.Scale, sessions: make(map[string]*webrtc.PeerConnection)}
+    if output.scale == 0 {
+        output.scale = MP3_DEFAULT_SCALE
+    }
+    if len(stunServers) > 0 {
+        output.configuration.ICEServers = []webrtc.ICEServer{{URLs: stunServers}}
+    }
+    output.encoder, err = opus.NewEncoder(streamSamplingFrequency, streamChannels, opus.AppAudio)
+    if err != nil {
+        return nil, err
+    }
+    if settings.Bitrate != 0 {
+        err = output.encoder.SetBitrate(settings.Bitrate * 1000)
+        if err != nil {
+            return nil, err
+        }
+    }
+    // The RTP clock of Opus is always 48 kHz and it is always described
+    // as two channels, whatever is inside
+    output.track, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus,
+                                                                                   ClockRate: 48000, Channels: 2},
+                                                         "audio", "chuffs")
+    if err != nil {
+        return nil, err
+    }
+    log.Printf("WebRTC output will be served through WHEP at %s.\n", WHEP_PATH)
+
+    return output, nil
+}
+
+// Encode some little-endian 16-bit PCM and send it to the sessions
+func (output *Whep) Write(pcm []byte) {
+    output.locker.Lock()
+    defer output.locker.Unlock()
+
+    if len(output.sessions) == 0 {
+        output.pcm = output.pcm[:0]
+        return
+    }
+    output.pcm = appendScaledPcm(output.pcm, pcm, output.scale)
+    frameSamples := streamSamplingFrequency * WHEP_FRAME_MS / 1000 * streamChannels
+    for len(output.pcm) >= frameSamples {
+        packet := make([]byte, OPUS_MAX_PACKET_SIZE)
+        length, err := output.encoder.Encode(output.pcm[:frameSamples], packet)
+        output.pcm = append(output.pcm[:0], output.pcm[frameSamples:]...)
+        if err != nil {
+            log.Printf("Unable to encode WebRTC audio (%s).\n", err.Error())
+            continue
+        }
+        err = output.track.WriteSample(media.Sample{Data: packet[:length],
+                                                    Duration: time.Duration(WHEP_FRAME_MS) * time.Millisecond})
+        if err != nil {
+            log.Printf("Unable to write WebRTC audio (%s).\n", err.Error())
+        }
+    }
+}
+
+// Return a new session ID
+func newWhepSessionId() string {
+    id := make([]byte, 16)
+    rand.Read(id)
+
+    return hex.EncodeToString(id)
+}
+
+// Start a session for an SDP offer, returning its ID and the SDP
+// answer
+func (output *Whep) start(offer string) (string, string, error) {
+    output.locker.Lock()
+    full := len(output.sessions) >= WHEP_MAX_SESSIONS
+    output.locker.Unlock()
+    if full {
+        return "", "", errors.New("too many sessions")
+    }
+
+    connection, err := webrtc.NewPeerConnection(output.configuration)
+    if err != nil {
+        return "", "", err
+    }
+    sender, err := connection.AddTrack(output.track)
+    if err == nil {
+        // RTCP has to be read for the interceptors to work
+        go func() {
+            buffer := make([]byte, 1500)
+            for {
+                if _, _, err := sender.Read(buffer); err != nil {
+                    return
+                }
+            }
+        }()
+        err = connection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+    }
+    var answer webrtc.SessionDescription
+    if err == nil {
+        answer, err = connection.CreateAnswer(nil)
+    }
+    if err == nil {
+        // No trickle ICE: the answer carries all the candidates
+        gathered := webrtc.GatheringCompletePromise(connection)
+        err = connection.SetLocalDescription(answer)
+        if err == nil {
+            select {
+                case <-gathered:
+                case <-time.After(WHEP_GATHER_TIMEOUT):
+                    log.Printf("Not all ICE candidates gathered within %d second(s), answering anyway.\n",
+                               WHEP_GATHER_TIMEOUT / time.Second)
+            }
+        }
+    }
+    if err != nil {
+        connection.Close()
+        output.locker.Lock()
+        output.failed++
+        output.locker.Unlock()
+        return "", "", err
+    }
+
+    id := newWhepSessionId()
+    connection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+        log.Printf("WebRTC session %s is %s.\n", id, state.String())
+        if (state == webrtc.PeerConnectionStateFailed) || (state == webrtc.PeerConnectionStateClosed) {
+            output.stop(id)
+        }
+    })
+    output.locker.Lock()
+    output.sessions[id] = connection
+    output.started++
+    output.locker.Unlock()
+
+    return id, connection.LocalDescription().SDP, nil
+}
+
+// Stop a session, returning false if there is no such session
+func (output *Whep) stop(id string) bool {
+    output.locker.Lock()
+    connection := output.sessions[id]
+    delete(output.sessions, id)
+    output.locker.Unlock()
+    if connection == nil {
+        return false
+    }
+    connection.Close()
+
+    return true
+}
+
+// Stop all the sessions; the WebRTC output may not be written to again
+func (output *Whep) Close() {
+    output.locker.Lock()
+    var ids []string
+    for id := range output.sessions {
+        ids = append(ids, id)
+    }
+    output.locker.Unlock()
+    for _, id := range ids {
+        output.stop(id)
+    }
+}
+
+// Handle a WHEP request: a POST of an offer to WHEP_PATH or a DELETE
+// of a session
+func whepHandler(out http.ResponseWriter, in *http.Request) {
+    if whep == nil {
+        http.NotFound(out, in)
+        return
+    }
+    out.Header().Set("Access-Control-Expose-Headers", "Location")
+    if in.URL.Path == WHEP_PATH {
+        if in.Method != http.MethodPost {
+            http.Error(out, "", http.StatusMethodNotAllowed)
+            return
+        }
+        if !strings.HasPrefix(in.Header.Get("Content-Type"), "application/sdp") {
+            http.Error(out, "the offer must be application/sdp", http.StatusUnsupportedMediaType)
+            return
+        }
+        offer, err := ioutil.ReadAll(http.MaxBytesReader(out, in.Body, WHEP_MAX_OFFER_SIZE))
+        if err != nil {
+            http.Error(out, err.Error(), http.StatusBadRequest)
+            return
+        }
+        id, answer, err := whep.start(string(offer))
+        if err != nil {
+            log.Printf("Unable to start WebRTC session for %s (%s).\n", in.RemoteAddr, err.Error())
+            http.Error(out, err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+        log.Printf("WebRTC session %s started for %s.\n", id, in.RemoteAddr)
+        out.Header().Set("Content-Type", "application/sdp")
+        out.Header().Set("Location", signUri(WHEP_PATH + "/" + id, signedQuery(in, urlSecret)))
+        out.WriteHeader(http.StatusCreated)
+        fmt.Fprint(out, answer)
+    } else {
+        if in.Method != http.MethodDelete {
+            http.Error(out, "", http.StatusMethodNotAllowed)
+            return
+        }
+        if !whep.stop(strings.TrimPrefix(in.URL.Path, WHEP_PATH + "/")) {
+            http.NotFound(out, in)
+            return
+        }
+        out.WriteHeader(http.StatusOK)
+    }
+}
+
+// Return the statistics of the WebRTC output
+func (output *Whep) Stats() interface{} {
+    output.locker.Lock()
+    defer output.locker.Unlock()
+
+    return WhepStats{Sessions: len(output.sessions), Started: output.started, Failed: output.failed}
+}
+
+/* End Of File */